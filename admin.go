@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"vault-warden/client"
+)
+
+// --- Admin Socket ---
+
+const defaultAdminSocket = "/run/vault-warden/admin.sock"
+
+// AdminConfig sets where a running `audit` process listens for local
+// control commands, and optionally for remote ones over TCP.
+type AdminConfig struct {
+	Socket string `yaml:"socket"`
+	// Listen is a TCP address, e.g. 127.0.0.1:8201, serving the same API
+	// to clients that send Token as a bearer token. It is plain HTTP, so
+	// keep it on loopback or behind a TLS proxy.
+	Listen string `yaml:"listen"`
+	Token  string `yaml:"token"`
+}
+
+// minAdminTokenLen keeps admin.token from being guessable.
+const minAdminTokenLen = 16
+
+// adminComponent serves mux on the admin unix socket. The socket is
+// owner-only; anyone who can reach it can control the warden. Monitoring
+// carries on without it, so a failure only stops the socket.
+func adminComponent(cfg *VaultConfig, mux *http.ServeMux) componentSpec {
+	return componentSpec{name: "admin-socket", policy: policyIgnore, run: func(ctx context.Context) error {
+		path := cfg.Admin.Socket
+		if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+			return fmt.Errorf("create admin socket dir: %w", err)
+		}
+		// A socket left behind by a crashed process blocks Listen.
+		if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return fmt.Errorf("listen on admin socket: %w", err)
+		}
+		defer os.Remove(path)
+		if err := os.Chmod(path, 0o600); err != nil {
+			l.Close()
+			return fmt.Errorf("chmod admin socket: %w", err)
+		}
+		return serveAdmin(ctx, l, mux, "admin socket")
+	}}
+}
+
+// adminTCPComponent serves mux on admin.listen to holders of the token.
+func adminTCPComponent(cfg *VaultConfig, mux *http.ServeMux) componentSpec {
+	return componentSpec{name: "admin-tcp", policy: policyIgnore, run: func(ctx context.Context) error {
+		l, err := net.Listen("tcp", cfg.Admin.Listen)
+		if err != nil {
+			return fmt.Errorf("listen on admin address: %w", err)
+		}
+		return serveAdmin(ctx, l, requireToken(cfg.Admin.Token, mux), "admin address")
+	}}
+}
+
+func serveAdmin(ctx context.Context, l net.Listener, h http.Handler, what string) error {
+	srv := &http.Server{Handler: h, ReadHeaderTimeout: 5 * time.Second}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+	select {
+	case err := <-served:
+		return fmt.Errorf("serve %s: %w", what, err)
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(shutdownCtx)
+	return nil
+}
+
+// requireToken rejects requests without the bearer token.
+func requireToken(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			metrics.inc("admin_unauthorized_total")
+			http.Error(w, "missing or wrong token", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// adminClient is a client for the admin socket of a running warden.
+func adminClient(cfg *VaultConfig) *client.Client {
+	return client.NewUnix(cfg.Admin.Socket)
+}
+
+// validateAdmin checks the admin settings and fills in their defaults.
+func validateAdmin(cfg *VaultConfig) error {
+	ad := &cfg.Admin
+	if ad.Socket == "" {
+		ad.Socket = defaultAdminSocket
+	}
+	if ad.Listen == "" {
+		if ad.Token != "" {
+			return &fieldError{"admin.token", "is only used with admin.listen"}
+		}
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(ad.Listen); err != nil {
+		return &fieldError{"admin.listen", "must be host:port, e.g. 127.0.0.1:8201"}
+	}
+	if len(ad.Token) < minAdminTokenLen {
+		return &fieldError{"admin.token", fmt.Sprintf("is required with admin.listen, at least %d characters", minAdminTokenLen)}
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// rulesHandler lists the configured rules, then the built-in ones.
+func rulesHandler(cfg *VaultConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := live(cfg)
+		rules := make([]client.Rule, 0, len(cfg.Rules)+len(builtinRules))
+		for _, ru := range cfg.Rules {
+			rules = append(rules, client.Rule{Name: ru.Name, Paths: ru.Paths, PathRegex: ru.PathRegex, Operations: ru.Operations,
+				Severity: ru.Severity, Title: ru.Title, When: ru.When})
+		}
+		for _, name := range builtinRules {
+			rules = append(rules, client.Rule{Name: name, Builtin: true})
+		}
+		writeJSON(w, rules)
+	}
+}
+
+const (
+	defaultHistoryPage = 100
+	maxHistoryPage     = 1000
+)
+
+// historyHandler serves the history file a page at a time. The cursor is
+// the line to go on from, so it stays valid as records are appended; a
+// maintenance rewrite of the file can make a page skip or repeat records.
+func historyHandler(cfg *VaultConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfg.HistoryFile == "" {
+			http.Error(w, "history_file is not configured", http.StatusNotFound)
+			return
+		}
+		q := r.URL.Query()
+		from, limit := 0, defaultHistoryPage
+		var since time.Time
+		var err error
+		if c := q.Get("cursor"); c != "" {
+			if from, err = strconv.Atoi(c); err != nil || from < 0 {
+				http.Error(w, "bad cursor", http.StatusBadRequest)
+				return
+			}
+		}
+		if l := q.Get("limit"); l != "" {
+			if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > maxHistoryPage {
+				http.Error(w, fmt.Sprintf("limit must be 1 to %d", maxHistoryPage), http.StatusBadRequest)
+				return
+			}
+		}
+		if s := q.Get("since"); s != "" {
+			if since, err = time.Parse(time.RFC3339, s); err != nil {
+				http.Error(w, "since must be RFC 3339", http.StatusBadRequest)
+				return
+			}
+		}
+		rule, requestID := q.Get("rule"), q.Get("request_id")
+
+		page := client.HistoryPage{Records: []client.HistoryRecord{}}
+		errFull := errors.New("page full")
+		err = readHistory(cfg.HistoryFile, func(lineNo int, rec *historyRecord) error {
+			if lineNo <= from {
+				return nil
+			}
+			if len(page.Records) == limit {
+				page.Next = strconv.Itoa(lineNo - 1)
+				return errFull
+			}
+			hr := client.HistoryRecord{Time: rec.Time, Backend: rec.Backend, Title: rec.Title, Severity: rec.Severity,
+				Environment: rec.Environment, RequestID: rec.RequestID, Delivered: rec.Delivered, Error: rec.Error}
+			if a := rec.Alert; a != nil {
+				hr.AlertID, hr.Rule = a.ID, a.Rule
+			}
+			if rec.Time.Before(since) || rule != "" && hr.Rule != rule || requestID != "" && hr.RequestID != requestID {
+				return nil
+			}
+			page.Records = append(page.Records, hr)
+			return nil
+		})
+		if err != nil && !errors.Is(err, errFull) && !errors.Is(err, os.ErrNotExist) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, page)
+	}
+}
+
+var (
+	msgTestNotification     = message("test-notification.title")
+	msgTestNotificationBody = message("test-notification.body")
+)
+
+// testNotificationHandler raises an info alert, to check delivery end to
+// end from wherever the warden runs.
+func testNotificationHandler(cfg *VaultConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		a := Alert{ID: newAlertID(), Severity: sevInfo, Color: sevInfo.color(),
+			Rule: "test-notification"}.say(msgTestNotification.with(), msgTestNotificationBody.with())
+		if err := notify(cfg, a); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, client.TestNotificationResult{AlertID: a.ID, Notifier: notifierFor(live(cfg)).kind()})
+	}
+}
+
+// wardenStatus is the /statusz document.
+type wardenStatus struct {
+	Version string `json:"version"`
+	Mode    string `json:"mode"`
+	// SafeMode is why audit mode runs in safe mode or was forced active.
+	SafeMode *safeModeDecision `json:"safe_mode,omitempty"`
+	Intake   intakeStatus      `json:"intake"`
+	Queue    map[string]int    `json:"queue,omitempty"`
+	Held     map[string]int    `json:"quiet_hours_held,omitempty"` // by destination
+	Jobs     []jobStatus       `json:"jobs"`
+
+	Components  []componentStatus  `json:"components,omitempty"`
+	Watchdogs   []watchdogStatus   `json:"watchdogs,omitempty"`
+	AuditFile   *auditFileStatus   `json:"audit_file,omitempty"`
+	AuditFiles  []auditTailStatus  `json:"audit_files,omitempty"`
+	AuditSocket *auditSocketStatus `json:"audit_socket,omitempty"`
+	AuditSyslog *auditSyslogStatus `json:"audit_syslog,omitempty"`
+	Canary      *canaryStatus      `json:"canary,omitempty"`
+	Memory      *memoryStatus      `json:"memory,omitempty"`
+
+	FirstAccess *firstAccessStatus            `json:"first_access,omitempty"`
+	VaultNodes  map[string]*vaultCapabilities `json:"vault_nodes,omitempty"`
+	Clusters    []clusterHealth               `json:"clusters,omitempty"`
+	Posture     []postureResult               `json:"posture,omitempty"`
+	Plugins     []pluginStatus                `json:"plugins,omitempty"`
+	Edges       []peerStatus                  `json:"edges,omitempty"`
+}
+
+func statuszHandler(gate *intakeGate, sched *scheduler, sup *supervisor, fa *firstAccessDetector, watch *watchEngine, recv *auditReceiver, auditFile *auditFileMonitor, tails *auditTails, sock *auditSocket, sl *auditSyslog, store *stateStore, plugins []*detectorPlugin, canary *canaryProbe, mem *memoryGuard, dogs ...*watchdog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st := wardenStatus{
+			Version:     version,
+			Mode:        mode.String(),
+			SafeMode:    safeMode,
+			Intake:      gate.status(),
+			Jobs:        sched.snapshot(),
+			Components:  sup.snapshot(),
+			AuditFile:   auditFile.status(),
+			AuditFiles:  tails.status(),
+			AuditSocket: sock.status(),
+			AuditSyslog: sl.status(),
+			Canary:      canary.status(),
+			Memory:      mem.status(),
+
+			FirstAccess: fa.status(),
+			Clusters:    watch.status(),
+			Posture:     watch.postureStatus(),
+			Plugins:     pluginStatuses(plugins),
+			Edges:       recv.status(),
+		}
+		if q := queue; q != nil {
+			st.Queue = q.depths()
+		}
+		st.Held = quiet.status()
+		for _, dog := range dogs {
+			if ds := dog.status(); ds != nil {
+				st.Watchdogs = append(st.Watchdogs, *ds)
+			}
+		}
+		if saved, err := store.load(); err == nil {
+			st.VaultNodes = saved.VaultNodes
+		}
+		writeJSON(w, st)
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"vault-warden/client"
+)
+
+const adminTestRules = `rules:
+  - name: root-policy
+    paths: ["sys/policies/acl/root"]
+    operations: [update]
+    severity: critical
+`
+
+// adminServer is an audit process's admin API, in process: the config at
+// path, served on its admin socket and on a TCP listener with a token.
+type adminServer struct {
+	cfg    *VaultConfig
+	path   string
+	tcp    string
+	token  string
+	reload *configReloader
+}
+
+func startAdminServer(t *testing.T, body string) *adminServer {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	body += "admin:\n  socket: " + filepath.Join(dir, "admin.sock") + "\n"
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := loadConfig(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := doc.config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &adminServer{cfg: cfg, path: path, token: "admin-token-0123456789"}
+	t.Cleanup(func() { liveConfig.Store((*VaultConfig)(nil)) })
+	captureAlerts(t)
+	mode.setStandby(false)
+	t.Cleanup(func() { mode.setStandby(false) })
+
+	mux := http.NewServeMux()
+	modeHandlers(cfg, mux)
+	mux.HandleFunc("/statusz", statuszHandler(newIntakeGate(cfg), newScheduler(), newSupervisor(), nil, nil, nil, nil, nil, nil, nil, newStateStore(""), nil, nil, nil))
+	mux.HandleFunc("/rules", rulesHandler(cfg))
+	mux.HandleFunc("/history", historyHandler(cfg))
+	mux.HandleFunc("/test-notification", testNotificationHandler(cfg))
+	s.reload = newConfigReloader(doc, cfg, nil, nil)
+	t.Cleanup(s.reload.stop)
+	mux.HandleFunc("/reload", reloadHandler(s.reload))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.tcp = l.Addr().String()
+	done := make(chan struct{}, 3)
+	for _, run := range []func() error{
+		func() error { return adminComponent(cfg, mux).run(ctx) },
+		func() error { return serveAdmin(ctx, l, requireToken(s.token, mux), "admin address") },
+		func() error { return s.reload.run(ctx) },
+	} {
+		run := run
+		go func() {
+			if err := run(); err != nil {
+				t.Error(err)
+			}
+			done <- struct{}{}
+		}()
+	}
+	t.Cleanup(func() {
+		cancel()
+		for i := 0; i < 3; i++ {
+			<-done
+		}
+	})
+	waitFor(t, "the admin socket", func() bool {
+		_, err := os.Stat(cfg.Admin.Socket)
+		return err == nil
+	})
+	return s
+}
+
+func (s *adminServer) clients() map[string]*client.Client {
+	return map[string]*client.Client{"unix": adminClient(s.cfg), "tcp": client.NewTCP(s.tcp, s.token)}
+}
+
+func TestAdminClientStatusAndMode(t *testing.T) {
+	s := startAdminServer(t, envTestBase+adminTestRules)
+	for name, c := range s.clients() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			st, err := c.Status(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if st.Version != version || !strings.HasPrefix(st.Mode, "active since") || !json.Valid(st.Raw) {
+				t.Errorf("status = %+v", st)
+			}
+			if out, err := c.Promote(ctx); err != nil || out != "already active" {
+				t.Errorf("Promote = %q, %v; want already active", out, err)
+			}
+			if out, err := c.Demote(ctx); err != nil || !strings.HasPrefix(out, "standby since") {
+				t.Errorf("Demote = %q, %v; want standby", out, err)
+			}
+			if out, err := c.Mode(ctx); err != nil || !strings.HasPrefix(out, "standby since") {
+				t.Errorf("Mode = %q, %v; want standby", out, err)
+			}
+			if out, err := c.Promote(ctx); err != nil || !strings.HasPrefix(out, "active since") {
+				t.Errorf("Promote = %q, %v; want active", out, err)
+			}
+		})
+	}
+}
+
+func TestAdminClientRules(t *testing.T) {
+	s := startAdminServer(t, envTestBase+adminTestRules)
+	rules, err := adminClient(s.cfg).Rules(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 1+len(builtinRules) {
+		t.Fatalf("%d rules, want root-policy and the built-in ones", len(rules))
+	}
+	if r := rules[0]; r.Name != "root-policy" || r.Builtin || r.Severity != "critical" || r.Paths[0] != "sys/policies/acl/root" ||
+		r.Operations[0] != "update" || r.Title != "🚨 Rule matched: root-policy" {
+		t.Errorf("rules[0] = %+v", r)
+	}
+	if r := rules[1]; r.Name != builtinRules[0] || !r.Builtin {
+		t.Errorf("rules[1] = %+v, want the first built-in rule", r)
+	}
+}
+
+func TestAdminClientTestNotification(t *testing.T) {
+	s := startAdminServer(t, envTestBase)
+	sent := captureAlerts(t)
+	res, err := client.NewTCP(s.tcp, s.token).TestNotification(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	alerts := sent()
+	if len(alerts) != 1 || alerts[0].ID != res.AlertID || alerts[0].Rule != "test-notification" || res.Notifier != "discord" {
+		t.Errorf("result = %+v, alerts = %+v; want one test alert with its ID", res, alerts)
+	}
+}
+
+func TestAdminClientToken(t *testing.T) {
+	s := startAdminServer(t, envTestBase)
+	before := metrics.sum("admin_unauthorized_total")
+	for _, token := range []string{"", "admin-token-012345678", "admin-token-0123456789x"} {
+		_, err := client.NewTCP(s.tcp, token).Mode(context.Background())
+		var e *client.Error
+		if !errors.As(err, &e) || e.Status != http.StatusUnauthorized {
+			t.Errorf("token %q: err = %v, want a 401", token, err)
+		}
+	}
+	if d := metrics.sum("admin_unauthorized_total") - before; d != 3 {
+		t.Errorf("admin_unauthorized_total grew by %v, want 3: a 401 isn't retried", d)
+	}
+}
+
+func writeHistoryRecords(t *testing.T, path string, n int) {
+	t.Helper()
+	var data []byte
+	start := time.Date(2026, 10, 14, 8, 0, 0, 0, time.UTC)
+	for i := 1; i <= n; i++ {
+		rule := "root-policy"
+		if i%2 == 0 {
+			rule = "unseal"
+		}
+		rec := historyRecord{Time: start.Add(time.Duration(i) * time.Minute), Backend: "discord", Title: fmt.Sprintf("alert %d", i),
+			Severity: "critical", RequestID: fmt.Sprintf("r-%d", i), Delivered: i != 3,
+			Alert: &Alert{ID: fmt.Sprintf("a-%d", i), Rule: rule}}
+		if i == 3 {
+			rec.Error = "discord returned 502"
+		}
+		line, err := json.Marshal(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(append(data, line...), '\n')
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdminClientHistory(t *testing.T) {
+	historyFile := filepath.Join(t.TempDir(), "history.jsonl")
+	writeHistoryRecords(t, historyFile, 7)
+	s := startAdminServer(t, envTestBase+"history_file: "+historyFile+"\n")
+	c := adminClient(s.cfg)
+	ctx := context.Background()
+
+	p, err := c.History(ctx, client.HistoryQuery{Limit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Records) != 3 || p.Next != "3" {
+		t.Fatalf("first page = %d records, next %q; want 3 and a cursor", len(p.Records), p.Next)
+	}
+	if r := p.Records[2]; r.Title != "alert 3" || r.AlertID != "a-3" || r.Rule != "root-policy" || r.RequestID != "r-3" || r.Delivered ||
+		r.Error != "discord returned 502" || r.Backend != "discord" || r.Severity != "critical" {
+		t.Errorf("record 3 = %+v", r)
+	}
+
+	// A record appended between pages comes on a later page, and none
+	// shifts.
+	var titles []string
+	pages := 0
+	err = c.EachHistory(ctx, client.HistoryQuery{Limit: 3}, func(r client.HistoryRecord) error {
+		titles = append(titles, strings.TrimPrefix(r.Title, "alert "))
+		if len(titles) == 1 {
+			writeHistoryRecords(t, historyFile, 8)
+		}
+		if len(titles)%3 == 1 {
+			pages++
+		}
+		return nil
+	})
+	if err != nil || strings.Join(titles, " ") != "1 2 3 4 5 6 7 8" || pages != 3 {
+		t.Errorf("titles = %q over %d pages, %v; want 1 to 8 over 3", titles, pages, err)
+	}
+
+	tests := []struct {
+		q    client.HistoryQuery
+		want string
+	}{
+		{client.HistoryQuery{Rule: "unseal"}, "2 4 6 8"},
+		{client.HistoryQuery{RequestID: "r-5"}, "5"},
+		{client.HistoryQuery{Since: time.Date(2026, 10, 14, 8, 6, 0, 0, time.UTC)}, "6 7 8"},
+		{client.HistoryQuery{Rule: "root-policy", Limit: 1}, "1 3 5 7"},
+		{client.HistoryQuery{Rule: "nope"}, ""},
+	}
+	for _, tt := range tests {
+		var got []string
+		if err := c.EachHistory(ctx, tt.q, func(r client.HistoryRecord) error {
+			got = append(got, strings.TrimPrefix(r.Title, "alert "))
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(got, " ") != tt.want {
+			t.Errorf("%+v: %q, want %q", tt.q, got, tt.want)
+		}
+	}
+
+	for _, q := range []client.HistoryQuery{{Limit: maxHistoryPage + 1}, {Cursor: "-1"}, {Cursor: "x"}} {
+		var e *client.Error
+		if _, err := c.History(ctx, q); !errors.As(err, &e) || e.Status != http.StatusBadRequest {
+			t.Errorf("%+v: err = %v, want a 400", q, err)
+		}
+	}
+}
+
+func TestAdminClientHistoryUnconfigured(t *testing.T) {
+	s := startAdminServer(t, envTestBase)
+	if _, err := adminClient(s.cfg).History(context.Background(), client.HistoryQuery{}); !client.IsNotFound(err) {
+		t.Errorf("err = %v, want not found", err)
+	}
+
+	historyFile := filepath.Join(t.TempDir(), "history.jsonl")
+	s = startAdminServer(t, envTestBase+"history_file: "+historyFile+"\n")
+	p, err := adminClient(s.cfg).History(context.Background(), client.HistoryQuery{})
+	if err != nil || len(p.Records) != 0 || p.Next != "" {
+		t.Errorf("history before the first alert = %+v, %v; want an empty page", p, err)
+	}
+}
+
+func TestAdminClientReload(t *testing.T) {
+	s := startAdminServer(t, envTestBase+adminTestRules)
+	c := client.NewTCP(s.tcp, s.token)
+	ctx := context.Background()
+
+	res, err := c.Reload(ctx, false)
+	if err != nil || !res.Applied || len(res.Changed) != 0 || res.Canary != nil {
+		t.Fatalf("reload = %+v, %v; want applied with nothing changed", res, err)
+	}
+
+	body, _ := os.ReadFile(s.path)
+	changed := strings.Replace(string(body), "severity: critical", "severity: warning", 1)
+	if err := os.WriteFile(s.path, []byte(changed), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if res, err = c.Reload(ctx, false); err != nil || !res.Applied || strings.Join(res.Changed, ",") != "rules" {
+		t.Fatalf("reload = %+v, %v; want rules changed", res, err)
+	}
+	rules, err := c.Rules(ctx)
+	if err != nil || rules[0].Severity != "warning" {
+		t.Errorf("rules after the reload = %+v, %v; want the new severity", rules, err)
+	}
+
+	if err := os.WriteFile(s.path, []byte(changed+"rules: [\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Reload(ctx, false)
+	var e *client.Error
+	if !errors.As(err, &e) || e.Status != http.StatusUnprocessableEntity || !strings.Contains(e.Message, "config reload failed") {
+		t.Errorf("err = %v, want the failed reload", err)
+	}
+}
+
+// The CLI commands go through the same client to the running warden.
+func TestAdminCommands(t *testing.T) {
+	s := startAdminServer(t, envTestBase+adminTestRules)
+	if err := runModeCommand(s.cfg, "demote"); err != nil {
+		t.Fatal(err)
+	}
+	if out, _ := adminClient(s.cfg).Mode(context.Background()); !strings.HasPrefix(out, "standby") {
+		t.Errorf("mode after demote = %q", out)
+	}
+	if err := runModeCommand(s.cfg, "promote"); err != nil {
+		t.Fatal(err)
+	}
+	if err := runReloadCommand(s.cfg, nil); err != nil {
+		t.Errorf("reload: %v", err)
+	}
+
+	s.cfg.Admin.Socket = filepath.Join(t.TempDir(), "nobody.sock")
+	err := runModeCommand(s.cfg, "promote")
+	if err == nil || !strings.Contains(err.Error(), "is `audit` running?") {
+		t.Errorf("no warden: err = %v", err)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// --- Alerts ---
+
+type severity int
+
+const (
+	sevInfo severity = iota
+	sevWarning
+	sevCritical
+)
+
+var severityNames = []string{"info", "warning", "critical"}
+
+func (s severity) String() string {
+	if s < 0 || int(s) >= len(severityNames) {
+		return fmt.Sprintf("severity(%d)", int(s))
+	}
+	return severityNames[s]
+}
+
+// color is the embed color used when an alert's own color no longer fits,
+// e.g. after an environment caps its severity.
+func (s severity) color() int {
+	switch s {
+	case sevCritical:
+		return 0xe74c3c
+	case sevWarning:
+		return 0xe67e22
+	default:
+		return 0x3498db
+	}
+}
+
+func (s severity) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s *severity) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return err
+	}
+	v, err := parseSeverity(name)
+	if err != nil {
+		return err
+	}
+	*s = v
+	return nil
+}
+
+func parseSeverity(s string) (severity, error) {
+	for i, name := range severityNames {
+		if strings.EqualFold(s, name) {
+			return severity(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown severity %q (want info, warning or critical)", s)
+}
+
+// alertSchemaVersion is the version of Alert's JSON form, the one shape
+// every machine-readable output (MQTT, the history file) emits. Bump it
+// when a field changes meaning or is removed; adding a field does not
+// need a bump. alert.schema.json is generated from the struct.
+//
+// Version 1 had no schema_version, id, detected_at, enrichment or
+// deliveries; such documents still decode.
+const alertSchemaVersion = 2
+
+//go:generate go run . alert-schema -o alert.schema.json
+
+// Alert is one notification on its way out.
+type Alert struct {
+	SchemaVersion int       `json:"schema_version"`
+	ID            string    `json:"id"`
+	Title         string    `json:"title"`
+	Description   string    `json:"description"`
+	Severity      severity  `json:"severity"`
+	Color         int       `json:"-"`
+	Environment   string    `json:"environment,omitempty"`
+	Cluster       string    `json:"cluster,omitempty"`
+	Source        string    `json:"source,omitempty"`     // edge warden the audit line came from
+	AuditFile     string    `json:"audit_file,omitempty"` // audit log the line came from, when there are several
+	AuditHost     string    `json:"audit_host,omitempty"` // host that reported the line over syslog
+	RequestID     string    `json:"request_id,omitempty"`
+	Time          time.Time `json:"time"`        // when the event happened
+	DetectedAt    time.Time `json:"detected_at"` // when vault-warden raised the alert
+
+	// Structured context from the triggering audit entry, when there is
+	// one. Chat backends render these as separate fields.
+	Rule      string `json:"rule,omitempty"`
+	User      string `json:"user,omitempty"`
+	Path      string `json:"path,omitempty"`
+	Operation string `json:"operation,omitempty"`
+	SourceIP  string `json:"source_ip,omitempty"`
+	// Sensitivity is the level of Path in the sensitivity map, if any.
+	Sensitivity string `json:"sensitivity,omitempty"`
+
+	// Identity behind User: the entity and, when known, the auth mount
+	// it came through. EntityName is set when the identity cache is on.
+	EntityID      string `json:"entity_id,omitempty"`
+	EntityName    string `json:"entity_name,omitempty"`
+	Accessor      string `json:"accessor,omitempty"` // token accessor
+	AuthMount     string `json:"auth_mount,omitempty"`
+	MountAccessor string `json:"mount_accessor,omitempty"`
+
+	Enrichment map[string]string `json:"enrichment,omitempty"`
+	Deliveries []deliveryRecord  `json:"deliveries,omitempty"`
+	// Topology is the cluster's nodes as probed when a seal alert was
+	// raised.
+	Topology *topologySnapshot `json:"topology,omitempty"`
+	// Approvals are those the unseals of an unseal alert needed.
+	Approvals []unsealApproval `json:"approvals,omitempty"`
+	// Excerpt is the start of the triggering audit entry, kept for the
+	// details on demand.
+	Excerpt string `json:"excerpt,omitempty"`
+
+	// Incident pairs an alert with its resolution (Resolved) so timeline
+	// sinks can draw the span between them.
+	Incident string `json:"-"`
+	Resolved bool   `json:"-"`
+	// Minimal marks an alert cut down by a content policy.
+	Minimal bool `json:"-"`
+	// Text is the built-in part of Title and Description, and Locale the
+	// locale they were put in for the destination being rendered.
+	Text   alertText `json:"-"`
+	Locale string    `json:"-"`
+}
+
+// deliveryRecord is the outcome of sending an alert to one sink.
+type deliveryRecord struct {
+	Sink      string    `json:"sink"`
+	Time      time.Time `json:"time"`
+	Delivered bool      `json:"delivered"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// newAlertID returns a random 128-bit hex ID.
+func newAlertID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// EnvironmentConfig holds per-environment alert policy.
+type EnvironmentConfig struct {
+	MaxSeverity string `yaml:"max_severity"`
+}
+
+// notify sends an alert to the configured destinations, applying the
+// environment label and severity ceiling first. The destinations are
+// those last reloaded.
+func notify(cfg *VaultConfig, a Alert) error {
+	return notifyTo(cfg, a, "")
+}
+
+// notifyTo is notify for the one destination only, or for all of them
+// when only is empty. A destination in its quiet hours may hold the
+// alert for its digest instead.
+func notifyTo(cfg *VaultConfig, a Alert, only string) error {
+	cfg = live(cfg)
+	if mode.suppress(a) {
+		metrics.inc("alerts_suppressed_total")
+		return nil
+	}
+	a.SchemaVersion = alertSchemaVersion
+	if a.ID == "" {
+		a.ID = newAlertID()
+	}
+	a.DetectedAt = time.Now().UTC()
+	if a.Time.IsZero() {
+		a.Time = a.DetectedAt
+	}
+	a.Cluster = clusterLabel(cfg)
+	if env := cfg.Environment; env != "" {
+		a.Environment = env
+		a.Title = "[" + strings.ToUpper(env) + "] " + a.Title
+		if envCfg, ok := cfg.Environments[env]; ok && envCfg.MaxSeverity != "" {
+			max, _ := parseSeverity(envCfg.MaxSeverity) // validated at load
+			if a.Severity > max {
+				a.Severity, a.Color = max, max.color()
+			}
+		}
+	}
+	if cfg.includeRemediation() {
+		a.Description += remediationBlock(cfg, a, english)
+	}
+	rule := a.Rule
+	if rule == "" {
+		rule = "none"
+	}
+	metrics.inc("alerts_total", "rule", rule, "severity", a.Severity.String(), "environment", a.Environment)
+	alertIndex.add(a)
+	if alertStream != nil {
+		return alertStream.Encode(a)
+	}
+	// MQTT, Grafana and PagerDuty buffer on their own; only the webhook
+	// goes through the queue.
+	to := func(dest string) bool { return only == "" || only == dest }
+	if to("mqtt") && mqttSink != nil {
+		if m, ok := forDestination(cfg, a, "mqtt"); ok && !quiet.hold(cfg, m, "mqtt") {
+			mqttSink.publishAlert(m)
+		}
+	}
+	if to("grafana") && grafanaSink != nil {
+		if g, ok := forDestination(cfg, a, "grafana"); ok && !quiet.hold(cfg, g, "grafana") {
+			grafanaSink.annotateAlert(g)
+		}
+	}
+	if to("pagerduty") && pagerDutySink != nil && a.Severity >= pagerDutySink.min {
+		if p, ok := forDestination(cfg, a, "pagerduty"); ok && !quiet.hold(cfg, p, "pagerduty") {
+			pagerDutySink.trigger(p)
+		}
+	}
+	kind := notifierFor(cfg).kind()
+	if !to(kind) {
+		return nil
+	}
+	a, ok := forDestination(cfg, a, kind)
+	if !ok || quiet.hold(cfg, a, kind) {
+		return nil
+	}
+	if queue != nil {
+		outbox.add(a, kind)
+		queue.push(a)
+		return nil
+	}
+	_, err := sendAlerts(cfg, []Alert{a})
+	return err
+}
+
+// openSinks sets up the process-wide notification sinks for a command and
+// returns a function that flushes and closes them.
+func openSinks(cfg *VaultConfig) func() {
+	history = openHistory(cfg)
+	locales = openLocales(cfg)
+	notifyClient = newNotifyClient(cfg)
+	mqttSink = startMQTT(cfg)
+	grafanaSink = startGrafana(cfg)
+	pagerDutySink = startPagerDuty(cfg)
+	metrics.setMaxSeries(cfg.Metrics.MaxSeries)
+	statsdSink = startStatsD(cfg)
+	return func() {
+		mqttSink.close(5 * time.Second)
+		grafanaSink.close(5 * time.Second)
+		pagerDutySink.close(5 * time.Second)
+		statsdSink.close(5 * time.Second)
+	}
+}
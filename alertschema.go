@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// --- Alert Schema ---
+
+// alertFieldDocs describes each JSON field of Alert and its nested types for
+// the generated schema. Every field needs an entry; "type.field" keys take
+// precedence over plain field names.
+var alertFieldDocs = map[string]string{
+	"schema_version":         "Version of this document's shape. Absent in version 1 documents.",
+	"id":                     "Random identifier of the alert, the same in every output.",
+	"title":                  "One-line summary, including the environment prefix.",
+	"description":            "Human-readable details in Discord markdown.",
+	"severity":               "Severity after the environment's ceiling is applied.",
+	"environment":            "Configured environment, e.g. prod.",
+	"cluster":                "Cluster label: the environment, or the Vault host.",
+	"source":                 "Label of the edge warden that forwarded the triggering audit entry, on a hub.",
+	"audit_file":             "Audit log the triggering entry was read from, when audit_log names several.",
+	"audit_host":             "Host that reported the triggering entry, from its syslog header, with audit_source: syslog.",
+	"request_id":             "Vault request ID of the triggering audit entry.",
+	"time":                   "When the event happened: the audit entry's time, or the detection time when there is no entry.",
+	"detected_at":            "When vault-warden raised the alert.",
+	"rule":                   "Name of the check that raised the alert.",
+	"user":                   "Display name of the identity in the triggering audit entry.",
+	"path":                   "Request path of the triggering audit entry.",
+	"operation":              "Request operation of the triggering audit entry.",
+	"source_ip":              "Client address of the triggering audit entry.",
+	"sensitivity":            "Sensitivity level of path in the sensitivity map: low, medium, high or critical.",
+	"entity_id":              "Vault entity ID of the identity in the triggering audit entry.",
+	"entity_name":            "Entity name, when the identity cache resolved it.",
+	"accessor":               "Token accessor of the triggering audit entry.",
+	"auth_mount":             "Type of the auth mount the identity logged in through, e.g. ldap, when known.",
+	"mount_accessor":         "Accessor of that auth mount.",
+	"enrichment":             "Extra context keyed by name.",
+	"deliveries":             "Delivery attempts known when the document was written.",
+	"deliveryRecord.time":    "When the delivery was attempted.",
+	"sink":                   "Destination, e.g. discord.",
+	"delivered":              "Whether the sink accepted the alert.",
+	"error":                  "Delivery error, when not delivered.",
+	"topology":               "The cluster's nodes as probed when the alert was raised, on seal alerts.",
+	"taken":                  "When the nodes were probed.",
+	"nodes":                  "One entry per known node.",
+	"partial":                "Whether the probe budget ran out before every node answered.",
+	"address":                "Node address.",
+	"state":                  "sealed, unsealed, uninitialized, unreachable, or pending when it did not answer within the budget.",
+	"role":                   "active, standby or perf-standby, when unsealed.",
+	"version":                "Vault version the node reports.",
+	"latency_ms":             "How long the node took to answer, in milliseconds.",
+	"nodeSnapshot.error":     "Why the node's state is not known.",
+	"approvals":              "Approvals the unseals of an unseal alert needed, when authorization asks for them.",
+	"excerpt":                "The start of the triggering audit entry, when details are configured.",
+	"unsealApproval.cluster": "Label of the cluster unsealed.",
+	"unsealApproval.source":  "Where the approval came from: http, discord or file.",
+	"approver":               "Who approved: the name the source gave, or the Discord user and ID.",
+	"at":                     "When the approval was given.",
+	"reference":              "The approval token, Discord message or file.",
+}
+
+// alertJSONSchema builds the JSON Schema of Alert from its struct tags.
+func alertJSONSchema() (map[string]interface{}, error) {
+	s, err := schemaFor(reflect.TypeOf(Alert{}), alertFieldDocs)
+	if err != nil {
+		return nil, err
+	}
+	s["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	s["$id"] = "https://github.com/usenix17/vault-warden/blob/main/alert.schema.json"
+	s["title"] = "vault-warden alert"
+	s["description"] = fmt.Sprintf("An alert as emitted by every machine-readable vault-warden output. Schema version %d.", alertSchemaVersion)
+	return s, nil
+}
+
+// schemaFor builds the schema of t. docs describes each JSON field, as in
+// alertFieldDocs.
+func schemaFor(t reflect.Type, docs map[string]string) (map[string]interface{}, error) {
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}, nil
+	case reflect.TypeOf(severity(0)):
+		return map[string]interface{}{"type": "string", "enum": severityNames}, nil
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaFor(t.Elem(), docs)
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}, nil
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}, nil
+	case reflect.Int, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}, nil
+	case reflect.Float64:
+		return map[string]interface{}{"type": "number"}, nil
+	case reflect.Slice:
+		items, err := schemaFor(t.Elem(), docs)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"type": "array", "items": items}, nil
+	case reflect.Map:
+		values, err := schemaFor(t.Elem(), docs)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"type": "object", "additionalProperties": values}, nil
+	case reflect.Struct:
+		props := map[string]interface{}{}
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "-" || name == "" {
+				continue
+			}
+			ps, err := schemaFor(f.Type, docs)
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: %w", t.Name(), f.Name, err)
+			}
+			doc, ok := docs[t.Name()+"."+name]
+			if !ok {
+				doc, ok = docs[name]
+			}
+			if !ok {
+				return nil, fmt.Errorf("%s.%s: no field description", t.Name(), f.Name)
+			}
+			ps["description"] = doc
+			props[name] = ps
+			if opts != "omitempty" {
+				required = append(required, name)
+			}
+		}
+		s := map[string]interface{}{"type": "object", "properties": props}
+		if len(required) > 0 {
+			s["required"] = required
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("no schema for %s", t)
+}
+
+// runAlertSchema writes the schema; see the go:generate line in alert.go.
+func runAlertSchema(args []string) error {
+	fs := flagSet("alert-schema")
+	out := fs.String("o", "", "Output file (default stdout)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	s, err := alertJSONSchema()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeOutput(*out, append(data, '\n'), 0o644)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The checked-in schema is what go generate writes today.
+func TestAlertSchemaFileCurrent(t *testing.T) {
+	s, err := alertJSONSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile("alert.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, append(want, '\n')) {
+		t.Error("alert.schema.json is stale; run go generate")
+	}
+}
+
+func fullAlert() Alert {
+	at := time.Date(2026, 10, 14, 8, 30, 0, 0, time.UTC)
+	return Alert{
+		SchemaVersion: alertSchemaVersion, ID: "0f1e2d3c4b5a69788796a5b4c3d2e1f0",
+		Title: "[PROD] 🔒 Vault Sealed", Description: "Vault **prod** is sealed.", Severity: sevCritical,
+		Environment: "prod", Cluster: "prod", Source: "edge-eu", AuditFile: "/var/log/vault/audit.log", AuditHost: "vault-1",
+		RequestID: "5d1f0c2a-8e4b-4a71-9f3e-2b6c7d8e9f01", Time: at, DetectedAt: at.Add(1200 * time.Millisecond),
+		Rule: "seal", User: "alice", Path: "sys/seal", Operation: "update", SourceIP: "10.1.2.3", Sensitivity: "critical",
+		EntityID: "b1c2d3e4-entity", EntityName: "alice", Accessor: "hmac-sha256:acc", AuthMount: "ldap", MountAccessor: "auth_ldap_1234",
+		Enrichment: map[string]string{"owner": "platform", "network": "office-vpn"},
+		Deliveries: []deliveryRecord{{Sink: "discord", Time: at.Add(2 * time.Second), Delivered: false, Error: "discord returned 429"}},
+		Topology: &topologySnapshot{Taken: at, Partial: true, Nodes: []nodeSnapshot{
+			{Address: "https://vault-1:8200", State: "sealed", Version: "1.15.4", LatencyMS: 12.5},
+			{Address: "https://vault-2:8200", State: "unsealed", Role: "standby", Version: "1.15.4", LatencyMS: 8},
+			{Address: "https://vault-3:8200", State: "pending", Error: "no answer within the budget"},
+		}},
+		Approvals: []unsealApproval{{Cluster: "prod", Source: "discord", Approver: "bob (1234)", At: at.Add(-time.Minute), Reference: "msg 42"}},
+		Excerpt:   `{"type":"request","time":"2026-10-14T08:30:00Z"}`,
+	}
+}
+
+// The current shape is locked down by a fixture, and decodes back to the
+// alert it came from.
+func TestAlertSchemaVersion2(t *testing.T) {
+	a := fullAlert()
+	data, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "alert-schema/v2-full.json", string(data)+"\n")
+
+	var back Alert
+	if err := json.Unmarshal(data, &back); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(back, a) {
+		t.Errorf("round trip = %+v\nwant %+v", back, a)
+	}
+}
+
+// Every field an alert emits is in the schema, and every required one is
+// emitted.
+func TestAlertJSONMatchesSchema(t *testing.T) {
+	s, err := alertJSONSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var check func(path string, schema map[string]interface{}, v interface{})
+	check = func(path string, schema map[string]interface{}, v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			props, _ := schema["properties"].(map[string]interface{})
+			if props == nil {
+				return // a map such as enrichment
+			}
+			for k, sub := range v {
+				ps, ok := props[k].(map[string]interface{})
+				if !ok {
+					t.Errorf("%s%s is emitted but not in the schema", path, k)
+					continue
+				}
+				check(path+k+".", ps, sub)
+			}
+			req, _ := schema["required"].([]string)
+			for _, k := range req {
+				if _, ok := v[k]; !ok {
+					t.Errorf("%s%s is required but not emitted", path, k)
+				}
+			}
+		case []interface{}:
+			items, _ := schema["items"].(map[string]interface{})
+			for _, item := range v {
+				check(path, items, item)
+			}
+		}
+	}
+	for name, a := range map[string]Alert{"full": fullAlert(), "bare": {Title: "t", Severity: sevInfo}} {
+		data, err := json.Marshal(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var doc map[string]interface{}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			t.Fatal(err)
+		}
+		t.Run(name, func(t *testing.T) { check("", s, doc) })
+	}
+}
+
+// Version 1 documents, as MQTT published them before schema_version,
+// still decode.
+func TestAlertSchemaVersion1(t *testing.T) {
+	files, err := filepath.Glob("testdata/alert-schema/v1-*.json")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no version 1 fixtures: %v", err)
+	}
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var a Alert
+			if err := json.Unmarshal(data, &a); err != nil {
+				t.Fatal(err)
+			}
+			if a.SchemaVersion != 0 || a.ID != "" || !a.DetectedAt.IsZero() {
+				t.Errorf("version 1 document decoded with version 2 fields: %+v", a)
+			}
+			if a.Title == "" || a.Rule == "" || a.Time.IsZero() {
+				t.Errorf("decoded %+v, want its title, rule and time", a)
+			}
+		})
+	}
+
+	data, _ := os.ReadFile("testdata/alert-schema/v1-mqtt.json")
+	var a Alert
+	json.Unmarshal(data, &a)
+	want := Alert{Title: "[PROD] 🚨 SECURITY ALERT: Privileged Access", Description: "**User:** alice\n**Path:** sys/policies/acl/root",
+		Severity: sevCritical, Environment: "prod", Cluster: "prod", RequestID: "5d1f0c2a-8e4b-4a71-9f3e-2b6c7d8e9f01",
+		Time: time.Date(2025, 3, 2, 17, 4, 11, 520000000, time.UTC), Rule: "privileged-access", User: "alice",
+		Path: "sys/policies/acl/root", Operation: "update", SourceIP: "10.1.2.3"}
+	if !reflect.DeepEqual(a, want) {
+		t.Errorf("v1-mqtt.json = %+v\nwant %+v", a, want)
+	}
+}
+
+// History files written before records carried the alert still read, and
+// a mix of old and new records reads in order.
+func TestHistoryVersion1Records(t *testing.T) {
+	old, err := os.ReadFile("testdata/alert-schema/v1-history.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	if err := os.WriteFile(path, old, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	h := &alertHistory{path: path}
+	h.record("discord", fullAlert(), []byte(`{"embeds":[]}`), nil)
+
+	var recs []*historyRecord
+	if err := readHistory(path, func(_ int, rec *historyRecord) error {
+		recs = append(recs, rec)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 3 {
+		t.Fatalf("read %d records, want 3", len(recs))
+	}
+	if recs[0].Alert != nil || recs[0].Severity != "critical" || !recs[0].Delivered {
+		t.Errorf("first record = %+v", recs[0])
+	}
+	if recs[1].Error != "discord returned 429" {
+		t.Errorf("second record error = %q", recs[1].Error)
+	}
+	a := recs[2].Alert
+	if a == nil || a.SchemaVersion != alertSchemaVersion || len(a.Deliveries) != 2 || a.Deliveries[1].Sink != "discord" {
+		t.Errorf("new record alert = %+v, want version %d with its delivery appended", a, alertSchemaVersion)
+	}
+}
@@ -0,0 +1,662 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Unseal Authorization ---
+
+const (
+	authorizationNone       = "none"
+	defaultApprovalDeadline = 15 * time.Minute
+	defaultApprovalInterval = 10 * time.Second
+	defaultDiscordAPI       = "https://discord.com/api/v10"
+	// fileApprovalInterval is how often the approval file is looked for.
+	fileApprovalInterval = 2 * time.Second
+	// discordSignatureMaxAge is how far a signed interaction's timestamp
+	// may be from now; an older one is a replay.
+	discordSignatureMaxAge = 5 * time.Minute
+)
+
+// ApprovalConfig is where an unseal's approval comes from when
+// authorization names a source: http, discord or file. No key is
+// submitted before it arrives, and the unlock gives up at the deadline.
+type ApprovalConfig struct {
+	Deadline Duration              `yaml:"deadline"`
+	HTTP     HTTPApprovalConfig    `yaml:"http"`
+	Discord  DiscordApprovalConfig `yaml:"discord"`
+	File     FileApprovalConfig    `yaml:"file"`
+}
+
+// HTTPApprovalConfig polls an endpoint, such as the change management
+// system's, that answers {"status": "approved", "approver": "alice",
+// "token": "CHG-1234"} once the change is approved. Until then it answers
+// "pending" or 404; "denied" ends the wait.
+type HTTPApprovalConfig struct {
+	URL      string   `yaml:"url"`   // {cluster} is replaced with the cluster's label
+	Token    string   `yaml:"token"` // sent as a bearer token, if set
+	Interval Duration `yaml:"interval"`
+}
+
+// DiscordBotConfig is a bot that posts messages with buttons. Discord
+// delivers the presses to the application's interactions endpoint URL,
+// which must reach listen.
+type DiscordBotConfig struct {
+	BotToken  string `yaml:"bot_token"`
+	ChannelID string `yaml:"channel_id"`
+	PublicKey string `yaml:"public_key"` // the application's, in hex; verifies the presses
+	Listen    string `yaml:"listen"`     // e.g. "127.0.0.1:8470", behind a TLS proxy
+	APIURL    string `yaml:"api_url"`
+}
+
+// DiscordApprovalConfig has the bot post the request with Approve and
+// Deny buttons.
+type DiscordApprovalConfig struct {
+	DiscordBotConfig `yaml:",inline"`
+	Approvers        []string `yaml:"approvers"` // Discord user IDs allowed to decide
+}
+
+// FileApprovalConfig waits for a file whose first line names the
+// approver. The file is removed once used, so it covers one unseal.
+type FileApprovalConfig struct {
+	Path string `yaml:"path"` // {cluster} is replaced with the cluster's label
+}
+
+// unsealApproval is who approved an unseal, when and through what. The
+// unseal notification carries it, so the history keeps it too.
+type unsealApproval struct {
+	Cluster   string    `json:"cluster"`
+	Source    string    `json:"source"` // http, discord or file
+	Approver  string    `json:"approver"`
+	At        time.Time `json:"at"`
+	Reference string    `json:"reference,omitempty"` // the approval token, Discord message or file
+}
+
+// approvalDenied is a source's explicit no.
+type approvalDenied struct{ by string }
+
+func (e *approvalDenied) Error() string { return "denied by " + e.by }
+
+// approvalSource waits for the decision on one cluster's unseal until ctx
+// is done.
+type approvalSource interface {
+	await(ctx context.Context, cfg *VaultConfig) (*unsealApproval, error)
+}
+
+func approvalSourceFor(cfg *VaultConfig) approvalSource {
+	switch cfg.Authorization {
+	case "http":
+		return httpApproval{}
+	case "discord":
+		return discordApproval{}
+	}
+	return fileApproval{}
+}
+
+var (
+	msgNotApproved        = message("unseal.not-approved.title")
+	msgNotApprovedBody    = message("unseal.not-approved.body")
+	msgNotApprovedExpired = message("unseal.not-approved.expired")
+	msgNotApprovedDenied  = message("unseal.not-approved.denied")
+	msgNotApprovedFailed  = message("unseal.not-approved.failed")
+	msgApproval           = message("unseal.approval")
+	msgApprovalReference  = message("unseal.approval.reference")
+)
+
+// authorizeUnseal waits for the approval of cfg's unseal when its
+// authorization asks for one, and returns nil when it doesn't. Without an
+// approval by the deadline, or with a denial, the unseal is called off
+// with exitNotApproved and a notification.
+func authorizeUnseal(cfg *VaultConfig) (*unsealApproval, error) {
+	if cfg.Authorization == "" || cfg.Authorization == authorizationNone {
+		return nil, nil
+	}
+	label, source, deadline := clusterLabel(cfg), cfg.Authorization, time.Duration(cfg.Approval.Deadline)
+	logInfo("✋ Waiting up to {deadline} for approval to unseal {cluster} via {source}", "deadline", formatDuration(deadline), "cluster", label, "source", source)
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	defer cancel()
+	ap, err := approvalSourceFor(cfg).await(ctx, cfg)
+	if err == nil {
+		ap.Cluster, ap.Source = label, source
+		metrics.inc("unseal_approvals_total", "cluster", label, "result", "approved")
+		logInfo("✅ Unseal of {cluster} approved by {approver} via {source}", "cluster", label, "approver", ap.Approver, "source", source)
+		return ap, nil
+	}
+
+	var denied *approvalDenied
+	var reason localText
+	result := "failed"
+	address := mdCode(cfg.Address, maxPathLen)
+	switch {
+	case errors.As(err, &denied):
+		result = "denied"
+		reason = msgNotApprovedDenied.with("approver", mdText(denied.by, maxNameLen), "address", address, "source", source)
+	case ctx.Err() != nil:
+		result = "expired"
+		err = fmt.Errorf("no approval via %s within %s", source, formatDuration(deadline))
+		reason = msgNotApprovedExpired.with("address", address, "source", source, "deadline", formatDuration(deadline))
+	default:
+		reason = msgNotApprovedFailed.with("address", address, "source", source, "error", mdCode(err.Error(), maxErrorLen))
+	}
+	metrics.inc("unseal_approvals_total", "cluster", label, "result", result)
+	notify(cfg, Alert{Severity: sevWarning, Color: sevWarning.color(), Rule: "unseal-approval"}.say(
+		msgNotApproved.with("cluster", cleanField(label, maxNameLen)), msgNotApprovedBody.with("reason", reason)))
+	return nil, &exitError{exitNotApproved, fmt.Errorf("unseal not approved: %w", err)}
+}
+
+// text is the approval line of an unseal notification; "" without one.
+func (ap *unsealApproval) text() localText {
+	if ap == nil || ap.Source == "" {
+		return localText{}
+	}
+	var ref localText
+	if ap.Reference != "" {
+		ref = msgApprovalReference.with("reference", mdCode(ap.Reference, maxNameLen))
+	}
+	return msgApproval.with("approver", mdText(ap.Approver, maxNameLen), "source", ap.Source,
+		"time", ap.At.UTC().Format(time.RFC3339), "reference", ref)
+}
+
+// list is the approval as an alert's approvals.
+func (ap *unsealApproval) list() []unsealApproval {
+	if ap == nil || ap.Source == "" {
+		return nil
+	}
+	return []unsealApproval{*ap}
+}
+
+// approvalPath fills the cluster's label into a configured path or URL.
+func approvalPath(cfg *VaultConfig, s string) string {
+	return strings.ReplaceAll(s, "{cluster}", clusterLabel(cfg))
+}
+
+// httpApproval polls approval.http.url.
+type httpApproval struct{}
+
+func (httpApproval) await(ctx context.Context, cfg *VaultConfig) (*unsealApproval, error) {
+	interval := time.Duration(cfg.Approval.HTTP.Interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		ap, err := pollApproval(ctx, cfg)
+		var denied *approvalDenied
+		switch {
+		case errors.As(err, &denied):
+			return nil, err
+		case err != nil && ctx.Err() == nil:
+			// The endpoint being down isn't a no; the deadline decides.
+			logWarn("⚠️  Approval endpoint: {error}; asking again in {interval}", "error", err, "interval", formatDuration(interval))
+		case ap != nil:
+			return ap, nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// pollApproval asks the endpoint once; nil while the decision is pending.
+func pollApproval(ctx context.Context, cfg *VaultConfig) (*unsealApproval, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeouts.of(opNotify))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", approvalPath(cfg, cfg.Approval.HTTP.URL), nil)
+	if err != nil {
+		return nil, err
+	}
+	if t := cfg.Approval.HTTP.Token; t != "" {
+		req.Header.Set("Authorization", "Bearer "+t)
+	}
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil // nothing filed yet
+	default:
+		return nil, fmt.Errorf("returned %d", resp.StatusCode)
+	}
+	var body struct {
+		Status   string `json:"status"`
+		Approver string `json:"approver"`
+		Token    string `json:"token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decode answer: %w", err)
+	}
+	switch body.Status {
+	case "pending":
+		return nil, nil
+	case "denied":
+		if body.Approver == "" {
+			body.Approver = "the approval endpoint"
+		}
+		return nil, &approvalDenied{by: body.Approver}
+	case "approved":
+		// The token is the record the change policy asks for.
+		if body.Approver == "" || body.Token == "" {
+			return nil, fmt.Errorf("approved without an approver and token")
+		}
+		return &unsealApproval{Approver: body.Approver, At: time.Now().UTC(), Reference: body.Token}, nil
+	}
+	return nil, fmt.Errorf("unknown status %q", body.Status)
+}
+
+// fileApproval waits for approval.file.path.
+type fileApproval struct{}
+
+func (fileApproval) await(ctx context.Context, cfg *VaultConfig) (*unsealApproval, error) {
+	path := approvalPath(cfg, cfg.Approval.File.Path)
+	ticker := time.NewTicker(fileApprovalInterval)
+	defer ticker.Stop()
+	for {
+		if ap, err := takeApprovalFile(path); err != nil || ap != nil {
+			return ap, err
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// takeApprovalFile reads and removes the approval file; nil while there
+// is none.
+func takeApprovalFile(path string) (*unsealApproval, error) {
+	fi, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	approver := strings.TrimSpace(strings.SplitN(string(data), "\n", 2)[0])
+	if approver == "" {
+		return nil, fmt.Errorf("%s names no approver on its first line", path)
+	}
+	if err := os.Remove(path); err != nil {
+		return nil, fmt.Errorf("use up %s: %w", path, err)
+	}
+	return &unsealApproval{Approver: approver, At: fi.ModTime().UTC(), Reference: path}, nil
+}
+
+// discordApproval posts the request and waits for a button press.
+type discordApproval struct{}
+
+// discordDecision is an approver's press of Approve or Deny.
+type discordDecision struct {
+	approve bool
+	by      string
+	at      time.Time
+}
+
+// discordRequest is an approval request awaiting its decision.
+type discordRequest struct {
+	cfg     *VaultConfig
+	label   string
+	decided chan discordDecision // buffered; the first decision wins
+}
+
+// discordApprovals are the requests open in this process, by the ID in
+// their buttons. The interactions endpoint starts with the first, and
+// serves the rest of the process, so clusters unsealed together share it.
+var discordApprovals = struct {
+	mu   sync.Mutex
+	open map[string]*discordRequest
+}{open: make(map[string]*discordRequest)}
+
+// discordEndpoints are the interactions endpoints listening: the public
+// key each verifies with, by address.
+var discordEndpoints = struct {
+	mu        sync.Mutex
+	listening map[string]string
+}{listening: make(map[string]string)}
+
+var (
+	msgDiscordRequest     = message("approval.discord.request")
+	msgDiscordApprove     = message("approval.discord.approve")
+	msgDiscordDeny        = message("approval.discord.deny")
+	msgDiscordApproved    = message("approval.discord.approved")
+	msgDiscordDenied      = message("approval.discord.denied")
+	msgDiscordExpired     = message("approval.discord.expired")
+	msgDiscordNotApprover = message("approval.discord.not-approver")
+	msgDiscordClosed      = message("approval.discord.closed")
+)
+
+func (discordApproval) await(ctx context.Context, cfg *VaultConfig) (*unsealApproval, error) {
+	if err := startDiscordInteractions(cfg.Approval.Discord.DiscordBotConfig); err != nil {
+		return nil, err
+	}
+	id := newAlertID()
+	req := &discordRequest{cfg: cfg, label: clusterLabel(cfg), decided: make(chan discordDecision, 1)}
+	discordApprovals.mu.Lock()
+	discordApprovals.open[id] = req
+	discordApprovals.mu.Unlock()
+	defer func() {
+		discordApprovals.mu.Lock()
+		delete(discordApprovals.open, id)
+		discordApprovals.mu.Unlock()
+	}()
+
+	dc := cfg.Approval.Discord
+	c := locales.catalog(locales.locale)
+	host, _ := os.Hostname()
+	deadline, _ := ctx.Deadline()
+	mentions := make([]string, len(dc.Approvers))
+	for i, a := range dc.Approvers {
+		mentions[i] = "<@" + a + ">"
+	}
+	body, err := discordAPI(cfg, dc.DiscordBotConfig, "POST", "/channels/"+dc.ChannelID+"/messages", map[string]interface{}{
+		"content": c.render(msgDiscordRequest.with("cluster", mdText(req.label, maxNameLen), "address", mdCode(cfg.Address, maxPathLen),
+			"host", mdText(host, maxNameLen), "approvers", strings.Join(mentions, ", "), "expires", fmt.Sprintf("<t:%d:R>", deadline.Unix()))),
+		"allowed_mentions": map[string]interface{}{"users": dc.Approvers},
+		"components": []interface{}{map[string]interface{}{"type": 1, "components": []interface{}{
+			map[string]interface{}{"type": 2, "style": 3, "label": c.text(msgDiscordApprove), "custom_id": "approve:" + id},
+			map[string]interface{}{"type": 2, "style": 4, "label": c.text(msgDiscordDeny), "custom_id": "deny:" + id},
+		}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var posted struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(body, &posted)
+
+	select {
+	case d := <-req.decided:
+		if !d.approve {
+			return nil, &approvalDenied{by: d.by}
+		}
+		return &unsealApproval{Approver: d.by, At: d.at, Reference: "discord message " + posted.ID}, nil
+	case <-ctx.Done():
+		// Take the buttons away, so nobody approves what no longer waits.
+		if _, err := discordAPI(cfg, dc.DiscordBotConfig, "PATCH", "/channels/"+dc.ChannelID+"/messages/"+posted.ID, map[string]interface{}{
+			"content":    c.render(msgDiscordExpired.with("cluster", mdText(req.label, maxNameLen))),
+			"components": []interface{}{},
+		}); err != nil {
+			logWarn("⚠️  Discord approval: could not mark the request expired: {error}", "error", err)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// discordAPI calls the Discord REST API as the bot.
+func discordAPI(cfg *VaultConfig, bot DiscordBotConfig, method, path string, payload interface{}) ([]byte, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	req, cancel, err := newOpRequest(cfg, opNotify, method, strings.TrimRight(bot.APIURL, "/")+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	req.Header.Set("Authorization", "Bot "+bot.BotToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("discord: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("discord %s %s returned %d: %s", method, path, resp.StatusCode, bytes.TrimSpace(body))
+	}
+	return body, nil
+}
+
+// startDiscordInteractions starts the bot's interactions endpoint once
+// per address. It answers the buttons of approvals and of alert details
+// alike, as one application has one endpoint URL; a second application on
+// the same address is refused rather than left unverifiable.
+func startDiscordInteractions(bot DiscordBotConfig) error {
+	discordEndpoints.mu.Lock()
+	defer discordEndpoints.mu.Unlock()
+	key := strings.ToLower(bot.PublicKey)
+	if running, ok := discordEndpoints.listening[bot.Listen]; ok {
+		if running != key {
+			return fmt.Errorf("interactions endpoint: %s already answers another application's public key", bot.Listen)
+		}
+		return nil
+	}
+	pub, _ := hex.DecodeString(bot.PublicKey) // validated at load
+	l, err := net.Listen("tcp", bot.Listen)
+	if err != nil {
+		return fmt.Errorf("interactions endpoint: %w", err)
+	}
+	discordEndpoints.listening[bot.Listen] = key
+	go func() {
+		srv := &http.Server{Handler: discordInteractionHandler(ed25519.PublicKey(pub)), ReadHeaderTimeout: 10 * time.Second}
+		if err := srv.Serve(l); err != nil {
+			logWarn("⚠️  Discord: interactions endpoint stopped: {error}", "error", err)
+		}
+	}()
+	logInfo("🔐 Discord: interactions endpoint on {address}", "address", l.Addr())
+	return nil
+}
+
+// discordTimestampFresh reports whether ts, in Unix seconds, is within
+// discordSignatureMaxAge of now.
+func discordTimestampFresh(ts string, now time.Time) bool {
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+	d := now.Sub(time.Unix(sec, 0))
+	return d <= discordSignatureMaxAge && d >= -discordSignatureMaxAge
+}
+
+// discordInteraction is the part of an interaction a button press needs.
+// The application ID and token address its follow-up messages.
+type discordInteraction struct {
+	Type          int    `json:"type"`
+	ApplicationID string `json:"application_id"`
+	Token         string `json:"token"`
+	Data          struct {
+		CustomID string `json:"custom_id"`
+	} `json:"data"`
+	Member *struct {
+		User discordUser `json:"user"`
+	} `json:"member"` // in a guild
+	User *discordUser `json:"user"` // in a DM
+}
+
+type discordUser struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+}
+
+func (in *discordInteraction) user() discordUser {
+	if in.Member != nil {
+		return in.Member.User
+	}
+	if in.User != nil {
+		return *in.User
+	}
+	return discordUser{}
+}
+
+// discordInteractionHandler answers Discord's pings and the presses of
+// the approval and details buttons. Discord signs every request; one that doesn't
+// verify is refused, as Discord requires, and so is one signed too long ago
+// to be anything but a replay.
+func discordInteractionHandler(pub ed25519.PublicKey) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sig, err := hex.DecodeString(r.Header.Get("X-Signature-Ed25519"))
+		ts := r.Header.Get("X-Signature-Timestamp")
+		msg := append([]byte(ts), body...)
+		if err != nil || len(sig) != ed25519.SignatureSize || !ed25519.Verify(pub, msg, sig) {
+			http.Error(w, "invalid request signature", http.StatusUnauthorized)
+			return
+		}
+		if !discordTimestampFresh(ts, time.Now()) {
+			http.Error(w, "stale request signature", http.StatusUnauthorized)
+			return
+		}
+		var in discordInteraction
+		if err := json.Unmarshal(body, &in); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch in.Type {
+		case 1: // ping
+			writeJSON(w, map[string]int{"type": 1})
+		case 3: // message component
+			if strings.HasPrefix(in.Data.CustomID, detailsButtonPrefix) {
+				writeJSON(w, answerDetails(&in))
+				break
+			}
+			writeJSON(w, decideDiscordApproval(&in))
+		default:
+			http.Error(w, "unsupported interaction", http.StatusBadRequest)
+		}
+	}
+}
+
+// decideDiscordApproval takes a button press and returns the response:
+// the request's message replaced by the decision, or a note only the
+// presser sees.
+func decideDiscordApproval(in *discordInteraction) interface{} {
+	action, id := in.Data.CustomID, ""
+	if i := strings.IndexByte(action, ':'); i >= 0 {
+		action, id = action[:i], action[i+1:]
+	}
+	user := in.user()
+	discordApprovals.mu.Lock()
+	req := discordApprovals.open[id]
+	allowed := req != nil && containsString(req.cfg.Approval.Discord.Approvers, user.ID)
+	if allowed {
+		delete(discordApprovals.open, id)
+	}
+	discordApprovals.mu.Unlock()
+
+	c := locales.catalog(locales.locale)
+	ephemeral := func(id msgID) interface{} {
+		return map[string]interface{}{"type": 4, "data": map[string]interface{}{"content": c.text(id), "flags": 64}}
+	}
+	switch {
+	case req == nil:
+		return ephemeral(msgDiscordClosed)
+	case !allowed:
+		logWarn("⚠️  Discord approval: {user} ({id}) is not an approver", "user", user.Username, "id", user.ID)
+		return ephemeral(msgDiscordNotApprover)
+	}
+	d := discordDecision{approve: action == "approve", by: user.Username + " (" + user.ID + ")", at: time.Now().UTC()}
+	req.decided <- d
+	result := msgDiscordDenied
+	if d.approve {
+		result = msgDiscordApproved
+	}
+	return map[string]interface{}{"type": 7, "data": map[string]interface{}{
+		"content":    c.render(result.with("cluster", mdText(req.label, maxNameLen), "user", "<@"+user.ID+">")),
+		"components": []interface{}{},
+	}}
+}
+
+// validateApproval checks the authorization of the top level and of each
+// cluster, and the settings of the sources they name.
+func validateApproval(cfg *VaultConfig) error {
+	used := make(map[string]bool)
+	check := func(field, a string) error {
+		switch a {
+		case "", authorizationNone:
+		case "http", "discord", "file":
+			used[a] = true
+		default:
+			return &fieldError{field, fmt.Sprintf("unknown authorization %q; use none, http, discord or file", a)}
+		}
+		return nil
+	}
+	if err := check("authorization", cfg.Authorization); err != nil {
+		return err
+	}
+	for i, v := range cfg.Vaults {
+		if err := check(fmt.Sprintf("vaults[%d].authorization", i), v.Authorization); err != nil {
+			return err
+		}
+	}
+	if len(used) == 0 {
+		return nil
+	}
+	ac := &cfg.Approval
+	if ac.Deadline == 0 {
+		ac.Deadline = Duration(defaultApprovalDeadline)
+	}
+	if ac.Deadline < 0 {
+		return &fieldError{"approval.deadline", "must be positive"}
+	}
+	if used["http"] {
+		if u, err := url.Parse(ac.HTTP.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return &fieldError{"approval.http.url", "must be an http:// or https:// URL"}
+		}
+		if ac.HTTP.Interval == 0 {
+			ac.HTTP.Interval = Duration(defaultApprovalInterval)
+		}
+		if ac.HTTP.Interval <= 0 {
+			return &fieldError{"approval.http.interval", "must be positive"}
+		}
+	}
+	if used["discord"] {
+		dc := &ac.Discord
+		if err := validateDiscordBot("approval.discord.", &dc.DiscordBotConfig); err != nil {
+			return err
+		}
+		if len(dc.Approvers) == 0 {
+			return &fieldError{"approval.discord.approvers", "must list the Discord user IDs who can approve"}
+		}
+	}
+	if used["file"] && !filepath.IsAbs(ac.File.Path) {
+		return &fieldError{"approval.file.path", "must be an absolute path"}
+	}
+	return nil
+}
+
+// validateDiscordBot checks a bot's settings, prefix naming where they
+// are, and fills in the API URL.
+func validateDiscordBot(prefix string, bot *DiscordBotConfig) error {
+	for _, f := range []struct{ name, value string }{
+		{"bot_token", bot.BotToken}, {"channel_id", bot.ChannelID}, {"public_key", bot.PublicKey}, {"listen", bot.Listen},
+	} {
+		if f.value == "" {
+			return &fieldError{prefix + f.name, "is required"}
+		}
+	}
+	if pub, err := hex.DecodeString(bot.PublicKey); err != nil || len(pub) != ed25519.PublicKeySize {
+		return &fieldError{prefix + "public_key", "must be the application's public key in hex"}
+	}
+	if bot.APIURL == "" {
+		bot.APIURL = defaultDiscordAPI
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiscordInteractionFreshness(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := discordInteractionHandler(pub)
+	body := []byte(`{"type":1}`)
+	press := func(at time.Time) int {
+		ts := strconv.FormatInt(at.Unix(), 10)
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		req.Header.Set("X-Signature-Timestamp", ts)
+		req.Header.Set("X-Signature-Ed25519", hex.EncodeToString(ed25519.Sign(priv, append([]byte(ts), body...))))
+		w := httptest.NewRecorder()
+		h(w, req)
+		return w.Code
+	}
+	if code := press(time.Now()); code != http.StatusOK {
+		t.Errorf("fresh ping: %d, want 200", code)
+	}
+	for _, at := range []time.Time{time.Now().Add(-10 * time.Minute), time.Now().Add(10 * time.Minute)} {
+		if code := press(at); code != http.StatusUnauthorized {
+			t.Errorf("ping signed at %v: %d, want 401", at, code)
+		}
+	}
+}
+
+func TestDiscordInteractionsOneKeyPerAddress(t *testing.T) {
+	key := func() string {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hex.EncodeToString(pub)
+	}
+	first := DiscordBotConfig{Listen: "127.0.0.1:0", PublicKey: key()}
+	if err := startDiscordInteractions(first); err != nil {
+		t.Fatal(err)
+	}
+	// The endpoint outlives the test; forget it so a rerun starts afresh.
+	t.Cleanup(func() {
+		discordEndpoints.mu.Lock()
+		defer discordEndpoints.mu.Unlock()
+		delete(discordEndpoints.listening, first.Listen)
+	})
+	if err := startDiscordInteractions(DiscordBotConfig{Listen: first.Listen, PublicKey: strings.ToUpper(first.PublicKey)}); err != nil {
+		t.Errorf("same key again: %v", err)
+	}
+	err := startDiscordInteractions(DiscordBotConfig{Listen: first.Listen, PublicKey: key()})
+	if err == nil || !strings.Contains(err.Error(), "another application's public key") {
+		t.Errorf("second key on %s: err = %v, want it refused", first.Listen, err)
+	}
+}
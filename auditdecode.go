@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// --- Audit Entry Decoding ---
+
+// Audit entries carry large request and response bodies that no check
+// reads. decodeAuditEntryFields walks the line once, extracts the fields
+// of AuditEntry that the caller asks for and skips every other value
+// without allocating. Anything it can't handle exactly like encoding/json
+// (a field of an unexpected type) falls back to json.Unmarshal, so the
+// fields it returns are identical on valid input. Malformed JSON nested
+// inside a skipped value is not diagnosed.
+
+var errProjectionFallback = errors.New("projection: needs full decode")
+
+// entryFields selects the optional fields of an AuditEntry. The time, type,
+// error, request id, path and operation and the display name are always
+// decoded: the rules match on them, and so does everything that looks at
+// every entry.
+type entryFields uint16
+
+const (
+	fieldRemoteAddress entryFields = 1 << iota
+	fieldMount                     // request mount_accessor and mount_type
+	fieldRequestData
+	fieldResponseData
+	fieldAccessor
+	fieldEntityID
+	fieldPolicies
+
+	allEntryFields entryFields = 1<<iota - 1
+)
+
+func decodeAuditEntry(line []byte) (AuditEntry, error) {
+	return decodeAuditEntryFields(line, allEntryFields)
+}
+
+// decodeAuditEntryFields decodes the base fields of line and those in
+// want; the rest stay zero.
+func decodeAuditEntryFields(line []byte, want entryFields) (AuditEntry, error) {
+	var entry AuditEntry
+	s := &jsonScanner{data: line}
+	// str decodes a string into dst if f is wanted, and skips it if not.
+	// A skipped value of another type still goes to the full decode, which
+	// rejects it.
+	str := func(f entryFields, dst *string) error {
+		if want&f != 0 {
+			return s.stringInto(dst)
+		}
+		if c := s.peek(); c != '"' && c != 'n' {
+			return s.errorf("expected string")
+		}
+		_, err := s.skipValue()
+		return err
+	}
+	err := s.object(func(key []byte) error {
+		switch string(key) {
+		case "time":
+			return s.stringInto(&entry.Time)
+		case "type":
+			return s.stringInto(&entry.Type)
+		case "error":
+			return s.stringInto(&entry.Error)
+		case "request":
+			return s.object(func(key []byte) error {
+				switch string(key) {
+				case "id":
+					return s.stringInto(&entry.Request.ID)
+				case "path":
+					return s.stringInto(&entry.Request.Path)
+				case "operation":
+					return s.stringInto(&entry.Request.Operation)
+				case "remote_address":
+					return str(fieldRemoteAddress, &entry.Request.RemoteAddress)
+				case "mount_accessor":
+					return str(fieldMount, &entry.Request.MountAccessor)
+				case "mount_type":
+					return str(fieldMount, &entry.Request.MountType)
+				}
+				raw, err := s.skipValue()
+				if err == nil && string(key) == "data" && want&fieldRequestData != 0 {
+					entry.Request.Data = append(json.RawMessage(nil), raw...)
+				}
+				return err
+			})
+		case "auth":
+			return s.object(func(key []byte) error {
+				switch string(key) {
+				case "display_name":
+					return s.stringInto(&entry.Auth.DisplayName)
+				case "accessor":
+					return str(fieldAccessor, &entry.Auth.Accessor)
+				case "entity_id":
+					return str(fieldEntityID, &entry.Auth.EntityID)
+				}
+				raw, err := s.skipValue()
+				if err == nil && string(key) == "policies" && want&fieldPolicies != 0 {
+					json.Unmarshal(raw, &entry.Auth.Policies) // policyList never fails
+				}
+				return err
+			})
+		case "response":
+			return s.object(func(key []byte) error {
+				raw, err := s.skipValue()
+				if err == nil && string(key) == "data" && want&fieldResponseData != 0 {
+					entry.Response.Data = append(json.RawMessage(nil), raw...)
+				}
+				return err
+			})
+		}
+		_, err := s.skipValue()
+		return err
+	})
+	if err == nil {
+		s.skipSpace()
+		if s.pos != len(s.data) {
+			err = s.errorf("trailing data")
+		}
+	}
+	if err != nil {
+		// Let encoding/json decide: it either decodes what we refused
+		// or returns the authoritative error.
+		var full AuditEntry
+		if uerr := json.Unmarshal(line, &full); uerr != nil {
+			return AuditEntry{}, uerr
+		}
+		want.trim(&full)
+		return full, nil
+	}
+	return entry, nil
+}
+
+// trim zeroes the optional fields of e that aren't in f.
+func (f entryFields) trim(e *AuditEntry) {
+	if f&fieldRemoteAddress == 0 {
+		e.Request.RemoteAddress = ""
+	}
+	if f&fieldMount == 0 {
+		e.Request.MountAccessor, e.Request.MountType = "", ""
+	}
+	if f&fieldRequestData == 0 {
+		e.Request.Data = nil
+	}
+	if f&fieldResponseData == 0 {
+		e.Response.Data = nil
+	}
+	if f&fieldAccessor == 0 {
+		e.Auth.Accessor = ""
+	}
+	if f&fieldEntityID == 0 {
+		e.Auth.EntityID = ""
+	}
+	if f&fieldPolicies == 0 {
+		e.Auth.Policies = nil
+	}
+}
+
+// projection is the set of fields the auditor reads from every entry. The
+// rules match only on base fields, so they add nothing here: an entry one
+// of them matches is decoded in full (see needsFullEntry) before the
+// enrichers, templates and alerts see it. Detectors that may alert on any
+// entry need everything. The reload canary replays entries as they were
+// decoded, so a reloaded rule's when condition on a field outside the
+// projection sees it empty there.
+func (a *auditor) projection() entryFields {
+	if a.coordinated != nil || a.firstAccess != nil || a.pki != nil || a.tokens != nil {
+		return allEntryFields
+	}
+	var f entryFields
+	if a.identities != nil || a.review != nil {
+		f |= fieldEntityID
+	}
+	if a.sessions != nil {
+		f |= fieldAccessor
+	}
+	if len(a.cfg.Enrichment.Networks) > 0 {
+		f |= fieldRemoteAddress
+	}
+	return f
+}
+
+// needsFullEntry reports whether an entry decoded with a projection must be
+// decoded again in full: a rule matches it, or it is an unseal, whose
+// response the external unseal check reads.
+func (a *auditor) needsFullEntry(e *AuditEntry) bool {
+	if strings.Contains(e.Request.Path, "sys/unseal") {
+		return true
+	}
+	rules := a.rules.load()
+	for i := range rules {
+		if _, ok := rules[i].match(e); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonScanner is a minimal single-pass JSON reader over one line.
+type jsonScanner struct {
+	data []byte
+	pos  int
+}
+
+func (s *jsonScanner) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w at offset %d: %s", errProjectionFallback, s.pos, fmt.Sprintf(format, args...))
+}
+
+func (s *jsonScanner) skipSpace() {
+	for s.pos < len(s.data) {
+		switch s.data[s.pos] {
+		case ' ', '\t', '\n', '\r':
+			s.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (s *jsonScanner) peek() byte {
+	s.skipSpace()
+	if s.pos >= len(s.data) {
+		return 0
+	}
+	return s.data[s.pos]
+}
+
+// object calls fn for each key of an object; fn must consume the value. A
+// null is accepted as an empty object, as encoding/json does for structs.
+// encoding/json also matches keys case-insensitively; a key with upper-case
+// letters therefore forces the full decode.
+func (s *jsonScanner) object(fn func(key []byte) error) error {
+	switch s.peek() {
+	case 'n':
+		return s.literal("null")
+	case '{':
+		s.pos++
+	default:
+		return s.errorf("expected object")
+	}
+	if s.peek() == '}' {
+		s.pos++
+		return nil
+	}
+	for {
+		if s.peek() != '"' {
+			return s.errorf("expected key")
+		}
+		key, err := s.readKey()
+		if err != nil {
+			return err
+		}
+		if s.peek() != ':' {
+			return s.errorf("expected colon")
+		}
+		s.pos++
+		if err := fn(key); err != nil {
+			return err
+		}
+		switch s.peek() {
+		case ',':
+			s.pos++
+		case '}':
+			s.pos++
+			return nil
+		default:
+			return s.errorf("expected comma or closing brace")
+		}
+	}
+}
+
+// stringInto decodes a string value into dst. null leaves dst unchanged.
+func (s *jsonScanner) stringInto(dst *string) error {
+	switch s.peek() {
+	case 'n':
+		return s.literal("null")
+	case '"':
+		v, err := s.readString()
+		if err == nil {
+			*dst = v
+		}
+		return err
+	}
+	return s.errorf("expected string")
+}
+
+// readKey returns an object key as a slice of the line.
+func (s *jsonScanner) readKey() ([]byte, error) {
+	start := s.pos + 1
+	for i := start; i < len(s.data); i++ {
+		switch c := s.data[i]; {
+		case c == '"':
+			s.pos = i + 1
+			return s.data[start:i], nil
+		case c == '\\' || c >= 'A' && c <= 'Z' || c >= 0x80:
+			return nil, s.errorf("key needs full decode")
+		}
+	}
+	return nil, s.errorf("unterminated key")
+}
+
+// readString reads a string token. Strings without escapes or invalid UTF-8
+// are sliced directly; the rest go through encoding/json.
+func (s *jsonScanner) readString() (string, error) {
+	start := s.pos
+	s.pos++ // opening quote
+	simple := true
+	for s.pos < len(s.data) {
+		c := s.data[s.pos]
+		switch {
+		case c == '"':
+			s.pos++
+			raw := s.data[start:s.pos]
+			if simple && utf8.Valid(raw) {
+				return string(raw[1 : len(raw)-1]), nil
+			}
+			var v string
+			if err := json.Unmarshal(raw, &v); err != nil {
+				return "", s.errorf("bad string: %v", err)
+			}
+			return v, nil
+		case c == '\\':
+			simple = false
+			s.pos += 2
+		case c < 0x20:
+			return "", s.errorf("control character in string")
+		default:
+			s.pos++
+		}
+	}
+	return "", s.errorf("unterminated string")
+}
+
+func (s *jsonScanner) literal(lit string) error {
+	if !bytes.HasPrefix(s.data[s.pos:], []byte(lit)) {
+		return s.errorf("expected %s", lit)
+	}
+	s.pos += len(lit)
+	return nil
+}
+
+// skipValue steps over one value of any type and returns its raw bytes.
+func (s *jsonScanner) skipValue() ([]byte, error) {
+	c := s.peek()
+	start := s.pos
+	switch {
+	case c == '"':
+		// Jump between quotes; one preceded by an odd run of
+		// backslashes is escaped.
+		for i := s.pos + 1; ; {
+			q := bytes.IndexByte(s.data[i:], '"')
+			if q < 0 {
+				return nil, s.errorf("unterminated string")
+			}
+			i += q
+			bs := 0
+			for j := i - 1; j > start && s.data[j] == '\\'; j-- {
+				bs++
+			}
+			i++
+			if bs%2 == 0 {
+				s.pos = i
+				return s.data[start:s.pos], nil
+			}
+		}
+	case c == '{' || c == '[':
+		depth := 0
+		for ; s.pos < len(s.data); s.pos++ {
+			switch s.data[s.pos] {
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					s.pos++
+					return s.data[start:s.pos], nil
+				}
+			case '"':
+				if _, err := s.skipValue(); err != nil {
+					return nil, err
+				}
+				s.pos-- // loop increment
+			}
+		}
+		return nil, s.errorf("unterminated %c", c)
+	case c == 't' || c == 'f' || c == 'n':
+		lit := "null"
+		if c == 't' {
+			lit = "true"
+		} else if c == 'f' {
+			lit = "false"
+		}
+		if err := s.literal(lit); err != nil {
+			return nil, err
+		}
+		return s.data[start:s.pos], nil
+	case c == '-' || (c >= '0' && c <= '9'):
+		for s.pos < len(s.data) && strings.IndexByte("+-.eE0123456789", s.data[s.pos]) >= 0 {
+			s.pos++
+		}
+		return s.data[start:s.pos], nil
+	}
+	return nil, s.errorf("unexpected %q", c)
+}
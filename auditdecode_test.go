@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func auditCorpus(t testing.TB) [][]byte {
+	t.Helper()
+	data, err := os.ReadFile("testdata/audit-corpus.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines [][]byte
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		lines = append(lines, append([]byte(nil), sc.Bytes()...))
+	}
+	return lines
+}
+
+// project zeroes the optional fields of e that want leaves out.
+func project(e AuditEntry, want entryFields) AuditEntry {
+	if want&fieldRemoteAddress == 0 {
+		e.Request.RemoteAddress = ""
+	}
+	if want&fieldMount == 0 {
+		e.Request.MountAccessor, e.Request.MountType = "", ""
+	}
+	if want&fieldRequestData == 0 {
+		e.Request.Data = nil
+	}
+	if want&fieldResponseData == 0 {
+		e.Response.Data = nil
+	}
+	if want&fieldAccessor == 0 {
+		e.Auth.Accessor = ""
+	}
+	if want&fieldEntityID == 0 {
+		e.Auth.EntityID = ""
+	}
+	if want&fieldPolicies == 0 {
+		e.Auth.Policies = nil
+	}
+	return e
+}
+
+// checkDecode compares the scanner with json.Unmarshal on one line, in
+// full and under every projection. The scanner doesn't validate what it
+// skips, so it may accept a line that isn't JSON at all; on any JSON it
+// agrees.
+func checkDecode(t *testing.T, line []byte) {
+	var want AuditEntry
+	werr := json.Unmarshal(line, &want)
+	if werr != nil && !json.Valid(line) {
+		return
+	}
+	for f := entryFields(0); f <= allEntryFields; f++ {
+		got, err := decodeAuditEntryFields(line, f)
+		if (err != nil) != (werr != nil) {
+			t.Fatalf("%q fields %b: err = %v, json.Unmarshal err = %v", line, f, err, werr)
+		}
+		if werr != nil {
+			continue
+		}
+		if exp := project(want, f); !reflect.DeepEqual(got, exp) {
+			t.Fatalf("%q fields %b:\n got %+v\nwant %+v", line, f, got, exp)
+		}
+	}
+}
+
+func TestDecodeAuditEntryMatchesUnmarshal(t *testing.T) {
+	for _, line := range auditCorpus(t) {
+		checkDecode(t, line)
+	}
+}
+
+func FuzzDecodeAuditEntry(f *testing.F) {
+	for _, line := range auditCorpus(f) {
+		f.Add(line)
+	}
+	f.Fuzz(checkDecode)
+}
+
+func TestAuditorProjection(t *testing.T) {
+	a := &auditor{cfg: &VaultConfig{}}
+	if f := a.projection(); f != 0 {
+		t.Errorf("rules only: projection = %b, want base fields only", f)
+	}
+	a.sessions = &sessionIndex{}
+	if f := a.projection(); f != fieldAccessor {
+		t.Errorf("with sessions: projection = %b, want the accessor", f)
+	}
+	a.tokens = &tokenWatcher{}
+	if f := a.projection(); f != allEntryFields {
+		t.Errorf("with the token detectors: projection = %b, want every field", f)
+	}
+}
+
+// Entries a rule matches are decoded again in full, so its templates and
+// alert see the fields the projection left out.
+func TestNeedsFullEntry(t *testing.T) {
+	a := &auditor{cfg: &VaultConfig{}}
+	a.rules.store(compileAlertRules([]AlertRule{{Name: "root", Paths: []string{"sys/policies/acl/root"}, Operations: []string{"update"}}}))
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{`{"type":"response","request":{"path":"sys/policies/acl/root","operation":"update"},"auth":{"entity_id":"e-1"}}`, true},
+		{`{"type":"response","request":{"path":"sys/policies/acl/root","operation":"read"}}`, false},
+		{`{"type":"response","request":{"path":"secret/data/app","operation":"update"}}`, false},
+		{`{"type":"response","request":{"path":"sys/unseal","operation":"update"},"response":{"data":{"sealed":false}}}`, true},
+	}
+	for _, tt := range tests {
+		e, err := decodeAuditEntryFields([]byte(tt.line), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Auth.EntityID != "" || e.Response.Data != nil {
+			t.Errorf("%s: projection decoded optional fields: %+v", tt.line, e)
+		}
+		if got := a.needsFullEntry(&e); got != tt.want {
+			t.Errorf("%s: needsFullEntry = %v, want %v", tt.line, got, tt.want)
+		}
+	}
+}
+
+// benchLine is a response entry with a large body, the case projection is
+// for.
+func benchLine(b *testing.B) []byte {
+	for _, line := range auditCorpus(b) {
+		if len(line) > 4096 {
+			return line
+		}
+	}
+	b.Fatal("no large entry in the corpus")
+	return nil
+}
+
+func BenchmarkDecodeAuditEntry(b *testing.B) {
+	line := benchLine(b)
+	b.Run("unmarshal", func(b *testing.B) {
+		b.SetBytes(int64(len(line)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var e AuditEntry
+			if err := json.Unmarshal(line, &e); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	for _, bc := range []struct {
+		name   string
+		fields entryFields
+	}{
+		{"full", allEntryFields},
+		{"projected", 0},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.SetBytes(int64(len(line)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := decodeAuditEntryFields(line, bc.fields); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Missing Audit Log ---
+
+const (
+	defaultMissingWarnAfter  = time.Minute
+	defaultMissingAlertAfter = 10 * time.Minute
+	auditFileCheckInterval   = 5 * time.Second
+	// auditDeviceProbeInterval is how often sys/audit is read again while
+	// the log stays missing.
+	auditDeviceProbeInterval = 5 * time.Minute
+)
+
+// MissingLogConfig tells a rotation apart from an audit log that is gone.
+// Rotation replaces the file within moments; a log missing for longer
+// usually means the audit device was disabled or pointed elsewhere, and
+// the tail would otherwise wait for it silently.
+type MissingLogConfig struct {
+	WarnAfter  Duration `yaml:"warn_after"`  // local warning
+	AlertAfter Duration `yaml:"alert_after"` // critical alert; /healthz fails
+	// Token, if set, reads sys/audit (it needs sudo there) so the alert
+	// can say whether the device was disabled or moved.
+	Token string `yaml:"token"`
+}
+
+// auditFileStatus is the audit log's presence, shown in /statusz.
+type auditFileStatus struct {
+	Path         string     `json:"path"`
+	Missing      bool       `json:"missing"`
+	MissingSince *time.Time `json:"missing_since,omitempty"`
+	Alerted      bool       `json:"alerted,omitempty"`
+	Device       string     `json:"device,omitempty"` // what sys/audit said last
+	LastGap      float64    `json:"last_gap_seconds,omitempty"`
+	LastGapEnded *time.Time `json:"last_gap_ended,omitempty"`
+}
+
+// auditFileMonitor watches for the audit log disappearing. A nil
+// *auditFileMonitor reports the log as present.
+type auditFileMonitor struct {
+	cfg    *VaultConfig
+	client *http.Client // nil without a token
+
+	mu        sync.Mutex
+	st        auditFileStatus
+	size      int64 // at the last check
+	warned    bool
+	lastProbe time.Time
+}
+
+func newAuditFileMonitor(cfg *VaultConfig) *auditFileMonitor {
+	m := &auditFileMonitor{cfg: cfg, st: auditFileStatus{Path: cfg.AuditLog}}
+	if cfg.MissingLog.Token != "" {
+		client, err := newVaultClient(cfg)
+		if err != nil {
+			logWarn("⚠️  Missing audit log: sys/audit probes disabled: {error}", "error", err)
+		}
+		m.client = client
+	}
+	return m
+}
+
+// run checks the log every few seconds until ctx is done.
+func (m *auditFileMonitor) run(ctx context.Context) error {
+	ticker := time.NewTicker(auditFileCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			m.check(ctx, now)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (m *auditFileMonitor) check(ctx context.Context, now time.Time) {
+	path := live(m.cfg).AuditLog
+	fi, err := os.Stat(path)
+	// Other errors, such as a permission change, aren't a missing file;
+	// the tail reports those itself.
+	missing := errors.Is(err, os.ErrNotExist)
+
+	m.mu.Lock()
+	if m.st.Path != path {
+		// A reload moved audit_log; whatever the old file was up to is
+		// no concern now.
+		m.st, m.warned = auditFileStatus{Path: path}, false
+	}
+	if err == nil {
+		m.size = fi.Size()
+	}
+	st := m.st
+	m.mu.Unlock()
+	if !missing {
+		if st.Missing {
+			m.recovered(now, st)
+		}
+		return
+	}
+	if !st.Missing {
+		st.Missing, st.MissingSince = true, &now
+		metrics.set("audit_log_missing", 1)
+	}
+	gap := now.Sub(*st.MissingSince)
+	if !m.warned && gap >= time.Duration(m.cfg.MissingLog.WarnAfter) {
+		m.warned = true
+		logWarn("⚠️  Audit log {path} has been missing for {gap}, longer than a rotation takes", "path", path, "gap", gap.Round(time.Second))
+	}
+	probe := m.client != nil && (gap >= time.Duration(m.cfg.MissingLog.AlertAfter) && !st.Alerted ||
+		st.Alerted && now.Sub(m.lastProbe) >= auditDeviceProbeInterval)
+	if probe {
+		m.lastProbe = now
+		if device := m.probeDevice(ctx, path); device != st.Device {
+			if st.Alerted {
+				logInfo("🔎 Audit log {path}: {device}", "path", path, "device", device)
+			}
+			st.Device = device
+		}
+	}
+	if !st.Alerted && gap >= time.Duration(m.cfg.MissingLog.AlertAfter) {
+		st.Alerted = true
+		var device localText
+		if st.Device != "" {
+			device = msgAuditLogDevice.with("device", mdText(st.Device, maxPathLen))
+		}
+		logError("🚨 Audit log {path} missing for {gap}", "path", path, "gap", gap.Round(time.Second))
+		notify(m.cfg, Alert{Severity: sevCritical, Color: sevCritical.color(), Rule: "audit-log-missing",
+			Incident: "audit-log-missing:" + path, Time: now}.say(msgAuditLogMissing.with(),
+			msgAuditLogMissingBody.with("path", mdCode(path, maxPathLen), "gap", gap.Round(time.Second), "device", device)))
+	}
+	m.mu.Lock()
+	m.st = st
+	m.mu.Unlock()
+}
+
+var (
+	msgAuditLogMissing     = message("audit-log-missing.title")
+	msgAuditLogMissingBody = message("audit-log-missing.body")
+	msgAuditLogDevice      = message("audit-log-missing.device")
+	msgAuditLogBack        = message("audit-log-missing.back.title")
+	msgAuditLogBackBody    = message("audit-log-missing.back.body")
+)
+
+// recovered ends a gap. The tail reopens the new file from its start, so
+// nothing written to it since is skipped.
+func (m *auditFileMonitor) recovered(now time.Time, st auditFileStatus) {
+	gap := now.Sub(*st.MissingSince)
+	metrics.set("audit_log_missing", 0)
+	metrics.observe("audit_log_gap_seconds", gap.Seconds())
+	if m.warned {
+		logInfo("✅ Audit log {path} is back after {gap}; reading it from the start", "path", st.Path, "gap", gap.Round(time.Second))
+	}
+	if st.Alerted {
+		notify(m.cfg, Alert{Severity: sevInfo, Color: sevInfo.color(), Rule: "audit-log-missing",
+			Incident: "audit-log-missing:" + st.Path, Resolved: true, Time: now}.say(msgAuditLogBack.with(),
+			msgAuditLogBackBody.with("path", mdCode(st.Path, maxPathLen), "gap", gap.Round(time.Second))))
+	}
+	m.warned = false
+	m.mu.Lock()
+	m.st = auditFileStatus{Path: st.Path, LastGap: gap.Seconds(), LastGapEnded: &now}
+	m.mu.Unlock()
+}
+
+// probeDevice describes what sys/audit says about the log's device.
+func (m *auditFileMonitor) probeDevice(ctx context.Context, logPath string) string {
+	ctx, cancel := context.WithTimeout(ctx, m.cfg.Timeouts.of(opAPI))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", m.cfg.Address+"/v1/sys/audit", nil)
+	if err != nil {
+		return "sys/audit: " + err.Error()
+	}
+	req.Header.Set("X-Vault-Token", m.cfg.MissingLog.Token)
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return "sys/audit unreachable: " + err.Error()
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Sprintf("sys/audit returned %d", resp.StatusCode)
+	}
+	// Devices are listed under "data"; older versions also put them at
+	// the top level, next to the request metadata.
+	var devices map[string]json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&devices); err != nil {
+		return "sys/audit: " + err.Error()
+	}
+	if data, ok := devices["data"]; ok {
+		var inner map[string]json.RawMessage
+		if json.Unmarshal(data, &inner) == nil {
+			devices = inner
+		}
+	}
+	var elsewhere []string
+	for path, raw := range devices {
+		var d struct {
+			Type    string            `json:"type"`
+			Options map[string]string `json:"options"`
+		}
+		if !strings.HasSuffix(path, "/") || json.Unmarshal(raw, &d) != nil || d.Type != "file" {
+			continue
+		}
+		if fp := d.Options["file_path"]; fp == logPath {
+			return fmt.Sprintf("device %s is enabled for this file, but it hasn't been recreated", path)
+		} else if fp != "" {
+			elsewhere = append(elsewhere, fp)
+		}
+	}
+	if len(elsewhere) > 0 {
+		sort.Strings(elsewhere)
+		return "the audit device was relocated; file devices now write to " + strings.Join(elsewhere, ", ")
+	}
+	return "the audit device was disabled; no file device is enabled"
+}
+
+// missingFor returns how long the log has been missing past alert_after,
+// for /healthz; zero while it is present or within the threshold.
+func (m *auditFileMonitor) missingFor() time.Duration {
+	if m == nil {
+		return 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.st.Alerted {
+		return 0
+	}
+	return time.Since(*m.st.MissingSince)
+}
+
+// lastSize is the log's size at the last check, so intake can tell
+// having nothing to read from a tail that stopped reading.
+func (m *auditFileMonitor) lastSize() int64 {
+	if m == nil {
+		return 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.size
+}
+
+func (m *auditFileMonitor) status() *auditFileStatus {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := m.st
+	return &st
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// --- Audit Log Position ---
+
+const (
+	defaultPositionFlushInterval = 5 * time.Second
+	defaultPositionFlushLines    = 1000
+	// positionSumBytes is how much of the file before the saved offset is
+	// checksummed, to tell the same file from one truncated and written
+	// again past the offset.
+	positionSumBytes = 256
+)
+
+// PositionConfig saves how far audit mode has read the audit log, so a
+// restart resumes there instead of at the end and events written while
+// the warden was down are still checked. Lines read since the last save
+// are read again after a crash, so alerts are at least once.
+type PositionConfig struct {
+	Path          string   `yaml:"path"`           // default: next to state_file
+	FlushInterval Duration `yaml:"flush_interval"` // the longest a read offset goes unsaved
+	FlushLines    int      `yaml:"flush_lines"`    // lines read between saves
+	Disabled      bool     `yaml:"disabled"`
+}
+
+// Where audit mode starts reading, as given to -from.
+const (
+	startEnd   = "end"
+	startSaved = "saved"
+	startFile  = "start"
+)
+
+// savedPosition is the position file, or with several audit logs one
+// entry of the list it holds.
+type savedPosition struct {
+	Path   string    `json:"path"`
+	Inode  uint64    `json:"inode"`
+	Size   int64     `json:"size"` // of the file when saved
+	Offset int64     `json:"offset"`
+	Sum    string    `json:"sum"` // of up to positionSumBytes before Offset
+	Saved  time.Time `json:"saved"`
+}
+
+// positionTracker saves the tails' offsets every flush_lines lines, every
+// flush_interval and on shutdown.
+type positionTracker struct {
+	cfg   PositionConfig
+	tails *auditTails
+
+	mu    sync.Mutex
+	lines int
+	last  map[string]savedPosition // by path
+}
+
+func newPositionTracker(cfg *VaultConfig) *positionTracker {
+	if cfg.Position.Disabled {
+		return nil
+	}
+	return &positionTracker{cfg: cfg.Position, last: make(map[string]savedPosition)}
+}
+
+// defaultPositionFile puts the position file next to the state file.
+func defaultPositionFile(stateFile string) string {
+	return strings.TrimSuffix(stateFile, filepath.Ext(stateFile)) + ".position.json"
+}
+
+// startOffset is where reading path begins for -from: the saved position
+// when it still belongs to the file, else the end.
+func (p *positionTracker) startOffset(path, from string) (int64, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, fmt.Errorf("audit log not accessible: %w", err)
+	}
+	switch from {
+	case startFile:
+		logInfo("📍 Reading {path} from the start", "path", path)
+		return 0, nil
+	case startEnd:
+		return fi.Size(), nil
+	}
+	if p == nil {
+		return fi.Size(), nil
+	}
+	all, err := loadPositions(p.cfg.Path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return fi.Size(), nil
+	case err != nil:
+		logWarn("⚠️  Audit log position unreadable, reading from the end: {error}", "error", err)
+		return fi.Size(), nil
+	}
+	saved := &all[0]
+	for i := range all {
+		if all[i].Path == path {
+			saved = &all[i]
+		}
+	}
+	if saved.Path != path && len(all) > 1 {
+		// One of several logs, new since the save.
+		return fi.Size(), nil
+	}
+	if why := saved.mismatch(path, fi); why != "" {
+		logWarn("⚠️  Not resuming {path} at offset {offset}: {reason}; reading from the end", "path", path, "offset", saved.Offset, "reason", why)
+		return fi.Size(), nil
+	}
+	logInfo("📍 Resuming {path} at offset {offset}, {behind} behind, saved at {saved}", "path", path, "offset", saved.Offset,
+		"behind", formatBytes(fi.Size()-saved.Offset), "saved", saved.Saved.Format(time.RFC3339))
+	p.mu.Lock()
+	p.last[path] = *saved
+	p.mu.Unlock()
+	return saved.Offset, nil
+}
+
+// mismatch says why the saved position isn't one in the file at path, or
+// "" when reading may resume there.
+func (s *savedPosition) mismatch(path string, fi os.FileInfo) string {
+	switch {
+	case s.Path != path:
+		return fmt.Sprintf("it was saved for %s", s.Path)
+	case fileInode(fi) != s.Inode:
+		return "the file was rotated"
+	case fi.Size() < s.Offset:
+		return "the file was truncated"
+	}
+	sum, err := positionSum(path, s.Offset)
+	if err != nil {
+		return err.Error()
+	}
+	if sum != s.Sum {
+		return "the file was truncated and written again"
+	}
+	return ""
+}
+
+// loadPositions reads the position file: one position, or a list of
+// them when several audit logs are followed.
+func loadPositions(path string) ([]savedPosition, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var all []savedPosition
+	if trimmed := strings.TrimSpace(string(data)); strings.HasPrefix(trimmed, "[") {
+		err = json.Unmarshal(data, &all)
+	} else {
+		all = make([]savedPosition, 1)
+		err = json.Unmarshal(data, &all[0])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if len(all) == 0 {
+		return nil, fmt.Errorf("parse %s: no position", path)
+	}
+	return all, nil
+}
+
+func fileInode(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
+
+// positionSum checksums the bytes of path just before offset.
+func positionSum(path string, offset int64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	from := offset - positionSumBytes
+	if from < 0 {
+		from = 0
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, from, offset-from)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// read counts a line read, saving the position every flush_lines.
+func (p *positionTracker) read() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.lines++
+	due := p.lines >= p.cfg.FlushLines
+	p.mu.Unlock()
+	if due {
+		if err := p.save(); err != nil {
+			logWarn("⚠️  Saving the audit log position failed: {error}", "error", err)
+		}
+	}
+}
+
+// save writes the tails' offsets, unless none has moved since the last
+// save. A file that is missing or was rotated under its tail keeps the
+// position saved last.
+func (p *positionTracker) save() error {
+	if p == nil || p.tails == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lines = 0
+	tails := p.tails.snapshot()
+	all := make([]savedPosition, 0, len(tails))
+	moved := len(tails) != len(p.last)
+	for _, t := range tails {
+		path, offset := t.logPath(), t.position()
+		last, ok := p.last[path]
+		if ok && offset == last.Offset {
+			all = append(all, last)
+			continue
+		}
+		s, err := positionOf(path, offset)
+		if err != nil || s == nil {
+			if ok {
+				all = append(all, last)
+			}
+			if err != nil && len(tails) == 1 {
+				return err
+			}
+			continue
+		}
+		all = append(all, *s)
+		moved = true
+	}
+	if !moved || len(all) == 0 {
+		return nil
+	}
+	var data []byte
+	var err error
+	if len(all) == 1 {
+		data, err = json.MarshalIndent(all[0], "", "  ")
+	} else {
+		data, err = json.MarshalIndent(all, "", "  ")
+	}
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(p.cfg.Path, data, 0o600); err != nil {
+		return err
+	}
+	p.last = make(map[string]savedPosition, len(all))
+	for _, s := range all {
+		p.last[s.Path] = s
+	}
+	metrics.set("audit_position_offset", float64(all[0].Offset))
+	return nil
+}
+
+// positionOf is offset in the file at path as saved, or nil when the
+// file is shorter, i.e. was rotated under the tail, which hasn't
+// reopened it yet.
+func positionOf(path string, offset int64) (*savedPosition, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("audit log not accessible: %w", err)
+	}
+	if fi.Size() < offset {
+		return nil, nil
+	}
+	sum, err := positionSum(path, offset)
+	if err != nil {
+		return nil, err
+	}
+	return &savedPosition{Path: path, Inode: fileInode(fi), Size: fi.Size(), Offset: offset, Sum: sum, Saved: time.Now().UTC()}, nil
+}
+
+// positionJob saves the position once per flush_interval.
+func positionJob(p *positionTracker) jobSpec {
+	return jobSpec{
+		name:    "audit-position",
+		every:   time.Duration(p.cfg.FlushInterval),
+		timeout: 10 * time.Second,
+		run:     func(ctx context.Context) error { return p.save() },
+	}
+}
+
+func validatePosition(cfg *VaultConfig) error {
+	pc := &cfg.Position
+	if pc.Disabled {
+		return nil
+	}
+	if pc.Path == "" {
+		pc.Path = defaultPositionFile(newStateStore(cfg.StateFile).path)
+	}
+	if pc.FlushInterval == 0 {
+		pc.FlushInterval = Duration(defaultPositionFlushInterval)
+	}
+	if pc.FlushInterval < Duration(time.Second) {
+		return &fieldError{"audit_position.flush_interval", "must be at least 1s"}
+	}
+	if pc.FlushLines == 0 {
+		pc.FlushLines = defaultPositionFlushLines
+	}
+	if pc.FlushLines < 0 {
+		return &fieldError{"audit_position.flush_lines", "must be positive"}
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Audit Socket ---
+
+// Where audit mode reads entries from, as given to audit_source; see
+// also auditSourceSyslog.
+const (
+	auditSourceFile   = "file"
+	auditSourceSocket = "socket"
+)
+
+const defaultAuditSocketReadTimeout = 15 * time.Minute
+
+// AuditSocketConfig is where audit_source: socket listens for Vault's
+// socket audit device, e.g.
+//
+//	vault audit enable socket address=127.0.0.1:9090 socket_type=tcp
+//
+// for when there is no audit log file to tail, as in a container.
+type AuditSocketConfig struct {
+	Listen string `yaml:"listen"` // host:port, or the path of a unix socket
+	// ReadTimeout closes a connection nothing was read from for this
+	// long. Vault dials again on its next entry.
+	ReadTimeout Duration `yaml:"read_timeout"`
+}
+
+// unix reports whether Listen is a unix socket path rather than host:port.
+func (c AuditSocketConfig) unix() bool { return strings.Contains(c.Listen, "/") }
+
+// auditConnStatus is one connection from Vault, shown in /statusz.
+type auditConnStatus struct {
+	Remote    string    `json:"remote"`
+	Connected time.Time `json:"connected"`
+	LastLine  time.Time `json:"last_line,omitempty"`
+	Lines     int       `json:"lines"`
+}
+
+type auditSocketStatus struct {
+	Listen      string            `json:"listen"`
+	Connections []auditConnStatus `json:"connections"`
+}
+
+// auditSocket accepts Vault's socket audit device and hands each line to
+// the audit loop. Every connection is read on its own; lines wait for
+// the loop on an unbuffered channel, so a busy or paused loop backs up
+// Vault's writes rather than buffering here.
+type auditSocket struct {
+	cfg   AuditSocketConfig
+	ln    net.Listener
+	lines chan string
+
+	mu    sync.Mutex
+	conns map[net.Conn]*auditConnStatus
+	quit  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// listenAuditSocket opens audit_socket.listen, so a bad address fails the
+// start rather than the first connection. A unix socket left behind by a
+// crashed process is replaced.
+func listenAuditSocket(cfg *VaultConfig) (*auditSocket, error) {
+	sc := cfg.AuditSocket
+	var ln net.Listener
+	var err error
+	if sc.unix() {
+		if err := os.MkdirAll(filepath.Dir(sc.Listen), 0o750); err != nil {
+			return nil, fmt.Errorf("create audit socket dir: %w", err)
+		}
+		if fi, err := os.Lstat(sc.Listen); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(sc.Listen)
+		}
+		if ln, err = net.Listen("unix", sc.Listen); err != nil {
+			return nil, err
+		}
+		// Vault runs as a user of its own; it connects through the group.
+		if err := os.Chmod(sc.Listen, 0o660); err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("chmod audit socket: %w", err)
+		}
+	} else if ln, err = net.Listen("tcp", sc.Listen); err != nil {
+		return nil, err
+	}
+	s := &auditSocket{cfg: sc, ln: ln, lines: make(chan string), conns: make(map[net.Conn]*auditConnStatus), quit: make(chan struct{})}
+	logInfo("📥 Reading Vault's socket audit device on {address}", "address", ln.Addr())
+	return s, nil
+}
+
+// run is the socket's component. It accepts connections until ctx is
+// done or the listener fails, then closes every connection.
+func (s *auditSocket) run(ctx context.Context) error {
+	accepted := make(chan error, 1)
+	go func() { accepted <- s.accept() }()
+	var err error
+	select {
+	case err = <-accepted:
+		err = fmt.Errorf("accept: %w", err)
+	case <-ctx.Done():
+	}
+	s.close()
+	return err
+}
+
+func (s *auditSocket) accept() error {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return err
+		}
+		if tc, ok := conn.(*net.TCPConn); ok {
+			tc.SetKeepAlive(true)
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serve(conn)
+		}()
+	}
+}
+
+// serve reads conn's newline-delimited entries until Vault hangs up, the
+// connection is silent for read_timeout or the socket closes. A line
+// split across reads is put back together first.
+func (s *auditSocket) serve(conn net.Conn) {
+	defer conn.Close()
+	remote := conn.RemoteAddr().String()
+	if remote == "" || remote == "@" {
+		remote = "unix"
+	}
+	st := &auditConnStatus{Remote: remote, Connected: time.Now()}
+	s.mu.Lock()
+	s.conns[conn] = st
+	n := len(s.conns)
+	s.mu.Unlock()
+	metrics.set("audit_socket_connections", float64(n))
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		n := len(s.conns)
+		s.mu.Unlock()
+		metrics.set("audit_socket_connections", float64(n))
+	}()
+	logInfo("🔗 Vault connected to the audit socket from {remote}", "remote", remote)
+
+	timeout := time.Duration(s.cfg.ReadTimeout)
+	err := readAuditLines(deadlineReader{conn, timeout}, func(line []byte) bool {
+		select {
+		case s.lines <- string(line):
+		case <-s.quit:
+			return true
+		}
+		metrics.inc("audit_socket_lines_total")
+		s.mu.Lock()
+		st.LastLine = time.Now()
+		st.Lines++
+		s.mu.Unlock()
+		return false
+	})
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		logInfo("🔌 Closing the audit socket connection from {remote}, silent for {timeout}", "remote", remote, "timeout", timeout)
+	case err != nil:
+		select {
+		case <-s.quit:
+		default:
+			logWarn("🔌 Audit socket connection from {remote} failed: {error}", "remote", remote, "error", err)
+		}
+	default:
+		logInfo("🔌 Vault disconnected from the audit socket ({remote})", "remote", remote)
+	}
+}
+
+// deadlineReader gives each read of conn timeout to return something.
+type deadlineReader struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (r deadlineReader) Read(p []byte) (int, error) {
+	r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	return r.conn.Read(p)
+}
+
+// incoming is the channel of lines for the audit loop; nil (never
+// ready) without a socket.
+func (s *auditSocket) incoming() chan string {
+	if s == nil {
+		return nil
+	}
+	return s.lines
+}
+
+// status lists the connections for /statusz.
+func (s *auditSocket) status() *auditSocketStatus {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := &auditSocketStatus{Listen: s.ln.Addr().String(), Connections: make([]auditConnStatus, 0, len(s.conns))}
+	for _, c := range s.conns {
+		st.Connections = append(st.Connections, *c)
+	}
+	sort.Slice(st.Connections, func(i, j int) bool { return st.Connections[i].Connected.Before(st.Connections[j].Connected) })
+	return st
+}
+
+func (s *auditSocket) close() {
+	close(s.quit)
+	s.ln.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	if s.cfg.unix() {
+		os.Remove(s.cfg.Listen)
+	}
+}
+
+func validateAuditSource(cfg *VaultConfig) error {
+	switch cfg.AuditSource {
+	case "":
+		cfg.AuditSource = auditSourceFile
+	case auditSourceFile, auditSourceSocket, auditSourceSyslog:
+	default:
+		return &fieldError{"audit_source", fmt.Sprintf("%q is not file, socket or syslog", cfg.AuditSource)}
+	}
+	if cfg.AuditSource == auditSourceFile {
+		return nil
+	}
+	if cfg.Forward.Address != "" {
+		return &fieldError{"audit_source", "forward.address spools audit_log, so it needs audit_source: file"}
+	}
+	if cfg.AuditSource == auditSourceSyslog {
+		return validateAuditSyslog(cfg)
+	}
+	sc := &cfg.AuditSocket
+	if sc.Listen == "" {
+		return &fieldError{"audit_socket.listen", "is required with audit_source: socket"}
+	}
+	if !sc.unix() {
+		if _, _, err := net.SplitHostPort(sc.Listen); err != nil {
+			return &fieldError{"audit_socket.listen", fmt.Sprintf("%q is not host:port or a socket path", sc.Listen)}
+		}
+	}
+	if sc.ReadTimeout == 0 {
+		sc.ReadTimeout = Duration(defaultAuditSocketReadTimeout)
+	}
+	if sc.ReadTimeout < Duration(time.Second) {
+		return &fieldError{"audit_socket.read_timeout", "must be at least 1s"}
+	}
+	return nil
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Audit Syslog ---
+
+const auditSourceSyslog = "syslog"
+
+const (
+	syslogUDP = "udp"
+	syslogTCP = "tcp"
+	// maxSyslogFrame bounds one message over TCP; a datagram is bounded
+	// by UDP itself.
+	maxSyslogFrame    = 16 * 1024 * 1024
+	maxSyslogDatagram = 64 * 1024
+)
+
+// AuditSyslogConfig is where audit_source: syslog listens for audit
+// entries relayed by syslog, from Vault's syslog audit device through
+// rsyslog or syslog-ng on each node. Both RFC 3164 and RFC 5424 headers
+// are read; over TCP, frames are newline-delimited or octet-counted
+// (RFC 6587).
+type AuditSyslogConfig struct {
+	Listen    string   `yaml:"listen"`    // host:port, for every protocol
+	Protocols []string `yaml:"protocols"` // udp and/or tcp, default both
+	// ReadTimeout closes a TCP connection nothing was read from for this
+	// long. Relays reconnect on their next message.
+	ReadTimeout Duration `yaml:"read_timeout"`
+}
+
+func (c AuditSyslogConfig) has(protocol string) bool {
+	for _, p := range c.Protocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// syslogLine is the audit entry of one syslog message, and the host that
+// reported it.
+type syslogLine struct {
+	host string
+	line string
+}
+
+type auditSyslogStatus struct {
+	Listen      string            `json:"listen"`
+	Protocols   []string          `json:"protocols"`
+	Connections []auditConnStatus `json:"connections,omitempty"`
+	Datagrams   int               `json:"datagrams"`
+	Malformed   int               `json:"malformed"`
+}
+
+// auditSyslog receives syslog messages over UDP and TCP and hands the
+// audit entry in each to the audit loop. As with the audit socket, lines
+// wait for the loop on an unbuffered channel; over UDP, what the kernel
+// can't buffer meanwhile is lost, as syslog over UDP always may be.
+type auditSyslog struct {
+	cfg   AuditSyslogConfig
+	tcp   net.Listener
+	udp   net.PacketConn
+	lines chan syslogLine
+
+	mu        sync.Mutex
+	conns     map[net.Conn]*auditConnStatus
+	datagrams int
+	malformed int
+	quit      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// listenAuditSyslog binds audit_syslog.listen for each protocol, so a bad
+// or taken address fails the start.
+func listenAuditSyslog(cfg *VaultConfig) (*auditSyslog, error) {
+	sc := cfg.AuditSyslog
+	s := &auditSyslog{cfg: sc, lines: make(chan syslogLine), conns: make(map[net.Conn]*auditConnStatus), quit: make(chan struct{})}
+	var err error
+	if sc.has(syslogUDP) {
+		if s.udp, err = net.ListenPacket("udp", sc.Listen); err != nil {
+			return nil, err
+		}
+	}
+	if sc.has(syslogTCP) {
+		if s.tcp, err = net.Listen("tcp", sc.Listen); err != nil {
+			if s.udp != nil {
+				s.udp.Close()
+			}
+			return nil, err
+		}
+	}
+	logInfo("📥 Reading audit entries from syslog on {address} ({protocols})", "address", sc.Listen, "protocols", strings.Join(sc.Protocols, ", "))
+	return s, nil
+}
+
+// run is the listener's component. It receives until ctx is done or a
+// listener fails, then closes every connection.
+func (s *auditSyslog) run(ctx context.Context) error {
+	failed := make(chan error, 2)
+	if s.udp != nil {
+		go func() { failed <- fmt.Errorf("udp: %w", s.receive()) }()
+	}
+	if s.tcp != nil {
+		go func() { failed <- fmt.Errorf("tcp accept: %w", s.accept()) }()
+	}
+	var err error
+	select {
+	case err = <-failed:
+	case <-ctx.Done():
+	}
+	s.close()
+	return err
+}
+
+// receive reads datagrams, one message each.
+func (s *auditSyslog) receive() error {
+	buf := make([]byte, maxSyslogDatagram)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.datagrams++
+		s.mu.Unlock()
+		if s.offer(append([]byte(nil), buf[:n]...), syslogUDP, remoteHost(addr)) {
+			return nil
+		}
+	}
+}
+
+func (s *auditSyslog) accept() error {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return err
+		}
+		if tc, ok := conn.(*net.TCPConn); ok {
+			tc.SetKeepAlive(true)
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serve(conn)
+		}()
+	}
+}
+
+// serve reads conn's frames until the relay hangs up, the connection is
+// silent for read_timeout, the framing is lost or the listener closes.
+func (s *auditSyslog) serve(conn net.Conn) {
+	defer conn.Close()
+	remote := conn.RemoteAddr().String()
+	st := &auditConnStatus{Remote: remote, Connected: time.Now()}
+	s.mu.Lock()
+	s.conns[conn] = st
+	n := len(s.conns)
+	s.mu.Unlock()
+	metrics.set("audit_syslog_connections", float64(n))
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		n := len(s.conns)
+		s.mu.Unlock()
+		metrics.set("audit_syslog_connections", float64(n))
+	}()
+	logInfo("🔗 Syslog relay connected from {remote}", "remote", remote)
+
+	timeout := time.Duration(s.cfg.ReadTimeout)
+	br := bufio.NewReader(deadlineReader{conn, timeout})
+	host := remoteHost(conn.RemoteAddr())
+	var err error
+	for {
+		var frame []byte
+		if frame, err = readSyslogFrame(br); err != nil {
+			break
+		}
+		if len(bytes.TrimSpace(frame)) == 0 {
+			continue
+		}
+		if s.offer(frame, syslogTCP, host) {
+			return
+		}
+		s.mu.Lock()
+		st.LastLine = time.Now()
+		st.Lines++
+		s.mu.Unlock()
+	}
+	switch {
+	case errors.Is(err, io.EOF):
+		logInfo("🔌 Syslog relay disconnected ({remote})", "remote", remote)
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		logInfo("🔌 Closing the syslog connection from {remote}, silent for {timeout}", "remote", remote, "timeout", timeout)
+	case errors.Is(err, errSyslogFraming):
+		s.countMalformed(syslogTCP)
+		logWarn("🔌 Closing the syslog connection from {remote}: {error}", "remote", remote, "error", err)
+	default:
+		select {
+		case <-s.quit:
+		default:
+			logWarn("🔌 Syslog connection from {remote} failed: {error}", "remote", remote, "error", err)
+		}
+	}
+}
+
+// offer parses a frame and hands its entry to the audit loop; it reports
+// whether the listener is closing. A malformed frame is counted and
+// skipped. The host is the message's own, or the sender's address when
+// the header has none.
+func (s *auditSyslog) offer(frame []byte, protocol, sender string) bool {
+	host, msg, err := parseSyslog(frame)
+	if err != nil {
+		s.countMalformed(protocol)
+		logDebug("🔍 Skipping a malformed syslog message from {remote}: {error}", "remote", sender, "error", err)
+		return false
+	}
+	if host == "" {
+		host = sender
+	}
+	select {
+	case s.lines <- syslogLine{host: host, line: string(msg)}:
+	case <-s.quit:
+		return true
+	}
+	metrics.inc("audit_syslog_messages_total", "protocol", protocol)
+	return false
+}
+
+func (s *auditSyslog) countMalformed(protocol string) {
+	metrics.inc("audit_syslog_malformed_total", "protocol", protocol)
+	s.mu.Lock()
+	s.malformed++
+	s.mu.Unlock()
+}
+
+// remoteHost is the IP of addr, without the port.
+func remoteHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+var errSyslogFraming = errors.New("syslog framing lost")
+
+// readSyslogFrame reads one message off a TCP stream: octet-counted
+// ("LEN SP MSG") when it starts with a digit, else up to the next LF.
+func readSyslogFrame(br *bufio.Reader) ([]byte, error) {
+	first, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] >= '1' && first[0] <= '9' {
+		n := 0
+		for {
+			c, err := br.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if c == ' ' {
+				break
+			}
+			if c < '0' || c > '9' || n > maxSyslogFrame/10 {
+				return nil, fmt.Errorf("%w: bad octet count", errSyslogFraming)
+			}
+			n = n*10 + int(c-'0')
+		}
+		if n > maxSyslogFrame {
+			return nil, fmt.Errorf("%w: %d-byte frame is over %s", errSyslogFraming, n, formatBytes(maxSyslogFrame))
+		}
+		frame := make([]byte, n)
+		if _, err := io.ReadFull(br, frame); err != nil {
+			return nil, err
+		}
+		return frame, nil
+	}
+	var frame []byte
+	for {
+		chunk, err := br.ReadSlice('\n')
+		frame = append(frame, chunk...)
+		if len(frame) > maxSyslogFrame {
+			return nil, fmt.Errorf("%w: line over %s", errSyslogFraming, formatBytes(maxSyslogFrame))
+		}
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case err == io.EOF && len(frame) > 0:
+			return frame, nil
+		case err != nil:
+			return nil, err
+		}
+		return frame, nil
+	}
+}
+
+// parseSyslog splits a syslog message into the reporting host and the
+// message, which should be the audit entry's JSON. An RFC 5424 header
+// has version 1 after the priority; anything else is read as RFC 3164,
+// whose timestamp may be the classic "Jan _2 15:04:05" or RFC 3339.
+func parseSyslog(frame []byte) (host string, msg []byte, err error) {
+	frame = bytes.TrimRight(frame, "\r\n\x00")
+	end := bytes.IndexByte(frame, '>')
+	if len(frame) == 0 || frame[0] != '<' || end < 2 || end > 4 {
+		return "", nil, errors.New("no <priority>")
+	}
+	if pri, err := strconv.Atoi(string(frame[1:end])); err != nil || pri > 191 {
+		return "", nil, fmt.Errorf("bad priority %q", frame[1:end])
+	}
+	rest := frame[end+1:]
+	if bytes.HasPrefix(rest, []byte("1 ")) {
+		host, msg, err = parseSyslog5424(rest[2:])
+	} else {
+		host, msg, err = parseSyslog3164(rest)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if host == "-" {
+		host = ""
+	}
+	if len(bytes.TrimSpace(msg)) == 0 {
+		return "", nil, errors.New("empty message")
+	}
+	return host, msg, nil
+}
+
+// syslogField cuts the next space-delimited field off b.
+func syslogField(b []byte) (field, rest []byte, ok bool) {
+	i := bytes.IndexByte(b, ' ')
+	if i <= 0 {
+		return nil, nil, false
+	}
+	return b[:i], b[i+1:], true
+}
+
+// parseSyslog5424 reads TIMESTAMP HOSTNAME APP-NAME PROCID MSGID
+// STRUCTURED-DATA [MSG].
+func parseSyslog5424(b []byte) (string, []byte, error) {
+	var fields [5][]byte
+	for i := range fields {
+		var ok bool
+		if fields[i], b, ok = syslogField(b); !ok {
+			return "", nil, errors.New("short RFC 5424 header")
+		}
+	}
+	switch {
+	case bytes.HasPrefix(b, []byte("-")):
+		b = b[1:]
+	case bytes.HasPrefix(b, []byte("[")):
+		// Elements run to an unescaped ']'; several may follow each other.
+		for len(b) > 0 && b[0] == '[' {
+			j := 1
+			for ; j < len(b) && b[j] != ']'; j++ {
+				if b[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(b) {
+				return "", nil, errors.New("unterminated structured data")
+			}
+			b = b[j+1:]
+		}
+	default:
+		return "", nil, errors.New("no structured data")
+	}
+	if len(b) > 0 && b[0] != ' ' {
+		return "", nil, errors.New("no space before the message")
+	}
+	b = bytes.TrimPrefix(bytes.TrimPrefix(b, []byte(" ")), []byte("\xEF\xBB\xBF"))
+	return string(fields[1]), b, nil
+}
+
+// parseSyslog3164 reads TIMESTAMP HOSTNAME TAG: MSG. A relay that left
+// the hostname out has the tag right after the timestamp.
+func parseSyslog3164(b []byte) (string, []byte, error) {
+	switch {
+	case len(b) > 16 && b[0] >= 'A' && b[0] <= 'Z' && b[3] == ' ' && b[15] == ' ':
+		if _, err := time.Parse(time.Stamp, string(b[:15])); err != nil {
+			return "", nil, fmt.Errorf("bad timestamp %q", b[:15])
+		}
+		b = b[16:]
+	case len(b) > 0 && b[0] >= '0' && b[0] <= '9':
+		ts, rest, ok := syslogField(b)
+		if !ok {
+			return "", nil, errors.New("no hostname")
+		}
+		if _, err := time.Parse(time.RFC3339Nano, string(ts)); err != nil {
+			return "", nil, fmt.Errorf("bad timestamp %q", ts)
+		}
+		b = rest
+	default:
+		return "", nil, errors.New("no timestamp")
+	}
+	host := ""
+	if field, rest, ok := syslogField(b); ok && !bytes.HasSuffix(field, []byte(":")) && !bytes.ContainsAny(field, "[{") {
+		host, b = string(field), rest
+	}
+	// The entry starts after TAG: or, without a tag, at its brace.
+	brace, colon := bytes.IndexByte(b, '{'), bytes.Index(b, []byte(": "))
+	switch {
+	case colon >= 0 && (brace < 0 || colon < brace):
+		b = b[colon+2:]
+	case brace >= 0:
+		b = b[brace:]
+	}
+	return host, b, nil
+}
+
+// incoming is the channel of lines for the audit loop; nil (never
+// ready) without a listener.
+func (s *auditSyslog) incoming() chan syslogLine {
+	if s == nil {
+		return nil
+	}
+	return s.lines
+}
+
+// status is the listener for /statusz.
+func (s *auditSyslog) status() *auditSyslogStatus {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := &auditSyslogStatus{Listen: s.cfg.Listen, Protocols: s.cfg.Protocols, Datagrams: s.datagrams, Malformed: s.malformed}
+	for _, c := range s.conns {
+		st.Connections = append(st.Connections, *c)
+	}
+	sort.Slice(st.Connections, func(i, j int) bool { return st.Connections[i].Connected.Before(st.Connections[j].Connected) })
+	return st
+}
+
+func (s *auditSyslog) close() {
+	close(s.quit)
+	if s.udp != nil {
+		s.udp.Close()
+	}
+	if s.tcp != nil {
+		s.tcp.Close()
+	}
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func validateAuditSyslog(cfg *VaultConfig) error {
+	sc := &cfg.AuditSyslog
+	if sc.Listen == "" {
+		return &fieldError{"audit_syslog.listen", "is required with audit_source: syslog"}
+	}
+	if _, _, err := net.SplitHostPort(sc.Listen); err != nil {
+		return &fieldError{"audit_syslog.listen", fmt.Sprintf("%q is not host:port", sc.Listen)}
+	}
+	if len(sc.Protocols) == 0 {
+		sc.Protocols = []string{syslogUDP, syslogTCP}
+	}
+	for _, p := range sc.Protocols {
+		if p != syslogUDP && p != syslogTCP {
+			return &fieldError{"audit_syslog.protocols", fmt.Sprintf("%q is not udp or tcp", p)}
+		}
+	}
+	if sc.ReadTimeout == 0 {
+		sc.ReadTimeout = Duration(defaultAuditSocketReadTimeout)
+	}
+	if sc.ReadTimeout < Duration(time.Second) {
+		return &fieldError{"audit_syslog.read_timeout", "must be at least 1s"}
+	}
+	return nil
+}
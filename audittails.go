@@ -0,0 +1,487 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nxadm/tail"
+	"gopkg.in/yaml.v3"
+)
+
+// --- Multiple Audit Logs ---
+
+const (
+	defaultDedupWindow = 30 * time.Second
+	// auditRescanInterval is how often audit_log's glob patterns are
+	// matched again, for files created since, and its files checked for
+	// one gone missing.
+	auditRescanInterval = 10 * time.Second
+)
+
+// auditLogList is audit_log: a path or glob pattern, such as
+// /var/log/vault/audit-*.log, or a list of them.
+type auditLogList []string
+
+func (l *auditLogList) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		*l = nil
+		if n.Value != "" {
+			*l = auditLogList{n.Value}
+		}
+		return nil
+	}
+	var list []string
+	if err := n.Decode(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// MarshalYAML keeps a single file a plain string, as it was written.
+func (l auditLogList) MarshalYAML() (interface{}, error) {
+	if len(l) == 1 {
+		return l[0], nil
+	}
+	return []string(l), nil
+}
+
+// DedupConfig drops an audit entry another of the audit logs had within
+// Window, as redundant audit devices each write every request.
+type DedupConfig struct {
+	Window   Duration `yaml:"window"`
+	Disabled bool     `yaml:"disabled"`
+}
+
+func isGlob(p string) bool { return strings.ContainsAny(p, "*?[") }
+
+// several reports whether audit_log may name more than one file, in which
+// case alerts and log lines say which file they came from.
+func (l auditLogList) several() bool {
+	return len(l) > 1 || len(l) == 1 && isGlob(l[0])
+}
+
+// resolveAuditLogs expands patterns into files, in order and without
+// repeats. A plain path is kept even while it doesn't exist.
+func resolveAuditLogs(patterns []string) []string {
+	var files []string
+	seen := make(map[string]bool)
+	for _, p := range patterns {
+		matches := []string{p}
+		if isGlob(p) {
+			matches, _ = filepath.Glob(p) // validated at load
+		}
+		for _, m := range matches {
+			if !seen[m] {
+				seen[m] = true
+				files = append(files, m)
+			}
+		}
+	}
+	return files
+}
+
+// tailLine is a line one of the tails read.
+type tailLine struct {
+	tail *auditTail
+	line *tail.Line
+}
+
+// auditTails follows every file audit_log names, one auditTail each, and
+// merges their lines for intake. Each tail follows its own file through
+// rotations; one that goes missing is warned about while the others carry
+// on. The first tail is the primary: the intake pause and the
+// missing-log monitor watch its file.
+type auditTails struct {
+	cfg      *VaultConfig
+	position *positionTracker
+	out      chan tailLine
+	done     chan struct{}
+
+	mu       sync.Mutex
+	patterns []string
+	tails    []*auditTail
+	stops    map[*auditTail]chan struct{}
+	skipped  map[string]bool      // files that couldn't be followed, warned about
+	missing  map[string]time.Time // followed files gone, since
+	warned   map[string]bool
+}
+
+// openAuditTails starts a tail on each file of audit_log, each at the
+// offset -from and its saved position give. Files that can't be followed
+// are warned about and tried again by the rescan, unless there is no file
+// to follow at all.
+func openAuditTails(cfg *VaultConfig, p *positionTracker, from string) (*auditTails, error) {
+	s := &auditTails{cfg: cfg, position: p, out: make(chan tailLine), done: make(chan struct{}), patterns: cfg.AuditLogs,
+		stops: make(map[*auditTail]chan struct{}), skipped: make(map[string]bool), missing: make(map[string]time.Time), warned: make(map[string]bool)}
+	files := resolveAuditLogs(cfg.AuditLogs)
+	var firstErr error
+	for _, path := range files {
+		offset, err := p.startOffset(path, from)
+		var t *auditTail
+		if err == nil {
+			t, err = openAuditTail(path, offset)
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			if len(files) > 1 {
+				logWarn("⚠️  Not following {path} for now: {error}", "path", path, "error", err)
+			}
+			s.skipped[path] = true
+			continue
+		}
+		s.add(t)
+	}
+	switch {
+	case len(s.tails) > 0:
+	case firstErr != nil:
+		return nil, firstErr
+	default:
+		return nil, fmt.Errorf("audit_log %s matches no file", strings.Join(cfg.AuditLogs, ", "))
+	}
+	if p != nil {
+		p.tails = s
+	}
+	return s, nil
+}
+
+// add starts passing t's lines on; s.mu need not be held.
+func (s *auditTails) add(t *auditTail) {
+	stop := make(chan struct{})
+	s.mu.Lock()
+	s.tails = append(s.tails, t)
+	s.stops[t] = stop
+	s.mu.Unlock()
+	go s.pump(t, stop)
+}
+
+// pump passes t's lines to intake. Lines block here while intake is
+// paused, and with them the tail.
+func (s *auditTails) pump(t *auditTail, stop chan struct{}) {
+	for {
+		for line := range t.lines() {
+			select {
+			case s.out <- tailLine{t, line}:
+			case <-stop:
+				return
+			case <-s.done:
+				return
+			}
+		}
+		// Closed: the watchdog reopened the tail, or it was stopped.
+		select {
+		case <-stop:
+			return
+		case <-s.done:
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// lines is the channel of lines for the audit loop; nil (never ready)
+// without tails.
+func (s *auditTails) lines() chan tailLine {
+	if s == nil {
+		return nil
+	}
+	return s.out
+}
+
+// caughtUp reports whether the primary has read up to size.
+func (s *auditTails) caughtUp(size int64) bool {
+	return s == nil || s.primary().position() >= size
+}
+
+func (s *auditTails) snapshot() []*auditTail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*auditTail(nil), s.tails...)
+}
+
+func (s *auditTails) primary() *auditTail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tails[0]
+}
+
+// label is the file a line of t came from, for alerts and log lines, or
+// "" when audit_log names a single file.
+func (s *auditTails) label(t *auditTail) string {
+	if !auditLogList(s.patterns).several() {
+		return ""
+	}
+	return t.logPath()
+}
+
+// reopen is the reader watchdog's heal: every tail is reopened. It fails
+// only when none could be.
+func (s *auditTails) reopen() error {
+	var firstErr error
+	ok := 0
+	for _, t := range s.snapshot() {
+		if err := t.reopen(); err != nil {
+			firstErr = err
+			logWarn("⚠️  Reopening {path} failed: {error}", "path", t.logPath(), "error", err)
+			continue
+		}
+		ok++
+	}
+	if ok == 0 {
+		return firstErr
+	}
+	return nil
+}
+
+// retarget follows the files of patterns instead, for a reload that
+// changed audit_log: files new to it are read from their end and those
+// it dropped are let go. When none of the new files can be opened, the
+// old tails are left running.
+func (s *auditTails) retarget(patterns []string) error {
+	files := resolveAuditLogs(patterns)
+	want := make(map[string]bool, len(files))
+	for _, f := range files {
+		want[f] = true
+	}
+	have := make(map[string]*auditTail)
+	for _, t := range s.snapshot() {
+		have[t.logPath()] = t
+	}
+	var opened []*auditTail
+	var firstErr error
+	for _, path := range files {
+		if have[path] != nil {
+			continue
+		}
+		fi, err := os.Stat(path)
+		var t *auditTail
+		if err == nil {
+			t, err = openAuditTail(path, fi.Size())
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("audit log not accessible: %w", err)
+			}
+			continue
+		}
+		opened = append(opened, t)
+	}
+	kept := 0
+	for path := range have {
+		if want[path] {
+			kept++
+		}
+	}
+	if kept+len(opened) == 0 {
+		if firstErr == nil {
+			firstErr = fmt.Errorf("audit_log %s matches no file", strings.Join(patterns, ", "))
+		}
+		return firstErr
+	}
+
+	s.mu.Lock()
+	s.patterns = patterns
+	var tails []*auditTail
+	var dropped []*auditTail
+	for _, t := range s.tails {
+		if want[t.logPath()] {
+			tails = append(tails, t)
+		} else {
+			dropped = append(dropped, t)
+			close(s.stops[t])
+			delete(s.stops, t)
+		}
+	}
+	s.tails = tails
+	s.skipped = make(map[string]bool)
+	s.mu.Unlock()
+	for _, t := range dropped {
+		logInfo("🔁 No longer following {path}", "path", t.logPath())
+		go t.stop()
+	}
+	for _, t := range opened {
+		s.add(t)
+		logInfo("🔁 Audit log is now {path}", "path", t.logPath())
+	}
+	if firstErr != nil {
+		logWarn("⚠️  {error}", "error", firstErr)
+	}
+	return nil
+}
+
+// rescan follows the files matched since, from their start as they are
+// new, and warns once about a followed file that has been missing for
+// longer than a rotation takes. The missing-log monitor watches the
+// primary's file already.
+func (s *auditTails) rescan(now time.Time) {
+	s.mu.Lock()
+	patterns := s.patterns
+	s.mu.Unlock()
+	followed := make(map[string]bool)
+	for i, t := range s.snapshot() {
+		followed[t.logPath()] = true
+		if i > 0 {
+			s.checkMissing(t.logPath(), now)
+		}
+	}
+	for _, path := range resolveAuditLogs(patterns) {
+		if followed[path] {
+			continue
+		}
+		t, err := openAuditTail(path, 0)
+		if err != nil {
+			s.mu.Lock()
+			warn := !s.skipped[path]
+			s.skipped[path] = true
+			s.mu.Unlock()
+			if warn {
+				logWarn("⚠️  Not following {path} for now: {error}", "path", path, "error", err)
+			}
+			continue
+		}
+		s.add(t)
+		logInfo("📄 Following {path}", "path", path)
+	}
+}
+
+func (s *auditTails) checkMissing(path string, now time.Time) {
+	_, err := os.Stat(path)
+	gone := errors.Is(err, os.ErrNotExist)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	since, was := s.missing[path]
+	switch {
+	case gone && !was:
+		s.missing[path] = now
+	case gone && !s.warned[path] && now.Sub(since) >= time.Duration(s.cfg.MissingLog.WarnAfter):
+		s.warned[path] = true
+		logWarn("⚠️  Audit log {path} has been missing for {gap}; following the others", "path", path, "gap", now.Sub(since).Round(time.Second))
+	case !gone && was:
+		if s.warned[path] {
+			logInfo("✓ Audit log {path} is back after {gap}; reading it from the start", "path", path, "gap", now.Sub(since).Round(time.Second))
+		}
+		delete(s.missing, path)
+		delete(s.warned, path)
+	}
+}
+
+func auditRescanJob(s *auditTails) jobSpec {
+	return jobSpec{
+		name:    "audit-rescan",
+		every:   auditRescanInterval,
+		timeout: 10 * time.Second,
+		run: func(ctx context.Context) error {
+			s.rescan(time.Now())
+			return nil
+		},
+	}
+}
+
+// auditTailStatus is one followed file in /statusz.
+type auditTailStatus struct {
+	Path    string `json:"path"`
+	Offset  int64  `json:"offset"`
+	Missing bool   `json:"missing,omitempty"`
+}
+
+func (s *auditTails) status() []auditTailStatus {
+	if s == nil || !auditLogList(s.patterns).several() {
+		return nil
+	}
+	var out []auditTailStatus
+	for _, t := range s.snapshot() {
+		s.mu.Lock()
+		_, missing := s.missing[t.logPath()]
+		s.mu.Unlock()
+		out = append(out, auditTailStatus{Path: t.logPath(), Offset: t.position(), Missing: missing})
+	}
+	return out
+}
+
+func (s *auditTails) stop() {
+	close(s.done)
+	for _, t := range s.snapshot() {
+		t.stop()
+	}
+}
+
+// auditDedup remembers the entries read lately, by type and request ID,
+// so the copy another audit log has of one is dropped. Intake is its only
+// caller.
+type auditDedup struct {
+	window time.Duration
+	seen   map[string]time.Time
+	order  []dedupEntry // oldest first
+}
+
+type dedupEntry struct {
+	key string
+	at  time.Time
+}
+
+func newAuditDedup(cfg *VaultConfig) *auditDedup {
+	if !cfg.AuditLogs.several() || cfg.AuditDedup.Disabled {
+		return nil
+	}
+	return &auditDedup{window: time.Duration(cfg.AuditDedup.Window), seen: make(map[string]time.Time)}
+}
+
+// duplicate reports whether e was read within the window, and otherwise
+// remembers it. Entries without a request ID are told apart by their
+// text.
+func (d *auditDedup) duplicate(e *AuditEntry, line string, now time.Time) bool {
+	if d == nil {
+		return false
+	}
+	for len(d.order) > 0 && now.Sub(d.order[0].at) > d.window {
+		if old := d.order[0]; d.seen[old.key] == old.at {
+			delete(d.seen, old.key)
+		}
+		d.order = d.order[1:]
+	}
+	key := e.Type + "\x00" + e.Request.ID
+	if e.Request.ID == "" {
+		sum := sha256.Sum256([]byte(line))
+		key = string(sum[:])
+	}
+	if at, ok := d.seen[key]; ok && now.Sub(at) <= d.window {
+		return true
+	}
+	d.seen[key] = now
+	d.order = append(d.order, dedupEntry{key, now})
+	return false
+}
+
+func validateAuditLogs(cfg *VaultConfig) error {
+	for i, p := range cfg.AuditLogs {
+		if p == "" {
+			return &fieldError{fmt.Sprintf("audit_log[%d]", i), "must not be empty"}
+		}
+		if _, err := filepath.Match(p, ""); err != nil {
+			return &fieldError{fmt.Sprintf("audit_log[%d]", i), fmt.Sprintf("%q is not a valid glob pattern", p)}
+		}
+	}
+	cfg.AuditLog = ""
+	if files := resolveAuditLogs(cfg.AuditLogs); len(files) > 0 {
+		cfg.AuditLog = files[0]
+	} else if len(cfg.AuditLogs) > 0 {
+		cfg.AuditLog = cfg.AuditLogs[0]
+	}
+	dc := &cfg.AuditDedup
+	if dc.Window == 0 {
+		dc.Window = Duration(defaultDedupWindow)
+	}
+	if dc.Window < 0 {
+		return &fieldError{"audit_dedup.window", "must be positive"}
+	}
+	return nil
+}
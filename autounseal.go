@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// --- Auto-Unseal Watch ---
+
+const (
+	defaultAutoUnsealInterval = 30 * time.Second
+	// autoUnsealConfirmDelay is how soon a sealed reading is checked
+	// again. Keys are only sent after two readings in a row agree, so a
+	// status endpoint flapping between calls doesn't trigger an unseal.
+	autoUnsealConfirmDelay = 2 * time.Second
+	// More than autoUnsealBurst unseals within flapWindow means something
+	// keeps sealing the cluster; unsealing it again is held until the
+	// window has passed.
+	autoUnsealBurst = 3
+)
+
+// autoUnsealer polls one cluster and unseals it whenever it is found
+// sealed, for unlock -watch. Only its own goroutine touches it.
+type autoUnsealer struct {
+	cfg      *VaultConfig
+	label    string
+	client   *http.Client
+	interval time.Duration
+	opts     unlockOptions
+
+	failures     int       // probes in a row that failed
+	sealedSince  time.Time // first reading of the current seal; zero while unsealed
+	lastUnsealed time.Time // last reading that was unsealed
+	attempts     int       // failed unseals in the current seal
+	unseals      []time.Time
+	held         bool
+}
+
+// watchUnlock keeps the clusters unsealed until SIGINT or SIGTERM. On
+// SIGHUP, reload swaps in where notifications go.
+func watchUnlock(targets []*VaultConfig, interval time.Duration, opts unlockOptions, reload *configReloader) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+	defer reload.stop()
+
+	opts.summarized = true // each auto-unseal sends its own message
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		reload.run(ctx)
+	}()
+	for _, t := range targets {
+		client, err := newVaultClient(t)
+		if err != nil {
+			return fmt.Errorf("%s: %w", clusterLabel(t), err)
+		}
+		u := &autoUnsealer{cfg: t, label: clusterLabel(t), client: client, interval: interval, opts: opts}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			u.run(ctx)
+		}()
+	}
+	if addr := targets[0].MetricsListen; addr != "" {
+		// Listening before readiness is reported, so a unit ordered
+		// after this one finds the endpoint up.
+		if l, err := listenMetrics(addr); err != nil {
+			logWarn("⚠️  Metrics: {error}", "error", err)
+		} else {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := serveMetrics(ctx, l); err != nil {
+					logWarn("⚠️  Metrics: {error}", "error", err)
+				}
+			}()
+		}
+	}
+	logInfo("👁️  Watching {clusters} cluster(s) every {interval}; unsealing when sealed", "clusters", len(targets), "interval", formatDuration(interval))
+	sd := newSDNotifier()
+	status := func() string {
+		return fmt.Sprintf("Watching %d cluster(s) every %s", len(targets), formatDuration(interval))
+	}
+	if sd != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sd.keepalive(ctx, alwaysHealthy, status)
+		}()
+	}
+	sd.ready(status())
+
+	<-sigChan
+	logInfo("\n🛑 Shutting down gracefully...")
+	sd.stopping()
+	cancel()
+	// An unseal in progress finishes rather than stopping between shares.
+	wg.Wait()
+	return nil
+}
+
+func (u *autoUnsealer) run(ctx context.Context) {
+	next := time.Duration(0)
+	for {
+		timer := time.NewTimer(next)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		next = u.step(ctx)
+	}
+}
+
+// step probes once, unseals if needed, and returns when to probe next.
+func (u *autoUnsealer) step(ctx context.Context) time.Duration {
+	pctx, cancel := context.WithTimeout(ctx, u.cfg.Timeouts.of(opHealth))
+	status, err := fetchSealStatusContext(pctx, u.client, u.cfg.Address)
+	cancel()
+	if ctx.Err() != nil {
+		return 0
+	}
+	if err != nil {
+		if u.failures++; u.failures == 1 {
+			logWarn("📡 {cluster} unreachable: {error}; backing off", "cluster", u.label, "error", err)
+		}
+		return u.backoff(u.failures)
+	}
+	if u.failures > 0 {
+		logInfo("📡 {cluster} reachable again after {failures} failed probes", "cluster", u.label, "failures", u.failures)
+		u.failures = 0
+	}
+	recordSealState(u.label, status.Sealed)
+
+	now := time.Now()
+	if !status.Sealed {
+		if !u.sealedSince.IsZero() {
+			logInfo("✓ {cluster} reports unsealed again; no keys were sent", "cluster", u.label)
+		}
+		u.sealedSince, u.lastUnsealed, u.attempts = time.Time{}, now, 0
+		return jitter(u.interval)
+	}
+	if u.sealedSince.IsZero() {
+		u.sealedSince = now
+		logInfo("🔒 {cluster} reports sealed; checking again in {delay}", "cluster", u.label, "delay", formatDuration(autoUnsealConfirmDelay))
+		return autoUnsealConfirmDelay
+	}
+	if u.holding(now) {
+		return jitter(u.interval)
+	}
+
+	var approval unsealApproval
+	opts := u.opts
+	opts.approval = &approval
+	outcome, err := unlockCluster(u.cfg, opts)
+	if err != nil {
+		// An unseal that wasn't approved has been notified as such.
+		var ee *exitError
+		if u.attempts++; u.attempts == 1 && !(errors.As(err, &ee) && ee.code == exitNotApproved) {
+			logError("❌ {cluster}: auto-unseal failed: {error}", "cluster", u.label, "error", err)
+			notify(u.cfg, Alert{Severity: sevWarning, Color: sevWarning.color(), Rule: "auto-unseal", Topology: takeTopology(u.cfg)}.say(
+				msgAutoUnsealFailed.with("cluster", cleanField(u.label, maxNameLen)),
+				msgAutoUnsealFailedBody.with("address", mdCode(u.cfg.Address, maxPathLen), "error", mdText(err.Error(), maxPathLen))))
+		} else {
+			logError("❌ {cluster}: auto-unseal failed (attempt {attempts}): {error}", "cluster", u.label, "attempts", u.attempts, "error", err)
+		}
+		return u.backoff(u.attempts)
+	}
+	if outcome == unlockUnsealed {
+		u.unseals = append(u.unseals, now)
+		metrics.inc("auto_unseals_total", "cluster", u.label)
+		recordSealState(u.label, false)
+		notify(u.cfg, Alert{Severity: sevInfo, Color: 0x2ecc71, Rule: "auto-unseal", Approvals: approval.list()}.say(
+			msgAutoUnsealed.with("cluster", cleanField(u.label, maxNameLen)),
+			msgAutoUnsealedBody.with("address", mdCode(u.cfg.Address, maxPathLen), "sealed_for", u.sealedFor(time.Now()),
+				"approval", approval.text())))
+	}
+	u.sealedSince, u.lastUnsealed, u.attempts = time.Time{}, time.Now(), 0
+	return jitter(u.interval)
+}
+
+// sealedFor describes how long the cluster was sealed. It went sealed
+// between the last unsealed reading and the first sealed one.
+func (u *autoUnsealer) sealedFor(now time.Time) localText {
+	var most localText
+	if !u.lastUnsealed.IsZero() {
+		most = msgSealedAtMost.with("duration", formatDuration(now.Sub(u.lastUnsealed).Round(time.Second)))
+	}
+	return msgSealedFor.with("duration", formatDuration(now.Sub(u.sealedSince).Round(time.Second)), "at_most", most)
+}
+
+var (
+	msgAutoUnsealFailed     = message("auto-unseal.failed.title")
+	msgAutoUnsealFailedBody = message("auto-unseal.failed.body")
+	msgAutoUnsealed         = message("auto-unseal.unsealed.title")
+	msgAutoUnsealedBody     = message("auto-unseal.unsealed.body")
+	msgSealedFor            = message("auto-unseal.unsealed.sealed_for")
+	msgSealedAtMost         = message("auto-unseal.unsealed.at_most")
+	msgAutoUnsealHeld       = message("auto-unseal.held.title")
+	msgAutoUnsealHeldBody   = message("auto-unseal.held.body")
+)
+
+// holding reports whether unseals are held because of too many recent
+// ones, saying so once when the hold starts and ends.
+func (u *autoUnsealer) holding(now time.Time) bool {
+	cutoff := now.Add(-flapWindow)
+	kept := u.unseals[:0]
+	for _, t := range u.unseals {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	u.unseals = kept
+
+	switch {
+	case !u.held && len(u.unseals) >= autoUnsealBurst:
+		u.held = true
+		resume := u.unseals[0].Add(flapWindow)
+		logInfo("〰️  {cluster}: sealed again after {unseals} auto-unseals in {window}; holding until {until}", "cluster", u.label, "unseals", len(u.unseals), "window", formatDuration(flapWindow), "until", resume.Format(time.RFC3339))
+		notify(u.cfg, Alert{Severity: sevCritical, Color: sevCritical.color(), Rule: "auto-unseal"}.say(
+			msgAutoUnsealHeld.with("cluster", cleanField(u.label, maxNameLen)),
+			msgAutoUnsealHeldBody.with("address", mdCode(u.cfg.Address, maxPathLen), "unseals", len(u.unseals),
+				"window", formatDuration(flapWindow), "until", resume.UTC().Format(time.RFC3339))))
+	case u.held && len(u.unseals) < autoUnsealBurst:
+		u.held = false
+		logInfo("〰️  {cluster}: auto-unseal resumed", "cluster", u.label)
+	}
+	return u.held
+}
+
+// backoff doubles the interval for each failure in a row, up to
+// watch.max_backoff (5m unless set).
+func (u *autoUnsealer) backoff(failures int) time.Duration {
+	d, limit := u.interval, time.Duration(u.cfg.Watch.MaxBackoff)
+	if limit == 0 {
+		limit = defaultWatchMaxBackoff
+	}
+	if limit < d {
+		limit = d
+	}
+	for i := 1; i < failures && d < limit; i++ {
+		d *= 2
+	}
+	if d > limit {
+		d = limit
+	}
+	return jitter(d)
+}
+
+// jitter spreads d by up to a tenth either way, so wardens restarted
+// together don't probe in lockstep.
+func jitter(d time.Duration) time.Duration {
+	spread := int64(d / 10)
+	if spread <= 0 {
+		return d
+	}
+	return d - time.Duration(spread) + time.Duration(rand.Int63n(2*spread))
+}
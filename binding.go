@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// --- Cluster Binding ---
+
+// clusterBinding ties a state file, and the keys configured with it, to
+// the cluster they were first used to unseal. Vault only reports the
+// cluster ID once unsealed, so a sealed node is checked against the seal
+// configuration, and against the ID when another node is unsealed.
+type clusterBinding struct {
+	ClusterID   string    `json:"cluster_id"`
+	ClusterName string    `json:"cluster_name,omitempty"`
+	SealType    string    `json:"seal_type,omitempty"`
+	Shares      int       `json:"shares"`
+	Threshold   int       `json:"threshold"`
+	StorageType string    `json:"storage_type,omitempty"`
+	Recorded    time.Time `json:"recorded"`
+}
+
+func (b *clusterBinding) String() string {
+	s := b.ClusterID
+	if b.ClusterName != "" {
+		s += " (" + b.ClusterName + ")"
+	}
+	return s
+}
+
+// describe is String with the seal configuration, which may be all that
+// changed.
+func (b *clusterBinding) describe() string {
+	return fmt.Sprintf("%s, %s seal %d/%d, storage %s", b, b.SealType, b.Threshold, b.Shares, b.StorageType)
+}
+
+// bindingOf is the binding a seal status of an unsealed node describes.
+func bindingOf(st *VaultStatus) *clusterBinding {
+	return &clusterBinding{ClusterID: st.ClusterID, ClusterName: st.ClusterName, SealType: st.Type,
+		Shares: st.Shares, Threshold: st.Threshold, StorageType: st.StorageType, Recorded: time.Now().UTC()}
+}
+
+// mismatch describes how what a sealed node reports, and the cluster ID
+// of any unsealed peer, differ from b; "" if nothing does.
+func (b *clusterBinding) mismatch(seal *VaultStatus, peerID string) string {
+	if peerID != "" && peerID != b.ClusterID {
+		return fmt.Sprintf("an unsealed node reports cluster ID %s", peerID)
+	}
+	if seal == nil {
+		return ""
+	}
+	var diffs []string
+	diff := func(name string, bound, live interface{}, set bool) {
+		if set && bound != live {
+			diffs = append(diffs, fmt.Sprintf("%s %v instead of %v", name, live, bound))
+		}
+	}
+	diff("seal type", b.SealType, seal.Type, b.SealType != "" && seal.Type != "")
+	diff("key shares", b.Shares, seal.Shares, b.Shares > 0 && seal.Shares > 0)
+	diff("threshold", b.Threshold, seal.Threshold, b.Threshold > 0 && seal.Threshold > 0)
+	diff("storage", b.StorageType, seal.StorageType, b.StorageType != "" && seal.StorageType != "")
+	if len(diffs) == 0 {
+		return ""
+	}
+	return "the node reports " + strings.Join(diffs, ", ")
+}
+
+// peerClusterID asks the cluster's other nodes for the cluster ID, which
+// only unsealed nodes report. It returns "" when none does.
+func peerClusterID(cfg *VaultConfig, client *http.Client) string {
+	for _, node := range cfg.Nodes {
+		if strings.TrimRight(node, "/") == strings.TrimRight(cfg.Address, "/") {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.of(opHealth))
+		st, err := fetchSealStatusContext(ctx, client, node)
+		cancel()
+		if err == nil && !st.Sealed && st.ClusterID != "" {
+			return st.ClusterID
+		}
+	}
+	return ""
+}
+
+// bindingCheck is the outcome of checking a sealed cluster against its
+// binding before keys are submitted.
+type bindingCheck struct {
+	bound  *clusterBinding // nil until the first unseal
+	rebind bool            // -accept-new-cluster and something differed
+}
+
+// checkClusterBinding refuses to submit keys to a cluster that isn't the
+// one the state file is bound to, unless accept is set.
+func checkClusterBinding(cfg *VaultConfig, client *http.Client, store *stateStore, seal *VaultStatus, accept bool) (bindingCheck, error) {
+	st, err := store.load()
+	if err != nil {
+		return bindingCheck{}, err
+	}
+	check := bindingCheck{bound: st.ClusterBinding}
+	if check.bound == nil {
+		return check, nil
+	}
+	why := check.bound.mismatch(seal, peerClusterID(cfg, client))
+	if why == "" {
+		return check, nil
+	}
+	metrics.inc("cluster_binding_mismatches_total")
+	if !accept {
+		refuseUnlock(cfg, msgBindingRefused.with(), msgBindingRefusedBody.with("address", cfg.Address,
+			"bound", mdCode(check.bound.String(), maxNameLen), "reason", cleanField(why, maxPathLen)))
+		return check, &exitError{exitClusterBinding, fmt.Errorf("cluster differs from the bound one (%s); rerun with -accept-new-cluster if that is expected", why)}
+	}
+	logInfo("🔗 Accepting a new cluster: {reason}", "reason", why)
+	check.rebind = true
+	return check, nil
+}
+
+var (
+	msgBindingRefused      = message("cluster-binding.refused.title")
+	msgBindingRefusedBody  = message("cluster-binding.refused.body")
+	msgBindingMismatch     = message("cluster-binding.mismatch.title")
+	msgBindingMismatchBody = message("cluster-binding.mismatch.body")
+	msgBindingChanged      = message("cluster-binding.changed.title")
+	msgBindingChangedBody  = message("cluster-binding.changed.body")
+)
+
+// recordBinding runs after a successful unseal, when the cluster ID can
+// be read. It records the first binding, or the new one after
+// -accept-new-cluster. A cluster that turns out to differ only now, with
+// no unsealed peer to ask beforehand, is reported but not rebound.
+func recordBinding(cfg *VaultConfig, client *http.Client, store *stateStore, check bindingCheck, accept bool) {
+	seal, err := fetchSealStatus(cfg, client)
+	if err != nil || seal.ClusterID == "" {
+		logWarn("⚠️  Could not read the cluster ID to bind to: {error}", "error", err)
+		return
+	}
+	live := bindingOf(seal)
+	old := check.bound
+	switch {
+	case old != nil && old.ClusterID == live.ClusterID && !check.rebind:
+		return
+	case old != nil && old.ClusterID != live.ClusterID && !accept:
+		metrics.inc("cluster_binding_mismatches_total")
+		logError("🚨 Unsealed cluster {cluster}, but the state is bound to {bound}", "cluster", live, "bound", old)
+		notify(cfg, Alert{Severity: sevCritical, Color: sevCritical.color(), Rule: "cluster-binding"}.say(msgBindingMismatch.with(),
+			msgBindingMismatchBody.with("address", cfg.Address, "cluster", mdCode(live.String(), maxNameLen), "bound", mdCode(old.String(), maxNameLen))))
+		return
+	}
+	if err := store.update(func(st *wardenState) { st.ClusterBinding = live }); err != nil {
+		logWarn("⚠️  Could not record the cluster binding: {error}", "error", err)
+		return
+	}
+	if old == nil {
+		logInfo("🔗 Bound to cluster {cluster}", "cluster", live)
+		return
+	}
+	logInfo("🔗 Binding changed from cluster {from} to {to}", "from", old.describe(), "to", live.describe())
+	notify(cfg, Alert{Severity: sevWarning, Color: sevWarning.color(), Rule: "cluster-binding"}.say(msgBindingChanged.with(),
+		msgBindingChangedBody.with("address", cfg.Address, "cluster", mdCode(live.describe(), maxPathLen), "bound", mdCode(old.describe(), maxPathLen))))
+}
+
+// doctorBindings lists each cluster's binding for support cases.
+func doctorBindings(cfg *VaultConfig) []byte {
+	var b strings.Builder
+	for _, c := range clusterConfigs(cfg) {
+		st, err := newStateStore(c.StateFile).load()
+		switch {
+		case err != nil:
+			fmt.Fprintf(&b, "%s: %v\n", clusterLabel(c), err)
+		case st.ClusterBinding == nil:
+			fmt.Fprintf(&b, "%s: not bound yet (no unseal by vault-warden recorded)\n", clusterLabel(c))
+		default:
+			cb := st.ClusterBinding
+			fmt.Fprintf(&b, "%s: cluster %s, recorded %s\n", clusterLabel(c), cb.describe(), cb.Recorded.Format(time.RFC3339))
+		}
+	}
+	return []byte(b.String())
+}
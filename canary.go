@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Audit Canary ---
+
+const (
+	defaultCanaryPath     = "secret/data/vault-warden/canary"
+	defaultCanaryInterval = 5 * time.Minute
+	defaultCanaryTimeout  = time.Minute
+)
+
+// CanaryConfig has the warden read a dedicated path on a schedule and
+// wait for the read to come through its own audit pipeline. The delay is
+// the pipeline's end-to-end lag; a read that never shows up means the
+// audit device, the tail or the parsing is broken.
+//
+// The token needs nothing but read on the path, e.g.
+//
+//	path "secret/data/vault-warden/canary" {
+//	  capabilities = ["read"]
+//	}
+//
+// created with `vault token create -policy=vault-warden-canary -period=768h
+// -orphan`. The secret needn't exist: a 404 is audited like a hit.
+type CanaryConfig struct {
+	Token    string   `yaml:"token"` // enables the canary
+	Path     string   `yaml:"path"`
+	Interval Duration `yaml:"interval"`
+	Timeout  Duration `yaml:"timeout"` // how long to wait for the entry before alerting
+}
+
+// canaryStatus is the canary's state, shown in /statusz.
+type canaryStatus struct {
+	Path       string     `json:"path"`
+	LastSent   *time.Time `json:"last_sent,omitempty"`
+	LastSeen   *time.Time `json:"last_seen,omitempty"`
+	LagSeconds float64    `json:"lag_seconds,omitempty"` // of the last one seen
+	Missing    bool       `json:"missing,omitempty"`
+	LastError  string     `json:"last_error,omitempty"`
+}
+
+// canaryProbe sends the reads and matches them in the audit stream.
+// Every entry for the canary path is kept away from the rules and the
+// statistics, whoever made it. A nil *canaryProbe matches nothing.
+type canaryProbe struct {
+	cfg    *VaultConfig
+	path   string
+	client *http.Client
+
+	mu      sync.Mutex
+	st      canaryStatus
+	pending string    // request ID awaited; "" when Vault sent none
+	sent    time.Time // zero when nothing is awaited
+	seen    chan struct{}
+}
+
+func newCanaryProbe(cfg *VaultConfig) *canaryProbe {
+	if cfg.Canary.Token == "" {
+		return nil
+	}
+	path := strings.Trim(cfg.Canary.Path, "/")
+	c := &canaryProbe{cfg: cfg, path: path, st: canaryStatus{Path: path}}
+	client, err := newVaultClient(cfg)
+	if err != nil {
+		logWarn("⚠️  Audit canary disabled: {error}", "error", err)
+		return nil
+	}
+	c.client = client
+	return c
+}
+
+// canaryComponent sends a canary every interval until ctx is done.
+func canaryComponent(c *canaryProbe) componentSpec {
+	return componentSpec{name: "audit-canary", policy: policyRestart, run: func(ctx context.Context) error {
+		ticker := time.NewTicker(time.Duration(c.cfg.Canary.Interval))
+		defer ticker.Stop()
+		for {
+			c.round(ctx)
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}}
+}
+
+// round sends one canary and waits for its audit entry.
+func (c *canaryProbe) round(ctx context.Context) {
+	seen := make(chan struct{})
+	sent := time.Now()
+	id, err := c.send(ctx)
+	if err != nil {
+		// Nothing reached Vault, so there is no entry to wait for.
+		metrics.inc("audit_canary_errors_total")
+		logWarn("⚠️  Audit canary: {error}", "error", err)
+		c.mu.Lock()
+		c.st.LastError = err.Error()
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Lock()
+	c.pending, c.sent, c.seen = id, sent, seen
+	c.st.LastSent, c.st.LastError = &sent, ""
+	c.mu.Unlock()
+
+	timer := time.NewTimer(time.Duration(c.cfg.Canary.Timeout))
+	defer timer.Stop()
+	select {
+	case <-seen:
+	case <-ctx.Done():
+	case <-timer.C:
+		c.missed(id, sent)
+	}
+	c.mu.Lock()
+	c.sent, c.seen = time.Time{}, nil
+	c.mu.Unlock()
+}
+
+// send reads the canary path and returns the request ID Vault answered
+// with; "" for answers without one, such as a 404.
+func (c *canaryProbe) send(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.Timeouts.of(opAPI))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimRight(c.cfg.Address, "/")+"/v1/"+c.path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", c.cfg.Canary.Token)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("read %s: %w", c.path, err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		RequestID string `json:"request_id"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body)
+	if resp.StatusCode == http.StatusForbidden {
+		// Audited all the same; the token's policy needs fixing.
+		logWarn("⚠️  Audit canary: {path} returned 403; give the token read on it", "path", c.path)
+	}
+	return body.RequestID, nil
+}
+
+// observe reports whether e is a canary entry, which the caller then
+// drops, and times the one awaited.
+func (c *canaryProbe) observe(e *AuditEntry) bool {
+	if c == nil || strings.Trim(e.Request.Path, "/") != c.path {
+		return false
+	}
+	metrics.inc("audit_canary_entries_total")
+	c.mu.Lock()
+	if c.sent.IsZero() || c.pending != "" && e.Request.ID != c.pending {
+		c.mu.Unlock()
+		return true
+	}
+	now := time.Now()
+	lag := now.Sub(c.sent)
+	wasMissing := c.st.Missing
+	c.st.LastSeen, c.st.LagSeconds, c.st.Missing = &now, lag.Seconds(), false
+	close(c.seen)
+	c.sent, c.seen = time.Time{}, nil
+	c.mu.Unlock()
+
+	metrics.observe("audit_canary_lag_seconds", lag.Seconds())
+	metrics.set("audit_pipeline_lag_seconds", lag.Seconds())
+	logDebug("🐤 Audit canary seen after {lag}", "lag", lag.Round(time.Millisecond), "request_id", e.Request.ID)
+	if wasMissing {
+		logInfo("✅ Audit canary seen again after {lag}", "lag", lag.Round(time.Millisecond))
+		notify(c.cfg, Alert{Severity: sevInfo, Color: sevInfo.color(), Rule: "audit-canary",
+			Incident: "audit-canary:" + c.cfg.Address, Resolved: true}.say(msgCanaryBack.with(),
+			msgCanaryBackBody.with("path", mdCode(c.path, maxPathLen), "lag", lag.Round(time.Millisecond))))
+	}
+	return true
+}
+
+var (
+	msgCanaryMissing     = message("audit-canary.missing.title")
+	msgCanaryMissingBody = message("audit-canary.missing.body")
+	msgCanaryRequest     = message("audit-canary.missing.request")
+	msgCanaryBack        = message("audit-canary.back.title")
+	msgCanaryBackBody    = message("audit-canary.back.body")
+)
+
+// missed alerts on the first canary in a row that didn't show up.
+func (c *canaryProbe) missed(id string, sent time.Time) {
+	metrics.inc("audit_canary_missing_total")
+	c.mu.Lock()
+	alerted := c.st.Missing
+	c.st.Missing = true
+	c.mu.Unlock()
+	timeout := time.Duration(c.cfg.Canary.Timeout)
+	logError("🐤 Audit canary {path} not seen within {timeout}", "path", c.path, "timeout", timeout, "request_id", id)
+	if alerted {
+		return
+	}
+	var request localText
+	if id != "" {
+		request = msgCanaryRequest.with("id", mdCode(id, maxNameLen))
+	}
+	notify(c.cfg, Alert{Severity: sevCritical, Color: sevCritical.color(), Rule: "audit-canary",
+		Incident: "audit-canary:" + c.cfg.Address, RequestID: id}.say(msgCanaryMissing.with(),
+		msgCanaryMissingBody.with("path", mdCode(c.path, maxPathLen), "sent", sent.UTC().Format(time.RFC3339),
+			"timeout", formatDuration(timeout), "request", request)))
+}
+
+func (c *canaryProbe) status() *canaryStatus {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := c.st
+	return &st
+}
+
+// validateCanary checks the canary settings and fills in their defaults.
+func validateCanary(cfg *VaultConfig) error {
+	cc := &cfg.Canary
+	if cc.Token == "" {
+		return nil
+	}
+	if cc.Path == "" {
+		cc.Path = defaultCanaryPath
+	}
+	if strings.Trim(cc.Path, "/") == "" {
+		return &fieldError{"canary.path", "must name a path"}
+	}
+	if cc.Interval == 0 {
+		cc.Interval = Duration(defaultCanaryInterval)
+	}
+	if cc.Interval < 0 {
+		return &fieldError{"canary.interval", "must be positive"}
+	}
+	if cc.Timeout == 0 {
+		cc.Timeout = Duration(defaultCanaryTimeout)
+	}
+	if cc.Timeout <= 0 || cc.Timeout > cc.Interval {
+		return &fieldError{"canary.timeout", "must be positive and at most canary.interval"}
+	}
+	return nil
+}
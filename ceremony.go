@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Unseal Ceremony ---
+
+// An unseal can be spread over several runs: "unlock -keys 1,2" submits
+// two shares and stops, "unlock -resume" continues later. Between runs the
+// state store remembers which shares went in, by index only. Vault keeps
+// the progress itself; the nonce it reports identifies the attempt, so a
+// reset or restart in between is noticed instead of piling shares onto
+// someone else's attempt.
+
+// ceremonyState is a step-wise unseal in progress. It never holds key
+// material.
+type ceremonyState struct {
+	Address   string    `json:"address"`
+	Nonce     string    `json:"nonce"`
+	Progress  int       `json:"progress"`
+	Threshold int       `json:"threshold"`
+	Submitted []int     `json:"submitted"` // 1-based key indices
+	Host      string    `json:"host"`
+	Started   time.Time `json:"started"`
+	Updated   time.Time `json:"updated"`
+}
+
+func (c *ceremonyState) String() string {
+	return fmt.Sprintf("%d/%d keys (submitted: %s), started %s on %s, last key %s",
+		c.Progress, c.Threshold, joinIndices(c.Submitted), c.Started.Format(time.RFC3339), c.Host,
+		c.Updated.Format(time.RFC3339))
+}
+
+func joinIndices(indices []int) string {
+	s := make([]string, len(indices))
+	for i, n := range indices {
+		s[i] = strconv.Itoa(n)
+	}
+	return strings.Join(s, ",")
+}
+
+func (c *ceremonyState) submitted(index int) bool {
+	for _, n := range c.Submitted {
+		if n == index {
+			return true
+		}
+	}
+	return false
+}
+
+// unsealEngine submits key shares one step at a time. With persist set the
+// ceremony is saved after every step; otherwise it only lives for this run.
+type unsealEngine struct {
+	cfg     *VaultConfig
+	client  *http.Client
+	store   *stateStore
+	migrate bool
+	persist bool
+	state   *ceremonyState
+}
+
+// errCeremonyMismatch means Vault's unseal attempt is not the one recorded.
+var errCeremonyMismatch = errors.New("unseal ceremony no longer matches Vault")
+
+// resume loads the saved ceremony and checks it against Vault's current
+// seal status.
+func (e *unsealEngine) resume(seal *VaultStatus) error {
+	st, err := e.store.load()
+	if err != nil {
+		return err
+	}
+	c := st.Ceremony
+	if c == nil {
+		return fmt.Errorf("no unseal ceremony in progress")
+	}
+	switch {
+	case c.Address != e.cfg.Address:
+		return fmt.Errorf("%w: it was started against %s", errCeremonyMismatch, c.Address)
+	case seal.Nonce != c.Nonce:
+		return fmt.Errorf("%w: the unseal nonce changed, so the attempt was reset or Vault restarted (progress now %d/%d)",
+			errCeremonyMismatch, seal.Progress, seal.Threshold)
+	case seal.Progress != c.Progress:
+		return fmt.Errorf("%w: Vault reports %d/%d keys but %d were recorded, so someone else submitted shares",
+			errCeremonyMismatch, seal.Progress, seal.Threshold, c.Progress)
+	}
+	e.state, e.persist = c, true
+	return nil
+}
+
+// begin starts a new ceremony.
+func (e *unsealEngine) begin(seal *VaultStatus) {
+	host, _ := os.Hostname()
+	now := time.Now().UTC()
+	e.state = &ceremonyState{Address: e.cfg.Address, Host: host, Started: now, Updated: now}
+	if seal != nil {
+		e.state.Threshold = seal.Threshold
+	}
+}
+
+// submit sends one key share and records the step.
+func (e *unsealEngine) submit(index int, key []byte) (*VaultStatus, error) {
+	reqBody := unsealRequestBody(key, e.migrate)
+	req, cancel, err := newOpRequest(e.cfg, opUnseal, "PUT", e.cfg.Address+"/v1/sys/unseal", bytes.NewReader(reqBody))
+	if err != nil {
+		zero(reqBody)
+		return nil, fmt.Errorf("create unseal request %d: %w", index, err)
+	}
+	defer cancel()
+
+	resp, err := e.client.Do(req)
+	zero(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("unseal request %d failed: %w", index, err)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("read unseal response %d: %w", index, err)
+	}
+
+	var status VaultStatus
+	if err := json.Unmarshal(body, &status); err != nil {
+		return nil, fmt.Errorf("parse unseal response %d: %w", index, err)
+	}
+	if len(status.Errors) > 0 {
+		return nil, &vaultResponseError{op: fmt.Sprintf("unseal request %d", index), status: resp.StatusCode, errors: status.Errors}
+	}
+
+	c := e.state
+	c.Nonce, c.Progress, c.Threshold = status.Nonce, status.Progress, status.Threshold
+	c.Submitted = append(c.Submitted, index)
+	c.Updated = time.Now().UTC()
+	if !status.Sealed {
+		return &status, e.clear()
+	}
+	return &status, e.save()
+}
+
+func (e *unsealEngine) save() error {
+	if !e.persist {
+		return nil
+	}
+	c := *e.state
+	if err := e.store.update(func(st *wardenState) { st.Ceremony = &c }); err != nil {
+		return fmt.Errorf("record unseal ceremony: %w", err)
+	}
+	return nil
+}
+
+// clear forgets the ceremony once Vault is unsealed or it was aborted.
+func (e *unsealEngine) clear() error {
+	st, err := e.store.load()
+	if err != nil || st.Ceremony == nil {
+		return err
+	}
+	return e.store.update(func(st *wardenState) { st.Ceremony = nil })
+}
+
+// abort discards Vault's unseal progress and the saved ceremony.
+func (e *unsealEngine) abort() error {
+	req, cancel, err := newOpRequest(e.cfg, opUnseal, "PUT", e.cfg.Address+"/v1/sys/unseal", strings.NewReader(`{"reset":true}`))
+	if err != nil {
+		return fmt.Errorf("create reset request: %w", err)
+	}
+	defer cancel()
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("reset request failed: %w", err)
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("reset returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return e.clear()
+}
+
+// parseKeyIndices parses a -keys list like "1,3" against n available keys.
+func parseKeyIndices(s string, n int) ([]int, error) {
+	var out []int
+	seen := make(map[int]bool)
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		i, err := strconv.Atoi(f)
+		if err != nil || i < 1 || i > n {
+			return nil, fmt.Errorf("invalid key index %q (have keys 1-%d)", f, n)
+		}
+		if !seen[i] {
+			seen[i] = true
+			out = append(out, i)
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no key indices given")
+	}
+	sort.Ints(out)
+	return out, nil
+}
+
+// ceremonyStatus describes the saved ceremony for the status command.
+func ceremonyStatus(cfg *VaultConfig) string {
+	st, err := newStateStore(cfg.StateFile).load()
+	switch {
+	case err != nil:
+		return "unknown: " + err.Error()
+	case st.Ceremony == nil:
+		return "none"
+	}
+	return st.Ceremony.String()
+}
+
+// --- Command: Status ---
+
+// statusReport is the -json form of the status command, one per cluster.
+type statusReport struct {
+	Cluster     string `json:"cluster,omitempty"` // with vaults
+	Address     string `json:"address"`
+	Reachable   bool   `json:"reachable"`
+	Initialized bool   `json:"initialized"`
+	Sealed      bool   `json:"sealed"`
+	Progress    int    `json:"progress"`
+	Threshold   int    `json:"threshold"`
+	// Role is active, standby or perf-standby, from sys/health, when
+	// unsealed.
+	Role         string             `json:"role,omitempty"`
+	Version      string             `json:"version"`
+	Error        string             `json:"error,omitempty"`
+	Capabilities *vaultCapabilities `json:"capabilities,omitempty"`
+	Ceremony     *ceremonyState     `json:"ceremony,omitempty"`
+	TLS          *tlsIdentity       `json:"tls,omitempty"`
+	TLSPin       string             `json:"tls_pin,omitempty"` // "ok" when pinned, "MISMATCH" when not
+	// Latency is the seal watch's view, from a running audit daemon.
+	Latency  *latencySummary   `json:"latency,omitempty"`
+	Topology *topologySnapshot `json:"topology,omitempty"`
+
+	probeErr error // reading the certificate, for the text form
+}
+
+// exitCode is the status command's exit code for the cluster: 0 only when
+// it is initialized and unsealed.
+func (r *statusReport) exitCode() int {
+	switch {
+	case !r.Reachable:
+		return exitUnreachable
+	case r.Error != "":
+		return 1
+	case !r.Initialized:
+		return exitNotInitialized
+	case r.Sealed:
+		return exitSealed
+	}
+	return 0
+}
+
+func runStatus(cfg *VaultConfig, args []string) error {
+	fs := flagSet("status")
+	output := fs.String("output", "text", "Output format: text or json")
+	asJSON := fs.Bool("json", false, "Same as -output json")
+	cluster := fs.String("cluster", "", "Only the cluster with this label")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *asJSON {
+		*output = "json"
+	}
+	if *output != "text" && *output != "json" {
+		return fmt.Errorf("unknown -output %q (want text or json)", *output)
+	}
+	targets, err := selectClusters(cfg, *cluster)
+	if err != nil {
+		return err
+	}
+	latency := daemonLatency(cfg)
+	reports := make([]*statusReport, len(targets))
+	for i, c := range targets {
+		reports[i] = clusterStatus(c, latency)
+	}
+
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		var v interface{} = reports
+		if len(cfg.Vaults) == 0 {
+			v = reports[0]
+		}
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+	} else {
+		for i, rep := range reports {
+			if i > 0 {
+				fmt.Println()
+			}
+			printStatus(targets[i], rep)
+		}
+	}
+
+	// Like unlock: the clusters' shared code, or 1 when they differ.
+	code := 0
+	for _, rep := range reports {
+		switch c := rep.exitCode(); {
+		case c == 0:
+		case code == 0:
+			code = c
+		case code != c:
+			code = 1
+		}
+	}
+	if code != 0 {
+		return &exitError{code, errReported}
+	}
+	return nil
+}
+
+// clusterStatus reads one cluster's seal status and health. A Vault that
+// can't be reached is reported, not returned as an error, so the other
+// clusters still are.
+func clusterStatus(cfg *VaultConfig, latency map[string]*latencySummary) *statusReport {
+	rep := &statusReport{Cluster: cfg.label, Address: cfg.Address}
+	client, err := newVaultClient(cfg)
+	if err != nil {
+		rep.Reachable, rep.Error = true, err.Error()
+		return rep
+	}
+	// Probe first: with a pin mismatch the request below fails, and what
+	// the node presented is the thing to look at.
+	rep.TLS, rep.probeErr = probeTLSIdentity(cfg)
+	seal, err := fetchSealStatus(cfg, client)
+	if err != nil {
+		var pm *pinMismatchError
+		var ue *url.Error
+		switch {
+		case errors.As(err, &pm):
+			rep.Reachable, rep.TLS, rep.TLSPin = true, pm.presented, "MISMATCH"
+		case errors.As(err, &ue):
+			// No answer at all, as opposed to one that wasn't usable.
+		default:
+			rep.Reachable = true
+		}
+		rep.Error = err.Error()
+		return rep
+	}
+	rep.Reachable, rep.Initialized, rep.Sealed = true, seal.Initialized, seal.Sealed
+	rep.Progress, rep.Threshold, rep.Version = seal.Progress, seal.Threshold, seal.Version
+	rep.Capabilities = vaultCapabilitiesFor(seal.Version)
+	if rep.TLS != nil && cfg.VaultTLS.PinnedCertSHA256 != "" {
+		rep.TLSPin = "ok" // the request above verified it
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.of(opHealth))
+	rep.Role = probeNode(ctx, cfg, client, cfg.Address).Role
+	cancel()
+	if st, err := newStateStore(cfg.StateFile).load(); err == nil {
+		rep.Ceremony = st.Ceremony
+	}
+	rep.Latency = latency[clusterLabel(cfg)]
+	rep.Topology = takeTopology(cfg)
+	return rep
+}
+
+func printStatus(cfg *VaultConfig, rep *statusReport) {
+	if rep.Cluster != "" {
+		fmt.Printf("Cluster:  %s\n", rep.Cluster)
+	}
+	if !rep.Reachable {
+		fmt.Printf("Vault:    %s is unreachable: %s\n", rep.Address, rep.Error)
+		return
+	}
+	if rep.Error != "" {
+		if rep.TLSPin == "MISMATCH" {
+			fmt.Printf("TLS:      %s\n", describeTLSIdentity(rep.TLS, rep.TLSPin))
+		}
+		fmt.Printf("Vault:    %s\n", rep.Address)
+		fmt.Printf("Error:    %s\n", rep.Error)
+		return
+	}
+	state := "unsealed"
+	switch {
+	case !rep.Initialized:
+		state = "not initialized"
+	case rep.Sealed:
+		state = fmt.Sprintf("sealed (%d/%d keys)", rep.Progress, rep.Threshold)
+	}
+	version := rep.Version
+	if version == "" {
+		version = "unknown"
+	}
+	fmt.Printf("Vault:    %s (version %s)\n", rep.Address, version)
+	fmt.Printf("Seal:     %s\n", state)
+	if rep.Role != "" {
+		fmt.Printf("Role:     %s\n", rep.Role)
+	}
+	fmt.Printf("Ceremony: %s\n", ceremonyStatus(cfg))
+	switch {
+	case rep.TLS != nil:
+		fmt.Printf("TLS:      %s\n", describeTLSIdentity(rep.TLS, rep.TLSPin))
+	case rep.probeErr != nil:
+		fmt.Printf("TLS:      could not read the certificate: %v\n", rep.probeErr)
+	}
+	if l := rep.Latency; l != nil && l.Samples > 0 {
+		d := func(ms float64) string { return formatLatency(time.Duration(ms * float64(time.Millisecond))) }
+		line := fmt.Sprintf("p50 %s, p95 %s, p99 %s over %s (%d probes)",
+			d(l.P50), d(l.P95), d(l.P99), formatDuration(time.Duration(l.WindowSecs*float64(time.Second))), l.Samples)
+		if l.Baseline > 0 {
+			line += ", baseline p95 " + d(l.Baseline)
+		}
+		if l.Degraded {
+			line += " — degraded"
+		}
+		fmt.Printf("Latency:  %s\n", line)
+	}
+	fmt.Println("Topology:")
+	for _, line := range strings.Split(strings.TrimSuffix(rep.Topology.table(), "\n"), "\n") {
+		fmt.Printf("  %s\n", line)
+	}
+	if note := rep.Topology.note(); note != "" {
+		fmt.Printf("  %s\n", note)
+	}
+	if c := rep.Capabilities; c != nil {
+		if !c.Supported {
+			fmt.Printf("Support:  older than the minimum supported %s; unlock is refused\n", minVaultVersion)
+		}
+		for _, f := range vaultFeatures {
+			if reason, off := c.Disabled[f.name]; off {
+				fmt.Printf("Disabled: %s (%s)\n", f.name, reason)
+			}
+		}
+	}
+}
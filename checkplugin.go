@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Command: Check Plugin ---
+
+// Exit codes from the monitoring-plugins guidelines.
+const (
+	pluginOK       = 0
+	pluginWarning  = 1
+	pluginCritical = 2
+	pluginUnknown  = 3
+)
+
+var pluginStatusNames = [...]string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+// pluginServices names the service in the output line for each mode.
+var pluginServices = map[string]string{
+	"seal":      "SEAL",
+	"audit-lag": "AUDIT LAG",
+	"webhook":   "WEBHOOK",
+	"keysource": "KEY SOURCE",
+}
+
+// pluginResult is the outcome of one check in plugin form.
+type pluginResult struct {
+	service string
+	status  int
+	text    string
+	perf    []perfValue
+}
+
+// perfValue is one perfdata item: 'label'=value[UOM];[warn];[crit];[min];[max]
+type perfValue struct {
+	label      string
+	value      float64
+	uom        string
+	warn, crit string
+	min, max   string
+}
+
+func (p perfValue) String() string {
+	label := p.label
+	if strings.ContainsAny(label, " '=") {
+		label = "'" + strings.ReplaceAll(label, "'", "''") + "'"
+	}
+	fields := []string{strconv.FormatFloat(math.Round(p.value*10)/10, 'f', -1, 64) + p.uom, p.warn, p.crit, p.min, p.max}
+	// Trailing empty fields may be dropped.
+	for len(fields) > 1 && fields[len(fields)-1] == "" {
+		fields = fields[:len(fields)-1]
+	}
+	return label + "=" + strings.Join(fields, ";")
+}
+
+// String renders the single plugin output line.
+func (r pluginResult) String() string {
+	line := r.service + " " + pluginStatusNames[r.status] + " - " + r.text
+	if len(r.perf) > 0 {
+		perf := make([]string, len(r.perf))
+		for i, p := range r.perf {
+			perf[i] = p.String()
+		}
+		line += " | " + strings.Join(perf, " ")
+	}
+	return line
+}
+
+// pluginRange is a threshold range in the monitoring-plugins syntax:
+// "10" (outside 0..10), "10:" (below 10), "~:10" (above 10), "10:20"
+// (outside 10..20) and "@10:20" (inside 10..20).
+type pluginRange struct {
+	raw        string
+	start, end float64
+	inside     bool
+}
+
+func parsePluginRange(s string) (*pluginRange, error) {
+	if s == "" {
+		return nil, nil
+	}
+	r := &pluginRange{raw: s, end: math.Inf(1)}
+	if strings.HasPrefix(s, "@") {
+		r.inside = true
+		s = s[1:]
+	}
+	if s == "" {
+		return nil, fmt.Errorf("invalid range %q", r.raw)
+	}
+	startStr, endStr, hasColon := strings.Cut(s, ":")
+	if !hasColon {
+		startStr, endStr = "0", s
+	}
+	var err error
+	switch startStr {
+	case "~":
+		r.start = math.Inf(-1)
+	case "":
+		r.start = 0
+	default:
+		if r.start, err = strconv.ParseFloat(startStr, 64); err != nil {
+			return nil, fmt.Errorf("invalid range %q", r.raw)
+		}
+	}
+	if endStr != "" {
+		if r.end, err = strconv.ParseFloat(endStr, 64); err != nil {
+			return nil, fmt.Errorf("invalid range %q", r.raw)
+		}
+	}
+	if r.start > r.end {
+		return nil, fmt.Errorf("invalid range %q: start is after end", r.raw)
+	}
+	return r, nil
+}
+
+// alert reports whether v triggers the threshold. A nil range never does.
+func (r *pluginRange) alert(v float64) bool {
+	if r == nil {
+		return false
+	}
+	in := v >= r.start && v <= r.end
+	return in == r.inside
+}
+
+func (r *pluginRange) String() string {
+	if r == nil {
+		return ""
+	}
+	return r.raw
+}
+
+// thresholdStatus applies warning/critical ranges to a value.
+func thresholdStatus(v float64, warn, crit *pluginRange) int {
+	switch {
+	case crit.alert(v):
+		return pluginCritical
+	case warn.alert(v):
+		return pluginWarning
+	}
+	return pluginOK
+}
+
+// runCheckPlugin performs one check and returns the plugin exit code. The
+// config error, if any, is reported as UNKNOWN rather than failing outright.
+func runCheckPlugin(doc *configDoc, loadErr error, args []string) int {
+	fs := flagSet("check-plugin")
+	fs.SetOutput(io.Discard)
+	checkMode := fs.String("mode", "", "Check to run: seal, audit-lag, webhook or keysource")
+	warnStr := fs.String("warning", "", "Warning threshold range")
+	critStr := fs.String("critical", "", "Critical threshold range")
+	if err := fs.Parse(args); err != nil {
+		fmt.Printf("UNKNOWN - %v\n", err)
+		return pluginUnknown
+	}
+
+	unknown := func(service string, err error) int {
+		fmt.Println(pluginResult{service: service, status: pluginUnknown, text: err.Error()})
+		return pluginUnknown
+	}
+	service, ok := pluginServices[*checkMode]
+	if !ok {
+		service = "VAULT"
+	}
+	if loadErr != nil {
+		return unknown(service, fmt.Errorf("config: %w", loadErr))
+	}
+	cfg, err := doc.config()
+	if err != nil {
+		return unknown(service, fmt.Errorf("config: %w", err))
+	}
+	warn, err := parsePluginRange(*warnStr)
+	if err != nil {
+		return unknown(service, err)
+	}
+	crit, err := parsePluginRange(*critStr)
+	if err != nil {
+		return unknown(service, err)
+	}
+
+	var res pluginResult
+	switch *checkMode {
+	case "seal":
+		res, err = checkSealPlugin(cfg, warn, crit)
+	case "audit-lag":
+		res, err = checkAuditLagPlugin(cfg, warn, crit)
+	case "webhook":
+		res, err = checkWebhookPlugin(cfg, warn, crit)
+	case "keysource":
+		res = checkKeySourcePlugin(cfg, warn, crit)
+	default:
+		err = fmt.Errorf("usage: vault-warden check-plugin -mode seal|audit-lag|webhook|keysource [-warning RANGE] [-critical RANGE]")
+	}
+	if err != nil {
+		return unknown(service, err)
+	}
+	fmt.Println(res)
+	return res.status
+}
+
+// checkSealPlugin reports the seal state. Thresholds apply to how long Vault
+// has been sealed (seconds); without a critical threshold any seal is
+// critical.
+func checkSealPlugin(cfg *VaultConfig, warn, crit *pluginRange) (pluginResult, error) {
+	res := pluginResult{service: pluginServices["seal"]}
+	client, err := newVaultClient(cfg)
+	if err != nil {
+		return res, err
+	}
+	status, err := fetchSealStatus(cfg, client)
+	if err != nil {
+		return res, err
+	}
+
+	// Remember when the seal was first seen so downtime survives
+	// between check runs.
+	var since time.Time
+	store := newStateStore(cfg.StateFile)
+	if err := store.update(func(st *wardenState) {
+		switch {
+		case !status.Sealed:
+			st.SealedSince = time.Time{}
+		case st.SealedSince.IsZero():
+			st.SealedSince = time.Now().UTC()
+		}
+		since = st.SealedSince
+	}); err != nil {
+		return res, err
+	}
+
+	downtime := 0.0
+	if !since.IsZero() {
+		downtime = time.Since(since).Seconds()
+	}
+	res.perf = []perfValue{{label: "seal_downtime", value: downtime, uom: "s", warn: warn.String(), crit: crit.String(), min: "0"}}
+
+	switch {
+	case !status.Initialized:
+		res.status, res.text = pluginCritical, "Vault is not initialized"
+	case !status.Sealed:
+		res.status, res.text = pluginOK, "Vault is unsealed"
+	default:
+		res.text = fmt.Sprintf("Vault sealed for %s (%d/%d keys)", time.Duration(downtime*float64(time.Second)).Round(time.Second), status.Progress, status.Threshold)
+		if crit == nil {
+			res.status = pluginCritical
+		} else {
+			res.status = thresholdStatus(downtime, warn, crit)
+		}
+	}
+	return res, nil
+}
+
+// checkAuditLagPlugin compares the newest audit entry's timestamp to now.
+func checkAuditLagPlugin(cfg *VaultConfig, warn, crit *pluginRange) (pluginResult, error) {
+	res := pluginResult{service: pluginServices["audit-lag"]}
+	last, err := lastAuditTime(cfg.AuditLog)
+	if err != nil {
+		return res, err
+	}
+	lag := time.Since(last).Seconds()
+	if lag < 0 {
+		lag = 0
+	}
+	res.status = thresholdStatus(lag, warn, crit)
+	res.text = fmt.Sprintf("newest audit entry is %s old", time.Duration(lag*float64(time.Second)).Round(100*time.Millisecond))
+	res.perf = []perfValue{{label: "lag", value: lag, uom: "s", warn: warn.String(), crit: crit.String()}}
+	return res, nil
+}
+
+// lastAuditTime returns the timestamp of the last parseable entry in the
+// final 256 KiB of the audit log.
+func lastAuditTime(path string) (time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("open audit log: %w", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("stat audit log: %w", err)
+	}
+	const window = 256 * 1024
+	off := fi.Size() - window
+	if off < 0 {
+		off = 0
+	}
+	buf := make([]byte, fi.Size()-off)
+	if _, err := f.ReadAt(buf, off); err != nil && err != io.EOF {
+		return time.Time{}, fmt.Errorf("read audit log: %w", err)
+	}
+
+	lines := bytes.Split(bytes.TrimRight(buf, "\n"), []byte("\n"))
+	for i := len(lines) - 1; i >= 0; i-- {
+		var entry AuditEntry
+		if json.Unmarshal(lines[i], &entry) != nil {
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339Nano, entry.Time); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("no audit entries in %s", path)
+}
+
+// checkWebhookPlugin reports notifier health from the alert history.
+// Thresholds apply to the number of consecutive failed deliveries, by
+// default warning at 1 and critical at 3.
+func checkWebhookPlugin(cfg *VaultConfig, warn, crit *pluginRange) (pluginResult, error) {
+	res := pluginResult{service: pluginServices["webhook"]}
+	if cfg.HistoryFile == "" {
+		return res, fmt.Errorf("history_file is not configured, so delivery results are unknown")
+	}
+	if warn == nil {
+		warn, _ = parsePluginRange("0")
+	}
+	if crit == nil {
+		crit, _ = parsePluginRange("2")
+	}
+
+	failures := 0
+	var lastOK time.Time
+	seen := false
+	err := readHistory(cfg.HistoryFile, func(_ int, rec *historyRecord) error {
+		seen = true
+		if rec.Delivered {
+			failures, lastOK = 0, rec.Time
+		} else {
+			failures++
+		}
+		return nil
+	})
+	if err != nil {
+		return res, err
+	}
+	if !seen {
+		return res, fmt.Errorf("no deliveries recorded yet")
+	}
+
+	res.status = thresholdStatus(float64(failures), warn, crit)
+	switch {
+	case failures == 0:
+		res.text = "last delivery succeeded"
+	case lastOK.IsZero():
+		res.text = fmt.Sprintf("%d consecutive failed deliveries, none ever succeeded", failures)
+	default:
+		res.text = fmt.Sprintf("%d consecutive failed deliveries since %s", failures, lastOK.Format(time.RFC3339))
+	}
+	res.perf = []perfValue{{label: "failures", value: float64(failures), warn: warn.String(), crit: crit.String(), min: "0"}}
+	return res, nil
+}
+
+// checkKeySourcePlugin fetches the unseal key shares and wipes them at
+// once. A failing source is CRITICAL; thresholds apply to the fetch time
+// in seconds.
+func checkKeySourcePlugin(cfg *VaultConfig, warn, crit *pluginRange) pluginResult {
+	res := pluginResult{service: pluginServices["keysource"]}
+	var failed, ok []string
+	for _, h := range probeKeySources(cfg) {
+		res.perf = append(res.perf, perfValue{label: h.source + "_fetch", value: h.took.Seconds(), uom: "s",
+			warn: warn.String(), crit: crit.String(), min: "0"})
+		if h.err != nil {
+			failed = append(failed, h.String())
+			res.status = pluginCritical
+			continue
+		}
+		if st := thresholdStatus(h.took.Seconds(), warn, crit); st > res.status {
+			res.status = st
+		}
+		ok = append(ok, h.String())
+	}
+	res.text = strings.Join(append(failed, ok...), "; ")
+	return res
+}
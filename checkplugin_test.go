@@ -0,0 +1,166 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// checkGolden compares got with testdata/name, or rewrites it with -update.
+func checkGolden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("%s:\n got %q\nwant %q", name, got, want)
+	}
+}
+
+// captureStdout returns what fn prints.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	out := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		out <- string(b)
+	}()
+	defer func() { os.Stdout = stdout }()
+	fn()
+	w.Close()
+	return <-out
+}
+
+func TestCheckPluginGolden(t *testing.T) {
+	v := newFakeVault(t)
+	dir := t.TempDir()
+	auditLog := filepath.Join(dir, "audit.log")
+	history := filepath.Join(dir, "history.jsonl")
+	config := filepath.Join(dir, "config.yaml")
+	os.WriteFile(config, []byte(fmt.Sprintf(`address: %q
+webhook_url: "https://discord.com/api/webhooks/1/x"
+unseal_keys: ["k1"]
+state_file: %q
+audit_log: %q
+history_file: %q
+`, v.URL, filepath.Join(dir, "state.json"), auditLog, history)), 0o600)
+
+	// Entries stamped ahead of now have no lag, so the output is stable.
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339Nano)
+	os.WriteFile(auditLog, []byte(`{"time":"2020-01-01T00:00:00Z","type":"request"}`+"\n"+`{"time":"`+future+`","type":"response"}`+"\nnot json\n"), 0o600)
+	// Each sealed case starts its downtime afresh, so it reads 0s.
+	resetSeal := func() { os.Remove(filepath.Join(dir, "state.json")) }
+	writeHistory := func(delivered ...bool) {
+		var b strings.Builder
+		for i, ok := range delivered {
+			fmt.Fprintf(&b, `{"time":"2026-10-14T08:%02d:00Z","backend":"discord","title":"t","payload":"{}","delivered":%v}`+"\n", i, ok)
+		}
+		os.WriteFile(history, []byte(b.String()), 0o600)
+	}
+
+	tests := []struct {
+		golden string
+		setup  func()
+		args   []string
+	}{
+		{"seal-unsealed.golden", func() { v.sealed = false }, []string{"-mode", "seal"}},
+		{"seal-sealed.golden", func() { v.sealed, v.progress = true, 1; resetSeal() }, []string{"-mode", "seal"}},
+		{"seal-sealed-warning.golden", resetSeal, []string{"-mode", "seal", "-warning", "~:-1", "-critical", "600"}},
+		{"seal-uninitialized.golden", func() { v.initialized = false }, []string{"-mode", "seal"}},
+		{"audit-lag.golden", nil, []string{"-mode", "audit-lag", "-warning", "5", "-critical", "30"}},
+		{"webhook-ok.golden", func() { writeHistory(false, true) }, []string{"-mode", "webhook"}},
+		{"webhook-warning.golden", func() { writeHistory(true, false) }, []string{"-mode", "webhook"}},
+		{"webhook-critical.golden", func() { writeHistory(false, false, false) }, []string{"-mode", "webhook"}},
+		{"webhook-since.golden", func() { writeHistory(true, false, false, false) }, []string{"-mode", "webhook", "-critical", "@3:"}},
+		{"bad-range.golden", nil, []string{"-mode", "seal", "-warning", "20:10"}},
+		{"bad-mode.golden", nil, []string{"-mode", "disk"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.golden, func(t *testing.T) {
+			if tt.setup != nil {
+				v.mu.Lock()
+				tt.setup()
+				v.mu.Unlock()
+			}
+			doc, err := loadConfig(config, "")
+			var code int
+			out := captureStdout(t, func() { code = runCheckPlugin(doc, err, tt.args) })
+			checkGolden(t, filepath.Join("check-plugin", tt.golden), fmt.Sprintf("exit %d\n%s", code, out))
+		})
+	}
+}
+
+func TestPerfdataSyntax(t *testing.T) {
+	tests := []struct {
+		p    perfValue
+		want string
+	}{
+		{perfValue{label: "lag", value: 2.14, uom: "s", warn: "5", crit: "30"}, "lag=2.1s;5;30"},
+		{perfValue{label: "seal_downtime", value: 0, uom: "s", min: "0"}, "seal_downtime=0s;;;0"},
+		{perfValue{label: "failures", value: 3}, "failures=3"},
+		{perfValue{label: "vault kv_fetch", value: 0.25, uom: "s"}, "'vault kv_fetch'=0.3s"},
+		{perfValue{label: "it's", value: 1}, "'it''s'=1"},
+		{perfValue{label: "a", value: 1, max: "10"}, "a=1;;;;10"},
+	}
+	for _, tt := range tests {
+		if got := tt.p.String(); got != tt.want {
+			t.Errorf("perfdata = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestPluginRanges(t *testing.T) {
+	tests := []struct {
+		rng    string
+		alerts []float64
+		quiet  []float64
+	}{
+		{"10", []float64{-1, 11}, []float64{0, 10}},
+		{"10:", []float64{9.9}, []float64{10, 1e9}},
+		{"~:10", []float64{10.1}, []float64{-1e9, 10}},
+		{"10:20", []float64{9, 21}, []float64{10, 20}},
+		{"@10:20", []float64{10, 15, 20}, []float64{9, 21}},
+	}
+	for _, tt := range tests {
+		r, err := parsePluginRange(tt.rng)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.rng, err)
+		}
+		for _, v := range tt.alerts {
+			if !r.alert(v) {
+				t.Errorf("%s: %v doesn't alert", tt.rng, v)
+			}
+		}
+		for _, v := range tt.quiet {
+			if r.alert(v) {
+				t.Errorf("%s: %v alerts", tt.rng, v)
+			}
+		}
+	}
+	for _, bad := range []string{"x", "20:10", "1:y", "@"} {
+		if _, err := parsePluginRange(bad); err == nil {
+			t.Errorf("parsePluginRange(%q) accepted", bad)
+		}
+	}
+}
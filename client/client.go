@@ -0,0 +1,357 @@
+// Package client talks to the admin API of a running vault-warden audit
+// process, over its unix socket or over TCP with a bearer token.
+//
+// The warden's own commands use this package, and the server encodes the
+// types defined here, so the two can't drift apart.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultTimeout bounds each attempt of a call when the context sets
+	// no deadline of its own.
+	DefaultTimeout = 10 * time.Second
+	// DefaultRetries is how many times idempotent calls are retried after
+	// a connection error or a 5xx answer.
+	DefaultRetries = 2
+
+	maxBody = 4 << 20
+)
+
+// Client is a connection to one warden. It is safe for concurrent use.
+type Client struct {
+	// Timeout bounds each attempt; 0 means DefaultTimeout.
+	Timeout time.Duration
+	// Retries of idempotent calls; negative means none.
+	Retries int
+
+	base  string
+	addr  string // for errors
+	token string
+	http  *http.Client
+}
+
+// NewUnix returns a client for the admin socket at path, which needs no
+// token: the socket is owner-only.
+func NewUnix(path string) *Client {
+	tr := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}
+	return &Client{Retries: DefaultRetries, base: "http://warden", addr: path, http: &http.Client{Transport: tr}}
+}
+
+// NewTCP returns a client for the admin listener at addr, e.g.
+// "127.0.0.1:8201", authenticating with token (admin.token).
+func NewTCP(addr, token string) *Client {
+	return &Client{Retries: DefaultRetries, base: "http://" + addr, addr: addr, token: token, http: &http.Client{}}
+}
+
+// Error is a request the warden answered with an error status.
+type Error struct {
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("warden returned %d: %s", e.Status, e.Message)
+}
+
+// IsNotFound reports whether err is a 404, e.g. from a warden too old to
+// serve the endpoint.
+func IsNotFound(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Status == http.StatusNotFound
+}
+
+// do sends one request, retrying idempotent ones, and returns the body.
+func (c *Client) do(ctx context.Context, method, path string, body []byte) ([]byte, error) {
+	retries := c.Retries
+	if method != http.MethodGet || retries < 0 {
+		retries = 0
+	}
+	var err error
+	for attempt := 0; ; attempt++ {
+		var out []byte
+		var retry bool
+		out, retry, err = c.once(ctx, method, path, body)
+		if err == nil || !retry || attempt >= retries {
+			return out, err
+		}
+		t := time.NewTimer(time.Duration(attempt+1) * 200 * time.Millisecond)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, err
+		case <-t.C:
+		}
+	}
+}
+
+func (c *Client) once(ctx context.Context, method, path string, body []byte) ([]byte, bool, error) {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, true, fmt.Errorf("contact warden at %s (is `audit` running?): %w", c.addr, err)
+	}
+	defer resp.Body.Close()
+	out, err := io.ReadAll(io.LimitReader(resp.Body, maxBody))
+	if err != nil {
+		return nil, true, fmt.Errorf("read warden response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode >= 500, &Error{resp.StatusCode, strings.TrimSpace(string(out))}
+	}
+	return out, false, nil
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, v interface{}) error {
+	out, err := c.do(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(out, v); err != nil {
+		return fmt.Errorf("decode %s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Client) text(ctx context.Context, method, path string) (string, error) {
+	out, err := c.do(ctx, method, path, nil)
+	return strings.TrimSpace(string(out)), err
+}
+
+// Status is the warden's /statusz document. Only the fields every
+// version has are typed; Raw is the whole document.
+type Status struct {
+	Version string          `json:"version"`
+	Mode    string          `json:"mode"`
+	Queue   map[string]int  `json:"queue,omitempty"`
+	Raw     json.RawMessage `json:"-"`
+}
+
+// Status fetches the warden's status.
+func (c *Client) Status(ctx context.Context) (*Status, error) {
+	var raw json.RawMessage
+	if err := c.getJSON(ctx, "/statusz", &raw); err != nil {
+		return nil, err
+	}
+	st := &Status{Raw: raw}
+	if err := json.Unmarshal(raw, st); err != nil {
+		return nil, fmt.Errorf("decode /statusz: %w", err)
+	}
+	return st, nil
+}
+
+// Mode is "active" or "standby".
+func (c *Client) Mode(ctx context.Context) (string, error) {
+	return c.text(ctx, http.MethodGet, "/mode")
+}
+
+// Promote makes a standby warden active. It returns the new mode, or
+// "already active".
+func (c *Client) Promote(ctx context.Context) (string, error) {
+	return c.text(ctx, http.MethodPost, "/promote")
+}
+
+// Demote puts an active warden in standby. It returns the new mode, or
+// "already standby".
+func (c *Client) Demote(ctx context.Context) (string, error) {
+	return c.text(ctx, http.MethodPost, "/demote")
+}
+
+// ReloadResult is what a reload did. Applied is false when the config
+// canary held the new rules back; Canary says why.
+type ReloadResult struct {
+	Applied bool          `json:"applied"`
+	Changed []string      `json:"changed,omitempty"` // top-level settings
+	Canary  *CanaryResult `json:"canary,omitempty"`
+}
+
+// CanaryResult compares the alerts the running and the reloaded rules
+// raise over the entries read lately.
+type CanaryResult struct {
+	Entries     int          `json:"entries"`
+	Window      string       `json:"window"`
+	OldAlerts   int          `json:"old_alerts"`
+	NewAlerts   int          `json:"new_alerts"`
+	Rules       []CanaryRule `json:"rules,omitempty"`        // those whose count changed
+	NewCritical []string     `json:"new_critical,omitempty"` // "rule request-id"
+	Passed      bool         `json:"passed"`
+	Reason      string       `json:"reason,omitempty"` // why it didn't
+	Forced      bool         `json:"forced,omitempty"`
+}
+
+// CanaryRule is one rule's alert count with each rule set.
+type CanaryRule struct {
+	Name string `json:"name"`
+	Old  int    `json:"old"`
+	New  int    `json:"new"`
+}
+
+// Reload has the warden re-read its config, as on SIGHUP. With force the
+// new rules are applied even when the config canary holds them back. It
+// isn't retried.
+func (c *Client) Reload(ctx context.Context, force bool) (*ReloadResult, error) {
+	path := "/reload"
+	if force {
+		path += "?force=1"
+	}
+	out, err := c.do(ctx, http.MethodPost, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	var r ReloadResult
+	if err := json.Unmarshal(out, &r); err != nil {
+		return nil, fmt.Errorf("decode /reload: %w", err)
+	}
+	return &r, nil
+}
+
+// Rule is one rule an audit entry is checked against. Built-in rules
+// come from the warden's detectors and only have a name.
+type Rule struct {
+	Name       string   `json:"name"`
+	Builtin    bool     `json:"builtin,omitempty"`
+	Paths      []string `json:"paths,omitempty"`
+	PathRegex  string   `json:"path_regex,omitempty"`
+	Operations []string `json:"operations,omitempty"`
+	Severity   string   `json:"severity,omitempty"`
+	Title      string   `json:"title,omitempty"`
+	When       string   `json:"when,omitempty"`
+}
+
+// Rules lists the configured rules, then the built-in ones.
+func (c *Client) Rules(ctx context.Context) ([]Rule, error) {
+	var rules []Rule
+	err := c.getJSON(ctx, "/rules", &rules)
+	return rules, err
+}
+
+// TestNotificationResult is the test alert the warden raised.
+type TestNotificationResult struct {
+	AlertID  string `json:"alert_id"`
+	Notifier string `json:"notifier"`
+}
+
+// TestNotification has the warden raise an info alert through its
+// notifier and sinks. It isn't retried: each call raises one alert.
+func (c *Client) TestNotification(ctx context.Context) (*TestNotificationResult, error) {
+	out, err := c.do(ctx, http.MethodPost, "/test-notification", []byte("{}"))
+	if err != nil {
+		return nil, err
+	}
+	var r TestNotificationResult
+	if err := json.Unmarshal(out, &r); err != nil {
+		return nil, fmt.Errorf("decode /test-notification: %w", err)
+	}
+	return &r, nil
+}
+
+// HistoryQuery selects a page of the alert history, oldest first.
+type HistoryQuery struct {
+	Cursor    string    // from the previous page's Next; empty starts at the beginning
+	Limit     int       // records per page; 0 means the server's default of 100
+	Since     time.Time // only deliveries at or after this time
+	Rule      string
+	RequestID string
+}
+
+// HistoryRecord is one delivery attempt of an alert.
+type HistoryRecord struct {
+	Time        time.Time `json:"time"`
+	Backend     string    `json:"backend"`
+	AlertID     string    `json:"alert_id,omitempty"`
+	Rule        string    `json:"rule,omitempty"`
+	Title       string    `json:"title"`
+	Severity    string    `json:"severity,omitempty"`
+	Environment string    `json:"environment,omitempty"`
+	RequestID   string    `json:"request_id,omitempty"`
+	Delivered   bool      `json:"delivered"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// HistoryPage is one page of records. Next is empty on the last page.
+type HistoryPage struct {
+	Records []HistoryRecord `json:"records"`
+	Next    string          `json:"next,omitempty"`
+}
+
+// History fetches one page of the alert history.
+func (c *Client) History(ctx context.Context, q HistoryQuery) (*HistoryPage, error) {
+	v := url.Values{}
+	if q.Cursor != "" {
+		v.Set("cursor", q.Cursor)
+	}
+	if q.Limit > 0 {
+		v.Set("limit", strconv.Itoa(q.Limit))
+	}
+	if !q.Since.IsZero() {
+		v.Set("since", q.Since.UTC().Format(time.RFC3339))
+	}
+	if q.Rule != "" {
+		v.Set("rule", q.Rule)
+	}
+	if q.RequestID != "" {
+		v.Set("request_id", q.RequestID)
+	}
+	path := "/history"
+	if len(v) > 0 {
+		path += "?" + v.Encode()
+	}
+	var p HistoryPage
+	if err := c.getJSON(ctx, path, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// EachHistory calls fn for every record matching q, fetching page after
+// page, until fn returns an error or the history ends.
+func (c *Client) EachHistory(ctx context.Context, q HistoryQuery, fn func(HistoryRecord) error) error {
+	for {
+		p, err := c.History(ctx, q)
+		if err != nil {
+			return err
+		}
+		for _, r := range p.Records {
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+		if p.Next == "" {
+			return nil
+		}
+		q.Cursor = p.Next
+	}
+}
@@ -0,0 +1,275 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// counted is a handler that answers with fn and counts its requests.
+type counted struct {
+	mu    sync.Mutex
+	calls int
+	fn    func(w http.ResponseWriter, r *http.Request, call int)
+}
+
+func (h *counted) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	h.calls++
+	call := h.calls
+	h.mu.Unlock()
+	h.fn(w, r, call)
+}
+
+func (h *counted) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.calls
+}
+
+func tcpClient(t *testing.T, h http.Handler) *Client {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return NewTCP(strings.TrimPrefix(srv.URL, "http://"), "s3cret-token-0123")
+}
+
+func TestUnixTransport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			t.Errorf("unix socket request sent %q", auth)
+		}
+		fmt.Fprintln(w, "active since 2026-10-14T08:00:00Z")
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	got, err := NewUnix(path).Mode(context.Background())
+	if err != nil || got != "active since 2026-10-14T08:00:00Z" {
+		t.Errorf("Mode = %q, %v", got, err)
+	}
+}
+
+func TestTokenSent(t *testing.T) {
+	c := tcpClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer s3cret-token-0123" {
+			http.Error(w, "missing or wrong token", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"version":"1.2.3","mode":"standby since x","queue":{"critical":2},"jobs":[]}`)
+	}))
+	st, err := c.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Version != "1.2.3" || st.Mode != "standby since x" || st.Queue["critical"] != 2 || !strings.Contains(string(st.Raw), `"jobs":[]`) {
+		t.Errorf("status = %+v, raw %s", st, st.Raw)
+	}
+
+	c.token = "wrong"
+	_, err = c.Status(context.Background())
+	var e *Error
+	if !errors.As(err, &e) || e.Status != http.StatusUnauthorized || e.Message != "missing or wrong token" {
+		t.Errorf("err = %v, want the 401", err)
+	}
+}
+
+// Reads are retried after a 5xx, actions never, and a 4xx is final.
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		name   string
+		call   func(*Client) error
+		status int
+		calls  int
+	}{
+		{"read after 503", func(c *Client) error { _, err := c.Rules(context.Background()); return err }, http.StatusServiceUnavailable, 3},
+		{"read after 404", func(c *Client) error { _, err := c.Rules(context.Background()); return err }, http.StatusNotFound, 1},
+		{"reload", func(c *Client) error { _, err := c.Reload(context.Background(), false); return err }, http.StatusInternalServerError, 1},
+		{"test notification", func(c *Client) error { _, err := c.TestNotification(context.Background()); return err }, http.StatusBadGateway, 1},
+		{"promote", func(c *Client) error { _, err := c.Promote(context.Background()); return err }, http.StatusInternalServerError, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &counted{fn: func(w http.ResponseWriter, r *http.Request, call int) {
+				http.Error(w, "nope", tt.status)
+			}}
+			c := tcpClient(t, h)
+			err := tt.call(c)
+			var e *Error
+			if !errors.As(err, &e) || e.Status != tt.status {
+				t.Errorf("err = %v, want a %d", err, tt.status)
+			}
+			if h.count() != tt.calls {
+				t.Errorf("%d requests, want %d", h.count(), tt.calls)
+			}
+		})
+	}
+}
+
+func TestRetryRecovers(t *testing.T) {
+	h := &counted{fn: func(w http.ResponseWriter, r *http.Request, call int) {
+		if call == 1 {
+			http.Error(w, "starting", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `[{"name":"root-policy","paths":["sys/policies/acl/root"]},{"name":"unseal","builtin":true}]`)
+	}}
+	rules, err := tcpClient(t, h).Rules(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules[0].Name != "root-policy" || rules[0].Paths[0] != "sys/policies/acl/root" || !rules[1].Builtin {
+		t.Errorf("rules = %+v", rules)
+	}
+
+	c := tcpClient(t, h)
+	c.Retries = -1
+	h.calls = 0
+	if _, err := c.Rules(context.Background()); err == nil {
+		t.Error("Retries -1 retried")
+	}
+}
+
+// Nothing listening is a connection error, retried, and the message says
+// where the client looked.
+func TestConnectionRefused(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	c := NewTCP(addr, "")
+	start := time.Now()
+	_, err = c.Status(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "contact warden at "+addr+" (is `audit` running?)") {
+		t.Errorf("err = %v", err)
+	}
+	if took := time.Since(start); took < 600*time.Millisecond {
+		t.Errorf("gave up after %s, want two retries with backoff", took)
+	}
+}
+
+// The context ends the retries, and Timeout bounds each attempt.
+func TestContextAndTimeout(t *testing.T) {
+	h := &counted{fn: func(w http.ResponseWriter, r *http.Request, call int) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}}
+	c := tcpClient(t, h)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.Rules(ctx); err == nil {
+		t.Fatal("no error")
+	}
+	if took := time.Since(start); took > 150*time.Millisecond || h.count() != 1 {
+		t.Errorf("%d requests in %s, want one, ended by the context", h.count(), took)
+	}
+
+	release := make(chan struct{})
+	defer close(release)
+	slow := tcpClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	slow.Timeout, slow.Retries = 50*time.Millisecond, -1
+	start = time.Now()
+	if _, err := slow.Mode(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want the deadline", err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("took %s with a 50ms timeout", took)
+	}
+}
+
+func TestIsNotFound(t *testing.T) {
+	c := tcpClient(t, http.NotFoundHandler())
+	_, err := c.History(context.Background(), HistoryQuery{})
+	if !IsNotFound(err) {
+		t.Errorf("IsNotFound(%v) = false", err)
+	}
+	if IsNotFound(errors.New("404")) || IsNotFound(&Error{Status: 500}) {
+		t.Error("IsNotFound true for other errors")
+	}
+}
+
+func TestHistoryQuery(t *testing.T) {
+	var got []string
+	c := tcpClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.URL.RequestURI())
+		fmt.Fprint(w, `{"records":[]}`)
+	}))
+	since := time.Date(2026, 10, 1, 12, 0, 0, 0, time.FixedZone("CEST", 2*3600))
+	for _, q := range []HistoryQuery{
+		{},
+		{Cursor: "7", Limit: 50, Since: since, Rule: "privileged-access", RequestID: "r 1"},
+	} {
+		if _, err := c.History(context.Background(), q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"/history", "/history?cursor=7&limit=50&request_id=r+1&rule=privileged-access&since=2026-10-01T10%3A00%3A00Z"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("requests = %q, want %q", got, want)
+	}
+}
+
+// EachHistory follows Next to the last page, and stops at fn's error.
+func TestEachHistory(t *testing.T) {
+	pages := map[string]string{
+		"":  `{"records":[{"title":"a","backend":"discord","delivered":true},{"title":"b"}],"next":"2"}`,
+		"2": `{"records":[{"title":"c"}],"next":"3"}`,
+		"3": `{"records":[{"title":"d"}]}`,
+	}
+	c := tcpClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("limit") != "2" {
+			t.Errorf("limit = %q, want 2 on every page", r.URL.Query().Get("limit"))
+		}
+		fmt.Fprint(w, pages[r.URL.Query().Get("cursor")])
+	}))
+	var titles []string
+	err := c.EachHistory(context.Background(), HistoryQuery{Limit: 2}, func(r HistoryRecord) error {
+		titles = append(titles, r.Title)
+		return nil
+	})
+	if err != nil || strings.Join(titles, "") != "abcd" {
+		t.Errorf("titles = %q, %v; want abcd", titles, err)
+	}
+
+	stop := errors.New("enough")
+	titles = nil
+	err = c.EachHistory(context.Background(), HistoryQuery{Limit: 2}, func(r HistoryRecord) error {
+		titles = append(titles, r.Title)
+		if r.Title == "c" {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || strings.Join(titles, "") != "abc" {
+		t.Errorf("titles = %q, %v; want abc and fn's error", titles, err)
+	}
+}
+
+func TestUndecodable(t *testing.T) {
+	c := tcpClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "<html>")
+	}))
+	if _, err := c.Reload(context.Background(), true); err == nil || !strings.Contains(err.Error(), "decode /reload") {
+		t.Errorf("err = %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package client_test
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"vault-warden/client"
+)
+
+func ExampleNewUnix() {
+	c := client.NewUnix("/run/vault-warden/admin.sock")
+	st, err := c.Status(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(st.Version, st.Mode)
+}
+
+func ExampleNewTCP() {
+	c := client.NewTCP("127.0.0.1:8201", "the admin.token of the warden")
+	c.Timeout = 3 * time.Second
+	rules, err := c.Rules(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, r := range rules {
+		if !r.Builtin {
+			fmt.Println(r.Name, r.Severity, r.Paths)
+		}
+	}
+}
+
+func ExampleClient_EachHistory() {
+	c := client.NewUnix("/run/vault-warden/admin.sock")
+	q := client.HistoryQuery{Rule: "privileged-access", Since: time.Now().Add(-24 * time.Hour)}
+	err := c.EachHistory(context.Background(), q, func(r client.HistoryRecord) error {
+		fmt.Println(r.Time.Format(time.RFC3339), r.Backend, r.Title, r.Delivered)
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func ExampleClient_Reload() {
+	c := client.NewUnix("/run/vault-warden/admin.sock")
+	res, err := c.Reload(context.Background(), false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !res.Applied {
+		fmt.Println("held back by the config canary:", res.Canary.Reason)
+		return
+	}
+	fmt.Println("changed:", res.Changed)
+}
+
+func ExampleIsNotFound() {
+	c := client.NewUnix("/run/vault-warden/admin.sock")
+	_, err := c.History(context.Background(), client.HistoryQuery{Limit: 10})
+	if client.IsNotFound(err) {
+		fmt.Println("the warden keeps no history_file")
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// --- Multiple Clusters ---
+
+const defaultUnlockConcurrency = 4
+
+// VaultTarget is one cluster of a config listing several under vaults.
+// Everything not set here is shared.
+type VaultTarget struct {
+	Label      string   `yaml:"label"` // default: the address's host name
+	Address    string   `yaml:"address"`
+	UnsealKeys []string `yaml:"unseal_keys"`
+	Nodes      []string `yaml:"nodes"`
+	// StateFile defaults to state_file with the label added, e.g.
+	// state.prod.json, so ceremonies and pins don't mix.
+	StateFile     string         `yaml:"state_file"`
+	VaultTLS      VaultTLSConfig `yaml:",inline"`       // replaces the shared settings when any is set
+	Authorization string         `yaml:"authorization"` // replaces the top-level one when set, e.g. none for dev
+	SealToken     string         `yaml:"seal_token"`    // replaces the top-level one when set
+}
+
+var clusterLabelPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// validateVaults checks the vaults list and fills in its defaults. The
+// first cluster also becomes the top-level address, keys, TLS and state
+// file, for the commands that talk to a single cluster.
+func validateVaults(cfg *VaultConfig) error {
+	if cfg.Address != "" || len(cfg.UnsealKeys) > 0 || len(cfg.UnsealKeysCommand) > 0 || len(cfg.Nodes) > 0 {
+		return &fieldError{"vaults", "cannot be combined with a top-level address, unseal_keys, unseal_keys_command or nodes"}
+	}
+	if cfg.UnlockConcurrency == 0 {
+		cfg.UnlockConcurrency = defaultUnlockConcurrency
+	}
+	if cfg.UnlockConcurrency < 1 {
+		return &fieldError{"unlock_concurrency", "must be at least 1"}
+	}
+	base := newStateStore(cfg.StateFile).path
+	seen := make(map[string]bool)
+	for i := range cfg.Vaults {
+		v := &cfg.Vaults[i]
+		field := fmt.Sprintf("vaults[%d]", i)
+		if v.Address == "" {
+			return &fieldError{field + ".address", "is required"}
+		}
+		if len(v.UnsealKeys) == 0 {
+			return &fieldError{field + ".unseal_keys", "is required"}
+		}
+		for j, k := range v.UnsealKeys {
+			if strings.HasPrefix(k, keyFileScheme) && !filepath.IsAbs(strings.TrimPrefix(k, keyFileScheme)) {
+				return &fieldError{fmt.Sprintf("%s.unseal_keys[%d]", field, j), "file reference must be an absolute path, e.g. file:///etc/vault-warden/keys/1"}
+			}
+		}
+		if v.Label == "" {
+			if u, err := url.Parse(v.Address); err == nil {
+				v.Label = u.Hostname()
+			}
+		}
+		if !clusterLabelPattern.MatchString(v.Label) {
+			return &fieldError{field + ".label", fmt.Sprintf("%q must be letters, digits, '.', '_' or '-'", v.Label)}
+		}
+		if seen[v.Label] {
+			return &fieldError{field + ".label", fmt.Sprintf("duplicate cluster label %q", v.Label)}
+		}
+		seen[v.Label] = true
+		if v.StateFile == "" {
+			ext := filepath.Ext(base)
+			v.StateFile = strings.TrimSuffix(base, ext) + "." + v.Label + ext
+		}
+		if err := validateNodes(field+".nodes", v.Nodes); err != nil {
+			return err
+		}
+		if v.VaultTLS != (VaultTLSConfig{}) && !strings.HasPrefix(v.Address, "https://") {
+			return &fieldError{field + ".address", "must be https:// when " + vaultTLSKeys + " is set"}
+		}
+		if err := validateVaultTLS(field+".", v.VaultTLS); err != nil {
+			return err
+		}
+	}
+	cfg.sharedTLS = cfg.VaultTLS
+	first := clusterConfigs(cfg)[0]
+	cfg.Address, cfg.UnsealKeys, cfg.Nodes, cfg.StateFile, cfg.VaultTLS, cfg.label =
+		first.Address, first.UnsealKeys, first.Nodes, first.StateFile, first.VaultTLS, first.label
+	return nil
+}
+
+// validateNodes checks a cluster's node addresses.
+func validateNodes(field string, nodes []string) error {
+	seen := make(map[string]bool)
+	for i, n := range nodes {
+		u, err := url.Parse(n)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return &fieldError{fmt.Sprintf("%s[%d]", field, i), fmt.Sprintf("%q must be an http:// or https:// address", n)}
+		}
+		if seen[u.Host] {
+			return &fieldError{fmt.Sprintf("%s[%d]", field, i), fmt.Sprintf("duplicate node %q", u.Host)}
+		}
+		seen[u.Host] = true
+	}
+	return nil
+}
+
+// clusterConfigs returns a config per cluster: the config itself without
+// a vaults list.
+func clusterConfigs(cfg *VaultConfig) []*VaultConfig {
+	if len(cfg.Vaults) == 0 {
+		return []*VaultConfig{cfg}
+	}
+	out := make([]*VaultConfig, 0, len(cfg.Vaults))
+	for _, v := range cfg.Vaults {
+		c := *cfg
+		c.Vaults = nil
+		c.Address, c.UnsealKeys, c.Nodes, c.StateFile, c.label = v.Address, v.UnsealKeys, v.Nodes, v.StateFile, v.Label
+		c.VaultTLS = cfg.sharedTLS
+		if v.VaultTLS != (VaultTLSConfig{}) {
+			c.VaultTLS = v.VaultTLS
+		}
+		if v.Authorization != "" {
+			c.Authorization = v.Authorization
+		}
+		if v.SealToken != "" {
+			c.SealToken = v.SealToken
+		}
+		out = append(out, &c)
+	}
+	return out
+}
+
+// selectClusters narrows the clusters to the one labelled name, if set.
+func selectClusters(cfg *VaultConfig, name string) ([]*VaultConfig, error) {
+	all := clusterConfigs(cfg)
+	if name == "" {
+		return all, nil
+	}
+	var labels []string
+	for _, c := range all {
+		if clusterLabel(c) == name {
+			return []*VaultConfig{c}, nil
+		}
+		labels = append(labels, clusterLabel(c))
+	}
+	return nil, fmt.Errorf("no cluster labelled %q; configured: %s", name, strings.Join(labels, ", "))
+}
+
+// publishSealState reports a seal state to MQTT and Grafana, per cluster
+// when there are several.
+func publishSealState(cfg *VaultConfig, state string) {
+	if cfg.label == "" {
+		mqttSink.publishState(state)
+		grafanaSink.sealState(state)
+		return
+	}
+	mqttSink.publishClusterState(cfg.label, state)
+	grafanaSink.clusterSealState(cfg.label, state)
+}
+
+// unlockResult is how one cluster's unlock went.
+type unlockResult struct {
+	label    string
+	outcome  unlockOutcome
+	err      error
+	startup  startupRetries
+	approval unsealApproval // zero when none was needed
+}
+
+var (
+	msgUnlockSummary  = message("unlock.summary.title")
+	msgUnlockSealed   = message("unlock.summary.sealed.title")
+	msgUnlockBody     = message("unlock.summary.body")
+	msgUnlockUnsealed = message("unlock.summary.unsealed")
+	msgUnlockAlready  = message("unlock.summary.already")
+	msgUnlockFailed   = message("unlock.summary.failed")
+	msgUnlockApproved = message("unlock.summary.approved")
+	msgUnlockApproval = message("unlock.summary.approval")
+)
+
+// unlockAll unlocks the clusters concurrently, at most
+// unlock_concurrency at a time. One cluster failing doesn't stop the
+// others; the error says which remain sealed.
+func unlockAll(cfg *VaultConfig, targets []*VaultConfig, opts unlockOptions) ([]unlockResult, error) {
+	results := make([]unlockResult, len(targets))
+	sem := make(chan struct{}, cfg.UnlockConcurrency)
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func(i int, t *VaultConfig) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			r := &results[i]
+			r.label = clusterLabel(t)
+			defer func() {
+				if p := recover(); p != nil {
+					r.outcome, r.err = unlockFailed, fmt.Errorf("panic: %v", p)
+				}
+			}()
+			logInfo("🏛️  {cluster}: {address}", "cluster", r.label, "address", t.Address)
+			o := opts
+			o.startup, o.approval = &r.startup, &r.approval
+			r.outcome, r.err = unlockCluster(t, o)
+			if r.err != nil {
+				logError("❌ {cluster}: {error}", "cluster", r.label, "error", r.err)
+			}
+		}(i, t)
+	}
+	wg.Wait()
+
+	var already, unsealed, failed []string
+	var failures []string
+	var approvals []unsealApproval
+	var approvalLines []localText
+	fmt.Println("📋 Unlock summary:")
+	for _, r := range results {
+		switch {
+		case r.err != nil:
+			fmt.Printf("  ❌ %s: failed: %v\n", r.label, r.err)
+			failed = append(failed, r.label)
+			failures = append(failures, fmt.Sprintf("• %s: %s", mdCode(r.label, maxNameLen), mdText(r.err.Error(), maxPathLen)))
+		case r.outcome == unlockUnsealed:
+			fmt.Printf("  🔓 %s: unsealed now\n", r.label)
+			unsealed = append(unsealed, r.label)
+			if ap := r.approval.list(); ap != nil {
+				approvals = append(approvals, ap...)
+				approvalLines = append(approvalLines, msgUnlockApproval.with("cluster", mdCode(r.label, maxNameLen),
+					"approver", mdText(r.approval.Approver, maxNameLen), "source", r.approval.Source))
+			}
+		default:
+			fmt.Printf("  ✓ %s: already unsealed\n", r.label)
+			already = append(already, r.label)
+		}
+	}
+
+	// Repeating "all already unsealed" every timer run would be noise.
+	if len(unsealed) > 0 || len(failed) > 0 {
+		var lines []localText
+		for _, g := range []struct {
+			name   msgID
+			labels []string
+		}{{msgUnlockUnsealed, unsealed}, {msgUnlockAlready, already}} {
+			if len(g.labels) > 0 {
+				lines = append(lines, g.name.with("clusters", mdText(strings.Join(g.labels, ", "), maxPathLen)))
+			}
+		}
+		if len(approvalLines) > 0 {
+			lines = append(lines, msgUnlockApproved.with("approvals", approvalLines))
+		}
+		if len(failures) > 0 {
+			lines = append(lines, msgUnlockFailed.with("failures", strings.Join(failures, "\n")))
+		}
+		title, sev := msgUnlockSummary.with("count", len(unsealed), "total", len(results)), sevInfo
+		if len(failed) > 0 {
+			title, sev = msgUnlockSealed.with("count", len(failed), "total", len(results)), sevWarning
+		}
+		notify(cfg, Alert{Severity: sev, Color: sev.color(), Rule: "unseal", Approvals: approvals}.say(title, msgUnlockBody.with("lines", lines)))
+	}
+
+	if len(failed) == 0 {
+		return results, nil
+	}
+	err := fmt.Errorf("%d of %d clusters may still be sealed: %s", len(failed), len(results), strings.Join(failed, ", "))
+	// Keep a specific exit code when every failure had the same one.
+	code := 0
+	for _, r := range results {
+		var ee *exitError
+		switch {
+		case r.err == nil:
+		case !errors.As(r.err, &ee) || code != 0 && ee.code != code:
+			return results, err
+		default:
+			code = ee.code
+		}
+	}
+	return results, &exitError{code, err}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"sort"
+	"time"
+	"unicode/utf8"
+)
+
+// --- Burst Coalescing ---
+
+const (
+	defaultCoalesceWindow = 2 * time.Second
+	// Discord's limits per message: embeds, and characters across the
+	// titles, descriptions, field names and values, footers and authors
+	// of all of them.
+	discordMaxEmbeds = 10
+	discordMaxChars  = 6000
+	// And per embed.
+	discordTitleMax       = 256
+	discordDescriptionMax = 4096
+	discordMaxFields      = 25
+)
+
+// CoalesceConfig combines alerts queued close together into one Discord
+// message, so a burst costs one webhook call instead of ten.
+type CoalesceConfig struct {
+	// Window is how long the first alert of a burst waits for others. No
+	// alert waits longer than this after it was queued.
+	Window   Duration `yaml:"window"`
+	Disabled bool     `yaml:"disabled"`
+}
+
+func coalesceWindow(c CoalesceConfig) time.Duration {
+	if c.Disabled {
+		return 0
+	}
+	return time.Duration(c.Window)
+}
+
+// discordMessage is one webhook call's worth of alerts.
+type discordMessage struct {
+	alerts []Alert
+	embeds []DiscordEmbed
+}
+
+// embedChars counts an embed the way Discord applies its total limit.
+func embedChars(e DiscordEmbed) int {
+	n := utf8.RuneCountInString(e.Title) + utf8.RuneCountInString(e.Description)
+	if e.Footer != nil {
+		n += utf8.RuneCountInString(e.Footer.Text)
+	}
+	if e.Author != nil {
+		n += utf8.RuneCountInString(e.Author.Name)
+	}
+	for _, f := range e.Fields {
+		n += utf8.RuneCountInString(f.Name) + utf8.RuneCountInString(f.Value)
+	}
+	return n
+}
+
+// fitEmbed cuts an embed down to Discord's limits, so an oversized alert
+// is still delivered on its own rather than refused: the title and
+// description are clipped, then fields dropped from the end.
+func fitEmbed(e *DiscordEmbed) {
+	e.Title = clipRunes(e.Title, discordTitleMax)
+	e.Description = clipRunes(e.Description, discordDescriptionMax)
+	if len(e.Fields) > discordMaxFields {
+		e.Fields = e.Fields[:discordMaxFields]
+	}
+	over := embedChars(*e) - discordMaxChars
+	if over <= 0 {
+		return
+	}
+	if n := utf8.RuneCountInString(e.Description); n > over+1 {
+		e.Description = clipRunes(e.Description, n-over)
+		return
+	}
+	e.Description = ""
+	for len(e.Fields) > 0 && embedChars(*e) > discordMaxChars {
+		e.Fields = e.Fields[:len(e.Fields)-1]
+	}
+}
+
+// packAlerts orders a burst by severity, then time, and splits it into
+// messages within Discord's limits. An alert too large to share a message
+// is sent on its own.
+func packAlerts(alerts []Alert) []discordMessage {
+	sorted := append([]Alert(nil), alerts...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Severity != sorted[j].Severity {
+			return sorted[i].Severity > sorted[j].Severity
+		}
+		return sorted[i].Time.Before(sorted[j].Time)
+	})
+	var msgs []discordMessage
+	var cur discordMessage
+	chars := 0
+	for _, a := range sorted {
+		e := discordEmbed(a)
+		n := embedChars(e)
+		if len(cur.embeds) > 0 && (len(cur.embeds) == discordMaxEmbeds || chars+n > discordMaxChars) {
+			msgs = append(msgs, cur)
+			cur, chars = discordMessage{}, 0
+		}
+		cur.alerts = append(cur.alerts, a)
+		cur.embeds = append(cur.embeds, e)
+		chars += n
+	}
+	if len(cur.embeds) > 0 {
+		msgs = append(msgs, cur)
+	}
+	return msgs
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// burstAlert is an alert of roughly size characters, spread over its
+// description and fields the way real ones are.
+func burstAlert(r *rand.Rand, i, size int) Alert {
+	base := time.Date(2026, 10, 14, 8, 0, 0, 0, time.UTC)
+	a := Alert{ID: fmt.Sprintf("a%03d", i), Title: fmt.Sprintf("Alert %d", i), Severity: severity(r.Intn(3)),
+		Time: base.Add(time.Duration(r.Intn(2000)) * time.Millisecond), Rule: "burst",
+		User: "token-" + strings.Repeat("u", r.Intn(40)), Path: "secret/data/" + strings.Repeat("p", r.Intn(600)),
+		Operation: "read", SourceIP: "10.0.0.1", RequestID: fmt.Sprintf("req-%d", i)}
+	a.Description = strings.Repeat("d", size)
+	if r.Intn(4) == 0 {
+		a.Enrichment = map[string]string{}
+		for k := 0; k < r.Intn(30); k++ {
+			a.Enrichment[fmt.Sprintf("field-%02d", k)] = strings.Repeat("v", r.Intn(300))
+		}
+	}
+	return a
+}
+
+func checkMessageLimits(t *testing.T, m discordMessage) {
+	t.Helper()
+	if len(m.embeds) > discordMaxEmbeds {
+		t.Errorf("message has %d embeds, over %d", len(m.embeds), discordMaxEmbeds)
+	}
+	total := 0
+	for _, e := range m.embeds {
+		total += embedChars(e)
+		if n := utf8.RuneCountInString(e.Title); n > discordTitleMax {
+			t.Errorf("title is %d characters, over %d", n, discordTitleMax)
+		}
+		if n := utf8.RuneCountInString(e.Description); n > discordDescriptionMax {
+			t.Errorf("description is %d characters, over %d", n, discordDescriptionMax)
+		}
+		if len(e.Fields) > discordMaxFields {
+			t.Errorf("embed has %d fields, over %d", len(e.Fields), discordMaxFields)
+		}
+	}
+	if total > discordMaxChars {
+		t.Errorf("message has %d characters, over %d", total, discordMaxChars)
+	}
+}
+
+func TestPackAlertsLimits(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for round := 0; round < 200; round++ {
+		n := 1 + r.Intn(40)
+		maxSize := []int{50, 800, 3000, 12000}[r.Intn(4)]
+		alerts := make([]Alert, n)
+		for i := range alerts {
+			alerts[i] = burstAlert(r, i, r.Intn(maxSize))
+		}
+		msgs := packAlerts(alerts)
+
+		seen := map[string]bool{}
+		var order []Alert
+		for _, m := range msgs {
+			checkMessageLimits(t, m)
+			if len(m.alerts) != len(m.embeds) {
+				t.Fatalf("%d alerts for %d embeds", len(m.alerts), len(m.embeds))
+			}
+			for _, a := range m.alerts {
+				if seen[a.ID] {
+					t.Errorf("%s sent twice", a.ID)
+				}
+				seen[a.ID] = true
+			}
+			order = append(order, m.alerts...)
+		}
+		if len(seen) != n {
+			t.Fatalf("round %d: %d of %d alerts packed", round, len(seen), n)
+		}
+		for i := 1; i < len(order); i++ {
+			a, b := order[i-1], order[i]
+			if a.Severity < b.Severity || a.Severity == b.Severity && a.Time.After(b.Time) {
+				t.Fatalf("round %d: %s (%s, %s) before %s (%s, %s)", round, a.ID, a.Severity, a.Time, b.ID, b.Severity, b.Time)
+			}
+		}
+		if t.Failed() {
+			t.Fatalf("round %d failed", round)
+		}
+	}
+}
+
+// An alert too large for Discord is cut to fit rather than refused.
+func TestDiscordEmbedFitsAlone(t *testing.T) {
+	a := Alert{Title: strings.Repeat("T", 400), Description: strings.Repeat("d", 9000), Severity: sevCritical,
+		Path: strings.Repeat("p", 2000), Enrichment: map[string]string{}}
+	for k := 0; k < 40; k++ {
+		a.Enrichment[fmt.Sprintf("k%02d", k)] = strings.Repeat("v", 200)
+	}
+	msgs := packAlerts([]Alert{a})
+	if len(msgs) != 1 {
+		t.Fatalf("%d messages, want 1", len(msgs))
+	}
+	checkMessageLimits(t, msgs[0])
+	data, err := discordNotifier{}.encode(msgs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p DiscordPayload
+	if err := json.Unmarshal(data, &p); err != nil || !strings.HasSuffix(p.Embeds[0].Title, "…") {
+		t.Errorf("title = %.20q… (%v), want it cut with an ellipsis", p.Embeds[0].Title, err)
+	}
+}
+
+func TestPackAlertsSplitsAtEmbedLimit(t *testing.T) {
+	var alerts []Alert
+	for i := 0; i < 23; i++ {
+		alerts = append(alerts, queueAlert(fmt.Sprintf("a%02d", i), sevInfo))
+	}
+	var sizes []int
+	for _, m := range packAlerts(alerts) {
+		sizes = append(sizes, len(m.embeds))
+	}
+	if got := fmt.Sprint(sizes); got != "[10 10 3]" {
+		t.Errorf("messages = %s embeds, want [10 10 3]", got)
+	}
+}
+
+// batchRecorder delivers to a list of batches, noting when each went.
+type batchRecorder struct {
+	mu      sync.Mutex
+	batches [][]string
+	at      []time.Time
+}
+
+func (b *batchRecorder) deliver(alerts []Alert) ([]Alert, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var ids []string
+	for _, a := range alerts {
+		ids = append(ids, a.ID)
+	}
+	b.batches = append(b.batches, ids)
+	b.at = append(b.at, time.Now())
+	return nil, nil
+}
+
+func (b *batchRecorder) sent() ([][]string, []time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([][]string(nil), b.batches...), append([]time.Time(nil), b.at...)
+}
+
+// Alerts close together go out as one batch once the first one's window
+// is up; a critical that joins late waits less than the window.
+func TestQueueCoalescesBurst(t *testing.T) {
+	rec := &batchRecorder{}
+	q := testQueue(100, rec.deliver)
+	q.window = 200 * time.Millisecond
+	go q.run(0)
+	defer q.close(time.Second)
+
+	start := time.Now()
+	q.push(queueAlert("info-1", sevInfo))
+	time.Sleep(50 * time.Millisecond)
+	q.push(queueAlert("warn-1", sevWarning))
+	time.Sleep(50 * time.Millisecond)
+	critAt := time.Now()
+	q.push(queueAlert("crit-1", sevCritical))
+
+	waitFor(t, "the batch", func() bool { b, _ := rec.sent(); return len(b) > 0 })
+	batches, at := rec.sent()
+	if got := fmt.Sprint(batches); got != "[[info-1 warn-1 crit-1]]" {
+		t.Errorf("batches = %s, want the burst in one", got)
+	}
+	if waited := at[0].Sub(start); waited < q.window {
+		t.Errorf("sent after %s, before the %s window", waited, q.window)
+	}
+	if waited := at[0].Sub(critAt); waited > q.window {
+		t.Errorf("critical waited %s, longer than the %s window", waited, q.window)
+	}
+}
+
+// A backlog is sent in full batches without waiting out the window, and
+// batches never exceed Discord's embed limit.
+func TestQueueBacklogFullBatches(t *testing.T) {
+	rec := &batchRecorder{}
+	q := testQueue(100, rec.deliver)
+	q.window = 30 * time.Second
+	for i := 0; i < 25; i++ {
+		q.push(queueAlert(fmt.Sprintf("a%02d", i), sevWarning))
+		q.bySeverity[sevWarning][i].enqueued = time.Now().Add(-time.Minute)
+	}
+	q.push(queueAlert("crit", sevCritical))
+	q.bySeverity[sevCritical][0].enqueued = time.Now().Add(-time.Minute)
+	go q.run(0)
+	defer q.close(time.Second)
+
+	waitFor(t, "the backlog", func() bool { b, _ := rec.sent(); return len(b) == 3 })
+	batches, _ := rec.sent()
+	var sizes []int
+	for _, b := range batches {
+		sizes = append(sizes, len(b))
+	}
+	if got := fmt.Sprint(sizes); got != "[10 10 6]" {
+		t.Errorf("batch sizes = %s, want [10 10 6]", got)
+	}
+	if batches[0][0] != "crit" {
+		t.Errorf("first batch = %v, want the critical first", batches[0])
+	}
+}
+
+func TestQueueCoalesceDisabled(t *testing.T) {
+	rec := &batchRecorder{}
+	q := testQueue(100, rec.deliver)
+	q.window = coalesceWindow(CoalesceConfig{Window: Duration(time.Hour), Disabled: true})
+	for i := 0; i < 3; i++ {
+		q.push(queueAlert(fmt.Sprintf("a%d", i), sevInfo))
+	}
+	go q.run(0)
+	defer q.close(time.Second)
+	waitFor(t, "the sends", func() bool { b, _ := rec.sent(); return len(b) == 3 })
+	if batches, _ := rec.sent(); fmt.Sprint(batches) != "[[a0] [a1] [a2]]" {
+		t.Errorf("batches = %v, want one alert each", batches)
+	}
+}
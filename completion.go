@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// --- Command: Completion ---
+
+// completeTimeout bounds the dynamic lookups behind a completion, config
+// read and admin socket together, so a hung daemon or a slow config mount
+// costs the shell a fraction of a second rather than freezing it.
+const completeTimeout = 500 * time.Millisecond
+
+// Value kinds of flags and arguments. Completions for kindFile and kindDir
+// are left to the shell.
+const (
+	kindNone         = ""
+	kindValue        = "value" // free text, nothing to offer
+	kindFile         = "file"
+	kindDir          = "dir"
+	kindClusters     = "clusters"
+	kindRules        = "rules"
+	kindDestinations = "destinations"
+)
+
+// builtinRules are the rule names alerts carry regardless of config.
+var builtinRules = []string{
+	"audit-canary", "audit-integrity", "audit-log-missing", "auto-unseal", "cluster-binding", "config-canary", "external-unseal", "first-time-access",
+	"intake-pause", "posture", "quiet-hours", "review-export", "rule-stats-report", "safe-mode", "seal-backend", "sensitivity-report", "tls-pin-mismatch", "unseal",
+	"watch-flapping", "watch-latency", "watch-sealed", "watch-unreachable", "watchdog",
+}
+
+type completionFlag struct {
+	name    string
+	kind    string   // kindNone for boolean flags
+	choices []string // fixed values, when kind is kindValue
+}
+
+// completionCommand describes a command (or "command subcommand") for the
+// completer. Keep it in step with the usage text in main.
+type completionCommand struct {
+	name    string
+	flags   []completionFlag
+	args    string   // kind of positional arguments
+	choices []string // fixed positional values
+}
+
+var globalCompletionFlags = []completionFlag{
+	{name: "config", kind: kindFile},
+	{name: "config-dir", kind: kindDir},
+	{name: "log-format", kind: kindValue, choices: []string{"text", "json"}},
+	{name: "log-level", kind: kindValue, choices: logLevelNames},
+}
+
+var completionCommands = []completionCommand{
+	{name: "unlock", flags: []completionFlag{{name: "keys", kind: kindValue}, {name: "resume"}, {name: "abort"},
+		{name: "cluster", kind: kindClusters}, {name: "watch"}, {name: "interval", kind: kindValue},
+		{name: "output", kind: kindValue, choices: []string{"text", "json"}}, {name: "accept-new-cluster"}}},
+	{name: "status", flags: []completionFlag{{name: "output", kind: kindValue, choices: []string{"text", "json"}},
+		{name: "json"}, {name: "cluster", kind: kindClusters}}},
+	{name: "seal", flags: []completionFlag{{name: "cluster", kind: kindClusters}, {name: "token", kind: kindValue},
+		{name: "yes"}, {name: "reason", kind: kindValue}}},
+	{name: "audit", flags: []completionFlag{{name: "from", kind: kindValue}, {name: "until", kind: kindValue},
+		{name: "once"}, {name: "rules-file", kind: kindFile}, {name: "print-only"}, {name: "stdin"},
+		{name: "force-active"}}},
+	{name: "config show", flags: []completionFlag{{name: "effective"}}},
+	{name: "config generate", flags: []completionFlag{
+		{name: "spec", kind: kindFile}, {name: "out", kind: kindFile}, {name: "list-packs"}, {name: "schema"}}},
+	{name: "keys sign-init"},
+	{name: "history show", flags: []completionFlag{{name: "request-id", kind: kindValue}, {name: "json"}}},
+	{name: "history verify-signatures"},
+	{name: "maintenance run"},
+	{name: "review export", flags: []completionFlag{{name: "since", kind: kindValue}, {name: "o", kind: kindFile}}},
+	{name: "rules list", flags: []completionFlag{{name: "stats"}, {name: "json"}}},
+	{name: "render-test", flags: []completionFlag{{name: "rule", kind: kindRules},
+		{name: "severity", kind: kindValue, choices: severityNames}}},
+	{name: "promote"},
+	{name: "demote"},
+	{name: "reload", flags: []completionFlag{{name: "force"}}},
+	{name: "healthcheck", flags: []completionFlag{{name: "socket", kind: kindFile}, {name: "max-staleness", kind: kindValue}}},
+	{name: "doctor", flags: []completionFlag{{name: "o", kind: kindFile}}},
+	{name: "self-update", flags: []completionFlag{{name: "check-only"}, {name: "version", kind: kindValue},
+		{name: "allow-downgrade"}, {name: "restart"}}},
+	{name: "alert-schema", flags: []completionFlag{{name: "o", kind: kindFile}}},
+	{name: "check-plugin", flags: []completionFlag{
+		{name: "mode", kind: kindValue, choices: []string{"seal", "audit-lag", "webhook", "keysource"}},
+		{name: "warning", kind: kindValue}, {name: "critical", kind: kindValue}}},
+	{name: "completion", args: kindValue, choices: []string{"bash", "zsh", "fish"}},
+}
+
+func findCompletionFlag(flags []completionFlag, word string) *completionFlag {
+	if !strings.HasPrefix(word, "-") || strings.Contains(word, "=") {
+		return nil
+	}
+	name := strings.TrimLeft(word, "-")
+	for i := range flags {
+		if flags[i].name == name {
+			return &flags[i]
+		}
+	}
+	return nil
+}
+
+// completionNames are the config-dependent values, also served by a running
+// warden on /completez for users who can't read its config.
+type completionNames struct {
+	Clusters     []string `json:"clusters"`
+	Rules        []string `json:"rules"`
+	Destinations []string `json:"destinations"`
+}
+
+func namesFromConfig(cfg *VaultConfig) completionNames {
+	var n completionNames
+	for _, c := range clusterConfigs(cfg) {
+		n.Clusters = append(n.Clusters, clusterLabel(c))
+	}
+	n.Rules = append(n.Rules, builtinRules...)
+	for _, r := range cfg.Rules {
+		n.Rules = append(n.Rules, r.Name)
+	}
+	for _, r := range cfg.Aggregation {
+		n.Rules = append(n.Rules, r.Name)
+	}
+	if cfg.PKI.Enabled {
+		for _, d := range pkiDetectors {
+			n.Rules = append(n.Rules, d.rule)
+		}
+	}
+	if cfg.Tokens.Enabled {
+		for _, d := range tokenDetectors {
+			n.Rules = append(n.Rules, d.rule)
+		}
+	}
+	for _, p := range cfg.Plugins {
+		n.Rules = append(n.Rules, p.Name) // the default rule of its alerts
+	}
+	if cfg.WebhookURL != "" || cfg.Notifier == "email" {
+		n.Destinations = append(n.Destinations, notifierFor(cfg).kind())
+	}
+	if cfg.MQTT.Broker != "" {
+		n.Destinations = append(n.Destinations, "mqtt")
+	}
+	if cfg.Grafana.URL != "" {
+		n.Destinations = append(n.Destinations, "grafana")
+	}
+	if cfg.PagerDuty.RoutingKey != "" {
+		n.Destinations = append(n.Destinations, "pagerduty")
+	}
+	if cfg.Metrics.StatsD.Address != "" {
+		n.Destinations = append(n.Destinations, "statsd")
+	}
+	return n
+}
+
+func (n completionNames) of(kind string) []string {
+	switch kind {
+	case kindClusters:
+		return n.Clusters
+	case kindRules:
+		return n.Rules
+	case kindDestinations:
+		return n.Destinations
+	}
+	return nil
+}
+
+func completezHandler(cfg *VaultConfig) http.HandlerFunc {
+	names := namesFromConfig(cfg)
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(names)
+	}
+}
+
+// completer resolves completions for one command line.
+type completer struct {
+	configPath, configDir string
+}
+
+// lookupNames reads the config without validating it, so a config that
+// wouldn't start still completes, or asks the daemon when the config can't
+// be read. The whole lookup is abandoned after completeTimeout.
+func (c *completer) lookupNames() completionNames {
+	ch := make(chan completionNames, 1)
+	go func() {
+		var n completionNames
+		socket := os.Getenv(adminSocketEnv)
+		if doc, err := loadConfig(c.configPath, c.configDir); err == nil {
+			var cfg VaultConfig
+			if err := doc.root.Decode(&cfg); err == nil {
+				n = namesFromConfig(&cfg)
+				if socket == "" {
+					socket = cfg.Admin.Socket
+				}
+			}
+		}
+		if n.Clusters == nil {
+			if socket == "" {
+				socket = defaultAdminSocket
+			}
+			n = askDaemonNames(socket)
+		}
+		ch <- n
+	}()
+	select {
+	case n := <-ch:
+		return n
+	case <-time.After(completeTimeout):
+		return completionNames{}
+	}
+}
+
+func askDaemonNames(socket string) completionNames {
+	client := &http.Client{
+		Timeout: completeTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	var n completionNames
+	resp, err := client.Get("http://warden/completez")
+	if err != nil {
+		return n
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		json.NewDecoder(resp.Body).Decode(&n)
+	}
+	return n
+}
+
+// complete returns the candidates for the last of words, or a single
+// ":file" or ":dir" to have the shell complete paths.
+func (c *completer) complete(words []string) []string {
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	cur, prev := words[len(words)-1], words[:len(words)-1]
+
+	// Global flags come before the command.
+	i := 0
+	for i < len(prev) && strings.HasPrefix(prev[i], "-") {
+		f := findCompletionFlag(globalCompletionFlags, prev[i])
+		if f != nil && f.kind != kindNone {
+			if i+1 == len(prev) {
+				return c.values(f.kind, f.choices, cur)
+			}
+			i++
+			if f.name == "config" {
+				c.configPath = prev[i]
+			} else {
+				c.configDir = prev[i]
+			}
+		}
+		i++
+	}
+	if i == len(prev) {
+		if strings.HasPrefix(cur, "-") {
+			return flagCandidates(globalCompletionFlags, nil, cur)
+		}
+		var names []string
+		for _, cmd := range completionCommands {
+			name := strings.Fields(cmd.name)[0]
+			if len(names) == 0 || names[len(names)-1] != name {
+				names = append(names, name)
+			}
+		}
+		return withPrefix(names, cur)
+	}
+
+	name := prev[i]
+	i++
+	var subs []string
+	for _, cmd := range completionCommands {
+		if fields := strings.Fields(cmd.name); len(fields) == 2 && fields[0] == name {
+			subs = append(subs, fields[1])
+		}
+	}
+	if len(subs) > 0 {
+		if i == len(prev) {
+			return withPrefix(subs, cur)
+		}
+		name += " " + prev[i]
+		i++
+	}
+	var cmd *completionCommand
+	for j := range completionCommands {
+		if completionCommands[j].name == name {
+			cmd = &completionCommands[j]
+		}
+	}
+	if cmd == nil {
+		return nil
+	}
+
+	rest := prev[i:]
+	if len(rest) > 0 {
+		if f := findCompletionFlag(cmd.flags, rest[len(rest)-1]); f != nil && f.kind != kindNone {
+			return c.values(f.kind, f.choices, cur)
+		}
+	}
+	if strings.HasPrefix(cur, "-") {
+		return flagCandidates(cmd.flags, rest, cur)
+	}
+	if cmd.args == kindNone {
+		return nil
+	}
+	return c.values(cmd.args, cmd.choices, cur)
+}
+
+func (c *completer) values(kind string, choices []string, cur string) []string {
+	switch kind {
+	case kindFile, kindDir:
+		return []string{":" + kind}
+	case kindValue:
+		return withPrefix(choices, cur)
+	}
+	return withPrefix(c.lookupNames().of(kind), cur)
+}
+
+// flagCandidates offers the flags not already on the line.
+func flagCandidates(flags []completionFlag, used []string, cur string) []string {
+	var out []string
+	for i := range flags {
+		seen := false
+		for _, w := range used {
+			if findCompletionFlag(flags[i:i+1], w) != nil {
+				seen = true
+			}
+		}
+		if !seen {
+			out = append(out, "-"+flags[i].name)
+		}
+	}
+	return withPrefix(out, cur)
+}
+
+func withPrefix(list []string, prefix string) []string {
+	var out []string
+	for _, s := range list {
+		if strings.HasPrefix(s, prefix) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// runComplete is the hidden `__complete` command the shell scripts call
+// with the words after the program name, the one being completed last.
+func runComplete(args []string) {
+	c := &completer{configPath: defaultConfigPath}
+	for _, s := range c.complete(args) {
+		fmt.Println(s)
+	}
+}
+
+func runCompletion(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: vault-warden completion bash|zsh|fish")
+	}
+	scripts := map[string]string{"bash": bashCompletion, "zsh": zshCompletion, "fish": fishCompletion}
+	script, ok := scripts[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown shell %q (bash, zsh or fish)", args[0])
+	}
+	_, err := os.Stdout.WriteString(script)
+	return err
+}
+
+const bashCompletion = `# bash completion for vault-warden
+# Load with: source <(vault-warden completion bash)
+_vault_warden() {
+    local cur="${COMP_WORDS[COMP_CWORD]}" out
+    out=$("${COMP_WORDS[0]}" __complete "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null)
+    case "$out" in
+        :file) COMPREPLY=($(compgen -f -- "$cur")) ;;
+        :dir) COMPREPLY=($(compgen -d -- "$cur")) ;;
+        *) COMPREPLY=($(compgen -W "$out" -- "$cur")) ;;
+    esac
+}
+complete -o filenames -F _vault_warden vault-warden
+`
+
+const zshCompletion = `#compdef vault-warden
+# zsh completion for vault-warden
+# Load with: source <(vault-warden completion zsh), or save as _vault-warden
+# in a directory on $fpath.
+_vault-warden() {
+    local out
+    local -a candidates
+    out=$("${words[1]}" __complete "${(@)words[2,CURRENT]}" 2>/dev/null)
+    case "$out" in
+        :file) _files ;;
+        :dir) _files -/ ;;
+        *) candidates=(${(f)out}); compadd -a candidates ;;
+    esac
+}
+if [ "$funcstack[1]" = "_vault-warden" ]; then
+    _vault-warden "$@"
+else
+    compdef _vault-warden vault-warden
+fi
+`
+
+const fishCompletion = `# fish completion for vault-warden
+# Load with: vault-warden completion fish | source
+function __vault_warden_complete
+    set -l tokens (commandline -opc)
+    set -l cur (commandline -ct)
+    set -l out ($tokens[1] __complete $tokens[2..-1] "$cur" 2>/dev/null)
+    switch "$out"
+        case :file
+            __fish_complete_path "$cur"
+        case :dir
+            __fish_complete_directories "$cur"
+        case '*'
+            printf '%s\n' $out
+    end
+end
+complete -c vault-warden -f -a '(__vault_warden_complete)'
+`
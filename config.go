@@ -0,0 +1,1254 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// --- Config Loading ---
+
+// deleteTag marks an inherited item for removal in a later config fragment.
+const deleteTag = "!delete"
+
+// configDoc is a parsed (and possibly merged) config document together with
+// the file that last set each field, keyed by dotted path.
+type configDoc struct {
+	root    *yaml.Node
+	sources map[string]string
+	// path and dir are what it was loaded from, for a reload.
+	path, dir string
+}
+
+// fieldError is a validation failure attributable to one config field.
+type fieldError struct {
+	field string
+	msg   string
+}
+
+func (e *fieldError) Error() string { return e.field + " " + e.msg }
+
+// loadConfig reads the config fragments in dir when set, otherwise the single
+// config file at path.
+func loadConfig(path, dir string) (*configDoc, error) {
+	load := loadConfigFile
+	from := path
+	if dir != "" {
+		load, from = loadConfigDir, dir
+	}
+	doc, err := load(from)
+	if err != nil {
+		return nil, err
+	}
+	doc.path, doc.dir = path, dir
+	return doc, nil
+}
+
+func loadConfigFile(path string) (*configDoc, error) {
+	root, err := parseConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	doc := &configDoc{root: &yaml.Node{Kind: yaml.MappingNode}, sources: map[string]string{}}
+	mergeNode(doc.root, root, path, "", doc.sources)
+	return doc, nil
+}
+
+func loadConfigDir(dir string) (*configDoc, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, fmt.Errorf("list config dir: %w", err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no *.yaml fragments in %s", dir)
+	}
+	sort.Strings(files)
+
+	doc := &configDoc{root: &yaml.Node{Kind: yaml.MappingNode}, sources: map[string]string{}}
+	for _, f := range files {
+		root, err := parseConfigFile(f)
+		if err != nil {
+			return nil, err
+		}
+		mergeNode(doc.root, root, f, "", doc.sources)
+	}
+	return doc, nil
+}
+
+// parseConfigFile returns the top-level mapping of a config file. Each file
+// is also type-checked on its own so decode errors name the right fragment.
+func parseConfigFile(path string) (*yaml.Node, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("open config: %w", err)
+	}
+	if err := checkConfigBytes(data); err != nil {
+		return nil, fmt.Errorf("decode config %s: %w", path, err)
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("decode config %s: %w", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return &yaml.Node{Kind: yaml.MappingNode}, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("decode config %s: top level must be a mapping", path)
+	}
+	if err := checkConfigTree(root); err != nil {
+		return nil, fmt.Errorf("decode config %s: %w", path, err)
+	}
+
+	var check VaultConfig
+	stripped := stripDeletes(root)
+	if err := stripped.Decode(&check); err != nil {
+		return nil, fmt.Errorf("decode config %s: %w", path, explainTypeError(stripped, err))
+	}
+	return root, nil
+}
+
+// config resolves environment references, decodes the document, applies
+// defaults and validates it. Errors name the fragment that set the
+// offending field when known.
+func (d *configDoc) config() (*VaultConfig, error) {
+	root, err := expandEnvRefs(d.root)
+	if err != nil {
+		return nil, d.located(err)
+	}
+	var cfg VaultConfig
+	if err := root.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("decode config: %w", err)
+	}
+	if err := validateConfig(&cfg); err != nil {
+		return nil, d.located(err)
+	}
+	return &cfg, nil
+}
+
+// located adds the fragment that set a fieldError's field.
+func (d *configDoc) located(err error) error {
+	if fe, ok := err.(*fieldError); ok {
+		if src := d.source(fe.field); src != "" {
+			return fmt.Errorf("%w (set in %s)", err, src)
+		}
+	}
+	return err
+}
+
+// source finds the file for a field, walking up to its closest set parent.
+func (d *configDoc) source(field string) string {
+	for field != "" {
+		if src, ok := d.sources[field]; ok {
+			return src
+		}
+		i := strings.LastIndexAny(field, ".[")
+		if i < 0 {
+			break
+		}
+		field = field[:i]
+	}
+	return ""
+}
+
+func validateConfig(cfg *VaultConfig) error {
+	// Checked as configured: the environment's settings only apply to
+	// https addresses.
+	if len(cfg.Vaults) == 0 && cfg.VaultTLS != (VaultTLSConfig{}) && !strings.HasPrefix(cfg.Address, "https://") {
+		return &fieldError{"address", "must be https:// when " + vaultTLSKeys + " is set"}
+	}
+	if err := applyVaultTLSEnv(&cfg.VaultTLS); err != nil {
+		return err
+	}
+	if err := validateVaultTLS("", cfg.VaultTLS); err != nil {
+		return err
+	}
+	if len(cfg.Vaults) > 0 {
+		if err := validateVaults(cfg); err != nil {
+			return err
+		}
+	}
+	if cfg.Address == "" {
+		return &fieldError{"address", "is required"}
+	}
+	if len(cfg.Vaults) == 0 {
+		if err := validateNodes("nodes", cfg.Nodes); err != nil {
+			return err
+		}
+	}
+	if len(cfg.UnsealKeysCommand) > 0 {
+		if len(cfg.UnsealKeys) > 0 {
+			return &fieldError{"unseal_keys_command", "cannot be combined with unseal_keys"}
+		}
+		if !cfg.AllowExecKeySource {
+			return &fieldError{"unseal_keys_command", "requires allow_exec_key_source: true"}
+		}
+		if !filepath.IsAbs(cfg.UnsealKeysCommand[0]) {
+			return &fieldError{"unseal_keys_command", "executable must be an absolute path"}
+		}
+	} else if len(cfg.UnsealKeys) == 0 && cfg.Forward.Address == "" {
+		return &fieldError{"unseal_keys", "is required"}
+	}
+	for i, k := range cfg.UnsealKeys {
+		if strings.HasPrefix(k, keyFileScheme) && !filepath.IsAbs(strings.TrimPrefix(k, keyFileScheme)) {
+			return &fieldError{fmt.Sprintf("unseal_keys[%d]", i), "file reference must be an absolute path, e.g. file:///etc/vault-warden/keys/1"}
+		}
+	}
+	// An edge only forwards; the hub holds the notifier credentials.
+	if cfg.WebhookURL == "" && cfg.Forward.Address == "" && cfg.Notifier != "email" {
+		return &fieldError{"webhook_url", "is required"}
+	}
+	if cfg.Notifier == "" && cfg.WebhookURL != "" {
+		cfg.Notifier = inferNotifier(cfg.WebhookURL)
+	}
+	if _, ok := notifiers[cfg.Notifier]; !ok && cfg.Notifier != "" {
+		return &fieldError{"notifier", "must be " + notifierKinds()}
+	}
+	if cfg.Notifier == "webhook" {
+		if err := validateWebhook(cfg); err != nil {
+			return err
+		}
+	}
+	if cfg.Notifier == "email" {
+		if err := validateEmail(cfg); err != nil {
+			return err
+		}
+	}
+
+	if si := &cfg.SessionIndex; si.Enabled {
+		if si.EntriesPerAccessor == 0 {
+			si.EntriesPerAccessor = 50
+		}
+		if si.MaxAccessors == 0 {
+			si.MaxAccessors = 1000
+		}
+		if si.Attach == 0 {
+			si.Attach = 10
+		}
+		for _, f := range []struct {
+			name string
+			v    int
+		}{
+			{"entries_per_accessor", si.EntriesPerAccessor},
+			{"max_accessors", si.MaxAccessors},
+			{"attach", si.Attach},
+		} {
+			if f.v < 0 {
+				return &fieldError{"session_index." + f.name, "must be positive"}
+			}
+		}
+	}
+
+	for i, r := range cfg.Sampling {
+		field := fmt.Sprintf("sampling[%d]", i)
+		if r.Path == "" {
+			return &fieldError{field + ".path", "is required"}
+		}
+		if !(r.Rate > 0 && r.Rate <= 1) {
+			return &fieldError{field + ".rate", fmt.Sprintf("must be in (0, 1], got %v", r.Rate)}
+		}
+	}
+
+	cfg.Timeouts.setDefaults()
+	for _, f := range []struct {
+		name string
+		d    Duration
+	}{
+		{"health", cfg.Timeouts.Health}, {"unseal", cfg.Timeouts.Unseal}, {"notify", cfg.Timeouts.Notify},
+		{"api", cfg.Timeouts.API}, {"dial", cfg.Timeouts.Dial}, {"tls_handshake", cfg.Timeouts.TLSHandshake},
+	} {
+		if f.d < 0 {
+			return &fieldError{"timeouts." + f.name, "must be positive"}
+		}
+	}
+	if cfg.UnlockStartupWait == 0 {
+		cfg.UnlockStartupWait = Duration(defaultUnlockStartupWait)
+	}
+	if cfg.UnlockStartupWait < 0 {
+		return &fieldError{"unlock_startup_wait", "must be positive"}
+	}
+
+	if fw := &cfg.Forward; fw.Address != "" {
+		if _, _, err := net.SplitHostPort(fw.Address); err != nil {
+			return &fieldError{"forward.address", "must be host:port"}
+		}
+		if fw.Cert == "" || fw.Key == "" {
+			return &fieldError{"forward", "cert and key are required for mutual TLS"}
+		}
+		if cfg.Receive.Listen != "" {
+			return &fieldError{"forward", "cannot be combined with receive"}
+		}
+		if fw.Spool == "" {
+			fw.Spool = defaultForwardSpool
+		}
+		if fw.MaxSpoolMB == 0 {
+			fw.MaxSpoolMB = defaultForwardMaxSpool
+		}
+		if fw.BatchSize == 0 {
+			fw.BatchSize = defaultForwardBatch
+		}
+		if fw.FlushInterval == 0 {
+			fw.FlushInterval = Duration(defaultForwardFlush)
+		}
+		if fw.MaxSpoolMB < 0 || fw.BatchSize < 0 || fw.FlushInterval < 0 {
+			return &fieldError{"forward", "max_spool_mb, batch_size and flush_interval must be positive"}
+		}
+	}
+	if rc := &cfg.Receive; rc.Listen != "" {
+		if _, _, err := net.SplitHostPort(rc.Listen); err != nil {
+			return &fieldError{"receive.listen", "must be host:port"}
+		}
+		if rc.Cert == "" || rc.Key == "" || rc.ClientCA == "" {
+			return &fieldError{"receive", "cert, key and client_ca are required for mutual TLS"}
+		}
+	}
+
+	if w := &cfg.Watch; w.Enabled {
+		if w.Interval == 0 {
+			w.Interval = Duration(defaultWatchInterval)
+		}
+		if w.Timeout == 0 {
+			w.Timeout = cfg.Timeouts.Health
+			if w.Timeout > w.Interval {
+				w.Timeout = w.Interval
+			}
+		}
+		if w.MaxConcurrentProbes == 0 {
+			w.MaxConcurrentProbes = defaultWatchConcurrency
+		}
+		if w.Confirm == 0 {
+			w.Confirm = defaultWatchConfirm
+		}
+		if w.MaxBackoff == 0 {
+			w.MaxBackoff = Duration(defaultWatchMaxBackoff)
+		}
+		if w.SealGrace == nil {
+			grace := Duration(defaultSealGrace)
+			w.SealGrace = &grace
+		}
+		if w.TopologyBudget == 0 {
+			w.TopologyBudget = Duration(defaultTopologyBudget)
+		}
+		switch {
+		case w.Interval < Duration(time.Second):
+			return &fieldError{"watch.interval", "must be at least 1s"}
+		case w.Timeout <= 0 || w.Timeout > w.Interval:
+			return &fieldError{"watch.timeout", "must be positive and no longer than watch.interval"}
+		case w.MaxConcurrentProbes < 0:
+			return &fieldError{"watch.max_concurrent_probes", "must be positive"}
+		case w.Confirm < 1:
+			return &fieldError{"watch.confirm", "must be at least 1"}
+		case w.MaxBackoff < w.Interval:
+			return &fieldError{"watch.max_backoff", "must be at least watch.interval"}
+		case *w.SealGrace < 0:
+			return &fieldError{"watch.seal_grace", "must not be negative"}
+		case w.TopologyBudget < 0:
+			return &fieldError{"watch.topology_budget", "must be positive"}
+		}
+
+		l := &w.Latency
+		if l.Window == 0 {
+			l.Window = Duration(defaultLatencyWindow)
+		}
+		if l.Baseline == 0 {
+			l.Baseline = Duration(defaultLatencyBaseline)
+		}
+		if l.GrowthFloor == 0 {
+			l.GrowthFloor = Duration(defaultLatencyGrowthFloor)
+		}
+		if l.MinSamples == 0 {
+			l.MinSamples = defaultLatencyMinSamples
+		}
+		switch {
+		case l.Window < w.Interval:
+			return &fieldError{"watch.latency.window", "must be at least watch.interval"}
+		case l.Baseline < l.Window:
+			return &fieldError{"watch.latency.baseline", "must be at least watch.latency.window"}
+		case l.P95Threshold < 0:
+			return &fieldError{"watch.latency.p95_threshold", "must not be negative"}
+		case l.GrowthFactor != 0 && l.GrowthFactor <= 1:
+			return &fieldError{"watch.latency.growth_factor", "must be greater than 1"}
+		case l.GrowthFloor < 0:
+			return &fieldError{"watch.latency.growth_floor", "must not be negative"}
+		case l.MinSamples < 1:
+			return &fieldError{"watch.latency.min_samples", "must be at least 1"}
+		}
+	}
+
+	if p := &cfg.PKI; p.Enabled {
+		if len(p.Mounts) == 0 {
+			p.Mounts = []string{"pki/"}
+		}
+		if p.MaxTTL == 0 {
+			p.MaxTTL = Duration(defaultPKIMaxTTL)
+		}
+		if p.MaxTTL < 0 {
+			return &fieldError{"pki.max_ttl", "must be positive"}
+		}
+		for i, m := range p.Mounts {
+			if strings.Trim(m, "/") == "" {
+				return &fieldError{fmt.Sprintf("pki.mounts[%d]", i), "must not be empty"}
+			}
+		}
+		if err := validateDetectors("pki.detectors", "a PKI", pkiDetectors, p.Detectors); err != nil {
+			return err
+		}
+	}
+
+	ml := &cfg.MissingLog
+	if ml.WarnAfter == 0 {
+		ml.WarnAfter = Duration(defaultMissingWarnAfter)
+	}
+	if ml.AlertAfter == 0 {
+		ml.AlertAfter = Duration(defaultMissingAlertAfter)
+	}
+	switch {
+	case ml.WarnAfter < 0:
+		return &fieldError{"missing_log.warn_after", "must be positive"}
+	case ml.AlertAfter < ml.WarnAfter:
+		return &fieldError{"missing_log.alert_after", "must not be shorter than warn_after"}
+	}
+
+	if t := &cfg.Tokens; t.Enabled {
+		if t.MaxTTL == 0 {
+			t.MaxTTL = Duration(defaultTokenMaxTTL)
+		}
+		if t.MaxTTL < 0 {
+			return &fieldError{"tokens.max_ttl", "must be positive"}
+		}
+		for i, c := range t.AllowedCreators {
+			if c == "" {
+				return &fieldError{fmt.Sprintf("tokens.allowed_creators[%d]", i), "must not be empty"}
+			}
+		}
+		if err := validateDetectors("tokens.detectors", "a token", tokenDetectors, t.Detectors); err != nil {
+			return err
+		}
+	}
+
+	if pc := &cfg.Posture; len(pc.Checks) > 0 {
+		if !cfg.Watch.Enabled {
+			return &fieldError{"posture.checks", "run with the seal watch; set watch.enabled"}
+		}
+		if pc.Interval == 0 {
+			pc.Interval = Duration(defaultPostureInterval)
+		}
+		if pc.Interval < Duration(10*time.Second) {
+			return &fieldError{"posture.interval", "must be at least 10s"}
+		}
+		seen := make(map[string]bool)
+		for i := range pc.Checks {
+			c := &pc.Checks[i]
+			field := fmt.Sprintf("posture.checks[%d]", i)
+			if c.Name == "" {
+				return &fieldError{field + ".name", "is required"}
+			}
+			if seen[c.Name] {
+				return &fieldError{field + ".name", fmt.Sprintf("duplicate check name %q", c.Name)}
+			}
+			seen[c.Name] = true
+			if _, ok := postureTypes[c.Type]; !ok {
+				return &fieldError{field + ".type", fmt.Sprintf("must be one of %s", strings.Join(postureTypeNames(), ", "))}
+			}
+			if c.Severity == "" {
+				c.Severity = "warning"
+			}
+			if _, err := parseSeverity(c.Severity); err != nil {
+				return &fieldError{field + ".severity", err.Error()}
+			}
+			if err := validatePostureCheck(field, *c); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(cfg.Plugins) > 0 && !cfg.AllowExecPlugins {
+		return &fieldError{"plugins", "requires allow_exec_plugins: true"}
+	}
+	seenPlugins := make(map[string]bool)
+	for i := range cfg.Plugins {
+		pc := &cfg.Plugins[i]
+		field := fmt.Sprintf("plugins[%d]", i)
+		if pc.Name == "" {
+			return &fieldError{field + ".name", "is required"}
+		}
+		if !clusterLabelPattern.MatchString(pc.Name) {
+			return &fieldError{field + ".name", fmt.Sprintf("%q must be letters, digits, '.', '_' or '-'", pc.Name)}
+		}
+		if seenPlugins[pc.Name] {
+			return &fieldError{field + ".name", fmt.Sprintf("duplicate plugin name %q", pc.Name)}
+		}
+		seenPlugins[pc.Name] = true
+		if len(pc.Command) == 0 {
+			return &fieldError{field + ".command", "is required"}
+		}
+		if !filepath.IsAbs(pc.Command[0]) {
+			return &fieldError{field + ".command", "executable must be an absolute path"}
+		}
+		if pc.Timeout == 0 {
+			pc.Timeout = Duration(defaultPluginTimeout)
+		}
+		if pc.HealthInterval == 0 {
+			pc.HealthInterval = Duration(defaultPluginHealthInterval)
+		}
+		if pc.Timeout < 0 || pc.HealthInterval < 0 {
+			return &fieldError{field, "timeout and health_interval must be positive"}
+		}
+		if pc.Buffer == 0 {
+			pc.Buffer = defaultPluginBuffer
+		}
+		if pc.Buffer < 1 {
+			return &fieldError{field + ".buffer", "must be at least 1"}
+		}
+	}
+
+	seenRules := make(map[string]bool)
+	for i := range cfg.Aggregation {
+		r := &cfg.Aggregation[i]
+		field := fmt.Sprintf("aggregation[%d]", i)
+		if r.Name == "" {
+			return &fieldError{field + ".name", "is required"}
+		}
+		if seenRules[r.Name] {
+			return &fieldError{field + ".name", fmt.Sprintf("duplicate rule name %q", r.Name)}
+		}
+		seenRules[r.Name] = true
+		if _, err := parseGroupBy(r.GroupBy); err != nil {
+			return &fieldError{field + ".group_by", err.Error()}
+		}
+		if r.Window == 0 {
+			r.Window = Duration(defaultAggregationWindow)
+		}
+		if r.Threshold == 0 {
+			r.Threshold = defaultAggregationThreshold
+		}
+		if r.MaxGroups == 0 {
+			r.MaxGroups = defaultAggregationGroups
+		}
+		if r.MaxMembers == 0 {
+			r.MaxMembers = defaultAggregationMembers
+		}
+		if r.Severity == "" {
+			r.Severity = "critical"
+		}
+		if r.Window < 0 {
+			return &fieldError{field + ".window", "must be positive"}
+		}
+		if r.Threshold < 2 {
+			return &fieldError{field + ".threshold", "must be at least 2"}
+		}
+		if r.MaxGroups < 0 || r.MaxMembers < r.Threshold {
+			return &fieldError{field, "max_groups must be positive and max_members at least threshold"}
+		}
+		if _, err := parseSeverity(r.Severity); err != nil {
+			return &fieldError{field + ".severity", err.Error()}
+		}
+		for j, name := range r.Sensitivity {
+			name = strings.ToLower(name)
+			if _, err := parseSensitivity(name); err != nil && name != "unclassified" {
+				return &fieldError{fmt.Sprintf("%s.sensitivity[%d]", field, j), err.Error()}
+			}
+			r.Sensitivity[j] = name
+		}
+	}
+
+	if wd := &cfg.Watchdog; !wd.Disabled {
+		if wd.Heartbeat == 0 {
+			wd.Heartbeat = Duration(defaultWatchdogHeartbeat)
+		}
+		if wd.Missed == 0 {
+			wd.Missed = defaultWatchdogMissed
+		}
+		if wd.MaxHeals == 0 {
+			wd.MaxHeals = defaultWatchdogMaxHeals
+		}
+		if wd.Heartbeat < Duration(time.Second) {
+			return &fieldError{"watchdog.heartbeat", "must be at least 1s"}
+		}
+		if wd.Missed < 1 || wd.MaxHeals < 1 {
+			return &fieldError{"watchdog", "missed and max_heals must be at least 1"}
+		}
+	}
+
+	if sc := &cfg.Sensitivity; sc.enabled() {
+		if sc.Report == "" {
+			sc.Report = defaultSensitivityReport
+		}
+		if sc.UnclassifiedMin == 0 {
+			sc.UnclassifiedMin = defaultSensitivityUnclassifiedMin
+		}
+		if _, err := compileSensitivity(sc.Paths); err != nil {
+			return &fieldError{"sensitivity.paths", err.Error()}
+		}
+		if sc.File != "" {
+			paths, err := readSensitivityFile(sc.File)
+			if err == nil {
+				_, err = compileSensitivity(paths)
+			}
+			if err != nil {
+				return &fieldError{"sensitivity.file", err.Error()}
+			}
+		}
+		for name, sev := range sc.Severity {
+			field := "sensitivity.severity." + name
+			if _, err := parseSensitivity(name); err != nil {
+				return &fieldError{field, err.Error()}
+			}
+			if sev.Floor != "" {
+				if _, err := parseSeverity(sev.Floor); err != nil {
+					return &fieldError{field + ".floor", err.Error()}
+				}
+			}
+			if sev.Boost < 0 || sev.Boost > int(sevCritical) {
+				return &fieldError{field + ".boost", "must be between 0 and 2"}
+			}
+		}
+		if _, err := parseCron(sc.Report); err != nil {
+			return &fieldError{"sensitivity.report", err.Error()}
+		}
+		if sc.UnclassifiedMin < 0 {
+			return &fieldError{"sensitivity.unclassified_min", "must be positive"}
+		}
+	}
+
+	if cfg.ExternalUnseal.AttributionWindow == 0 {
+		cfg.ExternalUnseal.AttributionWindow = Duration(2 * time.Minute)
+	}
+	if _, err := parseCIDRs(cfg.ExternalUnseal.KnownSources); err != nil {
+		return &fieldError{"external_unseal.known_sources", err.Error()}
+	}
+
+	if ig := &cfg.Integrity; ig.Enabled {
+		if ig.PairTimeout == 0 {
+			ig.PairTimeout = Duration(2 * time.Minute)
+		}
+		if ig.Threshold == 0 {
+			ig.Threshold = 5
+		}
+		if ig.Window == 0 {
+			ig.Window = Duration(10 * time.Minute)
+		}
+		if ig.ClockSkew == 0 {
+			ig.ClockSkew = Duration(time.Minute)
+		}
+		if ig.PairTimeout < 0 || ig.Window < 0 || ig.ClockSkew < 0 {
+			return &fieldError{"integrity", "durations must be positive"}
+		}
+		if ig.Threshold < 0 {
+			return &fieldError{"integrity.threshold", "must be positive"}
+		}
+	}
+
+	if fa := &cfg.FirstAccess; fa.Enabled {
+		if fa.LearningPeriod == 0 {
+			fa.LearningPeriod = Duration(defaultLearningPeriod)
+		}
+		if fa.MaxPrefixes == 0 {
+			fa.MaxPrefixes = defaultMaxPrefixes
+		}
+		if fa.MaxIdentities == 0 {
+			fa.MaxIdentities = defaultMaxIdentities
+		}
+		if fa.Severity == "" {
+			fa.Severity = "info"
+		}
+		if fa.LearningPeriod < 0 {
+			return &fieldError{"first_access.learning_period", "must be positive"}
+		}
+		if fa.MaxPrefixes < 0 || fa.MaxIdentities < 0 {
+			return &fieldError{"first_access", "max_prefixes and max_identities must be positive"}
+		}
+		if _, err := parseSeverity(fa.Severity); err != nil {
+			return &fieldError{"first_access.severity", err.Error()}
+		}
+		for prefix, sev := range fa.Escalate {
+			if _, err := parseSeverity(sev); err != nil {
+				return &fieldError{"first_access.escalate." + prefix, err.Error()}
+			}
+		}
+	}
+
+	if re := &cfg.ReviewExport; re.Enabled {
+		if !cfg.Sensitivity.enabled() {
+			return &fieldError{"review_export", "requires sensitivity paths or a sensitivity file"}
+		}
+		if re.MinSensitivity == "" {
+			re.MinSensitivity = "high"
+		}
+		if re.Table == "" {
+			re.Table = defaultReviewTable(cfg.StateFile)
+		}
+		if re.Retention == 0 {
+			re.Retention = Duration(defaultReviewRetention)
+		}
+		if re.MaxRows == 0 {
+			re.MaxRows = defaultReviewMaxRows
+		}
+		if re.Since == 0 {
+			re.Since = Duration(defaultReviewSince)
+		}
+		if _, err := parseSensitivity(re.MinSensitivity); err != nil {
+			return &fieldError{"review_export.min_sensitivity", err.Error()}
+		}
+		switch {
+		case re.Retention < 0 || re.Since < 0:
+			return &fieldError{"review_export", "retention and since must be positive"}
+		case re.Since > re.Retention:
+			return &fieldError{"review_export.since", "must not be longer than retention"}
+		case re.MaxRows < 0:
+			return &fieldError{"review_export.max_rows", "must be positive"}
+		}
+		if re.Schedule != "" {
+			if _, err := parseCron(re.Schedule); err != nil {
+				return &fieldError{"review_export.schedule", err.Error()}
+			}
+			if re.Output == "" {
+				return &fieldError{"review_export.output", "is required with a schedule"}
+			}
+		}
+	}
+
+	if id := &cfg.Identity; id.Enabled {
+		if id.Refresh == 0 {
+			id.Refresh = Duration(defaultIdentityRefresh)
+		}
+		if id.MaxEntities == 0 {
+			id.MaxEntities = defaultIdentityMaxEntities
+		}
+		if id.Token == "" {
+			return &fieldError{"identity.token", "is required"}
+		}
+		if id.Refresh < Duration(time.Minute) {
+			return &fieldError{"identity.refresh", "must be at least 1m"}
+		}
+		if id.MaxEntities < 0 {
+			return &fieldError{"identity.max_entities", "must be positive"}
+		}
+	}
+
+	for name, env := range cfg.Environments {
+		if env.MaxSeverity == "" {
+			continue
+		}
+		if _, err := parseSeverity(env.MaxSeverity); err != nil {
+			return &fieldError{"environments." + name + ".max_severity", err.Error()}
+		}
+	}
+
+	if m := &cfg.MQTT; m.Broker != "" {
+		if m.Topic == "" {
+			m.Topic = "vault/{{.Cluster}}/{{.Severity}}"
+		}
+		for _, t := range []struct{ field, tmpl string }{
+			{"topic", m.Topic}, {"state_topic", m.StateTopic}, {"status_topic", m.StatusTopic},
+		} {
+			if _, err := template.New(t.field).Parse(t.tmpl); err != nil {
+				return &fieldError{"mqtt." + t.field, err.Error()}
+			}
+		}
+		if m.QoS < 0 || m.QoS > 1 {
+			return &fieldError{"mqtt.qos", "must be 0 or 1"}
+		}
+		if u, err := url.Parse(m.Broker); err != nil || u.Host == "" {
+			return &fieldError{"mqtt.broker", "must be a URL like tcp://host:1883"}
+		}
+	}
+
+	if g := &cfg.Grafana; g.URL != "" {
+		if u, err := url.Parse(g.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return &fieldError{"grafana.url", "must be a URL like https://grafana.example.com"}
+		}
+		if g.APIToken == "" {
+			return &fieldError{"grafana.api_token", "is required when grafana.url is set"}
+		}
+	}
+
+	if pd := &cfg.PagerDuty; pd.RoutingKey != "" {
+		if pd.MinSeverity == "" {
+			pd.MinSeverity = "critical"
+		}
+		if _, err := parseSeverity(pd.MinSeverity); err != nil {
+			return &fieldError{"pagerduty.min_severity", err.Error()}
+		}
+		if pd.URL == "" {
+			pd.URL = defaultPagerDutyURL
+		}
+		if u, err := url.Parse(pd.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return &fieldError{"pagerduty.url", "must be a URL like " + defaultPagerDutyURL}
+		}
+	}
+
+	if cfg.Metrics.MaxSeries == 0 {
+		cfg.Metrics.MaxSeries = defaultMaxSeries
+	}
+	if cfg.Metrics.MaxSeries < 0 {
+		return &fieldError{"metrics.max_series", "must be positive"}
+	}
+	if cfg.MetricsListen != "" {
+		if _, _, err := net.SplitHostPort(cfg.MetricsListen); err != nil {
+			return &fieldError{"metrics_listen", "must be host:port or :port, e.g. :9410"}
+		}
+	}
+	if sd := &cfg.Metrics.StatsD; sd.Address != "" {
+		if _, _, err := net.SplitHostPort(sd.Address); err != nil {
+			return &fieldError{"metrics.statsd.address", "must be host:port, e.g. 127.0.0.1:8125"}
+		}
+		if sd.Prefix == "" {
+			sd.Prefix = defaultStatsDPrefix
+		}
+		if sd.FlushInterval == 0 {
+			sd.FlushInterval = Duration(defaultStatsDFlush)
+		}
+		if sd.FlushInterval < 0 {
+			return &fieldError{"metrics.statsd.flush_interval", "must be positive"}
+		}
+	}
+
+	if err := validateAdmin(cfg); err != nil {
+		return err
+	}
+	if err := validateLogging(cfg); err != nil {
+		return err
+	}
+	if err := validateCanary(cfg); err != nil {
+		return err
+	}
+	if err := validateMemory(cfg); err != nil {
+		return err
+	}
+	if err := validateLocalization(cfg); err != nil {
+		return err
+	}
+	if err := validateApproval(cfg); err != nil {
+		return err
+	}
+	if err := validateDetails(cfg); err != nil {
+		return err
+	}
+	if err := validateSelfUpdate(cfg); err != nil {
+		return err
+	}
+	if err := validatePosition(cfg); err != nil {
+		return err
+	}
+	if err := validateRuleStats(cfg); err != nil {
+		return err
+	}
+	if err := validateReloadCanary(cfg); err != nil {
+		return err
+	}
+	if err := validateExpectedHosts(cfg); err != nil {
+		return err
+	}
+	if err := validateAuditLogs(cfg); err != nil {
+		return err
+	}
+	if err := validateAuditSource(cfg); err != nil {
+		return err
+	}
+
+	if cfg.Intake.PauseAfter == 0 {
+		cfg.Intake.PauseAfter = Duration(defaultPauseAfter)
+	}
+	if cfg.Intake.PauseAfter < 0 {
+		return &fieldError{"intake.pause_after", "must be positive"}
+	}
+
+	if cfg.Queue.Size == 0 {
+		cfg.Queue.Size = defaultQueueSize
+	}
+	if cfg.Queue.Size < 0 {
+		return &fieldError{"queue.size", "must be positive"}
+	}
+	if cfg.Queue.DrainTimeout == 0 {
+		cfg.Queue.DrainTimeout = Duration(defaultDrainTimeout)
+	}
+	if cfg.Queue.DrainTimeout < 0 {
+		return &fieldError{"queue.drain_timeout", "must be positive"}
+	}
+	if cfg.Queue.PromoteAfter == 0 {
+		cfg.Queue.PromoteAfter = Duration(defaultPromoteAfter)
+	}
+	if cfg.Queue.PromoteAfter < 0 {
+		return &fieldError{"queue.promote_after", "must be positive"}
+	}
+	rc := &cfg.Queue.Retry
+	if rc.MaxAttempts == 0 {
+		rc.MaxAttempts = defaultRetryAttempts
+	}
+	if rc.MaxElapsed == 0 {
+		rc.MaxElapsed = Duration(defaultRetryElapsed)
+	}
+	if rc.Backoff == 0 {
+		rc.Backoff = Duration(defaultRetryBackoff)
+	}
+	switch {
+	case rc.MaxAttempts < 0:
+		return &fieldError{"queue.retry.max_attempts", "must be positive; 1 turns retries off"}
+	case rc.MaxElapsed < 0:
+		return &fieldError{"queue.retry.max_elapsed", "must be positive"}
+	case rc.Backoff < Duration(100*time.Millisecond) || rc.Backoff > Duration(maxRetryBackoff):
+		return &fieldError{"queue.retry.backoff", "must be between 100ms and 5m"}
+	}
+
+	if c := &cfg.Queue.Coalesce; c.Window == 0 {
+		c.Window = Duration(defaultCoalesceWindow)
+	} else if c.Window < 0 || c.Window > Duration(time.Minute) {
+		return &fieldError{"queue.coalesce.window", "must be positive and at most 1m"}
+	}
+	if ob := &cfg.Queue.Outbox; ob.Path != "" {
+		if ob.Freshness == 0 {
+			ob.Freshness = Duration(defaultOutboxFreshness)
+		}
+		if ob.MaxAge == 0 {
+			ob.MaxAge = Duration(defaultOutboxMaxAge)
+		}
+		if ob.Freshness < 0 {
+			return &fieldError{"queue.outbox.freshness", "must be positive"}
+		}
+		if ob.MaxAge < ob.Freshness {
+			return &fieldError{"queue.outbox.max_age", "must be at least queue.outbox.freshness"}
+		}
+	}
+
+	if cfg.Maintenance.Interval == 0 {
+		cfg.Maintenance.Interval = Duration(defaultMaintenanceInterval)
+	}
+	if cfg.Maintenance.HistoryRetention == 0 {
+		cfg.Maintenance.HistoryRetention = Duration(defaultHistoryRetention)
+	}
+	if cfg.Maintenance.Interval < 0 {
+		return &fieldError{"maintenance.interval", "must be positive"}
+	}
+	if cfg.Maintenance.HistoryRetention < 0 {
+		return &fieldError{"maintenance.history_retention", "must be positive"}
+	}
+	if cfg.Maintenance.Schedule != "" {
+		if _, err := parseCron(cfg.Maintenance.Schedule); err != nil {
+			return &fieldError{"maintenance.schedule", err.Error()}
+		}
+	}
+	if err := validateContentPolicies(cfg); err != nil {
+		return err
+	}
+	if err := validateQuietHours(cfg); err != nil {
+		return err
+	}
+	if err := validateEnrichment(cfg); err != nil {
+		return err
+	}
+	if err := validateRules(cfg); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// validateDetectors checks the overrides of a detector list; what names
+// the list in errors, e.g. "a PKI".
+func validateDetectors(field, what string, list []detector, overrides map[string]DetectorConfig) error {
+	for rule, o := range overrides {
+		f := field + "." + rule
+		if findDetector(list, rule) == nil {
+			return &fieldError{f, "is not " + what + " detector"}
+		}
+		if o.Severity != "" {
+			if _, err := parseSeverity(o.Severity); err != nil {
+				return &fieldError{f + ".severity", err.Error()}
+			}
+		}
+	}
+	return nil
+}
+
+// Duration is a time.Duration that also accepts a "d" (days) suffix in
+// YAML, e.g. "90d" or "1d12h".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(n *yaml.Node) error {
+	v, err := parseDuration(n.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", n.Line, err)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	var days time.Duration
+	if i := strings.Index(s, "d"); i > 0 {
+		var n int
+		if _, err := fmt.Sscanf(s[:i], "%d", &n); err != nil || fmt.Sprint(n) != s[:i] {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		days, s = time.Duration(n)*24*time.Hour, s[i+1:]
+		if s == "" {
+			return days, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return days + d, nil
+}
+
+// --- Config Merging ---
+
+// mergeNode merges src into dst (both mappings). Scalars and plain lists are
+// last-writer-wins; nested mappings merge recursively; lists of items with a
+// "name" key merge by name. A value tagged !delete removes the inherited key
+// or named item.
+func mergeNode(dst, src *yaml.Node, file, path string, sources map[string]string) {
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		key, val := src.Content[i], src.Content[i+1]
+		field := joinField(path, key.Value)
+		idx := mappingIndex(dst, key.Value)
+
+		if val.Tag == deleteTag {
+			if idx >= 0 {
+				dst.Content = append(dst.Content[:idx], dst.Content[idx+2:]...)
+			}
+			forgetSources(sources, field)
+			continue
+		}
+
+		if idx >= 0 {
+			cur := dst.Content[idx+1]
+			switch {
+			case cur.Kind == yaml.MappingNode && val.Kind == yaml.MappingNode:
+				mergeNode(cur, val, file, field, sources)
+				continue
+			case isNamedList(cur) && isNamedList(val):
+				mergeNamedList(cur, val, file, field, sources)
+				continue
+			}
+			forgetSources(sources, field)
+			dst.Content[idx+1] = stripDeletes(val)
+		} else {
+			dst.Content = append(dst.Content, key, stripDeletes(val))
+		}
+		recordSources(sources, val, file, field)
+	}
+}
+
+func mergeNamedList(dst, src *yaml.Node, file, path string, sources map[string]string) {
+	for _, item := range src.Content {
+		name := itemName(item)
+		field := fmt.Sprintf("%s[%s]", path, name)
+		idx := -1
+		for j, cur := range dst.Content {
+			if itemName(cur) == name {
+				idx = j
+				break
+			}
+		}
+
+		switch {
+		case item.Tag == deleteTag:
+			if idx >= 0 {
+				dst.Content = append(dst.Content[:idx], dst.Content[idx+1:]...)
+			}
+			forgetSources(sources, field)
+		case idx >= 0:
+			mergeNode(dst.Content[idx], item, file, field, sources)
+		default:
+			dst.Content = append(dst.Content, stripDeletes(item))
+			recordSources(sources, item, file, field)
+		}
+	}
+}
+
+func recordSources(sources map[string]string, n *yaml.Node, file, field string) {
+	sources[field] = file
+	switch n.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			recordSources(sources, n.Content[i+1], file, joinField(field, n.Content[i].Value))
+		}
+	case yaml.SequenceNode:
+		if isNamedList(n) {
+			for _, item := range n.Content {
+				recordSources(sources, item, file, fmt.Sprintf("%s[%s]", field, itemName(item)))
+			}
+		}
+	}
+}
+
+func forgetSources(sources map[string]string, field string) {
+	for k := range sources {
+		if k == field || strings.HasPrefix(k, field+".") || strings.HasPrefix(k, field+"[") {
+			delete(sources, k)
+		}
+	}
+}
+
+// stripDeletes returns a copy of n without any !delete items, so a fragment
+// can be decoded on its own.
+func stripDeletes(n *yaml.Node) *yaml.Node {
+	c := *n
+	c.Content = nil
+	for i := 0; i < len(n.Content); i++ {
+		child := n.Content[i]
+		if n.Kind == yaml.MappingNode && i+1 < len(n.Content) {
+			if n.Content[i+1].Tag == deleteTag {
+				i++
+				continue
+			}
+			c.Content = append(c.Content, child, stripDeletes(n.Content[i+1]))
+			i++
+			continue
+		}
+		if child.Tag == deleteTag {
+			continue
+		}
+		c.Content = append(c.Content, stripDeletes(child))
+	}
+	return &c
+}
+
+func mappingIndex(m *yaml.Node, key string) int {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// isNamedList reports whether n is a non-empty list whose items all carry a
+// scalar "name" key.
+func isNamedList(n *yaml.Node) bool {
+	if n.Kind != yaml.SequenceNode || len(n.Content) == 0 {
+		return false
+	}
+	for _, item := range n.Content {
+		if itemName(item) == "" {
+			return false
+		}
+	}
+	return true
+}
+
+func itemName(n *yaml.Node) string {
+	if n.Kind != yaml.MappingNode {
+		return ""
+	}
+	if i := mappingIndex(n, "name"); i >= 0 && n.Content[i+1].Kind == yaml.ScalarNode {
+		return n.Content[i+1].Value
+	}
+	return ""
+}
+
+func joinField(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// --- Command: Config ---
+
+// secretFields are redacted wherever they appear in printed config.
+var secretFields = []string{"key", "token", "password", "secret", "webhook"}
+
+func runConfig(doc *configDoc, args []string) error {
+	if len(args) < 1 || args[0] != "show" {
+		return fmt.Errorf("usage: vault-warden config show [-effective] | generate -spec spec.json")
+	}
+	fs := flagSet("config show")
+	effective := fs.Bool("effective", false, "Print the validated config with defaults applied")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	out, err := renderConfig(doc, *effective)
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(out))
+	return nil
+}
+
+// renderConfig returns the merged config, or the validated one with
+// defaults when effective is set, as YAML with secrets redacted.
+func renderConfig(doc *configDoc, effective bool) ([]byte, error) {
+	out := doc.root
+	if effective {
+		cfg, err := doc.config()
+		if err != nil {
+			return nil, err
+		}
+		var n yaml.Node
+		if err := n.Encode(cfg); err != nil {
+			return nil, fmt.Errorf("encode config: %w", err)
+		}
+		out = &n
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(redactNode(out, false)); err != nil {
+		return nil, fmt.Errorf("encode config: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// redactNode returns a copy of n with the values of secret-looking keys
+// replaced. Environment references are kept: they name the secret rather
+// than hold it.
+func redactNode(n *yaml.Node, secret bool) *yaml.Node {
+	c := *n
+	c.Content = nil
+	if secret && n.Kind == yaml.ScalarNode && n.Tag != envTag && !strings.HasPrefix(n.Value, envScheme) {
+		c.Value = redactValue(n.Value)
+		c.Tag = "!!str"
+		c.Style = 0
+		return &c
+	}
+	for i := 0; i < len(n.Content); i++ {
+		if n.Kind == yaml.MappingNode && i+1 < len(n.Content) {
+			key := n.Content[i]
+			c.Content = append(c.Content, key, redactNode(n.Content[i+1], secret || isSecretField(key.Value)))
+			i++
+			continue
+		}
+		c.Content = append(c.Content, redactNode(n.Content[i], secret))
+	}
+	return &c
+}
+
+// redactValue hides a secret. URLs keep their scheme and host, which help
+// with debugging, and lose credentials, path and query, which is where
+// webhook tokens live.
+func redactValue(v string) string {
+	if u, err := url.Parse(v); err == nil && u.Scheme != "" && u.Host != "" {
+		return u.Scheme + "://" + u.Host + "/<redacted>"
+	}
+	return "<redacted>"
+}
+
+func isSecretField(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range secretFields {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
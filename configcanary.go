@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"vault-warden/client"
+)
+
+// --- Config Canary ---
+
+const (
+	defaultCanaryWindow    = 15 * time.Minute
+	defaultCanaryBuffer    = 10000
+	defaultCanaryMaxRatio  = 2
+	defaultCanaryMinAlerts = 5
+	// canaryListMax bounds the rules and critical alerts the held-back
+	// notification lists.
+	canaryListMax = 10
+)
+
+// ReloadCanaryConfig checks reloaded rules against recent traffic before
+// they go live: the entries read in the last Window are run through the
+// running and the new rules, and the new ones are held back when they
+// raise more than MaxRatio times the alerts, or critical alerts the
+// running ones don't. `reload -force` applies them anyway.
+type ReloadCanaryConfig struct {
+	Disabled bool     `yaml:"disabled"`
+	Window   Duration `yaml:"window"`
+	Buffer   int      `yaml:"buffer"` // entries kept for it, the newest
+	MaxRatio float64  `yaml:"max_ratio"`
+	// MinAlerts is how many alerts the new rules must raise before the
+	// ratio counts, so one alert where there were none isn't held.
+	MinAlerts int `yaml:"min_alerts"`
+}
+
+// recentEntry is an entry as the rules saw it, enriched.
+type recentEntry struct {
+	at   time.Time
+	en   *enrichedEntry
+	size int // of the line, for the memory guard
+}
+
+// recentEntries is the ring of the entries read last, for the canary.
+// Intake records into it while a reload reads it.
+type recentEntries struct {
+	capacity int
+
+	mu   sync.Mutex
+	buf  []recentEntry
+	next int // where the next entry goes once buf is full
+}
+
+func newRecentEntries(cfg *VaultConfig) *recentEntries {
+	if cfg.ReloadCanary.Disabled {
+		return nil
+	}
+	return &recentEntries{capacity: cfg.ReloadCanary.Buffer}
+}
+
+func (r *recentEntries) record(en *enrichedEntry, size int, now time.Time) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e := recentEntry{at: now, en: en, size: size}
+	if limit := shedCap(r.capacity); len(r.buf) < limit {
+		// Grown back after a shed: the oldest go first again.
+		r.buf, r.next = append(r.ordered(), e), 0
+		return
+	}
+	if r.next >= len(r.buf) {
+		r.next = 0
+	}
+	r.buf[r.next] = e
+	r.next++
+}
+
+// since returns the entries read at or after t, oldest first.
+func (r *recentEntries) since(t time.Time) []recentEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var out []recentEntry
+	for _, e := range r.ordered() {
+		if !e.at.Before(t) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// ordered is buf oldest first; r.mu is held.
+func (r *recentEntries) ordered() []recentEntry {
+	if r.next == 0 {
+		return r.buf
+	}
+	out := make([]recentEntry, 0, len(r.buf))
+	return append(append(out, r.buf[r.next:]...), r.buf[:r.next]...)
+}
+
+func (r *recentEntries) usage() cacheUsage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u := cacheUsage{Entries: len(r.buf)}
+	for _, e := range r.buf {
+		u.Bytes += cacheEntryOverhead + int64(e.size)
+	}
+	return u
+}
+
+// shed drops the oldest entries down to the shrunk capacity.
+func (r *recentEntries) shed() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	limit := shedCap(r.capacity)
+	if len(r.buf) <= limit {
+		return
+	}
+	ordered := r.ordered()
+	r.buf, r.next = append([]recentEntry(nil), ordered[len(ordered)-limit:]...), 0
+}
+
+var (
+	msgCanaryHeld          = message("config-canary.held.title")
+	msgCanaryHeldBody      = message("config-canary.held.body")
+	msgCanaryHeldRules     = message("config-canary.held.rules")
+	msgCanaryHeldRule      = message("config-canary.held.rule")
+	msgCanaryHeldCriticals = message("config-canary.held.criticals")
+	msgCanaryHeldCritical  = message("config-canary.held.critical")
+)
+
+// evaluateCanary runs the entries of the last window through the running
+// and the reloaded rules, compiled afresh so neither touches the live
+// cooldowns, and compares what they raise.
+func evaluateCanary(cfg *VaultConfig, recent *recentEntries, sens *sensitivityMap, old, next []AlertRule, now time.Time) *client.CanaryResult {
+	cc := cfg.ReloadCanary
+	entries := recent.since(now.Add(-time.Duration(cc.Window)))
+	sc := ruleScope{Environment: cfg.Environment, Sensitivity: sens, History: alertIndex.lookup(cfg.HistoryLookup)}
+	before, after := shadowAlerts(old, entries, sc), shadowAlerts(next, entries, sc)
+	res := &client.CanaryResult{Entries: len(entries), Window: formatDuration(time.Duration(cc.Window)), OldAlerts: len(before), NewAlerts: len(after)}
+
+	counts := make(map[string]*client.CanaryRule)
+	count := func(name string) *client.CanaryRule {
+		if counts[name] == nil {
+			counts[name] = &client.CanaryRule{Name: name}
+		}
+		return counts[name]
+	}
+	critical := make(map[string]bool)
+	for _, a := range before {
+		count(a.Rule).Old++
+		if a.Severity == sevCritical {
+			critical[a.Rule+" "+a.RequestID] = true
+		}
+	}
+	for _, a := range after {
+		count(a.Rule).New++
+		if k := a.Rule + " " + a.RequestID; a.Severity == sevCritical && !critical[k] {
+			critical[k] = true
+			res.NewCritical = append(res.NewCritical, k)
+		}
+	}
+	for _, c := range counts {
+		if c.Old != c.New {
+			res.Rules = append(res.Rules, *c)
+		}
+	}
+	sort.Slice(res.Rules, func(i, j int) bool {
+		di, dj := res.Rules[i].New-res.Rules[i].Old, res.Rules[j].New-res.Rules[j].Old
+		if di != dj {
+			return di > dj
+		}
+		return res.Rules[i].Name < res.Rules[j].Name
+	})
+
+	switch {
+	case len(res.NewCritical) > 0:
+		res.Reason = fmt.Sprintf("the new rules raise critical alerts the running ones don't (%d)", len(res.NewCritical))
+	case res.NewAlerts >= cc.MinAlerts && float64(res.NewAlerts) > cc.MaxRatio*float64(res.OldAlerts):
+		res.Reason = fmt.Sprintf("the new rules raise %d alerts where the running ones raise %d, more than %g times as many",
+			res.NewAlerts, res.OldAlerts, cc.MaxRatio)
+	default:
+		res.Passed = true
+	}
+	return res
+}
+
+// canaryCheck is the reloader's canary over recent, classifying paths
+// with sens; nil, so every reload applies, when the canary is disabled.
+// The running config's reload_canary settings judge the new rules.
+func canaryCheck(recent *recentEntries, sens *sensitivityMap) func(running, next *VaultConfig) *client.CanaryResult {
+	if recent == nil {
+		return nil
+	}
+	return func(running, next *VaultConfig) *client.CanaryResult {
+		return evaluateCanary(running, recent, sens, running.Rules, next.Rules, time.Now())
+	}
+}
+
+// shadowAlerts is what rules raise over entries, cooldowns included. The
+// rules are marked shadow, so they count and log nothing, and the alerts
+// go nowhere.
+func shadowAlerts(rules []AlertRule, entries []recentEntry, sc ruleScope) []Alert {
+	compiled := compileAlertRules(rules)
+	for i := range compiled {
+		compiled[i].shadow = true
+	}
+	var out []Alert
+	for _, e := range entries {
+		for i := range compiled {
+			r := &compiled[i]
+			match, ok := r.match(&e.en.AuditEntry)
+			if !ok {
+				continue
+			}
+			alert, ok := r.alert(e.en, match, sc)
+			if ok && r.threshold != nil {
+				alert, ok = r.threshold.observe(alert)
+			}
+			if ok && r.cooldown.allow(alert, e.at) {
+				out = append(out, alert)
+			}
+		}
+	}
+	return out
+}
+
+// canaryHeldAlert tells on-call the reloaded rules were held back, and
+// how they differ.
+func canaryHeldAlert(res *client.CanaryResult) Alert {
+	var details, rules, critical []localText
+	for i, r := range res.Rules {
+		if i == canaryListMax {
+			break
+		}
+		rules = append(rules, msgCanaryHeldRule.with("rule", mdCode(r.Name, maxNameLen), "old", r.Old, "new", r.New))
+	}
+	for i, k := range res.NewCritical {
+		if i == canaryListMax {
+			break
+		}
+		critical = append(critical, msgCanaryHeldCritical.with("alert", mdCode(k, maxNameLen)))
+	}
+	if len(rules) > 0 {
+		details = append(details, msgCanaryHeldRules.with("rules", rules))
+	}
+	if len(critical) > 0 {
+		details = append(details, msgCanaryHeldCriticals.with("alerts", critical))
+	}
+	// Alerts about the warden's own config go to the incident a failed
+	// reload opens, so the next reload that applies resolves it.
+	return Alert{Severity: sevWarning, Color: sevWarning.color(), Rule: "config-canary", Incident: "config-reload"}.say(
+		msgCanaryHeld.with(), msgCanaryHeldBody.with("reason", mdText(res.Reason, maxErrorLen), "entries", res.Entries,
+			"window", res.Window, "old", res.OldAlerts, "new", res.NewAlerts, "details", details))
+}
+
+func validateReloadCanary(cfg *VaultConfig) error {
+	cc := &cfg.ReloadCanary
+	if cc.Disabled {
+		return nil
+	}
+	if cc.Window == 0 {
+		cc.Window = Duration(defaultCanaryWindow)
+	}
+	if cc.Window < Duration(time.Minute) {
+		return &fieldError{"reload_canary.window", "must be at least 1m"}
+	}
+	if cc.Buffer == 0 {
+		cc.Buffer = defaultCanaryBuffer
+	}
+	if cc.Buffer < 0 {
+		return &fieldError{"reload_canary.buffer", "must be positive"}
+	}
+	if cc.MaxRatio == 0 {
+		cc.MaxRatio = defaultCanaryMaxRatio
+	}
+	if cc.MaxRatio < 1 {
+		return &fieldError{"reload_canary.max_ratio", "must be at least 1"}
+	}
+	if cc.MinAlerts == 0 {
+		cc.MinAlerts = defaultCanaryMinAlerts
+	}
+	if cc.MinAlerts < 0 {
+		return &fieldError{"reload_canary.min_alerts", "must be positive"}
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// --- Config Environment References ---
+
+// A value opts in to environment expansion one of two ways, so literal
+// strings containing "$" are left alone:
+//
+//	webhook_url: !env "https://discord.com/api/webhooks/${DISCORD_HOOK}"
+//	unseal_keys: ["env://VAULT_KEY_1", "plain-share"]
+//
+// !env expands each ${VAR} in the value; env://VAR is the whole value.
+const (
+	envTag    = "!env"
+	envScheme = "env://"
+)
+
+// envFields are the settings that may refer to environment variables;
+// vaultEnvFields are those of each vaults entry. Every value of
+// webhook.headers may as well, as they often hold tokens, those of
+// webhook.failover entries and their url, and so may
+// email.password, admin.token, canary.token and the Discord bots' tokens.
+var (
+	discordBotSections = []string{"approval.discord", "details.discord"}
+	envFields          = []string{"address", "webhook_url", "unseal_keys", "seal_token"}
+	vaultEnvFields     = []string{"address", "unseal_keys", "seal_token"}
+)
+
+var (
+	envRef   = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+	envName  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	envIndex = regexp.MustCompile(`\[[^\]]*\]`)
+)
+
+// expandEnvRefs returns a copy of root with the environment references in
+// envFields, and in vaultEnvFields of each vaults entry, resolved. A
+// variable that is unset or empty is an error naming the field and the
+// variable; so is !env on any other field.
+func expandEnvRefs(root *yaml.Node) (*yaml.Node, error) {
+	if err := checkEnvTags(root, ""); err != nil {
+		return nil, err
+	}
+	c, err := expandEnvFields(root, "", envFields)
+	if err != nil {
+		return nil, err
+	}
+	if c, err = expandWebhookHeaders(c); err != nil {
+		return nil, err
+	}
+	if c, err = expandSection(c, "email", []string{"password"}); err != nil {
+		return nil, err
+	}
+	if c, err = expandSection(c, "admin", []string{"token"}); err != nil {
+		return nil, err
+	}
+	if c, err = expandSection(c, "canary", []string{"token"}); err != nil {
+		return nil, err
+	}
+	for _, bot := range discordBotSections {
+		if c, err = expandSection(c, bot, []string{"bot_token"}); err != nil {
+			return nil, err
+		}
+	}
+	i := mappingIndex(c, "vaults")
+	if i < 0 || c.Content[i+1].Kind != yaml.SequenceNode {
+		return c, nil
+	}
+	seq := *c.Content[i+1]
+	seq.Content = make([]*yaml.Node, len(c.Content[i+1].Content))
+	for j, item := range c.Content[i+1].Content {
+		if item.Kind != yaml.MappingNode {
+			seq.Content[j] = item
+			continue
+		}
+		if seq.Content[j], err = expandEnvFields(item, fmt.Sprintf("vaults[%d]", j), vaultEnvFields); err != nil {
+			return nil, err
+		}
+	}
+	c.Content[i+1] = &seq
+	return c, nil
+}
+
+// expandEnvFields returns a copy of the mapping m with keys resolved;
+// field prefixes them in errors.
+func expandEnvFields(m *yaml.Node, field string, keys []string) (*yaml.Node, error) {
+	c := *m
+	c.Content = append([]*yaml.Node(nil), m.Content...)
+	for _, key := range keys {
+		i := mappingIndex(&c, key)
+		if i < 0 {
+			continue
+		}
+		name := joinField(field, key)
+		val := c.Content[i+1]
+		if val.Kind != yaml.SequenceNode {
+			resolved, err := resolveEnvRef(name, val)
+			if err != nil {
+				return nil, err
+			}
+			c.Content[i+1] = resolved
+			continue
+		}
+		seq := *val
+		seq.Content = make([]*yaml.Node, len(val.Content))
+		for j, item := range val.Content {
+			resolved, err := resolveEnvRef(fmt.Sprintf("%s[%d]", name, j), item)
+			if err != nil {
+				return nil, err
+			}
+			seq.Content[j] = resolved
+		}
+		c.Content[i+1] = &seq
+	}
+	return &c, nil
+}
+
+// expandWebhookHeaders returns root with the values of webhook.headers
+// resolved, and the url and headers of each webhook.failover entry.
+func expandWebhookHeaders(root *yaml.Node) (*yaml.Node, error) {
+	i := mappingIndex(root, "webhook")
+	if i < 0 || root.Content[i+1].Kind != yaml.MappingNode {
+		return root, nil
+	}
+	w, err := expandHeaders(root.Content[i+1], "webhook")
+	if err != nil {
+		return nil, err
+	}
+	if j := mappingIndex(w, "failover"); j >= 0 && w.Content[j+1].Kind == yaml.SequenceNode {
+		seq := *w.Content[j+1]
+		seq.Content = make([]*yaml.Node, len(w.Content[j+1].Content))
+		for k, item := range w.Content[j+1].Content {
+			if item.Kind != yaml.MappingNode {
+				seq.Content[k] = item
+				continue
+			}
+			field := fmt.Sprintf("webhook.failover[%d]", k)
+			if item, err = expandEnvFields(item, field, []string{"url"}); err != nil {
+				return nil, err
+			}
+			if seq.Content[k], err = expandHeaders(item, field); err != nil {
+				return nil, err
+			}
+		}
+		w.Content[j+1] = &seq
+	}
+	c := *root
+	c.Content = append([]*yaml.Node(nil), root.Content...)
+	c.Content[i+1] = w
+	return &c, nil
+}
+
+// expandHeaders returns a copy of the mapping m with the values of its
+// headers resolved; field is m's, for errors.
+func expandHeaders(m *yaml.Node, field string) (*yaml.Node, error) {
+	c := *m
+	c.Content = append([]*yaml.Node(nil), m.Content...)
+	j := mappingIndex(&c, "headers")
+	if j < 0 || c.Content[j+1].Kind != yaml.MappingNode {
+		return &c, nil
+	}
+	var names []string
+	for k := 0; k+1 < len(c.Content[j+1].Content); k += 2 {
+		names = append(names, c.Content[j+1].Content[k].Value)
+	}
+	headers, err := expandEnvFields(c.Content[j+1], field+".headers", names)
+	if err != nil {
+		return nil, err
+	}
+	c.Content[j+1] = headers
+	return &c, nil
+}
+
+// expandSection returns root with keys of the mapping section resolved;
+// section may be nested, e.g. approval.discord.
+func expandSection(root *yaml.Node, section string, keys []string) (*yaml.Node, error) {
+	return expandNested(root, section, strings.Split(section, "."), keys)
+}
+
+func expandNested(root *yaml.Node, section string, path []string, keys []string) (*yaml.Node, error) {
+	i := mappingIndex(root, path[0])
+	if i < 0 || root.Content[i+1].Kind != yaml.MappingNode {
+		return root, nil
+	}
+	var m *yaml.Node
+	var err error
+	if len(path) == 1 {
+		m, err = expandEnvFields(root.Content[i+1], section, keys)
+	} else {
+		m, err = expandNested(root.Content[i+1], section, path[1:], keys)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := *root
+	c.Content = append([]*yaml.Node(nil), root.Content...)
+	c.Content[i+1] = m
+	return &c, nil
+}
+
+// envAllowed reports whether field, e.g. "vaults[1].unseal_keys[0]", may
+// refer to environment variables.
+func envAllowed(field string) bool {
+	field = envIndex.ReplaceAllString(field, "")
+	if strings.HasPrefix(field, "webhook.headers.") || strings.HasPrefix(field, "webhook.failover.headers.") || field == "webhook.failover.url" ||
+		field == "email.password" || field == "admin.token" || field == "canary.token" {
+		return true
+	}
+	for _, bot := range discordBotSections {
+		if field == bot+".bot_token" {
+			return true
+		}
+	}
+	if strings.HasPrefix(field, "vaults.") {
+		return containsString(vaultEnvFields, strings.TrimPrefix(field, "vaults."))
+	}
+	return containsString(envFields, field)
+}
+
+// checkEnvTags rejects !env on fields envAllowed refuses, where it would
+// otherwise be decoded as the literal text.
+func checkEnvTags(n *yaml.Node, field string) error {
+	if n.Tag == envTag && !envAllowed(field) {
+		return &fieldError{field, fmt.Sprintf("can't use %s; only %s, webhook.headers, the url and headers of webhook.failover entries, email.password, admin.token, canary.token, the bot_token of %s, and %s of vaults entries, may refer to environment variables",
+			envTag, strings.Join(envFields, ", "), strings.Join(discordBotSections, " and "), strings.Join(vaultEnvFields, " and "))}
+	}
+	for i, child := range n.Content {
+		switch n.Kind {
+		case yaml.MappingNode:
+			if i%2 == 1 {
+				if err := checkEnvTags(child, joinField(field, n.Content[i-1].Value)); err != nil {
+					return err
+				}
+			}
+		case yaml.SequenceNode:
+			if err := checkEnvTags(child, fmt.Sprintf("%s[%d]", field, i)); err != nil {
+				return err
+			}
+		default:
+			if err := checkEnvTags(child, field); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resolveEnvRef resolves one scalar, returning it unchanged when it
+// doesn't opt in.
+func resolveEnvRef(field string, n *yaml.Node) (*yaml.Node, error) {
+	if n.Kind != yaml.ScalarNode {
+		return n, nil
+	}
+	c := *n
+	switch {
+	case n.Tag == envTag:
+		refs := envRef.FindAllStringSubmatch(n.Value, -1)
+		if len(refs) == 0 {
+			return nil, &fieldError{field, fmt.Sprintf("is tagged %s but has no ${VAR} reference", envTag)}
+		}
+		for _, ref := range refs {
+			if _, err := lookupEnvRef(field, ref[1]); err != nil {
+				return nil, err
+			}
+		}
+		c.Value = envRef.ReplaceAllStringFunc(n.Value, func(ref string) string {
+			return os.Getenv(ref[2 : len(ref)-1])
+		})
+	case strings.HasPrefix(n.Value, envScheme):
+		name := strings.TrimPrefix(n.Value, envScheme)
+		if !envName.MatchString(name) {
+			return nil, &fieldError{field, fmt.Sprintf("refers to %q, which isn't a valid environment variable name", name)}
+		}
+		v, err := lookupEnvRef(field, name)
+		if err != nil {
+			return nil, err
+		}
+		c.Value = v
+	default:
+		return n, nil
+	}
+	c.Tag, c.Style = "!!str", 0
+	return &c, nil
+}
+
+func lookupEnvRef(field, name string) (string, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return "", &fieldError{field, fmt.Sprintf("refers to environment variable %s, which is not set", name)}
+	}
+	if v == "" {
+		return "", &fieldError{field, fmt.Sprintf("refers to environment variable %s, which is empty", name)}
+	}
+	return v, nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// loadTestConfig loads body as a config file, the way -config does.
+func loadTestConfig(t *testing.T, body string) (*VaultConfig, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := loadConfig(path, "")
+	if err != nil {
+		return nil, err
+	}
+	return doc.config()
+}
+
+const envTestBase = `
+address: "http://127.0.0.1:8200"
+webhook_url: "https://discord.com/api/webhooks/1/x"
+unseal_keys: ["k1"]
+`
+
+func TestEnvRefsExpandTokens(t *testing.T) {
+	t.Setenv("TEST_CANARY_TOK", "s.canary")
+	t.Setenv("TEST_ADMIN_TOK", "admin-secret-0123456789")
+	cfg, err := loadTestConfig(t, envTestBase+`
+canary:
+  token: !env "${TEST_CANARY_TOK}"
+admin:
+  listen: 127.0.0.1:0
+  token: env://TEST_ADMIN_TOK
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Canary.Token != "s.canary" {
+		t.Errorf("canary.token = %q, want s.canary", cfg.Canary.Token)
+	}
+	if cfg.Admin.Token != "admin-secret-0123456789" {
+		t.Errorf("admin.token = %q, want admin-secret-0123456789", cfg.Admin.Token)
+	}
+}
+
+func TestEnvRefsUnsetVariable(t *testing.T) {
+	_, err := loadTestConfig(t, envTestBase+`
+canary:
+  token: env://TEST_UNSET_CANARY_TOK
+`)
+	if err == nil || !strings.Contains(err.Error(), "canary.token") || !strings.Contains(err.Error(), "not set") {
+		t.Fatalf("err = %v, want canary.token naming the unset variable", err)
+	}
+}
+
+func TestEnvTagRejectedElsewhere(t *testing.T) {
+	t.Setenv("TEST_LOG", "/var/log/a.log")
+	_, err := loadTestConfig(t, envTestBase+`
+audit_log: !env "${TEST_LOG}"
+`)
+	if err == nil {
+		t.Fatal("!env on audit_log loaded")
+	}
+	for _, want := range []string{"audit_log", "admin.token", "canary.token"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("err = %v, want it to mention %s", err, want)
+		}
+	}
+}
+
+func TestEnvRefsWebhookFailover(t *testing.T) {
+	t.Setenv("TEST_DR_URL", "https://dr.example/hook")
+	t.Setenv("TEST_DR_TOKEN", "dr-token")
+	cfg, err := loadTestConfig(t, `
+address: "http://127.0.0.1:8200"
+notifier: webhook
+webhook_url: "https://a.example/hook"
+unseal_keys: ["k1"]
+webhook:
+  failover:
+    - url: env://TEST_DR_URL
+      headers:
+        Authorization: !env "Bearer ${TEST_DR_TOKEN}"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Webhook.Failover) != 1 {
+		t.Fatalf("failover = %d entries, want 1", len(cfg.Webhook.Failover))
+	}
+	f := cfg.Webhook.Failover[0]
+	if f.URL != "https://dr.example/hook" || f.Headers["Authorization"] != "Bearer dr-token" {
+		t.Errorf("failover = %+v, want the environment's url and token", f)
+	}
+}
+
+// mixedEnv is the environment testdata/config-env/mixed.yaml refers to.
+var mixedEnv = map[string]string{
+	"TEST_VAULT_HOST":    "vault.internal",
+	"TEST_WEBHOOK_URL":   "https://discord.com/api/webhooks/1/from-env",
+	"TEST_UNSEAL_KEY_2":  "share-two-from-env",
+	"TEST_UNSEAL_PREFIX": "third",
+	"TEST_UNSEAL_SUFFIX": "3",
+}
+
+func loadMixedEnvFixture() (*VaultConfig, error) {
+	doc, err := loadConfig(filepath.Join("testdata", "config-env", "mixed.yaml"), "")
+	if err != nil {
+		return nil, err
+	}
+	return doc.config()
+}
+
+func TestEnvRefsMixedFixture(t *testing.T) {
+	for name, v := range mixedEnv {
+		t.Setenv(name, v)
+	}
+	cfg, err := loadMixedEnvFixture()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Address != "http://vault.internal:8200" {
+		t.Errorf("address = %q, want the host expanded", cfg.Address)
+	}
+	if cfg.WebhookURL != mixedEnv["TEST_WEBHOOK_URL"] {
+		t.Errorf("webhook_url = %q, want %q", cfg.WebhookURL, mixedEnv["TEST_WEBHOOK_URL"])
+	}
+	want := []string{"literal-share-$1", "share-two-from-env", "third-share-3", "${TEST_UNSEAL_KEY_2}", "envs://TEST_UNSEAL_KEY_2"}
+	if fmt.Sprint(cfg.UnsealKeys) != fmt.Sprint(want) {
+		t.Errorf("unseal_keys = %q, want %q", cfg.UnsealKeys, want)
+	}
+}
+
+// A config with one reference missing doesn't load half-expanded: it
+// fails, naming the first field and variable that didn't resolve.
+func TestEnvRefsMixedFixtureMissing(t *testing.T) {
+	tests := []struct {
+		unset string
+		empty bool
+		want  string
+	}{
+		{"TEST_VAULT_HOST", false, "address refers to environment variable TEST_VAULT_HOST, which is not set"},
+		{"TEST_WEBHOOK_URL", true, "webhook_url refers to environment variable TEST_WEBHOOK_URL, which is empty"},
+		{"TEST_UNSEAL_KEY_2", false, "unseal_keys[1] refers to environment variable TEST_UNSEAL_KEY_2, which is not set"},
+		{"TEST_UNSEAL_SUFFIX", true, "unseal_keys[2] refers to environment variable TEST_UNSEAL_SUFFIX, which is empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.unset, func(t *testing.T) {
+			for name, v := range mixedEnv {
+				t.Setenv(name, v)
+			}
+			t.Setenv(tt.unset, "") // restored after the test either way
+			if !tt.empty {
+				os.Unsetenv(tt.unset)
+			}
+			cfg, err := loadMixedEnvFixture()
+			if err == nil {
+				t.Fatalf("loaded with %s unset: unseal_keys %q", tt.unset, cfg.UnsealKeys)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v\nwant it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvRefsInvalid(t *testing.T) {
+	t.Setenv("TEST_VAULT_KEY", "k")
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"no reference", "address: !env \"http://127.0.0.1:8200\"\n", "address is tagged !env but has no ${VAR} reference"},
+		{"bad name", "webhook_url: env://not-a-name\n", `webhook_url refers to "not-a-name", which isn't a valid environment variable name`},
+		{"vaults entry", "vaults:\n  - name: a\n    unseal_keys: [env://TEST_VAULT_KEY]\n  - name: b\n    unseal_keys: [env://TEST_UNSET_VAULT_KEY]\n",
+			"vaults[1].unseal_keys[0] refers to environment variable TEST_UNSET_VAULT_KEY, which is not set"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadTestConfig(t, tt.body)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v\nwant it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// --- Command: Config Generate ---
+
+//go:generate go run . config generate -schema -out config-spec.schema.json
+
+// configSpec is the compact document `config generate` expands. It is
+// meant to be rendered by Terraform's jsonencode, so it only has the
+// handful of settings that differ between deployments.
+type configSpec struct {
+	Clusters  []clusterSpec `json:"clusters"`
+	Notifiers notifierSpec  `json:"notifiers"`
+	RulePacks []string      `json:"rule_packs,omitempty"`
+}
+
+type clusterSpec struct {
+	Name              string   `json:"name"`
+	Address           string   `json:"address"`
+	Environment       string   `json:"environment,omitempty"`
+	AuditLog          string   `json:"audit_log,omitempty"`
+	StateFile         string   `json:"state_file,omitempty"`
+	HistoryFile       string   `json:"history_file,omitempty"`
+	UnsealKeysCommand []string `json:"unseal_keys_command,omitempty"`
+	UnsealKeys        []string `json:"unseal_keys,omitempty"`
+}
+
+type notifierSpec struct {
+	DiscordWebhookURL string       `json:"discord_webhook_url"`
+	MQTT              *mqttSpec    `json:"mqtt,omitempty"`
+	Grafana           *grafanaSpec `json:"grafana,omitempty"`
+	StatsD            *statsdSpec  `json:"statsd,omitempty"`
+}
+
+type mqttSpec struct {
+	Broker   string `json:"broker"`
+	Topic    string `json:"topic,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+type grafanaSpec struct {
+	URL          string `json:"url"`
+	APIToken     string `json:"api_token"`
+	DashboardUID string `json:"dashboard_uid,omitempty"`
+}
+
+type statsdSpec struct {
+	Address   string `json:"address"`
+	DogStatsD bool   `json:"dogstatsd,omitempty"`
+}
+
+// configSpecDocs describes each field of the spec for its schema.
+var configSpecDocs = map[string]string{
+	"clusters":            "Vault clusters; each gets its own config.",
+	"notifiers":           "Alert destinations shared by every cluster.",
+	"rule_packs":          "Built-in rule packs to enable; see config generate -list-packs.",
+	"name":                "Cluster name, used for the output file name when there are several.",
+	"address":             "Vault API address, e.g. https://vault.example.com:8200.",
+	"environment":         "Environment label, e.g. prod.",
+	"audit_log":           "Path of Vault's file audit log.",
+	"state_file":          "State file path.",
+	"history_file":        "Signed alert history path.",
+	"unseal_keys_command": "Absolute path and arguments of a command printing the unseal keys as a JSON array.",
+	"unseal_keys":         "Unseal key shares, when no command is used.",
+	"discord_webhook_url": "Discord webhook for alerts.",
+	"mqtt":                "MQTT broker to publish alerts to.",
+	"grafana":             "Grafana instance to annotate.",
+	"statsd":              "StatsD or DogStatsD agent to push metrics to.",
+	"broker":              "Broker URL, e.g. tls://mqtt.example.com:8883.",
+	"topic":               "Alert topic template, e.g. vault/{{.Cluster}}/alerts.",
+	"username":            "Broker username.",
+	"password":            "Broker password.",
+	"url":                 "Grafana base URL.",
+	"api_token":           "Grafana service account token.",
+	"dashboard_uid":       "Dashboard to scope annotations to.",
+	"statsdSpec.address":  "Agent address, host:port.",
+	"dogstatsd":           "Send labels as DogStatsD tags.",
+}
+
+var clusterNameRE = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+func configSpecSchema() (map[string]interface{}, error) {
+	s, err := schemaFor(reflect.TypeOf(configSpec{}), configSpecDocs)
+	if err != nil {
+		return nil, err
+	}
+	s["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	s["$id"] = "https://github.com/usenix17/vault-warden/blob/main/config-spec.schema.json"
+	s["title"] = "vault-warden config spec"
+	s["description"] = "Input of vault-warden config generate."
+	return s, nil
+}
+
+func runConfigGenerate(args []string) error {
+	fs := flagSet("config generate")
+	specPath := fs.String("spec", "", "Spec file (JSON)")
+	out := fs.String("out", "", "Output file, or directory when the spec has several clusters (default stdout)")
+	listPacks := fs.Bool("list-packs", false, "Describe the built-in rule packs and exit")
+	schema := fs.Bool("schema", false, "Print the JSON schema of the spec and exit")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *listPacks {
+		for _, p := range rulePacks {
+			fmt.Print(p.describe())
+		}
+		return nil
+	}
+	if *schema {
+		s, err := configSpecSchema()
+		if err != nil {
+			return err
+		}
+		data, err := json.MarshalIndent(s, "", "  ")
+		if err != nil {
+			return err
+		}
+		return writeOutput(*out, append(data, '\n'), 0o644)
+	}
+	if *specPath == "" {
+		return fmt.Errorf("usage: vault-warden config generate -spec spec.json [-out config.yaml] | -list-packs | -schema")
+	}
+
+	spec, err := readConfigSpec(*specPath)
+	if err != nil {
+		return err
+	}
+	docs := make([][]byte, len(spec.Clusters))
+	for i, c := range spec.Clusters {
+		if docs[i], err = generateConfig(spec, c); err != nil {
+			return fmt.Errorf("cluster %s: %w", c.Name, err)
+		}
+	}
+
+	if len(docs) == 1 {
+		return writeOutput(*out, docs[0], 0o600)
+	}
+	if *out == "" {
+		return fmt.Errorf("-out must name a directory when the spec has %d clusters", len(docs))
+	}
+	if err := os.MkdirAll(*out, 0o755); err != nil {
+		return err
+	}
+	for i, c := range spec.Clusters {
+		if err := writeOutput(filepath.Join(*out, c.Name+".yaml"), docs[i], 0o600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readConfigSpec(path string) (*configSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read spec: %w", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var spec configSpec
+	if err := dec.Decode(&spec); err != nil {
+		return nil, fmt.Errorf("parse spec: %w", err)
+	}
+	if len(spec.Clusters) == 0 {
+		return nil, fmt.Errorf("spec: clusters is required")
+	}
+	seen := make(map[string]bool)
+	for i, c := range spec.Clusters {
+		if !clusterNameRE.MatchString(c.Name) {
+			return nil, fmt.Errorf("spec: clusters[%d].name %q must be lowercase letters, digits, - and _", i, c.Name)
+		}
+		if seen[c.Name] {
+			return nil, fmt.Errorf("spec: duplicate cluster name %q", c.Name)
+		}
+		seen[c.Name] = true
+	}
+	for _, name := range spec.RulePacks {
+		if _, err := findRulePack(name); err != nil {
+			return nil, fmt.Errorf("spec: %w", err)
+		}
+	}
+	return &spec, nil
+}
+
+// generateConfig renders one cluster's config and checks it loads. Keys
+// are written in a fixed order and packs are expanded sorted by name, so
+// the same spec always produces the same bytes.
+func generateConfig(spec *configSpec, c clusterSpec) ([]byte, error) {
+	root := orderedMap(
+		"address", c.Address,
+		"environment", c.Environment,
+		"unseal_keys_command", c.UnsealKeysCommand,
+		"allow_exec_key_source", len(c.UnsealKeysCommand) > 0,
+		"unseal_keys", c.UnsealKeys,
+		"webhook_url", spec.Notifiers.DiscordWebhookURL,
+		"audit_log", c.AuditLog,
+		"state_file", c.StateFile,
+		"history_file", c.HistoryFile,
+	)
+	if m := spec.Notifiers.MQTT; m != nil {
+		appendPair(root, "mqtt", orderedMap("broker", m.Broker, "topic", m.Topic, "username", m.Username, "password", m.Password))
+	}
+	if g := spec.Notifiers.Grafana; g != nil {
+		appendPair(root, "grafana", orderedMap("url", g.URL, "api_token", g.APIToken, "dashboard_uid", g.DashboardUID))
+	}
+	if s := spec.Notifiers.StatsD; s != nil {
+		appendPair(root, "metrics", orderedMap("statsd", orderedMap("address", s.Address, "dogstatsd", s.DogStatsD)))
+	}
+
+	names := append([]string(nil), spec.RulePacks...)
+	sort.Strings(names)
+	escalate := make(map[string]string)
+	var rules []*yaml.Node
+	pki, tokens := false, false
+	for i, name := range names {
+		if i > 0 && names[i-1] == name {
+			continue
+		}
+		p, _ := findRulePack(name) // checked in readConfigSpec
+		for _, r := range p.Aggregation {
+			rules = append(rules, orderedMap(
+				"name", r.Name,
+				"paths", r.Paths,
+				"operations", r.Operations,
+				"group_by", r.GroupBy,
+				"window", formatDuration(time.Duration(r.Window)),
+				"threshold", r.Threshold,
+				"severity", r.Severity,
+			))
+		}
+		pki = pki || p.PKI
+		tokens = tokens || p.Tokens
+		for prefix, sev := range p.Escalate {
+			// Where packs overlap, the higher severity wins.
+			cur, _ := parseSeverity(escalate[prefix])
+			if s, _ := parseSeverity(sev); escalate[prefix] == "" || s > cur {
+				escalate[prefix] = sev
+			}
+		}
+	}
+	if len(escalate) > 0 {
+		esc := &yaml.Node{Kind: yaml.MappingNode}
+		for _, prefix := range sortedKeys(escalate) {
+			appendPair(esc, prefix, escalate[prefix])
+		}
+		appendPair(root, "first_access", orderedMap("enabled", true, "escalate", esc))
+	}
+	if len(rules) > 0 {
+		appendPair(root, "aggregation", &yaml.Node{Kind: yaml.SequenceNode, Content: rules})
+	}
+	if pki {
+		appendPair(root, "pki", orderedMap("enabled", true))
+	}
+	if tokens {
+		appendPair(root, "tokens", orderedMap("enabled", true))
+	}
+
+	doc := &configDoc{root: root, sources: map[string]string{}}
+	if _, err := doc.config(); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("# Generated by vault-warden config generate. Do not edit; change the spec instead.\n")
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(root); err != nil {
+		return nil, fmt.Errorf("encode config: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// orderedMap builds a mapping node from key, value pairs, in order,
+// leaving out zero values so the output only holds what the spec set.
+func orderedMap(pairs ...interface{}) *yaml.Node {
+	m := &yaml.Node{Kind: yaml.MappingNode}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		appendPair(m, pairs[i].(string), pairs[i+1])
+	}
+	return m
+}
+
+func appendPair(m *yaml.Node, key string, value interface{}) {
+	var v *yaml.Node
+	switch x := value.(type) {
+	case *yaml.Node:
+		if len(x.Content) == 0 && x.Kind != yaml.ScalarNode {
+			return
+		}
+		v = x
+	default:
+		if rv := reflect.ValueOf(value); !rv.IsValid() || rv.IsZero() || (rv.Kind() == reflect.Slice && rv.Len() == 0) {
+			return
+		}
+		v = &yaml.Node{}
+		if err := v.Encode(value); err != nil {
+			panic(err) // only strings, bools, ints and string slices get here
+		}
+	}
+	m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, v)
+}
+
+// formatDuration writes whole days, hours or minutes the way a person
+// would in the config, e.g. 7d or 15m.
+func formatDuration(d time.Duration) string {
+	switch {
+	case d%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+	return d.String()
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeOutput(path string, data []byte, perm os.FileMode) error {
+	if path == "" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(path, data, perm)
+}
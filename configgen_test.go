@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigGenerateGolden(t *testing.T) {
+	out := t.TempDir()
+	if err := runConfigGenerate([]string{"-spec", "testdata/config-generate/spec.json", "-out", out}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"prod.yaml", "staging.yaml"} {
+		data, err := os.ReadFile(filepath.Join(out, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkGolden(t, filepath.Join("config-generate", name+".golden"), string(data))
+	}
+}
+
+// Rule pack order, repeats and map iteration don't change the bytes, so
+// Terraform sees no diff.
+func TestConfigGenerateDeterministic(t *testing.T) {
+	spec, err := readConfigSpec("testdata/config-generate/spec.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := generateConfig(spec, spec.Clusters[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	reordered := *spec
+	reordered.RulePacks = []string{"database", "pki", "pki", "identity", "kv-prod", "tokens", "database"}
+	for i := 0; i < 20; i++ {
+		got, err := generateConfig(&reordered, spec.Clusters[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("run %d differs:\n%s\nwant\n%s", i, got, want)
+		}
+	}
+}
+
+// The generated config is the one the daemon loads, packs expanded.
+func TestConfigGenerateLoads(t *testing.T) {
+	spec, err := readConfigSpec("testdata/config-generate/spec.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := generateConfig(spec, spec.Clusters[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadTestConfig(t, string(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Environment != "prod" || !cfg.AllowExecKeySource || !cfg.PKI.Enabled || !cfg.Tokens.Enabled || !cfg.FirstAccess.Enabled {
+		t.Errorf("config = %+v, want prod with the packs' detectors on", cfg)
+	}
+	var want int
+	for _, p := range rulePacks {
+		want += len(p.Aggregation)
+	}
+	if len(cfg.Aggregation) != want {
+		t.Errorf("aggregation = %d rules, want %d", len(cfg.Aggregation), want)
+	}
+	if cfg.FirstAccess.Escalate["pki/root"] != "critical" {
+		t.Errorf("first_access.escalate = %v, want the pki pack's", cfg.FirstAccess.Escalate)
+	}
+}
+
+// Where packs escalate the same prefix, the higher severity wins whatever
+// the order they are listed in.
+func TestConfigGenerateEscalateOverlap(t *testing.T) {
+	saved := rulePacks
+	defer func() { rulePacks = saved }()
+	rulePacks = append(append([]rulePack(nil), saved...),
+		rulePack{Name: "a-strict", Escalate: map[string]string{"secret/data/": "critical"}},
+		rulePack{Name: "z-loose", Escalate: map[string]string{"secret/data/": "warning"}})
+
+	for _, packs := range [][]string{{"a-strict", "z-loose"}, {"z-loose", "a-strict"}} {
+		spec := &configSpec{
+			Clusters:  []clusterSpec{{Name: "prod", Address: "https://vault:8200", UnsealKeys: []string{"k1"}}},
+			Notifiers: notifierSpec{DiscordWebhookURL: "https://discord.com/api/webhooks/1/x"},
+			RulePacks: packs,
+		}
+		data, err := generateConfig(spec, spec.Clusters[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), "secret/data/: critical") {
+			t.Errorf("packs %v:\n%s\nwant secret/data/ critical", packs, data)
+		}
+	}
+}
+
+func TestConfigSpecErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+		want string
+	}{
+		{"unknown field", `{"clusters": [{"name": "a", "addres": "x"}]}`, `unknown field "addres"`},
+		{"no clusters", `{"clusters": []}`, "clusters is required"},
+		{"bad name", `{"clusters": [{"name": "Prod EU"}]}`, `clusters[0].name "Prod EU" must be lowercase`},
+		{"duplicate name", `{"clusters": [{"name": "a"}, {"name": "a"}]}`, `duplicate cluster name "a"`},
+		{"unknown pack", `{"clusters": [{"name": "a"}], "rule_packs": ["kv"]}`, `unknown rule pack "kv" (have database, identity, kv-prod, pki, tokens)`},
+		{"not json", `clusters: []`, "parse spec"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "spec.json")
+			if err := os.WriteFile(path, []byte(tt.spec), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := readConfigSpec(path)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// A spec that expands to an invalid config is refused, not written.
+func TestConfigGenerateValidates(t *testing.T) {
+	dir := t.TempDir()
+	spec := filepath.Join(dir, "spec.json")
+	out := filepath.Join(dir, "config.yaml")
+	body := `{"clusters": [{"name": "prod", "address": "https://vault:8200"}], "notifiers": {"discord_webhook_url": "https://discord.com/api/webhooks/1/x"}}`
+	if err := os.WriteFile(spec, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	err := runConfigGenerate([]string{"-spec", spec, "-out", out})
+	if err == nil || !strings.HasPrefix(err.Error(), "cluster prod: ") {
+		t.Fatalf("err = %v, want the cluster's validation error", err)
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("config written for an invalid spec: %v", err)
+	}
+}
+
+func TestConfigSpecSchemaFileCurrent(t *testing.T) {
+	s, err := configSpecSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile("config-spec.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, append(want, '\n')) {
+		t.Error("config-spec.schema.json is stale; run go generate")
+	}
+}
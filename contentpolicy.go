@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --- Content Policies ---
+
+// What a destination is told about an alert.
+const (
+	contentFull    = "full"    // everything
+	contentMinimal = "minimal" // the title and a generic body
+	contentSilent  = "silent"  // nothing
+	policyDefault  = "default" // rule or destination key matching any other
+)
+
+// msgMinimal is the body of every alert sent as minimal.
+var msgMinimal = message("content-policy.minimal")
+
+// contentPolicies is content_policies: per rule, the policy of each
+// destination, e.g. unseal: {discord: minimal}. Destinations are named as
+// in metrics: the notifier's kind, mqtt, grafana or pagerduty.
+type contentPolicies map[string]map[string]string
+
+// of returns the policy for rule at dest, the most specific entry first:
+// the rule's entry for dest, its default, then default's entry for dest
+// and its default. Anything unset is full.
+func (p contentPolicies) of(rule, dest string) string {
+	for _, r := range []string{rule, policyDefault} {
+		for _, d := range []string{dest, policyDefault} {
+			if v := p[r][d]; v != "" {
+				return v
+			}
+		}
+	}
+	return contentFull
+}
+
+// contentPolicy returns the policy an alert is sent to dest under. A
+// critical alert is never silenced, only cut to minimal, unless
+// allow_silence_critical is set.
+func contentPolicy(cfg *VaultConfig, a Alert, dest string) string {
+	p := cfg.ContentPolicies.of(a.Rule, dest)
+	if p == contentSilent && a.Severity >= sevCritical && !cfg.AllowSilenceCritical {
+		return contentMinimal
+	}
+	return p
+}
+
+// applyContentPolicy returns a as dest may see it, and false if dest must
+// not see it at all. It runs on the finished alert, just before a sink
+// renders it, so nothing added on the way out gets past it.
+func applyContentPolicy(cfg *VaultConfig, a Alert, dest string) (Alert, bool) {
+	switch contentPolicy(cfg, a, dest) {
+	case contentSilent:
+		metrics.inc("alerts_silenced_total", "destination", dest)
+		return a, false
+	case contentMinimal:
+		return minimalAlert(a), true
+	}
+	return a, true
+}
+
+// minimalAlert keeps what identifies an alert and drops the rest: the
+// body, every field from the audit entry, enrichment, topology and the
+// cluster label.
+func minimalAlert(a Alert) Alert {
+	return Alert{SchemaVersion: a.SchemaVersion, ID: a.ID, Title: a.Title, Description: a.label(msgMinimal),
+		Severity: a.Severity, Color: a.Color, Environment: a.Environment, Rule: a.Rule,
+		Time: a.Time, DetectedAt: a.DetectedAt, Incident: a.Incident, Resolved: a.Resolved, Minimal: true, Locale: a.Locale}
+}
+
+// validateContentPolicies checks content_policies against the rules and
+// destinations the config knows.
+func validateContentPolicies(cfg *VaultConfig) error {
+	names := namesFromConfig(cfg)
+	rules := map[string]bool{policyDefault: true}
+	for _, r := range names.Rules {
+		rules[r] = true
+	}
+	for rule, byDest := range cfg.ContentPolicies {
+		if !rules[rule] {
+			return &fieldError{"content_policies." + rule, "is not a known rule"}
+		}
+		for dest, p := range byDest {
+			f := "content_policies." + rule + "." + dest
+			if dest != policyDefault && !knownDestination(dest) {
+				return &fieldError{f, "is not a destination; use " + contentDestinations()}
+			}
+			if p != contentFull && p != contentMinimal && p != contentSilent {
+				return &fieldError{f, "must be full, minimal or silent"}
+			}
+		}
+	}
+	return nil
+}
+
+// knownDestination reports whether dest names a destination: the
+// notifier's kind, mqtt, grafana or pagerduty.
+func knownDestination(dest string) bool {
+	_, ok := notifiers[dest]
+	return ok || dest == "mqtt" || dest == "grafana" || dest == "pagerduty"
+}
+
+// destinationNames lists the destinations, for errors.
+func destinationNames() string {
+	kinds := []string{"grafana", "mqtt", "pagerduty"}
+	for k := range notifiers {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+	return strings.Join(kinds, ", ")
+}
+
+// contentDestinations lists what content_policies can name, for errors.
+func contentDestinations() string {
+	return destinationNames() + ", " + policyDefault
+}
+
+// runRenderTest prints what each configured destination would receive
+// for an alert of a rule, after its content policy. Nothing is sent.
+func runRenderTest(cfg *VaultConfig, args []string) error {
+	fs := flagSet("render-test")
+	rule := fs.String("rule", "unseal", "Rule the sample alert carries")
+	sevFlag := fs.String("severity", "info", "Severity of the sample alert")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	sev, err := parseSeverity(*sevFlag)
+	if err != nil {
+		return err
+	}
+	locales = openLocales(cfg)
+	a := sampleAlert(cfg, *rule, sev)
+
+	dests := namesFromConfig(cfg).Destinations
+	if len(dests) == 0 {
+		dests = []string{notifierFor(cfg).kind()}
+	}
+	for _, dest := range dests {
+		policy := contentPolicy(cfg, a, dest)
+		note := ""
+		if policy != cfg.ContentPolicies.of(a.Rule, dest) {
+			note = ", raised from silent: critical alerts can't be silenced"
+		}
+		fmt.Printf("── %s (%s%s) ──\n", dest, policy, note)
+		out, ok := forDestination(cfg, a, dest)
+		if !ok {
+			fmt.Println("(not sent)")
+			continue
+		}
+		var data []byte
+		switch dest {
+		case "mqtt":
+			data, err = json.MarshalIndent(out, "", "  ")
+		case "grafana":
+			data = []byte(fmt.Sprintf("annotation: %s", out.Title))
+		case "pagerduty":
+			data = []byte(fmt.Sprintf("trigger: %s (dedup key %s)", out.Title, pagerDutyDedupKey(out)))
+			if min, _ := parseSeverity(cfg.PagerDuty.MinSeverity); out.Severity < min {
+				data = []byte("(below min_severity; not sent)")
+			}
+		default:
+			var raw []byte
+			if raw, err = notifierFor(cfg).encode(packAlerts([]Alert{out})[0]); err == nil && json.Valid(raw) {
+				var buf bytes.Buffer
+				err = json.Indent(&buf, raw, "", "  ")
+				data = buf.Bytes()
+			} else {
+				data = raw // e.g. an email message
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("render for %s: %w", dest, err)
+		}
+		fmt.Println(string(data))
+	}
+	return nil
+}
+
+var (
+	msgSample     = message("render-test.sample.title")
+	msgSampleBody = message("render-test.sample.body")
+)
+
+// sampleAlert is a made-up alert of rule with every field filled in, as
+// notify would finish it.
+func sampleAlert(cfg *VaultConfig, rule string, sev severity) Alert {
+	a := Alert{SchemaVersion: alertSchemaVersion, ID: newAlertID(), Severity: sev, Color: sev.color(),
+		Cluster: clusterLabel(cfg), Rule: rule, User: "alice", Path: "secret/data/payments/db", Operation: "read",
+		SourceIP: "203.0.113.7", RequestID: "00000000-0000-0000-0000-000000000000",
+		Enrichment: map[string]string{"custodian": "ops-team"}}.say(msgSample.with("rule", rule), msgSampleBody.with())
+	a.DetectedAt = time.Now().UTC()
+	a.Time = a.DetectedAt
+	if env := cfg.Environment; env != "" {
+		a.Environment = env
+		a.Title = "[" + strings.ToUpper(env) + "] " + a.Title
+	}
+	return a
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+// --- Rule Cooldowns ---
+
+const (
+	// maxCooldownKeys bounds the (user, path) pairs a rule tracks; past
+	// it, the pair whose cooldown ends first is dropped, and its next
+	// alert goes out.
+	maxCooldownKeys       = 10000
+	cooldownSweepInterval = 10 * time.Second
+)
+
+type cooldownKey struct{ user, path string }
+
+type cooldownEntry struct {
+	key        cooldownKey
+	until      time.Time
+	suppressed int
+	last       Alert // the latest suppressed alert, for the summary
+	index      int   // in ruleCooldown.expiry
+}
+
+// restart starts a new cooldown for the entry's pair with nothing held
+// back.
+func (e *cooldownEntry) restart(until time.Time) {
+	e.until, e.suppressed, e.last = until, 0, Alert{}
+}
+
+// cooldownExpiry orders a rule's entries by when their cooldowns end, as
+// a container/heap min-heap; each entry knows its index, so one whose
+// cooldown restarts is fixed in place.
+type cooldownExpiry []*cooldownEntry
+
+func (h cooldownExpiry) Len() int           { return len(h) }
+func (h cooldownExpiry) Less(i, j int) bool { return h[i].until.Before(h[j].until) }
+func (h cooldownExpiry) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *cooldownExpiry) Push(x interface{}) {
+	e := x.(*cooldownEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *cooldownExpiry) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
+
+// ruleCooldown holds back a rule's repeated alerts for the same user and
+// path. When a pair's cooldown ends with alerts held back, a summary goes
+// out and a new cooldown starts, so a steady repeat costs one message per
+// cooldown. A nil *ruleCooldown holds nothing back.
+type ruleCooldown struct {
+	window time.Duration
+
+	mu     sync.Mutex
+	keys   map[cooldownKey]*cooldownEntry
+	expiry cooldownExpiry // the entries of keys, soonest to end first
+}
+
+func newRuleCooldown(window time.Duration) *ruleCooldown {
+	if window <= 0 {
+		return nil
+	}
+	return &ruleCooldown{window: window, keys: make(map[cooldownKey]*cooldownEntry)}
+}
+
+// allow reports whether a goes out now. Otherwise it is counted towards
+// its pair's summary.
+func (c *ruleCooldown) allow(a Alert, now time.Time) bool {
+	if c == nil {
+		return true
+	}
+	k := cooldownKey{a.User, a.Path}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.keys[k]
+	switch {
+	case ok && now.Before(e.until):
+		e.suppressed++
+		e.last = a
+		return false
+	case ok:
+		e.restart(now.Add(c.window))
+		heap.Fix(&c.expiry, e.index)
+		return true
+	}
+	if len(c.keys) >= shedCap(maxCooldownKeys) {
+		c.evictLocked()
+	}
+	e = &cooldownEntry{key: k, until: now.Add(c.window)}
+	c.keys[k] = e
+	heap.Push(&c.expiry, e)
+	return true
+}
+
+// evictLocked drops the pair whose cooldown ends first. Its held back
+// alerts go unsummarised, which is counted.
+func (c *ruleCooldown) evictLocked() {
+	e := heap.Pop(&c.expiry).(*cooldownEntry)
+	if e.suppressed > 0 {
+		metrics.inc("rule_cooldown_evictions_total", "rule", e.last.Rule)
+	}
+	delete(c.keys, e.key)
+}
+
+// expire ends the cooldowns due by now and returns the summaries of those
+// that held alerts back, the soonest to end first.
+func (c *ruleCooldown) expire(now time.Time) []Alert {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []Alert
+	for len(c.expiry) > 0 && !now.Before(c.expiry[0].until) {
+		e := c.expiry[0]
+		if e.suppressed == 0 {
+			heap.Pop(&c.expiry)
+			delete(c.keys, e.key)
+			continue
+		}
+		out = append(out, cooldownSummary(e, c.window))
+		e.restart(now.Add(c.window))
+		heap.Fix(&c.expiry, 0)
+	}
+	return out
+}
+
+// ruleCooldowns is the cooldowns of every rule as one cache for the memory
+// guard.
+type ruleCooldowns struct{ rules *ruleSet }
+
+func (rc ruleCooldowns) usage() cacheUsage {
+	var u cacheUsage
+	rules := rc.rules.load()
+	for i := range rules {
+		if c := rules[i].cooldown; c != nil {
+			c.mu.Lock()
+			u.Entries += len(c.keys)
+			for k, e := range c.keys {
+				u.Bytes += cacheEntryOverhead + int64(len(k.user)+len(k.path)+len(e.last.Description))
+			}
+			c.mu.Unlock()
+		}
+	}
+	return u
+}
+
+// shed drops the pairs whose cooldowns end first, as evictLocked does.
+func (rc ruleCooldowns) shed() {
+	rules := rc.rules.load()
+	for i := range rules {
+		c := rules[i].cooldown
+		if c == nil {
+			continue
+		}
+		c.mu.Lock()
+		for len(c.keys) > shedCap(maxCooldownKeys) {
+			c.evictLocked()
+		}
+		c.mu.Unlock()
+	}
+}
+
+var (
+	msgCooldown     = message("rule-cooldown.summary.title")
+	msgCooldownBody = message("rule-cooldown.summary.body")
+)
+
+// cooldownSummary is the last held back alert, with the count in its
+// title and in front of its description.
+func cooldownSummary(e *cooldownEntry, window time.Duration) Alert {
+	a := e.last
+	a.ID = ""
+	return a.say(msgCooldown.with("title", a.titleText(), "count", e.suppressed),
+		msgCooldownBody.with("count", e.suppressed, "window", formatDuration(window), "user", mdText(a.User, maxNameLen),
+			"path", mdCode(a.Path, maxPathLen), "latest", a.bodyText()))
+}
+
+// ruleCooldownJob sends the summaries of the rules' expired cooldowns.
+func ruleCooldownJob(a *auditor) jobSpec {
+	return jobSpec{
+		name:    "rule-cooldowns",
+		every:   cooldownSweepInterval,
+		timeout: 30 * time.Second,
+		run: func(ctx context.Context) error {
+			now := time.Now()
+			rules := a.rules.load()
+			for i := range rules {
+				r := &rules[i]
+				for _, s := range r.cooldown.expire(now) {
+					metrics.inc("rule_cooldown_summaries_total", "rule", r.Name)
+					a.sensitivity.apply(&s)
+					notify(a.cfg, s)
+					logInfo("🔁 Rule {rule}: {user} -> {path} repeated, summary sent", "rule", r.Name, "user", s.User, "path", s.Path)
+				}
+			}
+			return nil
+		},
+	}
+}
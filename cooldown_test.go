@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func cooldownAlert(user, path string) Alert {
+	return Alert{Rule: "repeat", Title: "Repeat", User: user, Path: path}
+}
+
+// A pair's repeats within the window are held back, and the sweep sends
+// one summary per pair that held any, soonest to end first, then starts
+// a new cooldown for it; a pair with nothing held back is forgotten.
+func TestCooldownExpire(t *testing.T) {
+	c := newRuleCooldown(time.Minute)
+	start := time.Now()
+	for i, user := range []string{"carol", "alice", "bob"} {
+		at := start.Add(time.Duration(i) * time.Second)
+		if !c.allow(cooldownAlert(user, "secret/x"), at) {
+			t.Fatalf("%s's first alert held back", user)
+		}
+		if user != "bob" && c.allow(cooldownAlert(user, "secret/x"), at.Add(time.Second)) {
+			t.Fatalf("%s's repeat went out", user)
+		}
+	}
+	if got := c.expire(start.Add(30 * time.Second)); len(got) != 0 {
+		t.Errorf("%d summaries before any cooldown ended", len(got))
+	}
+	end := start.Add(2 * time.Minute)
+	var users []string
+	for _, s := range c.expire(end) {
+		users = append(users, s.User)
+	}
+	if got := strings.Join(users, " "); got != "carol alice" {
+		t.Errorf("summaries for [%s], want carol's then alice's", got)
+	}
+	if _, ok := c.keys[cooldownKey{"bob", "secret/x"}]; ok || len(c.keys) != 2 || len(c.expiry) != 2 {
+		t.Errorf("after the sweep: %d pairs, %d on the heap, bob kept %v", len(c.keys), len(c.expiry), ok)
+	}
+	// The summarised pairs are in a new cooldown.
+	if c.allow(cooldownAlert("alice", "secret/x"), end.Add(time.Second)) {
+		t.Error("alice's alert went out straight after her summary")
+	}
+	if !c.allow(cooldownAlert("alice", "secret/x"), end.Add(2*time.Minute)) {
+		t.Error("alice's alert held back after the new cooldown ended")
+	}
+}
+
+// Past the cap on pairs, the one whose cooldown ends first makes room,
+// also when a restarted cooldown has moved it within the heap.
+func TestCooldownEvictsSoonestToEnd(t *testing.T) {
+	resetShedding(t)
+	atomic.StoreInt32(&shedStage, shedShrink)
+	limit := shedCap(maxCooldownKeys)
+	c := newRuleCooldown(time.Minute)
+	start := time.Now()
+	for i := 0; i < limit; i++ {
+		c.allow(cooldownAlert(fmt.Sprintf("u%d", i), "secret/x"), start.Add(time.Duration(i)*time.Millisecond))
+	}
+	// u0's cooldown ends and restarts last; u1's now ends first.
+	c.allow(cooldownAlert("u0", "secret/x"), start.Add(2*time.Minute))
+	c.allow(cooldownAlert("u1", "secret/x"), start.Add(time.Second))
+	before := metrics.sum("rule_cooldown_evictions_total")
+	c.allow(cooldownAlert("new", "secret/x"), start.Add(2*time.Minute))
+	if len(c.keys) != limit || len(c.expiry) != limit {
+		t.Fatalf("%d pairs, %d on the heap, want %d", len(c.keys), len(c.expiry), limit)
+	}
+	for _, user := range []string{"u1", "u2"} {
+		if _, ok := c.keys[cooldownKey{user, "secret/x"}]; ok == (user == "u1") {
+			t.Errorf("%s kept = %v", user, ok)
+		}
+	}
+	if d := metrics.sum("rule_cooldown_evictions_total") - before; d != 1 {
+		t.Errorf("rule_cooldown_evictions_total grew by %v, want u1's held alert counted", d)
+	}
+	for i, e := range c.expiry {
+		if e.index != i || c.keys[e.key] != e {
+			t.Fatalf("heap entry %d has index %d", i, e.index)
+		}
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Coordinated Access ---
+
+const (
+	defaultAggregationWindow    = 10 * time.Minute
+	defaultAggregationThreshold = 5
+	defaultAggregationGroups    = 1000
+	defaultAggregationMembers   = 100
+	// Windows at least this long are saved to the state file, so a
+	// restart doesn't reset them.
+	aggregationPersistAfter = 5 * time.Minute
+	maxListedSources        = 3
+)
+
+// AggregationRule alerts when Threshold distinct identities hit the same
+// group within Window. Groups are exact paths by default; "prefix:N"
+// groups on the first N path segments instead.
+type AggregationRule struct {
+	Name       string   `yaml:"name"`
+	Paths      []string `yaml:"paths"`      // prefixes; empty matches every path
+	Operations []string `yaml:"operations"` // empty matches every operation
+	EntityIDs  []string `yaml:"entity_ids"` // exact auth.entity_id; empty matches every identity
+	// Sensitivity lists the levels whose paths count, e.g. [high,
+	// critical]; "unclassified" matches paths the map doesn't cover.
+	// Empty matches every path.
+	Sensitivity []string `yaml:"sensitivity"`
+	GroupBy     string   `yaml:"group_by"` // "path" or "prefix:N"
+	Window      Duration `yaml:"window"`
+	Threshold   int      `yaml:"threshold"`
+	Severity    string   `yaml:"severity"` // default critical
+	MaxGroups   int      `yaml:"max_groups"`
+	MaxMembers  int      `yaml:"max_members"` // identities kept per group
+}
+
+// accessWindow is one group's recent identities.
+type accessWindow struct {
+	Members   map[string]*windowMember `json:"members"`
+	LastSeen  time.Time                `json:"last_seen"`
+	AlertedAt time.Time                `json:"alerted_at,omitempty"`
+}
+
+type windowMember struct {
+	Name     string    `json:"name,omitempty"` // display name, when keyed by entity
+	LastSeen time.Time `json:"last_seen"`
+	Sources  []string  `json:"sources,omitempty"`
+}
+
+type aggregationRule struct {
+	AggregationRule
+	segments int // 0: exact path
+	sev      severity
+	groups   map[string]*accessWindow
+}
+
+type coordinatedDetector struct {
+	rules []*aggregationRule
+	store *stateStore
+	sens  *sensitivityMap
+
+	mu sync.Mutex
+}
+
+func newCoordinatedDetector(cfg *VaultConfig, sens *sensitivityMap) *coordinatedDetector {
+	if len(cfg.Aggregation) == 0 {
+		return nil
+	}
+	d := &coordinatedDetector{store: newStateStore(cfg.StateFile), sens: sens}
+	for _, r := range cfg.Aggregation {
+		segments, _ := parseGroupBy(r.GroupBy) // validated at load
+		sev, _ := parseSeverity(r.Severity)
+		d.rules = append(d.rules, &aggregationRule{AggregationRule: r, segments: segments, sev: sev,
+			groups: make(map[string]*accessWindow)})
+	}
+	st, err := d.store.load()
+	if err != nil {
+		logWarn("⚠️  Coordinated access: could not restore windows: {error}", "error", err)
+		return d
+	}
+	now := time.Now()
+	for _, r := range d.rules {
+		for group, w := range st.Coordinated[r.Name] {
+			if w != nil && w.Members != nil && r.persisted() && now.Sub(w.LastSeen) < time.Duration(r.Window) {
+				r.groups[group] = w
+			}
+		}
+	}
+	return d
+}
+
+// parseGroupBy returns the number of leading segments to group on, or 0
+// for the exact path.
+func parseGroupBy(s string) (int, error) {
+	if s == "" || s == "path" {
+		return 0, nil
+	}
+	if strings.HasPrefix(s, "prefix:") {
+		if v, err := strconv.Atoi(strings.TrimPrefix(s, "prefix:")); err == nil && v > 0 {
+			return v, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown grouping %q (want path or prefix:N)", s)
+}
+
+func (r *aggregationRule) persisted() bool {
+	return time.Duration(r.Window) >= aggregationPersistAfter
+}
+
+func (r *aggregationRule) group(e *AuditEntry, level sensitivityLevel) (string, bool) {
+	path := strings.Trim(e.Request.Path, "/")
+	if len(r.Paths) > 0 {
+		matched := false
+		for _, p := range r.Paths {
+			matched = matched || strings.HasPrefix(path, strings.Trim(p, "/"))
+		}
+		if !matched {
+			return "", false
+		}
+	}
+	if len(r.Operations) > 0 {
+		matched := false
+		for _, op := range r.Operations {
+			matched = matched || strings.EqualFold(op, e.Request.Operation)
+		}
+		if !matched {
+			return "", false
+		}
+	}
+	if len(r.EntityIDs) > 0 && !containsString(r.EntityIDs, e.Auth.EntityID) {
+		return "", false
+	}
+	if len(r.Sensitivity) > 0 && !containsString(r.Sensitivity, level.String()) {
+		return "", false
+	}
+	if r.segments == 0 {
+		return path, true
+	}
+	parts := strings.SplitN(path, "/", r.segments+1)
+	if len(parts) > r.segments {
+		parts = parts[:r.segments]
+	}
+	return strings.Join(parts, "/"), true
+}
+
+// observe counts one successful response entry and returns an alert for
+// each rule whose group just crossed its threshold. A group alerts at most
+// once per window.
+func (d *coordinatedDetector) observe(e *AuditEntry) []Alert {
+	if d == nil || e.Type != "response" || e.Error != "" || e.Auth.DisplayName == "" || e.Request.Path == "" {
+		return nil
+	}
+	now := entryTime(e.Time)
+	id, source := identityKey(e), hostOnly(e.Request.RemoteAddress)
+
+	level := d.sens.classify(e.Request.Path)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var alerts []Alert
+	for _, r := range d.rules {
+		key, ok := r.group(e, level)
+		if !ok {
+			continue
+		}
+		window := time.Duration(r.Window)
+		w := r.groups[key]
+		if w == nil {
+			if len(r.groups) >= shedCap(r.MaxGroups) {
+				r.evictGroup()
+			}
+			w = &accessWindow{Members: make(map[string]*windowMember)}
+			r.groups[key] = w
+		}
+		w.LastSeen = now
+		for name, m := range w.Members {
+			if now.Sub(m.LastSeen) > window {
+				delete(w.Members, name)
+			}
+		}
+		m := w.Members[id]
+		if m == nil {
+			if len(w.Members) >= r.MaxMembers {
+				evictMember(w.Members)
+			}
+			m = &windowMember{}
+			w.Members[id] = m
+		}
+		m.LastSeen = now
+		if id != e.Auth.DisplayName {
+			m.Name = e.Auth.DisplayName
+		}
+		if source != "" && !containsString(m.Sources, source) && len(m.Sources) < maxListedSources {
+			m.Sources = append(m.Sources, source)
+		}
+
+		if len(w.Members) < r.Threshold || (!w.AlertedAt.IsZero() && now.Sub(w.AlertedAt) < window) {
+			continue
+		}
+		w.AlertedAt = now
+		metrics.inc("coordinated_access_total", "rule", r.Name)
+		alerts = append(alerts, Alert{Severity: r.sev, Color: r.sev.color(), RequestID: e.Request.ID, Rule: r.Name,
+			User: e.Auth.DisplayName, Path: e.Request.Path, Operation: e.Request.Operation, SourceIP: source, Time: now}.say(
+			msgCoordinated.with("path", cleanField(key, maxPathLen)),
+			msgCoordinatedBody.with("count", len(w.Members), "path", mdCode(key, maxPathLen), "window", window, "members", formatMembers(w.Members))))
+	}
+	return alerts
+}
+
+// suppresses reports whether an aggregated alert already covers path in
+// its current window, so per-identity alerts for it would double-page.
+func (d *coordinatedDetector) suppresses(e *AuditEntry) bool {
+	if d == nil {
+		return false
+	}
+	now, level := entryTime(e.Time), d.sens.classify(e.Request.Path)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, r := range d.rules {
+		key, ok := r.group(e, level)
+		if !ok {
+			continue
+		}
+		if w := r.groups[key]; w != nil && !w.AlertedAt.IsZero() && now.Sub(w.AlertedAt) < time.Duration(r.Window) {
+			return true
+		}
+	}
+	return false
+}
+
+func formatMembers(members map[string]*windowMember) []localText {
+	keys := make([]string, 0, len(members))
+	for key := range members {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	lines := make([]localText, 0, len(keys))
+	for _, key := range keys {
+		label := key
+		if m := members[key]; m.Name != "" {
+			label = identityLabel(&Alert{User: m.Name, EntityID: key})
+		}
+		var from localText
+		if srcs := members[key].Sources; len(srcs) > 0 {
+			from = msgMemberFrom.with("sources", mdText(strings.Join(srcs, ", "), maxNameLen))
+		}
+		lines = append(lines, msgMember.with("member", mdText(label, maxNameLen), "from", from))
+	}
+	return lines
+}
+
+var (
+	msgCoordinated     = message("coordinated.title")
+	msgCoordinatedBody = message("coordinated.body")
+	msgMember          = message("coordinated.member")
+	msgMemberFrom      = message("coordinated.member.from")
+)
+
+func (r *aggregationRule) evictGroup() {
+	var oldest string
+	var seen time.Time
+	for key, w := range r.groups {
+		if oldest == "" || w.LastSeen.Before(seen) {
+			oldest, seen = key, w.LastSeen
+		}
+	}
+	delete(r.groups, oldest)
+}
+
+// usage counts the groups of every rule.
+func (d *coordinatedDetector) usage() cacheUsage {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var u cacheUsage
+	for _, r := range d.rules {
+		u.Entries += len(r.groups)
+		for key, w := range r.groups {
+			u.Bytes += cacheEntryOverhead + cacheMapOverhead + int64(len(key))
+			for name, m := range w.Members {
+				u.Bytes += cacheEntryOverhead + int64(len(name)+len(m.Name))
+				for _, s := range m.Sources {
+					u.Bytes += int64(len(s))
+				}
+			}
+		}
+	}
+	return u
+}
+
+func (d *coordinatedDetector) shed() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, r := range d.rules {
+		excess := len(r.groups) - shedCap(r.MaxGroups)
+		if excess <= 0 {
+			continue
+		}
+		seen := make(map[string]time.Time, len(r.groups))
+		for key, w := range r.groups {
+			seen[key] = w.LastSeen
+		}
+		for _, key := range oldestKeys(seen)[:excess] {
+			delete(r.groups, key)
+		}
+	}
+}
+
+func evictMember(members map[string]*windowMember) {
+	var oldest string
+	var seen time.Time
+	for name, m := range members {
+		if oldest == "" || m.LastSeen.Before(seen) {
+			oldest, seen = name, m.LastSeen
+		}
+	}
+	delete(members, oldest)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// save persists the windows of rules long enough to be worth keeping,
+// dropping groups that have gone quiet.
+func (d *coordinatedDetector) save() error {
+	if d == nil {
+		return nil
+	}
+	now := time.Now()
+	out := make(map[string]map[string]*accessWindow)
+	d.mu.Lock()
+	for _, r := range d.rules {
+		for key, w := range r.groups {
+			if now.Sub(w.LastSeen) > time.Duration(r.Window) {
+				delete(r.groups, key)
+				continue
+			}
+			if !r.persisted() {
+				continue
+			}
+			if out[r.Name] == nil {
+				out[r.Name] = make(map[string]*accessWindow)
+			}
+			cp := &accessWindow{Members: make(map[string]*windowMember, len(w.Members)), LastSeen: w.LastSeen, AlertedAt: w.AlertedAt}
+			for name, m := range w.Members {
+				cp.Members[name] = &windowMember{Name: m.Name, LastSeen: m.LastSeen, Sources: append([]string(nil), m.Sources...)}
+			}
+			out[r.Name][key] = cp
+		}
+	}
+	d.mu.Unlock()
+
+	return d.store.update(func(st *wardenState) { st.Coordinated = out })
+}
+
+func coordinatedJob(d *coordinatedDetector) jobSpec {
+	return jobSpec{
+		name:    "coordinated-access",
+		every:   time.Minute,
+		timeout: 10 * time.Second,
+		run:     func(ctx context.Context) error { return d.save() },
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// --- Alert Details On Demand ---
+
+const (
+	defaultDetailsExpiry = 24 * time.Hour
+	detailsButtonPrefix  = "details:"
+	// detailsExcerptMax is how much of the audit entry the details show,
+	// in bytes.
+	detailsExcerptMax = 1500
+	// discordEphemeral is the message flag for "only you can see this".
+	discordEphemeral = 64
+)
+
+// DetailsConfig posts critical alerts to Discord minimal, with a Details
+// button that brings up the full alert on demand: its session activity,
+// an excerpt of the audit entry and the topology snapshot. The details
+// come from history_file when the button is pressed, so they sit in
+// Discord only once someone asks. Without a bot, a link to DashboardURL
+// takes the button's place.
+type DetailsConfig struct {
+	Discord DiscordBotConfig `yaml:"discord"`
+	// Visibility is who sees the details: the channel (default) or,
+	// ephemeral, only whoever pressed the button.
+	Visibility string   `yaml:"visibility"`
+	Expiry     Duration `yaml:"expiry"` // how long the button works
+	// DashboardURL links to the alert elsewhere; {id} is replaced with
+	// the alert's ID.
+	DashboardURL string `yaml:"dashboard_url"`
+}
+
+func (d *DetailsConfig) enabled() bool { return d.bot() || d.DashboardURL != "" }
+
+func (d *DetailsConfig) bot() bool { return d.Discord.BotToken != "" }
+
+// onDemand reports whether a's details are held back for the asking: a
+// critical alert Discord may see in full.
+func (d *DetailsConfig) onDemand(a Alert) bool {
+	return d.enabled() && a.Severity >= sevCritical && !a.Minimal
+}
+
+var (
+	msgDetailsWithheld  = message("details.withheld")
+	msgDetailsButton    = message("details.button")
+	msgDetailsLink      = message("details.link")
+	msgDetailsRequested = message("details.requested")
+	msgDetailsExcerpt   = message("details.excerpt")
+	msgDetailsExpired   = message("details.expired")
+	msgDetailsMissing   = message("details.missing")
+	msgDetailsClosed    = message("details.closed")
+)
+
+// alertDetails is the config the details buttons are answered with, set
+// once audit mode starts the interactions endpoint.
+var alertDetails struct {
+	mu  sync.Mutex
+	cfg *VaultConfig
+}
+
+func startAlertDetails(cfg *VaultConfig) error {
+	alertDetails.mu.Lock()
+	alertDetails.cfg = cfg
+	alertDetails.mu.Unlock()
+	return startDiscordInteractions(cfg.Details.Discord)
+}
+
+// auditExcerpt is the start of an audit line, for the details.
+func auditExcerpt(line string) string {
+	if len(line) <= detailsExcerptMax {
+		return line
+	}
+	cut := detailsExcerptMax
+	for cut > 0 && !utf8.RuneStart(line[cut]) {
+		cut--
+	}
+	return line[:cut] + "…"
+}
+
+// detailsTeaser is a as posted with its details held back: minimal, with
+// the dashboard link if there is one.
+func detailsTeaser(cfg *VaultConfig, a Alert) Alert {
+	m := minimalAlert(a)
+	m.Description = a.label(msgDetailsWithheld)
+	if link := cfg.Details.DashboardURL; link != "" {
+		link = strings.ReplaceAll(link, "{id}", url.PathEscape(a.ID))
+		m.Description += "\n\n" + locales.catalog(a.Locale).render(msgDetailsLink.with("url", link))
+	}
+	return m
+}
+
+// teaseMessages replaces the embeds of alerts whose details are held back.
+// The alerts themselves stay whole, so history_file records them in full.
+func teaseMessages(cfg *VaultConfig, msgs []discordMessage) []discordMessage {
+	for _, m := range msgs {
+		for i, a := range m.alerts {
+			if cfg.Details.onDemand(a) {
+				m.embeds[i] = discordEmbed(detailsTeaser(cfg, a))
+			}
+		}
+	}
+	return msgs
+}
+
+// postWithDetails has the bot post a's teaser with the Details button,
+// recording the delivery as the webhook's would be.
+func postWithDetails(cfg *VaultConfig, a Alert) error {
+	d := cfg.Details
+	expires := time.Now().Add(time.Duration(d.Expiry)).Unix()
+	payload := map[string]interface{}{
+		"embeds":           []DiscordEmbed{discordEmbed(detailsTeaser(cfg, a))},
+		"allowed_mentions": DiscordAllowedMentions{Parse: []string{}},
+		"components": []interface{}{map[string]interface{}{"type": 1, "components": []interface{}{
+			map[string]interface{}{"type": 2, "style": 2, "label": a.label(msgDetailsButton),
+				"custom_id": detailsButtonPrefix + a.ID + ":" + strconv.FormatInt(expires, 10)},
+		}}},
+	}
+	data, _ := json.Marshal(payload)
+	start := time.Now()
+	_, err := discordAPI(cfg, d.Discord, "POST", "/channels/"+d.Discord.ChannelID+"/messages", payload)
+	recordDelivery("discord", start, err)
+	history.record("discord", a, data, err)
+	return err
+}
+
+// answerDetails takes a press of a Details button. The answer is deferred
+// and the details follow once looked up, as reading the history may take
+// longer than Discord waits for a response.
+func answerDetails(in *discordInteraction) interface{} {
+	alertDetails.mu.Lock()
+	cfg := alertDetails.cfg
+	alertDetails.mu.Unlock()
+	c := locales.catalog(locales.locale)
+	ephemeral := func(t localText) interface{} {
+		return map[string]interface{}{"type": 4, "data": map[string]interface{}{"content": c.render(t), "flags": discordEphemeral}}
+	}
+	if cfg == nil {
+		return ephemeral(msgDetailsClosed.with())
+	}
+	cfg = live(cfg)
+	id, expires := strings.TrimPrefix(in.Data.CustomID, detailsButtonPrefix), int64(0)
+	if i := strings.LastIndexByte(id, ':'); i >= 0 {
+		expires, _ = strconv.ParseInt(id[i+1:], 10, 64)
+		id = id[:i]
+	}
+	user := in.user()
+	if time.Now().Unix() > expires {
+		metrics.inc("alert_details_total", "outcome", "expired")
+		return ephemeral(msgDetailsExpired.with())
+	}
+	logInfo("🔎 Details of alert {id} requested by {user} ({user_id})", "id", id, "user", user.Username, "user_id", user.ID)
+	flags := 0
+	if cfg.Details.Visibility == "ephemeral" {
+		flags = discordEphemeral
+	}
+	go postDetails(cfg, in, id, user, flags)
+	return map[string]interface{}{"type": 5, "data": map[string]interface{}{"flags": flags}}
+}
+
+// postDetails sends the alert recorded under id as the follow-up to a
+// press: its full embed, then the audit entry excerpt.
+func postDetails(cfg *VaultConfig, in *discordInteraction, id string, user discordUser, flags int) {
+	a, err := findHistoryAlert(cfg.HistoryFile, id)
+	if err != nil {
+		logWarn("⚠️  Details of alert {id}: {error}", "id", id, "error", err)
+	}
+	c := locales.catalog(locales.locale)
+	payload := map[string]interface{}{"flags": flags, "allowed_mentions": DiscordAllowedMentions{Parse: []string{}}}
+	outcome := "shown"
+	if a == nil {
+		outcome = "missing"
+		payload["content"] = c.render(msgDetailsMissing.with("id", mdCode(id, maxNameLen)))
+	} else {
+		payload["content"] = c.render(msgDetailsRequested.with("user", "<@"+user.ID+">"))
+		a.Color = a.Severity.color() // not recorded
+		embeds := []DiscordEmbed{discordEmbed(*a)}
+		if a.Excerpt != "" {
+			embeds = append(embeds, DiscordEmbed{Title: a.label(msgDetailsExcerpt), Color: a.Color, Timestamp: a.Time.Format(time.RFC3339),
+				Description: "```json\n" + strings.ReplaceAll(a.Excerpt, "```", "'''") + "\n```"})
+		}
+		payload["embeds"] = embeds
+	}
+	metrics.inc("alert_details_total", "outcome", outcome)
+	if _, err := discordAPI(cfg, cfg.Details.Discord, "POST", "/webhooks/"+in.ApplicationID+"/"+in.Token, payload); err != nil {
+		logWarn("⚠️  Details of alert {id}: {error}", "id", id, "error", err)
+	}
+}
+
+// findHistoryAlert returns the alert last recorded under id, or nil.
+func findHistoryAlert(path, id string) (*Alert, error) {
+	if path == "" {
+		return nil, nil
+	}
+	var found *Alert
+	err := readHistory(path, func(_ int, rec *historyRecord) error {
+		if rec.Alert != nil && rec.Alert.ID == id {
+			found = rec.Alert
+		}
+		return nil
+	})
+	return found, err
+}
+
+func validateDetails(cfg *VaultConfig) error {
+	d := &cfg.Details
+	if !d.enabled() {
+		return nil
+	}
+	if n := notifierFor(cfg).kind(); n != "discord" {
+		return &fieldError{"details", fmt.Sprintf("needs the Discord notifier, not %s", n)}
+	}
+	switch d.Visibility {
+	case "":
+		d.Visibility = "channel"
+	case "channel", "ephemeral":
+	default:
+		return &fieldError{"details.visibility", fmt.Sprintf("unknown visibility %q; use channel or ephemeral", d.Visibility)}
+	}
+	if d.Expiry == 0 {
+		d.Expiry = Duration(defaultDetailsExpiry)
+	}
+	if d.Expiry < 0 {
+		return &fieldError{"details.expiry", "must be positive"}
+	}
+	if d.DashboardURL != "" {
+		if u, err := url.Parse(d.DashboardURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return &fieldError{"details.dashboard_url", "must be an http:// or https:// URL"}
+		}
+	}
+	if !d.bot() {
+		return nil
+	}
+	if cfg.HistoryFile == "" {
+		return &fieldError{"details.discord", "needs history_file, where the details are looked up"}
+	}
+	if err := validateDiscordBot("details.discord.", &d.Discord); err != nil {
+		return err
+	}
+	// One address answers one application: the approval bot's key would
+	// refuse this one's presses, or the other way round.
+	if ab := cfg.Approval.Discord.DiscordBotConfig; ab.Listen == d.Discord.Listen && ab.PublicKey != "" && !strings.EqualFold(ab.PublicKey, d.Discord.PublicKey) {
+		return &fieldError{"details.discord.listen", "is approval.discord.listen, with another public_key; give each application its own address"}
+	}
+	return nil
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// --- Command: Doctor ---
+
+// doctorFile is one file of the support bundle.
+type doctorFile struct {
+	name string
+	data []byte
+}
+
+// runDoctor collects diagnostics into a redacted tar.gz for support
+// requests. It runs with a broken config too, since that is often the
+// reason for asking.
+func runDoctor(doc *configDoc, loadErr error, args []string) error {
+	fs := flagSet("doctor")
+	host, _ := os.Hostname()
+	out := fs.String("o", fmt.Sprintf("vault-warden-doctor-%s-%s.tar.gz", host, time.Now().UTC().Format("20060102T150405Z")), "Output archive")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var cfg *VaultConfig
+	cfgErr := loadErr
+	if doc != nil {
+		cfg, cfgErr = doc.config()
+	}
+
+	files := []doctorFile{
+		{"build.txt", doctorBuild()},
+		{"config.yaml", doctorConfig(doc, cfgErr)},
+	}
+	if cfg != nil {
+		files = append(files,
+			doctorFile{"system.txt", doctorSystem(cfg)},
+			doctorFile{"connectivity.txt", doctorConnectivity(cfg)},
+			doctorFile{"seal-status.json", doctorSealStatus(cfg)},
+			doctorFile{"state.json", doctorReadFile(newStateStore(cfg.StateFile).path)},
+			doctorFile{"cluster-binding.txt", doctorBindings(cfg)},
+			doctorFile{"statusz.json", doctorStatusz(cfg)},
+			doctorFile{"keysources.txt", doctorKeySources(cfg)},
+			doctorFile{"safe-mode.txt", doctorSafeMode(cfg)},
+		)
+	}
+	files = append(files, doctorFile{"logs.txt", doctorLogs()})
+
+	secrets := doctorSecrets(doc, cfg)
+	for i := range files {
+		files[i].data = scrubSecrets(files[i].data, secrets)
+	}
+	if err := writeDoctorArchive(*out, files); err != nil {
+		return err
+	}
+	logInfo("✓ Wrote {path} ({files} files). Review it before attaching it to an issue.", "path", *out, "files", len(files))
+	return nil
+}
+
+func doctorBuild() []byte {
+	host, _ := os.Hostname()
+	return []byte(fmt.Sprintf("version: %s\ngo: %s\nos/arch: %s/%s\nhost: %s\ntime: %s\n",
+		version, runtime.Version(), runtime.GOOS, runtime.GOARCH, host, time.Now().UTC().Format(time.RFC3339)))
+}
+
+func doctorConfig(doc *configDoc, cfgErr error) []byte {
+	var b bytes.Buffer
+	if cfgErr != nil {
+		fmt.Fprintf(&b, "# config error: %v\n", cfgErr)
+	}
+	if doc == nil {
+		return b.Bytes()
+	}
+	// The effective form shows defaults, but only exists for a valid config.
+	out, err := renderConfig(doc, cfgErr == nil)
+	if err != nil {
+		fmt.Fprintf(&b, "# render config: %v\n", err)
+		return b.Bytes()
+	}
+	b.Write(out)
+	return b.Bytes()
+}
+
+// doctorSystem describes the OS and the filesystems holding the audit log
+// and the state file.
+func doctorSystem(cfg *VaultConfig) []byte {
+	var b bytes.Buffer
+	if data, err := os.ReadFile("/etc/os-release"); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.HasPrefix(line, "PRETTY_NAME=") {
+				fmt.Fprintf(&b, "os: %s\n", strings.Trim(strings.TrimPrefix(line, "PRETTY_NAME="), `"`))
+			}
+		}
+	}
+	if data, err := os.ReadFile("/proc/version"); err == nil {
+		fmt.Fprintf(&b, "kernel: %s", data)
+	}
+	type file struct{ label, path string }
+	var files []file
+	for _, path := range resolveAuditLogs(cfg.AuditLogs) {
+		files = append(files, file{"audit log", path})
+	}
+	files = append(files, file{"state file", newStateStore(cfg.StateFile).path}, file{"history file", cfg.HistoryFile})
+	for _, p := range files {
+		if p.path == "" {
+			continue
+		}
+		fmt.Fprintf(&b, "\n%s: %s\n", p.label, p.path)
+		fi, err := os.Stat(p.path)
+		if err != nil {
+			fmt.Fprintf(&b, "  stat: %v\n", err)
+			continue
+		}
+		fmt.Fprintf(&b, "  size: %s, mode: %s, modified: %s\n", formatBytes(fi.Size()), fi.Mode(), fi.ModTime().UTC().Format(time.RFC3339))
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			fmt.Fprintf(&b, "  owner: uid %d gid %d, inode %d\n", st.Uid, st.Gid, st.Ino)
+		}
+		var sfs syscall.Statfs_t
+		if err := syscall.Statfs(p.path, &sfs); err == nil {
+			fmt.Fprintf(&b, "  filesystem: type 0x%x, %s free of %s\n", sfs.Type,
+				formatBytes(int64(sfs.Bavail)*int64(sfs.Bsize)), formatBytes(int64(sfs.Blocks)*int64(sfs.Bsize)))
+		}
+	}
+	return b.Bytes()
+}
+
+// doctorKeySources fetches the unseal key shares from each source and
+// wipes them at once; only counts, timings and errors are written.
+func doctorKeySources(cfg *VaultConfig) []byte {
+	var b bytes.Buffer
+	for _, h := range probeKeySources(cfg) {
+		fmt.Fprintln(&b, h)
+	}
+	return b.Bytes()
+}
+
+// doctorConnectivity checks that every configured endpoint is reachable.
+// Notifiers are only dialled, never sent a message.
+func doctorConnectivity(cfg *VaultConfig) []byte {
+	var b bytes.Buffer
+	client, err := newVaultClient(cfg)
+	if err != nil {
+		fmt.Fprintf(&b, "vault %s: %v\n", cfg.Address, err)
+		client = &http.Client{Transport: newTransport(cfg)}
+	}
+	start := time.Now()
+	req, cancel, err := newOpRequest(cfg, opHealth, "GET", cfg.Address+"/v1/sys/health", nil)
+	if err != nil {
+		return []byte(err.Error() + "\n")
+	}
+	defer cancel()
+	if resp, err := client.Do(req); err != nil {
+		fmt.Fprintf(&b, "vault %s: %v\n", cfg.Address, err)
+	} else {
+		resp.Body.Close()
+		fmt.Fprintf(&b, "vault %s: HTTP %d in %s\n", cfg.Address, resp.StatusCode, time.Since(start).Round(time.Millisecond))
+	}
+
+	if cfg.Notifier == "email" {
+		fmt.Fprintf(&b, "email %s: %s\n", cfg.Email.addr(), dialURL("smtp://"+cfg.Email.addr()))
+	} else {
+		fmt.Fprintf(&b, "%s %s: %s\n", notifierFor(cfg).kind(), redactValue(cfg.WebhookURL), dialURL(cfg.WebhookURL))
+	}
+	if cfg.MQTT.Broker != "" {
+		fmt.Fprintf(&b, "mqtt %s: %s\n", cfg.MQTT.Broker, dialURL(cfg.MQTT.Broker))
+	}
+	return b.Bytes()
+}
+
+// dialURL opens (and for TLS schemes, handshakes) a connection to the
+// URL's host and reports the result.
+func dialURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return "invalid URL"
+	}
+	host, secure := u.Host, false
+	switch u.Scheme {
+	case "https", "ssl", "tls", "mqtts":
+		secure = true
+	}
+	if u.Port() == "" {
+		port := "80"
+		switch {
+		case secure && strings.HasPrefix(u.Scheme, "http"):
+			port = "443"
+		case secure:
+			port = "8883"
+		case u.Scheme == "tcp" || u.Scheme == "mqtt":
+			port = "1883"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	start := time.Now()
+	d := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	if secure {
+		conn, err = tls.DialWithDialer(d, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	} else {
+		conn, err = d.Dial("tcp", host)
+	}
+	if err != nil {
+		return err.Error()
+	}
+	conn.Close()
+	return fmt.Sprintf("connected in %s", time.Since(start).Round(time.Millisecond))
+}
+
+func doctorSealStatus(cfg *VaultConfig) []byte {
+	client, err := newVaultClient(cfg)
+	if err != nil {
+		return []byte(err.Error() + "\n")
+	}
+	req, cancel, err := newOpRequest(cfg, opHealth, "GET", cfg.Address+"/v1/sys/seal-status", nil)
+	if err != nil {
+		return []byte(err.Error() + "\n")
+	}
+	defer cancel()
+	resp, err := client.Do(req)
+	if err != nil {
+		return []byte(err.Error() + "\n")
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	return body
+}
+
+func doctorReadFile(path string) []byte {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return []byte(err.Error() + "\n")
+	}
+	return data
+}
+
+// doctorStatusz asks a running audit process for its status (tail
+// position, queue depths, jobs).
+func doctorStatusz(cfg *VaultConfig) []byte {
+	st, err := adminClient(cfg).Status(context.Background())
+	if err != nil {
+		return []byte(err.Error() + "\n")
+	}
+	return append(st.Raw, '\n')
+}
+
+// doctorLogs returns the last 50 lines of the audit service's journal.
+func doctorLogs() []byte {
+	out, err := exec.Command("journalctl", "-u", "vault-warden", "-n", "50", "--no-pager", "-o", "short-iso").CombinedOutput()
+	if err != nil {
+		return []byte(fmt.Sprintf("journalctl: %v\n%s", err, out))
+	}
+	return out
+}
+
+// doctorSecrets lists every secret value known from the config, so they
+// can be scrubbed from all bundle files and not just the config.
+func doctorSecrets(doc *configDoc, cfg *VaultConfig) []string {
+	var secrets []string
+	if doc != nil {
+		var walk func(n *yaml.Node, secret bool)
+		walk = func(n *yaml.Node, secret bool) {
+			if secret && n.Kind == yaml.ScalarNode && n.Tag == "!!str" {
+				secrets = append(secrets, n.Value)
+			}
+			for i := 0; i < len(n.Content); i++ {
+				if n.Kind == yaml.MappingNode && i+1 < len(n.Content) {
+					walk(n.Content[i+1], secret || isSecretField(n.Content[i].Value))
+					i++
+					continue
+				}
+				walk(n.Content[i], secret)
+			}
+		}
+		walk(doc.root, false)
+	}
+	if cfg != nil {
+		secrets = append(secrets, cfg.UnsealKeys...)
+		secrets = append(secrets, cfg.WebhookURL, cfg.MQTT.Password, cfg.PagerDuty.RoutingKey, cfg.Email.Password, cfg.Admin.Token, cfg.Canary.Token, cfg.SealToken)
+		for _, v := range cfg.Vaults {
+			secrets = append(secrets, v.SealToken)
+		}
+		headers := []map[string]string{cfg.Webhook.Headers}
+		for _, t := range cfg.Webhook.Failover {
+			secrets = append(secrets, t.URL)
+			headers = append(headers, t.Headers)
+		}
+		for _, h := range headers {
+			for _, v := range h {
+				secrets = append(secrets, v)
+				// The token of e.g. "Bearer <token>" on its own.
+				for _, f := range strings.Fields(v) {
+					if len(f) >= 16 {
+						secrets = append(secrets, f)
+					}
+				}
+			}
+		}
+		// The webhook token also appears on its own, e.g. in logged errors.
+		if u, err := url.Parse(cfg.WebhookURL); err == nil {
+			for _, seg := range strings.Split(u.Path, "/") {
+				if len(seg) >= 16 {
+					secrets = append(secrets, seg)
+				}
+			}
+			if u.RawQuery != "" {
+				secrets = append(secrets, u.RawQuery)
+			}
+		}
+	}
+	return secrets
+}
+
+// scrubSecrets replaces every occurrence of a secret, longest first so a
+// secret containing another is removed whole.
+func scrubSecrets(data []byte, secrets []string) []byte {
+	sorted := append([]string(nil), secrets...)
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+	for _, s := range sorted {
+		if len(s) < 4 {
+			continue // too short to scrub without mangling unrelated text
+		}
+		data = bytes.ReplaceAll(data, []byte(s), []byte("<redacted>"))
+	}
+	return data
+}
+
+func writeDoctorArchive(path string, files []doctorFile) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("create archive: %w", err)
+	}
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	for _, file := range files {
+		hdr := &tar.Header{Name: "vault-warden-doctor/" + file.name, Mode: 0o600, Size: int64(len(file.data)), ModTime: now}
+		if err := tw.WriteHeader(hdr); err != nil {
+			f.Close()
+			return fmt.Errorf("write archive: %w", err)
+		}
+		if _, err := tw.Write(file.data); err != nil {
+			f.Close()
+			return fmt.Errorf("write archive: %w", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		f.Close()
+		return fmt.Errorf("write archive: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		f.Close()
+		return fmt.Errorf("write archive: %w", err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// doctorSeeded are the secrets the doctor test plants in the config, and
+// in what Vault and the state file hand back.
+var doctorSeeded = map[string]string{
+	"unseal key":     "c2VlZGVkLXVuc2VhbC1rZXktc2hhcmUtb25l",
+	"canary token":   "hvs.seededCanaryToken0123",
+	"admin token":    "seeded-admin-token-0123456789",
+	"webhook token":  "seededWebhookTokenSegment9876",
+	"header token":   "seededBearerHeaderToken4567",
+	"failover url":   "https://dr.example/hooks/seededFailoverPath",
+	"mqtt password":  "seeded-mqtt-password",
+	"seal token":     "hvs.seededSealToken5555",
+	"custom secret":  "seeded-custom-secret-value",
+	"details secret": "seeded-details-api-key",
+}
+
+func doctorTestConfig(t *testing.T, vault, receiver, extra string) (*configDoc, string) {
+	t.Helper()
+	dir := t.TempDir()
+	state := filepath.Join(dir, "state.json")
+	leak := fmt.Sprintf(`{"note": "leaked %s and %s"}`, doctorSeeded["webhook token"], doctorSeeded["unseal key"])
+	if err := os.WriteFile(state, []byte(leak), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s := doctorSeeded
+	path := filepath.Join(dir, "config.yaml")
+	body := fmt.Sprintf(`
+address: %q
+seal_token: %q
+notifier: webhook
+webhook_url: "%s/hooks/123/%s"
+state_file: %q
+unseal_keys: [%q]
+canary:
+  token: %q
+admin:
+  listen: 127.0.0.1:1
+  token: %q
+mqtt:
+  broker: tcp://127.0.0.1:1
+  topic: vault/alerts
+  password: %q
+webhook:
+  headers:
+    Authorization: "Bearer %s"
+  failover:
+    - url: %q
+x_custom_secret: %q
+details:
+  api_key: %q
+%s`, vault, s["seal token"], receiver, s["webhook token"], state, s["unseal key"], s["canary token"], s["admin token"],
+		s["mqtt password"], s["header token"], s["failover url"], s["custom secret"], s["details secret"], extra)
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := loadConfig(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc, dir
+}
+
+// readDoctorArchive returns the archive's raw bytes, its uncompressed tar
+// stream and its files by name.
+func readDoctorArchive(t *testing.T, path string) ([]byte, []byte, map[string]string) {
+	t.Helper()
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	tr := tar.NewReader(bytes.NewReader(stream))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(tr)
+		files[strings.TrimPrefix(hdr.Name, "vault-warden-doctor/")] = string(data)
+	}
+	return raw, stream, files
+}
+
+func TestDoctorArchiveHasNoSecrets(t *testing.T) {
+	// Vault echoes the seal token back, as a misbehaving proxy might.
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"sealed": false, "type": "shamir", "debug": %q}`, r.Header.Get("X-Vault-Token")+" "+doctorSeeded["seal token"])
+	}))
+	defer vault.Close()
+	receiver := httptest.NewServer(http.NotFoundHandler())
+	defer receiver.Close()
+
+	doc, dir := doctorTestConfig(t, vault.URL, receiver.URL, "")
+	out := filepath.Join(dir, "bundle.tar.gz")
+	if err := runDoctor(doc, nil, []string{"-o", out}); err != nil {
+		t.Fatal(err)
+	}
+	raw, stream, files := readDoctorArchive(t, out)
+
+	for _, name := range []string{"build.txt", "config.yaml", "system.txt", "connectivity.txt", "seal-status.json", "state.json", "statusz.json", "keysources.txt", "logs.txt"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("archive lacks %s", name)
+		}
+	}
+	for what, secret := range doctorSeeded {
+		if bytes.Contains(raw, []byte(secret)) || bytes.Contains(stream, []byte(secret)) {
+			t.Errorf("the %s is in the archive", what)
+		}
+	}
+	// The webhook keeps its host, which is what support needs to see.
+	host := strings.TrimPrefix(receiver.URL, "http://")
+	if !strings.Contains(files["connectivity.txt"], host+"/<redacted>") {
+		t.Errorf("connectivity.txt doesn't name the webhook host:\n%s", files["connectivity.txt"])
+	}
+	if !strings.Contains(files["state.json"], "leaked <redacted> and <redacted>") {
+		t.Errorf("state.json = %s, want the leaked values scrubbed", files["state.json"])
+	}
+}
+
+// A config that doesn't validate is still scrubbed by its secret-looking
+// keys, since the bundle is most wanted when the config is broken.
+func TestDoctorArchiveInvalidConfig(t *testing.T) {
+	doc, dir := doctorTestConfig(t, "http://127.0.0.1:1", "http://127.0.0.1:1", "queue:\n  size: -5\n")
+	out := filepath.Join(dir, "bundle.tar.gz")
+	if err := runDoctor(doc, nil, []string{"-o", out}); err != nil {
+		t.Fatal(err)
+	}
+	raw, stream, files := readDoctorArchive(t, out)
+	if !strings.HasPrefix(files["config.yaml"], "# config error:") {
+		t.Errorf("config.yaml = %.200s, want the config error first", files["config.yaml"])
+	}
+	for what, secret := range doctorSeeded {
+		if bytes.Contains(raw, []byte(secret)) || bytes.Contains(stream, []byte(secret)) {
+			t.Errorf("the %s is in the archive", what)
+		}
+	}
+}
+
+func TestScrubSecretsLongestFirst(t *testing.T) {
+	got := scrubSecrets([]byte("url https://h/x/tok-12345 then tok-12345 and abc"), []string{"tok-12345", "https://h/x/tok-12345", "abc"})
+	if want := "url <redacted> then <redacted> and abc"; string(got) != want {
+		t.Errorf("scrubSecrets = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"html"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Email ---
+
+const defaultEmailSubjectPrefix = "[vault-warden]"
+
+// EmailConfig is the SMTP settings of notifier: email, which mails each
+// alert to the to addresses. webhook_url isn't used.
+type EmailConfig struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"` // default 587 with starttls, else 25
+	StartTLS bool   `yaml:"starttls"`
+	// Username and Password log in with PLAIN, which needs starttls.
+	Username      string   `yaml:"username"`
+	Password      string   `yaml:"password"`
+	From          string   `yaml:"from"`
+	To            []string `yaml:"to"`
+	SubjectPrefix string   `yaml:"subject_prefix"` // default [vault-warden]
+}
+
+func (c EmailConfig) addr() string {
+	return net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+}
+
+// emailNotifier mails one alert per message, as HTML with a plain text
+// alternative. It delivers over SMTP itself, bounded as a whole by
+// timeouts.notify, so a hung server fails the send instead of holding it.
+type emailNotifier struct {
+	conf EmailConfig
+}
+
+func (emailNotifier) kind() string { return "email" }
+
+func (n emailNotifier) send(cfg *VaultConfig, alerts []Alert) ([]Alert, error) {
+	return postMessages(cfg, n, singleMessages(alerts))
+}
+
+// accept is unused: deliver judges the SMTP replies.
+func (emailNotifier) accept(status int, body []byte) error { return nil }
+
+// encode builds the whole message, headers and both parts.
+func (n emailNotifier) encode(m discordMessage) ([]byte, error) {
+	a, e := m.alerts[0], m.embeds[0]
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, part := range []struct{ kind, text string }{
+		{"text/plain", emailText(a, e)},
+		{"text/html", emailHTML(a, e)},
+	} {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.kind + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.text)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	subject := strings.TrimSpace(n.conf.SubjectPrefix + " " + a.Title)
+	var msg bytes.Buffer
+	for _, h := range [][2]string{
+		{"From", n.conf.From},
+		{"To", strings.Join(n.conf.To, ", ")},
+		{"Subject", mime.QEncoding.Encode("utf-8", subject)},
+		{"Date", emailTime(a).Format(time.RFC1123Z)},
+		{"Message-ID", "<" + a.ID + "@vault-warden>"},
+		{"Auto-Submitted", "auto-generated"},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", `multipart/alternative; boundary="` + mw.Boundary() + `"`},
+	} {
+		fmt.Fprintf(&msg, "%s: %s\r\n", h[0], h[1])
+	}
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+// deliver sends one encoded message. The deadline covers the dial and
+// every command after it.
+func (n emailNotifier) deliver(cfg *VaultConfig, m discordMessage, data []byte) error {
+	if err := n.exchange(cfg.Timeouts.of(opNotify), data); err != nil {
+		logWarn("⚠️  Mailing via {address} failed: {error}", "address", n.conf.addr(), "error", err)
+		return fmt.Errorf("email: %w", err)
+	}
+	return nil
+}
+
+func (n emailNotifier) exchange(timeout time.Duration, data []byte) error {
+	conn, err := net.DialTimeout("tcp", n.conf.addr(), timeout)
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return err
+	}
+	c, err := smtp.NewClient(conn, n.conf.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if host, err := os.Hostname(); err == nil {
+		if err := c.Hello(host); err != nil {
+			return err
+		}
+	}
+	if n.conf.StartTLS {
+		if err := c.StartTLS(&tls.Config{ServerName: n.conf.Host, MinVersion: tls.VersionTLS12}); err != nil {
+			return fmt.Errorf("starttls: %w", err)
+		}
+	}
+	if n.conf.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", n.conf.Username, n.conf.Password, n.conf.Host)); err != nil {
+			return fmt.Errorf("auth: %w", err)
+		}
+	}
+	if err := c.Mail(emailAddress(n.conf.From)); err != nil {
+		return err
+	}
+	for _, to := range n.conf.To {
+		if err := c.Rcpt(emailAddress(to)); err != nil {
+			return fmt.Errorf("recipient %s: %w", to, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// emailAddress is the bare address of e.g. "Vault <vault@example.com>",
+// checked at load.
+func emailAddress(s string) string {
+	if a, err := mail.ParseAddress(s); err == nil {
+		return a.Address
+	}
+	return s
+}
+
+func emailTime(a Alert) time.Time {
+	if a.Time.IsZero() {
+		return time.Now()
+	}
+	return a.Time
+}
+
+// emailFields are the alert's details as label and value, like the
+// fields of its Discord embed but without markdown.
+func emailFields(a Alert) [][2]string {
+	var rows [][2]string
+	add := func(name, value string) {
+		if value != "" {
+			rows = append(rows, [2]string{name, cleanField(value, maxPathLen)})
+		}
+	}
+	add(a.label(msgFieldUser), identityLabel(&a))
+	add(a.label(msgFieldPath), a.Path)
+	add(a.label(msgFieldOperation), a.Operation)
+	add(a.label(msgFieldSourceIP), a.SourceIP)
+	add(a.label(msgFieldCluster), a.Cluster)
+	add(a.label(msgFieldSource), a.Source)
+	add(a.label(msgFieldAuditFile), a.AuditFile)
+	add(a.label(msgFieldAuditHost), a.AuditHost)
+	add(a.label(msgFieldSeverity), a.Severity.String())
+	add(a.label(msgFieldSensitivity), a.Sensitivity)
+	add(a.label(msgFieldRequestID), a.RequestID)
+	for _, k := range sortedKeys(a.Enrichment) {
+		add(k, a.Enrichment[k])
+	}
+	return rows
+}
+
+// emailFooter is the line with the rule, the sender and the time.
+func emailFooter(a Alert, e DiscordEmbed) string {
+	var parts []string
+	if e.Author != nil {
+		parts = append(parts, e.Author.Name)
+	}
+	if e.Footer != nil {
+		parts = append(parts, e.Footer.Text)
+	}
+	return strings.Join(append(parts, emailTime(a).UTC().Format(time.RFC3339)), " · ")
+}
+
+func emailText(a Alert, e DiscordEmbed) string {
+	var b strings.Builder
+	b.WriteString(e.Title + "\n\n")
+	if e.Description != "" {
+		b.WriteString(markdownText(e.Description) + "\n\n")
+	}
+	for _, r := range emailFields(a) {
+		fmt.Fprintf(&b, "%s: %s\n", r[0], r[1])
+	}
+	b.WriteString("\n-- \n" + emailFooter(a, e) + "\n")
+	return b.String()
+}
+
+func emailHTML(a Alert, e DiscordEmbed) string {
+	var b strings.Builder
+	b.WriteString(`<!DOCTYPE html><html><body style="font-family: sans-serif">` + "\n")
+	fmt.Fprintf(&b, `<h2 style="border-left: 6px solid #%06x; padding-left: 8px">%s</h2>`+"\n", a.Color, html.EscapeString(e.Title))
+	if e.Description != "" {
+		b.WriteString("<div>" + markdownHTML(e.Description) + "</div>\n")
+	}
+	if rows := emailFields(a); len(rows) > 0 {
+		b.WriteString(`<table style="border-collapse: collapse; margin-top: 12px">` + "\n")
+		for _, r := range rows {
+			fmt.Fprintf(&b, `<tr><th style="text-align: left; padding: 2px 12px 2px 0">%s</th><td style="font-family: monospace">%s</td></tr>`+"\n",
+				html.EscapeString(r[0]), html.EscapeString(r[1]))
+		}
+		b.WriteString("</table>\n")
+	}
+	fmt.Fprintf(&b, `<p style="color: #777; font-size: small">%s</p>`+"\n", html.EscapeString(emailFooter(a, e)))
+	b.WriteString("</body></html>\n")
+	return b.String()
+}
+
+// markdownText renders the markdown of alert descriptions as plain text,
+// dropping escapes and bold markers. Code blocks are kept as they are.
+func markdownText(md string) string {
+	var b strings.Builder
+	for i, part := range strings.Split(md, "```") {
+		if i%2 == 1 {
+			b.WriteString(strings.Trim(part, "\n") + "\n")
+			continue
+		}
+		for j := 0; j < len(part); j++ {
+			switch c := part[j]; {
+			case c == '\\' && j+1 < len(part) && strings.IndexByte(markdownChars, part[j+1]) >= 0:
+				j++
+				b.WriteByte(part[j])
+			case c == '*' && j+1 < len(part) && part[j+1] == '*':
+				j++
+			default:
+				b.WriteByte(c)
+			}
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// markdownHTML renders the same markdown as escaped HTML: code blocks as
+// <pre>, inline code as <code>, bold as <b> and line breaks as <br>.
+func markdownHTML(md string) string {
+	var b strings.Builder
+	for i, part := range strings.Split(md, "```") {
+		if i%2 == 1 {
+			b.WriteString("<pre>" + html.EscapeString(strings.Trim(part, "\n")) + "</pre>")
+			continue
+		}
+		bold, code := false, false
+		for j := 0; j < len(part); j++ {
+			switch c := part[j]; {
+			case c == '`' && code:
+				b.WriteString("</code>")
+				code = false
+			case c == '`':
+				b.WriteString("<code>")
+				code = true
+			case code:
+				b.WriteString(html.EscapeString(string(c)))
+			case c == '\\' && j+1 < len(part) && strings.IndexByte(markdownChars, part[j+1]) >= 0:
+				j++
+				b.WriteString(html.EscapeString(string(part[j])))
+			case c == '*' && j+1 < len(part) && part[j+1] == '*' && bold:
+				j++
+				b.WriteString("</b>")
+				bold = false
+			case c == '*' && j+1 < len(part) && part[j+1] == '*':
+				j++
+				b.WriteString("<b>")
+				bold = true
+			case c == '\n':
+				b.WriteString("<br>\n")
+			default:
+				b.WriteString(html.EscapeString(string(c)))
+			}
+		}
+		if code {
+			b.WriteString("</code>")
+		}
+		if bold {
+			b.WriteString("</b>")
+		}
+	}
+	return b.String()
+}
+
+// validateEmail checks email and fills in its defaults.
+func validateEmail(cfg *VaultConfig) error {
+	e := &cfg.Email
+	if e.Host == "" {
+		return &fieldError{"email.host", "is required"}
+	}
+	if e.Port == 0 {
+		e.Port = 25
+		if e.StartTLS {
+			e.Port = 587
+		}
+	}
+	if e.Port < 1 || e.Port > 65535 {
+		return &fieldError{"email.port", "must be 1 to 65535"}
+	}
+	if e.Username != "" && !e.StartTLS {
+		return &fieldError{"email.username", "needs starttls; credentials are never sent in the clear"}
+	}
+	if e.Username != "" && e.Password == "" {
+		return &fieldError{"email.password", "is required with username"}
+	}
+	if _, err := mail.ParseAddress(e.From); err != nil {
+		return &fieldError{"email.from", "is not an address: " + err.Error()}
+	}
+	if len(e.To) == 0 {
+		return &fieldError{"email.to", "is required"}
+	}
+	for i, to := range e.To {
+		if _, err := mail.ParseAddress(to); err != nil {
+			return &fieldError{fmt.Sprintf("email.to[%d]", i), "is not an address: " + err.Error()}
+		}
+	}
+	if e.SubjectPrefix == "" {
+		e.SubjectPrefix = defaultEmailSubjectPrefix
+	}
+	if strings.ContainsAny(e.SubjectPrefix, "\n") {
+		return &fieldError{"email.subject_prefix", "must be a single line"}
+	}
+	return nil
+}
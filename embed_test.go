@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var embedTime = time.Date(2026, 10, 14, 8, 30, 0, 0, time.UTC)
+
+func goldenEntry(path, op string) *enrichedEntry {
+	en := &enrichedEntry{}
+	en.Time = "2026-10-14T08:30:00Z"
+	en.Request.ID, en.Request.Path, en.Request.Operation = "7f3c2a1e-0b9d-4e8f-a6c5-d4b3a2f1e0c9", path, op
+	en.Request.RemoteAddress = "10.0.4.17:52144"
+	en.Auth.DisplayName = "userpass-alice"
+	return en
+}
+
+func ruleAlert(t *testing.T, en *enrichedEntry) Alert {
+	rules := compileAlertRules([]AlertRule{{Name: "root-policy", Severity: "critical", Title: "🚨 Root policy changed",
+		Paths: []string{"sys/policies/acl/"}, Message: "{{md .User}} wrote {{md .Path}}."}})
+	a, ok := rules[0].alert(en, nil, ruleScope{})
+	if !ok {
+		t.Fatal("rule held the alert back")
+	}
+	en.annotate(&a)
+	a.Cluster = "prod-eu"
+	return a
+}
+
+func unsealAlert() Alert {
+	return Alert{Severity: sevInfo, Color: 0x2ecc71, Rule: "unseal", Cluster: "prod-eu"}.say(msgUnsealed.with(), msgUnsealedBody.with("approval", ""))
+}
+
+// TestDiscordPayloadGolden locks down the webhook payload for each kind of
+// alert. The footer's host name is the machine's, so it is normalized.
+func TestDiscordPayloadGolden(t *testing.T) {
+	long := "secret/data/" + strings.Repeat("team-platform/", 90) + "db-creds"
+	tests := map[string]func() []Alert{
+		"rule.golden.json": func() []Alert {
+			return []Alert{ruleAlert(t, goldenEntry("sys/policies/acl/root", "update"))}
+		},
+		"rule-enriched.golden.json": func() []Alert {
+			en := goldenEntry("sys/policies/acl/admins", "update")
+			en.Auth.EntityID = "b1c2d3e4-entity"
+			en.Fields = map[string]string{"owner": "platform-team", "network": "office-vpn"}
+			a := ruleAlert(t, en)
+			a.Sensitivity, a.AuditFile, a.AuditHost = "critical", "/var/log/vault/audit.log", "vault-2"
+			return []Alert{a}
+		},
+		"rule-long-path.golden.json": func() []Alert {
+			return []Alert{ruleAlert(t, goldenEntry(long, "read"))}
+		},
+		"unseal.golden.json": func() []Alert {
+			return []Alert{unsealAlert()}
+		},
+		"minimal.golden.json": func() []Alert {
+			a := ruleAlert(t, goldenEntry("sys/policies/acl/root", "update"))
+			a.Minimal = true
+			return []Alert{a}
+		},
+		"coalesced.golden.json": func() []Alert {
+			return []Alert{unsealAlert(), ruleAlert(t, goldenEntry("sys/policies/acl/root", "delete"))}
+		},
+	}
+	for name, build := range tests {
+		t.Run(name, func(t *testing.T) {
+			alerts := build()
+			for i := range alerts {
+				alerts[i].Time = embedTime
+			}
+			msgs := packAlerts(alerts)
+			if len(msgs) != 1 {
+				t.Fatalf("%d messages, want 1", len(msgs))
+			}
+			data, err := discordNotifier{}.encode(msgs[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			data = bytes.ReplaceAll(data, []byte(wardenSignature()), []byte("vault-warden VERSION on HOST"))
+			var pretty bytes.Buffer
+			if err := json.Indent(&pretty, data, "", "  "); err != nil {
+				t.Fatal(err)
+			}
+			pretty.WriteByte('\n')
+			checkGolden(t, filepath.Join("discord", name), pretty.String())
+		})
+	}
+}
+
+// Every field value fits Discord's limits, so a payload is never refused
+// for its shape.
+func TestDiscordEmbedLimits(t *testing.T) {
+	en := goldenEntry("secret/"+strings.Repeat("x", 5000), strings.Repeat("read", 100))
+	en.Auth.DisplayName = strings.Repeat("n", 2000)
+	a := ruleAlert(t, en)
+	e := discordEmbed(a)
+	for _, f := range e.Fields {
+		if n := len([]rune(f.Value)); n > discordFieldMax {
+			t.Errorf("field %s is %d runes, over %d", f.Name, n, discordFieldMax)
+		}
+	}
+	if embedChars(e) > discordMaxChars {
+		t.Errorf("embed is %d characters, over %d", embedChars(e), discordMaxChars)
+	}
+}
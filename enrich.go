@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --- Enrichment Pipeline ---
+
+const defaultEnricherTimeout = time.Second
+
+// What happens to an entry when one of its enrichers fails or times out.
+const (
+	enrichSkip     = "skip"     // go on without that enricher's result
+	enrichAnnotate = "annotate" // the same, noting the failure in the alerts' enrichment
+	enrichDrop     = "drop"     // evaluate no rules for the entry
+)
+
+// defaultEnrichers is the pipeline when enrichment.pipeline is unset.
+var defaultEnrichers = []string{"identity", "session", "owner", "network"}
+
+// EnrichmentConfig orders the steps that add context to each audit entry
+// before the rules see it.
+type EnrichmentConfig struct {
+	Pipeline []EnricherConfig `yaml:"pipeline"`
+	// Owners maps path prefixes to who owns the secrets below them.
+	Owners map[string]string `yaml:"owners"`
+	// Networks maps CIDR ranges to a label, e.g. a site or region.
+	Networks map[string]string `yaml:"networks"`
+}
+
+type EnricherConfig struct {
+	Name      string   `yaml:"name"`
+	Timeout   Duration `yaml:"timeout"`    // default 1s
+	OnFailure string   `yaml:"on_failure"` // skip (default), annotate or drop
+}
+
+// enrichedEntry is an audit entry and what the pipeline found out about
+// it. Fields end up in the enrichment of the entry's alerts.
+type enrichedEntry struct {
+	AuditEntry
+	Entity  *entityInfo
+	Session []sessionAction
+	Fields  map[string]string
+}
+
+// clone copies what an enricher may change, so one that times out can't
+// touch the entry the rules go on to read.
+func (e *enrichedEntry) clone() *enrichedEntry {
+	c := *e
+	c.Fields = make(map[string]string, len(e.Fields))
+	for k, v := range e.Fields {
+		c.Fields[k] = v
+	}
+	return &c
+}
+
+// annotate copies the entry's identity and fields onto one of its alerts.
+func (e *enrichedEntry) annotate(a *Alert) {
+	annotateIdentity(a, &e.AuditEntry, e.Entity)
+	if len(e.Fields) == 0 {
+		return
+	}
+	if a.Enrichment == nil {
+		a.Enrichment = make(map[string]string, len(e.Fields))
+	}
+	for k, v := range e.Fields {
+		a.Enrichment[k] = v
+	}
+}
+
+// enricher adds one kind of context to an entry. enrich must give up when
+// ctx is done; the pipeline stops waiting for it then anyway.
+type enricher interface {
+	name() string
+	enrich(ctx context.Context, e *enrichedEntry) error
+}
+
+type enrichStage struct {
+	enricher
+	timeout   time.Duration
+	onFailure string
+}
+
+// enrichPipeline runs the enrichers in order. A nil *enrichPipeline
+// passes entries through as they are.
+type enrichPipeline struct {
+	stages []enrichStage
+}
+
+var errEnrichTimeout = errors.New("timed out")
+
+func newEnrichPipeline(cfg *VaultConfig, ids *identityCache, sessions *sessionIndex) *enrichPipeline {
+	ec := cfg.Enrichment
+	steps := ec.Pipeline
+	if len(steps) == 0 {
+		for _, name := range defaultEnrichers {
+			steps = append(steps, EnricherConfig{Name: name})
+		}
+	}
+	p := &enrichPipeline{}
+	for _, s := range steps {
+		var en enricher
+		switch s.Name {
+		case "identity":
+			if ids == nil {
+				continue
+			}
+			en = identityEnricher{ids}
+		case "session":
+			if sessions == nil {
+				continue
+			}
+			en = sessionEnricher{sessions, cfg.SessionIndex.Attach}
+		case "owner":
+			if len(ec.Owners) == 0 {
+				continue
+			}
+			en = newOwnerEnricher(ec.Owners)
+		case "network":
+			if len(ec.Networks) == 0 {
+				continue
+			}
+			en = newNetworkEnricher(ec.Networks) // checked at load
+		}
+		st := enrichStage{enricher: en, timeout: time.Duration(s.Timeout), onFailure: s.OnFailure}
+		if st.timeout == 0 {
+			st.timeout = defaultEnricherTimeout
+		}
+		if st.onFailure == "" {
+			st.onFailure = enrichSkip
+		}
+		p.stages = append(p.stages, st)
+	}
+	return p
+}
+
+// run enriches entry, and returns false if an enricher whose failures
+// drop the entry failed. Each enricher works on a copy of the entry that
+// is kept only if it finishes in time.
+func (p *enrichPipeline) run(entry AuditEntry) (*enrichedEntry, bool) {
+	e := &enrichedEntry{AuditEntry: entry}
+	if p == nil {
+		return e, true
+	}
+	for _, st := range p.stages {
+		next, err := st.run(e)
+		if err == nil {
+			e = next
+			continue
+		}
+		reason := "error"
+		if errors.Is(err, errEnrichTimeout) {
+			reason = "timeout"
+		}
+		metrics.inc("enricher_failures_total", "enricher", st.name(), "reason", reason)
+		switch st.onFailure {
+		case enrichDrop:
+			metrics.inc("enrichment_drops_total", "enricher", st.name())
+			logWarn("⚠️  Enrichment: {enricher} failed ({error}), dropping the entry", "enricher", st.name(), "error", err, "request_id", entry.Request.ID)
+			return e, false
+		case enrichAnnotate:
+			e = e.clone()
+			e.Fields[st.name()+"_error"] = reason
+		}
+	}
+	return e, true
+}
+
+func (st enrichStage) run(e *enrichedEntry) (*enrichedEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), st.timeout)
+	defer cancel()
+	next := e.clone()
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				done <- fmt.Errorf("panic: %v", p)
+			}
+		}()
+		done <- st.enrich(ctx, next)
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = errEnrichTimeout
+	}
+	metrics.observe("enricher_seconds", time.Since(start).Seconds(), "enricher", st.name())
+	return next, err
+}
+
+// identityEnricher resolves the entry's entity through the identity cache.
+type identityEnricher struct{ c *identityCache }
+
+func (identityEnricher) name() string { return "identity" }
+
+func (en identityEnricher) enrich(ctx context.Context, e *enrichedEntry) error {
+	if e.Auth.EntityID == "" {
+		return nil
+	}
+	ei, err := en.c.lookup(ctx, e.Auth.EntityID)
+	e.Entity = ei
+	return err
+}
+
+// sessionEnricher attaches the accessor's recent actions.
+type sessionEnricher struct {
+	s *sessionIndex
+	k int
+}
+
+func (sessionEnricher) name() string { return "session" }
+
+func (en sessionEnricher) enrich(ctx context.Context, e *enrichedEntry) error {
+	e.Session = en.s.recent(e.Auth.Accessor, en.k)
+	return nil
+}
+
+// ownerEnricher labels an entry with the owner of the longest prefix of
+// its path, as "owner".
+type ownerEnricher struct {
+	prefixes []pathOwner // longest first
+}
+
+type pathOwner struct {
+	prefix, owner string
+}
+
+func newOwnerEnricher(owners map[string]string) ownerEnricher {
+	var en ownerEnricher
+	for p, o := range owners {
+		en.prefixes = append(en.prefixes, pathOwner{strings.TrimLeft(p, "/"), o})
+	}
+	sort.Slice(en.prefixes, func(i, j int) bool {
+		a, b := en.prefixes[i].prefix, en.prefixes[j].prefix
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		return a < b
+	})
+	return en
+}
+
+func (ownerEnricher) name() string { return "owner" }
+
+func (en ownerEnricher) enrich(ctx context.Context, e *enrichedEntry) error {
+	for _, p := range en.prefixes {
+		if strings.HasPrefix(e.Request.Path, p.prefix) {
+			e.Fields["owner"] = p.owner
+			return nil
+		}
+	}
+	return nil
+}
+
+// networkEnricher labels an entry with the narrowest configured range its
+// remote address is in, as "network".
+type networkEnricher struct {
+	nets []labelledNet // narrowest first
+}
+
+type labelledNet struct {
+	net   *net.IPNet
+	label string
+}
+
+func newNetworkEnricher(networks map[string]string) networkEnricher {
+	var en networkEnricher
+	for cidr, label := range networks {
+		if _, n, err := net.ParseCIDR(cidr); err == nil {
+			en.nets = append(en.nets, labelledNet{n, label})
+		}
+	}
+	sort.Slice(en.nets, func(i, j int) bool {
+		a, _ := en.nets[i].net.Mask.Size()
+		b, _ := en.nets[j].net.Mask.Size()
+		if a != b {
+			return a > b
+		}
+		return en.nets[i].net.String() < en.nets[j].net.String()
+	})
+	return en
+}
+
+func (networkEnricher) name() string { return "network" }
+
+func (en networkEnricher) enrich(ctx context.Context, e *enrichedEntry) error {
+	ip := net.ParseIP(hostOnly(e.Request.RemoteAddress))
+	if ip == nil {
+		return nil
+	}
+	for _, n := range en.nets {
+		if n.net.Contains(ip) {
+			e.Fields["network"] = n.label
+			return nil
+		}
+	}
+	return nil
+}
+
+// validateEnrichment checks the pipeline and the owner and network tables.
+func validateEnrichment(cfg *VaultConfig) error {
+	ec := &cfg.Enrichment
+	seen := make(map[string]bool)
+	for i, s := range ec.Pipeline {
+		f := fmt.Sprintf("enrichment.pipeline[%d]", i)
+		if !containsString(defaultEnrichers, s.Name) {
+			return &fieldError{f + ".name", "must be one of " + strings.Join(defaultEnrichers, ", ")}
+		}
+		if seen[s.Name] {
+			return &fieldError{f + ".name", s.Name + " is listed twice"}
+		}
+		seen[s.Name] = true
+		if s.Timeout < 0 {
+			return &fieldError{f + ".timeout", "must be positive"}
+		}
+		switch s.OnFailure {
+		case "", enrichSkip, enrichAnnotate, enrichDrop:
+		default:
+			return &fieldError{f + ".on_failure", "must be skip, annotate or drop"}
+		}
+	}
+	for p, o := range ec.Owners {
+		if strings.TrimLeft(p, "/") == "" {
+			return &fieldError{"enrichment.owners", "has an empty prefix"}
+		}
+		if o == "" {
+			return &fieldError{"enrichment.owners." + p, "must name an owner"}
+		}
+	}
+	for cidr := range ec.Networks {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return &fieldError{"enrichment.networks." + cidr, "is not a CIDR range"}
+		}
+	}
+	return nil
+}
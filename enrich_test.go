@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// enrichTestVault answers entity lookups for e-1 and 404 to the rest.
+func enrichTestVault(t *testing.T) *identityCache {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/identity/entity/id/e-1" {
+			http.Error(w, `{"errors":[]}`, http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, `{"data":{"name":"alice","aliases":[{"name":"alice","mount_path":"auth/oidc/","mount_type":"oidc"}]}}`)
+	}))
+	t.Cleanup(srv.Close)
+	return &identityCache{cfg: IdentityConfig{Token: "t", MaxEntities: 10}, address: srv.URL, client: srv.Client(),
+		timeout: 5 * time.Second, entities: make(map[string]*entityInfo), misses: make(map[string]time.Time)}
+}
+
+func enrichTestConfig() *VaultConfig {
+	cfg := &VaultConfig{}
+	cfg.SessionIndex = SessionIndexConfig{Enabled: true, EntriesPerAccessor: 5, MaxAccessors: 10, Attach: 3}
+	cfg.Enrichment.Owners = map[string]string{"secret/": "platform", "secret/data/app": "app-team", "/sys/": "security"}
+	cfg.Enrichment.Networks = map[string]string{"10.0.0.0/8": "dc", "10.0.0.0/28": "dc-rack-1", "192.168.0.0/16": "office"}
+	return cfg
+}
+
+// enrichCorpus runs the default pipeline over the audit corpus, recording
+// sessions the way the auditor does, and renders what each entry got.
+func enrichCorpus(t *testing.T) string {
+	cfg := enrichTestConfig()
+	sessions := newSessionIndex(cfg.SessionIndex)
+	p := newEnrichPipeline(cfg, enrichTestVault(t), sessions)
+	var out strings.Builder
+	for _, line := range auditCorpus(t) {
+		entry, err := decodeAuditEntry(line)
+		if err != nil {
+			continue
+		}
+		en, ok := p.run(entry)
+		if !ok {
+			t.Fatalf("%s dropped under skip policies", entry.Request.ID)
+		}
+		fmt.Fprintf(&out, "%s %s %s", entry.Request.ID, entry.Type, entry.Request.Path)
+		if en.Entity != nil {
+			fmt.Fprintf(&out, " entity=%s", en.Entity.Name)
+		}
+		if len(en.Session) > 0 {
+			var paths []string
+			for _, a := range en.Session {
+				paths = append(paths, a.Operation+":"+a.Path)
+			}
+			fmt.Fprintf(&out, " session=%s", strings.Join(paths, ","))
+		}
+		var keys []string
+		for k := range en.Fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(&out, " %s=%s", k, en.Fields[k])
+		}
+		out.WriteString("\n")
+		if entry.Type != "request" {
+			sessions.record(entry.Auth.Accessor, sessionAction{Path: entry.Request.Path, Operation: entry.Request.Operation,
+				Time: entryTime(entry.Time), Error: entry.Error})
+		}
+	}
+	return out.String()
+}
+
+// The full pipeline over the corpus enriches every entry the same way,
+// run after run.
+func TestEnrichCorpus(t *testing.T) {
+	got := enrichCorpus(t)
+	checkGolden(t, "enrich/corpus.golden", got)
+	for i := 0; i < 3; i++ {
+		if again := enrichCorpus(t); again != got {
+			t.Fatalf("run %d differs:\n%s\nfirst:\n%s", i+2, again, got)
+		}
+	}
+}
+
+// stubEnricher is an enricher that does whatever fn does.
+type stubEnricher struct {
+	n  string
+	fn func(ctx context.Context, e *enrichedEntry) error
+}
+
+func (s stubEnricher) name() string { return s.n }
+
+func (s stubEnricher) enrich(ctx context.Context, e *enrichedEntry) error { return s.fn(ctx, e) }
+
+func setField(k, v string) stubEnricher {
+	return stubEnricher{k, func(ctx context.Context, e *enrichedEntry) error {
+		e.Fields[k] = v
+		return nil
+	}}
+}
+
+// stall is an enricher that ignores its context and blocks until the test
+// ends, then writes to the entry it was given.
+func stall(t *testing.T, name string) stubEnricher {
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	return stubEnricher{name, func(ctx context.Context, e *enrichedEntry) error {
+		<-release
+		e.Fields["late"] = "yes"
+		return nil
+	}}
+}
+
+func stages(onFailure string, ens ...enricher) *enrichPipeline {
+	p := &enrichPipeline{}
+	for _, en := range ens {
+		p.stages = append(p.stages, enrichStage{enricher: en, timeout: 50 * time.Millisecond, onFailure: onFailure})
+	}
+	return p
+}
+
+var enrichEntry = func() AuditEntry {
+	var e AuditEntry
+	e.Type, e.Request.ID, e.Request.Path = "response", "r-1", "secret/data/app"
+	return e
+}()
+
+// A stalled enricher holds an entry up for its timeout and no longer, under
+// every policy, and what it does after can't reach the entry.
+func TestEnrichTimeoutPolicies(t *testing.T) {
+	tests := []struct {
+		policy string
+		ok     bool
+		fields string
+	}{
+		{enrichSkip, true, "after=ran before=ran"},
+		{enrichAnnotate, true, "after=ran before=ran stalled_error=timeout"},
+		{enrichDrop, false, "before=ran"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			p := stages(tt.policy, setField("before", "ran"), stall(t, "stalled"), setField("after", "ran"))
+			timeouts := metrics.sum("enricher_failures_total")
+			drops := metrics.sum("enrichment_drops_total")
+			start := time.Now()
+			en, ok := p.run(enrichEntry)
+			if took := time.Since(start); took > time.Second {
+				t.Errorf("run took %s with a 50ms timeout", took)
+			}
+			if ok != tt.ok {
+				t.Errorf("ok = %v, want %v", ok, tt.ok)
+			}
+			if got := fieldList(en); got != tt.fields {
+				t.Errorf("fields = %q, want %q", got, tt.fields)
+			}
+			if d := metrics.sum("enricher_failures_total") - timeouts; d != 1 {
+				t.Errorf("enricher_failures_total grew by %v, want 1", d)
+			}
+			wantDrops := 0.0
+			if tt.policy == enrichDrop {
+				wantDrops = 1
+			}
+			if d := metrics.sum("enrichment_drops_total") - drops; d != wantDrops {
+				t.Errorf("enrichment_drops_total grew by %v, want %v", d, wantDrops)
+			}
+		})
+	}
+}
+
+func fieldList(en *enrichedEntry) string {
+	var fields []string
+	for k, v := range en.Fields {
+		fields = append(fields, k+"="+v)
+	}
+	sort.Strings(fields)
+	return strings.Join(fields, " ")
+}
+
+// A failing enricher's partial changes are thrown away with its result;
+// a panicking one fails like an error and the next still runs.
+func TestEnrichFailures(t *testing.T) {
+	failing := stubEnricher{"failing", func(ctx context.Context, e *enrichedEntry) error {
+		e.Fields["partial"] = "yes"
+		return errors.New("lookup failed")
+	}}
+	panicking := stubEnricher{"panicking", func(ctx context.Context, e *enrichedEntry) error {
+		var m map[string]string
+		m["x"] = "y"
+		return nil
+	}}
+	en, ok := stages(enrichAnnotate, failing, panicking, setField("after", "ran")).run(enrichEntry)
+	if !ok {
+		t.Fatal("dropped under annotate")
+	}
+	if got, want := fieldList(en), "after=ran failing_error=error panicking_error=error"; got != want {
+		t.Errorf("fields = %q, want %q", got, want)
+	}
+	if en.Request.Path != enrichEntry.Request.Path {
+		t.Errorf("path = %q, want the entry's", en.Request.Path)
+	}
+}
+
+// Each enricher's latency is observed, success or not.
+func TestEnrichLatencyMetric(t *testing.T) {
+	before := metrics.sum("enricher_seconds")
+	p := stages(enrichSkip, stubEnricher{"sleepy", func(ctx context.Context, e *enrichedEntry) error {
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	}}, stall(t, "stuck"))
+	p.run(enrichEntry)
+	if d := metrics.sum("enricher_seconds") - before; d < 0.07 || d > 1 {
+		t.Errorf("enricher_seconds grew by %v, want the sleep plus the timeout", d)
+	}
+}
+
+// Enrichers without what they need drop out of the pipeline, and a nil
+// pipeline passes entries through.
+func TestEnrichPipelineStages(t *testing.T) {
+	names := func(p *enrichPipeline) string {
+		var n []string
+		for _, st := range p.stages {
+			n = append(n, fmt.Sprintf("%s/%s/%s", st.name(), st.timeout, st.onFailure))
+		}
+		return strings.Join(n, " ")
+	}
+	if p := newEnrichPipeline(&VaultConfig{}, nil, nil); len(p.stages) != 0 {
+		t.Errorf("stages = %s with nothing configured, want none", names(p))
+	}
+	cfg := enrichTestConfig()
+	cfg.Enrichment.Pipeline = []EnricherConfig{{Name: "network", Timeout: Duration(10 * time.Millisecond), OnFailure: enrichDrop},
+		{Name: "identity"}, {Name: "owner", OnFailure: enrichAnnotate}}
+	if got, want := names(newEnrichPipeline(cfg, nil, newSessionIndex(cfg.SessionIndex))), "network/10ms/drop owner/1s/annotate"; got != want {
+		t.Errorf("stages = %s, want %s", got, want)
+	}
+	en, ok := (*enrichPipeline)(nil).run(enrichEntry)
+	if !ok || en.Request.ID != "r-1" || len(en.Fields) != 0 {
+		t.Errorf("nil pipeline = %+v, %v; want the entry as it was", en, ok)
+	}
+}
+
+func TestValidateEnrichment(t *testing.T) {
+	tests := []struct {
+		ec   EnrichmentConfig
+		want string
+	}{
+		{EnrichmentConfig{}, ""},
+		{EnrichmentConfig{Pipeline: []EnricherConfig{{Name: "owner"}, {Name: "network", OnFailure: enrichDrop}}}, ""},
+		{EnrichmentConfig{Pipeline: []EnricherConfig{{Name: "geoip"}}}, "enrichment.pipeline[0].name must be one of identity, session, owner, network"},
+		{EnrichmentConfig{Pipeline: []EnricherConfig{{Name: "owner"}, {Name: "owner"}}}, "enrichment.pipeline[1].name owner is listed twice"},
+		{EnrichmentConfig{Pipeline: []EnricherConfig{{Name: "owner", Timeout: -1}}}, "enrichment.pipeline[0].timeout must be positive"},
+		{EnrichmentConfig{Pipeline: []EnricherConfig{{Name: "owner", OnFailure: "retry"}}}, "enrichment.pipeline[0].on_failure must be skip, annotate or drop"},
+		{EnrichmentConfig{Owners: map[string]string{"/": "root"}}, "enrichment.owners has an empty prefix"},
+		{EnrichmentConfig{Owners: map[string]string{"secret/": ""}}, "enrichment.owners.secret/ must name an owner"},
+		{EnrichmentConfig{Networks: map[string]string{"10.0.0.1": "host"}}, "enrichment.networks.10.0.0.1 is not a CIDR range"},
+	}
+	for _, tt := range tests {
+		if got := errString(validateEnrichment(&VaultConfig{Enrichment: tt.ec})); got != tt.want {
+			t.Errorf("validateEnrichment(%+v) = %q, want %q", tt.ec, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Command plugin is an example vault-warden detector plugin: it alerts
+// when a request path matches a pattern. See "Detector Plugins" in the
+// README for the protocol.
+//
+//	go build -o /usr/local/libexec/vault-warden-path-plugin ./examples/plugin
+//
+//	allow_exec_plugins: true
+//	plugins:
+//	  - name: break-glass
+//	    command: ["/usr/local/libexec/vault-warden-path-plugin", "-path", "^secret/data/break-glass/"]
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+)
+
+const protocol = 1
+
+// message is the subset of the protocol this plugin uses.
+type message struct {
+	Type     string          `json:"type"`
+	Protocol int             `json:"protocol,omitempty"`
+	Name     string          `json:"name,omitempty"`
+	Seq      int64           `json:"seq,omitempty"`
+	Entry    json.RawMessage `json:"entry,omitempty"`
+	Alert    *alert          `json:"alert,omitempty"`
+}
+
+type alert struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Severity    string `json:"severity,omitempty"`
+	RequestID   string `json:"request_id,omitempty"`
+	User        string `json:"user,omitempty"`
+	Path        string `json:"path,omitempty"`
+	Operation   string `json:"operation,omitempty"`
+	Time        string `json:"time,omitempty"`
+}
+
+// entry is the part of a Vault audit entry this plugin reads.
+type entry struct {
+	Type string `json:"type"`
+	Time string `json:"time"`
+	Auth struct {
+		DisplayName string `json:"display_name"`
+	} `json:"auth"`
+	Request struct {
+		ID        string `json:"id"`
+		Path      string `json:"path"`
+		Operation string `json:"operation"`
+	} `json:"request"`
+}
+
+func main() {
+	pattern := flag.String("path", "", "Alert on request paths matching this regular expression")
+	severity := flag.String("severity", "warning", "Severity of the alerts")
+	flag.Parse()
+	re, err := regexp.Compile(*pattern)
+	if *pattern == "" || err != nil {
+		log.Fatalf("-path must be a regular expression (%v)", err)
+	}
+	// stderr ends up in the warden's log.
+	log.SetFlags(0)
+
+	out := json.NewEncoder(os.Stdout)
+	send := func(m message) {
+		if err := out.Encode(m); err != nil {
+			log.Fatalf("write: %v", err)
+		}
+	}
+	send(message{Type: "hello", Protocol: protocol, Name: "path-match"})
+
+	in := bufio.NewScanner(os.Stdin)
+	in.Buffer(make([]byte, 64*1024), 1<<20)
+	for in.Scan() {
+		var m message
+		if err := json.Unmarshal(in.Bytes(), &m); err != nil {
+			log.Printf("bad message: %v", err)
+			continue
+		}
+		switch m.Type {
+		case "hello":
+			if m.Protocol != protocol {
+				log.Fatalf("warden speaks protocol %d, want %d", m.Protocol, protocol)
+			}
+		case "ping":
+			send(message{Type: "pong", Seq: m.Seq})
+		case "entry":
+			var e entry
+			if json.Unmarshal(m.Entry, &e) != nil || e.Type != "request" || !re.MatchString(e.Request.Path) {
+				continue
+			}
+			send(message{Type: "alert", Alert: &alert{
+				Title:       "Watched path accessed",
+				Description: fmt.Sprintf("A request matched %s.", re),
+				Severity:    *severity,
+				RequestID:   e.Request.ID,
+				User:        e.Auth.DisplayName,
+				Path:        e.Request.Path,
+				Operation:   e.Request.Operation,
+				Time:        e.Time,
+			}})
+		}
+	}
+	if err := in.Err(); err != nil {
+		log.Fatalf("read: %v", err)
+	}
+}
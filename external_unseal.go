@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// --- External Unseal Detection ---
+
+const (
+	maxUnsealRecords      = 50
+	unsealRecordRetention = 24 * time.Hour
+	// An in-progress record with no end time still attributes entries for
+	// this long after it started (covers an unlock that crashed mid-way).
+	unsealInProgressSpan = 10 * time.Minute
+	pendingUnsealTTL     = time.Hour
+)
+
+func (st *wardenState) addUnseal(r unsealRecord) {
+	kept := st.Unseals[:0]
+	for _, u := range st.Unseals {
+		if time.Since(u.Started) < unsealRecordRetention {
+			kept = append(kept, u)
+		}
+	}
+	st.Unseals = append(kept, r)
+	if n := len(st.Unseals); n > maxUnsealRecords {
+		st.Unseals = st.Unseals[n-maxUnsealRecords:]
+	}
+}
+
+func (st *wardenState) finishUnseal(started, finished time.Time) {
+	for i := range st.Unseals {
+		if st.Unseals[i].Started.Equal(started) {
+			st.Unseals[i].Finished = finished
+		}
+	}
+}
+
+// recordUnsealStart marks the start of a warden-initiated unseal so audit
+// mode can attribute the resulting sys/unseal entries to us. It returns a
+// function that marks the end. Failures only warn: losing attribution must
+// not stop an unseal.
+func recordUnsealStart(store *stateStore, keys int) func() {
+	host, _ := os.Hostname()
+	started := time.Now()
+	if err := store.update(func(st *wardenState) {
+		st.addUnseal(unsealRecord{Host: host, Started: started, Keys: keys})
+	}); err != nil {
+		logWarn("⚠️  Could not record unseal attempt: {error}", "error", err)
+		return func() {}
+	}
+	return func() {
+		if err := store.update(func(st *wardenState) { st.finishUnseal(started, time.Now()) }); err != nil {
+			logWarn("⚠️  Could not record unseal completion: {error}", "error", err)
+		}
+	}
+}
+
+// unsealSubmissions accumulates unattributed key submissions from one address.
+type unsealSubmissions struct {
+	addr  string
+	count int
+	first time.Time
+	last  time.Time
+}
+
+type externalUnsealDetector struct {
+	store   *stateStore
+	window  time.Duration
+	known   []*net.IPNet
+	pending map[string]*unsealSubmissions
+}
+
+func newExternalUnsealDetector(cfg *VaultConfig) *externalUnsealDetector {
+	known, _ := parseCIDRs(cfg.ExternalUnseal.KnownSources) // validated at load
+	return &externalUnsealDetector{
+		store:   newStateStore(cfg.StateFile),
+		window:  time.Duration(cfg.ExternalUnseal.AttributionWindow),
+		known:   known,
+		pending: make(map[string]*unsealSubmissions),
+	}
+}
+
+// observe tracks a sys/unseal audit entry. Once an unattributed source
+// completes an unseal, its submissions are returned for alerting.
+func (d *externalUnsealDetector) observe(entry *AuditEntry) *unsealSubmissions {
+	addr := entry.Request.RemoteAddress
+	t := entryTime(entry.Time)
+
+	for a, p := range d.pending {
+		if t.Sub(p.last) > pendingUnsealTTL {
+			delete(d.pending, a)
+		}
+	}
+
+	if entry.Type != "response" {
+		if entry.Error != "" || d.attributed(addr, t) {
+			return nil
+		}
+		p, ok := d.pending[addr]
+		if !ok {
+			p = &unsealSubmissions{addr: addr, first: t}
+			d.pending[addr] = p
+		}
+		p.count++
+		p.last = t
+		return nil
+	}
+
+	var data struct {
+		Sealed *bool `json:"sealed"`
+	}
+	if err := json.Unmarshal(entry.Response.Data, &data); err != nil || data.Sealed == nil || *data.Sealed {
+		return nil
+	}
+	p, ok := d.pending[addr]
+	if !ok {
+		return nil
+	}
+	delete(d.pending, addr)
+	return p
+}
+
+// attributed reports whether a submission from addr at t belongs to this
+// warden: either a known source, or inside a recorded warden unseal window.
+func (d *externalUnsealDetector) attributed(addr string, t time.Time) bool {
+	if ip := net.ParseIP(hostOnly(addr)); ip != nil {
+		for _, n := range d.known {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+
+	st, err := d.store.load()
+	if err != nil {
+		logWarn("⚠️  Could not read unseal records: {error}", "error", err)
+		return false
+	}
+	for _, u := range st.Unseals {
+		end := u.Finished
+		if end.IsZero() {
+			end = u.Started.Add(unsealInProgressSpan)
+		}
+		if !t.Before(u.Started.Add(-d.window)) && !t.After(end.Add(d.window)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *unsealSubmissions) describe() localText {
+	return msgExternalUnsealBody.with("count", s.count, "span", s.last.Sub(s.first).Round(time.Second))
+}
+
+var (
+	msgExternalUnseal     = message("external-unseal.title")
+	msgExternalUnsealBody = message("external-unseal.body")
+)
+
+// parseCIDRs accepts CIDRs and bare IPs.
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			s = fmt.Sprintf("%s/%d", s, bits)
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// hostOnly strips an optional port from an address.
+func hostOnly(addr string) string {
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		return h
+	}
+	return addr
+}
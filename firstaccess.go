@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- First-time Access ---
+
+const (
+	defaultLearningPeriod = 7 * 24 * time.Hour
+	defaultMaxPrefixes    = 200
+	defaultMaxIdentities  = 10000
+)
+
+// FirstAccessConfig flags an identity touching a path prefix (the first two
+// segments, e.g. secret/payments) it has never touched before.
+type FirstAccessConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Identities are only learned, not alerted on, for this long after
+	// they are first seen.
+	LearningPeriod Duration `yaml:"learning_period"`
+	MaxPrefixes    int      `yaml:"max_prefixes"`   // per identity; least recently used go first
+	MaxIdentities  int      `yaml:"max_identities"` // least recently seen go first
+	Severity       string   `yaml:"severity"`       // default info
+	// Escalate raises the severity for prefixes starting with a key.
+	Escalate map[string]string `yaml:"escalate"`
+}
+
+// identityAccess is what is known about one identity's access. Prefixes
+// maps each prefix to when it was last used.
+type identityAccess struct {
+	FirstSeen time.Time            `json:"first_seen"`
+	LastSeen  time.Time            `json:"last_seen"`
+	Prefixes  map[string]time.Time `json:"prefixes"`
+}
+
+type firstAccessDetector struct {
+	cfg   FirstAccessConfig
+	sev   severity
+	store *stateStore
+
+	mu         sync.Mutex
+	identities map[string]*identityAccess
+	events     int
+	learned    int // first-time prefixes recorded during learning
+}
+
+func newFirstAccessDetector(cfg *VaultConfig) *firstAccessDetector {
+	if !cfg.FirstAccess.Enabled {
+		return nil
+	}
+	sev, _ := parseSeverity(cfg.FirstAccess.Severity) // validated at load
+	d := &firstAccessDetector{
+		cfg:        cfg.FirstAccess,
+		sev:        sev,
+		store:      newStateStore(cfg.StateFile),
+		identities: make(map[string]*identityAccess),
+	}
+	st, err := d.store.load()
+	if err != nil {
+		logWarn("⚠️  First-time access: could not restore known prefixes: {error}", "error", err)
+		return d
+	}
+	for id, ia := range st.FirstAccess {
+		if ia != nil && ia.Prefixes != nil {
+			d.identities[id] = ia
+		}
+	}
+	return d
+}
+
+// pathPrefix returns the first two segments of a request path.
+func pathPrefix(path string) string {
+	parts := strings.SplitN(strings.Trim(path, "/"), "/", 3)
+	if len(parts) > 2 {
+		parts = parts[:2]
+	}
+	return strings.Join(parts, "/")
+}
+
+// observe records one response entry and returns an alert when its
+// identity is past learning and the prefix is new to it.
+func (d *firstAccessDetector) observe(e *AuditEntry) (Alert, bool) {
+	if d == nil || e.Type != "response" || e.Auth.DisplayName == "" || e.Request.Path == "" {
+		return Alert{}, false
+	}
+	id, prefix := identityKey(e), pathPrefix(e.Request.Path)
+	now := time.Now().UTC()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ia, ok := d.identities[id]
+	if !ok && id != e.Auth.DisplayName {
+		// Learned before entities were tracked: carry the history over
+		// rather than relearning.
+		if ia, ok = d.identities[e.Auth.DisplayName]; ok {
+			delete(d.identities, e.Auth.DisplayName)
+			d.identities[id] = ia
+		}
+	}
+	if !ok {
+		if len(d.identities) >= shedCap(d.cfg.MaxIdentities) {
+			d.evictIdentity()
+		}
+		ia = &identityAccess{FirstSeen: now, Prefixes: make(map[string]time.Time)}
+		d.identities[id] = ia
+	}
+	ia.LastSeen = now
+	if _, known := ia.Prefixes[prefix]; known {
+		ia.Prefixes[prefix] = now
+		return Alert{}, false
+	}
+	if len(ia.Prefixes) >= d.cfg.MaxPrefixes {
+		evictOldest(ia.Prefixes)
+	}
+	ia.Prefixes[prefix] = now
+
+	if now.Sub(ia.FirstSeen) < time.Duration(d.cfg.LearningPeriod) {
+		d.learned++
+		return Alert{}, false
+	}
+	d.events++
+	sev := d.severityFor(prefix)
+	metrics.inc("first_time_access_total", "severity", sev.String())
+	return Alert{Severity: sev, Color: sev.color(), RequestID: e.Request.ID, Rule: "first-time-access",
+		User: e.Auth.DisplayName, Path: e.Request.Path, Operation: e.Request.Operation,
+		SourceIP: hostOnly(e.Request.RemoteAddress), Time: entryTime(e.Time)}.say(
+		msgFirstAccess.with("prefix", cleanField(prefix, maxPathLen)),
+		msgFirstAccessBody.with("user", mdText(e.Auth.DisplayName, maxNameLen), "prefix", mdCode(prefix, maxPathLen),
+			"first_seen", ia.FirstSeen.Format("2006-01-02"), "others", len(ia.Prefixes)-1)), true
+}
+
+var (
+	msgFirstAccess     = message("first-time-access.title")
+	msgFirstAccessBody = message("first-time-access.body")
+)
+
+// severityFor applies the longest matching escalation.
+func (d *firstAccessDetector) severityFor(prefix string) severity {
+	sev, best := d.sev, -1
+	for p, name := range d.cfg.Escalate {
+		p = strings.Trim(p, "/")
+		if (prefix == p || strings.HasPrefix(prefix, p+"/")) && len(p) > best {
+			s, _ := parseSeverity(name) // validated at load
+			sev, best = s, len(p)
+		}
+	}
+	return sev
+}
+
+func (d *firstAccessDetector) evictIdentity() {
+	var oldest string
+	var seen time.Time
+	for id, ia := range d.identities {
+		if oldest == "" || ia.LastSeen.Before(seen) {
+			oldest, seen = id, ia.LastSeen
+		}
+	}
+	delete(d.identities, oldest)
+}
+
+func (d *firstAccessDetector) usage() cacheUsage {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	u := cacheUsage{Entries: len(d.identities)}
+	for id, ia := range d.identities {
+		u.Bytes += cacheEntryOverhead + cacheMapOverhead + int64(len(id))
+		for p := range ia.Prefixes {
+			u.Bytes += cacheEntryOverhead + int64(len(p))
+		}
+	}
+	return u
+}
+
+func (d *firstAccessDetector) shed() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	excess := len(d.identities) - shedCap(d.cfg.MaxIdentities)
+	if excess <= 0 {
+		return
+	}
+	seen := make(map[string]time.Time, len(d.identities))
+	for id, ia := range d.identities {
+		seen[id] = ia.LastSeen
+	}
+	for _, id := range oldestKeys(seen)[:excess] {
+		delete(d.identities, id)
+	}
+}
+
+func evictOldest(prefixes map[string]time.Time) {
+	var oldest string
+	var used time.Time
+	for p, t := range prefixes {
+		if oldest == "" || t.Before(used) {
+			oldest, used = p, t
+		}
+	}
+	delete(prefixes, oldest)
+}
+
+// save persists the known prefixes so a restart doesn't make everything
+// look new again.
+func (d *firstAccessDetector) save() error {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	out := make(map[string]*identityAccess, len(d.identities))
+	for id, ia := range d.identities {
+		cp := *ia
+		cp.Prefixes = make(map[string]time.Time, len(ia.Prefixes))
+		for p, t := range ia.Prefixes {
+			cp.Prefixes[p] = t
+		}
+		out[id] = &cp
+	}
+	d.mu.Unlock()
+
+	return d.store.update(func(st *wardenState) { st.FirstAccess = out })
+}
+
+func firstAccessJob(d *firstAccessDetector) jobSpec {
+	return jobSpec{
+		name:    "first-time-access",
+		every:   time.Minute,
+		timeout: 10 * time.Second,
+		run:     func(ctx context.Context) error { return d.save() },
+	}
+}
+
+// firstAccessStatus is the /statusz view of the detector.
+type firstAccessStatus struct {
+	Identities int `json:"identities"`
+	Learning   int `json:"learning"` // identities still in their learning period
+	Events     int `json:"events"`   // first-time alerts since start
+	Learned    int `json:"learned"`  // new prefixes recorded while learning
+}
+
+func (d *firstAccessDetector) status() *firstAccessStatus {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	st := &firstAccessStatus{Identities: len(d.identities), Events: d.events, Learned: d.learned}
+	for _, ia := range d.identities {
+		if time.Since(ia.FirstSeen) < time.Duration(d.cfg.LearningPeriod) {
+			st.Learning++
+		}
+	}
+	return st
+}
@@ -0,0 +1,587 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nxadm/tail"
+)
+
+// --- Audit Forwarding (edge) ---
+
+const (
+	defaultForwardSpool    = "/var/lib/vault-warden/forward.spool"
+	defaultForwardBatch    = 500
+	defaultForwardFlush    = time.Second
+	defaultForwardMaxSpool = 1024 // MiB
+	forwardMaxBackoff      = 30 * time.Second
+	forwardMaxFrame        = 64 * 1024 * 1024
+	spoolHeaderLen         = 8 // line length, CRC-32 of the line
+	spoolMaxLine           = 16 * 1024 * 1024
+)
+
+// ForwardConfig turns audit mode into an edge: audit lines are spooled to
+// disk and streamed to a hub warden (see ReceiveConfig) instead of being
+// checked here. The hub holds the rules, notifiers and state.
+type ForwardConfig struct {
+	Address    string `yaml:"address"` // hub host:port
+	ServerName string `yaml:"server_name"`
+	CACert     string `yaml:"ca_cert"` // default system roots
+	Cert       string `yaml:"cert"`    // client certificate for mTLS
+	Key        string `yaml:"key"`
+	// Spool holds lines until the hub acknowledges them, so they survive
+	// a lost link and a restart.
+	Spool         string   `yaml:"spool"`
+	MaxSpoolMB    int64    `yaml:"max_spool_mb"`
+	BatchSize     int      `yaml:"batch_size"`
+	FlushInterval Duration `yaml:"flush_interval"`
+}
+
+// Wire format. Each message is a 4-byte big-endian length followed by a
+// protobuf encoding of:
+//
+//	message Batch { uint64 seq = 1; string source = 2; repeated bytes lines = 3; }
+//	message Ack   { uint64 seq = 1; string error = 2; }
+//
+// The edge sends one batch at a time and waits for its ack. The hub only
+// acks once every line of the batch has been through its pipeline, and the
+// edge only moves its spool position past the batch on that ack, so lines
+// are delivered at least once.
+type forwardBatch struct {
+	seq    uint64
+	source string
+	lines  [][]byte
+}
+
+type forwardAck struct {
+	seq uint64
+	err string
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	b = appendVarint(b, uint64(field)<<3|2)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func (m *forwardBatch) marshal() []byte {
+	b := appendVarint(appendVarint(nil, 1<<3|0), m.seq)
+	if m.source != "" {
+		b = appendBytesField(b, 2, []byte(m.source))
+	}
+	for _, line := range m.lines {
+		b = appendBytesField(b, 3, line)
+	}
+	return b
+}
+
+func (m *forwardAck) marshal() []byte {
+	b := appendVarint(appendVarint(nil, 1<<3|0), m.seq)
+	if m.err != "" {
+		b = appendBytesField(b, 2, []byte(m.err))
+	}
+	return b
+}
+
+// protoFields calls fn for each field of a protobuf message; value is the
+// varint for wire type 0 and the payload for wire type 2. Other wire
+// types are skipped.
+func protoFields(b []byte, fn func(field int, varint uint64, value []byte)) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("bad field tag")
+		}
+		b = b[n:]
+		field := int(tag >> 3)
+		switch tag & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return fmt.Errorf("bad varint in field %d", field)
+			}
+			b = b[n:]
+			fn(field, v, nil)
+		case 1:
+			if len(b) < 8 {
+				return fmt.Errorf("short field %d", field)
+			}
+			b = b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return fmt.Errorf("bad length in field %d", field)
+			}
+			fn(field, 0, b[n:n+int(l)])
+			b = b[n+int(l):]
+		case 5:
+			if len(b) < 4 {
+				return fmt.Errorf("short field %d", field)
+			}
+			b = b[4:]
+		default:
+			return fmt.Errorf("unsupported wire type %d in field %d", tag&7, field)
+		}
+	}
+	return nil
+}
+
+func unmarshalBatch(b []byte) (*forwardBatch, error) {
+	m := &forwardBatch{}
+	err := protoFields(b, func(field int, v uint64, value []byte) {
+		switch field {
+		case 1:
+			m.seq = v
+		case 2:
+			m.source = string(value)
+		case 3:
+			m.lines = append(m.lines, value)
+		}
+	})
+	return m, err
+}
+
+func unmarshalAck(b []byte) (*forwardAck, error) {
+	m := &forwardAck{}
+	err := protoFields(b, func(field int, v uint64, value []byte) {
+		switch field {
+		case 1:
+			m.seq = v
+		case 2:
+			m.err = string(value)
+		}
+	})
+	return m, err
+}
+
+func writeFrame(w io.Writer, msg []byte) error {
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(msg)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(msg)
+	return err
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(header[:])
+	if n > forwardMaxFrame {
+		return nil, fmt.Errorf("frame of %d bytes exceeds the %d limit", n, forwardMaxFrame)
+	}
+	msg := make([]byte, n)
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+// forwardSpool is an append-only file of framed lines. acked is the offset
+// up to which the hub has acknowledged; it is kept in the state file. Once
+// everything is acknowledged the file is truncated.
+type forwardSpool struct {
+	path  string
+	max   int64
+	store *stateStore
+
+	mu       sync.Mutex
+	f        *os.File
+	size     int64
+	acked    int64
+	dropping bool
+	ready    chan struct{} // signalled after an append
+}
+
+func openSpool(cfg *VaultConfig) (*forwardSpool, error) {
+	fc := cfg.Forward
+	f, err := os.OpenFile(fc.Spool, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open spool: %w", err)
+	}
+	s := &forwardSpool{path: fc.Spool, max: fc.MaxSpoolMB << 20, store: newStateStore(cfg.StateFile), f: f,
+		ready: make(chan struct{}, 1)}
+	st, err := s.store.load()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	end, err := scanSpool(f)
+	if err != nil {
+		logWarn("⚠️  Forward spool: {error}; dropping the torn tail", "error", err)
+		if err := f.Truncate(end); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("truncate spool: %w", err)
+		}
+	}
+	s.size, s.acked = end, st.ForwardAcked
+	if s.acked > s.size {
+		// Truncated after a full ack but before the offset was saved.
+		s.acked = 0
+	}
+	if _, err := f.Seek(s.size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if s.size > s.acked {
+		logInfo("📦 Forward spool: {unacked} not yet acknowledged by the hub", "unacked", formatBytes(s.size-s.acked))
+	}
+	return s, nil
+}
+
+// scanSpool returns the offset past the last intact record.
+func scanSpool(f *os.File) (int64, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	var end int64
+	err := readSpool(f, -1, func(line []byte, next int64) bool { end = next; return true })
+	return end, err
+}
+
+// readSpool calls fn for records from r with the offset past each, until
+// fn returns false; limit < 0 reads to the end. Offsets are relative
+// to where r starts.
+func readSpool(r io.Reader, limit int64, fn func(line []byte, next int64) bool) error {
+	br := bufio.NewReader(r)
+	header := make([]byte, spoolHeaderLen)
+	var off int64
+	for limit < 0 || off < limit {
+		if _, err := io.ReadFull(br, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("partial record header at offset %d", off)
+		}
+		n := binary.BigEndian.Uint32(header[:4])
+		if n == 0 || n > spoolMaxLine {
+			return fmt.Errorf("bad record length %d at offset %d", n, off)
+		}
+		line := make([]byte, n)
+		if _, err := io.ReadFull(br, line); err != nil {
+			return fmt.Errorf("partial record at offset %d", off)
+		}
+		if crc32.ChecksumIEEE(line) != binary.BigEndian.Uint32(header[4:]) {
+			return fmt.Errorf("checksum mismatch at offset %d", off)
+		}
+		off += int64(spoolHeaderLen) + int64(n)
+		if !fn(line, off) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// append spools one line. When the spool is full new lines are dropped,
+// since the hub has been unreachable for long enough that it matters less
+// which ones.
+func (s *forwardSpool) append(line []byte) {
+	if len(line) == 0 || len(line) > spoolMaxLine {
+		return
+	}
+	frame := make([]byte, spoolHeaderLen, spoolHeaderLen+len(line))
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(line)))
+	binary.BigEndian.PutUint32(frame[4:], crc32.ChecksumIEEE(line))
+	frame = append(frame, line...)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.max > 0 && s.size-s.acked+int64(len(frame)) > s.max {
+		metrics.inc("forward_spool_dropped_total")
+		if !s.dropping {
+			s.dropping = true
+			logError("🚨 Forward spool full ({unacked} unacknowledged); dropping new audit lines", "unacked", formatBytes(s.size-s.acked))
+		}
+		return
+	}
+	s.dropping = false
+	if _, err := s.f.Write(frame); err != nil {
+		s.f.Truncate(s.size)
+		s.f.Seek(s.size, io.SeekStart)
+		metrics.inc("forward_spool_write_errors_total")
+		logWarn("⚠️  Could not write forward spool: {error}", "error", err)
+		return
+	}
+	s.size += int64(len(frame))
+	metrics.set("forward_spool_bytes", float64(s.size-s.acked))
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// next reads up to n unacknowledged lines and the offset past them.
+func (s *forwardSpool) next(n int) ([][]byte, int64, error) {
+	s.mu.Lock()
+	from, to := s.acked, s.size
+	s.mu.Unlock()
+	if from >= to {
+		return nil, from, nil
+	}
+	r := io.NewSectionReader(s.f, from, to-from)
+	var lines [][]byte
+	end := from
+	err := readSpool(r, to-from, func(line []byte, next int64) bool {
+		lines, end = append(lines, line), from+next
+		return len(lines) < n
+	})
+	return lines, end, err
+}
+
+// ack records that the hub accepted everything before offset.
+func (s *forwardSpool) ack(offset int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if offset < s.acked || offset > s.size {
+		return fmt.Errorf("ack offset %d outside spool (%d-%d)", offset, s.acked, s.size)
+	}
+	s.acked = offset
+	if s.acked == s.size {
+		if err := s.f.Truncate(0); err == nil {
+			s.f.Seek(0, io.SeekStart)
+			s.size, s.acked = 0, 0
+		}
+	}
+	metrics.set("forward_spool_bytes", float64(s.size-s.acked))
+	acked := s.acked
+	return s.store.update(func(st *wardenState) { st.ForwardAcked = acked })
+}
+
+func (s *forwardSpool) sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Sync()
+}
+
+func (s *forwardSpool) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.f.Sync()
+	s.f.Close()
+}
+
+func forwardTLSConfig(fc ForwardConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(fc.Cert, fc.Key)
+	if err != nil {
+		return nil, fmt.Errorf("load forward client certificate: %w", err)
+	}
+	conf := &tls.Config{Certificates: []tls.Certificate{cert}, ServerName: fc.ServerName, MinVersion: tls.VersionTLS12}
+	if fc.CACert != "" {
+		pem, err := os.ReadFile(fc.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("read forward.ca_cert: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("forward.ca_cert %s: no PEM certificates", fc.CACert)
+		}
+		conf.RootCAs = pool
+	}
+	if conf.ServerName == "" {
+		host, _, _ := net.SplitHostPort(fc.Address)
+		conf.ServerName = host
+	}
+	return conf, nil
+}
+
+// forwarder streams the spool to the hub, reconnecting with backoff.
+type forwarder struct {
+	cfg   *VaultConfig
+	tls   *tls.Config
+	spool *forwardSpool
+	seq   uint64
+}
+
+func (fw *forwarder) run(ctx context.Context) {
+	backoff := time.Second
+	down := false
+	for ctx.Err() == nil {
+		accepted, err := fw.stream(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		metrics.inc("forward_disconnects_total")
+		if accepted {
+			backoff, down = time.Second, false
+		}
+		if !down {
+			logWarn("⚠️  Forwarding to {address} failed: {error}; retrying with backoff", "address", fw.cfg.Forward.Address, "error", err)
+			down = true
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		if backoff *= 2; backoff > forwardMaxBackoff {
+			backoff = forwardMaxBackoff
+		}
+	}
+}
+
+// stream sends batches over one connection until it fails, and reports
+// whether the hub accepted anything on it. A hub refusing the certificate
+// only says so after the handshake, at the first batch.
+func (fw *forwarder) stream(ctx context.Context) (bool, error) {
+	fc := fw.cfg.Forward
+	d := &tls.Dialer{NetDialer: &net.Dialer{Timeout: time.Duration(fw.cfg.Timeouts.Dial)}, Config: fw.tls}
+	conn, err := d.DialContext(ctx, "tcp", fc.Address)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	defer metrics.set("forward_connected", 0)
+
+	accepted := false
+	source, _ := os.Hostname()
+	flush := time.NewTicker(time.Duration(fc.FlushInterval))
+	defer flush.Stop()
+	for {
+		lines, end, err := fw.spool.next(fc.BatchSize)
+		if err != nil {
+			return accepted, fmt.Errorf("read spool: %w", err)
+		}
+		if len(lines) == 0 {
+			select {
+			case <-fw.spool.ready:
+			case <-flush.C:
+			case <-ctx.Done():
+				return accepted, nil
+			}
+			continue
+		}
+
+		fw.seq++
+		batch := &forwardBatch{seq: fw.seq, source: source, lines: lines}
+		timeout := fw.cfg.Timeouts.of(opAPI)
+		conn.SetDeadline(time.Now().Add(timeout))
+		if err := writeFrame(conn, batch.marshal()); err != nil {
+			return accepted, err
+		}
+		msg, err := readFrame(conn)
+		if err != nil {
+			return accepted, err
+		}
+		ack, err := unmarshalAck(msg)
+		switch {
+		case err != nil:
+			return accepted, fmt.Errorf("bad ack: %w", err)
+		case ack.seq != batch.seq:
+			return accepted, fmt.Errorf("ack for batch %d, expected %d", ack.seq, batch.seq)
+		case ack.err != "":
+			return accepted, fmt.Errorf("hub refused batch: %s", ack.err)
+		}
+		if !accepted {
+			accepted = true
+			logInfo("🔗 Forwarding audit lines to {address}", "address", fc.Address)
+			metrics.set("forward_connected", 1)
+		}
+		if err := fw.spool.ack(end); err != nil {
+			logWarn("⚠️  Forward spool: {error}", "error", err)
+		}
+		metrics.add("forward_lines_total", float64(len(lines)))
+		metrics.inc("forward_batches_total")
+	}
+}
+
+// runForward is audit mode on an edge.
+func runForward(cfg *VaultConfig) error {
+	tlsConf, err := forwardTLSConfig(cfg.Forward)
+	if err != nil {
+		return err
+	}
+	spool, err := openSpool(cfg)
+	if err != nil {
+		return err
+	}
+	defer spool.close()
+
+	if _, err := os.Stat(cfg.AuditLog); err != nil {
+		return fmt.Errorf("audit log not accessible: %w", err)
+	}
+	t, err := tail.TailFile(cfg.AuditLog, tail.Config{
+		Follow:   true,
+		ReOpen:   true,
+		Poll:     true,
+		Location: &tail.SeekInfo{Offset: 0, Whence: io.SeekEnd},
+		Logger:   tail.DiscardingLogger,
+	})
+	if err != nil {
+		return fmt.Errorf("tail audit log: %w", err)
+	}
+	defer t.Stop()
+
+	sup := newSupervisor()
+	defer sup.stop(shutdownGrace)
+	fw := &forwarder{cfg: cfg, tls: tlsConf, spool: spool}
+	sup.add(componentSpec{name: "forwarder", policy: policyRestart, run: func(ctx context.Context) error {
+		fw.run(ctx)
+		return nil
+	}})
+	sup.add(componentSpec{name: "spool-intake", policy: policyRestart, run: func(ctx context.Context) error {
+		syncTicker := time.NewTicker(time.Duration(cfg.Forward.FlushInterval))
+		defer syncTicker.Stop()
+		for {
+			select {
+			case line := <-t.Lines:
+				if line.Err != nil {
+					logWarn("⚠️  Error reading line: {error}", "error", line.Err)
+					continue
+				}
+				metrics.inc("audit_lines_total", "type", "forwarded")
+				spool.append([]byte(line.Text))
+			case <-syncTicker.C:
+				if err := spool.sync(); err != nil {
+					logWarn("⚠️  Could not sync forward spool: {error}", "error", err)
+				}
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}})
+
+	sd := newSDNotifier()
+	status := func() string {
+		return fmt.Sprintf("Edge: %.0f audit lines spooled for %s", metrics.sum("audit_lines_total"), cfg.Forward.Address)
+	}
+	if sd != nil {
+		sup.add(sdComponent(sd, alwaysHealthy, status))
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	logInfo("📡 Vault Warden edge: spooling {audit_log} for {address}", "audit_log", cfg.AuditLog, "address", cfg.Forward.Address)
+	sd.ready(status())
+	defer sd.stopping()
+	select {
+	case <-sigChan:
+		logInfo("\n🛑 Shutting down gracefully...")
+		return nil
+	case err := <-sup.failure():
+		logWarn("🛑 Shutting down: {error}", "error", err)
+		return err
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// --- Grafana Annotations ---
+
+const (
+	grafanaQueueSize = 100
+	grafanaAttempts  = 3
+)
+
+// GrafanaConfig sends annotations to Grafana's HTTP API for seal lifecycle
+// events and for alerts from the listed rules. Paired events (sealed →
+// unsealed, seal backend down → recovered) become region annotations.
+type GrafanaConfig struct {
+	URL          string   `yaml:"url"`
+	APIToken     string   `yaml:"api_token"`
+	DashboardUID string   `yaml:"dashboard_uid"`
+	PanelID      int      `yaml:"panel_id"`
+	Tags         []string `yaml:"tags"`
+	Rules        []string `yaml:"rules"`
+}
+
+type grafanaAnnotation struct {
+	DashboardUID string   `json:"dashboardUID,omitempty"`
+	PanelID      int      `json:"panelId,omitempty"`
+	Time         int64    `json:"time,omitempty"`
+	TimeEnd      int64    `json:"timeEnd,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+	Text         string   `json:"text,omitempty"`
+}
+
+// grafanaOp is one queued API call. Opening an incident starts a region
+// whose ID is kept in the state store; closing it sets the region's end.
+type grafanaOp struct {
+	annotation grafanaAnnotation
+	incident   string
+	close      bool
+}
+
+// grafanaAnnotator posts annotations from a background worker so a slow
+// or unreachable Grafana never delays alerting. A nil *grafanaAnnotator
+// is a no-op.
+type grafanaAnnotator struct {
+	cfg     GrafanaConfig
+	rules   map[string]bool
+	store   *stateStore
+	client  *http.Client
+	timeout time.Duration
+	ops     chan grafanaOp
+	done    chan struct{}
+}
+
+var grafanaSink *grafanaAnnotator
+
+func startGrafana(cfg *VaultConfig) *grafanaAnnotator {
+	if cfg.Grafana.URL == "" {
+		return nil
+	}
+	g := &grafanaAnnotator{
+		cfg:     cfg.Grafana,
+		rules:   make(map[string]bool),
+		store:   newStateStore(cfg.StateFile),
+		client:  newNotifyClient(cfg),
+		timeout: cfg.Timeouts.of(opNotify),
+		ops:     make(chan grafanaOp, grafanaQueueSize),
+		done:    make(chan struct{}),
+	}
+	for _, r := range cfg.Grafana.Rules {
+		g.rules[r] = true
+	}
+	go g.run()
+	return g
+}
+
+// annotateAlert annotates alerts that belong to an incident or come from
+// a selected rule.
+func (g *grafanaAnnotator) annotateAlert(a Alert) {
+	if g == nil || (a.Incident == "" && !g.rules[a.Rule]) {
+		return
+	}
+	tags := []string{a.Severity.String()}
+	if a.Rule != "" {
+		tags = append(tags, a.Rule)
+	}
+	if a.Environment != "" {
+		tags = append(tags, a.Environment)
+	}
+	g.enqueue(grafanaOp{annotation: g.annotation(a.Time, a.Title, tags), incident: a.Incident, close: a.Resolved})
+}
+
+// sealState opens a "sealed" region when Vault is found sealed and closes
+// it once it is unsealed. Repeated reports of the same state are no-ops.
+func (g *grafanaAnnotator) sealState(state string) {
+	if g == nil {
+		return
+	}
+	text := "Vault " + state
+	g.enqueue(grafanaOp{annotation: g.annotation(time.Now(), text, []string{"seal"}),
+		incident: "sealed", close: state == "unsealed"})
+}
+
+// clusterSealState is sealState for one of several clusters, each with
+// its own seal region.
+func (g *grafanaAnnotator) clusterSealState(cluster, state string) {
+	if g == nil {
+		return
+	}
+	text := "Vault " + cluster + " " + state
+	g.enqueue(grafanaOp{annotation: g.annotation(time.Now(), text, []string{"seal", "cluster:" + cluster}),
+		incident: "sealed:" + cluster, close: state == "unsealed"})
+}
+
+func (g *grafanaAnnotator) annotation(t time.Time, text string, tags []string) grafanaAnnotation {
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return grafanaAnnotation{
+		DashboardUID: g.cfg.DashboardUID,
+		PanelID:      g.cfg.PanelID,
+		Time:         t.UnixNano() / int64(time.Millisecond),
+		Tags:         append(append([]string{"vault-warden"}, g.cfg.Tags...), tags...),
+		Text:         text,
+	}
+}
+
+func (g *grafanaAnnotator) enqueue(op grafanaOp) {
+	select {
+	case g.ops <- op:
+	default:
+		logWarn("⚠️  Grafana: queue full, dropping annotation \"{annotation}\"", "annotation", op.annotation.Text)
+	}
+}
+
+func (g *grafanaAnnotator) run() {
+	defer close(g.done)
+	for op := range g.ops {
+		if err := g.apply(op); err != nil {
+			logWarn("⚠️  Grafana annotation failed: {error}", "error", err)
+		}
+	}
+}
+
+// apply performs one op. Incident state is read at this point, after any
+// earlier op for the same incident has finished.
+func (g *grafanaAnnotator) apply(op grafanaOp) error {
+	if op.incident == "" {
+		_, err := g.call(http.MethodPost, "/api/annotations", op.annotation)
+		return err
+	}
+
+	st, err := g.store.load()
+	if err != nil {
+		return err
+	}
+	id, open := st.GrafanaRegions[op.incident]
+	switch {
+	case op.close && open:
+		if _, err := g.call(http.MethodPatch, fmt.Sprintf("/api/annotations/%d", id),
+			grafanaAnnotation{TimeEnd: op.annotation.Time}); err != nil {
+			return err
+		}
+		return g.store.update(func(st *wardenState) { delete(st.GrafanaRegions, op.incident) })
+	case op.close, open:
+		// Nothing to close, or the region is already open.
+		return nil
+	}
+
+	id, err = g.call(http.MethodPost, "/api/annotations", op.annotation)
+	if err != nil {
+		return err
+	}
+	return g.store.update(func(st *wardenState) {
+		if st.GrafanaRegions == nil {
+			st.GrafanaRegions = make(map[string]int64)
+		}
+		st.GrafanaRegions[op.incident] = id
+	})
+}
+
+// call sends one API request, retrying with backoff, and returns the
+// annotation ID from the response.
+func (g *grafanaAnnotator) call(method, path string, body grafanaAnnotation) (int64, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return 0, err
+	}
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		id, err := g.send(method, path, data)
+		if err == nil || attempt == grafanaAttempts {
+			return id, err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (g *grafanaAnnotator) send(method, path string, data []byte) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), g.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(g.cfg.URL, "/")+path, bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+g.cfg.APIToken)
+	start := time.Now()
+	resp, err := g.client.Do(req)
+	if err != nil {
+		recordDelivery("grafana", start, err)
+		return 0, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("%s %s returned %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(respBody)))
+		recordDelivery("grafana", start, err)
+		return 0, err
+	}
+	recordDelivery("grafana", start, nil)
+	var out struct {
+		ID int64 `json:"id"`
+	}
+	json.Unmarshal(respBody, &out)
+	return out.ID, nil
+}
+
+// close waits up to timeout for queued annotations to be sent.
+func (g *grafanaAnnotator) close(timeout time.Duration) {
+	if g == nil {
+		return
+	}
+	close(g.ops)
+	select {
+	case <-g.done:
+	case <-time.After(timeout):
+		logWarn("⚠️  Grafana: gave up with {unsent} annotations unsent", "unsent", len(g.ops))
+	}
+}
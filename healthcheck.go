@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// --- Command: Healthcheck ---
+
+// adminSocketEnv overrides the admin socket path for healthcheck, which
+// doesn't read the config.
+const adminSocketEnv = "VAULT_WARDEN_ADMIN_SOCKET"
+
+// readiness is the /healthz document: a cheap snapshot for container
+// health checks.
+type readiness struct {
+	Ready    bool      `json:"ready"`
+	Reason   string    `json:"reason,omitempty"`
+	Mode     string    `json:"mode"`
+	Started  time.Time `json:"started"`
+	LastLine time.Time `json:"last_line,omitempty"`
+}
+
+func healthzHandler(gate *intakeGate, auditFile *auditFileMonitor, started time.Time, dogs ...*watchdog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		paused, lastRead := gate.activity()
+		missing := auditFile.missingFor()
+		st := readiness{Ready: !paused && missing == 0, Mode: mode.String(), Started: started, LastLine: lastRead}
+		for _, dog := range dogs {
+			if n := dog.stuck(); n > 0 && st.Reason == "" {
+				st.Ready, st.Reason = false, fmt.Sprintf("%s stuck: %d self-heal attempts in a row failed", dog.name, n)
+			}
+		}
+		switch {
+		case st.Reason != "":
+		case missing > 0:
+			st.Reason = fmt.Sprintf("audit log missing for %s", missing.Round(time.Second))
+		case paused:
+			st.Reason = "audit intake paused: webhook failing"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(st)
+	}
+}
+
+// runHealthcheck asks the local daemon for its readiness and returns the
+// exit code. It reads no config and touches nothing but the socket, so it
+// is cheap enough for a HEALTHCHECK every few seconds.
+func runHealthcheck(args []string) int {
+	fs := flagSet("healthcheck")
+	socket := fs.String("socket", "", "Admin socket (default $"+adminSocketEnv+" or "+defaultAdminSocket+")")
+	maxStaleness := fs.Duration("max-staleness", 0, "Fail if the last audit line was read longer ago than this (0: don't check)")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	path := *socket
+	if path == "" {
+		path = os.Getenv(adminSocketEnv)
+	}
+	if path == "" {
+		path = defaultAdminSocket
+	}
+
+	fail := func(format string, a ...interface{}) int {
+		fmt.Printf("unhealthy: "+format+"\n", a...)
+		return 1
+	}
+	if _, err := os.Stat(path); err != nil {
+		return fail("no daemon socket at %s", path)
+	}
+	client := &http.Client{
+		Timeout: time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+	resp, err := client.Get("http://warden/healthz")
+	if err != nil {
+		return fail("daemon not answering on %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	var st readiness
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&st); err != nil || resp.StatusCode != http.StatusOK {
+		return fail("bad response from daemon (HTTP %d)", resp.StatusCode)
+	}
+	if !st.Ready {
+		return fail("%s", st.Reason)
+	}
+	if *maxStaleness > 0 {
+		if st.LastLine.IsZero() {
+			if age := time.Since(st.Started); age > *maxStaleness {
+				return fail("no audit line read in %s since start (max %s)", age.Round(time.Second), *maxStaleness)
+			}
+		} else if age := time.Since(st.LastLine); age > *maxStaleness {
+			return fail("last audit line read %s ago (max %s)", age.Round(time.Second), *maxStaleness)
+		}
+	}
+	fmt.Println("healthy")
+	return 0
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// --- Alert History ---
+
+// historyRecord is one outbound notification as written to history_file.
+// Payload is the exact body sent; the signature covers it together with the
+// timestamp and backend (see signedMessage).
+type historyRecord struct {
+	Time        time.Time `json:"time"`
+	Backend     string    `json:"backend"`
+	Title       string    `json:"title"`
+	Severity    string    `json:"severity,omitempty"`
+	Environment string    `json:"environment,omitempty"`
+	RequestID   string    `json:"request_id,omitempty"`
+	Payload     string    `json:"payload"`
+	Delivered   bool      `json:"delivered"`
+	Error       string    `json:"error,omitempty"`
+	KeyID       string    `json:"key_id,omitempty"`
+	Signature   string    `json:"signature,omitempty"`
+
+	// Alert is the alert in its schema form, with this delivery as its
+	// only delivery record. Not covered by the signature.
+	Alert *Alert `json:"alert,omitempty"`
+}
+
+// alertHistory appends records to the history file. A nil *alertHistory
+// (history_file unset) records nothing.
+type alertHistory struct {
+	mu     sync.Mutex
+	path   string
+	signer *signer
+}
+
+// history is the process-wide alert history, set up in main once the config
+// is loaded.
+var history *alertHistory
+
+func openHistory(cfg *VaultConfig) *alertHistory {
+	if cfg.HistoryFile == "" {
+		return nil
+	}
+	h := &alertHistory{path: cfg.HistoryFile}
+	if cfg.Signing.KeyDir != "" {
+		s, err := loadSigner(cfg.Signing.KeyDir)
+		if err != nil {
+			logWarn("⚠️  Notification signing disabled: {error}", "error", err)
+		}
+		h.signer = s
+	}
+	return h
+}
+
+func (h *alertHistory) record(backend string, a Alert, payload []byte, sendErr error) {
+	if h == nil {
+		return
+	}
+	rec := historyRecord{
+		Time:        time.Now().UTC(),
+		Backend:     backend,
+		Title:       a.Title,
+		Severity:    a.Severity.String(),
+		Environment: a.Environment,
+		RequestID:   a.RequestID,
+		Payload:     string(payload),
+		Delivered:   sendErr == nil,
+	}
+	if sendErr != nil {
+		rec.Error = sendErr.Error()
+	}
+	delivery := deliveryRecord{Sink: backend, Time: rec.Time, Delivered: rec.Delivered, Error: rec.Error}
+	a.Deliveries = append(append([]deliveryRecord(nil), a.Deliveries...), delivery)
+	rec.Alert = &a
+	if h.signer != nil {
+		// Signing must never block delivery: on failure keep the record unsigned.
+		if sig, err := h.signer.sign(signedMessage(&rec)); err != nil {
+			logWarn("⚠️  Could not sign notification record: {error}", "error", err)
+		} else {
+			rec.KeyID, rec.Signature = h.signer.keyID, sig
+		}
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		logWarn("⚠️  Could not encode history record: {error}", "error", err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// unlock, audit and maintenance may be separate processes.
+	unlock, err := lockHistory(h.path)
+	if err != nil {
+		logWarn("⚠️  Could not lock alert history: {error}", "error", err)
+		return
+	}
+	defer unlock()
+	f, err := os.OpenFile(h.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		logWarn("⚠️  Could not open alert history: {error}", "error", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		logWarn("⚠️  Could not write alert history: {error}", "error", err)
+	}
+}
+
+// lockHistory takes the cross-process lock guarding the history file (or
+// the outbox, which shares its locking and rewrite).
+func lockHistory(path string) (func(), error) {
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open history lock: %w", err)
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("lock history: %w", err)
+	}
+	return func() {
+		syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+		lock.Close()
+	}, nil
+}
+
+// readHistory calls fn for each record in the history file, in order.
+func readHistory(path string, fn func(lineNo int, rec *historyRecord) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open history: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		var rec historyRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return fmt.Errorf("history line %d: %w", lineNo, err)
+		}
+		if err := fn(lineNo, &rec); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read history: %w", err)
+	}
+	return nil
+}
+
+// --- Command: History ---
+
+func runHistory(cfg *VaultConfig, args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: vault-warden history show|verify-signatures")
+	}
+	if cfg.HistoryFile == "" {
+		return fmt.Errorf("history_file is not configured")
+	}
+
+	switch args[0] {
+	case "show":
+		return showHistory(cfg, args[1:])
+	case "verify-signatures":
+		return verifyHistorySignatures(cfg)
+	default:
+		return fmt.Errorf("unknown history command: %s", args[0])
+	}
+}
+
+func showHistory(cfg *VaultConfig, args []string) error {
+	fs := flagSet("history show")
+	requestID := fs.String("request-id", "", "Only show records for this Vault request ID")
+	asJSON := fs.Bool("json", false, "Print raw JSON records")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	return readHistory(cfg.HistoryFile, func(_ int, rec *historyRecord) error {
+		if *requestID != "" && rec.RequestID != *requestID {
+			return nil
+		}
+		if *asJSON {
+			line, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(line))
+			return nil
+		}
+		status := "✓"
+		if !rec.Delivered {
+			status = "✗"
+		}
+		fmt.Printf("%s %s %-8s %-8s %s%s\n", rec.Time.Format(time.RFC3339), status, rec.Backend,
+			rec.Severity, rec.Title, requestIDSuffix(rec.RequestID))
+		return nil
+	})
+}
+
+func verifyHistorySignatures(cfg *VaultConfig) error {
+	if cfg.Signing.KeyDir == "" {
+		return fmt.Errorf("signing.key_dir is not configured")
+	}
+	keys, err := loadPublicKeys(cfg.Signing.KeyDir)
+	if err != nil {
+		return err
+	}
+
+	var valid, unsigned, invalid int
+	err = readHistory(cfg.HistoryFile, func(lineNo int, rec *historyRecord) error {
+		if rec.Signature == "" {
+			unsigned++
+			return nil
+		}
+		pub, ok := keys[rec.KeyID]
+		if !ok {
+			invalid++
+			fmt.Printf("❌ Line %d: unknown signing key %q\n", lineNo, rec.KeyID)
+			return nil
+		}
+		if !verifySignature(pub, signedMessage(rec), rec.Signature) {
+			invalid++
+			fmt.Printf("❌ Line %d: bad signature (%s, %s)\n", lineNo, rec.Backend, rec.Title)
+			return nil
+		}
+		valid++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("✓ %d valid, %d unsigned, %d invalid\n", valid, unsigned, invalid)
+	if invalid > 0 {
+		return fmt.Errorf("%d history records failed verification", invalid)
+	}
+	return nil
+}
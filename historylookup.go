@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// --- History Lookups ---
+
+const (
+	defaultHistoryLookupBudget    = 50 * time.Millisecond
+	defaultHistoryLookupMaxWindow = 90 * 24 * time.Hour
+	defaultHistoryLookupMaxEvents = 100000
+)
+
+// HistoryLookupConfig bounds what rules can ask about past alerts.
+type HistoryLookupConfig struct {
+	// Budget is how long one rule evaluation may wait for the history to
+	// finish loading before its lookups answer "unknown".
+	Budget    Duration `yaml:"budget"`
+	MaxWindow Duration `yaml:"max_window"` // the longest window a lookup may ask for
+	MaxEvents int      `yaml:"max_events"` // alerts kept in memory, oldest dropped first
+}
+
+// historyEvent is what lookups need of a past alert.
+type historyEvent struct {
+	id, user, entity, rule, path string
+	at                           time.Time
+}
+
+func (ev historyEvent) keys() []string {
+	if ev.entity == "" || ev.entity == ev.user {
+		return []string{ev.user}
+	}
+	return []string{ev.user, ev.entity}
+}
+
+// historyIndex holds the alerts of the last max_window by identity. It is
+// loaded once from history_file in the background and added to as alerts
+// are raised, so an alert counts for the next entry before it is even
+// delivered. Alerts that other processes raise later aren't seen. A nil
+// *historyIndex answers every lookup with "unknown".
+type historyIndex struct {
+	cfg    HistoryLookupConfig
+	loaded chan struct{}
+
+	mu      sync.Mutex
+	err     error          // why loading failed
+	pending []historyEvent // raised while loading
+	events  []historyEvent // oldest first
+	byUser  map[string][]historyEvent
+	seen    map[string]bool // alert IDs indexed
+}
+
+// alertIndex serves the history lookups of rules; audit mode sets it up.
+var alertIndex *historyIndex
+
+func openHistoryIndex(cfg *VaultConfig) *historyIndex {
+	if cfg.HistoryFile == "" {
+		return nil
+	}
+	x := &historyIndex{cfg: cfg.HistoryLookup, loaded: make(chan struct{}),
+		byUser: make(map[string][]historyEvent), seen: make(map[string]bool)}
+	go x.load(cfg.HistoryFile)
+	return x
+}
+
+func (x *historyIndex) load(path string) {
+	defer close(x.loaded)
+	start := time.Now()
+	cutoff := start.Add(-time.Duration(x.cfg.MaxWindow))
+	var past []historyEvent
+	err := readHistory(path, func(_ int, rec *historyRecord) error {
+		if a := rec.Alert; a != nil && a.Time.After(cutoff) {
+			if ev, ok := eventOf(*a); ok {
+				past = append(past, ev)
+			}
+		}
+		return nil
+	})
+	if _, statErr := os.Stat(path); os.IsNotExist(statErr) {
+		err = nil // nothing recorded yet
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err != nil {
+		x.err = err
+		logWarn("⚠️  History lookups unavailable: {error}", "error", err)
+		return
+	}
+	for _, ev := range append(past, x.pending...) {
+		x.insertLocked(ev)
+	}
+	x.pending = nil
+	metrics.observe("history_index_load_seconds", time.Since(start).Seconds())
+	metrics.set("history_index_events", float64(len(x.events)))
+}
+
+// eventOf is the event of an alert, if it names an identity.
+func eventOf(a Alert) (historyEvent, bool) {
+	ev := historyEvent{id: a.ID, user: a.User, entity: a.EntityID, rule: a.Rule, path: a.Path, at: a.Time}
+	return ev, a.ID != "" && (a.User != "" || a.EntityID != "")
+}
+
+// add indexes an alert raised just now.
+func (x *historyIndex) add(a Alert) {
+	ev, ok := eventOf(a)
+	if x == nil || !ok {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	select {
+	case <-x.loaded:
+		x.insertLocked(ev)
+	default:
+		x.pending = append(x.pending, ev)
+	}
+}
+
+// insertLocked adds ev, dropping the oldest events past max_events or
+// max_window. The history file has a record per delivery, so an alert
+// is only indexed once.
+func (x *historyIndex) insertLocked(ev historyEvent) {
+	if x.seen[ev.id] {
+		return
+	}
+	x.seen[ev.id] = true
+	x.events = append(x.events, ev)
+	for _, k := range ev.keys() {
+		x.byUser[k] = append(x.byUser[k], ev)
+	}
+	cutoff := time.Now().Add(-time.Duration(x.cfg.MaxWindow))
+	for len(x.events) > x.cfg.MaxEvents || len(x.events) > 0 && x.events[0].at.Before(cutoff) {
+		old := x.events[0]
+		x.events = x.events[1:]
+		delete(x.seen, old.id)
+		for _, k := range old.keys() {
+			if l := x.byUser[k]; len(l) > 0 && l[0].id == old.id {
+				if len(l) == 1 {
+					delete(x.byUser, k)
+				} else {
+					x.byUser[k] = l[1:]
+				}
+			}
+		}
+	}
+}
+
+// historyLookup is the history as one rule evaluation sees it: every
+// lookup shares the evaluation's time budget.
+type historyLookup struct {
+	x        *historyIndex
+	max      time.Duration
+	deadline time.Time
+}
+
+func (x *historyIndex) lookup(cfg HistoryLookupConfig) *historyLookup {
+	return &historyLookup{x: x, max: time.Duration(cfg.MaxWindow), deadline: time.Now().Add(time.Duration(cfg.Budget))}
+}
+
+// ready waits, within the budget, for the index to load, and reports
+// whether lookups can be answered.
+func (h *historyLookup) ready() bool {
+	if h.x == nil {
+		return false
+	}
+	select {
+	case <-h.x.loaded:
+	default:
+		wait := time.Until(h.deadline)
+		if wait <= 0 {
+			return false
+		}
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		select {
+		case <-h.x.loaded:
+		case <-t.C:
+			metrics.inc("history_lookups_unknown_total", "reason", "budget")
+			return false
+		}
+	}
+	h.x.mu.Lock()
+	defer h.x.mu.Unlock()
+	return h.x.err == nil
+}
+
+func (h *historyLookup) window(s string) (time.Duration, error) {
+	d, err := parseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 || d > h.max {
+		return 0, fmt.Errorf("window %s must be positive and at most history_lookup.max_window (%s)", s, formatDuration(h.max))
+	}
+	return d, nil
+}
+
+// Count is the number of alerts of rule for user, a display name or an
+// entity ID, in the last window; any rule when rule is empty.
+func (h *historyLookup) Count(user, rule, window string) (historyValue, error) {
+	d, err := h.window(window)
+	if err != nil || !h.ready() {
+		return historyValue{}, err
+	}
+	cutoff := time.Now().Add(-d)
+	h.x.mu.Lock()
+	defer h.x.mu.Unlock()
+	n := 0
+	for _, ev := range h.x.byUser[user] {
+		if ev.at.After(cutoff) && (rule == "" || ev.rule == rule) {
+			n++
+		}
+	}
+	return historyValue{known: true, count: n}, nil
+}
+
+// LastSeen is when user last raised an alert for a path under prefix,
+// within max_window.
+func (h *historyLookup) LastSeen(user, prefix string) (historyValue, error) {
+	if !h.ready() {
+		return historyValue{time: true}, nil
+	}
+	h.x.mu.Lock()
+	defer h.x.mu.Unlock()
+	v := historyValue{known: true, time: true}
+	for _, ev := range h.x.byUser[user] {
+		if ev.path != "" && len(ev.path) >= len(prefix) && ev.path[:len(prefix)] == prefix && ev.at.After(v.last) {
+			v.last = ev.at
+		}
+	}
+	return v, nil
+}
+
+// historyValue is the answer to a lookup, which may be unknown: the
+// history is still loading past the budget or couldn't be read.
+type historyValue struct {
+	known bool
+	time  bool // from LastSeen
+	count int
+	last  time.Time // zero for never
+}
+
+// String renders the count, or the time it was last seen, "never" or
+// "unknown".
+func (v historyValue) String() string {
+	switch {
+	case !v.known:
+		return "unknown"
+	case !v.time:
+		return strconv.Itoa(v.count)
+	case v.last.IsZero():
+		return "never"
+	}
+	return v.last.UTC().Format("2006-01-02 15:04 UTC")
+}
+
+// Under reports whether a count is below n, as "true", "false" or
+// "unknown".
+func (v historyValue) Under(n int) string {
+	if !v.known {
+		return "unknown"
+	}
+	return strconv.FormatBool(v.count < n)
+}
+
+// Ago renders how long ago a time was, e.g. "3d", or "never" or
+// "unknown".
+func (v historyValue) Ago() string {
+	if !v.known || v.last.IsZero() {
+		return v.String()
+	}
+	switch d := time.Since(v.last); {
+	case d >= 24*time.Hour:
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	default:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+}
+
+// validateHistoryLookup checks history_lookup and fills in its defaults.
+func validateHistoryLookup(cfg *VaultConfig) error {
+	h := &cfg.HistoryLookup
+	if h.Budget == 0 {
+		h.Budget = Duration(defaultHistoryLookupBudget)
+	}
+	if h.Budget < 0 {
+		return &fieldError{"history_lookup.budget", "must be positive"}
+	}
+	if h.MaxWindow == 0 {
+		h.MaxWindow = Duration(defaultHistoryLookupMaxWindow)
+	}
+	if h.MaxWindow < 0 {
+		return &fieldError{"history_lookup.max_window", "must be positive"}
+	}
+	if h.MaxEvents == 0 {
+		h.MaxEvents = defaultHistoryLookupMaxEvents
+	}
+	if h.MaxEvents < 0 {
+		return &fieldError{"history_lookup.max_events", "must be positive"}
+	}
+	return nil
+}
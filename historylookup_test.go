@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const historyTestConfig = envTestBase + `
+rules:
+  - name: payments-read
+    paths: ["kv/data/payments/"]
+    severity: warning
+    message: 'Previous occurrences: {{.History.Count .User .Rule "30d"}} in the last 30 days. Last MFA-path alert: {{(.History.LastSeen .User "sys/mfa/").Ago}} ago.'
+  - name: payments-first-read
+    paths: ["kv/data/payments/"]
+    when: '{{(.History.Count .User .Rule "30d").Under 1}}'
+    message: 'First payments read.'
+`
+
+func historyLine(user, path string) string {
+	return `{"time":"` + time.Now().UTC().Format(time.RFC3339Nano) + `","type":"response","auth":{"display_name":"` + user +
+		`"},"request":{"id":"r-1","path":"` + path + `","operation":"read"}}`
+}
+
+// writeHistory writes a history file holding a record of each alert.
+func writeHistory(t *testing.T, alerts ...Alert) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	var data []byte
+	for i := range alerts {
+		line, err := json.Marshal(historyRecord{Time: alerts[i].Time, Backend: "discord", Alert: &alerts[i]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(append(data, line...), '\n')
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// historyAuditor loads historyTestConfig with history_file at path and
+// sets up the lookups audit mode would, until the test ends.
+func historyAuditor(t *testing.T, path string) *auditor {
+	t.Helper()
+	cfg, err := loadTestConfig(t, historyTestConfig+"history_file: "+path+"\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := alertIndex
+	alertIndex = openHistoryIndex(cfg)
+	t.Cleanup(func() { alertIndex = prev })
+	<-alertIndex.loaded
+	return newAuditor(cfg)
+}
+
+func pastAlert(id, user, rule, path string, ago time.Duration) Alert {
+	return Alert{ID: id, User: user, Rule: rule, Path: path, Time: time.Now().Add(-ago)}
+}
+
+// An alert counts for the next entry in the same run, on top of what the
+// history file held, and each alert counts once.
+func TestHistoryLookupSameRun(t *testing.T) {
+	path := writeHistory(t,
+		pastAlert("a-1", "oidc-bob", "payments-read", "kv/data/payments/db", 48*time.Hour),
+		pastAlert("a-1", "oidc-bob", "payments-read", "kv/data/payments/db", 48*time.Hour), // a second delivery
+		pastAlert("a-2", "oidc-bob", "payments-read", "kv/data/payments/db", 40*24*time.Hour),
+		pastAlert("a-3", "oidc-bob", "mfa-change", "sys/mfa/method/totp", 3*24*time.Hour))
+	a := historyAuditor(t, path)
+	sent := captureAlerts(t)
+
+	var got []string
+	for i := 0; i < 3; i++ {
+		a.processAuditLine(historyLine("oidc-bob", "kv/data/payments/db"))
+		got = append(got, alertRules(sent()))
+	}
+	a.processAuditLine(historyLine("oidc-carol", "kv/data/payments/db"))
+	carol := sent()
+	if strings.Join(got, "; ") != "payments-read payments-first-read; payments-read; payments-read" {
+		t.Errorf("bob's alerts = %q, want his first read of this run alone flagged", got)
+	}
+	if rules := alertRules(carol); rules != "payments-read payments-first-read" {
+		t.Errorf("carol's alerts = %q, want her first read flagged", rules)
+	}
+	if d := carol[0].Description; !strings.Contains(d, "Previous occurrences: 0 in the last 30 days") || !strings.Contains(d, "alert: never ago") {
+		t.Errorf("carol's description = %q, want no occurrences", d)
+	}
+
+	// Each of bob's reads counts for the next: 1 from the file, then
+	// the alerts raised above.
+	for i, want := range []string{"4 in the last 30 days", "5 in the last 30 days"} {
+		a.processAuditLine(historyLine("oidc-bob", "kv/data/payments/db"))
+		alerts := sent()
+		if len(alerts) != 1 || !strings.Contains(alerts[0].Description, want) || !strings.Contains(alerts[0].Description, "alert: 3d ago") {
+			t.Errorf("read %d: alerts = %+v, want %q and the MFA alert 3d ago", i+4, alerts, want)
+		}
+	}
+}
+
+// Alerts raised while the file loads are counted once they are in, and
+// not twice when the file has them too.
+func TestHistoryLookupRaisedWhileLoading(t *testing.T) {
+	a := pastAlert("a-1", "oidc-bob", "r", "kv/data/x", time.Hour)
+	path := writeHistory(t, a, pastAlert("a-2", "oidc-bob", "r", "kv/data/x", 2*time.Hour))
+	cfg := HistoryLookupConfig{Budget: Duration(time.Second), MaxWindow: Duration(30 * 24 * time.Hour), MaxEvents: 100}
+	x := &historyIndex{cfg: cfg, loaded: make(chan struct{}), byUser: make(map[string][]historyEvent), seen: make(map[string]bool)}
+	x.add(a)
+	x.add(pastAlert("a-3", "oidc-bob", "r", "kv/data/x", 0))
+	x.load(path)
+	if v, err := x.lookup(cfg).Count("oidc-bob", "r", "1d"); err != nil || v.String() != "3" {
+		t.Errorf("count = %s, %v; want 3", v, err)
+	}
+}
+
+// A history still loading past the budget, or that failed to load,
+// answers unknown, and a when condition over it doesn't hold alerts back.
+func TestHistoryLookupUnknown(t *testing.T) {
+	cfg := HistoryLookupConfig{Budget: Duration(30 * time.Millisecond), MaxWindow: Duration(30 * 24 * time.Hour), MaxEvents: 100}
+	stuck := &historyIndex{cfg: cfg, loaded: make(chan struct{}), byUser: make(map[string][]historyEvent), seen: make(map[string]bool)}
+	before := metrics.sum("history_lookups_unknown_total")
+	h := stuck.lookup(cfg)
+	start := time.Now()
+	count, err := h.Count("oidc-bob", "", "1d")
+	last, _ := h.LastSeen("oidc-bob", "sys/")
+	if err != nil || count.String() != "unknown" || count.Under(1) != "unknown" || last.String() != "unknown" || last.Ago() != "unknown" {
+		t.Errorf("lookups = %s, %s, %v; want unknown", count, last, err)
+	}
+	if took := time.Since(start); took > 300*time.Millisecond {
+		t.Errorf("lookups took %s with a 30ms budget for the evaluation", took)
+	}
+	if d := metrics.sum("history_lookups_unknown_total") - before; d != 1 {
+		t.Errorf("history_lookups_unknown_total grew by %v, want 1: the second lookup had no budget left", d)
+	}
+	if v, _ := (*historyIndex)(nil).lookup(cfg).Count("oidc-bob", "", "1d"); v.String() != "unknown" {
+		t.Errorf("without history_file: %s, want unknown", v)
+	}
+
+	broken := filepath.Join(t.TempDir(), "history.jsonl")
+	if err := os.WriteFile(broken, []byte("{not json\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	a := historyAuditor(t, broken)
+	sent := captureAlerts(t)
+	a.processAuditLine(historyLine("oidc-bob", "kv/data/payments/db"))
+	alerts := sent()
+	if rules := alertRules(alerts); rules != "payments-read payments-first-read" {
+		t.Fatalf("alerts = %q, want both rules to fire on an unknown history", rules)
+	}
+	if d := alerts[0].Description; !strings.Contains(d, "Previous occurrences: unknown in the last 30 days") {
+		t.Errorf("description = %q, want unknown", d)
+	}
+}
+
+func TestHistoryLookups(t *testing.T) {
+	cfg := HistoryLookupConfig{Budget: Duration(time.Second), MaxWindow: Duration(30 * 24 * time.Hour), MaxEvents: 3}
+	x := &historyIndex{cfg: cfg, loaded: make(chan struct{}), byUser: make(map[string][]historyEvent), seen: make(map[string]bool)}
+	close(x.loaded)
+	entity := pastAlert("a-1", "oidc-bob", "r1", "sys/mfa/method/totp", 5*time.Hour)
+	entity.EntityID = "e-bob"
+	x.add(entity)
+	x.add(pastAlert("a-2", "oidc-bob", "r2", "secret/data/x", 2*time.Hour))
+	x.add(pastAlert("a-3", "oidc-bob", "r1", "secret/data/y", 10*time.Minute))
+	x.add(Alert{ID: "a-4", Rule: "r1", Time: time.Now()}) // no identity: not indexed
+	h := x.lookup(cfg)
+
+	counts := []struct {
+		user, rule, window, want string
+	}{
+		{"oidc-bob", "r1", "1d", "2"},
+		{"oidc-bob", "", "1d", "3"},
+		{"oidc-bob", "r1", "1h", "1"},
+		{"e-bob", "", "1d", "1"},
+		{"oidc-carol", "", "1d", "0"},
+	}
+	for _, tt := range counts {
+		if v, err := h.Count(tt.user, tt.rule, tt.window); err != nil || v.String() != tt.want {
+			t.Errorf("Count(%s, %s, %s) = %s, %v; want %s", tt.user, tt.rule, tt.window, v, err, tt.want)
+		}
+	}
+	if _, err := h.Count("oidc-bob", "", "31d"); err == nil || !strings.Contains(err.Error(), "at most history_lookup.max_window") {
+		t.Errorf("a window past max_window: err = %v", err)
+	}
+	if v, _ := h.LastSeen("oidc-bob", "sys/mfa/"); v.Ago() != "5h" {
+		t.Errorf("LastSeen sys/mfa/ = %s ago, want 5h", v.Ago())
+	}
+	if v, _ := h.LastSeen("oidc-bob", "secret/"); v.Ago() != "10m" {
+		t.Errorf("LastSeen secret/ = %s ago, want 10m", v.Ago())
+	}
+	if v, _ := h.LastSeen("oidc-bob", "pki/"); v.String() != "never" {
+		t.Errorf("LastSeen pki/ = %s, want never", v)
+	}
+
+	// Past max_events the oldest goes, from every identity it was under.
+	x.add(pastAlert("a-5", "oidc-bob", "r2", "secret/data/z", 0))
+	if v, _ := h.Count("e-bob", "", "1d"); v.String() != "0" {
+		t.Errorf("e-bob's count = %s after its alert was evicted, want 0", v)
+	}
+	if v, _ := h.Count("oidc-bob", "", "1d"); v.String() != "3" {
+		t.Errorf("oidc-bob's count = %s, want max_events", v)
+	}
+}
+
+func TestHistoryLookupWindowAtLoad(t *testing.T) {
+	_, err := loadTestConfig(t, envTestBase+`rules:
+  - name: a
+    paths: [x]
+    message: '{{.History.Count .User .Rule "120d"}}'
+`)
+	if err == nil || !strings.Contains(err.Error(), "rules[0].message") || !strings.Contains(err.Error(), "at most history_lookup.max_window (90d)") {
+		t.Errorf("err = %v, want the window rejected", err)
+	}
+}
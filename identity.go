@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Identity ---
+
+const (
+	defaultIdentityRefresh     = 15 * time.Minute
+	defaultIdentityMaxEntities = 100000
+	shortEntityID              = 8
+)
+
+// IdentityConfig resolves the entity IDs in audit entries to entity names
+// and aliases through the Identity API. Display names collide across auth
+// mounts; entity IDs don't.
+type IdentityConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Token needs list and read on identity/entity/id.
+	Token       string   `yaml:"token"`
+	Refresh     Duration `yaml:"refresh"`
+	MaxEntities int      `yaml:"max_entities"`
+}
+
+type entityAlias struct {
+	Name          string `json:"name"`
+	MountAccessor string `json:"mount_accessor"`
+	MountPath     string `json:"mount_path"`
+	MountType     string `json:"mount_type"`
+}
+
+type entityInfo struct {
+	Name    string        `json:"name"`
+	Aliases []entityAlias `json:"aliases"`
+}
+
+// alias picks the alias an entry was made through. Login requests name
+// their mount; otherwise Vault's display name is "<mount path>-<alias>",
+// without the auth/ prefix.
+func (ei *entityInfo) alias(e *AuditEntry) *entityAlias {
+	for i := range ei.Aliases {
+		a := &ei.Aliases[i]
+		if strings.HasPrefix(e.Request.Path, "auth/") && a.MountAccessor == e.Request.MountAccessor {
+			return a
+		}
+		mount := strings.TrimPrefix(strings.Trim(a.MountPath, "/"), "auth/")
+		if e.Auth.DisplayName == mount+"-"+a.Name {
+			return a
+		}
+	}
+	if len(ei.Aliases) == 1 {
+		return &ei.Aliases[0]
+	}
+	return nil
+}
+
+// identityCache holds the entity list from the last sync. Entities created
+// since are looked up one by one when they first appear in an alert. A nil
+// *identityCache resolves nothing.
+type identityCache struct {
+	cfg     IdentityConfig
+	address string
+	client  *http.Client
+	timeout time.Duration // per lookup
+
+	mu       sync.Mutex
+	entities map[string]*entityInfo
+	misses   map[string]time.Time // IDs Vault didn't know, until the next sync
+}
+
+func newIdentityCache(cfg *VaultConfig) (*identityCache, error) {
+	if !cfg.Identity.Enabled {
+		return nil, nil
+	}
+	client, err := newVaultClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &identityCache{cfg: cfg.Identity, address: cfg.Address, client: client, timeout: cfg.Timeouts.of(opAPI),
+		entities: make(map[string]*entityInfo), misses: make(map[string]time.Time)}, nil
+}
+
+func (c *identityCache) get(ctx context.Context, method, path string, out interface{}) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.address+"/v1/"+path, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("X-Vault-Token", c.cfg.Token)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, fmt.Errorf("%s %s returned %d", method, path, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return resp.StatusCode, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return resp.StatusCode, nil
+}
+
+// sync replaces the cache with Vault's entity list.
+func (c *identityCache) sync(ctx context.Context) error {
+	var body struct {
+		Data struct {
+			KeyInfo map[string]*entityInfo `json:"key_info"`
+		} `json:"data"`
+	}
+	status, err := c.get(ctx, "LIST", "identity/entity/id", &body)
+	if err != nil && status != http.StatusNotFound { // 404: no entities yet
+		metrics.inc("identity_sync_errors_total")
+		return fmt.Errorf("identity sync: %w", err)
+	}
+	entities := make(map[string]*entityInfo, len(body.Data.KeyInfo))
+	for id, ei := range body.Data.KeyInfo {
+		if len(entities) >= c.cfg.MaxEntities {
+			logWarn("⚠️  Identity: {entities} entities, caching the first {max}", "entities", len(body.Data.KeyInfo), "max", c.cfg.MaxEntities)
+			break
+		}
+		if ei != nil {
+			entities[id] = ei
+		}
+	}
+	c.mu.Lock()
+	c.entities = entities
+	c.misses = make(map[string]time.Time)
+	c.mu.Unlock()
+	metrics.set("identity_entities", float64(len(entities)))
+	return nil
+}
+
+// lookup returns the entity for id, reading it from Vault on a miss
+// within ctx and the API timeout. A failed or unknown lookup isn't
+// retried until the next sync; only a failed one returns an error.
+func (c *identityCache) lookup(ctx context.Context, id string) (*entityInfo, error) {
+	c.mu.Lock()
+	ei, missed := c.entities[id], !c.misses[id].IsZero()
+	c.mu.Unlock()
+	if ei != nil || missed {
+		return ei, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	var body struct {
+		Data *entityInfo `json:"data"`
+	}
+	status, err := c.get(ctx, http.MethodGet, "identity/entity/id/"+url.PathEscape(id), &body)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil || body.Data == nil {
+		c.misses[id] = time.Now()
+		metrics.inc("identity_lookup_misses_total")
+		if status == http.StatusNotFound {
+			err = nil
+		}
+		return nil, err
+	}
+	if len(c.entities) < c.cfg.MaxEntities {
+		c.entities[id] = body.Data
+	}
+	return body.Data, nil
+}
+
+// annotate copies the entry's identity onto an alert, resolving the entity
+// when the cache is enabled.
+func (c *identityCache) annotate(a *Alert, e *AuditEntry) {
+	var ei *entityInfo
+	if c != nil && e.Auth.EntityID != "" {
+		ei, _ = c.lookup(context.Background(), e.Auth.EntityID)
+	}
+	annotateIdentity(a, e, ei)
+}
+
+// annotateIdentity copies the entry's identity onto an alert, with the
+// entity's name and the alias used when ei is known.
+func annotateIdentity(a *Alert, e *AuditEntry, ei *entityInfo) {
+	if a.User == "" {
+		a.User = e.Auth.DisplayName
+	}
+	a.EntityID, a.Accessor = e.Auth.EntityID, e.Auth.Accessor
+	if strings.HasPrefix(e.Request.Path, "auth/") {
+		a.MountAccessor, a.AuthMount = e.Request.MountAccessor, e.Request.MountType
+	}
+	if ei == nil {
+		return
+	}
+	a.EntityName = ei.Name
+	if alias := ei.alias(e); alias != nil {
+		a.MountAccessor, a.AuthMount = alias.MountAccessor, alias.MountType
+	}
+}
+
+func identityJob(c *identityCache) jobSpec {
+	return jobSpec{
+		name:    "identity-sync",
+		every:   time.Duration(c.cfg.Refresh),
+		timeout: time.Minute,
+		run:     c.sync,
+	}
+}
+
+// identityKey is what detectors count as one identity: the entity when
+// Vault reports one, since display names repeat across auth mounts.
+func identityKey(e *AuditEntry) string {
+	if e.Auth.EntityID != "" {
+		return e.Auth.EntityID
+	}
+	return e.Auth.DisplayName
+}
+
+// identityLabel renders an alert's identity as e.g.
+// "jsmith (ldap) — entity 0a1b2c3d…".
+func identityLabel(a *Alert) string {
+	name := a.User
+	if a.EntityName != "" {
+		name = a.EntityName
+	}
+	if a.AuthMount != "" {
+		name += " (" + a.AuthMount + ")"
+	}
+	if id := a.EntityID; id != "" {
+		if len(id) > shortEntityID {
+			id = id[:shortEntityID] + "…"
+		}
+		name = strings.TrimSpace(name + " — entity " + id)
+	}
+	return name
+}
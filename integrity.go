@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Audit Log Integrity ---
+
+const maxOutstandingRequests = 10000
+
+// IntegrityConfig enables tamper detection on the audit log. Vault writes a
+// request entry and a response entry with the same request.id for every
+// call; deleted lines leave one half of a pair behind.
+type IntegrityConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// How long a request may wait for its response before it counts as unpaired.
+	PairTimeout Duration `yaml:"pair_timeout"`
+	// Unpaired entries tolerated per window before alerting.
+	Threshold int      `yaml:"threshold"`
+	Window    Duration `yaml:"window"`
+	// How far entry timestamps may step backwards before alerting.
+	ClockSkew Duration `yaml:"clock_skew"`
+}
+
+// auditPairsState carries outstanding requests across an audit restart so
+// a pair split by the restart isn't reported.
+type auditPairsState struct {
+	Saved       time.Time            `json:"saved"`
+	Outstanding map[string]time.Time `json:"outstanding"`
+}
+
+type pendingRequest struct {
+	seen time.Time
+	// Restored from the state file: its response may have been written
+	// while we were down, so it never counts as unpaired.
+	restored bool
+}
+
+type integrityMonitor struct {
+	cfg     IntegrityConfig
+	store   *stateStore
+	started time.Time
+
+	mu          sync.Mutex
+	outstanding map[string]pendingRequest
+	latest      time.Time // newest entry timestamp seen
+	lastSweep   time.Time
+	unpaired    []unpairedEntry
+	windowStart time.Time
+	alerted     bool
+}
+
+type unpairedEntry struct {
+	id   string
+	kind string
+}
+
+func newIntegrityMonitor(cfg *VaultConfig) *integrityMonitor {
+	if !cfg.Integrity.Enabled {
+		return nil
+	}
+	m := &integrityMonitor{
+		cfg:         cfg.Integrity,
+		store:       newStateStore(cfg.StateFile),
+		started:     time.Now(),
+		outstanding: make(map[string]pendingRequest),
+	}
+	st, err := m.store.load()
+	if err != nil {
+		logWarn("⚠️  Integrity: could not restore outstanding requests: {error}", "error", err)
+		return m
+	}
+	if st.AuditPairs != nil {
+		cutoff := time.Now().Add(-time.Duration(m.cfg.PairTimeout))
+		for id, seen := range st.AuditPairs.Outstanding {
+			if seen.After(cutoff) {
+				m.outstanding[id] = pendingRequest{seen: seen, restored: true}
+			}
+		}
+	}
+	return m
+}
+
+// observe checks one audit entry and returns any alerts it triggers.
+func (m *integrityMonitor) observe(e *AuditEntry) []Alert {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var alerts []Alert
+	now := time.Now()
+
+	if t, err := time.Parse(time.RFC3339Nano, e.Time); err == nil {
+		if !m.latest.IsZero() && m.latest.Sub(t) > time.Duration(m.cfg.ClockSkew) {
+			alerts = append(alerts, Alert{Severity: sevWarning, Color: 0xe67e22, RequestID: e.Request.ID, Rule: "audit-integrity"}.say(
+				msgTimeBackwards.with(), msgTimeBackwardsBody.with("time", t.Format(time.RFC3339), "latest", m.latest.Format(time.RFC3339),
+					"earlier", m.latest.Sub(t).Round(time.Second))))
+		}
+		if t.After(m.latest) {
+			m.latest = t
+		}
+	}
+
+	m.expire(now)
+	if id := e.Request.ID; id != "" {
+		switch e.Type {
+		case "request":
+			if len(m.outstanding) >= maxOutstandingRequests {
+				m.dropOldest()
+			}
+			m.outstanding[id] = pendingRequest{seen: now}
+		case "response":
+			if _, ok := m.outstanding[id]; ok {
+				delete(m.outstanding, id)
+			} else if now.Sub(m.started) >= time.Duration(m.cfg.PairTimeout) {
+				// Earlier responses may belong to requests written
+				// while we were down.
+				m.addUnpaired(now, id, "responses without a request")
+			}
+		}
+	}
+
+	if a, ok := m.checkThreshold(); ok {
+		alerts = append(alerts, a)
+	}
+	return alerts
+}
+
+// expire moves requests that waited too long into the unpaired count.
+func (m *integrityMonitor) expire(now time.Time) {
+	if now.Sub(m.lastSweep) < time.Second {
+		return
+	}
+	m.lastSweep = now
+	timeout := time.Duration(m.cfg.PairTimeout)
+	for id, p := range m.outstanding {
+		if now.Sub(p.seen) < timeout {
+			continue
+		}
+		delete(m.outstanding, id)
+		if !p.restored {
+			m.addUnpaired(now, id, "requests without a response")
+		}
+	}
+}
+
+func (m *integrityMonitor) dropOldest() {
+	var oldest string
+	var seen time.Time
+	for id, p := range m.outstanding {
+		if oldest == "" || p.seen.Before(seen) {
+			oldest, seen = id, p.seen
+		}
+	}
+	delete(m.outstanding, oldest)
+}
+
+func (m *integrityMonitor) addUnpaired(now time.Time, id, kind string) {
+	if now.Sub(m.windowStart) >= time.Duration(m.cfg.Window) {
+		m.windowStart = now
+		m.unpaired = m.unpaired[:0]
+		m.alerted = false
+	}
+	m.unpaired = append(m.unpaired, unpairedEntry{id: id, kind: kind})
+}
+
+// checkThreshold alerts once per window when unpaired entries exceed the
+// noise threshold.
+func (m *integrityMonitor) checkThreshold() (Alert, bool) {
+	if m.alerted || len(m.unpaired) <= m.cfg.Threshold {
+		return Alert{}, false
+	}
+	m.alerted = true
+
+	counts := map[string]int{}
+	for _, u := range m.unpaired {
+		counts[u.kind]++
+	}
+	kinds := make([]string, 0, len(counts))
+	for k, n := range counts {
+		kinds = append(kinds, fmt.Sprintf("%s: %d", k, n))
+	}
+	sort.Strings(kinds)
+
+	ids := make([]string, 0, 5)
+	for i := 0; i < len(m.unpaired) && i < 5; i++ {
+		ids = append(ids, mdCode(m.unpaired[i].id, maxNameLen))
+	}
+	return Alert{Severity: sevCritical, Color: 0xe74c3c, Rule: "audit-integrity"}.say(msgUnpaired.with(),
+		msgUnpairedBody.with("counts", strings.Join(kinds, ", "), "since", m.windowStart.Format(time.RFC3339), "examples", strings.Join(ids, ", "))), true
+}
+
+var (
+	msgTimeBackwards     = message("audit-integrity.backwards.title")
+	msgTimeBackwardsBody = message("audit-integrity.backwards.body")
+	msgUnpaired          = message("audit-integrity.unpaired.title")
+	msgUnpairedBody      = message("audit-integrity.unpaired.body")
+)
+
+// save persists the outstanding requests for the next start.
+func (m *integrityMonitor) save() error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	out := make(map[string]time.Time, len(m.outstanding))
+	for id, p := range m.outstanding {
+		out[id] = p.seen
+	}
+	m.mu.Unlock()
+
+	return m.store.update(func(st *wardenState) {
+		st.AuditPairs = &auditPairsState{Saved: time.Now().UTC(), Outstanding: out}
+	})
+}
+
+// integrityJob saves the outstanding set regularly so a crash loses little.
+func integrityJob(m *integrityMonitor) jobSpec {
+	return jobSpec{
+		name:    "audit-integrity",
+		every:   30 * time.Second,
+		timeout: 10 * time.Second,
+		run:     func(ctx context.Context) error { return m.save() },
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// --- Unseal Key Sources ---
+
+const (
+	defaultKeyCommandTimeout = 30 * time.Second
+	maxKeyCommandStderr      = 1024
+)
+
+// Errors from unseal_keys_command, by how the command failed. The command
+// contract: print a JSON array of key shares on stdout and exit 0; exit 2
+// when access to the shares was denied; exit 3 when the source is
+// temporarily unavailable. Anything else is a generic failure.
+var (
+	errKeyCommandDenied      = errors.New("key command: access to key shares denied")
+	errKeyCommandUnavailable = errors.New("key command: key source temporarily unavailable")
+	errKeyCommandFailed      = errors.New("key command failed")
+	errKeyCommandTimeout     = errors.New("key command timed out")
+	errKeyCommandOutput      = errors.New("key command returned invalid output")
+	errKeyCommandUnsafe      = errors.New("key command failed safety checks")
+	errKeyFile               = errors.New("key file unreadable")
+)
+
+// keyFileScheme marks an unseal_keys entry whose share lives in its own
+// file, e.g. file:///etc/vault-warden/keys/1. The file is read only when
+// the share is submitted.
+const keyFileScheme = "file://"
+
+// keySource is where the unseal key shares come from. fetch returns them
+// as byte slices so they can be wiped with zeroKeys after use.
+type keySource interface {
+	kind() string // in metrics and messages; never key material
+	fetch() ([][]byte, error)
+}
+
+// inlineKeys are the unseal_keys from the config.
+type inlineKeys []string
+
+func (inlineKeys) kind() string { return "inline" }
+
+func (k inlineKeys) fetch() ([][]byte, error) {
+	keys := make([][]byte, len(k))
+	for i, s := range k {
+		keys[i] = []byte(s)
+	}
+	return keys, nil
+}
+
+// commandKeys runs unseal_keys_command.
+type commandKeys struct {
+	argv    []string
+	timeout time.Duration
+}
+
+func (commandKeys) kind() string { return "command" }
+
+func (c commandKeys) fetch() ([][]byte, error) { return runKeyCommand(c.argv, c.timeout) }
+
+// keySources lists the configured key sources.
+func keySources(cfg *VaultConfig) []keySource {
+	if len(cfg.UnsealKeysCommand) > 0 {
+		return []keySource{commandKeys{argv: cfg.UnsealKeysCommand, timeout: time.Duration(cfg.UnsealKeysCommandTimeout)}}
+	}
+	return []keySource{inlineKeys(cfg.UnsealKeys)}
+}
+
+// fetchKeys fetches from one source and records its latency, failures
+// and last success, apart from Vault's own errors. A failure names the
+// source and how long it took.
+func fetchKeys(src keySource) ([][]byte, time.Duration, error) {
+	start := time.Now()
+	keys, err := src.fetch()
+	took := time.Since(start)
+	metrics.observe("key_source_fetch_seconds", took.Seconds(), "source", src.kind())
+	if err != nil {
+		metrics.inc("key_source_failures_total", "source", src.kind())
+		return nil, took, fmt.Errorf("key source %s failed after %s: %w", src.kind(), took.Round(time.Millisecond), err)
+	}
+	metrics.set("key_source_last_success_timestamp_seconds", float64(time.Now().Unix()), "source", src.kind())
+	return keys, took, nil
+}
+
+// resolveShare returns a copy of share index's key material, reading it
+// from its file for a file:// entry, with trailing newlines trimmed. Files
+// are read one share at a time, so a missing file only matters once
+// Vault needs that share. The caller zeroes the result.
+func resolveShare(index int, share []byte) ([]byte, error) {
+	if !bytes.HasPrefix(share, []byte(keyFileScheme)) {
+		return append([]byte(nil), share...), nil
+	}
+	path := string(share[len(keyFileScheme):])
+	start := time.Now()
+	data, err := readKeyFile(path)
+	metrics.observe("key_source_fetch_seconds", time.Since(start).Seconds(), "source", "file")
+	if err != nil {
+		metrics.inc("key_source_failures_total", "source", "file")
+		return nil, fmt.Errorf("%w: key %d (%s): %v", errKeyFile, index, path, err)
+	}
+	metrics.set("key_source_last_success_timestamp_seconds", float64(time.Now().Unix()), "source", "file")
+	return data, nil
+}
+
+func readKeyFile(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, unwrapPathError(err)
+	}
+	if info.Mode().Perm()&0o044 != 0 {
+		logWarn("⚠️  Key file {path} is readable by group or others ({mode})", "path", path, "mode", info.Mode().Perm())
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, unwrapPathError(err)
+	}
+	key := bytes.TrimRight(data, "\r\n")
+	if len(key) == 0 {
+		zero(data)
+		return nil, errors.New("file is empty")
+	}
+	return key, nil
+}
+
+// unwrapPathError drops the path an *os.PathError repeats.
+func unwrapPathError(err error) error {
+	var pe *os.PathError
+	if errors.As(err, &pe) {
+		return pe.Err
+	}
+	return err
+}
+
+// loadUnsealKeys returns the unseal key shares from the configured source.
+func loadUnsealKeys(cfg *VaultConfig) ([][]byte, error) {
+	src := keySources(cfg)[0]
+	keys, took, err := fetchKeys(src)
+	if err != nil {
+		return nil, err
+	}
+	logInfo("🔑 Loaded {keys} key shares from {source} key source in {took}", "keys", len(keys), "source", src.kind(), "took", took.Round(time.Millisecond))
+	return keys, nil
+}
+
+// probeKeySources fetches from every source and wipes the shares at once,
+// for doctor and check-plugin. Only counts, timings and errors are kept.
+func probeKeySources(cfg *VaultConfig) []keySourceHealth {
+	var out []keySourceHealth
+	for _, src := range keySources(cfg) {
+		keys, took, err := fetchKeys(src)
+		h := keySourceHealth{source: src.kind(), shares: len(keys), took: took, err: err}
+		for i, k := range keys {
+			if h.err != nil {
+				break
+			}
+			key, err := resolveShare(i+1, k)
+			zero(key)
+			h.err = err
+		}
+		zeroKeys(keys)
+		out = append(out, h)
+	}
+	return out
+}
+
+type keySourceHealth struct {
+	source string
+	shares int
+	took   time.Duration
+	err    error
+}
+
+func (h keySourceHealth) String() string {
+	if h.err != nil {
+		return h.err.Error()
+	}
+	return fmt.Sprintf("key source %s: %d shares in %s", h.source, h.shares, h.took.Round(time.Millisecond))
+}
+
+func zeroKeys(keys [][]byte) {
+	for _, k := range keys {
+		zero(k)
+	}
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// checkKeyCommand refuses executables that someone other than the owner
+// could have replaced.
+func checkKeyCommand(path string) error {
+	if err := checkExecutable(path); err != nil {
+		return fmt.Errorf("%w: %v", errKeyCommandUnsafe, err)
+	}
+	return nil
+}
+
+// checkExecutable refuses paths that are relative, not executable, or
+// writable by anyone but the owner.
+func checkExecutable(path string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("%s is not an absolute path", path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0o022 != 0 {
+		return fmt.Errorf("%s is group- or world-writable (%s)", path, info.Mode().Perm())
+	}
+	if info.IsDir() || info.Mode().Perm()&0o111 == 0 {
+		return fmt.Errorf("%s is not executable", path)
+	}
+	return nil
+}
+
+// runKeyCommand executes argv directly (no shell) and parses its stdout as
+// a JSON array of shares. Stdout never appears in errors; stderr does,
+// truncated.
+func runKeyCommand(argv []string, timeout time.Duration) ([][]byte, error) {
+	if err := checkKeyCommand(argv[0]); err != nil {
+		return nil, err
+	}
+	if timeout == 0 {
+		timeout = defaultKeyCommandTimeout
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	// Own process group, so a timeout also kills anything the command
+	// spawned (which would otherwise hold stdout open).
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("%w: %v", errKeyCommandFailed, err)
+	}
+	defer zero(stdout.Bytes())
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(timeout):
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return nil, fmt.Errorf("%w after %s", errKeyCommandTimeout, timeout)
+	}
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) > maxKeyCommandStderr {
+			msg = msg[:maxKeyCommandStderr] + "..."
+		}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			base := errKeyCommandFailed
+			switch exitErr.ExitCode() {
+			case 2:
+				base = errKeyCommandDenied
+			case 3:
+				base = errKeyCommandUnavailable
+			}
+			return nil, fmt.Errorf("%w (exit %d): %s", base, exitErr.ExitCode(), msg)
+		}
+		return nil, fmt.Errorf("%w: %v", errKeyCommandFailed, err)
+	}
+
+	return parseKeyShares(stdout.Bytes())
+}
+
+// parseKeyShares decodes a JSON array of strings into byte slices without
+// going through Go strings, which could not be wiped afterwards.
+func parseKeyShares(data []byte) ([][]byte, error) {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%w: expected a JSON array of strings", errKeyCommandOutput)
+	}
+	keys := make([][]byte, 0, len(raw))
+	for i, r := range raw {
+		if len(r) < 2 || r[0] != '"' || r[len(r)-1] != '"' {
+			zeroKeys(keys)
+			return nil, fmt.Errorf("%w: element %d is not a string", errKeyCommandOutput, i+1)
+		}
+		if bytes.IndexByte(r, '\\') >= 0 {
+			zeroKeys(keys)
+			return nil, fmt.Errorf("%w: element %d contains escape sequences", errKeyCommandOutput, i+1)
+		}
+		keys = append(keys, r[1:len(r)-1])
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: no key shares", errKeyCommandOutput)
+	}
+	return keys, nil
+}
+
+// unsealRequestBody builds {"key": ..., "migrate": ...} by hand so the only
+// copy of the key is a buffer the caller can wipe.
+func unsealRequestBody(key []byte, migrate bool) []byte {
+	body := make([]byte, 0, len(key)+32)
+	body = append(body, `{"key":"`...)
+	for _, c := range key {
+		switch {
+		case c == '"' || c == '\\':
+			body = append(body, '\\', c)
+		case c < 0x20:
+			body = append(body, fmt.Sprintf(`\u%04x`, c)...)
+		default:
+			body = append(body, c)
+		}
+	}
+	body = append(body, '"')
+	if migrate {
+		body = append(body, `,"migrate":true`...)
+	}
+	return append(body, '}')
+}
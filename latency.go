@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --- Probe Latency ---
+
+const (
+	defaultLatencyWindow      = 5 * time.Minute
+	defaultLatencyBaseline    = time.Hour
+	defaultLatencyMinSamples  = 5
+	defaultLatencyGrowthFloor = 50 * time.Millisecond
+	// latencyTrendSlices is how many p95s a seal alert shows for the
+	// window leading up to it.
+	latencyTrendSlices = 5
+)
+
+// LatencyConfig turns the seal watch's probe round trips into an early
+// warning: a seal is often preceded by minutes of slow answers.
+type LatencyConfig struct {
+	Window Duration `yaml:"window"` // recent period the p95 is taken over
+	// Baseline is the period before the window that it is compared with.
+	Baseline Duration `yaml:"baseline"`
+	// P95Threshold alerts when the window's p95 exceeds it; 0 disables.
+	P95Threshold Duration `yaml:"p95_threshold"`
+	// GrowthFactor alerts when the window's p95 is this many times the
+	// baseline's; 0 disables. A p95 under GrowthFloor never counts as
+	// growth, so 2ms -> 8ms on an idle node stays quiet.
+	GrowthFactor float64  `yaml:"growth_factor"`
+	GrowthFloor  Duration `yaml:"growth_floor"`
+	MinSamples   int      `yaml:"min_samples"` // needed in the window, and in the baseline for growth
+}
+
+// latencySummary is a cluster's probe latency, shown in /statusz and
+// `status`. Only probes that got an answer count; a timeout is reported
+// as unreachable instead and would otherwise skew both periods.
+type latencySummary struct {
+	Samples    int     `json:"samples"`
+	P50        float64 `json:"p50_ms"`
+	P95        float64 `json:"p95_ms"`
+	P99        float64 `json:"p99_ms"`
+	Baseline   float64 `json:"baseline_p95_ms,omitempty"`
+	Degraded   bool    `json:"degraded,omitempty"`
+	WindowSecs float64 `json:"window_seconds"`
+}
+
+type latencySample struct {
+	at time.Time
+	d  time.Duration
+	// degraded samples are left out of the baseline, so a slowdown
+	// longer than the window doesn't become the new normal.
+	degraded bool
+}
+
+// latencyTracker keeps the answered probes of one cluster for the window
+// and the baseline before it. Like clusterWatcher it is goroutine-local.
+type latencyTracker struct {
+	cfg     LatencyConfig
+	samples []latencySample // oldest first
+	// lastBaseline stands in while a long slowdown leaves too few
+	// healthy samples to compute one.
+	lastBaseline time.Duration
+}
+
+func (l *latencyTracker) add(now time.Time, d time.Duration) {
+	l.samples = append(l.samples, latencySample{at: now, d: d})
+	cutoff := now.Add(-time.Duration(l.cfg.Window + l.cfg.Baseline))
+	drop := 0
+	for drop < len(l.samples) && !l.samples[drop].at.After(cutoff) {
+		drop++
+	}
+	l.samples = append(l.samples[:0], l.samples[drop:]...)
+}
+
+// between returns the latencies of samples in (from, to].
+func (l *latencyTracker) between(from, to time.Time, withDegraded bool) []time.Duration {
+	var out []time.Duration
+	for _, s := range l.samples {
+		if s.at.After(from) && !s.at.After(to) && (withDegraded || !s.degraded) {
+			out = append(out, s.d)
+		}
+	}
+	return out
+}
+
+// percentile is the nearest-rank percentile of ds, 0 < p <= 1.
+func percentile(ds []time.Duration, p float64) time.Duration {
+	if len(ds) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), ds...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := int(p*float64(len(sorted))+0.999999) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+func ms(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+
+type latencyCheck struct {
+	summary  latencySummary
+	p95      time.Duration
+	baseline time.Duration // 0 until there have been enough baseline samples
+	reason   string        // why the window is degraded; "" if it isn't
+}
+
+func (l *latencyTracker) check(now time.Time) latencyCheck {
+	windowStart := now.Add(-time.Duration(l.cfg.Window))
+	window := l.between(windowStart, now, true)
+	base := l.between(windowStart.Add(-time.Duration(l.cfg.Baseline)), windowStart, false)
+
+	c := latencyCheck{p95: percentile(window, 0.95)}
+	if len(base) >= l.cfg.MinSamples {
+		l.lastBaseline = percentile(base, 0.95)
+	}
+	c.baseline = l.lastBaseline
+	c.summary = latencySummary{Samples: len(window), P50: ms(percentile(window, 0.5)), P95: ms(c.p95),
+		P99: ms(percentile(window, 0.99)), Baseline: ms(c.baseline), WindowSecs: time.Duration(l.cfg.Window).Seconds()}
+	if len(window) < l.cfg.MinSamples {
+		return c
+	}
+	span := formatDuration(time.Duration(l.cfg.Window))
+	switch {
+	case l.cfg.P95Threshold > 0 && c.p95 > time.Duration(l.cfg.P95Threshold):
+		c.reason = fmt.Sprintf("p95 over the last %s is %s, above the %s threshold",
+			span, formatLatency(c.p95), formatLatency(time.Duration(l.cfg.P95Threshold)))
+	case l.cfg.GrowthFactor > 0 && c.baseline > 0 && c.p95 >= time.Duration(l.cfg.GrowthFloor) &&
+		float64(c.p95) > l.cfg.GrowthFactor*float64(c.baseline):
+		c.reason = fmt.Sprintf("p95 over the last %s is %s, %.1f× the %s of the %s before",
+			span, formatLatency(c.p95), float64(c.p95)/float64(c.baseline), formatLatency(c.baseline),
+			formatDuration(time.Duration(l.cfg.Baseline)))
+	}
+	c.summary.Degraded = c.reason != ""
+	return c
+}
+
+// trend renders the window's p95 in latencyTrendSlices steps, oldest
+// first, e.g. "40ms → 45ms → 1.2s → 2.5s → –".
+func (l *latencyTracker) trend(now time.Time) string {
+	step := time.Duration(l.cfg.Window) / latencyTrendSlices
+	start := now.Add(-time.Duration(l.cfg.Window))
+	parts := make([]string, latencyTrendSlices)
+	for i := range parts {
+		slice := l.between(start.Add(time.Duration(i)*step), start.Add(time.Duration(i+1)*step), true)
+		parts[i] = "–"
+		if len(slice) > 0 {
+			parts[i] = formatLatency(percentile(slice, 0.95))
+		}
+	}
+	return strings.Join(parts, " → ")
+}
+
+func formatLatency(d time.Duration) string {
+	if d >= time.Millisecond {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(time.Microsecond).String()
+}
+
+// recordLatency adds an answered probe and alerts when the window turns
+// degraded or recovers, once Confirm checks in a row agree.
+func (w *clusterWatcher) recordLatency(d time.Duration) {
+	now := time.Now()
+	w.latency.add(now, d)
+	c := w.latency.check(now)
+	w.latency.samples[len(w.latency.samples)-1].degraded = c.reason != ""
+	summary := c.summary
+	w.e.update(w.t.name, func(h *clusterHealth) { h.Latency = &summary })
+	for q, v := range map[string]float64{"0.5": summary.P50, "0.95": summary.P95, "0.99": summary.P99} {
+		metrics.set("watch_latency_seconds", v/1000, "cluster", w.t.name, "quantile", q)
+	}
+	if c.baseline > 0 {
+		metrics.set("watch_latency_baseline_seconds", c.baseline.Seconds(), "cluster", w.t.name)
+	}
+
+	if (c.reason != "") == w.slow {
+		w.slowAgree = 0
+		return
+	}
+	if w.slowAgree++; w.slowAgree < w.e.cfg.Confirm {
+		return
+	}
+	w.slow, w.slowAgree = c.reason != "", 0
+	name := cleanField(w.t.name, maxNameLen)
+	if w.slow {
+		logInfo("🐢 Seal watch: {node} slow: {reason}", "node", w.t.name, "reason", c.reason)
+		w.alert(Alert{Severity: sevWarning, Color: sevWarning.color(), Rule: "watch-latency", Incident: "latency:" + w.t.name}.say(
+			msgSlow.with("node", name), msgSlowBody.with("address", mdCode(w.t.cfg.Address, maxPathLen), "reason", c.reason, "trend", w.latency.trend(now))))
+		return
+	}
+	logInfo("🐢 Seal watch: {node} latency back to normal (p95 {p95})", "node", w.t.name, "p95", formatLatency(c.p95))
+	w.alert(Alert{Severity: sevInfo, Color: sevInfo.color(), Rule: "watch-latency", Incident: "latency:" + w.t.name, Resolved: true}.say(
+		msgLatencyNormal.with("node", name), msgLatencyNormalBody.with("address", mdCode(w.t.cfg.Address, maxPathLen),
+			"window", formatDuration(time.Duration(w.latency.cfg.Window)), "p95", formatLatency(c.p95))))
+}
+
+var (
+	msgSlow              = message("watch-latency.slow.title")
+	msgSlowBody          = message("watch-latency.slow.body")
+	msgLatencyNormal     = message("watch-latency.normal.title")
+	msgLatencyNormalBody = message("watch-latency.normal.body")
+)
+
+// daemonLatency asks a running warden for its clusters' probe latency.
+// It returns nil quickly when none is running.
+func daemonLatency(cfg *VaultConfig) map[string]*latencySummary {
+	c := adminClient(cfg)
+	c.Timeout, c.Retries = time.Second, -1
+	raw, err := c.Status(context.Background())
+	if err != nil {
+		return nil
+	}
+	var st wardenStatus
+	if json.Unmarshal(raw.Raw, &st) != nil {
+		return nil
+	}
+	out := make(map[string]*latencySummary)
+	for _, c := range st.Clusters {
+		if c.Latency != nil {
+			out[c.Name] = c.Latency
+		}
+	}
+	return out
+}
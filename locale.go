@@ -0,0 +1,389 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// --- Notification Localization ---
+
+const defaultLocale = "en"
+
+// LocalizationConfig picks the language of built-in notification text:
+// detector titles and descriptions, field labels and remediation notes.
+// Titles and messages written in the config are sent as written.
+type LocalizationConfig struct {
+	Locale string `yaml:"locale"` // en (default), ja, or one from catalogs
+	// Destinations overrides the locale per destination, named as in
+	// content_policies.
+	Destinations map[string]string `yaml:"destinations"`
+	// Catalogs are extra catalog files. One for a built-in locale
+	// overrides its messages; any other adds a locale.
+	Catalogs []string `yaml:"catalogs"`
+}
+
+// catalogFile is the format of locales/*.yaml and of extra catalogs.
+type catalogFile struct {
+	Locale   string            `yaml:"locale"`
+	Messages map[string]string `yaml:"messages"`
+}
+
+//go:embed locales/*.yaml
+var embeddedCatalogs embed.FS
+
+// msgID names a catalog message. IDs are declared with message, and the
+// English catalog must have every one declared.
+type msgID string
+
+var messageIDs []msgID
+
+func message(id string) msgID {
+	messageIDs = append(messageIDs, msgID(id))
+	return msgID(id)
+}
+
+// localText is a message with the values of its {name} placeholders, in
+// name/value pairs. A value may itself be a localText, rendered in the
+// same locale, a []localText, rendered one per line, or a localList; the
+// zero localText renders as "".
+type localText struct {
+	id   msgID
+	args []interface{}
+}
+
+func (id msgID) with(kv ...interface{}) localText { return localText{id, kv} }
+
+// localList is messages run together with a localized separator, such as
+// "; ".
+type localList struct {
+	sep   msgID
+	items []localText
+}
+
+// String renders t in English.
+func (t localText) String() string { return english.render(t) }
+
+// alertText is what of an alert's title and description is built-in
+// text, kept so each destination can have it in its own locale.
+type alertText struct {
+	title, body localText
+}
+
+// say sets the alert's title and description from built-in messages, in
+// English. A zero message leaves its part as it is.
+func (a Alert) say(title, body localText) Alert {
+	if title.id != "" {
+		a.Title = title.String()
+	}
+	if body.id != "" {
+		a.Description = body.String()
+	}
+	a.Text = alertText{title, body}
+	return a
+}
+
+// titleText and bodyText are the title and description as values for
+// another message, keeping their built-in text localizable.
+func (a *Alert) titleText() interface{} {
+	if a.Text.title.id != "" {
+		return a.Text.title
+	}
+	return a.Title
+}
+
+func (a *Alert) bodyText() interface{} {
+	if a.Text.body.id != "" {
+		return a.Text.body
+	}
+	return a.Description
+}
+
+// catalog is one locale's messages.
+type catalog struct {
+	locale   string
+	messages map[msgID]string
+}
+
+// render fills in t's template, falling back to English for a message
+// the catalog lacks, and to the message ID for one English lacks too.
+func (c *catalog) render(t localText) string {
+	if t.id == "" {
+		return ""
+	}
+	tmpl, ok := c.messages[t.id]
+	if !ok {
+		if tmpl, ok = english.messages[t.id]; !ok {
+			tmpl = string(t.id)
+		}
+	}
+	values := make(map[string]interface{}, len(t.args)/2)
+	for i := 0; i+1 < len(t.args); i += 2 {
+		if k, ok := t.args[i].(string); ok {
+			values[k] = t.args[i+1]
+		}
+	}
+	return logPlaceholder.ReplaceAllStringFunc(tmpl, func(p string) string {
+		switch v := values[p[1:len(p)-1]].(type) {
+		case nil:
+			return ""
+		case localText:
+			return c.render(v)
+		case []localText:
+			lines := make([]string, len(v))
+			for i, t := range v {
+				lines[i] = c.render(t)
+			}
+			return strings.Join(lines, "\n")
+		case localList:
+			items := make([]string, len(v.items))
+			for i, t := range v.items {
+				items[i] = c.render(t)
+			}
+			return strings.Join(items, c.text(v.sep))
+		default:
+			return fmt.Sprint(v)
+		}
+	})
+}
+
+func (c *catalog) text(id msgID) string { return c.render(localText{id: id}) }
+
+// missing lists the declared messages c lacks, sorted.
+func (c *catalog) missing() []string {
+	var out []string
+	for _, id := range messageIDs {
+		if _, ok := c.messages[id]; !ok {
+			out = append(out, string(id))
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func parseCatalog(data []byte, name string) (*catalog, error) {
+	var f catalogFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if f.Locale == "" {
+		return nil, fmt.Errorf("%s: no locale", name)
+	}
+	c := &catalog{locale: f.Locale, messages: make(map[msgID]string, len(f.Messages))}
+	for k, v := range f.Messages {
+		c.messages[msgID(k)] = v
+	}
+	return c, nil
+}
+
+// builtinCatalogs are the embedded catalogs by locale.
+var builtinCatalogs = func() map[string]*catalog {
+	entries, err := embeddedCatalogs.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	out := make(map[string]*catalog, len(entries))
+	for _, e := range entries {
+		data, err := embeddedCatalogs.ReadFile("locales/" + e.Name())
+		if err != nil {
+			panic(err)
+		}
+		c, err := parseCatalog(data, "locales/"+e.Name())
+		if err != nil {
+			panic(err)
+		}
+		out[c.locale] = c
+	}
+	return out
+}()
+
+var english = builtinCatalogs[defaultLocale]
+
+// localeSet is the catalogs loaded for a config and the locale of each
+// destination.
+type localeSet struct {
+	catalogs map[string]*catalog
+	locale   string
+	dest     map[string]string
+}
+
+// locales is the process-wide set; openSinks loads the config's.
+var locales = &localeSet{catalogs: builtinCatalogs, locale: defaultLocale}
+
+// loadLocales reads the config's catalogs on top of the built-in ones.
+func loadLocales(cfg *VaultConfig) (*localeSet, error) {
+	set := &localeSet{catalogs: make(map[string]*catalog), locale: cfg.Localization.Locale, dest: cfg.Localization.Destinations}
+	if set.locale == "" {
+		set.locale = defaultLocale
+	}
+	for k, c := range builtinCatalogs {
+		set.catalogs[k] = c
+	}
+	for _, path := range cfg.Localization.Catalogs {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		c, err := parseCatalog(data, path)
+		if err != nil {
+			return nil, err
+		}
+		if base := set.catalogs[c.locale]; base != nil {
+			merged := &catalog{locale: c.locale, messages: make(map[msgID]string, len(base.messages))}
+			for k, v := range base.messages {
+				merged.messages[k] = v
+			}
+			for k, v := range c.messages {
+				merged.messages[k] = v
+			}
+			c = merged
+		}
+		set.catalogs[c.locale] = c
+	}
+	return set, nil
+}
+
+// openLocales loads the config's locales for openSinks and warns once
+// about every message a locale in use lacks. Those go out in English.
+func openLocales(cfg *VaultConfig) *localeSet {
+	set, err := loadLocales(cfg)
+	if err != nil {
+		logWarn("⚠️  Localization: {error}; notifications are sent in English", "error", err)
+		return &localeSet{catalogs: builtinCatalogs, locale: defaultLocale}
+	}
+	// English is the fallback for every other locale, so a gap in it is a
+	// bug, which TestMessageIDsInEnglishCatalog catches before a release.
+	if gaps := english.missing(); len(gaps) > 0 {
+		logWarn("⚠️  Locale {locale} lacks {count} message(s), sent as their IDs: {ids}", "locale", defaultLocale, "count", len(gaps), "ids", strings.Join(gaps, ", "))
+	}
+	for _, l := range set.inUse() {
+		if gaps := set.catalogs[l].missing(); len(gaps) > 0 {
+			logWarn("🌐 Locale {locale} lacks {count} message(s), sent in English: {ids}", "locale", l, "count", len(gaps), "ids", strings.Join(gaps, ", "))
+		}
+	}
+	return set
+}
+
+// inUse lists the locales some destination is sent in, English aside.
+func (s *localeSet) inUse() []string {
+	all := []string{s.locale}
+	for _, dest := range sortedKeys(s.dest) {
+		all = append(all, s.dest[dest])
+	}
+	seen := map[string]bool{defaultLocale: true}
+	var out []string
+	for _, l := range all {
+		if !seen[l] {
+			seen[l] = true
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// names lists the locales loaded, for errors.
+func (s *localeSet) names() string {
+	names := make([]string, 0, len(s.catalogs))
+	for l := range s.catalogs {
+		names = append(names, l)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// of returns the locale dest is sent in.
+func (s *localeSet) of(dest string) string {
+	if l := s.dest[dest]; l != "" {
+		return l
+	}
+	return s.locale
+}
+
+func (s *localeSet) catalog(locale string) *catalog {
+	if c := s.catalogs[locale]; c != nil {
+		return c
+	}
+	return english
+}
+
+// The labels of an alert's fields in chat and email.
+var (
+	msgFieldUser        = message("field.user")
+	msgFieldPath        = message("field.path")
+	msgFieldOperation   = message("field.operation")
+	msgFieldSourceIP    = message("field.source_ip")
+	msgFieldCluster     = message("field.cluster")
+	msgFieldSource      = message("field.source")
+	msgFieldAuditFile   = message("field.audit_file")
+	msgFieldAuditHost   = message("field.audit_host")
+	msgFieldSeverity    = message("field.severity")
+	msgFieldSensitivity = message("field.sensitivity")
+	msgFieldRequestID   = message("field.request_id")
+)
+
+// label is a built-in string, such as a field name, in the locale the
+// alert is being sent in.
+func (a *Alert) label(id msgID) string {
+	return locales.catalog(a.Locale).text(id)
+}
+
+// localize returns a in dest's locale. The English renderings of its
+// built-in title, description and remediation notes are swapped for the
+// localized ones wherever they ended up, so the environment label and
+// anything else added around them stay.
+func localize(cfg *VaultConfig, a Alert, dest string) Alert {
+	a.Locale = locales.of(dest)
+	c := locales.catalog(a.Locale)
+	if c == english {
+		return a
+	}
+	swap := func(s, en, loc string) string {
+		if en == "" {
+			return s
+		}
+		return strings.Replace(s, en, loc, 1)
+	}
+	a.Title = swap(a.Title, english.render(a.Text.title), c.render(a.Text.title))
+	a.Description = swap(a.Description, english.render(a.Text.body), c.render(a.Text.body))
+	if cfg.includeRemediation() {
+		a.Description = swap(a.Description, remediationBlock(cfg, a, english), remediationBlock(cfg, a, c))
+	}
+	return a
+}
+
+// forDestination is a as dest gets it: in its locale, then cut down by
+// its content policy. It is false if dest must not get a at all.
+func forDestination(cfg *VaultConfig, a Alert, dest string) (Alert, bool) {
+	return applyContentPolicy(cfg, localize(cfg, a, dest), dest)
+}
+
+// validateLocalization checks that every locale named exists, loading
+// the extra catalogs to find out.
+func validateLocalization(cfg *VaultConfig) error {
+	lc := cfg.Localization
+	if lc.Locale == "" && len(lc.Destinations) == 0 && len(lc.Catalogs) == 0 {
+		return nil
+	}
+	set, err := loadLocales(cfg)
+	if err != nil {
+		return &fieldError{"localization.catalogs", err.Error()}
+	}
+	known := func(l string) bool { return set.catalogs[l] != nil }
+	if !known(set.locale) {
+		return &fieldError{"localization.locale", fmt.Sprintf("unknown locale %q (have %s)", set.locale, set.names())}
+	}
+	for dest, l := range lc.Destinations {
+		f := "localization.destinations." + dest
+		if !knownDestination(dest) {
+			return &fieldError{f, "is not a destination; use " + destinationNames()}
+		}
+		if !known(l) {
+			return &fieldError{f, fmt.Sprintf("unknown locale %q (have %s)", l, set.names())}
+		}
+	}
+	return nil
+}
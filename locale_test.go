@@ -0,0 +1,252 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// sourceMessageIDs finds every message ID the code names: the arguments
+// of message() and of msgID conversions. A non-literal ID can't be
+// checked, so it fails the test.
+func sourceMessageIDs(t *testing.T) map[string]string {
+	t.Helper()
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[string]string) // ID -> where
+	fset := token.NewFileSet()
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, name, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok || len(call.Args) != 1 {
+				return true
+			}
+			fn, ok := call.Fun.(*ast.Ident)
+			if !ok || fn.Name != "message" && fn.Name != "msgID" {
+				return true
+			}
+			if fn.Name == "message" && fn.Obj != nil && fn.Obj.Kind != ast.Fun {
+				return true // a variable called message
+			}
+			lit, ok := call.Args[0].(*ast.BasicLit)
+			if !ok || lit.Kind != token.STRING {
+				if fn.Name == "message" {
+					t.Errorf("%s: message() with a non-literal ID", fset.Position(call.Pos()))
+				}
+				return true
+			}
+			id, err := strconv.Unquote(lit.Value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids[id] = fset.Position(call.Pos()).String()
+			return true
+		})
+	}
+	return ids
+}
+
+func TestMessageIDsInEnglishCatalog(t *testing.T) {
+	ids := sourceMessageIDs(t)
+	if len(ids) < len(messageIDs)/2 {
+		t.Fatalf("found %d message IDs in the source, fewer than half of the %d declared", len(ids), len(messageIDs))
+	}
+	declared := make(map[msgID]bool, len(messageIDs))
+	for _, id := range messageIDs {
+		declared[id] = true
+	}
+	for id, where := range ids {
+		if _, ok := english.messages[msgID(id)]; !ok {
+			t.Errorf("%s: %s is not in locales/en.yaml", where, id)
+		}
+		if !declared[msgID(id)] && !strings.HasSuffix(where, "locale.go") {
+			t.Errorf("%s: %s is used without being declared with message()", where, id)
+		}
+	}
+	if gaps := english.missing(); len(gaps) > 0 {
+		t.Errorf("locales/en.yaml lacks %s", strings.Join(gaps, ", "))
+	}
+
+	// And nothing in the catalog that no code uses any more.
+	var stale []string
+	for id := range english.messages {
+		if _, ok := ids[string(id)]; !ok && !declared[id] {
+			stale = append(stale, string(id))
+		}
+	}
+	sort.Strings(stale)
+	if len(stale) > 0 {
+		t.Errorf("locales/en.yaml has messages no code uses: %s", strings.Join(stale, ", "))
+	}
+}
+
+// A message no catalog has, English included, is sent as its ID rather
+// than stopping the process.
+func TestMessageMissingFromEnglish(t *testing.T) {
+	id := msgID("no-such.message")
+	ja := builtinCatalogs["ja"]
+	if got := ja.render(localText{id: id}); got != "no-such.message" {
+		t.Errorf("ja render = %q, want the message ID", got)
+	}
+	if got := english.text(id); got != "no-such.message" {
+		t.Errorf("en text = %q, want the message ID", got)
+	}
+
+	prev := english.messages[msgFieldUser]
+	delete(english.messages, msgFieldUser)
+	t.Cleanup(func() { english.messages[msgFieldUser] = prev })
+	out := captureStdout(t, func() { openLocales(&VaultConfig{}) })
+	if !strings.Contains(out, "Locale en lacks 1 message(s), sent as their IDs: field.user") {
+		t.Errorf("startup log = %q, want the gap in English named", out)
+	}
+	if got := english.text(msgFieldUser); got != "field.user" {
+		t.Errorf("en field.user = %q, want the message ID", got)
+	}
+}
+
+func placeholders(s string) string {
+	ps := logPlaceholder.FindAllString(s, -1)
+	sort.Strings(ps)
+	return strings.Join(ps, " ")
+}
+
+// A translation fills in the values the English text does, no more.
+func TestCatalogPlaceholders(t *testing.T) {
+	for locale, c := range builtinCatalogs {
+		for id, text := range c.messages {
+			en, ok := english.messages[id]
+			if !ok {
+				t.Errorf("%s: %s is not an English message", locale, id)
+				continue
+			}
+			if got, want := placeholders(text), placeholders(en); got != want {
+				t.Errorf("%s: %s has placeholders %q, English has %q", locale, id, got, want)
+			}
+		}
+		if gaps := c.missing(); len(gaps) > 0 {
+			t.Errorf("built-in locale %s lacks %s", locale, strings.Join(gaps, ", "))
+		}
+	}
+}
+
+func writeCatalog(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "catalog.yaml")
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// A catalog that lacks messages falls back to English for them, and the
+// start warns once listing the gaps of each locale in use.
+func TestLocaleFallback(t *testing.T) {
+	fr := writeCatalog(t, "locale: fr\nmessages:\n  field.user: \"Utilisateur\"\n  audit-log-missing.title: \"🕳️ Journal d'audit absent\"\n")
+	jaOverride := writeCatalog(t, "locale: ja\nmessages:\n  field.user: \"利用者\"\n")
+	cfg := &VaultConfig{}
+	cfg.Localization = LocalizationConfig{Locale: "fr", Destinations: map[string]string{"mqtt": "en", "discord": "ja"}, Catalogs: []string{fr, jaOverride}}
+
+	var set *localeSet
+	out := captureStdout(t, func() { set = openLocales(cfg) })
+	if !strings.Contains(out, "Locale fr lacks") || !strings.Contains(out, "field.path") || !strings.Contains(out, "audit-log-missing.body") {
+		t.Errorf("startup log = %q, want fr's gaps listed", out)
+	}
+	if strings.Contains(out, "field.user") || strings.Contains(out, "Locale ja") || strings.Contains(out, "Locale en") {
+		t.Errorf("startup log = %q, want only fr's gaps", out)
+	}
+
+	c := set.catalog(set.of("webhook"))
+	if got := c.text(msgFieldUser); got != "Utilisateur" {
+		t.Errorf("fr field.user = %q", got)
+	}
+	if got, want := c.text(msgFieldPath), english.text(msgFieldPath); got != want {
+		t.Errorf("fr field.path = %q, want the English %q", got, want)
+	}
+	if got := set.catalog(set.of("discord")).text(msgFieldUser); got != "利用者" {
+		t.Errorf("ja override of field.user = %q", got)
+	}
+	if got, want := set.catalog(set.of("discord")).text(msgFieldPath), builtinCatalogs["ja"].text(msgFieldPath); got != want {
+		t.Errorf("ja field.path = %q, want the built-in %q", got, want)
+	}
+	if set.catalog(set.of("mqtt")) != english {
+		t.Error("mqtt isn't sent in English")
+	}
+	if builtinCatalogs["ja"].text(msgFieldUser) == "利用者" {
+		t.Error("the override changed the built-in catalog")
+	}
+}
+
+// Text from the config is sent as written; only the built-in text
+// around it is localized, per destination.
+func TestLocalizeCustomText(t *testing.T) {
+	prev := locales
+	t.Cleanup(func() { locales = prev })
+	cfg := &VaultConfig{}
+	cfg.Localization = LocalizationConfig{Locale: "ja", Destinations: map[string]string{"mqtt": "en"}}
+	locales = openLocales(cfg)
+
+	rule := compileAlertRules([]AlertRule{{Name: "root-policy", Severity: "critical", Title: "Root policy changed",
+		Paths: []string{"sys/policies/acl/"}, Message: "Page the on-call DBA."}})[0]
+	en := goldenEntry("sys/policies/acl/root", "update")
+	en.Auth.Accessor = "hmac-sha256:aa"
+	en.Session = []sessionAction{{Path: "sys/policies/acl/root", Operation: "read"}}
+	a, _ := rule.alert(en, nil, ruleScope{})
+
+	ja := localize(cfg, a, "discord")
+	if ja.Title != "Root policy changed" || !strings.Contains(ja.Description, "Page the on-call DBA.") {
+		t.Errorf("ja = %q %q, want the rule's text as written", ja.Title, ja.Description)
+	}
+	heading := builtinCatalogs["ja"].render(msgRuleRecent.with("count", 1, "session", formatSession(en.Session)))
+	if !strings.Contains(ja.Description, heading) || strings.Contains(ja.Description, msgRuleRecent.with("count", 1, "session", "").String()) {
+		t.Errorf("ja description = %q, want the recent activity heading in Japanese", ja.Description)
+	}
+	if ja.Locale != "ja" || ja.label(msgFieldUser) != builtinCatalogs["ja"].text(msgFieldUser) {
+		t.Errorf("ja locale = %q, label %q", ja.Locale, ja.label(msgFieldUser))
+	}
+	if mq := localize(cfg, a, "mqtt"); mq.Description != a.Description || mq.Title != a.Title || mq.Locale != "en" {
+		t.Errorf("mqtt = %+v, want the English alert", mq)
+	}
+
+	unseal := unsealAlert()
+	if got := localize(cfg, unseal, "discord"); got.Title != builtinCatalogs["ja"].render(unseal.Text.title) {
+		t.Errorf("unseal title = %q, want Japanese", got.Title)
+	}
+}
+
+func TestValidateLocalization(t *testing.T) {
+	fr := writeCatalog(t, "locale: fr\nmessages: {}\n")
+	tests := []struct {
+		lc   LocalizationConfig
+		want string
+	}{
+		{LocalizationConfig{}, ""},
+		{LocalizationConfig{Locale: "ja"}, ""},
+		{LocalizationConfig{Locale: "fr", Catalogs: []string{fr}}, ""},
+		{LocalizationConfig{Locale: "fr"}, `localization.locale unknown locale "fr" (have en, ja)`},
+		{LocalizationConfig{Destinations: map[string]string{"mqtt": "de"}}, `localization.destinations.mqtt unknown locale "de" (have en, ja)`},
+		{LocalizationConfig{Destinations: map[string]string{"pager": "ja"}}, "localization.destinations.pager is not a destination"},
+		{LocalizationConfig{Catalogs: []string{writeCatalog(t, "messages: {}\n")}}, "no locale"},
+		{LocalizationConfig{Catalogs: []string{filepath.Join(t.TempDir(), "none.yaml")}}, "no such file"},
+	}
+	for _, tt := range tests {
+		got := errString(validateLocalization(&VaultConfig{Localization: tt.lc}))
+		if tt.want == "" && got != "" || !strings.Contains(got, tt.want) {
+			t.Errorf("%+v: %q, want %q", tt.lc, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// --- Logging ---
+
+// LoggingConfig selects how console messages are written. The text
+// format is the emoji console output; json writes one object per line
+// for journald or Loki. -log-format and -log-level override it.
+type LoggingConfig struct {
+	Format string `yaml:"format"` // text (default) or json
+	Level  string `yaml:"level"`  // debug, info (default), warn or error
+}
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string { return logLevelNames[l] }
+
+func parseLogLevel(s string) (logLevel, error) {
+	for i, n := range logLevelNames {
+		if strings.EqualFold(s, n) {
+			return logLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown level %q (want debug, info, warn or error)", s)
+}
+
+// logger writes leveled records. A message is a template whose {name}
+// placeholders are filled from its fields, which alternate name and
+// value. The json format also carries every field on its own; the text
+// format appends those the message doesn't mention.
+type logger struct {
+	mu   sync.Mutex
+	json bool
+	min  logLevel
+}
+
+// logs is the process-wide logger. It writes to os.Stdout as it is at the
+// time, so commands that move console output to stderr move it too.
+var logs = &logger{min: levelInfo}
+
+// configure applies the config and the command-line overrides, which win
+// when set.
+func (l *logger) configure(cfg LoggingConfig, format, level string) error {
+	if format == "" {
+		format = cfg.Format
+	}
+	if level == "" {
+		level = cfg.Level
+	}
+	min := levelInfo
+	if level != "" {
+		var err error
+		if min, err = parseLogLevel(level); err != nil {
+			return err
+		}
+	}
+	if err := checkLogFormat(format); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.json, l.min = format == "json", min
+	l.mu.Unlock()
+	return nil
+}
+
+func checkLogFormat(s string) error {
+	switch s {
+	case "", "text", "json":
+		return nil
+	}
+	return fmt.Errorf("unknown format %q (want text or json)", s)
+}
+
+// validateLogging checks the logging settings.
+func validateLogging(cfg *VaultConfig) error {
+	if err := checkLogFormat(cfg.Logging.Format); err != nil {
+		return &fieldError{"logging.format", err.Error()}
+	}
+	if cfg.Logging.Level != "" {
+		if _, err := parseLogLevel(cfg.Logging.Level); err != nil {
+			return &fieldError{"logging.level", err.Error()}
+		}
+	}
+	return nil
+}
+
+func logDebug(msg string, kv ...interface{}) { logs.log(levelDebug, msg, kv...) }
+func logInfo(msg string, kv ...interface{})  { logs.log(levelInfo, msg, kv...) }
+func logWarn(msg string, kv ...interface{})  { logs.log(levelWarn, msg, kv...) }
+func logError(msg string, kv ...interface{}) { logs.log(levelError, msg, kv...) }
+
+var logPlaceholder = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+func (l *logger) log(level logLevel, msg string, kv ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if level < l.min {
+		return
+	}
+	fields := make(map[string]interface{}, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		if k, ok := kv[i].(string); ok {
+			fields[k] = logValue(kv[i+1])
+		}
+	}
+	used := make(map[string]bool, len(fields))
+	text := logPlaceholder.ReplaceAllStringFunc(msg, func(p string) string {
+		k := p[1 : len(p)-1]
+		if v, ok := fields[k]; ok {
+			used[k] = true
+			return fmt.Sprint(v)
+		}
+		return p
+	})
+	if !l.json {
+		// Fields the message doesn't mention follow it as [name=value],
+		// in the order given; empty ones are left out.
+		var b strings.Builder
+		b.WriteString(text)
+		for i := 0; i+1 < len(kv); i += 2 {
+			k, _ := kv[i].(string)
+			if v := fmt.Sprint(fields[k]); k != "" && !used[k] && v != "" && fields[k] != nil {
+				fmt.Fprintf(&b, " [%s=%s]", k, v)
+			}
+		}
+		fmt.Fprintln(os.Stdout, b.String())
+		return
+	}
+	// time, level and msg come first and win over fields of the same
+	// name; the fields follow in the order given.
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	put := func(k string, v interface{}) {
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		enc.Encode(k)
+		buf.Truncate(buf.Len() - 1)
+		buf.WriteByte(':')
+		if err := enc.Encode(v); err != nil {
+			enc.Encode(fmt.Sprint(v))
+		}
+		buf.Truncate(buf.Len() - 1)
+	}
+	buf.WriteByte('{')
+	put("time", time.Now().UTC().Format(time.RFC3339Nano))
+	put("level", level.String())
+	put("msg", plainMessage(text))
+	done := map[string]bool{"time": true, "level": true, "msg": true}
+	for i := 0; i+1 < len(kv); i += 2 {
+		if k, _ := kv[i].(string); k != "" && !done[k] {
+			done[k] = true
+			put(k, fields[k])
+		}
+	}
+	buf.WriteString("}\n")
+	os.Stdout.Write(buf.Bytes())
+}
+
+// logValue is how a field is recorded: errors, durations and times as
+// text, the rest as they marshal.
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case time.Time:
+		return v.UTC().Format(time.RFC3339)
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+// plainMessage drops the emoji and padding the text format leads with.
+func plainMessage(s string) string {
+	return strings.TrimLeftFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '`' && r != '"' && r != '('
+	})
+}
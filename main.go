@@ -2,28 +2,188 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
-
-	"github.com/nxadm/tail"
-	"gopkg.in/yaml.v3"
+	"unicode/utf8"
 )
 
+// version is set at build time: go build -ldflags "-X main.version=v1.2.3"
+var version = "dev"
+
+const defaultConfigPath = "/etc/vault-warden.yaml"
+
 // --- Shared Configuration & Structs ---
 
 type VaultConfig struct {
 	Address    string   `yaml:"address"`
 	UnsealKeys []string `yaml:"unseal_keys"`
-	WebhookURL string   `yaml:"webhook_url"`
-	AuditLog   string   `yaml:"audit_log"`
+	// Nodes are the cluster's nodes behind address, for the seal watch to
+	// tell one node restarting from the cluster going down.
+	Nodes []string `yaml:"nodes"`
+
+	// Vaults lists several clusters instead of the address and keys above.
+	Vaults            []VaultTarget  `yaml:"vaults"`
+	UnlockConcurrency int            `yaml:"unlock_concurrency"`
+	label             string         // of a cluster from Vaults
+	sharedTLS         VaultTLSConfig // VaultTLS before the first of Vaults replaced it
+
+	// UnlockStartupWait is how long unlock keeps retrying a node that is
+	// still starting up.
+	UnlockStartupWait Duration `yaml:"unlock_startup_wait"`
+
+	VaultTLS VaultTLSConfig `yaml:",inline"`
+	Timeouts TimeoutsConfig `yaml:"timeouts"`
+
+	// Alternative to unseal_keys: an executable printing a JSON array of
+	// shares. Requires allow_exec_key_source.
+	UnsealKeysCommand        []string `yaml:"unseal_keys_command"`
+	UnsealKeysCommandTimeout Duration `yaml:"unseal_keys_command_timeout"`
+	AllowExecKeySource       bool     `yaml:"allow_exec_key_source"`
+
+	// Notifier is the kind of webhook_url: discord, slack, teams or
+	// webhook, or email, which mails alerts instead. Inferred from the
+	// URL when unset, except webhook and email.
+	Notifier   string `yaml:"notifier"`
+	WebhookURL string `yaml:"webhook_url"`
+	// AuditLogs are the audit logs to follow: paths or glob patterns.
+	AuditLogs  auditLogList `yaml:"audit_log"`
+	AuditDedup DedupConfig  `yaml:"audit_dedup"`
+	// AuditLog is the first of them, which replays, forwarding,
+	// check-plugin, the missing-log monitor and the intake pause read.
+	AuditLog string `yaml:"-"`
+	// AuditSource is where entries come from: file, tailing audit_log,
+	// socket, listening on audit_socket for Vault's socket device, or
+	// syslog, receiving relayed messages on audit_syslog.
+	AuditSource string            `yaml:"audit_source"`
+	AuditSocket AuditSocketConfig `yaml:"audit_socket"`
+	AuditSyslog AuditSyslogConfig `yaml:"audit_syslog"`
+	StateFile   string            `yaml:"state_file"`
+	// ExpectedHosts are the hosts, or glob patterns, audit mode alerts
+	// from; elsewhere it starts in safe mode. Unset, any host will do.
+	ExpectedHosts []string `yaml:"expected_hosts"`
+
+	Position PositionConfig `yaml:"audit_position"`
+
+	Webhook WebhookConfig `yaml:"webhook"`
+	Email   EmailConfig   `yaml:"email"`
+
+	AllowSealMigration   bool `yaml:"allow_seal_migration"`
+	NotifyUnlockRefusals bool `yaml:"notify_unlock_refusals"`
+
+	// Authorization is what must approve an unseal before keys are
+	// submitted: none (the default), http, discord or file; see Approval.
+	// A cluster in Vaults can set its own.
+	Authorization string         `yaml:"authorization"`
+	Approval      ApprovalConfig `yaml:"approval"`
+
+	// SealToken is the Vault token of the seal command, used when neither
+	// -token nor VAULT_TOKEN is given. A cluster in Vaults can set its own.
+	SealToken string `yaml:"seal_token"`
+
+	// Details holds back the detail of critical alerts sent to Discord
+	// until someone asks for it.
+	Details DetailsConfig `yaml:"details"`
+
+	SelfUpdate   SelfUpdateConfig   `yaml:"self_update"`
+	RuleStats    RuleStatsConfig    `yaml:"rule_stats"`
+	ReloadCanary ReloadCanaryConfig `yaml:"reload_canary"`
+
+	// ContentPolicies sets per rule and destination how much an alert
+	// shows: full, minimal or silent.
+	ContentPolicies      contentPolicies `yaml:"content_policies"`
+	AllowSilenceCritical bool            `yaml:"allow_silence_critical"`
+	// QuietHours holds lesser alerts for a destination overnight, by
+	// destination; see quiethours.go.
+	QuietHours map[string]QuietHoursConfig `yaml:"quiet_hours"`
+
+	// IncludeRemediation, on when unset, adds suggested Vault commands to
+	// the alerts of built-in detectors; see remediation.go.
+	IncludeRemediation *bool `yaml:"include_remediation"`
+
+	Environment  string                       `yaml:"environment"`
+	Environments map[string]EnvironmentConfig `yaml:"environments"`
+
+	HistoryFile string        `yaml:"history_file"`
+	Signing     SigningConfig `yaml:"signing"`
+
+	Maintenance MaintenanceConfig `yaml:"maintenance"`
+
+	Queue  QueueConfig  `yaml:"queue"`
+	Intake IntakeConfig `yaml:"intake"`
+	MQTT   MQTTConfig   `yaml:"mqtt"`
+
+	Grafana   GrafanaConfig   `yaml:"grafana"`
+	PagerDuty PagerDutyConfig `yaml:"pagerduty"`
+	Metrics   MetricsConfig   `yaml:"metrics"`
+
+	// MetricsListen serves the metrics to Prometheus, e.g. ":9410".
+	MetricsListen string `yaml:"metrics_listen"`
+
+	Logging LoggingConfig `yaml:"logging"`
+	Canary  CanaryConfig  `yaml:"canary"`
+	Memory  MemoryConfig  `yaml:"memory"`
+
+	Localization LocalizationConfig `yaml:"localization"`
+
+	// Standby runs audit mode as a silent warm spare until promoted.
+	Standby bool        `yaml:"standby"`
+	Admin   AdminConfig `yaml:"admin"`
+
+	SessionIndex   SessionIndexConfig   `yaml:"session_index"`
+	Sampling       []SamplingRule       `yaml:"sampling"`
+	ExternalUnseal ExternalUnsealConfig `yaml:"external_unseal"`
+	Integrity      IntegrityConfig      `yaml:"integrity"`
+	FirstAccess    FirstAccessConfig    `yaml:"first_access"`
+	ReviewExport   ReviewExportConfig   `yaml:"review_export"`
+	Aggregation    []AggregationRule    `yaml:"aggregation"`
+	Watch          WatchConfig          `yaml:"watch"`
+	Identity       IdentityConfig       `yaml:"identity"`
+	Forward        ForwardConfig        `yaml:"forward"`
+	Receive        ReceiveConfig        `yaml:"receive"`
+	PKI            PKIConfig            `yaml:"pki"`
+	Tokens         TokenConfig          `yaml:"tokens"`
+	MissingLog     MissingLogConfig     `yaml:"missing_log"`
+	Sensitivity    SensitivityConfig    `yaml:"sensitivity"`
+	Watchdog       WatchdogConfig       `yaml:"watchdog"`
+	Posture        PostureConfig        `yaml:"posture"`
+	Enrichment     EnrichmentConfig     `yaml:"enrichment"`
+
+	// Rules are the path rules every audit entry is checked against;
+	// unset, defaultAlertRules. Their templates can look up past alerts
+	// in history_file, within history_lookup.
+	Rules         []AlertRule         `yaml:"rules"`
+	HistoryLookup HistoryLookupConfig `yaml:"history_lookup"`
+
+	// Plugins are detectors run as separate processes; see plugin.go.
+	Plugins          []PluginConfig `yaml:"plugins"`
+	AllowExecPlugins bool           `yaml:"allow_exec_plugins"`
+}
+
+// SessionIndexConfig controls the per-accessor activity index used to give
+// critical alerts some context. Off by default: memory grows with audit volume.
+type SessionIndexConfig struct {
+	Enabled            bool `yaml:"enabled"`
+	EntriesPerAccessor int  `yaml:"entries_per_accessor"`
+	MaxAccessors       int  `yaml:"max_accessors"`
+	Attach             int  `yaml:"attach"`
+}
+
+// ExternalUnsealConfig controls how audit mode decides whether a sys/unseal
+// submission came from this warden.
+type ExternalUnsealConfig struct {
+	AttributionWindow Duration `yaml:"attribution_window"`
+	KnownSources      []string `yaml:"known_sources"`
 }
 
 type VaultStatus struct {
@@ -31,271 +191,1469 @@ type VaultStatus struct {
 	Initialized bool   `json:"initialized"`
 	Progress    int    `json:"progress"`
 	Threshold   int    `json:"t"`
+
+	// Reported by sys/seal-status (and partly sys/health)
+	Type         string `json:"type"`
+	Shares       int    `json:"n"`
+	Nonce        string `json:"nonce"`
+	Migration    bool   `json:"migration"`
+	RecoverySeal bool   `json:"recovery_seal"`
+	StorageType  string `json:"storage_type"`
+	Version      string `json:"version"`
+	ClusterName  string `json:"cluster_name"`
+	ClusterID    string `json:"cluster_id"`
+
+	// Set instead of the above when Vault can't answer, e.g. an unreachable
+	// HSM seal backend
+	Errors []string `json:"errors"`
 }
 
 type AuditEntry struct {
+	Time    string `json:"time"`
+	Type    string `json:"type"`
 	Request struct {
-		Path string `json:"path"`
+		ID            string `json:"id"`
+		Path          string `json:"path"`
+		Operation     string `json:"operation"`
+		RemoteAddress string `json:"remote_address"`
+		MountAccessor string `json:"mount_accessor"`
+		MountType     string `json:"mount_type"`
+		// Data is kept raw; only the PKI and token detectors read it.
+		Data json.RawMessage `json:"data"`
 	} `json:"request"`
+	Response struct {
+		Data json.RawMessage `json:"data"`
+	} `json:"response"`
 	Auth struct {
 		DisplayName string `json:"display_name"`
+		Accessor    string `json:"accessor"`
+		EntityID    string `json:"entity_id"`
+		// Policies of the requesting token; read by the token detectors.
+		Policies policyList `json:"policies"`
 	} `json:"auth"`
 	Error string `json:"error"`
 }
 
 type DiscordEmbed struct {
-	Title       string `json:"title"`
-	Description string `json:"description"`
-	Color       int    `json:"color"`
-	Timestamp   string `json:"timestamp"`
+	Title       string         `json:"title"`
+	Description string         `json:"description"`
+	Color       int            `json:"color"`
+	Timestamp   string         `json:"timestamp"`
+	Author      *DiscordAuthor `json:"author,omitempty"`
+	Fields      []DiscordField `json:"fields,omitempty"`
+	Footer      *DiscordFooter `json:"footer,omitempty"`
+}
+
+type DiscordField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline,omitempty"`
+}
+
+type DiscordAuthor struct {
+	Name string `json:"name"`
+}
+
+type DiscordFooter struct {
+	Text string `json:"text"`
 }
 
 type DiscordPayload struct {
-	Embeds []DiscordEmbed `json:"embeds"`
+	Embeds          []DiscordEmbed          `json:"embeds"`
+	AllowedMentions *DiscordAllowedMentions `json:"allowed_mentions,omitempty"`
+}
+
+// DiscordAllowedMentions with an empty Parse list stops Discord from
+// resolving any mention in the message, whatever its text.
+type DiscordAllowedMentions struct {
+	Parse []string `json:"parse"`
 }
 
 // --- Helper Functions ---
 
-func readConfig(path string) (*VaultConfig, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, fmt.Errorf("open config: %w", err)
-	}
-	defer file.Close()
+const (
+	// Longer field values read badly on mobile and go into the
+	// description instead (Discord's own limit is 1024).
+	discordFieldMax = 256
+	// Values up to this length share a row with their neighbours.
+	discordInlineMax = 40
+)
 
-	var cfg VaultConfig
-	if err := yaml.NewDecoder(file).Decode(&cfg); err != nil {
-		return nil, fmt.Errorf("decode config: %w", err)
+// discordEmbed lays out an alert: the description holds the sentence, the
+// rule is the author, and each piece of structured context the alert
+// carries gets its own field. The request ID is included so it can be
+// quoted to support or grepped in Vault's own logs.
+func discordEmbed(a Alert) DiscordEmbed {
+	ts := a.Time
+	if ts.IsZero() {
+		ts = time.Now()
 	}
-
-	// Validate required fields
-	if cfg.Address == "" {
-		return nil, fmt.Errorf("address is required")
+	e := DiscordEmbed{
+		Title:       a.Title,
+		Description: a.Description,
+		Color:       a.Color,
+		Timestamp:   ts.Format(time.RFC3339),
+		Footer:      &DiscordFooter{Text: wardenSignature()},
 	}
-	if len(cfg.UnsealKeys) == 0 {
-		return nil, fmt.Errorf("unseal_keys is required")
+	if a.Minimal {
+		e.Footer.Text = "vault-warden" // without the host name
 	}
-	if cfg.WebhookURL == "" {
-		return nil, fmt.Errorf("webhook_url is required")
+	if a.Rule != "" {
+		e.Author = &DiscordAuthor{Name: cleanField(a.Rule, maxNameLen)}
 	}
 
-	return &cfg, nil
-}
+	var overflow []string
+	field := func(name, raw, rendered string) {
+		if raw == "" {
+			return
+		}
+		if utf8.RuneCountInString(rendered) > discordFieldMax {
+			overflow = append(overflow, "**"+name+":** "+rendered)
+			return
+		}
+		e.Fields = append(e.Fields, DiscordField{Name: name, Value: rendered,
+			Inline: utf8.RuneCountInString(raw) <= discordInlineMax})
+	}
+	user := identityLabel(&a)
+	field(a.label(msgFieldUser), user, mdText(user, maxNameLen))
+	field(a.label(msgFieldPath), a.Path, mdCode(a.Path, maxPathLen))
+	field(a.label(msgFieldOperation), a.Operation, mdText(a.Operation, maxNameLen))
+	field(a.label(msgFieldSourceIP), a.SourceIP, mdCode(a.SourceIP, maxNameLen))
+	field(a.label(msgFieldCluster), a.Cluster, mdText(a.Cluster, maxNameLen))
+	field(a.label(msgFieldSource), a.Source, mdText(a.Source, maxNameLen))
+	field(a.label(msgFieldAuditFile), a.AuditFile, mdCode(a.AuditFile, maxPathLen))
+	field(a.label(msgFieldAuditHost), a.AuditHost, mdCode(a.AuditHost, maxNameLen))
+	field(a.label(msgFieldSeverity), a.Severity.String(), a.Severity.String())
+	field(a.label(msgFieldSensitivity), a.Sensitivity, a.Sensitivity)
+	field(a.label(msgFieldRequestID), a.RequestID, mdCode(a.RequestID, maxNameLen))
+	for _, k := range sortedKeys(a.Enrichment) {
+		v := a.Enrichment[k]
+		field(cleanField(k, maxNameLen), v, mdText(v, maxNameLen))
+	}
 
-func sendDiscord(url, title, desc string, color int) error {
-	payload := DiscordPayload{
-		Embeds: []DiscordEmbed{{
-			Title:       title,
-			Description: desc,
-			Color:       color,
-			Timestamp:   time.Now().Format(time.RFC3339),
-		}},
+	if len(overflow) > 0 {
+		if e.Description != "" {
+			e.Description += "\n\n"
+		}
+		e.Description += strings.Join(overflow, "\n")
 	}
+	if a.Topology != nil {
+		if e.Description != "" {
+			e.Description += "\n\n"
+		}
+		e.Description += a.Topology.markdown()
+	}
+	fitEmbed(&e)
+	return e
+}
 
-	data, err := json.Marshal(payload)
+// wardenSignature identifies the sending instance, e.g. in embed footers.
+func wardenSignature() string {
+	host, err := os.Hostname()
 	if err != nil {
-		return fmt.Errorf("marshal payload: %w", err)
+		host = "unknown host"
 	}
+	return "vault-warden " + version + " on " + host
+}
+
+// notifyClient is shared by every webhook post; openSinks gives it the
+// configured dial limits.
+var notifyClient = &http.Client{}
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Post(url, "application/json", bytes.NewBuffer(data))
+// postWebhook posts one message to webhook_url, with any headers the
+// notifier adds. The notifier names itself in console messages and
+// errors, and judges the response.
+func postWebhook(cfg *VaultConfig, n notifier, data []byte, header http.Header) error {
+	kind := n.kind()
+	req, cancel, err := newOpRequest(cfg, opNotify, "POST", cfg.WebhookURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := notifyClient.Do(req)
 	if err != nil {
-		// Log but don't fail - Discord being down shouldn't break monitoring
-		fmt.Printf("⚠️  Discord webhook failed: %v\n", err)
+		// Log but don't fail - the chat service being down shouldn't break monitoring
+		logWarn("⚠️  Posting to {sink} failed: {error}", "sink", kind, "error", err)
 		return err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		fmt.Printf("⚠️  Discord returned %d: %s\n", resp.StatusCode, body)
-		return fmt.Errorf("discord returned status %d", resp.StatusCode)
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err := n.accept(resp.StatusCode, body); err != nil {
+		logWarn("⚠️  {sink} returned {status}: {body}", "sink", kind, "status", resp.StatusCode, "body", body)
+		se := &sinkStatusError{status: resp.StatusCode, err: fmt.Errorf("%s %w", kind, err)}
+		if s, perr := strconv.Atoi(resp.Header.Get("Retry-After")); perr == nil && s > 0 {
+			se.retryAfter = time.Duration(s) * time.Second
+		}
+		return se
 	}
 
 	return nil
 }
 
+// sinkStatusError is a message the sink answered but didn't take.
+type sinkStatusError struct {
+	status     int
+	retryAfter time.Duration // from Retry-After, if the sink gave one
+	err        error
+}
+
+func (e *sinkStatusError) Error() string { return e.err.Error() }
+func (e *sinkStatusError) Unwrap() error { return e.err }
+
+// permanentFailure reports whether sending again can't help: the sink
+// refused the message itself, with a 4xx other than 429 or an error in a
+// 2xx body. Network errors and 5xx responses are worth retrying.
+func permanentFailure(err error) bool {
+	var se *sinkStatusError
+	return errors.As(err, &se) && se.status != http.StatusTooManyRequests && se.status < 500
+}
+
+// Exit codes besides the generic 1, so timers and scripts can tell
+// deliberate refusals apart from failures.
+const (
+	exitNotInitialized   = 3
+	exitSealMigration    = 4
+	exitKeySource        = 5
+	exitCeremony         = 6
+	exitUnsupportedVault = 7
+	exitClusterBinding   = 8
+	exitNotApproved      = 9
+	exitSealed           = 10 // status only
+	exitUnreachable      = 11
+)
+
+// exitError carries a specific process exit code up to main.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+// errReported is the error of an exitError whose command has already said
+// why in its output, so main exits with the code alone.
+var errReported = errors.New("reported in the output")
+
+// flagSet creates the flag set for a subcommand's own flags.
+func flagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet(name, flag.ContinueOnError)
+}
+
 // --- Command: Unlock ---
 
-func runUnlock(cfg *VaultConfig) error {
-	client := &http.Client{Timeout: 10 * time.Second}
+// unlockOptions are unlock's flags.
+type unlockOptions struct {
+	keyList       string
+	resume, abort bool
+	// summarized leaves the success notification to the summary of a
+	// multi-cluster run.
+	summarized bool
+	// startup, when set, collects the run's startup retries.
+	startup *startupRetries
+	// approval, when set, gets the unseal's approval, if it needed one.
+	approval *unsealApproval
+	// acceptNewCluster unseals a cluster other than the bound one and
+	// binds to it.
+	acceptNewCluster bool
+}
 
-	// Check current seal status
-	// Note: Vault returns 503 when sealed, 200 when unsealed
-	// We need to handle both as valid responses
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/v1/sys/health", cfg.Address), nil)
-	if err != nil {
-		return fmt.Errorf("create health request: %w", err)
-	}
+// unlockOutcome is what unlocking one cluster did, short of failing.
+type unlockOutcome int
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("health check failed: %w", err)
+const (
+	unlockFailed unlockOutcome = iota
+	unlockAlready
+	unlockUnsealed
+	unlockPaused  // -keys: ceremony left open
+	unlockAborted // -abort
+)
+
+func (o unlockOutcome) String() string {
+	switch o {
+	case unlockAlready:
+		return "already_unsealed"
+	case unlockUnsealed:
+		return "unsealed"
+	case unlockPaused:
+		return "paused"
+	case unlockAborted:
+		return "aborted"
 	}
-	defer resp.Body.Close()
+	return "failed"
+}
+
+// unlockReport is unlock's JSON output, one entry per cluster.
+type unlockReport struct {
+	Clusters []unlockClusterReport `json:"clusters"`
+}
 
-	body, err := io.ReadAll(resp.Body)
+type unlockClusterReport struct {
+	Cluster string          `json:"cluster"`
+	Address string          `json:"address"`
+	Outcome string          `json:"outcome"`
+	Error   string          `json:"error,omitempty"`
+	Startup *startupRetries `json:"startup"`
+}
+
+func runUnlock(doc *configDoc, cfg *VaultConfig, args []string) error {
+	fs := flagSet("unlock")
+	var opts unlockOptions
+	fs.StringVar(&opts.keyList, "keys", "", "Submit only these key shares (1-based, e.g. 1,2) and keep the ceremony open for -resume")
+	fs.BoolVar(&opts.resume, "resume", false, "Continue the unseal ceremony in progress")
+	fs.BoolVar(&opts.abort, "abort", false, "Reset Vault's unseal progress and discard the ceremony")
+	cluster := fs.String("cluster", "", "Only unlock the cluster with this vaults label")
+	watch := fs.Bool("watch", false, "Keep running, and unseal whenever Vault is found sealed")
+	interval := fs.Duration("interval", defaultAutoUnsealInterval, "How often -watch checks the seal status")
+	output := fs.String("output", "text", "Output format: text or json")
+	fs.BoolVar(&opts.acceptNewCluster, "accept-new-cluster", false, "Unseal even if the cluster differs from the one the state is bound to, and bind to it")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *output != "text" && *output != "json" {
+		return fmt.Errorf("-output must be text or json")
+	}
+	targets, err := selectClusters(cfg, *cluster)
 	if err != nil {
-		return fmt.Errorf("read health response: %w", err)
+		return err
 	}
-
-	var status VaultStatus
-	if err := json.Unmarshal(body, &status); err != nil {
-		return fmt.Errorf("parse health response: %w", err)
+	if len(targets) > 1 && (opts.keyList != "" || opts.resume || opts.abort || opts.acceptNewCluster) {
+		return fmt.Errorf("-keys, -resume, -abort and -accept-new-cluster work on one cluster at a time; choose it with -cluster")
 	}
-
-	if !status.Sealed {
-		fmt.Println("✓ Vault is already unsealed. Skipping.")
-		return nil
+	if *watch && (opts.keyList != "" || opts.resume || opts.abort || opts.acceptNewCluster) {
+		return fmt.Errorf("-watch cannot be combined with -keys, -resume, -abort or -accept-new-cluster")
+	}
+	if *interval < time.Second {
+		return fmt.Errorf("-interval must be at least 1s")
 	}
+	if *watch && *output == "json" {
+		return fmt.Errorf("-output json cannot be combined with -watch")
+	}
+	stdout := os.Stdout
+	if *output == "json" {
+		// The report is the output; console messages move to stderr.
+		os.Stdout = os.Stderr
+		defer func() { os.Stdout = stdout }()
+	}
+	defer openSinks(cfg)()
+	if *watch {
+		return watchUnlock(targets, *interval, opts, newConfigReloader(doc, cfg, deliverySections, nil))
+	}
+	var results []unlockResult
+	if len(targets) > 1 {
+		opts.summarized = true
+		results, err = unlockAll(cfg, targets, opts)
+	} else {
+		r := unlockResult{label: clusterLabel(targets[0])}
+		opts.startup, opts.approval = &r.startup, &r.approval
+		r.outcome, r.err = unlockCluster(targets[0], opts)
+		results, err = []unlockResult{r}, r.err
+	}
+	if *output == "json" {
+		var report unlockReport
+		for i, r := range results {
+			c := unlockClusterReport{Cluster: r.label, Address: targets[i].Address, Outcome: r.outcome.String(),
+				Startup: &results[i].startup}
+			if r.err != nil {
+				c.Outcome, c.Error = unlockFailed.String(), r.err.Error()
+			}
+			report.Clusters = append(report.Clusters, c)
+		}
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		if eerr := enc.Encode(report); eerr != nil && err == nil {
+			err = eerr
+		}
+	}
+	return err
+}
 
-	fmt.Printf("🔒 Vault is sealed. Attempting to unseal with %d keys...\n", len(cfg.UnsealKeys))
+// unlockCluster unseals one cluster.
+func unlockCluster(cfg *VaultConfig, opts unlockOptions) (unlockOutcome, error) {
+	client, err := newVaultClient(cfg)
+	if err != nil {
+		return unlockFailed, err
+	}
+	store := newStateStore(cfg.StateFile)
 
-	// Send unseal keys
-	for i, key := range cfg.UnsealKeys {
-		reqBody, err := json.Marshal(map[string]string{"key": key})
-		if err != nil {
-			return fmt.Errorf("marshal unseal key %d: %w", i+1, err)
+	if opts.abort {
+		engine := &unsealEngine{cfg: cfg, client: client, store: store}
+		if err := engine.abort(); err != nil {
+			return unlockFailed, err
 		}
+		logInfo("✓ Unseal progress reset and ceremony discarded")
+		return unlockAborted, nil
+	}
 
-		req, err := http.NewRequest("PUT", cfg.Address+"/v1/sys/unseal", bytes.NewReader(reqBody))
+	startup := opts.startup
+	if startup == nil {
+		startup = &startupRetries{}
+	}
+	// Check current seal status
+	// Note: Vault returns 503 when sealed, 200 when unsealed
+	// We need to handle both as valid responses
+	var status VaultStatus
+	err = startup.do(cfg, "health check", true, func() error {
+		req, cancel, err := newOpRequest(cfg, opHealth, "GET", fmt.Sprintf("%s/v1/sys/health", cfg.Address), nil)
 		if err != nil {
-			return fmt.Errorf("create unseal request %d: %w", i+1, err)
+			return fmt.Errorf("create health request: %w", err)
 		}
+		defer cancel()
 
 		resp, err := client.Do(req)
 		if err != nil {
-			return fmt.Errorf("unseal request %d failed: %w", i+1, err)
+			return fmt.Errorf("health check failed: %w", err)
 		}
+		defer resp.Body.Close()
 
 		body, err := io.ReadAll(resp.Body)
-		resp.Body.Close()
 		if err != nil {
-			return fmt.Errorf("read unseal response %d: %w", i+1, err)
+			return fmt.Errorf("read health response: %w", err)
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			return &vaultResponseError{op: "health check", status: resp.StatusCode}
+		}
+		status = VaultStatus{}
+		if err := json.Unmarshal(body, &status); err != nil {
+			return fmt.Errorf("parse health response: %w", err)
+		}
+		if len(status.Errors) > 0 {
+			return &vaultResponseError{op: "health check", status: resp.StatusCode, errors: status.Errors}
 		}
+		return nil
+	})
+	var ve *vaultResponseError
+	switch {
+	case errors.As(err, &ve) && len(ve.errors) > 0:
+		// A broken seal backend answers with an errors body, which would
+		// otherwise decode as "unsealed".
+		checkSealBackend(cfg, store, nil, ve.errors)
+		return unlockFailed, err
+	case err != nil:
+		reportPinMismatch(cfg, store, err)
+		return unlockFailed, err
+	}
+	if cfg.VaultTLS.PinnedCertSHA256 != "" {
+		clearPinMismatch(cfg, store)
+	}
+	caps := checkVaultVersion(cfg, store, status.Version)
+	seal, sealErr := fetchSealStatus(cfg, client)
+	switch {
+	case !caps.has("seal-backend-health"):
+		// Older nodes don't report seal backend errors reliably.
+	case sealErr == nil:
+		checkSealBackend(cfg, store, seal, nil)
+	case seal != nil:
+		checkSealBackend(cfg, store, nil, seal.Errors)
+	}
 
-		var unsealStatus VaultStatus
-		if err := json.Unmarshal(body, &unsealStatus); err != nil {
-			return fmt.Errorf("parse unseal response %d: %w", i+1, err)
+	// Keys submitted to an uninitialized node are just rejected; say why.
+	if !status.Initialized {
+		refuseUnlock(cfg, msgRefusedUninitialized.with(), msgRefusedUninitializedBody.with("address", cfg.Address))
+		return unlockFailed, &exitError{exitNotInitialized, fmt.Errorf("cluster is not initialized")}
+	}
+
+	engine := &unsealEngine{cfg: cfg, client: client, store: store}
+	if !status.Sealed {
+		logInfo("✓ Vault is already unsealed. Skipping.")
+		publishSealState(cfg, "unsealed")
+		if err := engine.clear(); err != nil {
+			logWarn("⚠️  Could not clear unseal ceremony: {error}", "error", err)
+		}
+		return unlockAlready, nil
+	}
+	publishSealState(cfg, "sealed")
+
+	if caps != nil && !caps.Supported {
+		refuseUnlock(cfg, msgRefusedVersion.with(),
+			msgRefusedVersionBody.with("address", cfg.Address, "version", mdText(caps.Version, maxNameLen), "minimum", minVaultVersion))
+		return unlockFailed, &exitError{exitUnsupportedVault, fmt.Errorf("vault %s is older than the minimum supported %s", caps.Version, minVaultVersion)}
+	}
+	if (opts.keyList != "" || opts.resume) && !caps.has("unseal-ceremony") {
+		return unlockFailed, &exitError{exitCeremony, fmt.Errorf("unseal ceremony unavailable: %s", caps.Disabled["unseal-ceremony"])}
+	}
+
+	// Seal migration needs every key submitted with migrate=true; only do
+	// that when the operator has explicitly allowed it.
+	migrate := sealErr == nil && seal.Migration && caps.has("seal-migration")
+	if migrate && !cfg.AllowSealMigration {
+		refuseUnlock(cfg, msgRefusedMigration.with(), msgRefusedMigrationBody.with("address", cfg.Address))
+		return unlockFailed, &exitError{exitSealMigration, fmt.Errorf("seal migration in progress; set allow_seal_migration: true to unseal with migrate")}
+	}
+	if migrate {
+		logInfo("🔁 Seal migration in progress; submitting keys with migrate=true")
+	}
+	engine.migrate = migrate
+
+	binding, err := checkClusterBinding(cfg, client, store, seal, opts.acceptNewCluster)
+	if err != nil {
+		return unlockFailed, err
+	}
+	approval, err := authorizeUnseal(cfg)
+	if err != nil {
+		return unlockFailed, err
+	}
+	if approval != nil && opts.approval != nil {
+		*opts.approval = *approval
+	}
+
+	// A step-wise ceremony is only continued on request, and only if Vault
+	// is still in the same unseal attempt.
+	if opts.resume {
+		if sealErr != nil {
+			return unlockFailed, &exitError{exitCeremony, fmt.Errorf("cannot verify the unseal ceremony: %w", sealErr)}
+		}
+		if err := engine.resume(seal); err != nil {
+			return unlockFailed, &exitError{exitCeremony, fmt.Errorf("%w; cancel it with -abort to start over", err)}
+		}
+	} else {
+		if st, err := store.load(); err == nil && st.Ceremony != nil {
+			refuseUnlock(cfg, msgRefusedCeremony.with(), msgRefusedCeremonyBody.with("address", cfg.Address, "ceremony", st.Ceremony))
+			return unlockFailed, &exitError{exitCeremony, fmt.Errorf("unseal ceremony in progress; continue with -resume or cancel with -abort")}
+		}
+		engine.begin(seal)
+		engine.persist = opts.keyList != ""
+	}
+
+	keys, err := loadUnsealKeys(cfg)
+	if err != nil {
+		return unlockFailed, &exitError{exitKeySource, fmt.Errorf("load unseal keys: %w", err)}
+	}
+	defer zeroKeys(keys)
+
+	var indices []int
+	if opts.keyList != "" {
+		if indices, err = parseKeyIndices(opts.keyList, len(keys)); err != nil {
+			return unlockFailed, err
+		}
+	} else {
+		for i := 1; i <= len(keys); i++ {
+			indices = append(indices, i)
+		}
+	}
+	var todo []int
+	for _, i := range indices {
+		if engine.state.submitted(i) {
+			logInfo("  Key {key} was already submitted, skipping", "key", i)
+			continue
+		}
+		todo = append(todo, i)
+	}
+
+	if engine.persist {
+		logInfo("🔒 Vault is sealed. Submitting key shares {keys} ({progress}/{threshold} so far)...", "keys", joinIndices(todo), "progress", engine.state.Progress, "threshold", engine.state.Threshold)
+	} else {
+		logInfo("🔒 Vault is sealed. Attempting to unseal with {keys} keys...", "keys", len(keys))
+	}
+
+	// Let audit mode attribute the sys/unseal entries we're about to cause.
+	finishRecord := recordUnsealStart(store, len(todo))
+	defer finishRecord()
+
+	// Send unseal keys
+	for _, i := range todo {
+		key, err := resolveShare(i, keys[i-1])
+		if err != nil {
+			return unlockFailed, &exitError{exitKeySource, err}
+		}
+		// Vault may drop back into startup between shares, e.g. when the
+		// storage backend remounts; a share it refused is sent again.
+		var unsealStatus *VaultStatus
+		err = startup.do(cfg, fmt.Sprintf("unseal request %d", i), false, func() error {
+			var err error
+			unsealStatus, err = engine.submit(i, key)
+			return err
+		})
+		zero(key)
+		if err != nil {
+			return unlockFailed, err
 		}
 
 		if !unsealStatus.Sealed {
-			fmt.Println("✓ Vault successfully unsealed")
+			logInfo("✓ Vault successfully unsealed")
+			publishSealState(cfg, "unsealed")
+			recordUnseal(cfg)
+			recordBinding(cfg, client, store, binding, opts.acceptNewCluster)
 			// Send notification
-			sendDiscord(cfg.WebhookURL, "🔓 Vault Unsealed", 
-				"Vault has been successfully unsealed.", 0x2ecc71)
-			return nil
+			if !opts.summarized {
+				notify(cfg, Alert{Severity: sevInfo, Color: 0x2ecc71, Rule: "unseal", Approvals: approval.list()}.say(msgUnsealed.with(),
+					msgUnsealedBody.with("approval", approval.text())))
+			}
+			return unlockUnsealed, nil
 		}
 
-		fmt.Printf("  Progress: %d/%d keys\n", unsealStatus.Progress, unsealStatus.Threshold)
+		logInfo("  Progress: {progress}/{threshold} keys", "progress", unsealStatus.Progress, "threshold", unsealStatus.Threshold)
 	}
 
-	return fmt.Errorf("vault still sealed after providing all %d keys", len(cfg.UnsealKeys))
+	if engine.persist {
+		logInfo("⏸️  Ceremony paused at {progress}/{threshold} keys. Continue with `vault-warden unlock -resume`.", "progress", engine.state.Progress, "threshold", engine.state.Threshold)
+		return unlockPaused, nil
+	}
+	return unlockFailed, fmt.Errorf("vault still sealed after providing all %d keys", len(keys))
+}
+
+var (
+	msgUnsealed                 = message("unseal.title")
+	msgUnsealedBody             = message("unseal.body")
+	msgRefusedUninitialized     = message("unseal.refused.uninitialized.title")
+	msgRefusedUninitializedBody = message("unseal.refused.uninitialized.body")
+	msgRefusedVersion           = message("unseal.refused.version.title")
+	msgRefusedVersionBody       = message("unseal.refused.version.body")
+	msgRefusedMigration         = message("unseal.refused.migration.title")
+	msgRefusedMigrationBody     = message("unseal.refused.migration.body")
+	msgRefusedCeremony          = message("unseal.refused.ceremony.title")
+	msgRefusedCeremonyBody      = message("unseal.refused.ceremony.body")
+)
+
+// refuseUnlock reports an unseal we deliberately didn't attempt. It only
+// notifies when notify_unlock_refusals is set, since the timer would
+// otherwise repeat it every run.
+func refuseUnlock(cfg *VaultConfig, title, desc localText) {
+	logWarn("⛔ {reason}", "reason", desc)
+	if cfg.NotifyUnlockRefusals {
+		notify(cfg, Alert{Severity: sevWarning, Color: 0xe67e22}.say(title, desc))
+	}
 }
 
 // --- Command: Audit ---
 
-func processAuditLine(line string, webhookURL string) {
-	var entry AuditEntry
-	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+// auditor holds the state shared across audit lines.
+type auditor struct {
+	cfg            *VaultConfig
+	sessions       *sessionIndex
+	externalUnseal *externalUnsealDetector
+	integrity      *integrityMonitor
+	firstAccess    *firstAccessDetector
+	coordinated    *coordinatedDetector
+	sampler        *sampler
+	identities     *identityCache
+	pki            *pkiWatcher
+	tokens         *tokenWatcher
+	sensitivity    *sensitivityMap
+	review         *accessReview
+	enrich         *enrichPipeline
+	rules          ruleSet
+	plugins        []*detectorPlugin
+	canary         *canaryProbe
+	position       *positionTracker
+	dedup          *auditDedup
+	recent         *recentEntries
+	source         string // edge label of the line being processed
+	file           string // audit log of the line being processed, when there are several
+	host           string // host that sent the line being processed over syslog
+	line           string // the line being processed, when details keep an excerpt
+}
+
+func newAuditor(cfg *VaultConfig) *auditor {
+	sens := newSensitivityMap(cfg.Sensitivity)
+	a := &auditor{
+		cfg:            cfg,
+		externalUnseal: newExternalUnsealDetector(cfg),
+		integrity:      newIntegrityMonitor(cfg),
+		firstAccess:    newFirstAccessDetector(cfg),
+		coordinated:    newCoordinatedDetector(cfg, sens),
+		sampler:        newSampler(cfg.Sampling),
+		pki:            newPKIWatcher(cfg.PKI),
+		tokens:         newTokenWatcher(cfg.Tokens),
+		sensitivity:    sens,
+	}
+	a.rules.store(compileAlertRules(cfg.Rules))
+	if cfg.SessionIndex.Enabled {
+		a.sessions = newSessionIndex(cfg.SessionIndex)
+	}
+	ids, err := newIdentityCache(cfg)
+	if err != nil {
+		logWarn("⚠️  Identity cache disabled: {error}", "error", err)
+	}
+	a.identities = ids
+	a.review = newAccessReview(cfg, sens, ids)
+	a.enrich = newEnrichPipeline(cfg, ids, a.sessions)
+	return a
+}
+
+// memoryCaches are the auditor's caches that grow with traffic, by name,
+// for the memory guard.
+func (a *auditor) memoryCaches() map[string]memoryCache {
+	caches := map[string]memoryCache{"rule_cooldowns": ruleCooldowns{&a.rules}, "rule_thresholds": ruleThresholds{&a.rules}}
+	if a.sessions != nil {
+		caches["sessions"] = a.sessions
+	}
+	if a.firstAccess != nil {
+		caches["first_access"] = a.firstAccess
+	}
+	if a.coordinated != nil {
+		caches["aggregation"] = a.coordinated
+	}
+	if a.review != nil {
+		caches["review"] = a.review
+	}
+	if a.recent != nil {
+		caches["reload_canary"] = a.recent
+	}
+	return caches
+}
+
+// processForwarded checks a line received from an edge warden; its
+// alerts carry the edge's label.
+func (a *auditor) processForwarded(source, line string) {
+	a.source = source
+	defer func() { a.source = "" }()
+	a.processAuditLine(line)
+}
+
+func (a *auditor) processAuditLine(line string) {
+	if a.cfg.Details.enabled() {
+		a.line = line
+		defer func() { a.line = "" }()
+	}
+	fields := a.projection()
+	entry, err := decodeAuditEntryFields([]byte(line), fields)
+	if err == nil && fields != allEntryFields && a.needsFullEntry(&entry) {
+		entry, err = decodeAuditEntry([]byte(line))
+	}
+	if err != nil {
+		metrics.inc("audit_decode_errors_total")
+		logDebug("🔍 Skipping undecodable audit line: {error}", "error", err)
 		return
 	}
+	if a.dedup.duplicate(&entry, line, time.Now()) {
+		metrics.inc("audit_duplicates_total")
+		logDebug("🔍 Skipping {type} {request_id} from {audit_file}, already read from another audit log", "type", entry.Type,
+			"request_id", entry.Request.ID, "audit_file", a.file)
+		return
+	}
+	if a.canary.observe(&entry) {
+		return
+	}
+	metrics.inc("audit_lines_total", "type", entry.Type)
+	logDebug("🔍 Audit {type}: {operation} {path} by {user}", "type", entry.Type, "operation", entry.Request.Operation,
+		"path", entry.Request.Path, "user", entry.Auth.DisplayName, "request_id", entry.Request.ID)
+	for _, p := range a.plugins {
+		p.offer([]byte(line))
+	}
+	a.sensitivity.observe(&entry)
+	a.review.observe(&entry)
+	for _, alert := range a.integrity.observe(&entry) {
+		a.notify(alert)
+		logWarn("🚨 Integrity: {title}", "title", alert.Title)
+	}
 
-	// Alert on privileged access
-	if strings.Contains(entry.Request.Path, "sign/root") || 
-	   strings.Contains(entry.Request.Path, "database/creds/admin") {
-		desc := fmt.Sprintf("**User:** %s\n**Resource:** `%s`", 
-			entry.Auth.DisplayName, entry.Request.Path)
-		sendDiscord(webhookURL, "🚨 SECURITY ALERT: Privileged Access", desc, 0xe74c3c)
-		fmt.Printf("🚨 Privileged access: %s -> %s\n", entry.Auth.DisplayName, entry.Request.Path)
+	// Integrity and the counts above see every entry; the rules only see
+	// those the enrichment pipeline passes.
+	en, ok := a.enrich.run(entry)
+	if !ok {
+		return
+	}
+	a.recent.record(en, len(line), time.Now())
+
+	for _, alert := range a.coordinated.observe(&entry) {
+		en.annotate(&alert)
+		a.notify(alert)
+		logWarn("👥 Coordinated access: {title}", "title", alert.Title, "request_id", entry.Request.ID)
+	}
+	// Once an aggregated alert covers a path, per-identity alerts for it
+	// would page again for the same incident.
+	coordinated := a.coordinated.suppresses(&entry)
+
+	// Alert on every configured rule the entry matches
+	rules := a.rules.load()
+	for i := range rules {
+		r := &rules[i]
+		if coordinated {
+			break
+		}
+		match, ok := r.match(&entry)
+		if !ok {
+			if ruleStats != nil && r.nearMiss(&entry) {
+				ruleStats.nearMiss(r.Name)
+			}
+			continue
+		}
+		metrics.inc("rule_matches_total", "rule", r.Name)
+		ruleStats.matched(r.Name)
+		alert, ok := r.alert(en, match, ruleScope{Environment: a.cfg.Environment, Sensitivity: a.sensitivity,
+			History: alertIndex.lookup(a.cfg.HistoryLookup)})
+		if !ok {
+			ruleStats.suppressed(r.Name, "when")
+			continue
+		}
+		if r.threshold != nil {
+			if alert, ok = r.threshold.observe(alert); !ok {
+				continue
+			}
+		}
+		en.annotate(&alert)
+		alert.Source = a.source
+		if !r.cooldown.allow(alert, time.Now()) {
+			metrics.inc("rule_cooldown_suppressed_total", "rule", r.Name)
+			ruleStats.suppressed(r.Name, "cooldown")
+			continue
+		}
+		a.notify(alert)
+		logWarn("🚨 Rule {rule}: {user} -> {path}", "rule", r.Name, "user", entry.Auth.DisplayName, "path", entry.Request.Path, "request_id", entry.Request.ID,
+			"environment", a.cfg.Environment, "audit_file", a.file, "audit_host", a.host)
+	}
+
+	for _, alert := range a.pki.observe(&entry) {
+		en.annotate(&alert)
+		a.notify(alert)
+		logWarn("🔏 PKI: {rule}: {user} -> {path}", "rule", alert.Rule, "user", entry.Auth.DisplayName, "path", entry.Request.Path, "request_id", entry.Request.ID)
+	}
+
+	for _, alert := range a.tokens.observe(&entry) {
+		en.annotate(&alert)
+		a.notify(alert)
+		logWarn("🎟️  Token: {rule}: {user} -> {path}", "rule", alert.Rule, "user", entry.Auth.DisplayName, "path", entry.Request.Path, "request_id", entry.Request.ID)
+	}
+
+	if alert, ok := a.firstAccess.observe(&entry); ok && !coordinated {
+		en.annotate(&alert)
+		a.notify(alert)
+		logWarn("🆕 First-time access: {user} -> {path}", "user", entry.Auth.DisplayName, "path", pathPrefix(entry.Request.Path), "request_id", entry.Request.ID)
 	}
 
 	// Alert on unseal events
 	if strings.Contains(entry.Request.Path, "sys/unseal") && entry.Error == "" {
-		sendDiscord(webhookURL, "🔓 Vault Unsealed", 
-			"Vault has been successfully unsealed.", 0x2ecc71)
-		fmt.Println("🔓 Vault unseal detected")
+		a.notify(Alert{Severity: sevInfo, Color: 0x2ecc71, RequestID: entry.Request.ID, Rule: "unseal",
+			SourceIP: hostOnly(entry.Request.RemoteAddress), Time: entryTime(entry.Time)}.say(msgUnsealed.with(), msgUnsealedBody.with()))
+		logInfo("🔓 Vault unseal detected", "request_id", entry.Request.ID)
+		mqttSink.publishState("unsealed")
+		grafanaSink.sealState("unsealed")
+	}
+
+	// Alert on unseals completed with key shares we didn't submit
+	if entry.Request.Path == "sys/unseal" {
+		if ext := a.externalUnseal.observe(&entry); ext != nil {
+			a.notify(Alert{Severity: sevWarning, Color: 0xe67e22, RequestID: entry.Request.ID,
+				Rule: "external-unseal", SourceIP: hostOnly(ext.addr), Time: entryTime(entry.Time)}.say(
+				msgExternalUnseal.with("address", cleanField(ext.addr, maxNameLen)), ext.describe()))
+			logWarn("⚠️  External unseal from {address} ({count} submissions)", "address", ext.addr, "count", ext.count, "request_id", entry.Request.ID)
+		}
 	}
+
+	// Vault writes a request and a response entry per call; index only
+	// one of them so sessions aren't doubled.
+	if entry.Type != "request" && a.sampler.keep(entry.Request.Path, line) && shedKeep(line) {
+		a.sessions.record(entry.Auth.Accessor, sessionAction{
+			Path:      entry.Request.Path,
+			Operation: entry.Request.Operation,
+			Time:      entryTime(entry.Time),
+			Error:     entry.Error,
+		})
+	}
+}
+
+// notify sends an alert raised by an audit line, weighted by its path's
+// sensitivity.
+func (a *auditor) notify(alert Alert) {
+	alert.Source, alert.AuditFile, alert.AuditHost = a.source, a.file, a.host
+	if a.line != "" {
+		alert.Excerpt = auditExcerpt(a.line)
+	}
+	a.sensitivity.apply(&alert)
+	notify(a.cfg, alert)
+}
+
+// requestIDSuffix formats a request ID for console lines.
+func requestIDSuffix(id string) string {
+	if id == "" {
+		return ""
+	}
+	return " [request_id=" + id + "]"
+}
+
+// entryTime parses an audit entry timestamp, falling back to now.
+func entryTime(ts string) time.Time {
+	if t, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+		return t
+	}
+	return time.Now()
 }
 
-func runAudit(cfg *VaultConfig) error {
-	fmt.Println("🛡️  Vault Warden Active. Monitoring logs...")
-	sendDiscord(cfg.WebhookURL, "🛡️ Vault Warden Active", 
-		"Monitoring audit logs for Starnix cluster...", 0x3498db)
+var (
+	msgWardenActive      = message("warden.active.title")
+	msgWardenActiveBody  = message("warden.active.body")
+	msgWardenStopped     = message("warden.stopped.title")
+	msgWardenStoppedBody = message("warden.stopped.body")
+	msgWardenFailedBody  = message("warden.stopped.failure")
+)
 
-	// Verify audit log exists
-	if _, err := os.Stat(cfg.AuditLog); err != nil {
-		return fmt.Errorf("audit log not accessible: %w", err)
+func runAudit(doc *configDoc, cfg *VaultConfig, args []string) error {
+	opts, replay, err := parseAuditFlags(args, time.Now())
+	if err != nil {
+		return err
+	}
+	switch {
+	case opts.stdin:
+		return runStdin(doc, cfg, opts)
+	case replay:
+		return runReplay(doc, cfg, opts)
+	}
+	// Before anything is sent or written: a copy of prod's config run
+	// elsewhere, or next to the instance already running, runs safe.
+	d, lock := detectForeign(doc, cfg, opts.forceActive)
+	if lock != nil {
+		defer lock.Close()
+	}
+	if d.safe() {
+		if err := enterSafeMode(cfg, d); err != nil {
+			return err
+		}
+		defer printAlerts()()
+	}
+	safeMode = d
+	defer func() { safeMode = nil }()
+	if cfg.Forward.Address != "" {
+		return runForward(cfg)
+	}
+	defer openSinks(cfg)()
+
+	ob, pending, err := openOutbox(cfg)
+	if err != nil {
+		logWarn("⚠️  Outbox disabled: {error}", "error", err)
 	}
+	outbox = ob
+	defer func() {
+		outbox.close()
+		outbox = nil
+	}()
 
-	// Use tail library for proper log rotation handling
-	t, err := tail.TailFile(cfg.AuditLog, tail.Config{
-		Follow:   true,
-		ReOpen:   true, // Handles log rotation
-		Poll:     true, // Use polling (more reliable than inotify)
-		Location: &tail.SeekInfo{Offset: 0, Whence: io.SeekEnd}, // Start at end of file
-		Logger:   tail.DiscardingLogger, // Suppress tail's own logs
+	// Slow webhooks must not stall line processing.
+	queue = startNotifyQueue(cfg, deliverAlerts(cfg))
+	defer func() {
+		queue.close(time.Duration(cfg.Queue.DrainTimeout))
+		queue = nil
+	}()
+	quiet = newQuietHours()
+	defer func() { quiet = nil }()
+	replayOutbox(cfg, queue, pending)
+
+	alertIndex = openHistoryIndex(cfg)
+	a := newAuditor(cfg)
+	// Only the daemon counts rule matches: replays see old entries again.
+	ruleStats = newRuleStats(cfg, &a.rules)
+	defer func() { ruleStats = nil }()
+	a.plugins = newDetectorPlugins(cfg, func(al Alert) {
+		a.sensitivity.apply(&al)
+		notify(cfg, al)
+	})
+	gate := newIntakeGate(cfg)
+	sched := newScheduler()
+	q := queue
+	metrics.onCollect(func(r *metricsRegistry) {
+		for sev, n := range q.depths() {
+			r.set("queue_depth", float64(n), "severity", sev)
+		}
+		r.set("queue_capacity", float64(q.capacity))
+		paused := 0.0
+		if gate.status().Paused {
+			paused = 1
+		}
+		r.set("intake_paused", paused)
 	})
+
+	mode.setStandby(cfg.Standby)
+	recv, err := startReceiver(cfg)
 	if err != nil {
-		return fmt.Errorf("tail audit log: %w", err)
+		return fmt.Errorf("receive: %w", err)
+	}
+	sup := newSupervisor()
+	defer sup.stop(shutdownGrace)
+	if recv != nil {
+		sup.add(componentSpec{name: "receiver", policy: policyFatal, run: recv.run})
+	}
+	from := opts.start
+	if from == "" {
+		from = startSaved
+	}
+	// With a socket or syslog, entries arrive as they happen and there
+	// is no file to resume in or tail to heal.
+	var tails *auditTails
+	var sock *auditSocket
+	var sl *auditSyslog
+	var reader *watchdog
+	if cfg.AuditSource != auditSourceFile && opts.start != "" {
+		return fmt.Errorf("-from %s reads audit_log, but audit_source is %s", opts.start, cfg.AuditSource)
+	}
+	switch cfg.AuditSource {
+	case auditSourceSocket:
+		if sock, err = listenAuditSocket(cfg); err != nil {
+			return fmt.Errorf("audit socket: %w", err)
+		}
+		sup.add(componentSpec{name: "audit-socket", policy: policyFatal, run: sock.run})
+	case auditSourceSyslog:
+		if sl, err = listenAuditSyslog(cfg); err != nil {
+			return fmt.Errorf("audit syslog: %w", err)
+		}
+		sup.add(componentSpec{name: "audit-syslog", policy: policyFatal, run: sl.run})
+	default:
+		a.position = newPositionTracker(cfg)
+		if a.position == nil && opts.start == startSaved {
+			return fmt.Errorf("-from saved needs audit_position, which is disabled")
+		}
+		if tails, err = openAuditTails(cfg, a.position, from); err != nil {
+			return err
+		}
+		defer tails.stop()
+		if a.position != nil {
+			sched.add(positionJob(a.position))
+		}
+		if cfg.AuditLogs.several() {
+			sched.add(auditRescanJob(tails))
+		}
+		reader = newWatchdog(cfg, "audit-reader", tails.reopen)
+	}
+	a.dedup = newAuditDedup(cfg)
+	a.recent = newRecentEntries(cfg)
+	watch := startWatch(cfg, sup)
+	mux := http.NewServeMux()
+	modeHandlers(cfg, mux)
+	var auditFile *auditFileMonitor
+	if tails != nil {
+		auditFile = newAuditFileMonitor(cfg)
+	}
+	a.canary = newCanaryProbe(cfg)
+	if cfg.Details.bot() {
+		if err := startAlertDetails(cfg); err != nil {
+			return fmt.Errorf("details: %w", err)
+		}
+	}
+	mem := newMemoryGuard(cfg, a.memoryCaches(), a.sessions)
+	mux.HandleFunc("/statusz", statuszHandler(gate, sched, sup, a.firstAccess, watch, recv, auditFile, tails, sock, sl, newStateStore(cfg.StateFile), a.plugins, a.canary, mem, reader, q.dog))
+	mux.HandleFunc("/healthz", healthzHandler(gate, auditFile, time.Now(), reader, q.dog))
+	mux.HandleFunc("/completez", completezHandler(cfg))
+	mux.HandleFunc("/rules", rulesHandler(cfg))
+	mux.HandleFunc("/history", historyHandler(cfg))
+	mux.HandleFunc("/test-notification", testNotificationHandler(cfg))
+	sup.add(adminComponent(cfg, mux))
+	if cfg.Admin.Listen != "" {
+		sup.add(adminTCPComponent(cfg, mux))
+	}
+	if cfg.MetricsListen != "" {
+		sup.add(metricsComponent(cfg))
+	}
+	if a.canary != nil {
+		sup.add(canaryComponent(a.canary))
 	}
-	defer t.Stop()
+
+	announceSafeMode(cfg, d)
+	switch {
+	case d.safe():
+		logInfo("🧪 Vault Warden in safe mode. Monitoring logs, printing alerts...")
+	case cfg.Standby:
+		logInfo("💤 Vault Warden in standby. Following logs silently until promoted...")
+	default:
+		logInfo("🛡️  Vault Warden Active. Monitoring logs...")
+	}
+	notify(cfg, Alert{Severity: sevInfo, Color: 0x3498db}.say(msgWardenActive.with(), msgWardenActiveBody.with()))
 
 	// Set up signal handling for graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	// SIGHUP swaps in the rules, destinations and audit_log of the
+	// config as it is now; each tail keeps its place unless its log was
+	// dropped.
+	reload := newConfigReloader(doc, cfg, auditSections, func(next *VaultConfig) error {
+		if tails != nil && strings.Join(next.AuditLogs, "\x00") != strings.Join(live(cfg).AuditLogs, "\x00") {
+			if err := tails.retarget(next.AuditLogs); err != nil {
+				return err
+			}
+		}
+		a.rules.store(compileAlertRules(next.Rules))
+		return nil
+	})
+	reload.canary = canaryCheck(a.recent, a.sensitivity)
+	defer reload.stop()
+	mux.HandleFunc("/reload", reloadHandler(reload))
+	sup.add(reloadComponent(reload))
+
+	sched.add(maintenanceJob(cfg))
+	sched.add(quietHoursJob(cfg))
+	if mem.budget > 0 {
+		logInfo("🧠 Memory budget {budget} ({origin})", "budget", formatBytes(int64(mem.budget)), "origin", mem.origin)
+		sched.add(memoryJob(mem))
+	}
+	a.schedule(sched)
+	if watch != nil && watch.posture != nil {
+		sched.add(postureJob(watch.posture))
+	}
+	sup.add(componentSpec{name: "scheduler", policy: policyFatal, run: sched.run})
+	if auditFile != nil {
+		sup.add(componentSpec{name: "audit-file", policy: policyRestart, run: auditFile.run})
+	}
+	sup.add(componentSpec{name: "audit-intake", policy: policyRestart, run: func(ctx context.Context) error {
+		return a.intake(ctx, tails, sock, sl, gate, recv, auditFile, reader)
+	}})
+	for _, p := range a.plugins {
+		sup.add(componentSpec{name: "plugin:" + p.cfg.Name, policy: policyRestart, run: p.run})
+	}
+	for _, dog := range []*watchdog{reader, q.dog} {
+		if dog != nil {
+			sup.add(componentSpec{name: "watchdog:" + dog.name, policy: policyRestart, run: dog.run})
+		}
+	}
+	// The watchdog pings stop once the reader's self-heals have failed,
+	// so systemd restarts what healing in place couldn't fix.
+	sd := newSDNotifier()
+	if sd != nil {
+		sup.add(sdComponent(sd, func() bool { return reader.stuck() == 0 }, auditStatus(gate)))
+	}
+	sd.ready(auditStatus(gate)())
+
+	var failure error
+	select {
+	case <-sigChan:
+		logInfo("\n🛑 Shutting down gracefully...")
+	case failure = <-sup.failure():
+		logWarn("🛑 Shutting down: {error}", "error", failure)
+	}
+	sd.stopping()
+	sup.stop(shutdownGrace)
+	if summary := a.sampler.summary(); summary != "" {
+		logInfo("📉 Sampling: {summary}", "summary", summary)
+	}
+	a.save()
+	// The backlog goes out first; closed, the queue sends stopped itself
+	// synchronously, so it can't be left behind in a drain that times out.
+	queue.close(time.Duration(cfg.Queue.DrainTimeout))
+	stopped := Alert{Severity: sevInfo, Color: 0x95a5a6}.say(msgWardenStopped.with(), msgWardenStoppedBody.with())
+	if failure != nil {
+		stopped = Alert{Severity: sevWarning, Color: sevWarning.color()}.say(msgWardenStopped.with(),
+			msgWardenFailedBody.with("error", mdText(failure.Error(), maxPathLen)))
+	}
+	notify(cfg, stopped)
+	return failure
+}
+
+// intake is the audit loop's component: it feeds local, socket, syslog
+// and forwarded lines to the checks until ctx is done. Lines stay where they
+// are while intake is paused. Every tick it beats the reader watchdog if
+// lines were read, or if there was nothing to read.
+func (a *auditor) intake(ctx context.Context, tails *auditTails, sock *auditSocket, sl *auditSyslog, gate *intakeGate, recv *auditReceiver, auditFile *auditFileMonitor, reader *watchdog) error {
+	gateTicker := time.NewTicker(time.Second)
+	defer gateTicker.Stop()
+	lines, socketLines, syslogLines, incoming := tails.lines(), sock.incoming(), sl.incoming(), recv.incoming()
+	progressed := false
 
 	for {
 		select {
-		case line := <-t.Lines:
+		case tl := <-lines:
+			line := tl.line
 			if line.Err != nil {
-				fmt.Printf("⚠️  Error reading line: %v\n", line.Err)
+				logWarn("⚠️  Error reading line: {error}", "error", line.Err, "audit_file", tails.label(tl.tail))
 				continue
 			}
-			processAuditLine(line.Text, cfg.WebhookURL)
+			progressed = true
+			tl.tail.advance(line.SeekInfo.Offset)
+			if tl.tail == tails.primary() {
+				gate.read(line.SeekInfo.Offset)
+			} else {
+				gate.seen()
+			}
+			mode.observe()
+			a.file = tails.label(tl.tail)
+			a.processAuditLine(line.Text)
+			a.file = ""
+			a.position.read()
 
-		case <-sigChan:
-			fmt.Println("\n🛑 Shutting down gracefully...")
-			sendDiscord(cfg.WebhookURL, "🛑 Vault Warden Stopped", 
-				"Audit monitoring has been stopped.", 0x95a5a6)
+		case line := <-socketLines:
+			progressed = true
+			gate.seen()
+			mode.observe()
+			a.processAuditLine(line)
+
+		case sm := <-syslogLines:
+			progressed = true
+			gate.seen()
+			mode.observe()
+			a.host = sm.host
+			a.processAuditLine(sm.line)
+			a.host = ""
+
+		case rb := <-incoming:
+			a.processBatch(rb)
+
+		case <-gateTicker.C:
+			// While paused the tail blocks on its unbuffered channel,
+			// so reading resumes exactly where it stopped. Edges are
+			// told the hub is busy and retry.
+			paused := gate.check()
+			if paused {
+				lines, socketLines, syslogLines, incoming = nil, nil, nil, nil
+			} else {
+				lines, socketLines, syslogLines, incoming = tails.lines(), sock.incoming(), sl.incoming(), recv.incoming()
+			}
+			if progressed || paused || tails.caughtUp(auditFile.lastSize()) {
+				reader.beat()
+			}
+			progressed = false
+
+		case <-ctx.Done():
 			return nil
 		}
 	}
 }
 
+// deliverAlerts sends a batch from the queue with the live config and
+// clears from the outbox what was delivered.
+func deliverAlerts(cfg *VaultConfig) func([]Alert) ([]Alert, error) {
+	return func(alerts []Alert) ([]Alert, error) {
+		cfg := live(cfg)
+		failed, err := sendAlerts(cfg, alerts)
+		webhookHealth.report(err)
+		undelivered := make(map[string]bool, len(failed))
+		for _, a := range failed {
+			undelivered[a.ID] = true
+		}
+		for _, a := range alerts {
+			if !undelivered[a.ID] {
+				outbox.done(a.ID, notifierFor(cfg).kind())
+				ruleStats.delivered(a)
+			}
+		}
+		return failed, err
+	}
+}
+
+// schedule adds the detectors' periodic jobs: expiring windows, saving
+// what they learned and syncing identities.
+func (a *auditor) schedule(sched *scheduler) {
+	cfg := a.cfg
+	if a.integrity != nil {
+		sched.add(integrityJob(a.integrity))
+	}
+	if a.firstAccess != nil {
+		sched.add(firstAccessJob(a.firstAccess))
+	}
+	if a.coordinated != nil {
+		sched.add(coordinatedJob(a.coordinated))
+	}
+	// Even without cooldowns now: a reload may add one.
+	sched.add(ruleCooldownJob(a))
+	if ruleStats != nil {
+		sched.add(ruleStatsJob(ruleStats))
+		if ruleStats.cfg.Report != "" {
+			sched.add(ruleReportJob(cfg, ruleStats))
+		}
+	}
+	if a.sensitivity != nil {
+		sched.add(sensitivityReportJob(cfg, a.sensitivity))
+		if cfg.Sensitivity.File != "" {
+			sched.add(sensitivityReloadJob(a.sensitivity))
+		}
+	}
+	if a.review != nil {
+		sched.add(reviewSaveJob(a.review))
+		if cfg.ReviewExport.Schedule != "" {
+			sched.add(reviewExportJob(cfg, a.review))
+		}
+	}
+	if a.identities != nil {
+		sched.add(identityJob(a.identities))
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			if err := a.identities.sync(ctx); err != nil {
+				logWarn("⚠️  {error}", "error", err)
+			}
+		}()
+	}
+}
+
+// save writes out the detectors' state on shutdown.
+func (a *auditor) save() {
+	if err := a.integrity.save(); err != nil {
+		logWarn("⚠️  Integrity: could not save outstanding requests: {error}", "error", err)
+	}
+	if err := a.firstAccess.save(); err != nil {
+		logWarn("⚠️  First-time access: could not save known prefixes: {error}", "error", err)
+	}
+	if err := a.coordinated.save(); err != nil {
+		logWarn("⚠️  Coordinated access: could not save windows: {error}", "error", err)
+	}
+	if err := a.review.save(); err != nil {
+		logWarn("⚠️  Access review: {error}", "error", err)
+	}
+	if err := a.position.save(); err != nil {
+		logWarn("⚠️  Saving the audit log position failed: {error}", "error", err)
+	}
+	if err := ruleStats.save(); err != nil {
+		logWarn("⚠️  Rule stats: could not save counts: {error}", "error", err)
+	}
+}
+
+// processBatch runs a forwarded batch through the checks. The edge is
+// acked even when a line panics, as a local line would be skipped.
+func (a *auditor) processBatch(rb *receivedBatch) {
+	defer close(rb.done)
+	for _, line := range rb.lines {
+		mode.observe()
+		a.processForwarded(rb.source, string(line))
+	}
+}
+
 // --- Main Entrypoint ---
 
 func main() {
-	configPath := flag.String("config", "/etc/vault-warden.yaml", "Path to config file")
+	configPath := flag.String("config", defaultConfigPath, "Path to config file")
+	configDir := flag.String("config-dir", "", "Directory of *.yaml config fragments, merged in lexical order (overrides -config)")
+	logFormat := flag.String("log-format", "", "Console log format: text or json (overrides logging.format)")
+	logLevel := flag.String("log-level", "", "Minimum log level: debug, info, warn or error (overrides logging.level)")
 	flag.Parse()
+	if err := logs.configure(LoggingConfig{}, *logFormat, *logLevel); err != nil {
+		fmt.Printf("❌ Error: -log-format/-log-level: %v\n", err)
+		os.Exit(1)
+	}
 
 	if len(flag.Args()) < 1 {
-		fmt.Println("Usage: vault-warden [-config path] [unlock | audit]")
+		fmt.Println("Usage: vault-warden [-config path | -config-dir dir] [-log-format text|json] [-log-level info] [unlock | audit | config show]")
 		fmt.Println("\nCommands:")
-		fmt.Println("  unlock  - Unseal Vault if sealed")
-		fmt.Println("  audit   - Monitor audit logs for privileged access")
+		fmt.Println("  unlock       - Unseal Vault if sealed")
+		fmt.Println("  unlock -keys 1,2 | -resume | -abort - Unseal step-wise across runs (ceremony)")
+		fmt.Println("  unlock -cluster label      - Unseal only this one of the vaults clusters")
+		fmt.Println("  unlock -accept-new-cluster - Unseal a cluster other than the bound one and bind to it")
+		fmt.Println("  unlock -watch [-interval 30s] - Keep running and unseal whenever Vault is sealed")
+		fmt.Println("  unlock -output json        - Print a JSON report per cluster, with startup retries")
+		fmt.Println("  status [-cluster name] [-json] - Show seal status, role, Vault capabilities and any unseal ceremony")
+		fmt.Println("  seal [-cluster name] [-token t] [-yes] [-reason text] - Seal Vault now, e.g. on a suspected compromise")
+		fmt.Println("  audit [-from end|saved|start] [-force-active] - Monitor audit logs for privileged access, resuming at the saved position")
+		fmt.Println("  audit -from -30m [-until T] [-once] [-rules-file f] [-print-only] - Re-run the rules over part of the log")
+		fmt.Println("  audit -stdin [-print-only] - Run the audit pipeline over entries piped in, until EOF")
+		fmt.Println("  config show  - Print the merged config (-effective: as loaded, with defaults), secrets redacted")
+		fmt.Println("  config generate -spec spec.json [-out config.yaml] - Expand a compact JSON spec and rule packs into a config")
+		fmt.Println("  keys sign-init            - Generate a new notification signing key")
+		fmt.Println("  history show [-request-id ID]  - List alert history records")
+		fmt.Println("  history verify-signatures - Verify signatures in the alert history")
+		fmt.Println("  maintenance run           - Prune alert history and compact the state file now")
+		fmt.Println("  review export [-since 90d] [-o file] - Write the access review CSV")
+		fmt.Println("  rules list [-stats] [-json] - List the rules, with -stats their matches and those that never match")
+		fmt.Println("  render-test [-rule unseal] [-severity info] - Show what each destination gets after content policies")
+		fmt.Println("  promote | demote          - Switch a running audit process between active and standby")
+		fmt.Println("  reload [-force]           - Reload the running audit process's config, new rules checked against recent traffic first")
+		fmt.Println("  healthcheck [-max-staleness 5m] - Exit 0 if the local audit daemon is healthy (for HEALTHCHECK)")
+		fmt.Println("  doctor [-o file.tar.gz]   - Bundle redacted diagnostics for a support request")
+		fmt.Println("  self-update [-check-only] [-version v] [-allow-downgrade] [-restart] - Install the latest signed release")
+		fmt.Println("  alert-schema [-o file]    - Print the JSON schema of alerts in machine-readable outputs")
+		fmt.Println("  check-plugin -mode seal|audit-lag|webhook|keysource [-warning R] [-critical R] - Nagios/Icinga plugin check")
+		fmt.Println("  completion bash|zsh|fish  - Print a shell completion script")
+		os.Exit(1)
+	}
+
+	if flag.Arg(0) == "healthcheck" {
+		// Deliberately skips the config: it only talks to the socket.
+		os.Exit(runHealthcheck(flag.Args()[1:]))
+	}
+	switch flag.Arg(0) {
+	case "__complete":
+		// Called by the completion scripts on every <Tab>; it must stay
+		// quiet and quick whatever the state of the config.
+		runComplete(flag.Args()[1:])
+		return
+	case "completion":
+		if err := runCompletion(flag.Args()[1:]); err != nil {
+			logError("❌ Error: {error}", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if flag.Arg(0) == "alert-schema" {
+		// Used by go generate; needs no config.
+		if err := runAlertSchema(flag.Args()[1:]); err != nil {
+			logError("❌ Error: {error}", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "config" && flag.Arg(1) == "generate" {
+		// Produces a config rather than reading one.
+		if err := runConfigGenerate(flag.Args()[2:]); err != nil {
+			logError("❌ Error: {error}", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	doc, err := loadConfig(*configPath, *configDir)
+	if flag.Arg(0) == "check-plugin" {
+		// Plugin output and exit codes follow the monitoring-plugins
+		// contract, config errors included.
+		os.Exit(runCheckPlugin(doc, err, flag.Args()[1:]))
+	}
+	if flag.Arg(0) == "doctor" {
+		if err := runDoctor(doc, err, flag.Args()[1:]); err != nil {
+			logError("❌ Error: {error}", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if err != nil {
+		logError("❌ Config error: {error}", "error", err)
 		os.Exit(1)
 	}
 
-	cfg, err := readConfig(*configPath)
+	if flag.Arg(0) == "config" {
+		if err := runConfig(doc, flag.Args()[1:]); err != nil {
+			logError("❌ Error: {error}", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	cfg, err := doc.config()
 	if err != nil {
-		fmt.Printf("❌ Config error: %v\n", err)
+		logError("❌ Config error: {error}", "error", err)
 		os.Exit(1)
 	}
+	logs.configure(cfg.Logging, *logFormat, *logLevel) // validated with the config
 
 	var cmdErr error
 	switch flag.Arg(0) {
 	case "unlock":
-		cmdErr = runUnlock(cfg)
+		cmdErr = runUnlock(doc, cfg, flag.Args()[1:])
+	case "status":
+		cmdErr = runStatus(cfg, flag.Args()[1:])
+	case "seal":
+		cmdErr = runSeal(cfg, flag.Args()[1:])
 	case "audit":
-		cmdErr = runAudit(cfg)
+		cmdErr = runAudit(doc, cfg, flag.Args()[1:])
+	case "keys":
+		cmdErr = runKeys(cfg, flag.Args()[1:])
+	case "history":
+		cmdErr = runHistory(cfg, flag.Args()[1:])
+	case "maintenance":
+		cmdErr = runMaintenanceCommand(cfg, flag.Args()[1:])
+	case "review":
+		cmdErr = runReview(cfg, flag.Args()[1:])
+	case "render-test":
+		cmdErr = runRenderTest(cfg, flag.Args()[1:])
+	case "promote", "demote":
+		cmdErr = runModeCommand(cfg, flag.Arg(0))
+	case "self-update":
+		cmdErr = runSelfUpdate(cfg, flag.Args()[1:])
+	case "rules":
+		cmdErr = runRules(cfg, flag.Args()[1:])
+	case "reload":
+		cmdErr = runReloadCommand(cfg, flag.Args()[1:])
 	default:
-		fmt.Printf("❌ Unknown command: %s\n", flag.Arg(0))
+		logError("❌ Unknown command: {command}", "command", flag.Arg(0))
 		os.Exit(1)
 	}
 
 	if cmdErr != nil {
-		fmt.Printf("❌ Error: %v\n", cmdErr)
+		var ee *exitError
+		if errors.As(cmdErr, &ee) && ee.err == errReported {
+			os.Exit(ee.code)
+		}
+		logError("❌ Error: {error}", "error", cmdErr)
+		if errors.As(cmdErr, &ee) {
+			os.Exit(ee.code)
+		}
 		os.Exit(1)
 	}
 }
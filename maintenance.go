@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// --- Maintenance ---
+
+const (
+	defaultHistoryRetention    = 90 * 24 * time.Hour
+	defaultMaintenanceInterval = 24 * time.Hour
+)
+
+// MaintenanceConfig controls pruning of the alert history and state file.
+type MaintenanceConfig struct {
+	Interval         Duration `yaml:"interval"`
+	Schedule         string   `yaml:"schedule"` // cron, overrides interval
+	HistoryRetention Duration `yaml:"history_retention"`
+}
+
+type maintenanceReport struct {
+	historyPruned  int
+	historyBytes   int64
+	stateBytes     int64
+	unsealsDropped int
+	outboxSettled  int
+	outboxBytes    int64
+}
+
+func (r maintenanceReport) String() string {
+	return fmt.Sprintf("pruned %d history records, reclaimed %s (history %s, state %s, outbox %s), dropped %d unseal records and %d settled outbox records",
+		r.historyPruned, formatBytes(r.historyBytes+r.stateBytes+r.outboxBytes), formatBytes(r.historyBytes),
+		formatBytes(r.stateBytes), formatBytes(r.outboxBytes), r.unsealsDropped, r.outboxSettled)
+}
+
+func runMaintenance(cfg *VaultConfig) (maintenanceReport, error) {
+	var report maintenanceReport
+
+	if cfg.HistoryFile != "" {
+		cutoff := time.Now().Add(-time.Duration(cfg.Maintenance.HistoryRetention))
+		pruned, reclaimed, err := pruneHistory(cfg.HistoryFile, cutoff)
+		if err != nil {
+			return report, err
+		}
+		report.historyPruned, report.historyBytes = pruned, reclaimed
+	}
+
+	if cfg.Queue.Outbox.Path != "" {
+		settled, reclaimed, err := compactOutbox(cfg.Queue.Outbox)
+		if err != nil {
+			return report, err
+		}
+		report.outboxSettled, report.outboxBytes = settled, reclaimed
+	}
+
+	dropped, reclaimed, err := compactState(cfg)
+	if err != nil {
+		return report, err
+	}
+	report.unsealsDropped, report.stateBytes = dropped, reclaimed
+	return report, nil
+}
+
+// pruneHistory drops records older than cutoff.
+func pruneHistory(path string, cutoff time.Time) (int, int64, error) {
+	return rewriteFile(path, func(in io.Reader, out *bufio.Writer) (int, error) {
+		scanner := bufio.NewScanner(in)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		pruned := 0
+		for scanner.Scan() {
+			var rec struct {
+				Time time.Time `json:"time"`
+			}
+			// Keep lines we can't parse rather than silently losing them.
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err == nil && rec.Time.Before(cutoff) {
+				pruned++
+				continue
+			}
+			out.Write(scanner.Bytes())
+			out.WriteByte('\n')
+		}
+		if err := scanner.Err(); err != nil {
+			return 0, fmt.Errorf("read history: %w", err)
+		}
+		return pruned, nil
+	})
+}
+
+// rewriteFile streams path through filter into a temp file that atomically
+// replaces the original, so a crash mid-way leaves the old file intact.
+// filter returns how many records it dropped; when none were, the original
+// is left alone. It holds the file's lock (see lockHistory) throughout and
+// returns the dropped count and the bytes reclaimed.
+func rewriteFile(path string, filter func(in io.Reader, out *bufio.Writer) (int, error)) (int, int64, error) {
+	unlock, err := lockHistory(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer unlock()
+
+	before, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("stat %s: %w", path, err)
+	}
+
+	in, err := os.Open(path)
+	if err != nil {
+		return 0, 0, fmt.Errorf("open %s: %w", path, err)
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return 0, 0, fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	out := bufio.NewWriter(tmp)
+	dropped, err := filter(in, out)
+	if err != nil {
+		tmp.Close()
+		return 0, 0, err
+	}
+	if dropped == 0 {
+		tmp.Close()
+		return 0, 0, nil
+	}
+
+	if err := out.Flush(); err != nil {
+		tmp.Close()
+		return 0, 0, fmt.Errorf("write temp file: %w", err)
+	}
+	if err := tmp.Chmod(before.Mode().Perm()); err != nil {
+		tmp.Close()
+		return 0, 0, fmt.Errorf("chmod temp file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return 0, 0, fmt.Errorf("sync temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, 0, fmt.Errorf("close temp file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, 0, fmt.Errorf("replace %s: %w", path, err)
+	}
+
+	after, err := os.Stat(path)
+	if err != nil {
+		return dropped, 0, nil
+	}
+	return dropped, before.Size() - after.Size(), nil
+}
+
+// compactState drops expired unseal records and seal backend entries for
+// addresses that are no longer configured.
+func compactState(cfg *VaultConfig) (int, int64, error) {
+	store := newStateStore(cfg.StateFile)
+	before, err := os.Stat(store.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("stat state: %w", err)
+	}
+
+	dropped := 0
+	err = store.update(func(st *wardenState) {
+		kept := st.Unseals[:0]
+		for _, u := range st.Unseals {
+			if time.Since(u.Started) < unsealRecordRetention {
+				kept = append(kept, u)
+			}
+		}
+		dropped = len(st.Unseals) - len(kept)
+		st.Unseals = kept
+
+		for addr := range st.SealBackends {
+			if addr != cfg.Address {
+				delete(st.SealBackends, addr)
+			}
+		}
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	after, err := os.Stat(store.path)
+	if err != nil {
+		return dropped, 0, nil
+	}
+	return dropped, before.Size() - after.Size(), nil
+}
+
+// maintenanceJob schedules runMaintenance on the configured cron schedule,
+// or every interval when no schedule is set.
+func maintenanceJob(cfg *VaultConfig) jobSpec {
+	spec := jobSpec{
+		name:    "maintenance",
+		every:   time.Duration(cfg.Maintenance.Interval),
+		timeout: time.Hour,
+		run: func(ctx context.Context) error {
+			report, err := runMaintenance(cfg)
+			if err != nil {
+				return err
+			}
+			logInfo("🧹 Maintenance: {report}", "report", report)
+			return nil
+		},
+	}
+	if cfg.Maintenance.Schedule != "" {
+		spec.cron, _ = parseCron(cfg.Maintenance.Schedule) // validated at load
+	}
+	return spec
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// --- Command: Maintenance ---
+
+func runMaintenanceCommand(cfg *VaultConfig, args []string) error {
+	if len(args) < 1 || args[0] != "run" {
+		return fmt.Errorf("usage: vault-warden maintenance run")
+	}
+	report, err := runMaintenance(cfg)
+	if err != nil {
+		return err
+	}
+	logInfo("✓ Maintenance complete: {report}", "report", report)
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/user"
+	"strings"
+)
+
+// --- Command: Seal ---
+
+// errSealNotConfirmed is a seal the operator didn't confirm.
+var errSealNotConfirmed = errors.New("seal not confirmed")
+
+var (
+	msgManualSeal     = message("manual-seal.title")
+	msgManualSealBody = message("manual-seal.body")
+	msgManualReason   = message("manual-seal.reason")
+)
+
+// runSeal seals a cluster through sys/seal, for when a compromise is
+// suspected. The token comes from -token, VAULT_TOKEN or seal_token, in
+// that order; it needs update and sudo on sys/seal.
+func runSeal(cfg *VaultConfig, args []string) error {
+	fs := flagSet("seal")
+	token := fs.String("token", "", "Vault token allowed to seal (default $VAULT_TOKEN, then seal_token)")
+	yes := fs.Bool("yes", false, "Seal without asking for confirmation")
+	cluster := fs.String("cluster", "", "Label of the cluster to seal; required with vaults")
+	reason := fs.String("reason", "", "Why, for the notification")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(cfg.Vaults) > 0 && *cluster == "" {
+		return fmt.Errorf("seal needs -cluster with vaults")
+	}
+	targets, err := selectClusters(cfg, *cluster)
+	if err != nil {
+		return err
+	}
+	c := targets[0]
+	tok := *token
+	if tok == "" {
+		tok = os.Getenv("VAULT_TOKEN")
+	}
+	if tok == "" {
+		tok = c.SealToken
+	}
+	if tok == "" {
+		return fmt.Errorf("no token: pass -token, set VAULT_TOKEN or seal_token")
+	}
+
+	client, err := newVaultClient(c)
+	if err != nil {
+		return err
+	}
+	before, err := fetchSealStatus(c, client)
+	if err != nil {
+		return err
+	}
+	if before.Sealed {
+		logInfo("✓ {cluster} ({address}) is already sealed", "cluster", clusterLabel(c), "address", c.Address)
+		return nil
+	}
+	if !*yes {
+		if err := confirmSeal(c); err != nil {
+			return err
+		}
+	}
+
+	req, cancel, err := newOpRequest(c, opAPI, http.MethodPut, c.Address+"/v1/sys/seal", nil)
+	if err != nil {
+		return fmt.Errorf("create seal request: %w", err)
+	}
+	defer cancel()
+	req.Header.Set("X-Vault-Token", tok)
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("seal request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	switch {
+	case resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("the token may not seal %s: it needs update and sudo on sys/seal", c.Address)
+	case resp.StatusCode/100 != 2:
+		var e struct {
+			Errors []string `json:"errors"`
+		}
+		json.Unmarshal(body, &e)
+		return &vaultResponseError{op: "seal", status: resp.StatusCode, errors: e.Errors}
+	}
+
+	after, err := fetchSealStatus(c, client)
+	if err != nil {
+		return fmt.Errorf("sealed, but could not confirm it: %w", err)
+	}
+	if !after.Sealed {
+		return fmt.Errorf("Vault accepted the seal but still reports unsealed; check %s", c.Address)
+	}
+	logWarn("🛑 Sealed {cluster} ({address})", "cluster", clusterLabel(c), "address", c.Address)
+	publishSealState(c, "sealed")
+
+	host, _ := os.Hostname()
+	who := os.Getenv("SUDO_USER")
+	if u, err := user.Current(); who == "" && err == nil {
+		who = u.Username
+	}
+	var why localText
+	if *reason != "" {
+		why = msgManualReason.with("reason", mdText(*reason, maxErrorLen))
+	}
+	notify(c, Alert{Severity: sevCritical, Color: sevCritical.color(), Rule: "manual-seal", User: who}.say(
+		msgManualSeal.with(), msgManualSealBody.with("address", mdCode(c.Address, maxPathLen), "host", mdText(host, maxNameLen),
+			"user", mdText(who, maxNameLen), "reason", why)))
+	return nil
+}
+
+// confirmSeal asks for the cluster's label on the terminal. Without one
+// it refuses, so a script has to say -yes.
+func confirmSeal(c *VaultConfig) error {
+	if fi, err := os.Stdin.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return fmt.Errorf("stdin is not a terminal; pass -yes to seal without confirmation")
+	}
+	label := clusterLabel(c)
+	fmt.Printf("This seals %s (%s). It stays sealed until enough key shares unseal it.\n", label, c.Address)
+	fmt.Printf("Type %q to confirm: ", label)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		fmt.Println()
+		return fmt.Errorf("%w: nothing was read; pass -yes to seal without confirmation", errSealNotConfirmed)
+	}
+	if strings.TrimSpace(line) != label {
+		return errSealNotConfirmed
+	}
+	return nil
+}
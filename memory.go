@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- Memory Budget ---
+
+const (
+	defaultMemoryInterval = 15 * time.Second
+	// cgroupBudgetShare is the part of a cgroup memory limit the budget
+	// defaults to, leaving the rest to the runtime and the page cache.
+	cgroupBudgetShare = 0.8
+	// memoryRecoverShare is how far under the budget the heap must fall
+	// before a shedding stage is undone, so the stages don't flap.
+	memoryRecoverShare = 0.7
+	// shedSessionRate is the share of entries still indexed into sessions
+	// in the sample-sessions stage.
+	shedSessionRate = 0.1
+	// cacheEntryOverhead is what an estimate charges per entry on top of
+	// its strings: map slot, pointers and struct headers. An entry holding
+	// a map of its own is also charged cacheMapOverhead, for the map's
+	// header and first bucket.
+	cacheEntryOverhead = 64
+	cacheMapOverhead   = 400
+)
+
+// MemoryConfig bounds the heap of a long-running audit daemon. Above the
+// budget the warden sheds in stages instead of growing until it is OOM
+// killed: first its caches shrink, then session indexing samples harder,
+// then it stops. Alert rules and detectors keep seeing every entry.
+type MemoryConfig struct {
+	// BudgetMB is the heap budget. Unset, it is 80% of the cgroup memory
+	// limit; without a limit there is no budget.
+	BudgetMB int64    `yaml:"budget_mb"`
+	Interval Duration `yaml:"interval"` // between heap samples
+	Disabled bool     `yaml:"disabled"`
+}
+
+// Shedding stages, each keeping those before it.
+const (
+	shedNone     = iota
+	shedShrink   // caches are held to half their limits
+	shedSample   // session indexing keeps shedSessionRate of entries
+	shedSessions // session indexing stops and is emptied
+)
+
+var shedStageNames = []string{"none", "shrink-caches", "sample-sessions", "drop-sessions"}
+
+// shedStage is the process-wide stage, read on every audit entry.
+var shedStage int32
+
+func shedding(stage int32) bool { return atomic.LoadInt32(&shedStage) >= stage }
+
+// shedCap is a cache limit as it stands: halved while caches are shrunk.
+func shedCap(n int) int {
+	if n > 1 && shedding(shedShrink) {
+		return n / 2
+	}
+	return n
+}
+
+// shedKeep reports whether an entry still reaches session indexing. Like
+// the sampler, it hashes the line.
+func shedKeep(line string) bool {
+	switch {
+	case shedding(shedSessions):
+		return false
+	case !shedding(shedSample):
+		return true
+	}
+	h := fnv.New64a()
+	h.Write([]byte(line))
+	if float64(h.Sum64())/math.MaxUint64 < shedSessionRate {
+		return true
+	}
+	metrics.inc("memory_shed_sampled_out_total")
+	return false
+}
+
+// cacheUsage is one cache's size. Bytes is an estimate: the lengths of the
+// strings held plus a fixed cost per entry.
+type cacheUsage struct {
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"estimated_bytes"`
+}
+
+// memoryCache is a cache the guard reports on and shrinks.
+type memoryCache interface {
+	usage() cacheUsage
+	// shed evicts, least recently used first, down to the cache's
+	// shedCap limit.
+	shed()
+}
+
+// oldestKeys orders the keys of a cache by when they were last seen,
+// oldest first, for trimming it in one pass.
+func oldestKeys(seen map[string]time.Time) []string {
+	keys := make([]string, 0, len(seen))
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return seen[keys[i]].Before(seen[keys[j]]) })
+	return keys
+}
+
+// memoryGuard samples the heap against the budget and moves through the
+// shedding stages, one per sample.
+type memoryGuard struct {
+	cfg      *VaultConfig
+	budget   uint64 // zero: no budget, only the cache report
+	origin   string // where the budget came from, for the log
+	caches   map[string]memoryCache
+	sessions *sessionIndex
+
+	mu    sync.Mutex
+	heap  uint64
+	since time.Time // shedding began
+}
+
+func newMemoryGuard(cfg *VaultConfig, caches map[string]memoryCache, sessions *sessionIndex) *memoryGuard {
+	g := &memoryGuard{cfg: cfg, caches: caches, sessions: sessions}
+	mc := cfg.Memory
+	switch {
+	case mc.Disabled:
+	case mc.BudgetMB > 0:
+		g.budget, g.origin = uint64(mc.BudgetMB)<<20, "memory.budget_mb"
+	default:
+		if limit, ok := cgroupMemoryLimit(); ok {
+			g.budget = uint64(float64(limit) * cgroupBudgetShare)
+			g.origin = fmt.Sprintf("%.0f%% of the cgroup limit of %s", cgroupBudgetShare*100, formatBytes(int64(limit)))
+		}
+	}
+	return g
+}
+
+// cgroupMemoryLimit reads the memory limit of the process's cgroup, v2 or
+// v1. It is false when there is none or it can't be read.
+func cgroupMemoryLimit() (uint64, bool) {
+	var candidates []string
+	if f, err := os.Open("/proc/self/cgroup"); err == nil {
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			parts := strings.SplitN(sc.Text(), ":", 3)
+			if len(parts) != 3 {
+				continue
+			}
+			switch {
+			case parts[0] == "0" && parts[1] == "":
+				candidates = append(candidates, "/sys/fs/cgroup"+parts[2]+"/memory.max")
+			case containsString(strings.Split(parts[1], ","), "memory"):
+				candidates = append(candidates, "/sys/fs/cgroup/memory"+parts[2]+"/memory.limit_in_bytes")
+			}
+		}
+		f.Close()
+	}
+	// Inside a container the cgroup is mounted as the root.
+	candidates = append(candidates, "/sys/fs/cgroup/memory.max", "/sys/fs/cgroup/memory/memory.limit_in_bytes")
+	for _, path := range candidates {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		v := strings.TrimSpace(string(data))
+		if v == "max" {
+			return 0, false
+		}
+		n, err := strconv.ParseUint(v, 10, 64)
+		// v1 reports no limit as a number near the top of int64.
+		if err != nil || n == 0 || n >= 1<<62 {
+			return 0, false
+		}
+		return n, true
+	}
+	return 0, false
+}
+
+var (
+	msgMemoryShedding      = message("memory-budget.shedding.title")
+	msgMemorySheddingBody  = message("memory-budget.shedding.body")
+	msgMemoryRecovered     = message("memory-budget.recovered.title")
+	msgMemoryRecoveredBody = message("memory-budget.recovered.body")
+)
+
+// sample reads the heap and moves one stage towards where it should be.
+func (g *memoryGuard) sample() {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	heap := ms.HeapAlloc
+	g.mu.Lock()
+	g.heap = heap
+	g.mu.Unlock()
+	stage := atomic.LoadInt32(&shedStage)
+	switch {
+	case heap > g.budget && stage < shedSessions:
+		g.escalate(stage+1, heap)
+	case float64(heap) < memoryRecoverShare*float64(g.budget) && stage > shedNone:
+		g.relax(stage-1, heap)
+	}
+	metrics.set("memory_heap_bytes", float64(heap))
+	metrics.set("memory_budget_bytes", float64(g.budget))
+	metrics.set("memory_shed_stage", float64(atomic.LoadInt32(&shedStage)))
+}
+
+func (g *memoryGuard) escalate(stage int32, heap uint64) {
+	atomic.StoreInt32(&shedStage, stage)
+	name := shedStageNames[stage]
+	metrics.inc("memory_shed_stages_total", "stage", name)
+	logWarn("🧠 Heap at {heap}, over the memory budget of {budget}: shedding, stage {stage}",
+		"heap", formatBytes(int64(heap)), "budget", formatBytes(int64(g.budget)), "stage", name)
+	switch stage {
+	case shedShrink:
+		for _, c := range g.caches {
+			c.shed()
+		}
+	case shedSessions:
+		g.sessions.clear()
+	}
+	if stage != shedShrink {
+		return
+	}
+	g.mu.Lock()
+	g.since = time.Now()
+	g.mu.Unlock()
+	notify(g.cfg, Alert{Severity: sevWarning, Color: sevWarning.color(), Rule: "memory-budget", Incident: "memory-budget"}.say(
+		msgMemoryShedding.with(), msgMemorySheddingBody.with("heap", formatBytes(int64(heap)), "budget", formatBytes(int64(g.budget)))))
+}
+
+func (g *memoryGuard) relax(stage int32, heap uint64) {
+	undone := shedStageNames[stage+1]
+	atomic.StoreInt32(&shedStage, stage)
+	logInfo("🧠 Heap at {heap}, back under the memory budget of {budget}: stage {stage} undone",
+		"heap", formatBytes(int64(heap)), "budget", formatBytes(int64(g.budget)), "stage", undone)
+	if stage != shedNone {
+		return
+	}
+	g.mu.Lock()
+	lasted := time.Since(g.since)
+	g.mu.Unlock()
+	notify(g.cfg, Alert{Severity: sevInfo, Color: sevInfo.color(), Rule: "memory-budget", Incident: "memory-budget", Resolved: true}.say(
+		msgMemoryRecovered.with(), msgMemoryRecoveredBody.with("heap", formatBytes(int64(heap)), "duration", formatDuration(lasted.Round(time.Second)))))
+}
+
+// memoryJob samples the heap once per memory.interval.
+func memoryJob(g *memoryGuard) jobSpec {
+	return jobSpec{
+		name:    "memory-budget",
+		every:   time.Duration(g.cfg.Memory.Interval),
+		timeout: 30 * time.Second,
+		run: func(ctx context.Context) error {
+			g.sample()
+			return nil
+		},
+	}
+}
+
+// memoryStatus is the /statusz view of the budget and the caches.
+type memoryStatus struct {
+	BudgetBytes uint64                `json:"budget_bytes,omitempty"`
+	HeapBytes   uint64                `json:"heap_bytes,omitempty"` // at the last sample
+	Stage       string                `json:"stage"`
+	Since       *time.Time            `json:"since,omitempty"`
+	Caches      map[string]cacheUsage `json:"caches"`
+}
+
+func (g *memoryGuard) status() *memoryStatus {
+	if g == nil {
+		return nil
+	}
+	st := &memoryStatus{BudgetBytes: g.budget, Stage: shedStageNames[atomic.LoadInt32(&shedStage)],
+		Caches: make(map[string]cacheUsage, len(g.caches))}
+	g.mu.Lock()
+	st.HeapBytes = g.heap
+	if shedding(shedShrink) {
+		since := g.since
+		st.Since = &since
+	}
+	g.mu.Unlock()
+	for name, c := range g.caches {
+		st.Caches[name] = c.usage()
+	}
+	return st
+}
+
+func validateMemory(cfg *VaultConfig) error {
+	mc := &cfg.Memory
+	if mc.BudgetMB < 0 {
+		return &fieldError{"memory.budget_mb", "must not be negative"}
+	}
+	if mc.Interval == 0 {
+		mc.Interval = Duration(defaultMemoryInterval)
+	}
+	if mc.Interval < Duration(time.Second) {
+		return &fieldError{"memory.interval", "must be at least 1s"}
+	}
+	return nil
+}
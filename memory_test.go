@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// resetShedding puts the process-wide stage back when the test ends.
+func resetShedding(t *testing.T) {
+	t.Helper()
+	t.Cleanup(func() { atomic.StoreInt32(&shedStage, shedNone) })
+}
+
+func liveHeap() uint64 {
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.HeapAlloc
+}
+
+// Over the budget the guard goes one stage per sample, alerting once as
+// it starts; back under, it undoes one per sample and alerts once the
+// last is undone.
+func TestMemoryStages(t *testing.T) {
+	resetShedding(t)
+	cfg, err := loadTestConfig(t, envTestBase+"session_index:\n  enabled: true\n  max_accessors: 8\nmemory:\n  budget_mb: 1\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions := newSessionIndex(cfg.SessionIndex)
+	for i := 0; i < 8; i++ {
+		sessions.record(fmt.Sprintf("acc-%d", i), sessionAction{Path: "secret/data/x", Operation: "read"})
+	}
+	g := newMemoryGuard(cfg, map[string]memoryCache{"sessions": sessions}, sessions)
+	if g.budget != 1<<20 || g.origin != "memory.budget_mb" {
+		t.Fatalf("budget = %d from %q", g.budget, g.origin)
+	}
+	sent := captureAlerts(t)
+	before := metrics.sum("memory_shed_stages_total")
+
+	var stages []string
+	entries := []int{sessions.usage().Entries}
+	out := captureStdout(t, func() {
+		for i := 0; i < 4; i++ {
+			g.sample()
+			stages = append(stages, g.status().Stage)
+			entries = append(entries, sessions.usage().Entries)
+		}
+	})
+	if got := strings.Join(stages, " "); got != "shrink-caches sample-sessions drop-sessions drop-sessions" {
+		t.Errorf("stages = %s", got)
+	}
+	if fmt.Sprint(entries) != "[8 4 4 0 0]" {
+		t.Errorf("sessions held = %v, want halved then emptied", entries)
+	}
+	if d := metrics.sum("memory_shed_stages_total") - before; d != 3 {
+		t.Errorf("memory_shed_stages_total grew by %v, want a count per stage", d)
+	}
+	if n := strings.Count(out, "over the memory budget of 1.0 MiB"); n != 3 {
+		t.Errorf("logged %d stages, want 3:\n%s", n, out)
+	}
+	if st := g.status(); st.Since == nil || st.HeapBytes <= st.BudgetBytes || st.Caches["sessions"].Entries != 0 {
+		t.Errorf("status = %+v", st)
+	}
+	alerts := sent()
+	if len(alerts) != 1 || alerts[0].Rule != "memory-budget" || alerts[0].Title != english.render(msgMemoryShedding.with()) {
+		t.Fatalf("alerts = %+v, want one as shedding began", alerts)
+	}
+
+	g.budget = 1 << 40
+	stages = nil
+	captureStdout(t, func() {
+		for i := 0; i < 4; i++ {
+			g.sample()
+			stages = append(stages, g.status().Stage)
+		}
+	})
+	if got := strings.Join(stages, " "); got != "sample-sessions shrink-caches none none" {
+		t.Errorf("stages = %s", got)
+	}
+	alerts = sent()
+	if len(alerts) != 1 || alerts[0].Title != english.render(msgMemoryRecovered.with()) || alerts[0].Severity != sevInfo {
+		t.Errorf("alerts = %+v, want one as the last stage was undone", alerts)
+	}
+	if st := g.status(); st.Since != nil {
+		t.Errorf("since = %v with nothing shed", st.Since)
+	}
+}
+
+func TestMemoryShedKeep(t *testing.T) {
+	resetShedding(t)
+	lines := make([]string, 10000)
+	for i := range lines {
+		lines[i] = historyLine(fmt.Sprintf("oidc-%d", i), "secret/data/x")
+	}
+	kept := func() int {
+		n := 0
+		for _, l := range lines {
+			if shedKeep(l) {
+				n++
+			}
+		}
+		return n
+	}
+	for _, tt := range []struct {
+		stage    int32
+		min, max int
+		cap      int
+	}{
+		{shedNone, 10000, 10000, 100},
+		{shedShrink, 10000, 10000, 50},
+		{shedSample, 700, 1300, 50},
+		{shedSessions, 0, 0, 50},
+	} {
+		atomic.StoreInt32(&shedStage, tt.stage)
+		if n := kept(); n < tt.min || n > tt.max {
+			t.Errorf("%s: kept %d of 10000, want %d-%d", shedStageNames[tt.stage], n, tt.min, tt.max)
+		}
+		if c := shedCap(100); c != tt.cap {
+			t.Errorf("%s: shedCap(100) = %d, want %d", shedStageNames[tt.stage], c, tt.cap)
+		}
+	}
+	// The same line is kept or not on every replica.
+	atomic.StoreInt32(&shedStage, shedSample)
+	if kept() != kept() {
+		t.Error("sampling differs between runs")
+	}
+}
+
+func TestValidateMemory(t *testing.T) {
+	for _, tt := range []struct {
+		mc   MemoryConfig
+		want string
+	}{
+		{MemoryConfig{}, ""},
+		{MemoryConfig{BudgetMB: 512, Interval: Duration(time.Minute)}, ""},
+		{MemoryConfig{BudgetMB: -1}, "memory.budget_mb must not be negative"},
+		{MemoryConfig{Interval: Duration(time.Millisecond)}, "memory.interval must be at least 1s"},
+	} {
+		cfg := &VaultConfig{Memory: tt.mc}
+		if got := errString(validateMemory(cfg)); got != tt.want {
+			t.Errorf("%+v: %q, want %q", tt.mc, got, tt.want)
+		}
+		if tt.want == "" && tt.mc.Interval == 0 && cfg.Memory.Interval != Duration(defaultMemoryInterval) {
+			t.Errorf("interval = %s, want the default", time.Duration(cfg.Memory.Interval))
+		}
+	}
+	if g := newMemoryGuard(&VaultConfig{Memory: MemoryConfig{BudgetMB: 64, Disabled: true}}, nil, nil); g.budget != 0 {
+		t.Errorf("disabled guard has a budget of %d", g.budget)
+	}
+}
+
+// A soak under traffic whose every entry is a new accessor, user and
+// path: unshed, the session index alone would hold several times the
+// budget. The live heap stays under it, and every rule alert is still
+// raised, before shedding and after.
+func TestMemorySoak(t *testing.T) {
+	if testing.Short() {
+		t.Skip("soak")
+	}
+	resetShedding(t)
+	const (
+		lines       = 20000
+		sampleEvery = 10 // the guard's interval, in entries
+		alertEvery  = 500
+		headroomMB  = 24
+	)
+	budgetMB := liveHeap()>>20 + headroomMB
+	cfg, err := loadTestConfig(t, envTestBase+fmt.Sprintf(`
+session_index:
+  enabled: true
+  entries_per_accessor: 128
+  max_accessors: 1000000
+first_access:
+  enabled: true
+  max_identities: 20000
+memory:
+  budget_mb: %d
+rules:
+  - name: payments-read
+    paths: ["kv/data/payments/"]
+    severity: warning
+    cooldown: 1h
+`, budgetMB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newAuditor(cfg)
+	g := newMemoryGuard(cfg, a.memoryCaches(), a.sessions)
+	sent := captureAlerts(t)
+	before := metrics.sum("memory_shed_stages_total")
+
+	var peak uint64
+	var rules, shedding int
+	captureStdout(t, func() {
+		for i := 0; i < lines; i++ {
+			path := fmt.Sprintf("secret/data/team-%d/key", i)
+			if i%alertEvery == 0 {
+				path = fmt.Sprintf("kv/data/payments/%d", i)
+			}
+			a.processAuditLine(fmt.Sprintf(`{"time":"%s","type":"response","auth":{"accessor":"hmac-sha256:%08x","display_name":"oidc-u%d"},"request":{"id":"r-%d","path":"%s","operation":"read"}}`,
+				time.Now().UTC().Format(time.RFC3339Nano), i, i, i, path))
+			if i%sampleEvery == 0 {
+				g.sample()
+			}
+			if i%1000 == 999 {
+				if h := liveHeap(); h > peak {
+					peak = h
+				}
+				for _, al := range sent() {
+					switch al.Rule {
+					case "payments-read":
+						rules++
+					case "memory-budget":
+						shedding++
+					}
+				}
+			}
+		}
+	})
+
+	// The guard acts on samples, so the heap can pass the budget by what
+	// arrives in the three samples it takes to stop indexing sessions:
+	// a few hundred KiB here.
+	budget := uint64(budgetMB) << 20
+	if peak >= budget+1<<20 {
+		t.Errorf("live heap peaked at %s, over the budget of %s", formatBytes(int64(peak)), formatBytes(int64(budget)))
+	}
+	if rules != lines/alertEvery {
+		t.Errorf("%d payments-read alerts, want %d", rules, lines/alertEvery)
+	}
+	if shedding == 0 || metrics.sum("memory_shed_stages_total")-before < 3 {
+		t.Errorf("%d memory-budget alerts, %v stages: the guard never reached drop-sessions", shedding,
+			metrics.sum("memory_shed_stages_total")-before)
+	}
+	st := g.status()
+	if u := st.Caches["sessions"]; u.Bytes > int64(budget) {
+		t.Errorf("sessions hold an estimated %s", formatBytes(u.Bytes))
+	}
+	if u := st.Caches["first_access"]; u.Entries == 0 || u.Entries > 20000 {
+		t.Errorf("first_access holds %d identities, want at most max_identities", u.Entries)
+	}
+	t.Logf("budget %s, peak live heap %s, stage %s, caches %+v", formatBytes(int64(budget)), formatBytes(int64(peak)), st.Stage, st.Caches)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Metrics ---
+
+// Every exporter renders the same registry snapshot, so the numbers
+// agree whichever backend is looking.
+
+const defaultMaxSeries = 100
+
+// MetricsConfig configures metric collection and the push exporters.
+type MetricsConfig struct {
+	// MaxSeries caps distinct label sets per metric; further label sets
+	// are counted under overflow="true" instead.
+	MaxSeries int          `yaml:"max_series"`
+	StatsD    StatsDConfig `yaml:"statsd"`
+}
+
+type metricKind int
+
+const (
+	kindCounter metricKind = iota
+	kindGauge
+	kindHistogram
+)
+
+// latencyBuckets are the upper bounds (seconds) of delivery histograms.
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metricSample is one series in a snapshot. For histograms, Buckets holds
+// cumulative counts per bound in latencyBuckets; Value is the sum.
+type metricSample struct {
+	Name    string
+	Kind    metricKind
+	Labels  []string // alternating name, value; sorted by name
+	Value   float64
+	Count   uint64
+	Buckets []uint64
+}
+
+type metricsRegistry struct {
+	mu         sync.Mutex
+	maxSeries  int
+	series     map[string]*metricSample
+	perName    map[string]int
+	collectors []func(*metricsRegistry)
+}
+
+// metrics is the process-wide registry. Recording is cheap enough to do
+// unconditionally; nothing is sent unless an exporter is configured.
+var metrics = newMetricsRegistry(defaultMaxSeries)
+
+func newMetricsRegistry(maxSeries int) *metricsRegistry {
+	return &metricsRegistry{
+		maxSeries: maxSeries,
+		series:    make(map[string]*metricSample),
+		perName:   make(map[string]int),
+	}
+}
+
+func (r *metricsRegistry) setMaxSeries(n int) {
+	r.mu.Lock()
+	r.maxSeries = n
+	r.mu.Unlock()
+}
+
+// lookup returns the series for name and labels, creating it if needed.
+// Once a metric has maxSeries label sets, new ones share one overflow
+// series. Callers hold r.mu.
+func (r *metricsRegistry) lookup(name string, kind metricKind, labels []string) *metricSample {
+	labels = sortLabels(labels)
+	key := name + "\x00" + strings.Join(labels, "\x00")
+	if s, ok := r.series[key]; ok {
+		return s
+	}
+	if len(labels) > 0 && r.perName[name] >= r.maxSeries {
+		labels = []string{"overflow", "true"}
+		key = name + "\x00overflow\x00true"
+		if s, ok := r.series[key]; ok {
+			return s
+		}
+	}
+	s := &metricSample{Name: name, Kind: kind, Labels: labels}
+	if kind == kindHistogram {
+		s.Buckets = make([]uint64, len(latencyBuckets))
+	}
+	r.series[key] = s
+	r.perName[name]++
+	return s
+}
+
+// inc adds one to a counter. labels alternate name and value.
+func (r *metricsRegistry) inc(name string, labels ...string) {
+	r.add(name, 1, labels...)
+}
+
+func (r *metricsRegistry) add(name string, n float64, labels ...string) {
+	r.mu.Lock()
+	r.lookup(name, kindCounter, labels).Value += n
+	r.mu.Unlock()
+}
+
+// set sets a gauge.
+func (r *metricsRegistry) set(name string, v float64, labels ...string) {
+	r.mu.Lock()
+	r.lookup(name, kindGauge, labels).Value = v
+	r.mu.Unlock()
+}
+
+// observe records a value (seconds) in a histogram.
+func (r *metricsRegistry) observe(name string, v float64, labels ...string) {
+	r.mu.Lock()
+	s := r.lookup(name, kindHistogram, labels)
+	s.Value += v
+	s.Count++
+	for i, bound := range latencyBuckets {
+		if v <= bound {
+			s.Buckets[i]++
+		}
+	}
+	r.mu.Unlock()
+}
+
+// sum totals a metric over all its label sets.
+func (r *metricsRegistry) sum(name string) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	total := 0.0
+	for _, s := range r.series {
+		if s.Name == name {
+			total += s.Value
+		}
+	}
+	return total
+}
+
+// onCollect registers fn to refresh gauges right before each snapshot.
+func (r *metricsRegistry) onCollect(fn func(*metricsRegistry)) {
+	r.mu.Lock()
+	r.collectors = append(r.collectors, fn)
+	r.mu.Unlock()
+}
+
+// snapshot returns a copy of every series, sorted by name and labels.
+func (r *metricsRegistry) snapshot() []metricSample {
+	r.mu.Lock()
+	collectors := make([]func(*metricsRegistry), len(r.collectors))
+	copy(collectors, r.collectors)
+	r.mu.Unlock()
+	for _, fn := range collectors {
+		fn(r)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]metricSample, 0, len(r.series))
+	keys := make([]string, 0, len(r.series))
+	for k := range r.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := *r.series[k]
+		s.Labels = append([]string(nil), s.Labels...)
+		s.Buckets = append([]uint64(nil), s.Buckets...)
+		out = append(out, s)
+	}
+	return out
+}
+
+// sortLabels returns the name/value pairs ordered by name. A trailing
+// name without a value is dropped.
+func sortLabels(labels []string) []string {
+	n := len(labels) / 2
+	if n == 0 {
+		return nil
+	}
+	pairs := make([][2]string, n)
+	for i := range pairs {
+		pairs[i] = [2]string{labels[2*i], labels[2*i+1]}
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i][0] < pairs[j][0] })
+	out := make([]string, 0, 2*n)
+	for _, p := range pairs {
+		out = append(out, p[0], p[1])
+	}
+	return out
+}
+
+// recordDelivery counts one delivery attempt to a sink and its latency.
+func recordDelivery(sink string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	metrics.inc("deliveries_total", "sink", sink, "result", result)
+	metrics.observe("delivery_seconds", time.Since(start).Seconds(), "sink", sink)
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// --- MQTT Publisher ---
+
+const (
+	mqttKeepAlive    = 60 * time.Second
+	mqttAckTimeout   = 10 * time.Second
+	mqttMaxBackoff   = 2 * time.Minute
+	mqttDefaultQueue = 100
+)
+
+// MQTTConfig publishes alerts (as Alert JSON) to an MQTT 3.1.1 broker.
+// Broker URLs use tcp:// (or mqtt://) and ssl:// (or tls://, mqtts://).
+type MQTTConfig struct {
+	Broker   string `yaml:"broker"`
+	ClientID string `yaml:"client_id"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	// Topic and StateTopic are templates over .Cluster, .Environment,
+	// .Severity and .Host.
+	Topic       string `yaml:"topic"`
+	StateTopic  string `yaml:"state_topic"`  // retained seal state
+	StatusTopic string `yaml:"status_topic"` // retained online/offline, also the last will
+	QoS         int    `yaml:"qos"`
+	Buffer      int    `yaml:"buffer"` // messages held while disconnected
+
+	TLS struct {
+		CACert             string `yaml:"ca_cert"`
+		InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	} `yaml:"tls"`
+}
+
+type mqttMessage struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+type mqttTopicData struct {
+	Cluster     string
+	Environment string
+	Severity    string
+	Host        string
+}
+
+// mqttPublisher keeps one broker connection in the background,
+// reconnecting with backoff. Messages published while disconnected wait in
+// a bounded queue; the oldest are dropped once it is full.
+type mqttPublisher struct {
+	cfg        MQTTConfig
+	cluster    string
+	env        string
+	host       string
+	topic      *template.Template
+	stateTopic *template.Template
+	status     string
+
+	mu      sync.Mutex
+	queue   []mqttMessage
+	dropped int
+	wake    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+	nextID  uint16
+}
+
+// mqttSink is the process-wide MQTT publisher, nil when mqtt isn't
+// configured.
+var mqttSink *mqttPublisher
+
+func startMQTT(cfg *VaultConfig) *mqttPublisher {
+	if cfg.MQTT.Broker == "" {
+		return nil
+	}
+	host, _ := os.Hostname()
+	p := &mqttPublisher{
+		cfg:     cfg.MQTT,
+		cluster: clusterLabel(cfg),
+		env:     cfg.Environment,
+		host:    host,
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	// Templates were validated at load.
+	p.topic = template.Must(template.New("topic").Parse(cfg.MQTT.Topic))
+	if cfg.MQTT.StateTopic != "" {
+		p.stateTopic = template.Must(template.New("state_topic").Parse(cfg.MQTT.StateTopic))
+	}
+	if cfg.MQTT.StatusTopic != "" {
+		st, err := renderTopic(template.Must(template.New("status_topic").Parse(cfg.MQTT.StatusTopic)), p.data(""))
+		if err == nil {
+			p.status = st
+		}
+	}
+	if p.cfg.Buffer <= 0 {
+		p.cfg.Buffer = mqttDefaultQueue
+	}
+	go p.run()
+	return p
+}
+
+// clusterLabel names the cluster in topics: its vaults label, else the
+// environment when set, otherwise the Vault host.
+func clusterLabel(cfg *VaultConfig) string {
+	if cfg.label != "" {
+		return cfg.label
+	}
+	if cfg.Environment != "" {
+		return cfg.Environment
+	}
+	if u, err := url.Parse(cfg.Address); err == nil && u.Hostname() != "" {
+		return u.Hostname()
+	}
+	return "vault"
+}
+
+func (p *mqttPublisher) data(sev string) mqttTopicData {
+	return mqttTopicData{Cluster: p.cluster, Environment: p.env, Severity: sev, Host: p.host}
+}
+
+func renderTopic(t *template.Template, data mqttTopicData) (string, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func (p *mqttPublisher) publishAlert(a Alert) {
+	if p == nil {
+		return
+	}
+	topic, err := renderTopic(p.topic, p.data(a.Severity.String()))
+	if err != nil {
+		logWarn("⚠️  MQTT topic template failed: {error}", "error", err)
+		return
+	}
+	payload, err := json.Marshal(a)
+	if err != nil {
+		logWarn("⚠️  MQTT payload encoding failed: {error}", "error", err)
+		return
+	}
+	p.enqueue(mqttMessage{topic: topic, payload: payload})
+}
+
+// publishState publishes the current seal state as a retained message so
+// dashboards show it right after they reconnect.
+func (p *mqttPublisher) publishState(state string) {
+	if p == nil {
+		return
+	}
+	p.publishClusterState(p.cluster, state)
+}
+
+// publishClusterState is publishState for one of several clusters.
+func (p *mqttPublisher) publishClusterState(cluster, state string) {
+	if p == nil || p.stateTopic == nil {
+		return
+	}
+	data := p.data("")
+	data.Cluster = cluster
+	topic, err := renderTopic(p.stateTopic, data)
+	if err != nil {
+		logWarn("⚠️  MQTT state topic template failed: {error}", "error", err)
+		return
+	}
+	p.enqueue(mqttMessage{topic: topic, payload: []byte(state), retain: true})
+}
+
+func (p *mqttPublisher) enqueue(m mqttMessage) {
+	p.mu.Lock()
+	if len(p.queue) >= p.cfg.Buffer {
+		p.queue = p.queue[1:]
+		p.dropped++
+	}
+	p.queue = append(p.queue, m)
+	p.mu.Unlock()
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// close flushes queued messages for up to timeout, marks the warden offline
+// and disconnects.
+func (p *mqttPublisher) close(timeout time.Duration) {
+	if p == nil {
+		return
+	}
+	close(p.stop)
+	select {
+	case <-p.done:
+	case <-time.After(timeout):
+		p.mu.Lock()
+		n := len(p.queue)
+		p.mu.Unlock()
+		logWarn("⚠️  MQTT: gave up with {unsent} messages unsent", "unsent", n)
+	}
+}
+
+func (p *mqttPublisher) run() {
+	defer close(p.done)
+	backoff := time.Second
+	for {
+		conn, err := p.connect()
+		if err != nil {
+			logWarn("⚠️  MQTT connect failed (retrying in {retry_in}): {error}", "retry_in", backoff, "error", err)
+			select {
+			case <-time.After(backoff):
+			case <-p.stop:
+				return
+			}
+			if backoff *= 2; backoff > mqttMaxBackoff {
+				backoff = mqttMaxBackoff
+			}
+			continue
+		}
+		backoff = time.Second
+
+		stopped := p.serve(conn)
+		conn.Close()
+		if stopped {
+			return
+		}
+	}
+}
+
+// serve publishes queued messages until the connection fails (returns
+// false) or the publisher is stopped and drained (returns true).
+func (p *mqttPublisher) serve(conn net.Conn) bool {
+	r := bufio.NewReader(conn)
+	if p.status != "" {
+		if err := p.send(conn, r, mqttMessage{topic: p.status, payload: []byte("online"), retain: true}); err != nil {
+			logWarn("⚠️  MQTT publish failed: {error}", "error", err)
+			return false
+		}
+	}
+
+	stopping := false
+	ping := time.NewTicker(mqttKeepAlive / 2)
+	defer ping.Stop()
+	for {
+		p.mu.Lock()
+		var m *mqttMessage
+		if len(p.queue) > 0 {
+			m = &p.queue[0]
+		}
+		p.mu.Unlock()
+
+		if m != nil {
+			if err := p.send(conn, r, *m); err != nil {
+				logWarn("⚠️  MQTT publish failed: {error}", "error", err)
+				return false
+			}
+			p.mu.Lock()
+			p.queue = p.queue[1:]
+			p.mu.Unlock()
+			continue
+		}
+
+		if stopping {
+			if p.status != "" {
+				p.send(conn, r, mqttMessage{topic: p.status, payload: []byte("offline"), retain: true})
+			}
+			conn.Write([]byte{0xe0, 0x00}) // DISCONNECT
+			return true
+		}
+
+		select {
+		case <-p.wake:
+		case <-p.stop:
+			stopping = true
+		case <-ping.C:
+			if err := p.ping(conn, r); err != nil {
+				logWarn("⚠️  MQTT keepalive failed: {error}", "error", err)
+				return false
+			}
+		}
+	}
+}
+
+func (p *mqttPublisher) connect() (net.Conn, error) {
+	u, err := url.Parse(p.cfg.Broker)
+	if err != nil {
+		return nil, fmt.Errorf("parse broker URL: %w", err)
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+
+	var conn net.Conn
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		conn, err = dialer.Dial("tcp", hostPort(u, "1883"))
+	case "ssl", "tls", "mqtts":
+		tlsCfg := &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: p.cfg.TLS.InsecureSkipVerify}
+		if p.cfg.TLS.CACert != "" {
+			pem, rerr := os.ReadFile(p.cfg.TLS.CACert)
+			if rerr != nil {
+				return nil, fmt.Errorf("read MQTT CA: %w", rerr)
+			}
+			tlsCfg.RootCAs = x509.NewCertPool()
+			tlsCfg.RootCAs.AppendCertsFromPEM(pem)
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", hostPort(u, "8883"), tlsCfg)
+	default:
+		return nil, fmt.Errorf("unsupported broker scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(p.connectPacket()); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("send CONNECT: %w", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(mqttAckTimeout))
+	typ, body, err := readPacket(bufio.NewReader(conn))
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("read CONNACK: %w", err)
+	}
+	if typ != 2 || len(body) != 2 {
+		conn.Close()
+		return nil, fmt.Errorf("expected CONNACK, got packet type %d", typ)
+	}
+	if body[1] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("broker refused connection (code %d)", body[1])
+	}
+	return conn, nil
+}
+
+func hostPort(u *url.URL, defaultPort string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), defaultPort)
+}
+
+func (p *mqttPublisher) connectPacket() []byte {
+	clientID := p.cfg.ClientID
+	if clientID == "" {
+		clientID = "vault-warden-" + p.host
+	}
+
+	var vh, payload bytes.Buffer
+	writeMQTTString(&vh, "MQTT")
+	vh.WriteByte(4)     // protocol level 3.1.1
+	flags := byte(0x02) // clean session
+	writeMQTTString(&payload, clientID)
+	if p.status != "" {
+		flags |= 0x04 | 0x20 | byte(p.cfg.QoS)<<3 // will, will retain, will QoS
+		writeMQTTString(&payload, p.status)
+		writeMQTTString(&payload, "offline")
+	}
+	if p.cfg.Username != "" {
+		flags |= 0x80
+		writeMQTTString(&payload, p.cfg.Username)
+		if p.cfg.Password != "" {
+			flags |= 0x40
+			writeMQTTString(&payload, p.cfg.Password)
+		}
+	}
+	vh.WriteByte(flags)
+	binary.Write(&vh, binary.BigEndian, uint16(mqttKeepAlive/time.Second))
+	return mqttPacket(0x10, append(vh.Bytes(), payload.Bytes()...))
+}
+
+// send publishes one message, waiting for PUBACK at QoS 1.
+func (p *mqttPublisher) send(conn net.Conn, r *bufio.Reader, m mqttMessage) error {
+	var body bytes.Buffer
+	writeMQTTString(&body, m.topic)
+	header := byte(0x30) | byte(p.cfg.QoS)<<1
+	if m.retain {
+		header |= 0x01
+	}
+	var id uint16
+	if p.cfg.QoS > 0 {
+		p.nextID++
+		if p.nextID == 0 {
+			p.nextID = 1
+		}
+		id = p.nextID
+		binary.Write(&body, binary.BigEndian, id)
+	}
+	body.Write(m.payload)
+
+	conn.SetWriteDeadline(time.Now().Add(mqttAckTimeout))
+	if _, err := conn.Write(mqttPacket(header, body.Bytes())); err != nil {
+		return err
+	}
+	if p.cfg.QoS == 0 {
+		return nil
+	}
+	return p.await(conn, r, 4, func(b []byte) bool {
+		return len(b) == 2 && binary.BigEndian.Uint16(b) == id
+	})
+}
+
+func (p *mqttPublisher) ping(conn net.Conn, r *bufio.Reader) error {
+	conn.SetWriteDeadline(time.Now().Add(mqttAckTimeout))
+	if _, err := conn.Write([]byte{0xc0, 0x00}); err != nil {
+		return err
+	}
+	return p.await(conn, r, 13, func([]byte) bool { return true })
+}
+
+// await reads packets until one of type want satisfies match.
+func (p *mqttPublisher) await(conn net.Conn, r *bufio.Reader, want byte, match func([]byte) bool) error {
+	conn.SetReadDeadline(time.Now().Add(mqttAckTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		typ, body, err := readPacket(r)
+		if err != nil {
+			return err
+		}
+		if typ == want && match(body) {
+			return nil
+		}
+	}
+}
+
+func mqttPacket(header byte, body []byte) []byte {
+	out := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		out = append(out, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(out, body...)
+}
+
+func readPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, mult := 0, 1
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(b&0x7f) * mult
+		if b&0x80 == 0 {
+			break
+		}
+		if mult *= 128; i >= 3 {
+			return 0, nil, fmt.Errorf("malformed remaining length")
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header >> 4, body, nil
+}
+
+func writeMQTTString(b *bytes.Buffer, s string) {
+	binary.Write(b, binary.BigEndian, uint16(len(s)))
+	b.WriteString(s)
+}
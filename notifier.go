@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --- Notifiers ---
+
+// notifier posts alerts to webhook_url in one chat service's format. send
+// returns the alerts whose message failed, and the last error. encode is
+// the payload of one message. accept tells a delivered message from a
+// rejected one by the response, which each service reports its own way.
+type notifier interface {
+	kind() string // in metrics, the alert history and the outbox
+	send(cfg *VaultConfig, alerts []Alert) ([]Alert, error)
+	encode(m discordMessage) ([]byte, error)
+	accept(status int, body []byte) error
+}
+
+// headerNotifier is a notifier that sets request headers of its own.
+type headerNotifier interface {
+	header(m discordMessage) http.Header
+}
+
+// deliveringNotifier is a notifier that delivers messages itself instead
+// of posting them to webhook_url.
+type deliveringNotifier interface {
+	deliver(cfg *VaultConfig, m discordMessage, data []byte) error
+}
+
+var notifiers = map[string]notifier{
+	"discord": discordNotifier{},
+	"email":   emailNotifier{},
+	"slack":   slackNotifier{},
+	"teams":   teamsNotifier{},
+	"webhook": webhookNotifier{},
+}
+
+// notifierFor returns the configured notifier. notifier is resolved by
+// validateConfig, so this only falls back to Discord for configs that
+// never went through it.
+func notifierFor(cfg *VaultConfig) notifier {
+	switch cfg.Notifier {
+	case "webhook":
+		return webhookNotifier{conf: cfg.Webhook, url: cfg.WebhookURL}
+	case "email":
+		return emailNotifier{conf: cfg.Email}
+	}
+	if n, ok := notifiers[cfg.Notifier]; ok {
+		return n
+	}
+	return discordNotifier{}
+}
+
+// inferNotifier picks the notifier from a webhook URL's host: Slack's
+// incoming webhooks live on hooks.slack.com, Teams' on webhook.office.com
+// (or outlook.office.com for older ones), and anything else is taken for
+// Discord as before.
+func inferNotifier(webhook string) string {
+	u, err := url.Parse(webhook)
+	if err != nil {
+		return "discord"
+	}
+	host := strings.ToLower(u.Hostname())
+	under := func(domain string) bool { return host == domain || strings.HasSuffix(host, "."+domain) }
+	switch {
+	case under("slack.com"):
+		return "slack"
+	case under("webhook.office.com"), host == "outlook.office.com":
+		return "teams"
+	}
+	return "discord"
+}
+
+// notifierKinds lists the known notifiers, for config errors.
+func notifierKinds() string {
+	kinds := make([]string, 0, len(notifiers))
+	for k := range notifiers {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+	last := len(kinds) - 1
+	return strings.Join(kinds[:last], ", ") + " or " + kinds[last]
+}
+
+// sendAlerts delivers alerts through the configured notifier.
+func sendAlerts(cfg *VaultConfig, alerts []Alert) ([]Alert, error) {
+	return notifierFor(cfg).send(cfg, alerts)
+}
+
+// discordNotifier posts embeds, several alerts to a message.
+type discordNotifier struct{}
+
+func (discordNotifier) kind() string { return "discord" }
+
+func (discordNotifier) accept(status int, body []byte) error {
+	if status != http.StatusNoContent && status != http.StatusOK {
+		return fmt.Errorf("returned status %d", status)
+	}
+	return nil
+}
+
+func (n discordNotifier) send(cfg *VaultConfig, alerts []Alert) ([]Alert, error) {
+	if !cfg.Details.bot() {
+		return postMessages(cfg, n, teaseMessages(cfg, packAlerts(alerts)))
+	}
+	// Alerts with a Details button go through the bot; webhooks can't
+	// carry buttons.
+	var failed, rest []Alert
+	var lastErr error
+	for _, a := range alerts {
+		if !cfg.Details.onDemand(a) {
+			rest = append(rest, a)
+		} else if err := postWithDetails(cfg, a); err != nil {
+			failed, lastErr = append(failed, a), err
+		}
+	}
+	if len(rest) == 0 {
+		return failed, lastErr
+	}
+	f, err := postMessages(cfg, n, packAlerts(rest))
+	if err == nil {
+		err = lastErr
+	}
+	return append(failed, f...), err
+}
+
+func (discordNotifier) encode(m discordMessage) ([]byte, error) {
+	return json.Marshal(DiscordPayload{
+		Embeds:          m.embeds,
+		AllowedMentions: &DiscordAllowedMentions{Parse: []string{}},
+	})
+}
+
+// singleMessages packs alerts one to a message, for services that take a
+// single alert per request.
+func singleMessages(alerts []Alert) []discordMessage {
+	var msgs []discordMessage
+	for _, m := range packAlerts(alerts) {
+		for i := range m.alerts {
+			msgs = append(msgs, discordMessage{alerts: m.alerts[i : i+1], embeds: m.embeds[i : i+1]})
+		}
+	}
+	return msgs
+}
+
+// postMessages encodes and posts each message, recording the outcome for
+// every alert in it under the notifier's kind.
+func postMessages(cfg *VaultConfig, n notifier, msgs []discordMessage) ([]Alert, error) {
+	kind := n.kind()
+	var failed []Alert
+	var lastErr error
+	for _, m := range msgs {
+		data, err := n.encode(m)
+		if err != nil {
+			err = fmt.Errorf("marshal payload: %w", err)
+		} else if dn, ok := n.(deliveringNotifier); ok {
+			start := time.Now()
+			err = dn.deliver(cfg, m, data)
+			recordDelivery(kind, start, err)
+		} else {
+			var header http.Header
+			if hn, ok := n.(headerNotifier); ok {
+				header = hn.header(m)
+			}
+			start := time.Now()
+			err = postWebhook(cfg, n, data, header)
+			recordDelivery(kind, start, err)
+		}
+		for _, a := range m.alerts {
+			history.record(kind, a, data, err)
+		}
+		if err != nil && permanentFailure(err) {
+			// Not failed: retrying a refused message won't change the answer.
+			for _, a := range m.alerts {
+				logError("❌ {sink} refused alert {title}: {error}", "sink", kind, "title", a.Title,
+					"error", err, "alert_id", a.ID, "rule", a.Rule, "severity", a.Severity.String())
+			}
+			metrics.add("notify_refused_total", float64(len(m.alerts)), "sink", kind)
+			lastErr = err
+			continue
+		}
+		if err != nil {
+			failed, lastErr = append(failed, m.alerts...), err
+			continue
+		}
+		logDebug("📨 Delivered {alerts} alert(s) to {sink}", "alerts", len(m.alerts), "sink", kind)
+		if len(m.alerts) > 1 {
+			metrics.add(kind+"_coalesced_total", float64(len(m.alerts)-1))
+		}
+	}
+	return failed, lastErr
+}
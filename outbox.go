@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Notification Outbox ---
+
+const (
+	defaultOutboxFreshness = 5 * time.Minute
+	defaultOutboxMaxAge    = 24 * time.Hour
+	outboxMaxRecord        = 16 * 1024 * 1024
+	outboxHeaderLen        = 8 // payload length, CRC-32 of the payload
+)
+
+// OutboxConfig makes queued alerts survive a crash: each is written to a
+// file before its first delivery attempt and marked once delivered.
+type OutboxConfig struct {
+	Path string `yaml:"path"`
+	// Undelivered alerts older than this are re-sent marked [delayed].
+	Freshness Duration `yaml:"freshness"`
+	// Undelivered alerts older than this are dropped instead.
+	MaxAge Duration `yaml:"max_age"`
+}
+
+// outboxRecord is one framed record. An "alert" record carries the alert
+// and the sinks it is still owed to; a "done" record settles one sink.
+type outboxRecord struct {
+	Op    string    `json:"op"`
+	Time  time.Time `json:"time"`
+	ID    string    `json:"id"`
+	Sinks []string  `json:"sinks,omitempty"`
+	Alert *Alert    `json:"alert,omitempty"`
+}
+
+// outboxEntry is an alert still owed to at least one sink.
+type outboxEntry struct {
+	alert   Alert
+	written time.Time
+	sinks   []string
+}
+
+// alertOutbox is the write-ahead file. Records are appended under the
+// history-style lock so `maintenance run` can compact it from another
+// process; a replaced file is reopened before the next write. A nil
+// *alertOutbox (queue.outbox.path unset) records nothing.
+type alertOutbox struct {
+	cfg OutboxConfig
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// outbox is the process-wide outbox. It is only open in audit mode,
+// alongside the notification queue.
+var outbox *alertOutbox
+
+// openOutbox opens the outbox and returns the alerts a previous run left
+// undelivered, oldest first. Expired ones are dropped and counted.
+func openOutbox(cfg *VaultConfig) (*alertOutbox, []outboxEntry, error) {
+	oc := cfg.Queue.Outbox
+	if oc.Path == "" {
+		return nil, nil, nil
+	}
+	// Start from a compact file holding only what is still owed.
+	if _, _, err := compactOutbox(oc); err != nil {
+		logWarn("⚠️  Outbox: could not compact: {error}", "error", err)
+	}
+	pending, err := loadOutbox(oc)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.OpenFile(oc.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open outbox: %w", err)
+	}
+	return &alertOutbox{cfg: oc, f: f}, pending, nil
+}
+
+// loadOutbox reads the outbox, cutting off a partial or corrupt tail left
+// by a crash mid-write.
+func loadOutbox(oc OutboxConfig) ([]outboxEntry, error) {
+	unlock, err := lockHistory(oc.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	f, err := os.OpenFile(oc.Path, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open outbox: %w", err)
+	}
+	defer f.Close()
+
+	var recs []outboxRecord
+	good, err := readOutbox(f, func(rec outboxRecord) { recs = append(recs, rec) })
+	if err != nil {
+		if fi, serr := f.Stat(); serr == nil {
+			logWarn("⚠️  Outbox: {error}; discarding the last {discarded}", "error", err, "discarded", formatBytes(fi.Size()-good))
+		}
+		if err := f.Truncate(good); err != nil {
+			return nil, fmt.Errorf("truncate outbox: %w", err)
+		}
+	}
+	pending, expired := settleOutbox(recs, oc)
+	reportExpired(oc, expired)
+	return pending, nil
+}
+
+func reportExpired(oc OutboxConfig, expired int) {
+	if expired > 0 {
+		metrics.add("outbox_expired_total", float64(expired))
+		logWarn("⚠️  Outbox: dropped {expired} undelivered alerts older than {max_age}", "expired", expired, "max_age", time.Duration(oc.MaxAge))
+	}
+}
+
+// readOutbox calls fn for each intact record and returns the offset just
+// past the last one. A short or corrupt record ends the read with an
+// error; everything before it is still delivered.
+func readOutbox(r io.Reader, fn func(outboxRecord)) (int64, error) {
+	br := bufio.NewReader(r)
+	var off int64
+	header := make([]byte, outboxHeaderLen)
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			if err == io.EOF {
+				return off, nil
+			}
+			return off, fmt.Errorf("partial record header at offset %d", off)
+		}
+		n := binary.BigEndian.Uint32(header[:4])
+		if n == 0 || n > outboxMaxRecord {
+			return off, fmt.Errorf("bad record length %d at offset %d", n, off)
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return off, fmt.Errorf("partial record at offset %d", off)
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+			return off, fmt.Errorf("checksum mismatch at offset %d", off)
+		}
+		var rec outboxRecord
+		if err := json.Unmarshal(payload, &rec); err != nil {
+			return off, fmt.Errorf("record at offset %d: %w", off, err)
+		}
+		fn(rec)
+		off += int64(outboxHeaderLen) + int64(n)
+	}
+}
+
+// settleOutbox replays records into the alerts still owed to a sink,
+// oldest first, and counts those dropped for being past max_age.
+func settleOutbox(recs []outboxRecord, oc OutboxConfig) ([]outboxEntry, int) {
+	byID := make(map[string]*outboxEntry)
+	var order []string
+	for _, rec := range recs {
+		switch rec.Op {
+		case "alert":
+			if rec.Alert == nil || len(rec.Sinks) == 0 {
+				continue
+			}
+			if _, seen := byID[rec.ID]; !seen {
+				order = append(order, rec.ID)
+			}
+			byID[rec.ID] = &outboxEntry{alert: *rec.Alert, written: rec.Time, sinks: rec.Sinks}
+		case "done":
+			if e := byID[rec.ID]; e != nil {
+				e.sinks = removeSink(e.sinks, rec.Sinks)
+			}
+		}
+	}
+
+	var pending []outboxEntry
+	expired := 0
+	for _, id := range order {
+		e := byID[id]
+		if len(e.sinks) == 0 {
+			continue
+		}
+		if time.Since(e.alert.DetectedAt) > time.Duration(oc.MaxAge) {
+			expired++
+			continue
+		}
+		pending = append(pending, *e)
+	}
+	return pending, expired
+}
+
+func removeSink(sinks, done []string) []string {
+	kept := sinks[:0:0]
+	for _, s := range sinks {
+		settled := false
+		for _, d := range done {
+			settled = settled || s == d
+		}
+		if !settled {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
+
+// compactOutbox rewrites the outbox with only the alerts still owed,
+// using the same atomic rewrite as history pruning. It returns how many
+// records were dropped and the bytes reclaimed.
+func compactOutbox(oc OutboxConfig) (int, int64, error) {
+	return rewriteFile(oc.Path, func(in io.Reader, out *bufio.Writer) (int, error) {
+		var recs []outboxRecord
+		torn := 0
+		if _, err := readOutbox(in, func(rec outboxRecord) { recs = append(recs, rec) }); err != nil {
+			logWarn("⚠️  Outbox: {error}; keeping the records before it", "error", err)
+			torn = 1
+		}
+		pending, expired := settleOutbox(recs, oc)
+		reportExpired(oc, expired)
+		for _, e := range pending {
+			a := e.alert
+			frame, err := outboxFrame(outboxRecord{Op: "alert", Time: e.written, ID: a.ID, Sinks: e.sinks, Alert: &a})
+			if err != nil {
+				return 0, err
+			}
+			out.Write(frame)
+		}
+		return len(recs) - len(pending) + torn, nil
+	})
+}
+
+func outboxFrame(rec outboxRecord) ([]byte, error) {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return nil, fmt.Errorf("encode outbox record: %w", err)
+	}
+	frame := make([]byte, outboxHeaderLen, outboxHeaderLen+len(payload))
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:], crc32.ChecksumIEEE(payload))
+	return append(frame, payload...), nil
+}
+
+// add records an alert before its first delivery attempt. Critical alerts
+// are fsynced; for the rest a process crash is covered by the page cache.
+func (o *alertOutbox) add(a Alert, sinks ...string) {
+	if o == nil {
+		return
+	}
+	o.write(outboxRecord{Op: "alert", Time: time.Now().UTC(), ID: a.ID, Sinks: sinks, Alert: &a}, a.Severity == sevCritical)
+}
+
+// done marks an alert delivered to a sink. Never fsynced: a lost mark only
+// means one duplicate after a crash.
+func (o *alertOutbox) done(id, sink string) {
+	if o == nil || id == "" {
+		return
+	}
+	o.write(outboxRecord{Op: "done", Time: time.Now().UTC(), ID: id, Sinks: []string{sink}}, false)
+}
+
+func (o *alertOutbox) write(rec outboxRecord, sync bool) {
+	frame, err := outboxFrame(rec)
+	if err != nil {
+		logWarn("⚠️  Outbox: {error}", "error", err)
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	unlock, err := lockHistory(o.cfg.Path)
+	if err != nil {
+		logWarn("⚠️  Could not lock outbox: {error}", "error", err)
+		return
+	}
+	defer unlock()
+	if err := o.reopenIfReplaced(); err != nil {
+		logWarn("⚠️  Could not reopen outbox: {error}", "error", err)
+		return
+	}
+	fi, err := o.f.Stat()
+	if err != nil {
+		logWarn("⚠️  Could not write outbox: {error}", "error", err)
+		return
+	}
+	if _, err := o.f.Write(frame); err != nil {
+		// Don't leave a torn record for the next append to follow.
+		o.f.Truncate(fi.Size())
+		metrics.inc("outbox_write_errors_total")
+		logWarn("⚠️  Could not write outbox: {error}", "error", err)
+		return
+	}
+	if sync {
+		if err := o.f.Sync(); err != nil {
+			logWarn("⚠️  Could not sync outbox: {error}", "error", err)
+		}
+	}
+}
+
+// reopenIfReplaced follows a compaction that renamed a new file into place.
+func (o *alertOutbox) reopenIfReplaced() error {
+	cur, err := o.f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(o.cfg.Path); err == nil && os.SameFile(cur, fi) {
+		return nil
+	}
+	f, err := os.OpenFile(o.cfg.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	o.f.Close()
+	o.f = f
+	return nil
+}
+
+func (o *alertOutbox) close() {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.f.Close()
+}
+
+var (
+	msgDelayed     = message("outbox.delayed.title")
+	msgDelayedBody = message("outbox.delayed.body")
+)
+
+// replayOutbox queues what a previous run left undelivered. Alerts raised
+// longer ago than queue.outbox.freshness are marked as delayed. Alerts
+// held for quiet hours are held again instead.
+func replayOutbox(cfg *VaultConfig, q *notifyQueue, pending []outboxEntry) {
+	var resend []outboxEntry
+	held := 0
+	for _, e := range pending {
+		if len(e.sinks) == 1 && strings.HasPrefix(e.sinks[0], quietSinkPrefix) {
+			quiet.restore(e.alert, strings.TrimPrefix(e.sinks[0], quietSinkPrefix))
+			held++
+		} else {
+			resend = append(resend, e)
+		}
+	}
+	if held > 0 {
+		logInfo("🌙 Outbox: {held} alerts from the previous run are still held for quiet hours", "held", held)
+	}
+	if len(resend) == 0 {
+		return
+	}
+	logInfo("📬 Outbox: re-sending {pending} undelivered alerts from the previous run", "pending", len(resend))
+	for _, e := range resend {
+		a := e.alert
+		if a.Color == 0 {
+			a.Color = a.Severity.color()
+		}
+		// The text was localized when first queued; the labels follow.
+		a.Locale = locales.of(q.sink)
+		if age := time.Since(a.DetectedAt); age > time.Duration(cfg.Queue.Outbox.Freshness) {
+			c := locales.catalog(a.Locale)
+			a.Title = c.render(msgDelayed.with("title", a.Title))
+			a.Description += c.render(msgDelayedBody.with("age", age.Round(time.Second)))
+		}
+		metrics.inc("outbox_replayed_total")
+		if len(e.sinks) != 1 || e.sinks[0] != q.sink {
+			// Owed to a notifier since replaced; the current one takes
+			// it over.
+			outbox.add(a, q.sink)
+		}
+		q.push(a)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- PagerDuty ---
+
+const (
+	defaultPagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+	pagerDutyQueueSize  = 100
+	// PagerDuty asks for retries with backoff on 429 and 5xx; six
+	// attempts 1s to 16s apart ride out about half a minute.
+	pagerDutyAttempts   = 6
+	pagerDutyMaxBackoff = 30 * time.Second
+	pagerDutyMaxDedup   = 255
+	pagerDutyMaxSummary = 1024
+)
+
+// PagerDutyConfig triggers PagerDuty incidents through the Events API v2
+// for alerts at or above min_severity, besides the usual notifier.
+type PagerDutyConfig struct {
+	RoutingKey  string `yaml:"routing_key"`  // the integration key of an Events API v2 service
+	MinSeverity string `yaml:"min_severity"` // default critical
+	URL         string `yaml:"url"`          // default the Events API endpoint
+}
+
+type pagerDutyEvent struct {
+	RoutingKey  string           `json:"routing_key"`
+	EventAction string           `json:"event_action"` // "trigger"
+	DedupKey    string           `json:"dedup_key"`
+	Client      string           `json:"client"`
+	Payload     pagerDutyPayload `json:"payload"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string            `json:"summary"`
+	Source        string            `json:"source"`
+	Severity      string            `json:"severity"` // critical, error, warning or info
+	Timestamp     string            `json:"timestamp"`
+	Component     string            `json:"component,omitempty"`
+	Group         string            `json:"group,omitempty"`
+	Class         string            `json:"class,omitempty"`
+	CustomDetails map[string]string `json:"custom_details,omitempty"`
+}
+
+// pagerDutySender sends events from a background worker like Grafana's,
+// so PagerDuty being slow or rate limiting never delays alerting. A nil
+// *pagerDutySender is a no-op.
+type pagerDutySender struct {
+	cfg     PagerDutyConfig
+	min     severity
+	client  *http.Client
+	timeout time.Duration
+	events  chan pagerDutyEvent
+	done    chan struct{}
+}
+
+var pagerDutySink *pagerDutySender
+
+func startPagerDuty(cfg *VaultConfig) *pagerDutySender {
+	if cfg.PagerDuty.RoutingKey == "" {
+		return nil
+	}
+	min, _ := parseSeverity(cfg.PagerDuty.MinSeverity) // validated at load
+	p := &pagerDutySender{
+		cfg:     cfg.PagerDuty,
+		min:     min,
+		client:  newNotifyClient(cfg),
+		timeout: cfg.Timeouts.of(opNotify),
+		events:  make(chan pagerDutyEvent, pagerDutyQueueSize),
+		done:    make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// trigger pages for alerts at or above min_severity. Resolutions are
+// left to whoever handles the incident.
+func (p *pagerDutySender) trigger(a Alert) {
+	if p == nil || a.Severity < p.min || a.Resolved {
+		return
+	}
+	details := map[string]string{"alert_id": a.ID, "description": a.Description}
+	for k, v := range map[string]string{"user": identityLabel(&a), "path": a.Path, "operation": a.Operation,
+		"source_ip": a.SourceIP, "request_id": a.RequestID, "sensitivity": a.Sensitivity,
+		"environment": a.Environment, "cluster": a.Cluster} {
+		if v != "" {
+			details[k] = v
+		}
+	}
+	source := a.Cluster
+	if source == "" {
+		source = "vault-warden"
+	}
+	ev := pagerDutyEvent{
+		RoutingKey:  p.cfg.RoutingKey,
+		EventAction: "trigger",
+		DedupKey:    pagerDutyDedupKey(a),
+		Client:      "vault-warden",
+		Payload: pagerDutyPayload{
+			Summary:       clipRunes(a.Title, pagerDutyMaxSummary),
+			Source:        source,
+			Severity:      a.Severity.String(),
+			Timestamp:     a.Time.UTC().Format(time.RFC3339),
+			Component:     a.Path,
+			Group:         a.Cluster,
+			Class:         a.Rule,
+			CustomDetails: details,
+		},
+	}
+	select {
+	case p.events <- ev:
+	default:
+		logWarn("⚠️  PagerDuty: queue full, dropping event \"{summary}\"", "summary", ev.Payload.Summary)
+	}
+}
+
+// pagerDutyDedupKey groups repeated hits on one resource by one user into
+// one incident: the path and user, or the rule and cluster for alerts
+// without a path. Keys over PagerDuty's limit are hashed.
+func pagerDutyDedupKey(a Alert) string {
+	key := "vault-warden/" + a.Rule + "/" + a.Cluster
+	if a.Path != "" || a.User != "" {
+		key = "vault-warden/" + a.Path + "/" + a.User
+	}
+	if len(key) > pagerDutyMaxDedup {
+		sum := sha256.Sum256([]byte(key))
+		key = "vault-warden/" + hex.EncodeToString(sum[:])
+	}
+	return key
+}
+
+func (p *pagerDutySender) run() {
+	defer close(p.done)
+	for ev := range p.events {
+		if err := p.post(ev); err != nil {
+			logWarn("⚠️  PagerDuty event failed: {error}", "error", err)
+		}
+	}
+}
+
+// post sends one event, retrying 429s, 5xx responses and network errors
+// with exponential backoff, or after Retry-After when PagerDuty gives
+// one. Other errors, such as a 400 for a bad routing key, are final.
+func (p *pagerDutySender) post(ev pagerDutyEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		wait, err := p.send(data)
+		if err == nil || wait < 0 || attempt == pagerDutyAttempts {
+			return err
+		}
+		if wait == 0 {
+			wait = backoff
+		}
+		time.Sleep(wait)
+		if backoff *= 2; backoff > pagerDutyMaxBackoff {
+			backoff = pagerDutyMaxBackoff
+		}
+	}
+}
+
+// send makes one attempt. On failure wait is how long to hold off before
+// the next, 0 for the usual backoff, or negative when retrying is futile.
+func (p *pagerDutySender) send(data []byte) (wait time.Duration, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.URL, bytes.NewReader(data))
+	if err != nil {
+		return -1, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	start := time.Now()
+	resp, err := p.client.Do(req)
+	if err != nil {
+		recordDelivery("pagerduty", start, err)
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode == http.StatusAccepted || resp.StatusCode == http.StatusOK {
+		recordDelivery("pagerduty", start, nil)
+		return 0, nil
+	}
+	err = fmt.Errorf("returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	recordDelivery("pagerduty", start, err)
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+		return -1, err
+	}
+	if s, perr := strconv.Atoi(resp.Header.Get("Retry-After")); perr == nil && s > 0 {
+		wait = time.Duration(s) * time.Second
+		if wait > pagerDutyMaxBackoff {
+			wait = pagerDutyMaxBackoff
+		}
+	}
+	return wait, err
+}
+
+// close waits up to timeout for queued events to be sent.
+func (p *pagerDutySender) close(timeout time.Duration) {
+	if p == nil {
+		return
+	}
+	close(p.events)
+	select {
+	case <-p.done:
+	case <-time.After(timeout):
+		logWarn("⚠️  PagerDuty: gave up with {unsent} events unsent", "unsent", len(p.events))
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// --- Intake Pause ---
+
+const defaultPauseAfter = 2 * time.Minute
+
+// IntakeConfig controls what audit mode does when alerts can't get out.
+// By default it keeps reading and the notification queue drops the oldest
+// alerts once full.
+type IntakeConfig struct {
+	// Stop reading the audit log while the webhook has been failing for
+	// pause_after, and retry queued alerts instead of dropping them. Trades
+	// latency for at-least-once delivery.
+	PauseOnSinkFailure bool     `yaml:"pause_on_sink_failure"`
+	PauseAfter         Duration `yaml:"pause_after"`
+}
+
+// sinkHealth tracks consecutive delivery failures of one sink.
+type sinkHealth struct {
+	mu           sync.Mutex
+	failingSince time.Time
+	lastError    string
+}
+
+// webhookHealth is the health of the Discord webhook, the critical sink.
+var webhookHealth = &sinkHealth{}
+
+func (h *sinkHealth) report(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err == nil {
+		h.failingSince, h.lastError = time.Time{}, ""
+		return
+	}
+	if h.failingSince.IsZero() {
+		h.failingSince = time.Now()
+	}
+	h.lastError = err.Error()
+}
+
+// failingFor returns how long the sink has been failing, or zero.
+func (h *sinkHealth) failingFor() (time.Duration, string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.failingSince.IsZero() {
+		return 0, ""
+	}
+	return time.Since(h.failingSince), h.lastError
+}
+
+// intakeGate pauses and resumes reading the audit log.
+type intakeGate struct {
+	cfg   *VaultConfig
+	after time.Duration
+
+	mu          sync.Mutex
+	paused      bool
+	since       time.Time
+	position    int64 // offset of the last line read
+	lastRead    time.Time
+	pausedAt    int64
+	catchUpTo   int64 // file size when intake resumed; zero when caught up
+	lastPause   time.Duration
+	pauseCount  int
+	catchUpFrom int64
+}
+
+func newIntakeGate(cfg *VaultConfig) *intakeGate {
+	return &intakeGate{cfg: cfg, after: time.Duration(cfg.Intake.PauseAfter)}
+}
+
+// read records the position of a line just taken from the tail.
+func (g *intakeGate) read(offset int64) {
+	g.mu.Lock()
+	g.position = offset
+	g.lastRead = time.Now()
+	if g.catchUpTo > 0 && offset >= g.catchUpTo {
+		logInfo("✓ Intake caught up ({caught_up} since resume)", "caught_up", formatBytes(g.catchUpTo-g.catchUpFrom))
+		g.catchUpTo = 0
+	}
+	g.mu.Unlock()
+}
+
+// seen records a line read from an audit log other than the first, whose
+// offsets say nothing about the first's backlog.
+func (g *intakeGate) seen() {
+	g.mu.Lock()
+	g.lastRead = time.Now()
+	g.mu.Unlock()
+}
+
+var (
+	msgPaused      = message("intake-pause.paused.title")
+	msgPausedBody  = message("intake-pause.paused.body")
+	msgResumed     = message("intake-pause.resumed.title")
+	msgResumedBody = message("intake-pause.resumed.body")
+)
+
+// check pauses or resumes intake based on webhook health and reports
+// whether intake is paused.
+func (g *intakeGate) check() bool {
+	if !g.cfg.Intake.PauseOnSinkFailure {
+		return false
+	}
+	failing, lastErr := webhookHealth.failingFor()
+
+	g.mu.Lock()
+	switch {
+	case !g.paused && failing >= g.after:
+		g.paused, g.since, g.pausedAt = true, time.Now(), g.position
+		g.pauseCount++
+		pos := g.position
+		g.mu.Unlock()
+
+		logError("🚨 CRITICAL: webhook failing for {failing_for}, pausing audit intake at offset {offset}: {error}", "failing_for", failing.Round(time.Second), "offset", pos, "error", lastErr)
+		notify(g.cfg, Alert{Severity: sevCritical, Color: 0xe74c3c, Rule: "intake-pause"}.say(msgPaused.with(),
+			msgPausedBody.with("failing_for", failing.Round(time.Second), "error", mdCode(lastErr, maxErrorLen), "offset", pos)))
+		return true
+
+	case g.paused && failing == 0:
+		g.paused = false
+		g.lastPause = time.Since(g.since)
+		g.catchUpFrom = g.pausedAt
+		if fi, err := os.Stat(live(g.cfg).AuditLog); err == nil && fi.Size() > g.pausedAt {
+			g.catchUpTo = fi.Size()
+		}
+		paused, backlog := g.lastPause, g.catchUpTo-g.pausedAt
+		g.mu.Unlock()
+
+		if backlog < 0 {
+			backlog = 0
+		}
+		logInfo("▶️  Webhook recovered after {paused_for}, resuming intake ({backlog} to catch up)", "paused_for", paused.Round(time.Second), "backlog", formatBytes(backlog))
+		notify(g.cfg, Alert{Severity: sevWarning, Color: 0x2ecc71, Rule: "intake-pause"}.say(msgResumed.with(),
+			msgResumedBody.with("paused_for", paused.Round(time.Second), "backlog", formatBytes(backlog))))
+		return false
+	}
+	paused := g.paused
+	g.mu.Unlock()
+	return paused
+}
+
+// activity reports whether intake is paused and when a line was last read.
+func (g *intakeGate) activity() (bool, time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused, g.lastRead
+}
+
+// intakeStatus is the /statusz view of the gate.
+type intakeStatus struct {
+	PauseOnSinkFailure bool   `json:"pause_on_sink_failure"`
+	Paused             bool   `json:"paused"`
+	PausedSince        string `json:"paused_since,omitempty"`
+	PausedFor          string `json:"paused_for,omitempty"`
+	PausedAtOffset     int64  `json:"paused_at_offset,omitempty"`
+	Pauses             int    `json:"pauses"`
+	LastPause          string `json:"last_pause,omitempty"`
+	Offset             int64  `json:"offset"`
+	CatchUpTarget      int64  `json:"catch_up_target,omitempty"`
+	CatchUpRemaining   int64  `json:"catch_up_remaining,omitempty"`
+	WebhookFailingFor  string `json:"webhook_failing_for,omitempty"`
+}
+
+func (g *intakeGate) status() intakeStatus {
+	failing, _ := webhookHealth.failingFor()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	st := intakeStatus{
+		PauseOnSinkFailure: g.cfg.Intake.PauseOnSinkFailure,
+		Paused:             g.paused,
+		Pauses:             g.pauseCount,
+		Offset:             g.position,
+	}
+	if g.paused {
+		st.PausedSince = g.since.UTC().Format(time.RFC3339)
+		st.PausedFor = time.Since(g.since).Round(time.Second).String()
+		st.PausedAtOffset = g.pausedAt
+	}
+	if g.lastPause > 0 {
+		st.LastPause = g.lastPause.Round(time.Second).String()
+	}
+	if g.catchUpTo > 0 {
+		st.CatchUpTarget = g.catchUpTo
+		st.CatchUpRemaining = g.catchUpTo - g.position
+	}
+	if failing > 0 {
+		st.WebhookFailingFor = failing.Round(time.Second).String()
+	}
+	return st
+}
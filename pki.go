@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- PKI Detectors ---
+
+const (
+	defaultPKIMaxTTL = 90 * 24 * time.Hour
+	// maxPKIRoles bounds the allowed_domains remembered per role.
+	maxPKIRoles = 10000
+)
+
+// PKIConfig turns on the PKI abuse detectors. Their paths are relative to
+// each mount in Mounts, so renamed or additional PKI mounts are covered by
+// listing them. Request fields are only readable when the mount is tuned
+// to leave them out of audit HMACing (see pkiNonHMACKeys).
+type PKIConfig struct {
+	Enabled   bool                      `yaml:"enabled"`
+	Mounts    []string                  `yaml:"mounts"`  // default ["pki/"]
+	MaxTTL    Duration                  `yaml:"max_ttl"` // pki-long-ttl threshold
+	Detectors map[string]DetectorConfig `yaml:"detectors"`
+}
+
+// DetectorConfig overrides one built-in detector, keyed by its rule name.
+type DetectorConfig struct {
+	Disabled bool   `yaml:"disabled"`
+	Severity string `yaml:"severity"`
+}
+
+// pkiNonHMACKeys are the request fields the detectors read. Vault HMACs
+// request data in the audit log unless the mount lists them in
+// audit_non_hmac_request_keys; an HMACed value is ignored.
+var pkiNonHMACKeys = []string{"ttl", "not_after", "allowed_domains", "allow_any_name"}
+
+// detector is one built-in check. PKI paths are relative to the mount, with
+// issuer/<ref>/ stripped from per-issuer variants.
+type detector struct {
+	rule     string
+	severity string
+	title    msgID
+	inspects string // documented in -list-packs and the README
+}
+
+var pkiDetectors = []detector{
+	{rule: "pki-long-ttl", severity: "warning", title: message("pki-long-ttl.title"),
+		inspects: "update on issue/<role>, sign/<role>, sign-verbatim[/<role>], sign-intermediate, root/sign-intermediate, root/generate/<type>: data.ttl or data.not_after beyond max_ttl"},
+	{rule: "pki-sign-verbatim", severity: "critical", title: message("pki-sign-verbatim.title"),
+		inspects: "update on sign-verbatim[/<role>]"},
+	{rule: "pki-sign-intermediate", severity: "critical", title: message("pki-sign-intermediate.title"),
+		inspects: "update on root/sign-intermediate, sign-intermediate, root/sign-self-issued, sign-self-issued"},
+	{rule: "pki-crl-config", severity: "warning", title: message("pki-crl-config.title"),
+		inspects: "update on config/crl, config/urls"},
+	{rule: "pki-role-broadened", severity: "warning", title: message("pki-role-broadened.title"),
+		inspects: "create/update on roles/<name>: data.allow_any_name true, or data.allowed_domains gaining a wildcard or a domain the role didn't have"},
+	{rule: "pki-issuer-deleted", severity: "critical", title: message("pki-issuer-deleted.title"),
+		inspects: "delete on issuer/<ref>, root"},
+}
+
+// pkiWatcher runs the enabled detectors over audit responses.
+type pkiWatcher struct {
+	mounts  []string
+	maxTTL  time.Duration
+	enabled map[string]severity
+	// roles remembers each role's allowed_domains to tell broadening
+	// from an unrelated update. It starts empty after a restart.
+	roles map[string][]string
+}
+
+func newPKIWatcher(cfg PKIConfig) *pkiWatcher {
+	if !cfg.Enabled {
+		return nil
+	}
+	w := &pkiWatcher{maxTTL: time.Duration(cfg.MaxTTL), roles: make(map[string][]string)}
+	for _, m := range cfg.Mounts {
+		w.mounts = append(w.mounts, strings.Trim(m, "/")+"/")
+	}
+	w.enabled = enabledDetectors(pkiDetectors, cfg.Detectors)
+	return w
+}
+
+// enabledDetectors applies the overrides to a detector list, returning
+// the severity of each detector left enabled.
+func enabledDetectors(list []detector, overrides map[string]DetectorConfig) map[string]severity {
+	enabled := make(map[string]severity)
+	for _, d := range list {
+		o := overrides[d.rule]
+		if o.Disabled {
+			continue
+		}
+		name := d.severity
+		if o.Severity != "" {
+			name = o.Severity
+		}
+		sev, _ := parseSeverity(name) // checked in validateConfig
+		enabled[d.rule] = sev
+	}
+	return enabled
+}
+
+func findDetector(list []detector, rule string) *detector {
+	for i := range list {
+		if list[i].rule == rule {
+			return &list[i]
+		}
+	}
+	return nil
+}
+
+// relative returns path relative to the first matching mount, with a
+// per-issuer prefix removed: issuer/<ref>/sign-verbatim is sign-verbatim.
+func (w *pkiWatcher) relative(path string) (mount, rel string, ok bool) {
+	for _, m := range w.mounts {
+		if strings.HasPrefix(path, m) {
+			rel = strings.TrimPrefix(path, m)
+			if parts := strings.SplitN(rel, "/", 3); len(parts) == 3 && parts[0] == "issuer" {
+				rel = parts[2]
+			}
+			return m, rel, true
+		}
+	}
+	return "", "", false
+}
+
+// observe returns the alerts for one entry. Only successful responses
+// count, so each call is judged once and refused requests don't page.
+func (w *pkiWatcher) observe(e *AuditEntry) []Alert {
+	if w == nil || e.Type != "response" || e.Error != "" {
+		return nil
+	}
+	mount, rel, ok := w.relative(e.Request.Path)
+	if !ok {
+		return nil
+	}
+	op := e.Request.Operation
+	var data map[string]json.RawMessage
+	if len(e.Request.Data) > 0 {
+		json.Unmarshal(e.Request.Data, &data) // a non-object leaves data empty
+	}
+
+	var alerts []Alert
+	fire := func(rule string, detail localText) {
+		sev, on := w.enabled[rule]
+		if !on {
+			return
+		}
+		d := findDetector(pkiDetectors, rule)
+		metrics.inc("pki_alerts_total", "rule", rule)
+		alerts = append(alerts, Alert{Severity: sev, Color: sev.color(), RequestID: e.Request.ID, Rule: rule,
+			User: e.Auth.DisplayName, Path: e.Request.Path, Operation: op,
+			SourceIP: hostOnly(e.Request.RemoteAddress), Time: entryTime(e.Time)}.say(d.title.with(), detail))
+	}
+	issuing := strings.HasPrefix(rel, "issue/") || strings.HasPrefix(rel, "sign/") ||
+		rel == "sign-verbatim" || strings.HasPrefix(rel, "sign-verbatim/") ||
+		rel == "sign-intermediate" || rel == "root/sign-intermediate" || strings.HasPrefix(rel, "root/generate/")
+
+	switch {
+	case op == "update" && issuing:
+		if ttl, ok := w.requestedTTL(data, entryTime(e.Time)); ok && ttl > w.maxTTL {
+			fire("pki-long-ttl", msgPKILongTTL.with("ttl", formatDuration(ttl.Round(time.Hour)), "mount", mdCode(mount, maxPathLen),
+				"limit", formatDuration(w.maxTTL)))
+		}
+		if rel == "sign-verbatim" || strings.HasPrefix(rel, "sign-verbatim/") {
+			fire("pki-sign-verbatim", msgPKIVerbatim.with("mount", mdCode(mount, maxPathLen)))
+		}
+		if rel == "sign-intermediate" || rel == "root/sign-intermediate" {
+			fire("pki-sign-intermediate", msgPKIIntermediate.with("mount", mdCode(mount, maxPathLen)))
+		}
+	case op == "update" && (rel == "root/sign-self-issued" || rel == "sign-self-issued"):
+		fire("pki-sign-intermediate", msgPKISelfIssued.with("mount", mdCode(mount, maxPathLen)))
+	case op == "update" && (rel == "config/crl" || rel == "config/urls"):
+		fire("pki-crl-config", msgPKICRL.with("path", mdCode(mount+rel, maxPathLen)))
+	case (op == "create" || op == "update") && strings.HasPrefix(rel, "roles/"):
+		if detail, ok := w.roleBroadened(mount+rel, data); ok {
+			fire("pki-role-broadened", detail)
+		}
+	case op == "delete" && strings.HasPrefix(rel, "roles/"):
+		delete(w.roles, mount+rel)
+	case op == "delete" && (rel == "root" || strings.HasPrefix(rel, "issuer/") && strings.Count(rel, "/") == 1):
+		what := msgPKIIssuerDeleted
+		if rel == "root" {
+			what = msgPKIRootDeleted
+		}
+		fire("pki-issuer-deleted", what.with("mount", mdCode(mount, maxPathLen)))
+	}
+	return alerts
+}
+
+// dataDuration reads a request field the way Vault does: seconds, as a
+// number or a string, or a duration string. HMACed values are ignored.
+func dataDuration(raw json.RawMessage) (time.Duration, bool) {
+	if len(raw) == 0 {
+		return 0, false
+	}
+	var secs float64
+	if json.Unmarshal(raw, &secs) == nil {
+		return time.Duration(secs * float64(time.Second)), true
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil && !strings.HasPrefix(s, "hmac-") {
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return time.Duration(n) * time.Second, true
+		}
+		if d, err := parseDuration(s); err == nil {
+			return d, true
+		}
+	}
+	return 0, false
+}
+
+// dataBool reads a boolean request field, also accepted as a string.
+func dataBool(raw json.RawMessage) bool {
+	var b bool
+	var s string
+	if json.Unmarshal(raw, &b) != nil && json.Unmarshal(raw, &s) == nil {
+		b, _ = strconv.ParseBool(s)
+	}
+	return b
+}
+
+// requestedTTL reads data.ttl (seconds or a duration string) or
+// data.not_after (RFC 3339) relative to the entry's time.
+func (w *pkiWatcher) requestedTTL(data map[string]json.RawMessage, at time.Time) (time.Duration, bool) {
+	if d, ok := dataDuration(data["ttl"]); ok {
+		return d, true
+	}
+	var s string
+	if raw, ok := data["not_after"]; ok && json.Unmarshal(raw, &s) == nil {
+		if t, err := time.Parse(time.RFC3339, s); err == nil {
+			if at.IsZero() {
+				at = time.Now()
+			}
+			return t.Sub(at), true
+		}
+	}
+	return 0, false
+}
+
+// roleBroadened describes how a role write widened what it may issue, and
+// is false if it didn't. allowed_domains is compared with the role's last
+// write.
+func (w *pkiWatcher) roleBroadened(role string, data map[string]json.RawMessage) (localText, bool) {
+	var reasons []localText
+	if dataBool(data["allow_any_name"]) {
+		reasons = append(reasons, msgRoleAnyName.with())
+	}
+
+	if domains, ok := dataList(data["allowed_domains"]); ok {
+		prev, known := w.roles[role]
+		var wild, added []string
+		for _, d := range domains {
+			if strings.Contains(d, "*") {
+				wild = append(wild, d)
+			} else if known && !containsString(prev, d) {
+				added = append(added, d)
+			}
+		}
+		if len(wild) > 0 {
+			reasons = append(reasons, msgRoleWildcards.with("domains", mdCode(strings.Join(wild, ", "), maxPathLen)))
+		}
+		if len(added) > 0 {
+			reasons = append(reasons, msgRoleGained.with("domains", mdCode(strings.Join(added, ", "), maxPathLen)))
+		}
+		if known || len(w.roles) < maxPKIRoles {
+			w.roles[role] = domains
+		}
+	}
+	if len(reasons) == 0 {
+		return localText{}, false
+	}
+	return msgRoleBroadened.with("role", mdCode(role, maxPathLen), "reasons", localList{msgReasonSep, reasons}), true
+}
+
+var (
+	msgPKILongTTL       = message("pki-long-ttl.body")
+	msgPKIVerbatim      = message("pki-sign-verbatim.body")
+	msgPKIIntermediate  = message("pki-sign-intermediate.body")
+	msgPKISelfIssued    = message("pki-sign-intermediate.self-issued.body")
+	msgPKICRL           = message("pki-crl-config.body")
+	msgPKIIssuerDeleted = message("pki-issuer-deleted.body")
+	msgPKIRootDeleted   = message("pki-issuer-deleted.root.body")
+	msgRoleBroadened    = message("pki-role-broadened.body")
+	msgRoleAnyName      = message("pki-role-broadened.any_name")
+	msgRoleWildcards    = message("pki-role-broadened.wildcards")
+	msgRoleGained       = message("pki-role-broadened.gained")
+	msgReasonSep        = message("list.reason_separator")
+)
+
+// dataList reads a list field as Vault accepts it: a list or a comma
+// separated string, sorted. HMACed values are ignored.
+func dataList(raw json.RawMessage) ([]string, bool) {
+	if len(raw) == 0 {
+		return nil, false
+	}
+	var list []string
+	if json.Unmarshal(raw, &list) != nil {
+		var s string
+		if json.Unmarshal(raw, &s) != nil {
+			return nil, false
+		}
+		list = strings.Split(s, ",")
+	}
+	var out []string
+	for _, d := range list {
+		if d = strings.TrimSpace(d); d == "" {
+			continue
+		}
+		if strings.HasPrefix(d, "hmac-") {
+			return nil, false
+		}
+		out = append(out, d)
+	}
+	sort.Strings(out)
+	return out, true
+}
+
+// describePKIDetectors renders the detectors for -list-packs.
+func describePKIDetectors() string {
+	var b strings.Builder
+	for _, d := range pkiDetectors {
+		fmt.Fprintf(&b, "  detector %s (%s): %s\n", d.rule, d.severity, d.inspects)
+	}
+	fmt.Fprintf(&b, "  (tune each mount with audit_non_hmac_request_keys=%s)\n", strings.Join(pkiNonHMACKeys, ","))
+	return b.String()
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// replayFixture feeds each audit line of testdata/file to observe and
+// returns the alerts raised.
+func replayFixture(t *testing.T, file string, observe func(*AuditEntry) []Alert) []Alert {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var alerts []Alert
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		entry, err := decodeAuditEntry(sc.Bytes())
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		alerts = append(alerts, observe(&entry)...)
+	}
+	return alerts
+}
+
+func alertRules(alerts []Alert) string {
+	rules := make([]string, len(alerts))
+	for i, a := range alerts {
+		rules[i] = a.Rule
+	}
+	return strings.Join(rules, " ")
+}
+
+func TestPKIDetectorFixtures(t *testing.T) {
+	tests := []struct {
+		fixture string
+		mounts  []string
+		want    string
+	}{
+		{"long-ttl-duration.jsonl", nil, "pki-long-ttl"},
+		{"long-ttl-seconds.jsonl", nil, "pki-long-ttl pki-long-ttl"},
+		{"long-ttl-not-after.jsonl", nil, "pki-long-ttl"},
+		{"ttl-within-limit.jsonl", nil, ""},
+		{"ttl-hmaced.jsonl", nil, ""},
+		{"sign-verbatim.jsonl", nil, "pki-sign-verbatim pki-long-ttl pki-sign-verbatim"},
+		{"sign-intermediate.jsonl", nil, "pki-sign-intermediate pki-sign-intermediate"},
+		{"crl-config.jsonl", nil, "pki-crl-config pki-crl-config"},
+		{"role-any-name.jsonl", nil, "pki-role-broadened"},
+		{"role-gained-domain.jsonl", nil, "pki-role-broadened"},
+		{"role-wildcard.jsonl", nil, "pki-role-broadened"},
+		{"role-deleted.jsonl", nil, ""},
+		{"role-hmaced.jsonl", nil, ""},
+		{"issuer-deleted.jsonl", nil, "pki-issuer-deleted pki-issuer-deleted"},
+		{"not-judged.jsonl", nil, ""},
+		{"renamed-mount.jsonl", []string{"pki-int"}, "pki-sign-verbatim"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			mounts := tt.mounts
+			if mounts == nil {
+				mounts = []string{"pki/"}
+			}
+			w := newPKIWatcher(PKIConfig{Enabled: true, Mounts: mounts, MaxTTL: Duration(defaultPKIMaxTTL)})
+			alerts := replayFixture(t, filepath.Join("pki", tt.fixture), w.observe)
+			if got := alertRules(alerts); got != tt.want {
+				t.Errorf("alerts = [%s], want [%s]", got, tt.want)
+			}
+			for _, a := range alerts {
+				if a.User != "token-pki-admin" || a.RequestID == "" || a.SourceIP != "10.20.0.7" || a.Time.IsZero() {
+					t.Errorf("alert %s lacks its entry's context: %+v", a.Rule, a)
+				}
+			}
+		})
+	}
+}
+
+// The alert bodies carry what was asked for, not just that it happened.
+func TestPKIDetectorDetails(t *testing.T) {
+	tests := map[string][]string{
+		"long-ttl-duration.jsonl":  {"365d", "90d", "`pki/`"},
+		"role-gained-domain.jsonl": {"attacker.net", "`pki/roles/web`"},
+		"role-wildcard.jsonl":      {"*.example.com"},
+		"crl-config.jsonl":         {"`pki/config/crl`"},
+	}
+	for fixture, wants := range tests {
+		// A watcher per fixture: role fixtures share pki/roles/web.
+		w := newPKIWatcher(PKIConfig{Enabled: true, Mounts: []string{"pki/"}, MaxTTL: Duration(defaultPKIMaxTTL)})
+		alerts := replayFixture(t, filepath.Join("pki", fixture), w.observe)
+		if len(alerts) == 0 {
+			t.Fatalf("%s raised nothing", fixture)
+		}
+		for _, want := range wants {
+			if !strings.Contains(alerts[0].Description, want) {
+				t.Errorf("%s: description %q lacks %q", fixture, alerts[0].Description, want)
+			}
+		}
+	}
+}
+
+func TestPKIDetectorOverrides(t *testing.T) {
+	w := newPKIWatcher(PKIConfig{Enabled: true, Mounts: []string{"pki/"}, MaxTTL: Duration(defaultPKIMaxTTL),
+		Detectors: map[string]DetectorConfig{
+			"pki-sign-verbatim": {Disabled: true},
+			"pki-long-ttl":      {Severity: "critical"},
+		}})
+	alerts := replayFixture(t, "pki/sign-verbatim.jsonl", w.observe)
+	if got := alertRules(alerts); got != "pki-long-ttl" {
+		t.Fatalf("alerts = [%s], want only pki-long-ttl", got)
+	}
+	if alerts[0].Severity != sevCritical {
+		t.Errorf("severity = %s, want the override's critical", alerts[0].Severity)
+	}
+
+	// A shorter max_ttl catches what the default lets through.
+	w = newPKIWatcher(PKIConfig{Enabled: true, Mounts: []string{"pki/"}, MaxTTL: Duration(7 * 24 * time.Hour)})
+	if got := alertRules(replayFixture(t, "pki/ttl-within-limit.jsonl", w.observe)); got != "pki-long-ttl pki-long-ttl" {
+		t.Errorf("alerts with max_ttl 7d = [%s], want both issues", got)
+	}
+}
+
+func TestPKIConfigValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"unknown detector", "pki:\n  enabled: true\n  detectors:\n    pki-nope: {disabled: true}\n", "pki.detectors.pki-nope is not a PKI detector"},
+		{"bad severity", "pki:\n  enabled: true\n  detectors:\n    pki-long-ttl: {severity: loud}\n", "pki.detectors.pki-long-ttl.severity"},
+		{"empty mount", "pki:\n  enabled: true\n  mounts: [\"/\"]\n", "pki.mounts[0] must not be empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadTestConfig(t, envTestBase+tt.body)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+	cfg, err := loadTestConfig(t, envTestBase+"pki:\n  enabled: true\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.PKI.Mounts) != 1 || cfg.PKI.Mounts[0] != "pki/" || cfg.PKI.MaxTTL != Duration(defaultPKIMaxTTL) {
+		t.Errorf("defaults = %+v, want pki/ and 90d", cfg.PKI)
+	}
+}
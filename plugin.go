@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// --- Detector Plugins ---
+
+// Detector plugins are site-specific rules that run as separate
+// processes, so they can be written in any language and can't crash the
+// warden. Protocol version 1 is newline-delimited JSON over the plugin's
+// stdin and stdout; its stderr goes to the warden's log.
+//
+// The warden sends:
+//
+//	{"type":"hello","protocol":1,"warden":"v1.2.3"}   once, first
+//	{"type":"entry","seq":1,"entry":{...}}            each audit entry, as Vault wrote it
+//	{"type":"ping","seq":1}                           every health_interval
+//
+// The plugin sends:
+//
+//	{"type":"hello","protocol":1,"name":"..."}        first, within timeout
+//	{"type":"pong","seq":1}                           within timeout of each ping
+//	{"type":"alert","alert":{...}}                    in the alert schema; title is required
+//
+// The alert's severity defaults to warning and its rule to the plugin's
+// name; id, schema_version, cluster, environment and detected_at are the
+// warden's. Unknown message types are ignored both ways, so either side
+// can add some within a protocol version.
+const pluginProtocol = 1
+
+const (
+	defaultPluginTimeout        = 5 * time.Second
+	defaultPluginHealthInterval = 30 * time.Second
+	defaultPluginBuffer         = 1000
+
+	maxPluginLine = 1 << 20
+	// pluginStableRun is how long a plugin must stay up for its restart
+	// delay to start over.
+	pluginStableRun = time.Minute
+)
+
+// PluginConfig is one detector plugin. Requires allow_exec_plugins.
+type PluginConfig struct {
+	Name    string   `yaml:"name"`
+	Command []string `yaml:"command"` // executed directly, no shell
+	// Timeout bounds the hello and each pong; default 5s.
+	Timeout        Duration `yaml:"timeout"`
+	HealthInterval Duration `yaml:"health_interval"` // default 30s
+	// Buffer is how many entries may wait for a slow plugin before new
+	// ones are dropped; default 1000.
+	Buffer int `yaml:"buffer"`
+}
+
+// pluginMessage is a protocol message in either direction.
+type pluginMessage struct {
+	Type     string          `json:"type"`
+	Protocol int             `json:"protocol,omitempty"`
+	Warden   string          `json:"warden,omitempty"`
+	Name     string          `json:"name,omitempty"`
+	Seq      int64           `json:"seq,omitempty"`
+	Entry    json.RawMessage `json:"entry,omitempty"`
+	Alert    json.RawMessage `json:"alert,omitempty"`
+}
+
+// pluginStatus is the /statusz view of a plugin.
+type pluginStatus struct {
+	Name     string     `json:"name"`
+	Up       bool       `json:"up"`
+	Since    *time.Time `json:"since,omitempty"` // when it last became ready
+	Restarts int        `json:"restarts"`
+	Dropped  int64      `json:"dropped"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// detectorPlugin runs one plugin and feeds it the audit entries. Entries
+// wait in a bounded queue; while the plugin keeps up the audit reader
+// never waits on it.
+type detectorPlugin struct {
+	cfg   PluginConfig
+	emit  func(Alert)
+	queue chan []byte
+
+	mu     sync.Mutex
+	status pluginStatus
+}
+
+func newDetectorPlugins(cfg *VaultConfig, emit func(Alert)) []*detectorPlugin {
+	var out []*detectorPlugin
+	for _, pc := range cfg.Plugins {
+		out = append(out, &detectorPlugin{cfg: pc, emit: emit,
+			queue: make(chan []byte, pc.Buffer), status: pluginStatus{Name: pc.Name}})
+	}
+	return out
+}
+
+// offer queues an entry for the plugin, dropping it if the queue is full.
+func (p *detectorPlugin) offer(line []byte) {
+	select {
+	case p.queue <- line:
+	default:
+		metrics.inc("plugin_dropped_total", "plugin", p.cfg.Name)
+		p.update(func(st *pluginStatus) { st.Dropped++ })
+	}
+}
+
+func (p *detectorPlugin) update(f func(*pluginStatus)) {
+	p.mu.Lock()
+	f(&p.status)
+	p.mu.Unlock()
+}
+
+func (p *detectorPlugin) snapshot() pluginStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
+
+// run keeps the plugin running until ctx ends. A plugin that keeps
+// failing is restarted with a growing delay rather than taking the
+// warden down with it.
+func (p *detectorPlugin) run(ctx context.Context) error {
+	delay := time.Second
+	for {
+		started := time.Now()
+		err := p.serve(ctx)
+		p.update(func(st *pluginStatus) { st.Up, st.Since = false, nil })
+		metrics.set("plugin_up", 0, "plugin", p.cfg.Name)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if time.Since(started) > pluginStableRun {
+			delay = time.Second
+		}
+		logWarn("🔌 Plugin {plugin} stopped: {error}; restarting in {delay}", "plugin", p.cfg.Name, "error", err, "delay", delay)
+		metrics.inc("plugin_restarts_total", "plugin", p.cfg.Name)
+		p.update(func(st *pluginStatus) { st.Restarts++; st.Error = err.Error() })
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil
+		}
+		if delay *= 2; delay > maxRestartDelay {
+			delay = maxRestartDelay
+		}
+	}
+}
+
+// serve starts the plugin and talks to it until it fails, stops
+// answering, or ctx ends.
+func (p *detectorPlugin) serve(ctx context.Context) error {
+	argv := p.cfg.Command
+	if err := checkExecutable(argv[0]); err != nil {
+		return err
+	}
+	cmd := exec.Command(argv[0], argv[1:]...)
+	// Own process group, so stopping it also stops anything it spawned.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start: %w", err)
+	}
+
+	stop := make(chan struct{})
+	msgs := make(chan pluginMessage)
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go func() {
+		defer readers.Done()
+		defer close(msgs)
+		p.read(stdout, msgs, stop)
+	}()
+	go func() {
+		defer readers.Done()
+		p.log(stderr)
+	}()
+	// Wait closes the pipes, so it must come after the reads.
+	var waitErr error
+	exited := make(chan struct{})
+	go func() {
+		readers.Wait()
+		waitErr = cmd.Wait()
+		close(exited)
+	}()
+	written := make(chan error, 1)
+	ctrl := make(chan []byte, 2)
+	ctrl <- encodePluginMessage(pluginMessage{Type: "hello", Protocol: pluginProtocol, Warden: version})
+	go func() { written <- p.write(stdin, ctrl, stop) }()
+	defer func() {
+		close(stop)
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-exited
+	}()
+
+	deadline := time.NewTimer(time.Duration(p.cfg.Timeout))
+	defer deadline.Stop()
+	health := time.NewTicker(time.Duration(p.cfg.HealthInterval))
+	defer health.Stop()
+	ready := false
+	var pingSeq, awaiting int64
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-written:
+			return fmt.Errorf("write: %w", err)
+		case m, ok := <-msgs:
+			if !ok {
+				select {
+				case <-exited:
+				case <-time.After(time.Duration(p.cfg.Timeout)):
+					return errors.New("closed its stdout")
+				}
+				if waitErr != nil {
+					return fmt.Errorf("exited: %w", waitErr)
+				}
+				return errors.New("exited")
+			}
+			switch {
+			case !ready && m.Type != "hello":
+				return fmt.Errorf("sent %q before hello", m.Type)
+			case m.Type == "hello":
+				if m.Protocol != pluginProtocol {
+					return fmt.Errorf("speaks protocol %d, want %d", m.Protocol, pluginProtocol)
+				}
+				if !ready {
+					ready = true
+					stopTimer(deadline)
+					logInfo("🔌 Plugin {plugin} ready ({info})", "plugin", p.cfg.Name, "info", describePlugin(m))
+					metrics.set("plugin_up", 1, "plugin", p.cfg.Name)
+					now := time.Now().UTC()
+					p.update(func(st *pluginStatus) { st.Up, st.Since, st.Error = true, &now, "" })
+				}
+			case m.Type == "pong":
+				if awaiting != 0 && m.Seq == awaiting {
+					awaiting = 0
+					stopTimer(deadline)
+				}
+			case m.Type == "alert":
+				p.alert(m.Alert)
+			}
+		case <-health.C:
+			if !ready || awaiting != 0 {
+				continue
+			}
+			pingSeq++
+			select {
+			case ctrl <- encodePluginMessage(pluginMessage{Type: "ping", Seq: pingSeq}):
+			default:
+			}
+			awaiting = pingSeq
+			deadline.Reset(time.Duration(p.cfg.Timeout))
+		case <-deadline.C:
+			if !ready {
+				return fmt.Errorf("no hello within %s", formatDuration(time.Duration(p.cfg.Timeout)))
+			}
+			if awaiting == 0 {
+				continue // fired just before the reply was read
+			}
+			return fmt.Errorf("no pong within %s", formatDuration(time.Duration(p.cfg.Timeout)))
+		}
+	}
+}
+
+// stopTimer stops t and drains a fire that wasn't received, so a later
+// Reset starts clean.
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+}
+
+func describePlugin(m pluginMessage) string {
+	if m.Name == "" {
+		return fmt.Sprintf("protocol %d", m.Protocol)
+	}
+	return fmt.Sprintf("%s, protocol %d", m.Name, m.Protocol)
+}
+
+// write sends control messages and queued entries to the plugin.
+// Control messages go first, so the hello precedes every entry and a
+// backlog doesn't hold up pings. A plugin that stops reading blocks this,
+// and its pings with it.
+func (p *detectorPlugin) write(w io.WriteCloser, ctrl <-chan []byte, stop <-chan struct{}) error {
+	defer w.Close()
+	var seq int64
+	for {
+		var b []byte
+		select {
+		case b = <-ctrl:
+		default:
+			select {
+			case <-stop:
+				return nil
+			case b = <-ctrl:
+			case line := <-p.queue:
+				seq++
+				b = encodePluginMessage(pluginMessage{Type: "entry", Seq: seq, Entry: line})
+				metrics.inc("plugin_entries_total", "plugin", p.cfg.Name)
+			}
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+}
+
+func encodePluginMessage(m pluginMessage) []byte {
+	b, _ := json.Marshal(m)
+	return append(b, '\n')
+}
+
+// read decodes the plugin's stdout. Lines that aren't JSON are logged and
+// skipped, so a stray print doesn't kill the plugin.
+func (p *detectorPlugin) read(r io.Reader, msgs chan<- pluginMessage, stop <-chan struct{}) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), maxPluginLine)
+	for sc.Scan() {
+		var m pluginMessage
+		if err := json.Unmarshal(sc.Bytes(), &m); err != nil {
+			logWarn("⚠️  Plugin {plugin}: not a protocol message: {error}", "plugin", p.cfg.Name, "error", err)
+			continue
+		}
+		select {
+		case msgs <- m:
+		case <-stop:
+		}
+	}
+	if err := sc.Err(); err != nil {
+		logWarn("⚠️  Plugin {plugin}: {error}", "plugin", p.cfg.Name, "error", err)
+	}
+	// Keep draining so the plugin doesn't block on a full pipe while it
+	// is being stopped.
+	io.Copy(io.Discard, r)
+}
+
+// log copies the plugin's stderr to the warden's log.
+func (p *detectorPlugin) log(r io.Reader) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 4096), maxPluginLine)
+	for sc.Scan() {
+		logInfo("🔌 {plugin}: {text}", "plugin", p.cfg.Name, "text", cleanField(sc.Text(), maxPathLen))
+	}
+	io.Copy(io.Discard, r)
+}
+
+// alert raises an alert the plugin sent.
+func (p *detectorPlugin) alert(raw json.RawMessage) {
+	al := Alert{Severity: sevWarning}
+	if err := json.Unmarshal(raw, &al); err != nil {
+		logWarn("⚠️  Plugin {plugin}: invalid alert: {error}", "plugin", p.cfg.Name, "error", err)
+		return
+	}
+	if al.Title = cleanField(al.Title, maxNameLen); al.Title == "" {
+		logWarn("⚠️  Plugin {plugin}: alert without a title", "plugin", p.cfg.Name)
+		return
+	}
+	if al.Rule == "" {
+		al.Rule = p.cfg.Name
+	}
+	al.ID, al.Environment, al.Cluster, al.Source, al.AuditFile, al.AuditHost = "", "", "", "", "", ""
+	al.DetectedAt, al.Topology = time.Time{}, nil
+	al.Color = al.Severity.color()
+	metrics.inc("plugin_alerts_total", "plugin", p.cfg.Name)
+	logInfo("🔌 {plugin}: {title}", "plugin", p.cfg.Name, "title", al.Title)
+	p.emit(al)
+}
+
+func pluginStatuses(plugins []*detectorPlugin) []pluginStatus {
+	var out []pluginStatus
+	for _, p := range plugins {
+		out = append(out, p.snapshot())
+	}
+	return out
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// buildExamplePlugin compiles examples/plugin, the plugin the README
+// points people at.
+func buildExamplePlugin(t *testing.T) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("builds the example plugin")
+	}
+	goTool := filepath.Join(runtime.GOROOT(), "bin", "go")
+	if _, err := os.Stat(goTool); err != nil {
+		t.Skipf("no go tool to build the example plugin: %v", err)
+	}
+	bin := filepath.Join(t.TempDir(), "path-plugin")
+	cmd := exec.Command(goTool, "build", "-o", bin, "./examples/plugin")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("build example plugin: %v\n%s", err, out)
+	}
+	return bin
+}
+
+// scriptPlugin writes a shell script plugin.
+func scriptPlugin(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "plugin.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// startPlugin runs p until the test ends, sending what it raises to the
+// returned channel.
+func startPlugin(t *testing.T, pc PluginConfig) (*detectorPlugin, <-chan Alert) {
+	t.Helper()
+	if pc.Timeout == 0 {
+		pc.Timeout = Duration(2 * time.Second)
+	}
+	if pc.HealthInterval == 0 {
+		pc.HealthInterval = Duration(time.Hour)
+	}
+	if pc.Buffer == 0 {
+		pc.Buffer = 10
+	}
+	alerts := make(chan Alert, 10)
+	cfg := &VaultConfig{Plugins: []PluginConfig{pc}}
+	p := newDetectorPlugins(cfg, func(a Alert) { alerts <- a })[0]
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return p, alerts
+}
+
+func waitAlert(t *testing.T, alerts <-chan Alert) Alert {
+	t.Helper()
+	select {
+	case a := <-alerts:
+		return a
+	case <-time.After(5 * time.Second):
+		t.Fatal("no alert from the plugin")
+		return Alert{}
+	}
+}
+
+const pluginEntry = `{"time":"2026-04-01T12:00:00Z","type":"request","auth":{"display_name":"oidc-alice"},"request":{"id":"req-1","operation":"read","path":"secret/data/break-glass/root"}}`
+
+// The example plugin, run as a real subprocess: entries go in, its
+// alerts come out into the delivery pipeline, and it answers pings.
+func TestExamplePlugin(t *testing.T) {
+	bin := buildExamplePlugin(t)
+	p, alerts := startPlugin(t, PluginConfig{Name: "break-glass", HealthInterval: Duration(50 * time.Millisecond),
+		Command: []string{bin, "-path", "^secret/data/break-glass/", "-severity", "critical"}})
+
+	p.offer([]byte(strings.Replace(pluginEntry, "break-glass/root", "app/config", 1)))
+	p.offer([]byte(strings.Replace(pluginEntry, `"type":"request"`, `"type":"response"`, 1)))
+	p.offer([]byte(pluginEntry))
+	a := waitAlert(t, alerts)
+	if a.Title != "Watched path accessed" || a.Severity != sevCritical || a.Rule != "break-glass" {
+		t.Errorf("alert = %q %s %s, want the example's critical alert under the plugin's name", a.Title, a.Severity, a.Rule)
+	}
+	if a.Path != "secret/data/break-glass/root" || a.User != "oidc-alice" || a.RequestID != "req-1" || a.Color != sevCritical.color() {
+		t.Errorf("alert = %+v, want the entry's path, user and request ID", a)
+	}
+	select {
+	case extra := <-alerts:
+		t.Errorf("unexpected alert for %s", extra.Path)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// A few health checks go by without a restart.
+	time.Sleep(300 * time.Millisecond)
+	if st := p.snapshot(); !st.Up || st.Restarts != 0 || st.Since == nil {
+		t.Errorf("status = %+v, want up with no restarts", st)
+	}
+}
+
+// A plugin that crashes is restarted and picks up where the queue is.
+// Entries queued before it starts still come after the hello.
+func TestPluginRestartsOnCrash(t *testing.T) {
+	starts := filepath.Join(t.TempDir(), "starts")
+	script := scriptPlugin(t, `echo x >> "$1"
+echo '{"type":"hello","protocol":1}'
+read hello
+case "$hello" in
+*'"type":"hello"'*) ;;
+*) echo "first message wasn't hello: $hello" >&2; exit 9 ;;
+esac
+read entry
+case "$entry" in
+*crash*) echo "crashing on purpose" >&2; exit 3 ;;
+esac
+echo '{"type":"alert","alert":{"title":"after restart","id":"forged","cluster":"elsewhere","severity":"info"}}'
+echo '{"type":"alert","alert":{"description":"no title"}}'
+while read line; do :; done
+`)
+	p, alerts := startPlugin(t, PluginConfig{Name: "crashy", Command: []string{script, starts}})
+
+	p.offer([]byte(`{"crash":true}`))
+	waitFor(t, "a restart", func() bool { return p.snapshot().Restarts == 1 })
+	if st := p.snapshot(); !strings.Contains(st.Error, "exit status 3") {
+		t.Errorf("error = %q, want the exit status", st.Error)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !p.snapshot().Up {
+		if time.Now().After(deadline) {
+			t.Fatal("plugin never came back up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	p.offer([]byte(`{"fine":true}`))
+	a := waitAlert(t, alerts)
+	if a.Title != "after restart" || a.ID != "" || a.Cluster != "" || a.Rule != "crashy" || a.Severity != sevInfo {
+		t.Errorf("alert = %+v, want the warden's own id and cluster, and the plugin's name as rule", a)
+	}
+	select {
+	case extra := <-alerts:
+		t.Errorf("an alert without a title got through: %+v", extra)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if data, _ := os.ReadFile(starts); strings.Count(string(data), "x") != 2 {
+		t.Errorf("plugin started %d times, want 2", strings.Count(string(data), "x"))
+	}
+}
+
+func TestPluginHealthFailures(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   string
+	}{
+		{"no hello", "while read line; do :; done\n", "no hello within"},
+		{"no pong", "echo '{\"type\":\"hello\",\"protocol\":1}'\nwhile read line; do :; done\n", "no pong within"},
+		{"wrong protocol", "echo '{\"type\":\"hello\",\"protocol\":2}'\nwhile read line; do :; done\n", "speaks protocol 2, want 1"},
+		{"alert before hello", "echo '{\"type\":\"alert\",\"alert\":{\"title\":\"early\"}}'\nwhile read line; do :; done\n", `sent "alert" before hello`},
+		{"exits", "echo '{\"type\":\"hello\",\"protocol\":1}'\nread hello\n", "exited"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := startPlugin(t, PluginConfig{Name: "sick", Command: []string{scriptPlugin(t, tt.script)},
+				Timeout: Duration(100 * time.Millisecond), HealthInterval: Duration(50 * time.Millisecond)})
+			waitFor(t, "the plugin to fail", func() bool { return p.snapshot().Restarts > 0 })
+			if st := p.snapshot(); st.Up || !strings.Contains(st.Error, tt.want) {
+				t.Errorf("status = %+v, want down with an error containing %q", st, tt.want)
+			}
+		})
+	}
+}
+
+// A plugin that falls behind costs entries, not audit reading.
+func TestPluginBackpressure(t *testing.T) {
+	p := newDetectorPlugins(&VaultConfig{Plugins: []PluginConfig{{Name: "slow", Buffer: 2}}}, func(Alert) {})[0]
+	before := metrics.sum("plugin_dropped_total")
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			p.offer([]byte(pluginEntry))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("offer blocked on a plugin that isn't reading")
+	}
+	if st := p.snapshot(); st.Dropped != 3 {
+		t.Errorf("dropped = %d, want 3", st.Dropped)
+	}
+	if d := metrics.sum("plugin_dropped_total") - before; d != 3 {
+		t.Errorf("plugin_dropped_total grew by %v, want 3", d)
+	}
+}
+
+func TestPluginRefusesWritableExecutable(t *testing.T) {
+	script := scriptPlugin(t, "exit 0\n")
+	if err := os.Chmod(script, 0o777); err != nil {
+		t.Fatal(err)
+	}
+	p, _ := startPlugin(t, PluginConfig{Name: "writable", Command: []string{script}})
+	waitFor(t, "the plugin to fail", func() bool { return p.snapshot().Restarts > 0 })
+	if st := p.snapshot(); !strings.Contains(st.Error, "group- or world-writable") {
+		t.Errorf("error = %q, want the writable executable refused", st.Error)
+	}
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Security Posture ---
+
+const defaultPostureInterval = 5 * time.Minute
+
+// PostureConfig asserts how Vault is set up, rather than reacting to what
+// happens in it. The checks run with the seal watch; a check that starts
+// failing alerts with what was expected and what was found, and one that
+// passes again sends an all-clear.
+type PostureConfig struct {
+	// Token reads what the checks need: sys/audit, sys/auth, sys/mounts
+	// and their tune endpoints, sys/policies/acl and
+	// identity/mfa/login-enforcement. A check it can't read is reported
+	// as unverifiable, not as drift.
+	Token    string         `yaml:"token"`
+	Interval Duration       `yaml:"interval"`
+	Checks   []PostureCheck `yaml:"checks"`
+}
+
+// PostureCheck is one assertion. Which fields apply depends on Type.
+type PostureCheck struct {
+	Name     string `yaml:"name"`
+	Type     string `yaml:"type"`
+	Severity string `yaml:"severity"` // of the drift alert; default warning
+
+	Devices []string `yaml:"devices"` // audit_devices: must be enabled; empty means at least one
+	Mount   string   `yaml:"mount"`   // auth_mount: e.g. "oidc/"
+	MFA     bool     `yaml:"mfa"`     // auth_mount: a login MFA enforcement must cover it
+	Policy  string   `yaml:"policy"`  // policy_hash
+	SHA256  string   `yaml:"sha256"`  // policy_hash: of the policy text as Vault returns it
+	Max     Duration `yaml:"max"`     // max_lease_ttl: effective ceiling of every mount
+	Mounts  []string `yaml:"mounts"`  // max_lease_ttl: path prefixes to check; empty means all
+}
+
+// A check's outcome.
+const (
+	postureOK           = "ok"
+	postureDrift        = "drift"
+	postureUnverifiable = "unverifiable"
+)
+
+// postureReading is what a check found. A check that couldn't read
+// something returns an error instead.
+type postureReading struct {
+	ok               bool
+	expected, actual string
+}
+
+type postureProbe func(ctx context.Context, v *postureClient, c PostureCheck) (postureReading, error)
+
+// postureTypes are the check types, by the name used in config.
+var postureTypes = map[string]postureProbe{
+	"audit_devices":   probeAuditDevices,
+	"auth_mount":      probeAuthMount,
+	"root_generation": probeRootGeneration,
+	"policy_hash":     probePolicyHash,
+	"max_lease_ttl":   probeMaxLeaseTTL,
+}
+
+func postureTypeNames() []string {
+	names := make([]string, 0, len(postureTypes))
+	for name := range postureTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validatePostureCheck checks the fields its type needs.
+func validatePostureCheck(field string, c PostureCheck) error {
+	switch c.Type {
+	case "auth_mount":
+		if c.Mount == "" {
+			return &fieldError{field + ".mount", "is required for auth_mount checks"}
+		}
+	case "policy_hash":
+		if c.Policy == "" {
+			return &fieldError{field + ".policy", "is required for policy_hash checks"}
+		}
+		if b, err := hex.DecodeString(c.SHA256); err != nil || len(b) != sha256.Size {
+			return &fieldError{field + ".sha256", "must be a hex SHA-256 digest"}
+		}
+	case "max_lease_ttl":
+		if c.Max <= 0 {
+			return &fieldError{field + ".max", "is required for max_lease_ttl checks"}
+		}
+	}
+	return nil
+}
+
+// postureResult is the last outcome of a check, shown in /statusz.
+type postureResult struct {
+	Check    string    `json:"check"`
+	Type     string    `json:"type"`
+	State    string    `json:"state"`
+	Expected string    `json:"expected,omitempty"`
+	Actual   string    `json:"actual,omitempty"`
+	Reason   string    `json:"reason,omitempty"` // why it was unverifiable
+	Since    time.Time `json:"since"`
+	Checked  time.Time `json:"checked"`
+	alerted  bool
+}
+
+// postureChecker runs the checks and remembers their outcomes, so only a
+// change alerts.
+type postureChecker struct {
+	cfg *VaultConfig
+	v   *postureClient
+
+	mu      sync.Mutex
+	results map[string]*postureResult
+}
+
+func newPostureChecker(cfg *VaultConfig) (*postureChecker, error) {
+	if len(cfg.Posture.Checks) == 0 {
+		return nil, nil
+	}
+	client, err := newVaultClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &postureChecker{cfg: cfg, results: make(map[string]*postureResult),
+		v: &postureClient{address: cfg.Address, token: cfg.Posture.Token, client: client, timeout: cfg.Timeouts.of(opAPI)}}, nil
+}
+
+func postureJob(p *postureChecker) jobSpec {
+	return jobSpec{name: "posture", every: time.Duration(p.cfg.Posture.Interval), timeout: time.Minute, run: p.run}
+}
+
+// run evaluates every check once.
+func (p *postureChecker) run(ctx context.Context) error {
+	for _, c := range p.cfg.Posture.Checks {
+		reading, err := postureTypes[c.Type](ctx, p.v, c)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		p.record(c, reading, err, time.Now())
+	}
+	return nil
+}
+
+func (p *postureChecker) record(c PostureCheck, reading postureReading, err error, now time.Time) {
+	r := &postureResult{Check: c.Name, Type: c.Type, State: postureOK, Expected: reading.expected,
+		Actual: reading.actual, Since: now, Checked: now}
+	switch {
+	case err != nil:
+		r.State, r.Reason = postureUnverifiable, err.Error()
+	case !reading.ok:
+		r.State = postureDrift
+	}
+
+	p.mu.Lock()
+	prev := p.results[c.Name]
+	if prev != nil {
+		r.alerted = prev.alerted
+		if prev.State == r.State {
+			r.Since = prev.Since
+		}
+	}
+	alert := r.State == postureDrift && !r.alerted
+	resolve := r.State == postureOK && r.alerted
+	r.alerted = alert || r.alerted && !resolve
+	p.results[c.Name] = r
+	p.mu.Unlock()
+
+	drift, unverifiable := 0.0, 0.0
+	switch r.State {
+	case postureDrift:
+		drift = 1
+	case postureUnverifiable:
+		unverifiable = 1
+		if prev == nil || prev.Reason != r.Reason {
+			logInfo("❔ Posture: {check} is unverifiable: {reason}", "check", c.Name, "reason", r.Reason)
+		}
+	}
+	metrics.set("posture_drift", drift, "check", c.Name)
+	metrics.set("posture_unverifiable", unverifiable, "check", c.Name)
+
+	detail := msgPostureDetail.with("expected", mdText(r.Expected, maxPathLen), "actual", mdText(r.Actual, maxPathLen))
+	switch {
+	case alert:
+		sev, _ := parseSeverity(c.Severity) // validated at load
+		logWarn("🧭 Posture drift: {check}: expected {expected}, found {actual}", "check", c.Name, "expected", r.Expected, "actual", r.Actual)
+		notify(p.cfg, Alert{Severity: sev, Color: sev.color(), Rule: "posture", Incident: "posture:" + c.Name,
+			Time: now}.say(msgPostureDrift.with("check", c.Name), detail))
+	case resolve:
+		logInfo("✅ Posture: {check} holds again", "check", c.Name)
+		notify(p.cfg, Alert{Severity: sevInfo, Color: sevInfo.color(), Rule: "posture", Incident: "posture:" + c.Name,
+			Resolved: true, Time: now}.say(msgPostureRestored.with("check", c.Name), detail))
+	}
+}
+
+var (
+	msgPostureDrift    = message("posture.drift.title")
+	msgPostureRestored = message("posture.restored.title")
+	msgPostureDetail   = message("posture.body")
+)
+
+// status returns each check's last outcome, in config order.
+func (p *postureChecker) status() []postureResult {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var out []postureResult
+	for _, c := range p.cfg.Posture.Checks {
+		if r := p.results[c.Name]; r != nil {
+			out = append(out, *r)
+		}
+	}
+	return out
+}
+
+// --- Posture Reads ---
+
+// errPostureDenied is a read the token isn't allowed.
+var errPostureDenied = errors.New("permission denied")
+
+// postureClient makes the checks' authenticated reads.
+type postureClient struct {
+	address string
+	token   string
+	client  *http.Client
+	timeout time.Duration
+}
+
+// get reads path into out. A missing path returns its status and no
+// error: for several checks that is the answer, not a failure.
+func (v *postureClient) get(ctx context.Context, method, path string, out interface{}) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, v.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, v.address+"/v1/"+path, nil)
+	if err != nil {
+		return 0, err
+	}
+	if v.token != "" {
+		req.Header.Set("X-Vault-Token", v.token)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("%s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return resp.StatusCode, nil
+	case http.StatusForbidden:
+		return resp.StatusCode, fmt.Errorf("%s %s: %w", method, path, errPostureDenied)
+	default:
+		return resp.StatusCode, fmt.Errorf("%s %s returned %d", method, path, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return resp.StatusCode, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return resp.StatusCode, nil
+}
+
+// mountTable reads sys/audit, sys/auth or sys/mounts. Entries are listed
+// under "data"; older versions also put them at the top level, next to
+// the request metadata.
+func (v *postureClient) mountTable(ctx context.Context, path string) (map[string]vaultMount, error) {
+	var top map[string]json.RawMessage
+	if _, err := v.get(ctx, "GET", path, &top); err != nil {
+		return nil, err
+	}
+	if data, ok := top["data"]; ok {
+		var inner map[string]json.RawMessage
+		if json.Unmarshal(data, &inner) == nil {
+			top = inner
+		}
+	}
+	mounts := make(map[string]vaultMount)
+	for p, raw := range top {
+		var m vaultMount
+		if strings.HasSuffix(p, "/") && json.Unmarshal(raw, &m) == nil && m.Type != "" {
+			mounts[p] = m
+		}
+	}
+	return mounts, nil
+}
+
+type vaultMount struct {
+	Type     string `json:"type"`
+	Accessor string `json:"accessor"`
+}
+
+func mountPath(p string) string {
+	return strings.TrimSuffix(p, "/") + "/"
+}
+
+func probeAuditDevices(ctx context.Context, v *postureClient, c PostureCheck) (postureReading, error) {
+	devices, err := v.mountTable(ctx, "sys/audit")
+	if err != nil {
+		return postureReading{}, err
+	}
+	var enabled []string
+	for p := range devices {
+		enabled = append(enabled, p)
+	}
+	sort.Strings(enabled)
+	r := postureReading{actual: "enabled: " + strings.Join(enabled, ", ")}
+	if len(enabled) == 0 {
+		r.actual = "no audit device enabled"
+	}
+	if len(c.Devices) == 0 {
+		r.expected, r.ok = "at least one audit device enabled", len(enabled) > 0
+		return r, nil
+	}
+	var want, missing []string
+	for _, d := range c.Devices {
+		want = append(want, mountPath(d))
+		if _, ok := devices[mountPath(d)]; !ok {
+			missing = append(missing, mountPath(d))
+		}
+	}
+	r.expected, r.ok = "enabled: "+strings.Join(want, ", "), len(missing) == 0
+	if !r.ok && len(enabled) > 0 {
+		r.actual += "; missing: " + strings.Join(missing, ", ")
+	}
+	return r, nil
+}
+
+func probeAuthMount(ctx context.Context, v *postureClient, c PostureCheck) (postureReading, error) {
+	path := mountPath(c.Mount)
+	r := postureReading{expected: path + " mounted"}
+	if c.MFA {
+		r.expected += " with login MFA enforced"
+	}
+	mounts, err := v.mountTable(ctx, "sys/auth")
+	if err != nil {
+		return postureReading{}, err
+	}
+	m, ok := mounts[path]
+	if !ok {
+		r.actual = path + " is not mounted"
+		return r, nil
+	}
+	r.actual = fmt.Sprintf("%s mounted (%s)", path, m.Type)
+	if !c.MFA {
+		r.ok = true
+		return r, nil
+	}
+	enforcement, err := loginEnforcementFor(ctx, v, m)
+	if err != nil {
+		return postureReading{}, err
+	}
+	if enforcement == "" {
+		r.actual += ", no login MFA enforcement covers it"
+		return r, nil
+	}
+	r.actual += ", MFA enforced by " + enforcement
+	r.ok = true
+	return r, nil
+}
+
+// loginEnforcementFor returns the name of a login MFA enforcement that
+// applies to the mount, or "" when none does.
+func loginEnforcementFor(ctx context.Context, v *postureClient, m vaultMount) (string, error) {
+	var list struct {
+		Data struct {
+			Keys []string `json:"keys"`
+		} `json:"data"`
+	}
+	if _, err := v.get(ctx, "LIST", "identity/mfa/login-enforcement", &list); err != nil {
+		return "", err
+	}
+	for _, name := range list.Data.Keys {
+		var e struct {
+			Data struct {
+				Accessors []string `json:"auth_method_accessors"`
+				Types     []string `json:"auth_method_types"`
+			} `json:"data"`
+		}
+		if _, err := v.get(ctx, "GET", "identity/mfa/login-enforcement/"+url.PathEscape(name), &e); err != nil {
+			return "", err
+		}
+		if containsString(e.Data.Accessors, m.Accessor) || containsString(e.Data.Types, m.Type) {
+			return name, nil
+		}
+	}
+	return "", nil
+}
+
+func probeRootGeneration(ctx context.Context, v *postureClient, c PostureCheck) (postureReading, error) {
+	var attempt struct {
+		Started  bool `json:"started"`
+		Progress int  `json:"progress"`
+		Required int  `json:"required"`
+	}
+	if _, err := v.get(ctx, "GET", "sys/generate-root/attempt", &attempt); err != nil {
+		return postureReading{}, err
+	}
+	r := postureReading{expected: "no root token generation in progress", actual: "none in progress"}
+	if attempt.Started || attempt.Progress > 0 {
+		r.actual = fmt.Sprintf("root token generation started, %d of %d key shares submitted", attempt.Progress, attempt.Required)
+		return r, nil
+	}
+	r.ok = true
+	return r, nil
+}
+
+func probePolicyHash(ctx context.Context, v *postureClient, c PostureCheck) (postureReading, error) {
+	var policy struct {
+		Data struct {
+			Policy string `json:"policy"`
+		} `json:"data"`
+	}
+	status, err := v.get(ctx, "GET", "sys/policies/acl/"+url.PathEscape(c.Policy), &policy)
+	if err != nil {
+		return postureReading{}, err
+	}
+	want := strings.ToLower(c.SHA256)
+	r := postureReading{expected: fmt.Sprintf("policy %s with sha256 %s", c.Policy, want)}
+	if status == http.StatusNotFound {
+		r.actual = "policy " + c.Policy + " does not exist"
+		return r, nil
+	}
+	sum := sha256.Sum256([]byte(policy.Data.Policy))
+	got := hex.EncodeToString(sum[:])
+	r.actual, r.ok = "sha256 "+got, got == want
+	return r, nil
+}
+
+func probeMaxLeaseTTL(ctx context.Context, v *postureClient, c PostureCheck) (postureReading, error) {
+	max := time.Duration(c.Max)
+	r := postureReading{expected: "max lease TTL at most " + max.String()}
+	secrets, err := v.mountTable(ctx, "sys/mounts")
+	if err != nil {
+		return postureReading{}, err
+	}
+	auths, err := v.mountTable(ctx, "sys/auth")
+	if err != nil {
+		return postureReading{}, err
+	}
+	paths := map[string]string{} // display path -> tune endpoint
+	for p, m := range secrets {
+		// These never issue leases.
+		if m.Type != "system" && m.Type != "identity" && m.Type != "cubbyhole" {
+			paths[p] = "sys/mounts/" + p + "tune"
+		}
+	}
+	for p := range auths {
+		paths["auth/"+p] = "sys/auth/" + p + "tune"
+	}
+	var names, over []string
+	for p := range paths {
+		if len(c.Mounts) == 0 || hasAnyPrefix(p, c.Mounts) {
+			names = append(names, p)
+		}
+	}
+	sort.Strings(names)
+	for _, p := range names {
+		var tune struct {
+			MaxLeaseTTL int64 `json:"max_lease_ttl"`
+		}
+		if _, err := v.get(ctx, "GET", paths[p], &tune); err != nil {
+			return postureReading{}, err
+		}
+		if ttl := time.Duration(tune.MaxLeaseTTL) * time.Second; ttl > max {
+			over = append(over, fmt.Sprintf("%s %s", p, ttl))
+		}
+	}
+	if len(over) > 0 {
+		r.actual = "over the limit: " + strings.Join(over, ", ")
+		return r, nil
+	}
+	r.actual = fmt.Sprintf("%d mounts within the limit", len(names))
+	r.ok = true
+	return r, nil
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
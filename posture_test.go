@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postureResponse is one answer of a testdata/posture fixture; Status
+// defaults to 200.
+type postureResponse struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body"`
+}
+
+// postureVault answers the reads in a testdata/posture fixture, keyed by
+// method and path, and 404 to everything else.
+func postureVault(t *testing.T, fixture string) *postureClient {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "posture", fixture+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var responses map[string]postureResponse
+	if err := json.Unmarshal(data, &responses); err != nil {
+		t.Fatalf("%s: %v", fixture, err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "posture-token" {
+			t.Errorf("%s %s without the posture token", r.Method, r.URL.Path)
+		}
+		resp, ok := responses[r.Method+" "+strings.TrimPrefix(r.URL.Path, "/v1/")]
+		if !ok {
+			http.Error(w, `{"errors":[]}`, http.StatusNotFound)
+			return
+		}
+		if resp.Status != 0 {
+			w.WriteHeader(resp.Status)
+		}
+		w.Write(resp.Body)
+	}))
+	t.Cleanup(srv.Close)
+	return &postureClient{address: srv.URL, token: "posture-token", client: srv.Client(), timeout: 5 * time.Second}
+}
+
+const appReadSHA256 = "64ca40559561938e3e6f860fd2e18ed5eb1557524d5ea012100a3f545656d6ba"
+
+func TestPostureChecks(t *testing.T) {
+	tests := []struct {
+		fixture string
+		check   PostureCheck
+		state   string
+		actual  string // substring of the actual value, or of the reason
+	}{
+		{"audit-devices-ok", PostureCheck{Type: "audit_devices"}, postureOK, "enabled: file/, syslog/"},
+		{"audit-devices-ok", PostureCheck{Type: "audit_devices", Devices: []string{"file", "syslog/"}}, postureOK, "enabled: file/, syslog/"},
+		{"audit-devices-legacy", PostureCheck{Type: "audit_devices", Devices: []string{"syslog"}}, postureOK, "enabled: file/, syslog/"},
+		{"audit-devices-none", PostureCheck{Type: "audit_devices"}, postureDrift, "no audit device enabled"},
+		{"audit-devices-missing", PostureCheck{Type: "audit_devices", Devices: []string{"file", "syslog"}}, postureDrift, "enabled: file/; missing: syslog/"},
+		{"audit-devices-denied", PostureCheck{Type: "audit_devices"}, postureUnverifiable, "GET sys/audit: permission denied"},
+
+		{"auth-mount-mfa-accessor", PostureCheck{Type: "auth_mount", Mount: "oidc", MFA: true}, postureOK, "oidc/ mounted (oidc), MFA enforced by admins"},
+		{"auth-mount-mfa-type", PostureCheck{Type: "auth_mount", Mount: "oidc/", MFA: true}, postureOK, "MFA enforced by by-type"},
+		{"auth-mount-no-mfa", PostureCheck{Type: "auth_mount", Mount: "oidc/", MFA: true}, postureDrift, "no login MFA enforcement covers it"},
+		{"auth-mount-no-mfa", PostureCheck{Type: "auth_mount", Mount: "oidc/"}, postureOK, "oidc/ mounted (oidc)"},
+		{"auth-mount-no-enforcements", PostureCheck{Type: "auth_mount", Mount: "oidc/", MFA: true}, postureDrift, "no login MFA enforcement covers it"},
+		{"auth-mount-not-mounted", PostureCheck{Type: "auth_mount", Mount: "oidc/", MFA: true}, postureDrift, "oidc/ is not mounted"},
+		{"auth-mount-mfa-denied", PostureCheck{Type: "auth_mount", Mount: "oidc/", MFA: true}, postureUnverifiable, "LIST identity/mfa/login-enforcement: permission denied"},
+
+		{"root-generation-idle", PostureCheck{Type: "root_generation"}, postureOK, "none in progress"},
+		{"root-generation-started", PostureCheck{Type: "root_generation"}, postureDrift, "root token generation started, 2 of 3 key shares submitted"},
+		{"root-generation-denied", PostureCheck{Type: "root_generation"}, postureUnverifiable, "permission denied"},
+
+		{"policy-hash-match", PostureCheck{Type: "policy_hash", Policy: "app-read", SHA256: strings.ToUpper(appReadSHA256)}, postureOK, "sha256 " + appReadSHA256},
+		{"policy-hash-changed", PostureCheck{Type: "policy_hash", Policy: "app-read", SHA256: appReadSHA256}, postureDrift, "sha256 "},
+		{"policy-hash-missing", PostureCheck{Type: "policy_hash", Policy: "app-read", SHA256: appReadSHA256}, postureDrift, "policy app-read does not exist"},
+		{"policy-hash-denied", PostureCheck{Type: "policy_hash", Policy: "app-read", SHA256: appReadSHA256}, postureUnverifiable, "GET sys/policies/acl/app-read: permission denied"},
+
+		{"max-lease-ttl-within", PostureCheck{Type: "max_lease_ttl", Max: Duration(72 * time.Hour)}, postureOK, "3 mounts within the limit"},
+		{"max-lease-ttl-over", PostureCheck{Type: "max_lease_ttl", Max: Duration(72 * time.Hour)}, postureDrift, "over the limit: auth/token/ 768h0m0s, pki/ 87600h0m0s"},
+		{"max-lease-ttl-over", PostureCheck{Type: "max_lease_ttl", Max: Duration(72 * time.Hour), Mounts: []string{"secret/", "auth/"}}, postureDrift, "over the limit: auth/token/ 768h0m0s"},
+		{"max-lease-ttl-over", PostureCheck{Type: "max_lease_ttl", Max: Duration(72 * time.Hour), Mounts: []string{"secret/"}}, postureOK, "1 mounts within the limit"},
+		{"max-lease-ttl-tune-denied", PostureCheck{Type: "max_lease_ttl", Max: Duration(72 * time.Hour)}, postureUnverifiable, "GET sys/mounts/pki/tune: permission denied"},
+	}
+	for _, tt := range tests {
+		tt.check.Name = tt.fixture
+		t.Run(tt.fixture, func(t *testing.T) {
+			cfg := &VaultConfig{}
+			cfg.Posture.Checks = []PostureCheck{tt.check}
+			p := &postureChecker{cfg: cfg, v: postureVault(t, tt.fixture), results: make(map[string]*postureResult)}
+			captureAlerts(t)
+			if err := p.run(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			r := p.status()[0]
+			got := r.Actual
+			if r.State == postureUnverifiable {
+				got = r.Reason
+			}
+			if r.State != tt.state || !strings.Contains(got, tt.actual) {
+				t.Errorf("%+v: %s %q, want %s containing %q", tt.check, r.State, got, tt.state, tt.actual)
+			}
+			if r.State != postureUnverifiable && r.Expected == "" {
+				t.Errorf("%+v: no expected value", tt.check)
+			}
+		})
+	}
+}
+
+// Drift alerts once with both values, an unverifiable check neither
+// alerts nor clears, and passing again sends the all-clear.
+func TestPostureDriftAndRecovery(t *testing.T) {
+	sent := captureAlerts(t)
+	check := PostureCheck{Name: "audit on", Type: "audit_devices", Severity: "critical"}
+	cfg := &VaultConfig{}
+	cfg.Posture.Checks = []PostureCheck{check}
+	p := &postureChecker{cfg: cfg, results: make(map[string]*postureResult)}
+	drift := postureReading{expected: "at least one audit device enabled", actual: "no audit device enabled"}
+	start := time.Date(2026, 5, 1, 9, 0, 0, 0, time.UTC)
+
+	p.record(check, postureReading{ok: true, expected: drift.expected, actual: "enabled: file/"}, nil, start)
+	p.record(check, drift, nil, start.Add(time.Minute))
+	p.record(check, drift, nil, start.Add(2*time.Minute))
+	alerts := sent()
+	if len(alerts) != 1 {
+		t.Fatalf("sent %d alerts for a drift seen twice, want 1", len(alerts))
+	}
+	a := alerts[0]
+	if a.Severity != sevCritical || a.Rule != "posture" || !strings.Contains(a.Title, "audit on") ||
+		!strings.Contains(a.Description, "at least one audit device enabled") || !strings.Contains(a.Description, "no audit device enabled") {
+		t.Errorf("drift alert = %s %q %q, want critical with expected and actual", a.Severity, a.Title, a.Description)
+	}
+	if r := p.status()[0]; r.State != postureDrift || !r.Since.Equal(start.Add(time.Minute)) {
+		t.Errorf("status = %s since %s, want drift since the first drifted check", r.State, r.Since)
+	}
+
+	p.record(check, postureReading{}, errPostureDenied, start.Add(3*time.Minute))
+	if alerts := sent(); len(alerts) != 0 {
+		t.Errorf("unverifiable sent %d alerts, want none", len(alerts))
+	}
+	if r := p.status()[0]; r.State != postureUnverifiable || r.Reason != "permission denied" {
+		t.Errorf("status = %s %q, want unverifiable with the reason", r.State, r.Reason)
+	}
+
+	p.record(check, postureReading{ok: true, expected: drift.expected, actual: "enabled: file/"}, nil, start.Add(4*time.Minute))
+	alerts = sent()
+	if len(alerts) != 1 || alerts[0].Severity != sevInfo || alerts[0].Rule != "posture" {
+		t.Fatalf("alerts = %+v, want one all-clear", alerts)
+	}
+	p.record(check, postureReading{ok: true}, nil, start.Add(5*time.Minute))
+	if alerts := sent(); len(alerts) != 0 {
+		t.Errorf("sent %d alerts while it holds, want none", len(alerts))
+	}
+}
+
+// A token that can't read a check from the start never alerts.
+func TestPostureUnverifiableNeverAlerts(t *testing.T) {
+	sent := captureAlerts(t)
+	check := PostureCheck{Name: "root", Type: "root_generation"}
+	cfg := &VaultConfig{}
+	cfg.Posture.Checks = []PostureCheck{check}
+	p := &postureChecker{cfg: cfg, v: postureVault(t, "root-generation-denied"), results: make(map[string]*postureResult)}
+	for i := 0; i < 3; i++ {
+		if err := p.run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if alerts := sent(); len(alerts) != 0 {
+		t.Errorf("sent %d alerts, want none", len(alerts))
+	}
+}
+
+func TestValidatePostureCheck(t *testing.T) {
+	tests := []struct {
+		check PostureCheck
+		want  string
+	}{
+		{PostureCheck{Type: "audit_devices"}, ""},
+		{PostureCheck{Type: "auth_mount"}, "checks[0].mount is required for auth_mount checks"},
+		{PostureCheck{Type: "policy_hash", SHA256: appReadSHA256}, "checks[0].policy is required for policy_hash checks"},
+		{PostureCheck{Type: "policy_hash", Policy: "p", SHA256: "abc"}, "checks[0].sha256 must be a hex SHA-256 digest"},
+		{PostureCheck{Type: "policy_hash", Policy: "p", SHA256: appReadSHA256}, ""},
+		{PostureCheck{Type: "max_lease_ttl"}, "checks[0].max is required for max_lease_ttl checks"},
+	}
+	for _, tt := range tests {
+		if got := errString(validatePostureCheck("checks[0]", tt.check)); got != tt.want {
+			t.Errorf("validatePostureCheck(%+v) = %q, want %q", tt.check, got, tt.want)
+		}
+	}
+}
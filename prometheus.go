@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Prometheus Exporter ---
+
+const prometheusPrefix = "vault_warden_"
+
+// metricsComponent serves /metrics on metrics_listen. Like the admin
+// listener, monitoring carries on without it.
+func metricsComponent(cfg *VaultConfig) componentSpec {
+	return componentSpec{name: "metrics", policy: policyIgnore, run: func(ctx context.Context) error {
+		l, err := listenMetrics(cfg.MetricsListen)
+		if err != nil {
+			return err
+		}
+		return serveMetrics(ctx, l)
+	}}
+}
+
+func listenMetrics(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen on metrics address: %w", err)
+	}
+	return l, nil
+}
+
+// serveMetrics serves the registry on l until ctx is done.
+func serveMetrics(ctx context.Context, l net.Listener) error {
+	logInfo("📈 Serving Prometheus metrics on http://{address}/metrics", "address", l.Addr())
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", prometheusHandler(metrics))
+	return serveAdmin(ctx, l, mux, "metrics address")
+}
+
+// prometheusHandler renders a registry snapshot in the Prometheus text
+// format. Each scrape takes its own snapshot, so it never sees a series
+// half updated.
+func prometheusHandler(reg *metricsRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		writePrometheus(bw, reg.snapshot())
+		bw.Flush()
+	}
+}
+
+func writePrometheus(w *bufio.Writer, samples []metricSample) {
+	var last string
+	for _, s := range samples {
+		name := prometheusPrefix + s.Name
+		if s.Name != last {
+			last = s.Name
+			fmt.Fprintf(w, "# TYPE %s %s\n", name, prometheusType(s.Kind))
+		}
+		switch s.Kind {
+		case kindHistogram:
+			for i, bound := range latencyBuckets {
+				le := strconv.FormatFloat(bound, 'g', -1, 64)
+				fmt.Fprintf(w, "%s_bucket%s %d\n", name, prometheusLabels(s.Labels, "le", le), s.Buckets[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, prometheusLabels(s.Labels, "le", "+Inf"), s.Count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", name, prometheusLabels(s.Labels), prometheusValue(s.Value))
+			fmt.Fprintf(w, "%s_count%s %d\n", name, prometheusLabels(s.Labels), s.Count)
+		default:
+			fmt.Fprintf(w, "%s%s %s\n", name, prometheusLabels(s.Labels), prometheusValue(s.Value))
+		}
+	}
+}
+
+func prometheusType(k metricKind) string {
+	switch k {
+	case kindCounter:
+		return "counter"
+	case kindHistogram:
+		return "histogram"
+	}
+	return "gauge"
+}
+
+func prometheusValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// prometheusLabels renders alternating names and values as {a="1",b="2"},
+// or "" when there are none.
+func prometheusLabels(labels []string, extra ...string) string {
+	all := append(append([]string(nil), labels...), extra...)
+	if len(all) < 2 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(all); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(all[i])
+		b.WriteString(`="`)
+		b.WriteString(prometheusEscaper.Replace(all[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var prometheusEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// recordUnseal records a successful unseal of a cluster for the
+// last-unseal gauge.
+func recordUnseal(cfg *VaultConfig) {
+	metrics.set("last_unseal_timestamp_seconds", float64(time.Now().Unix()), "cluster", clusterLabel(cfg))
+}
+
+// recordSealState sets the sealed gauge of a watched cluster: 1 sealed,
+// 0 unsealed.
+func recordSealState(cluster string, sealed bool) {
+	v := 0.0
+	if sealed {
+		v = 1
+	}
+	metrics.set("vault_sealed", v, "cluster", cluster)
+}
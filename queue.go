@@ -0,0 +1,455 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// --- Notification Queue ---
+
+const (
+	defaultQueueSize    = 1000
+	defaultPromoteAfter = 30 * time.Second
+	defaultDrainTimeout = 10 * time.Second
+
+	defaultRetryAttempts = 6
+	defaultRetryElapsed  = 15 * time.Minute
+	defaultRetryBackoff  = 2 * time.Second
+	maxRetryBackoff      = 5 * time.Minute
+)
+
+// QueueConfig tunes the audit-mode notification queue.
+type QueueConfig struct {
+	// Size is how many alerts may wait; past it the oldest of the lowest
+	// severity is dropped, or the new alert if nothing queued is below or
+	// at its severity.
+	Size int `yaml:"size"`
+	// DrainTimeout is how long shutdown waits for the queue to empty
+	// before the final stopped notification.
+	DrainTimeout Duration `yaml:"drain_timeout"`
+	// Lower-severity alerts that have waited this long are sent ahead of
+	// newer higher-severity ones, so they can't starve forever.
+	PromoteAfter Duration `yaml:"promote_after"`
+
+	Coalesce CoalesceConfig `yaml:"coalesce"`
+	Outbox   OutboxConfig   `yaml:"outbox"`
+	Retry    RetryConfig    `yaml:"retry"`
+}
+
+// RetryConfig bounds the retries of an alert whose send failed on a
+// network error, a 429 or a 5xx. Retries wait in the queue, so later
+// alerts go out meanwhile; the wait doubles from Backoff, with jitter.
+type RetryConfig struct {
+	MaxAttempts int      `yaml:"max_attempts"` // sends in all, the first included
+	MaxElapsed  Duration `yaml:"max_elapsed"`  // since the first failure
+	Backoff     Duration `yaml:"backoff"`      // before the first retry
+}
+
+type queuedAlert struct {
+	alert    Alert
+	enqueued time.Time
+	// attempts counts the failed sends; failedAt is the first of them and
+	// due when the next may be made.
+	attempts int
+	failedAt time.Time
+	due      time.Time
+}
+
+// notifyQueue delivers alerts from a background worker, highest severity
+// first and FIFO within a severity. When full, the oldest alert of the
+// lowest non-empty severity is dropped to make room, as long as it isn't
+// above the new one's; otherwise the new alert is.
+type notifyQueue struct {
+	mu           sync.Mutex
+	bySeverity   [sevCritical + 1][]queuedAlert
+	retrying     []queuedAlert // failed, waiting for their due time
+	size         int
+	capacity     int
+	promoteAfter time.Duration
+	// deliver sends a batch and returns the alerts it couldn't, with the
+	// last error.
+	deliver func([]Alert) ([]Alert, error)
+	sink    string // the notifier's kind, for the outbox
+	retries RetryConfig
+	// window is how long a batch waits for more alerts after its first
+	// was queued; 0 sends alerts one by one.
+	window time.Duration
+	// retry keeps a failed alert at the head of its severity and retries
+	// it with backoff instead of moving on.
+	retry  bool
+	wake   chan struct{}
+	closed bool
+	done   chan struct{}
+	// dog restarts the worker when a delivery hangs; worker is the
+	// generation that is current, so a replaced one exits when it
+	// returns.
+	dog    *watchdog
+	worker int
+}
+
+// queue is the process-wide notification queue. It is nil outside audit
+// mode, where notify delivers synchronously.
+var queue *notifyQueue
+
+func startNotifyQueue(cfg *VaultConfig, deliver func([]Alert) ([]Alert, error)) *notifyQueue {
+	q := &notifyQueue{
+		capacity:     cfg.Queue.Size,
+		promoteAfter: time.Duration(cfg.Queue.PromoteAfter),
+		deliver:      deliver,
+		sink:         notifierFor(cfg).kind(),
+		retries:      cfg.Queue.Retry,
+		retry:        cfg.Intake.PauseOnSinkFailure,
+		window:       coalesceWindow(cfg.Queue.Coalesce),
+		wake:         make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
+	q.dog = newWatchdog(cfg, "notify-queue", q.restart)
+	go q.run(0)
+	return q
+}
+
+// restart replaces a worker that stopped making progress. The alerts it
+// was sending stay in the outbox for the next start.
+func (q *notifyQueue) restart() error {
+	q.mu.Lock()
+	q.worker++
+	gen := q.worker
+	q.mu.Unlock()
+	go q.run(gen)
+	return nil
+}
+
+// current reports whether gen is the worker that should keep running.
+func (q *notifyQueue) current(gen int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.worker == gen
+}
+
+// sleep waits d, showing the watchdog it's waiting on purpose.
+func (q *notifyQueue) sleep(d time.Duration) {
+	for end := time.Now().Add(d); time.Now().Before(end); {
+		q.dog.beat()
+		wait := time.Until(end)
+		if wait > time.Second {
+			wait = time.Second
+		}
+		time.Sleep(wait)
+	}
+	q.dog.beat()
+}
+
+func (q *notifyQueue) push(a Alert) {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		q.deliver([]Alert{a})
+		return
+	}
+	if q.size >= q.capacity && !q.makeRoom(a.Severity) {
+		// Everything waiting outranks it.
+		q.discard(a)
+		q.mu.Unlock()
+		return
+	}
+	q.bySeverity[a.Severity] = append(q.bySeverity[a.Severity], queuedAlert{alert: a, enqueued: time.Now()})
+	q.size++
+	q.mu.Unlock()
+	metrics.inc("notify_queued_total", "severity", a.Severity.String())
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// makeRoom drops the oldest alert of the lowest severity waiting, queued
+// or retrying, unless that is above sev; q.mu is held.
+func (q *notifyQueue) makeRoom(sev severity) bool {
+	for s := sevInfo; s <= sev; s++ {
+		if items := q.bySeverity[s]; len(items) > 0 {
+			q.drop(items[0])
+			q.bySeverity[s] = items[1:]
+			return true
+		}
+		for i, item := range q.retrying {
+			if item.alert.Severity == s {
+				q.drop(item)
+				q.retrying = append(q.retrying[:i:i], q.retrying[i+1:]...)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// drop makes room in a full queue; q.mu is held.
+func (q *notifyQueue) drop(item queuedAlert) {
+	q.discard(item.alert)
+	q.size--
+}
+
+// discard gives up on an alert the full queue has no room for.
+func (q *notifyQueue) discard(a Alert) {
+	logWarn("⚠️  Notification queue full, dropping: {title}", "title", a.Title)
+	metrics.inc("notify_dropped_total", "severity", a.Severity.String())
+	// Settled, so a restart doesn't bring it back.
+	outbox.done(a.ID, q.sink)
+}
+
+// pop removes the next alert to send: a retry that is due, highest
+// severity first, then the queued alerts. Once the queue is closed every
+// retry is due, for one last attempt.
+func (q *notifyQueue) pop() (queuedAlert, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.retrying) > 0 {
+		r, now := -1, time.Now()
+		for i, item := range q.retrying {
+			if (q.closed || !now.Before(item.due)) && (r < 0 || item.alert.Severity > q.retrying[r].alert.Severity) {
+				r = i
+			}
+		}
+		if r >= 0 {
+			item := q.retrying[r]
+			q.retrying = append(q.retrying[:r:r], q.retrying[r+1:]...)
+			q.size--
+			return item, true
+		}
+	}
+
+	// Starvation guard: the oldest overdue lower-severity head goes first.
+	best := -1
+	for sev := sevInfo; sev < sevCritical; sev++ {
+		items := q.bySeverity[sev]
+		if len(items) == 0 || time.Since(items[0].enqueued) < q.promoteAfter {
+			continue
+		}
+		if best < 0 || items[0].enqueued.Before(q.bySeverity[best][0].enqueued) {
+			best = int(sev)
+		}
+	}
+	if best < 0 {
+		for sev := sevCritical; sev >= sevInfo; sev-- {
+			if len(q.bySeverity[sev]) > 0 {
+				best = int(sev)
+				break
+			}
+		}
+	}
+	if best < 0 {
+		return queuedAlert{}, false
+	}
+
+	item := q.bySeverity[best][0]
+	q.bySeverity[best] = q.bySeverity[best][1:]
+	q.size--
+	return item, true
+}
+
+// popBatch removes the next alert and whatever else arrives until the
+// window after it was queued has passed, up to one Discord message of
+// embeds. A backlog is therefore sent in full batches without waiting.
+// Higher severities are still taken first, and nothing waits longer than
+// the window.
+func (q *notifyQueue) popBatch() ([]queuedAlert, bool) {
+	first, ok := q.pop()
+	if !ok {
+		return nil, false
+	}
+	batch := []queuedAlert{first}
+	if q.window <= 0 {
+		return batch, true
+	}
+	timer := time.NewTimer(time.Until(first.enqueued.Add(q.window)))
+	defer timer.Stop()
+	for len(batch) < discordMaxEmbeds {
+		if item, ok := q.pop(); ok {
+			batch = append(batch, item)
+			continue
+		}
+		q.mu.Lock()
+		closed := q.closed
+		q.mu.Unlock()
+		if closed {
+			break
+		}
+		select {
+		case <-q.wake:
+		case <-timer.C:
+			return batch, true
+		}
+	}
+	return batch, true
+}
+
+// requeue puts alerts that failed to send back at the head of their
+// severity, keeping their original enqueue time and order.
+func (q *notifyQueue) requeue(items []queuedAlert) {
+	q.mu.Lock()
+	for i := len(items) - 1; i >= 0; i-- {
+		sev := items[i].alert.Severity
+		q.bySeverity[sev] = append([]queuedAlert{items[i]}, q.bySeverity[sev]...)
+		q.size++
+	}
+	q.mu.Unlock()
+}
+
+// depths returns the number of queued alerts per severity.
+func (q *notifyQueue) depths() map[string]int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out := make(map[string]int, len(q.bySeverity))
+	for sev, items := range q.bySeverity {
+		out[severity(sev).String()] = len(items)
+	}
+	for _, item := range q.retrying {
+		out[item.alert.Severity.String()]++
+	}
+	return out
+}
+
+// run is a worker. It beats the watchdog between deliveries and while
+// idle; a delivery that hangs stops the beats.
+func (q *notifyQueue) run(gen int) {
+	backoff := time.Second
+	for {
+		if !q.current(gen) {
+			return
+		}
+		q.dog.beat()
+		if batch, ok := q.popBatch(); ok {
+			alerts := make([]Alert, len(batch))
+			for i, item := range batch {
+				alerts[i] = item.alert
+			}
+			failed, err := q.deliver(alerts)
+			q.countSent(batch, failed)
+			if len(failed) > 0 && q.retry {
+				q.requeue(failedItems(batch, failed))
+				q.sleep(backoff)
+				if backoff *= 2; backoff > 30*time.Second {
+					backoff = 30 * time.Second
+				}
+				continue
+			}
+			backoff = time.Second
+			if len(failed) > 0 {
+				q.retryLater(failedItems(batch, failed), err)
+			}
+			continue
+		}
+		q.mu.Lock()
+		closed := q.closed
+		q.mu.Unlock()
+		if closed {
+			if q.current(gen) {
+				close(q.done)
+			}
+			return
+		}
+		select {
+		case <-q.wake:
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// countSent counts the alerts of a batch that went out.
+func (q *notifyQueue) countSent(batch []queuedAlert, failed []Alert) {
+	left := failedItems(batch, failed)
+	for _, item := range batch {
+		if len(left) > 0 && left[0].alert.ID == item.alert.ID {
+			left = left[1:]
+			continue
+		}
+		metrics.inc("notify_sent_total", "severity", item.alert.Severity.String())
+	}
+}
+
+// retryLater schedules the next attempt of each failed item, or gives up
+// on it once retry.max_attempts or retry.max_elapsed is reached or the
+// queue is closing. An alert given up on stays in the outbox, if there is
+// one, for the next start.
+func (q *notifyQueue) retryLater(items []queuedAlert, err error) {
+	now := time.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, item := range items {
+		item.attempts++
+		if item.failedAt.IsZero() {
+			item.failedAt = now
+		}
+		a := item.alert
+		if q.closed || item.attempts >= q.retries.MaxAttempts || now.Sub(item.failedAt) >= time.Duration(q.retries.MaxElapsed) {
+			logError("❌ Gave up sending alert {title} to {sink} after {attempts} attempt(s) over {elapsed}: {error}",
+				"title", a.Title, "sink", q.sink, "attempts", item.attempts, "elapsed", now.Sub(item.failedAt).Round(time.Second),
+				"error", err, "alert_id", a.ID, "rule", a.Rule, "severity", a.Severity.String())
+			metrics.inc("notify_gave_up_total", "sink", q.sink)
+			continue
+		}
+		wait := retryBackoff(time.Duration(q.retries.Backoff), item.attempts, err)
+		item.due = now.Add(wait)
+		q.retrying = append(q.retrying, item)
+		q.size++
+		metrics.inc("notify_retries_total", "sink", q.sink)
+		logDebug("🔁 Retrying alert {title} to {sink} in {wait}", "title", a.Title, "sink", q.sink, "wait", wait.Round(time.Millisecond))
+	}
+}
+
+// retryBackoff is the wait before retry number n: base doubled for each
+// retry before it, capped and jittered, and no shorter than a Retry-After
+// the sink asked for.
+func retryBackoff(base time.Duration, n int, err error) time.Duration {
+	d := base
+	for i := 1; i < n && d < maxRetryBackoff; i++ {
+		d *= 2
+	}
+	if d > maxRetryBackoff {
+		d = maxRetryBackoff
+	}
+	d = jitter(d)
+	var se *sinkStatusError
+	if errors.As(err, &se) && se.retryAfter > d {
+		d = se.retryAfter
+		if d > maxRetryBackoff {
+			d = maxRetryBackoff
+		}
+	}
+	return d
+}
+
+// failedItems picks the queued items of the alerts that failed.
+func failedItems(batch []queuedAlert, failed []Alert) []queuedAlert {
+	ids := make(map[string]bool, len(failed))
+	for _, a := range failed {
+		ids[a.ID] = true
+	}
+	var out []queuedAlert
+	for _, item := range batch {
+		if ids[item.alert.ID] {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// close stops accepting queued alerts (later ones are sent synchronously)
+// and waits up to timeout for the backlog to drain.
+func (q *notifyQueue) close(timeout time.Duration) {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	select {
+	case <-q.done:
+	case <-time.After(timeout):
+		logWarn("⚠️  Notification queue not drained after {timeout}: {queued} still queued", "timeout", timeout, "queued", q.depths())
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// testQueue is a queue with no worker running; tests pop from it, or
+// start one with go q.run(0).
+func testQueue(capacity int, deliver func([]Alert) ([]Alert, error)) *notifyQueue {
+	return &notifyQueue{
+		capacity:     capacity,
+		promoteAfter: time.Hour,
+		deliver:      deliver,
+		sink:         "discord",
+		retries:      RetryConfig{MaxAttempts: 1},
+		wake:         make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
+}
+
+func queueAlert(id string, sev severity) Alert {
+	return Alert{ID: id, Title: id, Severity: sev}
+}
+
+func queuedIDs(q *notifyQueue) []string {
+	var ids []string
+	for {
+		item, ok := q.pop()
+		if !ok {
+			return ids
+		}
+		ids = append(ids, item.alert.ID)
+	}
+}
+
+func TestQueueOrder(t *testing.T) {
+	q := testQueue(10, nil)
+	q.push(queueAlert("info-1", sevInfo))
+	q.push(queueAlert("warn-1", sevWarning))
+	q.push(queueAlert("info-2", sevInfo))
+	q.push(queueAlert("crit-1", sevCritical))
+	q.push(queueAlert("warn-2", sevWarning))
+
+	got := fmt.Sprint(queuedIDs(q))
+	if want := "[crit-1 warn-1 warn-2 info-1 info-2]"; got != want {
+		t.Errorf("order = %s, want %s", got, want)
+	}
+}
+
+func TestQueuePromotesStarved(t *testing.T) {
+	q := testQueue(10, nil)
+	q.promoteAfter = time.Minute
+	q.push(queueAlert("info-old", sevInfo))
+	q.bySeverity[sevInfo][0].enqueued = time.Now().Add(-2 * time.Minute)
+	q.push(queueAlert("crit", sevCritical))
+
+	got := fmt.Sprint(queuedIDs(q))
+	if want := "[info-old crit]"; got != want {
+		t.Errorf("order = %s, want %s", got, want)
+	}
+}
+
+func TestQueueFullDropsLowest(t *testing.T) {
+	tests := []struct {
+		name    string
+		queued  []severity
+		push    severity
+		want    string
+		dropped string
+	}{
+		{"drops oldest info", []severity{sevInfo, sevInfo, sevCritical}, sevWarning, "[q2 new q1]", "q0"},
+		{"drops same severity", []severity{sevCritical, sevCritical}, sevCritical, "[q1 new]", "q0"},
+		{"keeps criticals over info", []severity{sevCritical, sevCritical}, sevInfo, "[q0 q1]", "new"},
+		{"keeps warnings over info", []severity{sevWarning, sevCritical}, sevInfo, "[q1 q0]", "new"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := testQueue(len(tt.queued), nil)
+			for i, sev := range tt.queued {
+				q.push(queueAlert(fmt.Sprintf("q%d", i), sev))
+			}
+			dropped := metrics.sum("notify_dropped_total")
+			q.push(queueAlert("new", tt.push))
+			if d := metrics.sum("notify_dropped_total") - dropped; d != 1 {
+				t.Errorf("notify_dropped_total grew by %v, want 1", d)
+			}
+			if q.size != len(tt.queued) {
+				t.Errorf("size = %d, want %d", q.size, len(tt.queued))
+			}
+			if got := fmt.Sprint(queuedIDs(q)); got != tt.want {
+				t.Errorf("queue = %s, want %s (%s dropped)", got, tt.want, tt.dropped)
+			}
+		})
+	}
+}
+
+func TestQueueFullDropsRetryingBeforeHigher(t *testing.T) {
+	q := testQueue(2, nil)
+	q.push(queueAlert("crit", sevCritical))
+	q.retrying = append(q.retrying, queuedAlert{alert: queueAlert("info-retry", sevInfo), due: time.Now()})
+	q.size++
+	q.push(queueAlert("warn", sevWarning))
+
+	if len(q.retrying) != 0 {
+		t.Errorf("retrying = %d, want the info retry dropped", len(q.retrying))
+	}
+	if got := fmt.Sprint(queuedIDs(q)); got != "[crit warn]" {
+		t.Errorf("queue = %s, want [crit warn]", got)
+	}
+}
+
+// A critical alert queued behind a backlog of info alerts goes out in the
+// next send slot, even while the sink only takes one send at a time.
+func TestQueueCriticalJumpsBacklog(t *testing.T) {
+	slots := make(chan struct{})
+	sent := make(chan string, 400)
+	q := testQueue(1000, func(alerts []Alert) ([]Alert, error) {
+		<-slots
+		for _, a := range alerts {
+			sent <- a.ID
+		}
+		return nil, nil
+	})
+	go q.run(0)
+	defer close(slots)
+
+	q.push(queueAlert("info-0", sevInfo))
+	// Wait for the worker to take info-0 into the blocked send.
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		q.mu.Lock()
+		size := q.size
+		q.mu.Unlock()
+		if size == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("worker never took the first alert")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i := 1; i <= 300; i++ {
+		q.push(queueAlert(fmt.Sprintf("info-%d", i), sevInfo))
+	}
+	q.push(queueAlert("crit", sevCritical))
+
+	for _, want := range []string{"info-0", "crit", "info-1"} {
+		slots <- struct{}{}
+		select {
+		case got := <-sent:
+			if got != want {
+				t.Fatalf("sent %s, want %s", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("nothing sent, want %s", want)
+		}
+	}
+}
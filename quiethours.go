@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Quiet Hours ---
+
+// quietSinkPrefix marks the outbox records of deferred alerts: they are
+// owed to the destination's morning digest rather than to a sink.
+const quietSinkPrefix = "quiet:"
+
+// QuietHoursConfig keeps a destination quiet from Start until End, both
+// cron schedules as for maintenance.schedule, e.g. "0 22 * * *" and
+// "0 7 * * *" for the night. Alerts below Override are held and sent as
+// one digest when the quiet ends; those at or above it go out at once.
+type QuietHoursConfig struct {
+	Start    string `yaml:"start"`
+	End      string `yaml:"end"`
+	Override string `yaml:"override"` // severity, default critical
+}
+
+// window reports whether now falls in the quiet hours, and when they end:
+// inside, the next end comes before the next start.
+func (q QuietHoursConfig) window(now time.Time) (bool, time.Time) {
+	start, err := parseCron(q.Start)
+	if err != nil {
+		return false, time.Time{}
+	}
+	end, err := parseCron(q.End)
+	if err != nil {
+		return false, time.Time{}
+	}
+	until := end.next(now)
+	return until.Before(start.next(now)), until
+}
+
+// quietHours holds what quiet destinations are owed, oldest first, until
+// their digest. Each held alert is in the outbox, so a restart during
+// the quiet keeps the digest whole.
+type quietHours struct {
+	mu   sync.Mutex
+	held map[string][]Alert // by destination
+}
+
+// quiet is the process-wide holder. It is nil outside the audit daemon,
+// where nothing is held.
+var quiet *quietHours
+
+func newQuietHours() *quietHours {
+	return &quietHours{held: make(map[string][]Alert)}
+}
+
+// hold takes a, as dest would get it, if dest is in its quiet hours and a
+// is below the override.
+func (q *quietHours) hold(cfg *VaultConfig, a Alert, dest string) bool {
+	if q == nil {
+		return false
+	}
+	qc, ok := cfg.QuietHours[dest]
+	if !ok {
+		return false
+	}
+	override, _ := parseSeverity(qc.Override) // validated at load
+	if a.Severity >= override {
+		return false
+	}
+	if in, _ := qc.window(time.Now()); !in {
+		return false
+	}
+	q.restore(a, dest)
+	outbox.add(a, quietSinkPrefix+dest)
+	metrics.inc("alerts_deferred_total", "destination", dest)
+	logDebug("🌙 Holding {title} for {destination} until its quiet hours end", "title", a.Title, "destination", dest)
+	return true
+}
+
+// restore holds an alert again that a previous run deferred.
+func (q *quietHours) restore(a Alert, dest string) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.held[dest] = append(q.held[dest], a)
+}
+
+// flush sends the digest of each destination whose quiet hours are over,
+// or no longer configured.
+func (q *quietHours) flush(cfg *VaultConfig, now time.Time) {
+	q.mu.Lock()
+	var due []string
+	for dest := range q.held {
+		qc, ok := cfg.QuietHours[dest]
+		if in, _ := qc.window(now); !ok || !in {
+			due = append(due, dest)
+		}
+	}
+	sort.Strings(due)
+	ready := make(map[string][]Alert, len(due))
+	for _, dest := range due {
+		ready[dest] = q.held[dest]
+		delete(q.held, dest)
+	}
+	q.mu.Unlock()
+
+	for _, dest := range due {
+		held := ready[dest]
+		to := dest
+		if _, ok := notifiers[dest]; ok {
+			// Held for a notifier since replaced by a reload; the current
+			// one takes the digest over.
+			to = notifierFor(cfg).kind()
+		}
+		logInfo("🌅 Quiet hours over for {destination}: sending the digest of {count} held alerts", "destination", dest, "count", len(held))
+		if err := notifyTo(cfg, quietDigest(held, now), to); err != nil {
+			logWarn("⚠️  Quiet hours digest for {destination} failed: {error}", "destination", dest, "error", err)
+		}
+		for _, a := range held {
+			outbox.done(a.ID, quietSinkPrefix+dest)
+		}
+	}
+}
+
+// status lists how many alerts each destination is owed, for /statusz.
+func (q *quietHours) status() map[string]int {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out := make(map[string]int, len(q.held))
+	for dest, held := range q.held {
+		out[dest] = len(held)
+	}
+	return out
+}
+
+var (
+	msgQuietDigest     = message("quiet-hours.digest.title")
+	msgQuietDigestBody = message("quiet-hours.digest.body")
+	msgQuietDigestRule = message("quiet-hours.digest.rule")
+)
+
+// quietDigest sums up held alerts by rule, the most frequent first, at
+// the severity of the worst of them.
+func quietDigest(held []Alert, now time.Time) Alert {
+	type group struct {
+		name  string
+		count int
+		worst severity
+	}
+	byRule := make(map[string]*group)
+	var groups []*group
+	worst, since := sevInfo, now
+	for _, a := range held {
+		name := a.Rule
+		if name == "" {
+			name = a.Title
+		}
+		g := byRule[name]
+		if g == nil {
+			g = &group{name: name, worst: a.Severity}
+			byRule[name] = g
+			groups = append(groups, g)
+		}
+		g.count++
+		if a.Severity > g.worst {
+			g.worst = a.Severity
+		}
+		if a.Severity > worst {
+			worst = a.Severity
+		}
+		if a.DetectedAt.Before(since) {
+			since = a.DetectedAt
+		}
+	}
+	sort.SliceStable(groups, func(i, j int) bool { return groups[i].count > groups[j].count })
+	lines := make([]localText, 0, len(groups))
+	for _, g := range groups {
+		lines = append(lines, msgQuietDigestRule.with("rule", mdCode(g.name, maxNameLen), "count", g.count, "severity", g.worst.String()))
+	}
+	return Alert{Severity: worst, Color: worst.color(), Rule: "quiet-hours"}.say(msgQuietDigest.with("count", len(held)),
+		msgQuietDigestBody.with("since", since.Local().Format("2006-01-02 15:04"), "until", now.Local().Format("2006-01-02 15:04"),
+			"rules", lines))
+}
+
+// quietHoursJob sends the digests of destinations coming out of their
+// quiet hours.
+func quietHoursJob(cfg *VaultConfig) jobSpec {
+	return jobSpec{name: "quiet-hours", every: time.Minute, timeout: time.Minute, run: func(ctx context.Context) error {
+		quiet.flush(live(cfg), time.Now())
+		return nil
+	}}
+}
+
+func validateQuietHours(cfg *VaultConfig) error {
+	for dest, qc := range cfg.QuietHours {
+		f := "quiet_hours." + dest
+		if !knownDestination(dest) {
+			return &fieldError{f, "is not a destination; use " + destinationNames()}
+		}
+		if _, ok := notifiers[dest]; ok && dest != notifierFor(cfg).kind() {
+			return &fieldError{f, "is not the notifier, which is " + notifierFor(cfg).kind()}
+		}
+		if qc.Start == "" || qc.End == "" {
+			return &fieldError{f, "needs start and end"}
+		}
+		if _, err := parseCron(qc.Start); err != nil {
+			return &fieldError{f + ".start", err.Error()}
+		}
+		if _, err := parseCron(qc.End); err != nil {
+			return &fieldError{f + ".end", err.Error()}
+		}
+		if strings.Join(strings.Fields(qc.Start), " ") == strings.Join(strings.Fields(qc.End), " ") {
+			return &fieldError{f, "start and end are the same"}
+		}
+		if qc.Override == "" {
+			qc.Override = sevCritical.String()
+		}
+		if _, err := parseSeverity(qc.Override); err != nil {
+			return &fieldError{f + ".override", err.Error()}
+		}
+		cfg.QuietHours[dest] = qc
+	}
+	if len(cfg.QuietHours) > 0 && cfg.Queue.Outbox.Path == "" {
+		return &fieldError{"quiet_hours", "needs queue.outbox.path, so held alerts survive a restart"}
+	}
+	return nil
+}
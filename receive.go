@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// --- Audit Forwarding (hub) ---
+
+// receiveHandoff bounds how long a batch waits for the audit loop, e.g.
+// while intake is paused, before the edge is told to retry.
+const receiveHandoff = 5 * time.Second
+
+// ReceiveConfig accepts audit lines from edge wardens (see ForwardConfig)
+// and feeds them into this warden's checks, as if read from its own log.
+type ReceiveConfig struct {
+	Listen   string `yaml:"listen"` // host:port
+	Cert     string `yaml:"cert"`
+	Key      string `yaml:"key"`
+	ClientCA string `yaml:"client_ca"` // edges must present a certificate signed by it
+	// Sources maps an edge certificate's common name to the label its
+	// alerts carry. When set, other names are refused.
+	Sources map[string]string `yaml:"sources"`
+}
+
+// receivedBatch is a batch handed to the audit loop; done is closed once
+// every line has been processed.
+type receivedBatch struct {
+	source string
+	lines  [][]byte
+	done   chan struct{}
+}
+
+// peerStatus is one connected edge, shown in /statusz.
+type peerStatus struct {
+	Source    string    `json:"source"`
+	Remote    string    `json:"remote"`
+	Connected time.Time `json:"connected"`
+	LastBatch time.Time `json:"last_batch,omitempty"`
+	Lines     int       `json:"lines"`
+}
+
+type auditReceiver struct {
+	cfg     ReceiveConfig
+	ln      net.Listener
+	batches chan *receivedBatch
+
+	mu    sync.Mutex
+	peers map[net.Conn]*peerStatus
+	quit  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func startReceiver(cfg *VaultConfig) (*auditReceiver, error) {
+	rc := cfg.Receive
+	if rc.Listen == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(rc.Cert, rc.Key)
+	if err != nil {
+		return nil, fmt.Errorf("load receive certificate: %w", err)
+	}
+	pem, err := os.ReadFile(rc.ClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("read receive.client_ca: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("receive.client_ca %s: no PEM certificates", rc.ClientCA)
+	}
+	ln, err := tls.Listen("tcp", rc.Listen, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	})
+	if err != nil {
+		return nil, err
+	}
+	r := &auditReceiver{cfg: rc, ln: ln, batches: make(chan *receivedBatch),
+		peers: make(map[net.Conn]*peerStatus), quit: make(chan struct{})}
+	logInfo("📥 Receiving forwarded audit lines on {address}", "address", ln.Addr())
+	return r, nil
+}
+
+// run is the receiver's component. It accepts edges until ctx is done or
+// the listener fails, then closes every connection.
+func (r *auditReceiver) run(ctx context.Context) error {
+	accepted := make(chan error, 1)
+	go func() { accepted <- r.accept() }()
+	var err error
+	select {
+	case err = <-accepted:
+		err = fmt.Errorf("accept: %w", err)
+	case <-ctx.Done():
+	}
+	r.close()
+	return err
+}
+
+func (r *auditReceiver) accept() error {
+	for {
+		conn, err := r.ln.Accept()
+		if err != nil {
+			return err
+		}
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			r.serve(conn.(*tls.Conn))
+		}()
+	}
+}
+
+// authenticate completes the handshake and returns the edge's label.
+func (r *auditReceiver) authenticate(conn *tls.Conn) (string, error) {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := conn.Handshake(); err != nil {
+		return "", err
+	}
+	conn.SetDeadline(time.Time{})
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", fmt.Errorf("no client certificate")
+	}
+	cn := certs[0].Subject.CommonName
+	if len(r.cfg.Sources) == 0 {
+		return cn, nil
+	}
+	label, ok := r.cfg.Sources[cn]
+	if !ok {
+		return "", fmt.Errorf("certificate %q is not in receive.sources", cn)
+	}
+	if label == "" {
+		label = cn
+	}
+	return label, nil
+}
+
+func (r *auditReceiver) serve(conn *tls.Conn) {
+	defer conn.Close()
+	source, err := r.authenticate(conn)
+	if err != nil {
+		metrics.inc("receive_rejected_total")
+		logWarn("⛔ Refused edge {remote}: {error}", "remote", conn.RemoteAddr(), "error", err)
+		return
+	}
+	peer := &peerStatus{Source: source, Remote: conn.RemoteAddr().String(), Connected: time.Now()}
+	r.mu.Lock()
+	r.peers[conn] = peer
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.peers, conn)
+		r.mu.Unlock()
+	}()
+	logInfo("🔗 Edge {edge} connected from {remote}", "edge", source, "remote", peer.Remote)
+
+	for {
+		msg, err := readFrame(conn)
+		if err != nil {
+			logInfo("🔌 Edge {edge} disconnected: {error}", "edge", source, "error", err)
+			return
+		}
+		batch, err := unmarshalBatch(msg)
+		if err != nil {
+			writeFrame(conn, (&forwardAck{err: "bad batch: " + err.Error()}).marshal())
+			return
+		}
+		ack := &forwardAck{seq: batch.seq}
+		rb := &receivedBatch{source: source, lines: batch.lines, done: make(chan struct{})}
+		select {
+		case r.batches <- rb:
+			select {
+			case <-rb.done:
+			case <-r.quit:
+				return // not acked; the edge resends it
+			}
+			metrics.add("receive_lines_total", float64(len(batch.lines)), "source", source)
+			r.mu.Lock()
+			peer.LastBatch = time.Now()
+			peer.Lines += len(batch.lines)
+			r.mu.Unlock()
+		case <-time.After(receiveHandoff):
+			ack.err = "hub busy"
+		case <-r.quit:
+			return
+		}
+		if err := writeFrame(conn, ack.marshal()); err != nil {
+			return
+		}
+	}
+}
+
+// status lists connected edges for /statusz.
+func (r *auditReceiver) status() []peerStatus {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]peerStatus, 0, len(r.peers))
+	for _, p := range r.peers {
+		out = append(out, *p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Source < out[j].Source })
+	return out
+}
+
+// incoming is the channel of batches for the audit loop; nil (never
+// ready) without a receiver.
+func (r *auditReceiver) incoming() chan *receivedBatch {
+	if r == nil {
+		return nil
+	}
+	return r.batches
+}
+
+func (r *auditReceiver) close() {
+	close(r.quit)
+	r.ln.Close()
+	r.mu.Lock()
+	for conn := range r.peers {
+		conn.Close()
+	}
+	r.mu.Unlock()
+	r.wg.Wait()
+}
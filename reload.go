@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"gopkg.in/yaml.v3"
+
+	"vault-warden/client"
+)
+
+// --- Config Reload ---
+
+// The top-level settings a reload applies. The rest are read once at
+// start, and a change to them waits for the next restart.
+var (
+	deliverySections = []string{"notifier", "webhook_url", "webhook", "email", "quiet_hours"}
+	auditSections    = append([]string{"rules", "audit_log"}, deliverySections...)
+)
+
+// liveConfig is the config last reloaded; nil until a reload succeeds.
+var liveConfig atomic.Value // *VaultConfig
+
+// live returns cfg with the settings a reload changes taken from the
+// config last reloaded. Whatever reads those settings while running goes
+// through it.
+func live(cfg *VaultConfig) *VaultConfig {
+	next, _ := liveConfig.Load().(*VaultConfig)
+	if next == nil {
+		return cfg
+	}
+	c := *cfg
+	c.Notifier, c.WebhookURL, c.Webhook, c.Email = next.Notifier, next.WebhookURL, next.Webhook, next.Email
+	c.QuietHours = next.QuietHours
+	c.Rules, c.AuditLogs, c.AuditLog = next.Rules, next.AuditLogs, next.AuditLog
+	return &c
+}
+
+// configReloader re-reads the config on SIGHUP. A config that fails to
+// load or validate is reported and the running one kept.
+type configReloader struct {
+	cfg     *VaultConfig // as started
+	started *configDoc
+	applies []string
+	// apply puts what else the sections change in place, before the
+	// config goes live; on an error nothing is.
+	apply func(next *VaultConfig) error
+	// canary, when set, compares the reloaded rules with the running
+	// ones first; see ReloadCanaryConfig.
+	canary   func(running, next *VaultConfig) *client.CanaryResult
+	hup      chan os.Signal
+	requests chan reloadRequest
+
+	doc    *configDoc // as last applied
+	failed bool
+}
+
+// newConfigReloader takes over SIGHUP, which would otherwise end the
+// process.
+func newConfigReloader(doc *configDoc, cfg *VaultConfig, applies []string, apply func(*VaultConfig) error) *configReloader {
+	r := &configReloader{cfg: cfg, started: doc, doc: doc, applies: applies, apply: apply, hup: make(chan os.Signal, 1),
+		requests: make(chan reloadRequest)}
+	signal.Notify(r.hup, syscall.SIGHUP)
+	return r
+}
+
+func (r *configReloader) stop() { signal.Stop(r.hup) }
+
+// reloadRequest is a reload asked for through the admin API.
+type reloadRequest struct {
+	force bool
+	done  chan reloadOutcome // buffered
+}
+
+type reloadOutcome struct {
+	res *client.ReloadResult
+	err error
+}
+
+// run reloads once per SIGHUP or admin request until ctx is done, one at
+// a time.
+func (r *configReloader) run(ctx context.Context) error {
+	for {
+		select {
+		case <-r.hup:
+			r.reload("SIGHUP", false)
+		case req := <-r.requests:
+			res, err := r.reload("Admin API", req.force)
+			req.done <- reloadOutcome{res, err}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// request reloads as SIGHUP does and says what came of it.
+func (r *configReloader) request(ctx context.Context, force bool) (*client.ReloadResult, error) {
+	req := reloadRequest{force: force, done: make(chan reloadOutcome, 1)}
+	select {
+	case r.requests <- req:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case out := <-req.done:
+		return out.res, out.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// reloadHandler serves POST /reload; ?force=1 applies rules the config
+// canary holds back.
+func reloadHandler(r *configReloader) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		res, err := r.request(req.Context(), req.URL.Query().Get("force") != "")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		writeJSON(w, res)
+	}
+}
+
+func reloadComponent(r *configReloader) componentSpec {
+	return componentSpec{name: "config-reload", policy: policyRestart, run: r.run}
+}
+
+var (
+	msgReloadFailed     = message("config-reload.failed.title")
+	msgReloadFailedBody = message("config-reload.failed.body")
+	msgReloaded         = message("config-reload.ok.title")
+	msgReloadedBody     = message("config-reload.ok.body")
+)
+
+// reload re-reads the config and applies it, unless the canary holds
+// the new rules back and force isn't set. Nothing is applied then, and
+// the result says why.
+func (r *configReloader) reload(trigger string, force bool) (*client.ReloadResult, error) {
+	logInfo("🔁 {trigger}: reloading the config", "trigger", trigger)
+	res := &client.ReloadResult{}
+	doc, err := loadConfig(r.started.path, r.started.dir)
+	var next *VaultConfig
+	if err == nil {
+		next, err = doc.config()
+	}
+	running := live(r.cfg)
+	if err == nil && r.canary != nil && !reflect.DeepEqual(running.Rules, next.Rules) {
+		c := r.canary(running, next)
+		res.Canary = c
+		switch {
+		case c.Passed:
+			logInfo("🐤 Config canary passed: {old} alerts with the running rules, {new} with the new ones, over {entries} entries of the last {window}",
+				"old", c.OldAlerts, "new", c.NewAlerts, "entries", c.Entries, "window", c.Window)
+		case force:
+			c.Forced = true
+			logWarn("⚠️  Config canary failed, applying anyway (-force): {reason}", "reason", c.Reason)
+		default:
+			metrics.inc("config_reloads_total", "result", "held")
+			logWarn("🐤 Config canary failed, still running the previous config: {reason}. `reload -force` applies it anyway.", "reason", c.Reason)
+			r.failed = true
+			notify(r.cfg, canaryHeldAlert(c))
+			return res, nil
+		}
+	}
+	if err == nil && r.apply != nil {
+		err = r.apply(next)
+	}
+	if err != nil {
+		metrics.inc("config_reloads_total", "result", "error")
+		logError("❌ Config reload failed, still running the previous config: {error}", "error", err)
+		r.failed = true
+		notify(r.cfg, Alert{Severity: sevWarning, Color: sevWarning.color(), Rule: "config-reload",
+			Incident: "config-reload"}.say(msgReloadFailed.with(), msgReloadFailedBody.with("error", mdCode(err.Error(), maxErrorLen))))
+		return nil, fmt.Errorf("config reload failed: %w", err)
+	}
+	liveConfig.Store(next)
+	changed := changedSections(r.doc, doc)
+	r.doc = doc
+	res.Applied, res.Changed = true, changed
+	metrics.inc("config_reloads_total", "result", "ok")
+	if len(changed) == 0 {
+		logInfo("🔁 Config reloaded; nothing changed")
+	} else {
+		logInfo("🔁 Config reloaded; changed: {sections}", "sections", strings.Join(changed, ", "))
+	}
+	var pending []string
+	for _, s := range changedSections(r.started, doc) {
+		if !containsString(r.applies, s) {
+			pending = append(pending, s)
+		}
+	}
+	if len(pending) > 0 {
+		logWarn("⚠️  Config reload: {sections} changed since start and apply at the next restart", "sections", strings.Join(pending, ", "))
+	}
+	if r.failed {
+		r.failed = false
+		notify(r.cfg, Alert{Severity: sevInfo, Color: sevInfo.color(), Rule: "config-reload",
+			Incident: "config-reload", Resolved: true}.say(msgReloaded.with(), msgReloadedBody.with()))
+	}
+	return res, nil
+}
+
+// runReloadCommand implements `reload`: the running warden re-reads its
+// config, as on SIGHUP, and says what came of it.
+func runReloadCommand(cfg *VaultConfig, args []string) error {
+	fs := flagSet("reload")
+	force := fs.Bool("force", false, "Apply the new rules even when the config canary holds them back")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	res, err := adminClient(cfg).Reload(context.Background(), *force)
+	if err != nil {
+		return err
+	}
+	if c := res.Canary; c != nil {
+		logInfo("🐤 Canary: {old} alerts with the running rules, {new} with the new ones, over {entries} entries of the last {window}",
+			"old", c.OldAlerts, "new", c.NewAlerts, "entries", c.Entries, "window", c.Window)
+		for _, ru := range c.Rules {
+			logInfo("   {rule}: {old} → {new}", "rule", ru.Name, "old", ru.Old, "new", ru.New)
+		}
+		for _, k := range c.NewCritical {
+			logInfo("   new critical: {alert}", "alert", k)
+		}
+		if !res.Applied {
+			return fmt.Errorf("config canary failed, the warden keeps the running config: %s; run `reload -force` to apply it anyway", c.Reason)
+		}
+	}
+	if len(res.Changed) == 0 {
+		logInfo("✓ Config reloaded; nothing changed")
+	} else {
+		logInfo("✓ Config reloaded; changed: {sections}", "sections", strings.Join(res.Changed, ", "))
+	}
+	return nil
+}
+
+// changedSections lists the top-level settings that differ between two
+// docs, sorted.
+func changedSections(a, b *configDoc) []string {
+	va, vb := topLevelValues(a.root), topLevelValues(b.root)
+	var out []string
+	for k, v := range va {
+		if w, ok := vb[k]; !ok || !reflect.DeepEqual(v, w) {
+			out = append(out, k)
+		}
+	}
+	for k := range vb {
+		if _, ok := va[k]; !ok {
+			out = append(out, k)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// topLevelValues decodes each top-level value of a doc, so formatting and
+// comments don't count as changes.
+func topLevelValues(root *yaml.Node) map[string]interface{} {
+	out := make(map[string]interface{}, len(root.Content)/2)
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		var v interface{}
+		root.Content[i+1].Decode(&v)
+		out[root.Content[i].Value] = v
+	}
+	return out
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// --- Remediation Suggestions ---
+
+// remediationStep is one suggested command. {name} placeholders are
+// filled from the alert; a step missing any of them is left out.
+type remediationStep struct {
+	contain bool // investigation steps come first
+	note    msgID
+	cmd     string
+}
+
+// remediations are the next steps suggested for built-in detectors'
+// alerts, for on-call engineers who don't live in Vault.
+var remediations = map[string][]remediationStep{
+	"external-unseal": {
+		{note: message("remediation.external-unseal.status"), cmd: "vault status -address={address}"},
+		{note: message("remediation.external-unseal.grep"), cmd: "grep -F '\"remote_address\":\"{source_ip}\"' {audit_log}"},
+		{contain: true, note: message("remediation.external-unseal.seal"), cmd: "vault operator seal -address={address}"},
+	},
+	"audit-log-missing": {
+		{note: message("remediation.audit-log-missing.list"), cmd: "vault audit list -detailed -address={address}"},
+		{contain: true, note: message("remediation.audit-log-missing.enable"), cmd: "vault audit enable -address={address} file file_path={audit_log}"},
+	},
+	"token-policy-escalation": {
+		{note: message("remediation.token-policy-escalation.lookup"), cmd: "vault token lookup -accessor {accessor}"},
+		{contain: true, note: message("remediation.token-policy-escalation.revoke"), cmd: "vault token revoke -accessor {accessor}"},
+	},
+	"pki-role-broadened": {
+		{note: message("remediation.pki-role-broadened.read"), cmd: "vault read {path}"},
+		{note: message("remediation.pki-role-broadened.certs"), cmd: "vault list {pki_mount}/certs"},
+	},
+}
+
+// remediationSafe is what may be put in a suggested command unquoted.
+// Anything else, which an audit entry can contain, leaves the step out
+// rather than risk a command that does something else when pasted.
+var remediationSafe = regexp.MustCompile(`^[A-Za-z0-9._/:@=+-]+$`)
+
+// includeRemediation reports whether include_remediation is on (the
+// default).
+func (c *VaultConfig) includeRemediation() bool {
+	return c.IncludeRemediation == nil || *c.IncludeRemediation
+}
+
+// remediationValues are the placeholders an alert can fill in.
+func remediationValues(cfg *VaultConfig, a Alert) map[string]string {
+	v := map[string]string{
+		"address":   cfg.Address,
+		"audit_log": cfg.AuditLog,
+		"source_ip": a.SourceIP,
+		"path":      a.Path,
+	}
+	// Accessors are HMACed in the audit log unless the mount says otherwise.
+	if !strings.HasPrefix(a.Accessor, "hmac-") {
+		v["accessor"] = a.Accessor
+	}
+	if i := strings.Index(a.Path, "/roles/"); i > 0 {
+		v["pki_mount"] = a.Path[:i]
+	}
+	return v
+}
+
+var remediationPlaceholder = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+var (
+	msgRemediation = message("remediation.heading")
+	msgInvestigate = message("remediation.investigate")
+	msgContain     = message("remediation.contain")
+)
+
+// remediationBlock renders the suggested steps for a in c's locale, or ""
+// when its rule has none or the alert lacks what they need.
+func remediationBlock(cfg *VaultConfig, a Alert, c *catalog) string {
+	steps := remediations[a.Rule]
+	if len(steps) == 0 || a.Resolved {
+		return ""
+	}
+	values := remediationValues(cfg, a)
+	var lines []string
+	for _, contain := range []bool{false, true} {
+		for _, st := range steps {
+			if st.contain != contain {
+				continue
+			}
+			ok := true
+			cmd := remediationPlaceholder.ReplaceAllStringFunc(st.cmd, func(p string) string {
+				val := values[p[1:len(p)-1]]
+				if !remediationSafe.MatchString(val) {
+					ok = false
+				}
+				return val
+			})
+			if !ok {
+				continue
+			}
+			kind := msgInvestigate
+			if contain {
+				kind = msgContain
+			}
+			lines = append(lines, "# "+c.text(kind)+": "+c.text(st.note), cmd)
+		}
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return "\n\n**" + c.text(msgRemediation) + "**\n```\n" + strings.Join(lines, "\n") + "\n```"
+}
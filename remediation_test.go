@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func remediationConfig() *VaultConfig {
+	return &VaultConfig{Address: "https://vault.example.com:8200", AuditLog: "/var/log/vault/audit.log"}
+}
+
+// remediationLines is the commands and notes of a block, without its
+// heading and fence.
+func remediationLines(block string) string {
+	block = strings.TrimSuffix(block, "\n```")
+	if i := strings.Index(block, "```\n"); i >= 0 {
+		block = block[i+4:]
+	}
+	return block
+}
+
+// Each detector's steps, filled in from the alert, investigation first.
+func TestRemediationDetectors(t *testing.T) {
+	tests := []struct {
+		alert Alert
+		want  string
+	}{
+		{Alert{Rule: "external-unseal", SourceIP: "10.9.8.7"}, `# Investigate: check the node's seal state and key shares
+vault status -address=https://vault.example.com:8200
+# Investigate: see everything the unsealing host sent
+grep -F '"remote_address":"10.9.8.7"' /var/log/vault/audit.log
+# Contain: if nobody authorised the unseal; this stops every client
+vault operator seal -address=https://vault.example.com:8200`},
+		{Alert{Rule: "audit-log-missing"}, `# Investigate: list the audit devices and where they write
+vault audit list -detailed -address=https://vault.example.com:8200
+# Contain: if no device writes the file any more
+vault audit enable -address=https://vault.example.com:8200 file file_path=/var/log/vault/audit.log`},
+		{Alert{Rule: "token-policy-escalation", Accessor: "Xk2p9RgcS8lOAUYqJmM4vT1e"}, `# Investigate: see the creating token's policies and owner
+vault token lookup -accessor Xk2p9RgcS8lOAUYqJmM4vT1e
+# Contain: revokes the creating token and the non-orphan tokens it made
+vault token revoke -accessor Xk2p9RgcS8lOAUYqJmM4vT1e`},
+		{Alert{Rule: "pki-role-broadened", Path: "pki-int/roles/web"}, `# Investigate: review the role as it is now
+vault read pki-int/roles/web
+# Investigate: list the certificates issued by the mount
+vault list pki-int/certs`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.alert.Rule, func(t *testing.T) {
+			block := remediationBlock(remediationConfig(), tt.alert, english)
+			if !strings.HasPrefix(block, "\n\n**"+english.text(msgRemediation)+"**\n```\n") {
+				t.Errorf("block = %q, want the heading and a fence", block)
+			}
+			if got := remediationLines(block); got != tt.want {
+				t.Errorf("steps:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+	for rule := range remediations {
+		found := false
+		for _, tt := range tests {
+			found = found || tt.alert.Rule == rule
+		}
+		if !found {
+			t.Errorf("no test for %s's remediation", rule)
+		}
+	}
+}
+
+// A step is left out when the alert lacks a value it needs or the value
+// isn't safe to paste; with none left, so is the block.
+func TestRemediationRefused(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   func(*VaultConfig)
+		alert Alert
+		want  string // the commands kept, one per line
+	}{
+		{"hmaced accessor", nil, Alert{Rule: "token-policy-escalation", Accessor: "hmac-sha256:acc"}, ""},
+		{"no accessor", nil, Alert{Rule: "token-policy-escalation"}, ""},
+		{"crafted accessor", nil, Alert{Rule: "token-policy-escalation", Accessor: "x; vault token create -policy=root"}, ""},
+		{"crafted source address", nil, Alert{Rule: "external-unseal", SourceIP: "10.0.0.1' /etc/shadow; echo '"},
+			"vault status -address=https://vault.example.com:8200\nvault operator seal -address=https://vault.example.com:8200"},
+		{"no address", func(c *VaultConfig) { c.Address = "" }, Alert{Rule: "external-unseal", SourceIP: "10.9.8.7"},
+			`grep -F '"remote_address":"10.9.8.7"' /var/log/vault/audit.log`},
+		{"audit log with spaces", func(c *VaultConfig) { c.AuditLog = "/var/log/vault audit.log" }, Alert{Rule: "audit-log-missing"},
+			"vault audit list -detailed -address=https://vault.example.com:8200"},
+		{"crafted path", nil, Alert{Rule: "pki-role-broadened", Path: "pki/roles/$(id)"}, "vault list pki/certs"},
+		{"role outside a mount", nil, Alert{Rule: "pki-role-broadened", Path: "roles/web"}, "vault read roles/web"},
+		{"resolved", nil, Alert{Rule: "audit-log-missing", Resolved: true}, ""},
+		{"rule without steps", nil, Alert{Rule: "privileged-access", Path: "sys/policies/acl/root"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := remediationConfig()
+			if tt.cfg != nil {
+				tt.cfg(cfg)
+			}
+			block := remediationBlock(cfg, tt.alert, english)
+			if tt.want == "" {
+				if block != "" {
+					t.Errorf("block = %q, want none", block)
+				}
+				return
+			}
+			var cmds []string
+			for _, l := range strings.Split(remediationLines(block), "\n") {
+				if !strings.HasPrefix(l, "# ") {
+					cmds = append(cmds, l)
+				}
+			}
+			if got := strings.Join(cmds, "\n"); got != tt.want {
+				t.Errorf("commands:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+// The steps reach the alert from the detectors themselves, as audit
+// -print-only writes them, and include_remediation: false leaves them out.
+func TestRemediationFromDetectors(t *testing.T) {
+	for _, include := range []bool{true, false} {
+		cfg := remediationConfig()
+		cfg.IncludeRemediation = &include
+		sent := captureAlerts(t)
+		w := newPKIWatcher(PKIConfig{Enabled: true, Mounts: []string{"pki/"}, MaxTTL: Duration(defaultPKIMaxTTL)})
+		for _, a := range replayFixture(t, "pki/role-wildcard.jsonl", w.observe) {
+			notify(cfg, a)
+		}
+		for _, a := range replayFixture(t, "tokens/policy-escalation.jsonl", testTokenWatcher(nil).observe) {
+			notify(cfg, a)
+		}
+		alerts := sent()
+		if got := alertRules(alerts); got != "pki-role-broadened token-policy-escalation" {
+			t.Fatalf("alerts = [%s]", got)
+		}
+		pki := alerts[0].Description
+		if has := strings.Contains(pki, "vault read pki/roles/web\n") && strings.Contains(pki, "vault list pki/certs\n"); has != include {
+			t.Errorf("include_remediation %v: pki description = %q", include, pki)
+		}
+		// The fixture's accessor is HMACed: nothing to revoke by.
+		if strings.Contains(alerts[1].Description, english.text(msgRemediation)) {
+			t.Errorf("token description = %q, want no steps", alerts[1].Description)
+		}
+	}
+}
+
+func TestRemediationLocalized(t *testing.T) {
+	ja := builtinCatalogs["ja"]
+	block := remediationBlock(remediationConfig(), Alert{Rule: "audit-log-missing"}, ja)
+	if !strings.Contains(block, "**"+ja.text(msgRemediation)+"**") || !strings.Contains(block, "# "+ja.text(msgContain)+": ") {
+		t.Errorf("ja block = %q", block)
+	}
+	if !strings.Contains(block, "vault audit enable -address=https://vault.example.com:8200 file file_path=/var/log/vault/audit.log") {
+		t.Errorf("ja block = %q, want the commands unchanged", block)
+	}
+}
+
+// The missing audit log alert carries its steps whatever sys/audit
+// answered, a failed call included.
+func TestRemediationAuditLogMissing(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		device string
+	}{
+		{"disabled", http.StatusOK, `{"data":{}}`, "the audit device was disabled"},
+		{"relocated", http.StatusOK, `{"data":{"file/":{"type":"file","options":{"file_path":"/srv/audit.log"}}}}`, "file devices now write to /srv/audit.log"},
+		{"permission denied", http.StatusForbidden, `{"errors":["permission denied"]}`, "sys/audit returned 403"},
+		{"vault failing", http.StatusInternalServerError, `{"errors":["internal error"]}`, "sys/audit returned 500"},
+		{"vault down", 0, "", "sys/audit unreachable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v1/sys/audit" || r.Header.Get("X-Vault-Token") != "s.audit-reader" {
+					t.Errorf("%s %s with token %q", r.Method, r.URL.Path, r.Header.Get("X-Vault-Token"))
+				}
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			}))
+			defer srv.Close()
+			if tt.status == 0 {
+				srv.Close()
+			}
+			logPath := filepath.Join(t.TempDir(), "audit.log")
+			cfg, err := loadTestConfig(t, fmt.Sprintf(`address: %q
+webhook_url: "https://discord.com/api/webhooks/1/x"
+unseal_keys: ["k1"]
+audit_log: %q
+missing_log:
+  token: s.audit-reader
+  warn_after: 1s
+  alert_after: 1m
+`, srv.URL, logPath))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sent := captureAlerts(t)
+			m := newAuditFileMonitor(cfg)
+			now := time.Now()
+			captureStdout(t, func() {
+				m.check(context.Background(), now)
+				m.check(context.Background(), now.Add(2*time.Minute))
+			})
+			alerts := sent()
+			if len(alerts) != 1 || alerts[0].Rule != "audit-log-missing" {
+				t.Fatalf("alerts = [%s], want the missing log's", alertRules(alerts))
+			}
+			d := strings.ReplaceAll(alerts[0].Description, `\`, "")
+			if !strings.Contains(d, tt.device) {
+				t.Errorf("description = %q, want %q", d, tt.device)
+			}
+			if !strings.Contains(d, "vault audit enable -address="+srv.URL+" file file_path="+logPath+"\n") {
+				t.Errorf("description = %q, want the steps to re-enable the device", d)
+			}
+		})
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/nxadm/tail"
+	"gopkg.in/yaml.v3"
+)
+
+// --- Audit Replay ---
+
+const (
+	// replaySeekBlock is where the binary search over the file stops and
+	// reading goes line by line.
+	replaySeekBlock = 64 * 1024
+	// replaySampleLines is how many lines a probe reads looking for one
+	// with a timestamp.
+	replaySampleLines = 16
+)
+
+// replayRuleFields are the config sections a -rules-file may set. Each
+// one it sets replaces the config's section as a whole.
+var replayRuleFields = []string{"aggregation", "first_access", "pki", "tokens", "sensitivity"}
+
+// alertStream, when set by audit -print-only, receives every alert in
+// place of the notifiers.
+var alertStream *json.Encoder
+
+// replayOptions are audit's flags for re-running the rules over part of
+// the log, separate from the daemon.
+type replayOptions struct {
+	from, until time.Time
+	once        bool   // stop at the end of the file instead of following it
+	rulesFile   string // replaces the rule sections of the config
+	printOnly   bool   // alerts go to stdout as JSON, not to the notifiers
+	stdin       bool   // read entries from stdin instead of audit_log
+	// start is where the daemon starts reading, for -from end, saved or
+	// start; it is no replay.
+	start string
+	// forceActive starts the daemon for real where it would start in
+	// safe mode.
+	forceActive bool
+}
+
+// parseAuditFlags parses audit's flags. replay reports whether any of
+// them asks for a replay rather than the daemon.
+func parseAuditFlags(args []string, now time.Time) (opts replayOptions, replay bool, err error) {
+	fs := flagSet("audit")
+	from := fs.String("from", "", "Start at the first entry at or after this time (RFC3339, or relative like -30m), or, for the daemon, at the end, saved position or start")
+	until := fs.String("until", "", "Stop at the first entry after this time (RFC3339, or relative like -5m)")
+	fs.BoolVar(&opts.once, "once", false, "Stop at the end of the file instead of following it")
+	fs.StringVar(&opts.rulesFile, "rules-file", "", "YAML file whose rule sections replace the config's")
+	fs.BoolVar(&opts.printOnly, "print-only", false, "Print alerts to stdout as JSON instead of notifying")
+	fs.BoolVar(&opts.stdin, "stdin", false, "Read audit entries from stdin until EOF instead of audit_log")
+	fs.BoolVar(&opts.forceActive, "force-active", false, "Alert for real even on a host or state file that calls for safe mode")
+	if err := fs.Parse(args); err != nil {
+		return opts, false, err
+	}
+	if fs.NArg() > 0 {
+		return opts, false, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	switch *from {
+	case "":
+	case startEnd, startSaved, startFile:
+		opts.start = *from
+	default:
+		if opts.from, err = parseReplayTime("from", *from, now); err != nil {
+			return opts, false, err
+		}
+	}
+	if *until != "" {
+		if opts.until, err = parseReplayTime("until", *until, now); err != nil {
+			return opts, false, err
+		}
+	}
+	if opts.stdin && opts.once {
+		return opts, false, fmt.Errorf("-once has no effect with -stdin, which stops at EOF")
+	}
+	if !opts.from.IsZero() && !opts.until.IsZero() && !opts.until.After(opts.from) {
+		return opts, false, fmt.Errorf("-until %s is not after -from %s",
+			opts.until.Format(time.RFC3339), opts.from.Format(time.RFC3339))
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "force-active":
+		case "from":
+			replay = replay || opts.start == ""
+		default:
+			replay = true
+		}
+	})
+	if replay && opts.start != "" {
+		return opts, false, fmt.Errorf("-from %s is where the daemon starts reading; replays take a time", opts.start)
+	}
+	if replay && opts.forceActive {
+		return opts, false, fmt.Errorf("-force-active is for the daemon; replays don't start in safe mode")
+	}
+	return opts, replay, nil
+}
+
+// parseReplayTime accepts an RFC3339 time, or a negative duration counted
+// back from now, e.g. -30m or -1d.
+func parseReplayTime(name, s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	if strings.HasPrefix(s, "-") {
+		if d, err := parseDuration(s[1:]); err == nil {
+			return now.Add(-d), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("-%s %q is neither an RFC3339 time nor a relative duration such as -30m", name, s)
+}
+
+// withRules returns the document with the rule sections set in path
+// replacing its own.
+func (d *configDoc) withRules(path string) (*configDoc, error) {
+	rules, err := parseConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &configDoc{root: &yaml.Node{Kind: yaml.MappingNode}, sources: make(map[string]string, len(d.sources))}
+	c.root.Content = append([]*yaml.Node(nil), d.root.Content...)
+	for k, v := range d.sources {
+		c.sources[k] = v
+	}
+	for i := 0; i+1 < len(rules.Content); i += 2 {
+		key := rules.Content[i].Value
+		if !containsString(replayRuleFields, key) {
+			return nil, fmt.Errorf("rules file %s: %s is not a rule section; only %s may be set",
+				path, key, strings.Join(replayRuleFields, ", "))
+		}
+		if idx := mappingIndex(c.root, key); idx >= 0 {
+			c.root.Content = append(c.root.Content[:idx:idx], c.root.Content[idx+2:]...)
+			forgetSources(c.sources, key)
+		}
+	}
+	mergeNode(c.root, rules, path, "", c.sources)
+	return c, nil
+}
+
+// auditLineTime reads just the timestamp of an audit line.
+func auditLineTime(line []byte) (time.Time, bool) {
+	var e struct {
+		Time string `json:"time"`
+	}
+	if json.Unmarshal(line, &e) != nil {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, e.Time)
+	return t, err == nil
+}
+
+// nextLine returns the offset of the first line starting after off, or
+// the file's end.
+func nextLine(f *os.File, off int64) (int64, error) {
+	r := bufio.NewReader(io.NewSectionReader(f, off, 1<<62))
+	for n := int64(1); ; n++ {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			return off + n - 1, nil
+		} else if err != nil {
+			return 0, err
+		}
+		if b == '\n' {
+			return off + n, nil
+		}
+	}
+}
+
+// sampleTime returns the time of the first timestamped line starting
+// after off.
+func sampleTime(f *os.File, off int64) (time.Time, bool, error) {
+	start, err := nextLine(f, off)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	r := bufio.NewReader(io.NewSectionReader(f, start, 1<<62))
+	for i := 0; i < replaySampleLines; i++ {
+		line, err := r.ReadBytes('\n')
+		if t, ok := auditLineTime(line); ok {
+			return t, true, nil
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return time.Time{}, false, err
+		}
+	}
+	return time.Time{}, false, nil
+}
+
+// seekAuditTime finds where to start reading for entries at or after
+// from without reading the whole file: it bisects on sampled timestamps,
+// then leaves the last block to be skipped line by line. Vault writes
+// entries in roughly time order, which is all this relies on.
+func seekAuditTime(f *os.File, size int64, from time.Time) (int64, error) {
+	lo, hi := int64(0), size
+	for hi-lo > replaySeekBlock {
+		mid := lo + (hi-lo)/2
+		t, ok, err := sampleTime(f, mid)
+		if err != nil {
+			return 0, err
+		}
+		if ok && t.Before(from) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	if lo == 0 {
+		return 0, nil
+	}
+	return nextLine(f, lo)
+}
+
+// runReplay runs the rules over the entries between opts.from and
+// opts.until. Nothing is saved and the admin socket isn't opened, so it
+// can run next to the daemon on the same config.
+func runReplay(doc *configDoc, cfg *VaultConfig, opts replayOptions) error {
+	cfg, err := opts.config(doc, cfg)
+	if err != nil {
+		return err
+	}
+	// The integrity checks watch the log as it is written; replayed
+	// entries would only look late.
+	cfg.Integrity.Enabled = false
+
+	f, err := os.Open(cfg.AuditLog)
+	if err != nil {
+		return fmt.Errorf("audit log not accessible: %w", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("audit log not accessible: %w", err)
+	}
+	var start int64
+	if !opts.from.IsZero() {
+		if start, err = seekAuditTime(f, fi.Size(), opts.from); err != nil {
+			return fmt.Errorf("seek audit log: %w", err)
+		}
+	}
+
+	if opts.printOnly {
+		defer printAlerts()()
+	} else {
+		defer openSinks(cfg)()
+		queue = startNotifyQueue(cfg, func(alerts []Alert) ([]Alert, error) {
+			return sendAlerts(cfg, alerts)
+		})
+		defer func() {
+			queue.close(time.Duration(cfg.Queue.DrainTimeout))
+			queue = nil
+		}()
+	}
+	logInfo("⏪ Replaying {path} from offset {offset} of {size}{window}", "path", cfg.AuditLog, "offset", start, "size", fi.Size(), "window", describeReplay(opts))
+
+	a := newAuditor(cfg)
+	var st replayStats
+	if opts.once {
+		err = readAuditLines(io.NewSectionReader(f, start, 1<<62), func(line []byte) bool { return st.line(a, opts, line) })
+	} else {
+		err = replayFollow(cfg.AuditLog, start, opts, a, &st)
+	}
+	logInfo("⏪ Replayed {entries} entries{span} ({skipped} skipped before -from)", "entries", st.entries, "span", st.span(), "skipped", st.skipped)
+	return err
+}
+
+// config is the config with the rule sections of -rules-file, if set.
+func (opts replayOptions) config(doc *configDoc, cfg *VaultConfig) (*VaultConfig, error) {
+	if opts.rulesFile == "" {
+		return cfg, nil
+	}
+	rdoc, err := doc.withRules(opts.rulesFile)
+	if err != nil {
+		return nil, err
+	}
+	if cfg, err = rdoc.config(); err != nil {
+		return nil, fmt.Errorf("rules file: %w", err)
+	}
+	return cfg, nil
+}
+
+// printAlerts sends alerts to stdout as JSON in place of the notifiers,
+// until the returned func restores them.
+func printAlerts() func() {
+	// The alerts are the output; console messages move to stderr.
+	alertStream = json.NewEncoder(os.Stdout)
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+	return func() {
+		os.Stdout = stdout
+		alertStream = nil
+	}
+}
+
+func describeReplay(opts replayOptions) string {
+	var s string
+	if !opts.from.IsZero() {
+		s += ", from " + opts.from.UTC().Format(time.RFC3339)
+	}
+	if !opts.until.IsZero() {
+		s += ", until " + opts.until.UTC().Format(time.RFC3339)
+	}
+	if opts.rulesFile != "" {
+		s += ", rules from " + opts.rulesFile
+	}
+	return s
+}
+
+type replayStats struct {
+	entries, skipped int
+	first, last      time.Time
+}
+
+func (st *replayStats) span() string {
+	if st.first.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf(" from %s to %s", st.first.UTC().Format(time.RFC3339), st.last.UTC().Format(time.RFC3339))
+}
+
+// line checks one line and reports whether the replay is done. Lines
+// before from are skipped until the first one at or after it.
+func (st *replayStats) line(a *auditor, opts replayOptions, line []byte) bool {
+	t, ok := auditLineTime(line)
+	if ok && !opts.until.IsZero() && t.After(opts.until) {
+		return true
+	}
+	if st.entries == 0 && !opts.from.IsZero() && (!ok || t.Before(opts.from)) {
+		st.skipped++
+		return false
+	}
+	if ok {
+		if st.first.IsZero() {
+			st.first = t
+		}
+		st.last = t
+	}
+	st.entries++
+	a.processAuditLine(string(line))
+	return false
+}
+
+// readAuditLines passes each line to each until EOF or until each reports
+// it is done. A last line without a newline is still an entry.
+func readAuditLines(in io.Reader, each func(line []byte) bool) error {
+	r := bufio.NewReader(in)
+	for {
+		line, err := r.ReadBytes('\n')
+		if line = bytes.TrimRight(line, "\r\n"); len(line) > 0 && each(line) {
+			return nil
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("read audit entries: %w", err)
+		}
+	}
+}
+
+// replayFollow reads from start and keeps following the log, until an
+// entry after until, or an interrupt. Once the clock is past until and
+// every line written has been read, no later entry can be in range.
+func replayFollow(path string, start int64, opts replayOptions, a *auditor, st *replayStats) error {
+	t, err := tailAuditLog(path, tail.SeekInfo{Offset: start, Whence: io.SeekStart})
+	if err != nil {
+		return err
+	}
+	defer t.Stop()
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	pos := start
+	for {
+		select {
+		case line, ok := <-t.Lines:
+			if !ok {
+				return t.Err()
+			}
+			if line.Err != nil {
+				logWarn("⚠️  Error reading line: {error}", "error", line.Err)
+				continue
+			}
+			pos = line.SeekInfo.Offset
+			if st.line(a, opts, []byte(line.Text)) {
+				return nil
+			}
+		case now := <-ticker.C:
+			if opts.until.IsZero() || !now.After(opts.until) {
+				continue
+			}
+			if fi, err := os.Stat(path); err == nil && pos >= fi.Size() {
+				return nil
+			}
+		case <-sigChan:
+			logInfo("\n🛑 Replay interrupted")
+			return nil
+		}
+	}
+}
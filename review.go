@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Access Review Export ---
+
+const (
+	defaultReviewSince     = 90 * 24 * time.Hour
+	defaultReviewRetention = 400 * 24 * time.Hour // a quarter's review of last year's quarter still works
+	defaultReviewMaxRows   = 100000
+	reviewDayFormat        = "2006-01-02"
+)
+
+// ReviewExportConfig keeps a running table of who accessed which
+// sensitive prefixes, so quarterly access reviews are an export rather
+// than months of grepping audit logs.
+type ReviewExportConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// MinSensitivity is the lowest sensitivity level tracked; default high.
+	MinSensitivity string `yaml:"min_sensitivity"`
+	// Table is where the aggregate is kept; default next to state_file.
+	Table string `yaml:"table"`
+	// Identities unseen for Retention are pruned, and counts older than
+	// it dropped.
+	Retention Duration `yaml:"retention"`
+	MaxRows   int      `yaml:"max_rows"` // least recently seen go first
+	// Schedule (cron) writes Output covering the last Since. Unset, the
+	// export only runs through review export.
+	Schedule string   `yaml:"schedule"`
+	Since    Duration `yaml:"since"`
+	Output   string   `yaml:"output"` // {date} is replaced with the export's date
+}
+
+// reviewRow is one identity's access to one prefix. Days counts accesses
+// per UTC day, so an export can cover any period within the retention.
+type reviewRow struct {
+	ID        string                `json:"id"` // identityKey
+	Identity  string                `json:"identity"`
+	EntityID  string                `json:"entity_id,omitempty"`
+	AuthMount string                `json:"auth_mount,omitempty"`
+	Prefix    string                `json:"prefix"`
+	Level     string                `json:"sensitivity"`
+	FirstSeen time.Time             `json:"first_seen"`
+	LastSeen  time.Time             `json:"last_seen"`
+	Days      map[string]*reviewDay `json:"days"`
+}
+
+type reviewDay struct {
+	Count  int `json:"n"`
+	Denied int `json:"denied,omitempty"`
+}
+
+// reviewTable is the table file's shape.
+type reviewTable struct {
+	Saved time.Time    `json:"saved"`
+	Rows  []*reviewRow `json:"rows"`
+}
+
+// accessReview maintains the table from the audit stream. A nil
+// *accessReview records nothing.
+type accessReview struct {
+	cfg   ReviewExportConfig
+	min   sensitivityLevel
+	sens  *sensitivityMap
+	ids   *identityCache
+	path  string
+	rows  map[string]*reviewRow // by ID and prefix
+	mu    sync.Mutex
+	dirty bool
+}
+
+func newAccessReview(cfg *VaultConfig, sens *sensitivityMap, ids *identityCache) *accessReview {
+	if !cfg.ReviewExport.Enabled || sens == nil {
+		return nil
+	}
+	min, _ := parseSensitivity(cfg.ReviewExport.MinSensitivity) // validated at load
+	r := &accessReview{cfg: cfg.ReviewExport, min: min, sens: sens, ids: ids,
+		path: cfg.ReviewExport.Table, rows: make(map[string]*reviewRow)}
+	t, err := loadReviewTable(r.path)
+	if err != nil {
+		logWarn("⚠️  Access review: could not restore the table: {error}", "error", err)
+		return r
+	}
+	for _, row := range t.Rows {
+		if row != nil && row.Days != nil {
+			r.rows[reviewKey(row.ID, row.Prefix)] = row
+		}
+	}
+	return r
+}
+
+func reviewKey(id, prefix string) string { return id + "\x00" + prefix }
+
+// defaultReviewTable puts the table next to the state file.
+func defaultReviewTable(stateFile string) string {
+	return strings.TrimSuffix(stateFile, filepath.Ext(stateFile)) + ".review.json"
+}
+
+// loadReviewTable reads the table file; a missing file is an empty table.
+func loadReviewTable(path string) (*reviewTable, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &reviewTable{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var t reviewTable
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return &t, nil
+}
+
+// observe counts one response on a tracked prefix. Only a row's first
+// access resolves its identity, so the identity cache isn't asked per
+// entry.
+func (r *accessReview) observe(e *AuditEntry) {
+	if r == nil || e.Type != "response" || e.Request.Path == "" || e.Auth.DisplayName == "" {
+		return
+	}
+	prefix, level := r.sens.match(e.Request.Path)
+	if level == sensUnclassified || level < r.min {
+		return
+	}
+	id, now := identityKey(e), entryTime(e.Time).UTC()
+	key := reviewKey(id, prefix)
+
+	r.mu.Lock()
+	row := r.rows[key]
+	r.mu.Unlock()
+	var who Alert
+	if row == nil {
+		// Outside the lock: a cache miss reads from Vault.
+		r.ids.annotate(&who, e)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if row = r.rows[key]; row == nil {
+		if len(r.rows) >= shedCap(r.cfg.MaxRows) {
+			r.evict()
+		}
+		row = &reviewRow{ID: id, Identity: e.Auth.DisplayName, EntityID: e.Auth.EntityID, AuthMount: who.AuthMount,
+			Prefix: prefix, FirstSeen: now, Days: make(map[string]*reviewDay)}
+		if who.EntityName != "" {
+			row.Identity = who.EntityName
+		}
+		r.rows[key] = row
+	}
+	row.Level = level.String()
+	if now.After(row.LastSeen) {
+		row.LastSeen = now
+	}
+	if now.Before(row.FirstSeen) {
+		row.FirstSeen = now
+	}
+	day := row.Days[now.Format(reviewDayFormat)]
+	if day == nil {
+		day = &reviewDay{}
+		row.Days[now.Format(reviewDayFormat)] = day
+	}
+	day.Count++
+	if strings.Contains(e.Error, "permission denied") {
+		day.Denied++
+	}
+	r.dirty = true
+	metrics.inc("review_accesses_total", "level", level.String())
+}
+
+// evict drops the least recently seen row. Called with r.mu held.
+func (r *accessReview) evict() {
+	var oldest string
+	var seen time.Time
+	for key, row := range r.rows {
+		if oldest == "" || row.LastSeen.Before(seen) {
+			oldest, seen = key, row.LastSeen
+		}
+	}
+	delete(r.rows, oldest)
+	metrics.inc("review_rows_evicted_total")
+}
+
+func (r *accessReview) usage() cacheUsage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u := cacheUsage{Entries: len(r.rows)}
+	for key, row := range r.rows {
+		u.Bytes += cacheEntryOverhead + cacheMapOverhead + int64(len(key)+len(row.Identity)+len(row.EntityID)+len(row.AuthMount))
+		u.Bytes += int64(len(row.Days)) * (cacheEntryOverhead + int64(len(reviewDayFormat)))
+	}
+	return u
+}
+
+// shed drops the least recently seen rows over the shrunk limit, which a
+// later export won't have.
+func (r *accessReview) shed() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	excess := len(r.rows) - shedCap(r.cfg.MaxRows)
+	if excess <= 0 {
+		return
+	}
+	seen := make(map[string]time.Time, len(r.rows))
+	for key, row := range r.rows {
+		seen[key] = row.LastSeen
+	}
+	for _, key := range oldestKeys(seen)[:excess] {
+		delete(r.rows, key)
+	}
+	r.dirty = true
+	metrics.add("review_rows_evicted_total", float64(excess))
+}
+
+// prune drops identities unseen for the retention, and the days before it
+// from the rest. Called with r.mu held.
+func (r *accessReview) prune(now time.Time) {
+	cutoff := now.Add(-time.Duration(r.cfg.Retention))
+	lastSeen := make(map[string]time.Time)
+	for _, row := range r.rows {
+		if row.LastSeen.After(lastSeen[row.ID]) {
+			lastSeen[row.ID] = row.LastSeen
+		}
+	}
+	oldest := cutoff.Format(reviewDayFormat)
+	for key, row := range r.rows {
+		if lastSeen[row.ID].Before(cutoff) {
+			delete(r.rows, key)
+			r.dirty = true
+			continue
+		}
+		for day := range row.Days {
+			if day < oldest {
+				delete(row.Days, day)
+				r.dirty = true
+			}
+		}
+		if len(row.Days) == 0 {
+			delete(r.rows, key)
+		}
+	}
+}
+
+// save prunes the table and writes it out when it changed.
+func (r *accessReview) save() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	r.prune(time.Now().UTC())
+	if !r.dirty {
+		r.mu.Unlock()
+		return nil
+	}
+	t := reviewTable{Saved: time.Now().UTC(), Rows: make([]*reviewRow, 0, len(r.rows))}
+	for _, row := range r.rows {
+		t.Rows = append(t.Rows, row)
+	}
+	data, err := json.Marshal(t)
+	r.dirty = false
+	r.mu.Unlock()
+	metrics.set("review_rows", float64(len(t.Rows)))
+	if err != nil {
+		return fmt.Errorf("marshal review table: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o700); err == nil {
+		err = writeFileAtomic(r.path, data, 0o600)
+	}
+	if err != nil {
+		r.mu.Lock()
+		r.dirty = true // try again next time
+		r.mu.Unlock()
+		return fmt.Errorf("save review table: %w", err)
+	}
+	return nil
+}
+
+// reviewLine is one row of an export, counted over its period.
+type reviewLine struct {
+	identity, entityID, authMount, prefix, level string
+	count, denied                                int
+	firstSeen, lastSeen                          time.Time
+}
+
+// reviewLines counts each row's accesses since the cutoff, dropping rows
+// without any. first_seen is the row's first access if that falls in the
+// period; otherwise the start of its first day in the period.
+func reviewLines(rows []*reviewRow, since time.Time) []reviewLine {
+	since = since.UTC()
+	fromDay := since.Format(reviewDayFormat)
+	var lines []reviewLine
+	for _, row := range rows {
+		l := reviewLine{identity: row.Identity, entityID: row.EntityID, authMount: row.AuthMount,
+			prefix: row.Prefix, level: row.Level, lastSeen: row.LastSeen}
+		first := ""
+		for day, n := range row.Days {
+			if day < fromDay {
+				continue
+			}
+			l.count += n.Count
+			l.denied += n.Denied
+			if first == "" || day < first {
+				first = day
+			}
+		}
+		if l.count == 0 || row.LastSeen.Before(since) {
+			continue
+		}
+		l.firstSeen = row.FirstSeen
+		if row.FirstSeen.Before(since) {
+			l.firstSeen, _ = time.Parse(reviewDayFormat, first)
+		}
+		lines = append(lines, l)
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		if lines[i].identity != lines[j].identity {
+			return lines[i].identity < lines[j].identity
+		}
+		if lines[i].entityID != lines[j].entityID {
+			return lines[i].entityID < lines[j].entityID
+		}
+		return lines[i].prefix < lines[j].prefix
+	})
+	return lines
+}
+
+// writeReviewCSV writes lines as CSV that spreadsheets open as they are: a
+// byte order mark so Excel reads UTF-8, and cells that would start a
+// formula prefixed with a quote, since identities and paths come from
+// audit entries.
+func writeReviewCSV(w io.Writer, lines []reviewLine) error {
+	if _, err := io.WriteString(w, "\ufeff"); err != nil {
+		return err
+	}
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"identity", "entity_id", "auth_mount", "path_prefix", "sensitivity",
+		"access_count", "first_seen", "last_seen", "denied_count"})
+	for _, l := range lines {
+		cw.Write([]string{csvCell(l.identity), csvCell(l.entityID), csvCell(l.authMount), csvCell(l.prefix), l.level,
+			strconv.Itoa(l.count), l.firstSeen.Format(time.RFC3339), l.lastSeen.Format(time.RFC3339), strconv.Itoa(l.denied)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func csvCell(s string) string {
+	s = cleanField(s, maxPathLen)
+	if s != "" && strings.ContainsRune("=+-@", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// exportReview writes the lines since the cutoff to path, or stdout, and
+// returns how many there were.
+func exportReview(rows []*reviewRow, since time.Time, path string) (int, error) {
+	lines := reviewLines(rows, since)
+	var b strings.Builder
+	if err := writeReviewCSV(&b, lines); err != nil {
+		return 0, err
+	}
+	if path == "" {
+		_, err := os.Stdout.WriteString(b.String())
+		return len(lines), err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return 0, fmt.Errorf("create export dir: %w", err)
+	}
+	return len(lines), writeFileAtomic(path, []byte(b.String()), 0o600)
+}
+
+// snapshot copies the rows for an export.
+func (r *accessReview) snapshot() []*reviewRow {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rows := make([]*reviewRow, 0, len(r.rows))
+	for _, row := range r.rows {
+		cp := *row
+		cp.Days = make(map[string]*reviewDay, len(row.Days))
+		for d, n := range row.Days {
+			c := *n
+			cp.Days[d] = &c
+		}
+		rows = append(rows, &cp)
+	}
+	return rows
+}
+
+func reviewSaveJob(r *accessReview) jobSpec {
+	return jobSpec{
+		name:    "review-table",
+		every:   time.Minute,
+		timeout: 30 * time.Second,
+		run:     func(ctx context.Context) error { return r.save() },
+	}
+}
+
+var (
+	msgReviewExported     = message("review-export.title")
+	msgReviewExportedBody = message("review-export.body")
+)
+
+// reviewExportJob writes the scheduled export and says where it went.
+func reviewExportJob(cfg *VaultConfig, r *accessReview) jobSpec {
+	spec := jobSpec{
+		name:    "review-export",
+		timeout: 5 * time.Minute,
+		run: func(ctx context.Context) error {
+			now := time.Now().UTC()
+			since := now.Add(-time.Duration(r.cfg.Since))
+			path := strings.ReplaceAll(r.cfg.Output, "{date}", now.Format(reviewDayFormat))
+			n, err := exportReview(r.snapshot(), since, path)
+			if err != nil {
+				return fmt.Errorf("review export: %w", err)
+			}
+			logInfo("📋 Access review: {rows} rows since {since} written to {path}", "rows", n, "since", since.Format(reviewDayFormat), "path", path)
+			return notify(cfg, Alert{Severity: sevInfo, Color: sevInfo.color(), Rule: "review-export"}.say(msgReviewExported.with(),
+				msgReviewExportedBody.with("rows", n, "since", since.Format(reviewDayFormat), "min", r.min, "path", mdCode(path, maxPathLen))))
+		},
+	}
+	spec.cron, _ = parseCron(r.cfg.Schedule) // validated at load
+	return spec
+}
+
+// --- Command: Review ---
+
+func runReview(cfg *VaultConfig, args []string) error {
+	if len(args) < 1 || args[0] != "export" {
+		return fmt.Errorf("usage: vault-warden review export [-since 90d] [-o file]")
+	}
+	if !cfg.ReviewExport.Enabled {
+		return fmt.Errorf("review_export is not enabled")
+	}
+	fs := flagSet("review export")
+	sinceFlag := fs.String("since", formatDuration(time.Duration(cfg.ReviewExport.Since)), "Period the report covers, e.g. 90d")
+	out := fs.String("o", "", "Output file (default stdout)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	since, err := parseDuration(*sinceFlag)
+	if err != nil || since <= 0 {
+		return fmt.Errorf("-since must be a positive duration, e.g. 90d")
+	}
+	// The running audit process saves the table every minute.
+	t, err := loadReviewTable(cfg.ReviewExport.Table)
+	if err != nil {
+		return err
+	}
+	n, err := exportReview(t.Rows, time.Now().Add(-since), *out)
+	if err != nil {
+		return err
+	}
+	if *out != "" {
+		logInfo("✓ {rows} rows written to {path} (table saved {saved})", "rows", n, "path", *out, "saved", t.Saved.Format(time.RFC3339))
+	}
+	return nil
+}
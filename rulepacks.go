@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// --- Rule Packs ---
+
+// rulePack is a named set of rules that `config generate` expands into a
+// full config. Escalate entries turn on first-time access alerting.
+type rulePack struct {
+	Name        string
+	Description string
+	Aggregation []AggregationRule
+	Escalate    map[string]string // first_access.escalate
+	PKI         bool              // turns on the PKI detectors
+	Tokens      bool              // turns on the token creation detectors
+}
+
+var rulePacks = []rulePack{
+	{
+		Name:        "database",
+		Description: "Dynamic database credentials and connection config.",
+		Aggregation: []AggregationRule{
+			{Name: "database-creds-coordinated", Paths: []string{"database/creds/"}, Operations: []string{"read"},
+				GroupBy: "prefix:3", Window: Duration(defaultAggregationWindow), Threshold: 3, Severity: "critical"},
+		},
+		Escalate: map[string]string{
+			"database/config":      "critical",
+			"database/rotate-root": "critical",
+			"database/creds":       "warning",
+		},
+	},
+	{
+		Name:        "identity",
+		Description: "Changes to identity entities, groups and OIDC.",
+		Aggregation: []AggregationRule{
+			{Name: "identity-changes", Paths: []string{"identity/entity", "identity/group"},
+				Operations: []string{"create", "update", "delete"}, GroupBy: "prefix:2",
+				Window: Duration(15 * time.Minute), Threshold: 3, Severity: "warning"},
+		},
+		Escalate: map[string]string{
+			"identity/entity": "warning",
+			"identity/group":  "warning",
+			"identity/oidc":   "warning",
+		},
+	},
+	{
+		Name:        "kv-prod",
+		Description: "Production secrets in the KV v2 engine at secret/, under prod/.",
+		Aggregation: []AggregationRule{
+			{Name: "kv-prod-coordinated-read", Paths: []string{"secret/data/prod/"}, Operations: []string{"read"},
+				GroupBy: "path", Window: Duration(defaultAggregationWindow), Threshold: 5, Severity: "critical"},
+			{Name: "kv-prod-deletes", Paths: []string{"secret/delete/prod/", "secret/destroy/prod/", "secret/metadata/prod/"},
+				Operations: []string{"update", "delete"}, GroupBy: "prefix:3",
+				Window: Duration(30 * time.Minute), Threshold: 2, Severity: "critical"},
+		},
+	},
+	{
+		Name:        "pki",
+		Description: "Certificate issuance and CA management in the pki/ engine.",
+		Aggregation: []AggregationRule{
+			{Name: "pki-coordinated-issue", Paths: []string{"pki/issue/", "pki/sign/"}, Operations: []string{"update"},
+				GroupBy: "prefix:3", Window: Duration(15 * time.Minute), Threshold: 3, Severity: "warning"},
+		},
+		Escalate: map[string]string{
+			"pki/root":          "critical",
+			"pki/sign-verbatim": "critical",
+			"pki/config":        "warning",
+			"pki/intermediate":  "warning",
+		},
+		PKI: true,
+	},
+	{
+		Name:        "tokens",
+		Description: "Long-lived, orphan, periodic and over-privileged tokens from auth/token/create.",
+		Tokens:      true,
+	},
+}
+
+func findRulePack(name string) (*rulePack, error) {
+	for i := range rulePacks {
+		if rulePacks[i].Name == name {
+			return &rulePacks[i], nil
+		}
+	}
+	names := make([]string, len(rulePacks))
+	for i, p := range rulePacks {
+		names[i] = p.Name
+	}
+	return nil, fmt.Errorf("unknown rule pack %q (have %s)", name, strings.Join(names, ", "))
+}
+
+// describe renders a pack for -list-packs.
+func (p *rulePack) describe() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %s\n", p.Name, p.Description)
+	for _, r := range p.Aggregation {
+		ops := "any operation"
+		if len(r.Operations) > 0 {
+			ops = strings.Join(r.Operations, "/")
+		}
+		fmt.Fprintf(&b, "  aggregation %s: %d+ identities, %s on %s within %s, grouped by %s (%s)\n",
+			r.Name, r.Threshold, ops, strings.Join(r.Paths, ", "), formatDuration(time.Duration(r.Window)), r.GroupBy, r.Severity)
+	}
+	for _, prefix := range sortedKeys(p.Escalate) {
+		fmt.Fprintf(&b, "  first access to %s: %s\n", prefix, p.Escalate[prefix])
+	}
+	if p.PKI {
+		b.WriteString(describePKIDetectors())
+	}
+	if p.Tokens {
+		b.WriteString(describeTokenDetectors())
+	}
+	return b.String()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRulePacksWellFormed(t *testing.T) {
+	packs := map[string]bool{}
+	rules := map[string]string{}
+	for _, p := range rulePacks {
+		if packs[p.Name] {
+			t.Errorf("pack %s is defined twice", p.Name)
+		}
+		packs[p.Name] = true
+		if p.Description == "" {
+			t.Errorf("pack %s has no description", p.Name)
+		}
+		if len(p.Aggregation) == 0 && len(p.Escalate) == 0 && !p.PKI && !p.Tokens {
+			t.Errorf("pack %s turns nothing on", p.Name)
+		}
+		for _, r := range p.Aggregation {
+			if other, ok := rules[r.Name]; ok {
+				t.Errorf("rule %s is in packs %s and %s", r.Name, other, p.Name)
+			}
+			rules[r.Name] = p.Name
+		}
+		for prefix, sev := range p.Escalate {
+			if _, err := parseSeverity(sev); err != nil {
+				t.Errorf("pack %s escalates %s: %v", p.Name, prefix, err)
+			}
+		}
+	}
+}
+
+// Each pack makes a config that loads on its own.
+func TestRulePacksLoad(t *testing.T) {
+	for _, p := range rulePacks {
+		t.Run(p.Name, func(t *testing.T) {
+			spec := &configSpec{
+				Clusters:  []clusterSpec{{Name: "prod", Address: "https://vault:8200", UnsealKeys: []string{"k1"}}},
+				Notifiers: notifierSpec{DiscordWebhookURL: "https://discord.com/api/webhooks/1/x"},
+				RulePacks: []string{p.Name},
+			}
+			data, err := generateConfig(spec, spec.Clusters[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := loadTestConfig(t, string(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(cfg.Aggregation) != len(p.Aggregation) {
+				t.Errorf("aggregation = %d rules, want %d", len(cfg.Aggregation), len(p.Aggregation))
+			}
+			for prefix, sev := range p.Escalate {
+				if cfg.FirstAccess.Escalate[prefix] != sev {
+					t.Errorf("first_access.escalate[%s] = %q, want %q", prefix, cfg.FirstAccess.Escalate[prefix], sev)
+				}
+			}
+			if cfg.PKI.Enabled != p.PKI || cfg.Tokens.Enabled != p.Tokens {
+				t.Errorf("pki %v, tokens %v; want %v, %v", cfg.PKI.Enabled, cfg.Tokens.Enabled, p.PKI, p.Tokens)
+			}
+		})
+	}
+}
+
+func TestListPacksGolden(t *testing.T) {
+	out := captureStdout(t, func() {
+		if err := runConfigGenerate([]string{"-list-packs"}); err != nil {
+			t.Error(err)
+		}
+	})
+	for _, p := range rulePacks {
+		if !strings.Contains(out, p.Name+": "+p.Description+"\n") {
+			t.Errorf("-list-packs doesn't describe %s", p.Name)
+		}
+	}
+	checkGolden(t, "config-generate/list-packs.golden", out)
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// --- Alert Rules ---
+
+// AlertRule raises an alert for every audit entry whose path contains
+// one of Paths or matches PathRegex.
+type AlertRule struct {
+	Name       string   `yaml:"name"`
+	Paths      []string `yaml:"paths"`      // substrings; one must match
+	PathRegex  string   `yaml:"path_regex"` // unanchored unless it says ^ or $
+	Operations []string `yaml:"operations"` // empty matches every operation
+	Severity   string   `yaml:"severity"`   // default critical
+	Title      string   `yaml:"title"`      // default from the name
+	Message    string   `yaml:"message"`    // the alert's description, a template
+	// Cooldown holds back repeats for the same user and path, then sends
+	// one summary; 0 sends every alert.
+	Cooldown Duration `yaml:"cooldown"`
+
+	// When is a template; the rule only fires for an entry if it doesn't
+	// render "false", so a lookup that answers "unknown" still alerts.
+	When string `yaml:"when"`
+
+	// Threshold, when set, fires once per burst of matching entries
+	// rather than for each; see rulethreshold.go.
+	Threshold *RuleThreshold `yaml:"threshold"`
+}
+
+// defaultAlertRules are the rules used when the config sets none: the
+// two paths vault-warden has always alerted on.
+var defaultAlertRules = []AlertRule{
+	{Name: "privileged-access", Paths: []string{"sign/root", "database/creds/admin"}, Severity: "critical",
+		Title: "🚨 SECURITY ALERT: Privileged Access", Message: "A privileged credential or signing path was accessed."},
+}
+
+// alertRule is an AlertRule ready to evaluate.
+type alertRule struct {
+	AlertRule
+	sev       severity
+	re        *regexp.Regexp // nil when unset
+	cooldown  *ruleCooldown
+	threshold *ruleThreshold     // nil unless a threshold rule
+	when      *template.Template // nil when unset
+	message   *template.Template
+	shadow    bool // the config canary's copy, which counts and logs nothing
+}
+
+// ruleData is what a rule's templates see. Match holds the groups of
+// path_regex by name and number, e.g. {{.Match.role}}, and History
+// answers questions about past alerts, e.g. {{.History.Count .User .Rule "30d"}}.
+type ruleData struct {
+	Rule, User, Entity, Path, Operation, SourceIP string
+	RequestID, Environment, Sensitivity           string
+	Match                                         map[string]string
+	History                                       *historyLookup
+}
+
+// ruleScope is what a rule's templates see beyond the entry: the
+// config's environment, the sensitivity map and the alert history.
+type ruleScope struct {
+	Environment string
+	Sensitivity *sensitivityMap // nil without one: every path unclassified
+	History     *historyLookup
+}
+
+// ruleFuncs are the rule templates' functions. md escapes a value for
+// the markdown of the description, as audit fields must be.
+var ruleFuncs = template.FuncMap{
+	"md": func(v interface{}) string { return mdText(fmt.Sprint(v), maxPathLen) },
+}
+
+func parseRuleTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(ruleFuncs).Option("missingkey=error").Parse(text)
+}
+
+func compileAlertRules(rules []AlertRule) []alertRule {
+	out := make([]alertRule, 0, len(rules))
+	for _, r := range rules {
+		// All validated at load.
+		sev, _ := parseSeverity(r.Severity)
+		c := alertRule{AlertRule: r, sev: sev, cooldown: newRuleCooldown(time.Duration(r.Cooldown)), threshold: newRuleThreshold(r.Threshold)}
+		if r.PathRegex != "" {
+			c.re = regexp.MustCompile(r.PathRegex)
+		}
+		c.message = template.Must(parseRuleTemplate("message", r.Message))
+		if r.When != "" {
+			c.when = template.Must(parseRuleTemplate("when", r.When))
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// ruleSet holds the compiled rules, swapped whole by a config reload
+// while the intake reads them.
+type ruleSet struct{ v atomic.Value }
+
+func (s *ruleSet) load() []alertRule {
+	rules, _ := s.v.Load().([]alertRule)
+	return rules
+}
+
+// store swaps in rules. A rule that keeps its name and cooldown keeps the
+// cooldowns running, so a reload doesn't let held back repeats through;
+// one that keeps its threshold keeps its window counting.
+func (s *ruleSet) store(rules []alertRule) {
+	old := make(map[string]*ruleCooldown)
+	windows := make(map[string]*ruleThreshold)
+	for _, r := range s.load() {
+		if r.cooldown != nil {
+			old[r.Name] = r.cooldown
+		}
+		if r.threshold != nil {
+			windows[r.Name] = r.threshold
+		}
+	}
+	for i := range rules {
+		if c := old[rules[i].Name]; c != nil && rules[i].cooldown != nil && c.window == rules[i].cooldown.window {
+			rules[i].cooldown = c
+		}
+		if t := windows[rules[i].Name]; t != nil && rules[i].threshold != nil && t.cfg == rules[i].threshold.cfg {
+			rules[i].threshold = t
+		}
+	}
+	s.v.Store(rules)
+}
+
+// match reports whether r matches e and, when path_regex did, returns
+// its groups. The substrings are tried first: they're cheaper.
+func (r *alertRule) match(e *AuditEntry) (map[string]string, bool) {
+	if len(r.Operations) > 0 && !containsString(r.Operations, e.Request.Operation) {
+		return nil, false
+	}
+	if r.Threshold != nil && (e.Type == "request" || r.Threshold.ErrorsOnly && e.Error == "") {
+		return nil, false
+	}
+	for _, p := range r.Paths {
+		if strings.Contains(e.Request.Path, p) {
+			return nil, true
+		}
+	}
+	if r.re == nil {
+		return nil, false
+	}
+	if r.re.NumSubexp() == 0 {
+		return nil, r.re.MatchString(e.Request.Path)
+	}
+	m := r.re.FindStringSubmatch(e.Request.Path)
+	if m == nil {
+		return nil, false
+	}
+	return regexGroups(r.re, m), true
+}
+
+// nearMiss reports whether e is on r's paths but with an operation r
+// doesn't list, a sign the operations may be too narrow.
+func (r *alertRule) nearMiss(e *AuditEntry) bool {
+	if len(r.Operations) == 0 || containsString(r.Operations, e.Request.Operation) {
+		return false
+	}
+	for _, p := range r.Paths {
+		if strings.Contains(e.Request.Path, p) {
+			return true
+		}
+	}
+	return r.re != nil && r.re.MatchString(e.Request.Path)
+}
+
+// regexGroups maps each group of a match to its number and, if it has
+// one, its name.
+func regexGroups(re *regexp.Regexp, m []string) map[string]string {
+	groups := make(map[string]string, 2*len(m))
+	for i, name := range re.SubexpNames() {
+		if i == 0 {
+			continue
+		}
+		groups[fmt.Sprint(i)] = m[i]
+		if name != "" {
+			groups[name] = m[i]
+		}
+	}
+	return groups
+}
+
+func (r *alertRule) data(e *enrichedEntry, match map[string]string, sc ruleScope) ruleData {
+	return ruleData{Rule: r.Name, User: e.Auth.DisplayName, Entity: e.Auth.EntityID, Path: e.Request.Path,
+		Operation: e.Request.Operation, SourceIP: hostOnly(e.Request.RemoteAddress), RequestID: e.Request.ID,
+		Environment: sc.Environment, Sensitivity: sc.Sensitivity.classify(e.Request.Path).String(), Match: match, History: sc.History}
+}
+
+func render(t *template.Template, data ruleData) (string, error) {
+	var b bytes.Buffer
+	err := t.Execute(&b, data)
+	return b.String(), err
+}
+
+// alert is the alert r raises for e, whose path gave match, before
+// enrichment, and false if its when condition holds it back. A template
+// that fails to render leaves the condition open and the message as
+// written.
+func (r *alertRule) alert(e *enrichedEntry, match map[string]string, sc ruleScope) (Alert, bool) {
+	data := r.data(e, match, sc)
+	if r.when != nil {
+		cond, err := render(r.when, data)
+		switch {
+		case err != nil:
+			if !r.shadow {
+				logWarn("⚠️  Rule {rule}: when: {error}", "rule", r.Name, "error", err)
+			}
+		case strings.TrimSpace(cond) == "false":
+			if !r.shadow {
+				metrics.inc("rule_conditions_false_total", "rule", r.Name)
+			}
+			return Alert{}, false
+		}
+	}
+	desc, err := render(r.message, data)
+	if err != nil {
+		if !r.shadow {
+			logWarn("⚠️  Rule {rule}: message: {error}", "rule", r.Name, "error", err)
+		}
+		desc = r.Message
+	}
+	// The message is the rule's own text, sent as written; only the
+	// recent activity heading is localized.
+	var recent localText
+	if s := e.Session; len(s) > 0 {
+		recent = msgRuleRecent.with("count", len(s), "session", formatSession(s))
+	}
+	return Alert{Title: r.Title, Severity: r.sev, Color: r.sev.color(),
+		RequestID: e.Request.ID, Rule: r.Name, User: e.Auth.DisplayName, Path: e.Request.Path,
+		Operation: e.Request.Operation, SourceIP: hostOnly(e.Request.RemoteAddress),
+		Time: entryTime(e.Time)}.say(localText{}, msgRuleBody.with("message", desc, "recent", recent)), true
+}
+
+var (
+	msgRuleBody   = message("rule.body")
+	msgRuleRecent = message("rule.recent")
+)
+
+// validateRules checks rules and fills in their defaults; unset, the
+// default rules apply.
+func validateRules(cfg *VaultConfig) error {
+	if err := validateHistoryLookup(cfg); err != nil {
+		return err
+	}
+	if cfg.Rules == nil {
+		cfg.Rules = append([]AlertRule(nil), defaultAlertRules...)
+		return nil
+	}
+	seen := make(map[string]bool)
+	for i := range cfg.Rules {
+		r := &cfg.Rules[i]
+		field := fmt.Sprintf("rules[%d]", i)
+		if r.Name == "" {
+			return &fieldError{field + ".name", "is required"}
+		}
+		if seen[r.Name] {
+			return &fieldError{field + ".name", fmt.Sprintf("duplicate rule name %q", r.Name)}
+		}
+		if containsString(builtinRules, r.Name) {
+			return &fieldError{field + ".name", fmt.Sprintf("%q is the name of a built-in rule", r.Name)}
+		}
+		seen[r.Name] = true
+		if len(r.Paths) == 0 && r.PathRegex == "" {
+			return &fieldError{field + ".paths", "or path_regex is required"}
+		}
+		for j, p := range r.Paths {
+			if p == "" {
+				return &fieldError{fmt.Sprintf("%s.paths[%d]", field, j), "must not be empty; it would match every path"}
+			}
+		}
+		if r.PathRegex != "" {
+			re, err := regexp.Compile(r.PathRegex)
+			if err != nil {
+				return &fieldError{field + ".path_regex", fmt.Sprintf("rule %s: %v", r.Name, err)}
+			}
+			if re.MatchString("") {
+				return &fieldError{field + ".path_regex", fmt.Sprintf("rule %s: matches the empty path, so every path", r.Name)}
+			}
+		}
+		if r.Cooldown < 0 {
+			return &fieldError{field + ".cooldown", "must be positive, or 0 for none"}
+		}
+		if err := validateRuleThreshold(field, r); err != nil {
+			return err
+		}
+		if r.Severity == "" {
+			r.Severity = "critical"
+		}
+		sev, err := parseSeverity(r.Severity)
+		if err != nil {
+			return &fieldError{field + ".severity", err.Error()}
+		}
+		if r.Title == "" {
+			mark := "ℹ️"
+			switch sev {
+			case sevCritical:
+				mark = "🚨"
+			case sevWarning:
+				mark = "⚠️"
+			}
+			r.Title = mark + " Rule matched: " + r.Name
+		}
+		if r.Message == "" {
+			r.Message = fmt.Sprintf("An audit entry matched the rule %s.", mdCode(r.Name, maxNameLen))
+		}
+		if err := checkRuleTemplates(cfg, r); err != nil {
+			return &fieldError{field + "." + err.field, err.msg}
+		}
+	}
+	return nil
+}
+
+// checkRuleTemplates parses a rule's templates and renders them for a
+// sample entry, with the history unknown, which catches bad windows.
+// Every group of path_regex is set, so a misspelt one fails.
+func checkRuleTemplates(cfg *VaultConfig, r *AlertRule) *fieldError {
+	var e enrichedEntry
+	e.Auth.DisplayName, e.Request.Path, e.Request.Operation = "alice", "secret/data/payments/db", "read"
+	var match map[string]string
+	if r.PathRegex != "" {
+		re := regexp.MustCompile(r.PathRegex) // checked above
+		match = regexGroups(re, make([]string, re.NumSubexp()+1))
+	}
+	c := alertRule{AlertRule: *r}
+	data := c.data(&e, match, ruleScope{Environment: cfg.Environment, History: (*historyIndex)(nil).lookup(cfg.HistoryLookup)})
+	for _, t := range []struct{ field, text string }{{"message", r.Message}, {"when", r.When}} {
+		tmpl, err := parseRuleTemplate(t.field, t.text)
+		if err == nil {
+			_, err = render(tmpl, data)
+		}
+		if err != nil {
+			return &fieldError{t.field, err.Error()}
+		}
+	}
+	return nil
+}
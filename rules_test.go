@@ -0,0 +1,398 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+const rulesTestConfig = envTestBase + `
+rules:
+  - name: pki-root
+    paths: ["pki/root", "sign/root"]
+    severity: critical
+    message: "{{md .User}} used the root CA."
+  - name: secret-writes
+    paths: ["secret/"]
+    operations: [create, update, delete]
+    severity: warning
+  - name: admin-creds
+    paths: ["creds/admin"]
+    severity: info
+    title: "Admin credentials read"
+  - name: any-sign
+    path_regex: "/sign(-verbatim)?/"
+    severity: warning
+`
+
+func ruleLine(path, op string) string {
+	return `{"time":"2026-01-02T03:04:05Z","type":"response","auth":{"display_name":"oidc-alice"},"request":{"id":"r-1","path":"` +
+		path + `","operation":"` + op + `"}}`
+}
+
+// Every rule an entry matches fires, in the order the config lists them.
+func TestProcessAuditLineRules(t *testing.T) {
+	tests := []struct {
+		name, path, op string
+		want           string
+	}{
+		{"one rule", "pki/root/generate/internal", "update", "pki-root"},
+		{"two rules on one line", "pki/root/sign/web", "update", "pki-root any-sign"},
+		{"three rules on one line", "secret/pki/root/sign/creds/admin", "update", "pki-root secret-writes admin-creds any-sign"},
+		{"operation required", "secret/data/app", "update", "secret-writes"},
+		{"operation not listed", "secret/data/app", "read", ""},
+		{"operations are per rule", "secret/sign/creds/admin", "read", "admin-creds any-sign"},
+		{"regex only", "pki/sign-verbatim/web", "update", "any-sign"},
+		{"nothing", "auth/token/lookup-self", "read", ""},
+	}
+	cfg, err := loadTestConfig(t, rulesTestConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent := captureAlerts(t)
+			newAuditor(cfg).processAuditLine(ruleLine(tt.path, tt.op))
+			if got := alertRules(sent()); got != tt.want {
+				t.Errorf("%s %s fired %q, want %q", tt.op, tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessAuditLineRuleAlert(t *testing.T) {
+	cfg, err := loadTestConfig(t, rulesTestConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := captureAlerts(t)
+	newAuditor(cfg).processAuditLine(ruleLine("pki/root/sign/web", "update"))
+	alerts := sent()
+	if len(alerts) != 2 {
+		t.Fatalf("alerts = %q, want two", alertRules(alerts))
+	}
+	if a := alerts[0]; a.Severity != sevCritical || a.Title != "🚨 Rule matched: pki-root" || !strings.Contains(a.Description, `oidc\-alice used the root CA.`) ||
+		a.Path != "pki/root/sign/web" || a.User != "oidc-alice" || a.Operation != "update" {
+		t.Errorf("pki-root alert = %+v, want the rule's severity, default title and message", a)
+	}
+	if a := alerts[1]; a.Severity != sevWarning || a.Title != "⚠️ Rule matched: any-sign" || !strings.Contains(a.Description, "any-sign") {
+		t.Errorf("any-sign alert = %s %q %q, want the defaults for a warning", a.Severity, a.Title, a.Description)
+	}
+}
+
+// metricValue is the value of the series of name with exactly labels.
+func metricValue(name string, labels ...string) float64 {
+	want := strings.Join(sortLabels(labels), "\x00")
+	for _, s := range metrics.snapshot() {
+		if s.Name == name && strings.Join(s.Labels, "\x00") == want {
+			return s.Value
+		}
+	}
+	return 0
+}
+
+// The templates see the config's environment, and the alert counts and
+// the rule's log line carry it.
+func TestRuleEnvironment(t *testing.T) {
+	for _, env := range []string{"prod", "dev"} {
+		cfg, err := loadTestConfig(t, envTestBase+"environment: "+env+`
+rules:
+  - name: prod-writes
+    paths: ["secret/"]
+    severity: warning
+    when: '{{eq .Environment "prod"}}'
+    message: "Written in {{.Environment}}."
+`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent := captureAlerts(t)
+		before := metricValue("alerts_total", "rule", "prod-writes", "severity", "warning", "environment", env)
+		out := captureStdout(t, func() { newAuditor(cfg).processAuditLine(ruleLine("secret/data/app", "update")) })
+		alerts := sent()
+		if env == "dev" {
+			if len(alerts) != 0 {
+				t.Errorf("dev: alerts = %q, want the condition to hold them back", alertRules(alerts))
+			}
+			continue
+		}
+		if len(alerts) != 1 || !strings.Contains(alerts[0].Description, "Written in prod.") || alerts[0].Environment != "prod" {
+			t.Fatalf("prod: alerts = %+v", alerts)
+		}
+		if d := metricValue("alerts_total", "rule", "prod-writes", "severity", "warning", "environment", "prod") - before; d != 1 {
+			t.Errorf("alerts_total{environment=prod} grew by %v", d)
+		}
+		if !strings.Contains(out, "Rule prod-writes: oidc-alice -> secret/data/app") || !strings.Contains(out, "[environment=prod]") {
+			t.Errorf("log = %q, want the environment", out)
+		}
+	}
+}
+
+// {{.RequestID}} is the audit entry's request ID, so a message can name
+// the request to look up.
+func TestRuleRequestID(t *testing.T) {
+	cfg, err := loadTestConfig(t, envTestBase+`
+rules:
+  - name: secret-writes
+    paths: ["secret/"]
+    message: "See request {{md .RequestID}}."
+    when: '{{ne .RequestID ""}}'
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := captureAlerts(t)
+	a := newAuditor(cfg)
+	a.processAuditLine(ruleLine("secret/data/app", "update"))
+	a.processAuditLine(strings.Replace(ruleLine("secret/data/app", "update"), `"id":"r-1",`, "", 1))
+	alerts := sent()
+	if len(alerts) != 1 || !strings.Contains(alerts[0].Description, `See request r\-1.`) || alerts[0].RequestID != "r-1" {
+		t.Errorf("alerts = %+v, want one naming request r-1", alerts)
+	}
+}
+
+// A rule can match on the level the sensitivity map gives the path.
+func TestRuleSensitivity(t *testing.T) {
+	cfg, err := loadTestConfig(t, envTestBase+`
+sensitivity:
+  paths:
+    secret/: low
+    secret/data/prod/: high
+rules:
+  - name: high-reads
+    paths: ["secret/", "kv/"]
+    when: '{{eq .Sensitivity "high"}}'
+    message: "A {{.Sensitivity}} path was read."
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{
+		"secret/data/prod/db":  "high-reads",
+		"/secret/data/prod/db": "high-reads",
+		"secret/data/dev/db":   "",
+		"kv/data/prod/db":      "",
+	} {
+		sent := captureAlerts(t)
+		newAuditor(cfg).processAuditLine(ruleLine(path, "read"))
+		alerts := sent()
+		if got := alertRules(alerts); got != want {
+			t.Errorf("%s fired %q, want %q", path, got, want)
+			continue
+		}
+		if want != "" && (!strings.Contains(alerts[0].Description, "A high path was read.") || alerts[0].Sensitivity != "high") {
+			t.Errorf("%s: alert = %+v", path, alerts[0])
+		}
+	}
+}
+
+// Without rules in the config the two paths vault-warden always alerted
+// on still alert.
+func TestDefaultRules(t *testing.T) {
+	cfg, err := loadTestConfig(t, envTestBase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Rules) != 1 || cfg.Rules[0].Name != "privileged-access" {
+		t.Fatalf("rules = %+v, want the default set", cfg.Rules)
+	}
+	for path, want := range map[string]string{
+		"pki/sign/root":           "privileged-access",
+		"database/creds/admin":    "privileged-access",
+		"database/creds/readonly": "",
+		"secret/data/app":         "",
+	} {
+		sent := captureAlerts(t)
+		newAuditor(cfg).processAuditLine(ruleLine(path, "read"))
+		alerts := sent()
+		if got := alertRules(alerts); got != want {
+			t.Errorf("%s fired %q, want %q", path, got, want)
+		}
+		if want != "" && (alerts[0].Severity != sevCritical || alerts[0].Title != defaultAlertRules[0].Title) {
+			t.Errorf("%s: %s %q, want the default rule's critical alert", path, alerts[0].Severity, alerts[0].Title)
+		}
+	}
+
+	// An empty list is a choice, not unset.
+	cfg, err = loadTestConfig(t, envTestBase+"rules: []\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Rules) != 0 {
+		t.Errorf("rules: [] gave %d rules, want none", len(cfg.Rules))
+	}
+}
+
+func TestValidateRulesAtLoad(t *testing.T) {
+	tests := []struct {
+		rules string
+		want  string
+	}{
+		{"  - name: ok\n    paths: [secret/]\n", ""},
+		{"  - paths: [secret/]\n", "rules[0].name is required"},
+		{"  - name: a\n    paths: [x]\n  - name: a\n    paths: [y]\n", `rules[1].name duplicate rule name "a"`},
+		{"  - name: unseal\n    paths: [x]\n", `rules[0].name "unseal" is the name of a built-in rule`},
+		{"  - name: a\n", "rules[0].paths or path_regex is required"},
+		{"  - name: a\n    paths: []\n", "rules[0].paths or path_regex is required"},
+		{"  - name: a\n    paths: [x, \"\"]\n", "rules[0].paths[1] must not be empty; it would match every path"},
+		{"  - name: a\n    path_regex: \"(\"\n", "rules[0].path_regex rule a: error parsing regexp"},
+		{"  - name: a\n    path_regex: \".*\"\n", "rules[0].path_regex rule a: matches the empty path, so every path"},
+		{"  - name: a\n    paths: [x]\n    severity: urgent\n", `rules[0].severity unknown severity "urgent" (want info, warning or critical)`},
+		{"  - name: a\n    paths: [x]\n    severity: WARNING\n", ""},
+		{"  - name: a\n    paths: [x]\n    cooldown: -1m\n", "rules[0].cooldown must be positive, or 0 for none"},
+		{"  - name: a\n    paths: [x]\n    message: \"{{.Nope}}\"\n", "rules[0].message"},
+		{"  - name: a\n    paths: [x]\n    message: \"{{\"\n", "rules[0].message"},
+	}
+	for _, tt := range tests {
+		_, err := loadTestConfig(t, envTestBase+"rules:\n"+tt.rules)
+		if got := errString(err); tt.want == "" && got != "" || !strings.Contains(got, tt.want) {
+			t.Errorf("rules:\n%s: err = %q, want %q", tt.rules, got, tt.want)
+		}
+	}
+}
+
+func TestRulePathRegex(t *testing.T) {
+	tests := []struct {
+		regex, path string
+		match       bool
+		message     string
+	}{
+		{`^database/creds/admin$`, "database/creds/admin", true, ""},
+		{`^database/creds/admin$`, "database/creds/admin-readonly", false, ""},
+		{`^database/creds/admin$`, "ns1/database/creds/admin", false, ""},
+		{`database/creds/admin$`, "ns1/database/creds/admin", true, ""},
+		{`creds/admin`, "database/creds/admin-readonly", true, ""}, // unanchored, like a substring
+		{`^database/creds/(?P<role>[^/]+)$`, "database/creds/payments-rw", true, "role payments\\-rw"},
+		{`^database/creds/(?P<role>[^/]+)$`, "database/creds/a/b", false, ""},
+		{`^(\w+)/creds/(?P<role>[^/]+)$`, "mysql/creds/reader", true, "mount mysql role reader"},
+	}
+	for _, tt := range tests {
+		message := "matched"
+		if strings.Contains(tt.regex, "(") {
+			message = "{{with index .Match \"1\"}}{{if ne . $.Match.role}}mount {{md .}} {{end}}{{end}}role {{md .Match.role}}"
+		}
+		cfg, err := loadTestConfig(t, envTestBase+"rules:\n  - name: creds\n    path_regex: '"+tt.regex+"'\n    message: '"+message+"'\n")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.regex, err)
+		}
+		sent := captureAlerts(t)
+		newAuditor(cfg).processAuditLine(ruleLine(tt.path, "read"))
+		alerts := sent()
+		if (len(alerts) == 1) != tt.match {
+			t.Errorf("%s on %s: %d alerts, want match %v", tt.regex, tt.path, len(alerts), tt.match)
+			continue
+		}
+		if tt.message != "" && !strings.Contains(alerts[0].Description, tt.message) {
+			t.Errorf("%s on %s: description %q, want %q", tt.regex, tt.path, alerts[0].Description, tt.message)
+		}
+	}
+}
+
+// A template naming a group the regex doesn't have fails the load, with
+// the rule's field.
+func TestRulePathRegexUnknownGroup(t *testing.T) {
+	_, err := loadTestConfig(t, envTestBase+`rules:
+  - name: creds
+    path_regex: '^database/creds/(?P<role>[^/]+)$'
+    message: '{{.Match.rol}}'
+`)
+	if err == nil || !strings.Contains(err.Error(), "rules[0].message") || !strings.Contains(err.Error(), `"rol"`) {
+		t.Errorf("err = %v, want the misspelt group rejected", err)
+	}
+}
+
+// ruleTestPaths are the corpus's paths and a spread of variations on the
+// ones rules are written for.
+func ruleTestPaths(t testing.TB) []string {
+	paths := []string{"", "/", "database/creds/admin", "database/creds/admin-readonly", "database/creds/admin/", "ns1/database/creds/admin",
+		"database/creds/Admin", "database/credsXadmin", "pki/sign/root", "pki/root/sign-self-issued", "sign/root", "secret/data/été/creds/admin",
+		"sys/policies/acl/root", "auth/token/create", "a.b", "a+b", "(x)"}
+	for _, line := range auditCorpus(t) {
+		if e, err := decodeAuditEntry(line); err == nil {
+			paths = append(paths, e.Request.Path)
+		}
+	}
+	for _, mount := range []string{"database", "mysql", "pki_int", "kv-v2"} {
+		for _, role := range []string{"admin", "admin-readonly", "readonly", "a/b", "x.y"} {
+			paths = append(paths, mount+"/creds/"+role, mount+"/sign/"+role, mount+"/"+role)
+		}
+	}
+	return paths
+}
+
+func matches(r *alertRule, path string) bool {
+	var e AuditEntry
+	e.Request.Path, e.Request.Operation = path, "read"
+	_, ok := r.match(&e)
+	return ok
+}
+
+// Differential: a quoted substring as path_regex matches exactly what
+// the substring does, anchoring it matches the path alone, and adding
+// groups changes what's captured, not what matches.
+func TestRulePathRegexDifferential(t *testing.T) {
+	paths := ruleTestPaths(t)
+	for _, s := range []string{"sign/root", "database/creds/admin", "creds/", "a.b", "a+b", "(x)", "/", "été"} {
+		rules := compileAlertRules([]AlertRule{
+			{Name: "substring", Paths: []string{s}},
+			{Name: "quoted", PathRegex: regexp.QuoteMeta(s)},
+			{Name: "anchored", PathRegex: "^" + regexp.QuoteMeta(s) + "$"},
+		})
+		for _, p := range paths {
+			sub, quoted, anchored := matches(&rules[0], p), matches(&rules[1], p), matches(&rules[2], p)
+			if sub != strings.Contains(p, s) || quoted != sub {
+				t.Errorf("%q on %q: substring %v, quoted regex %v", s, p, sub, quoted)
+			}
+			if anchored != (p == s) {
+				t.Errorf("^%s$ on %q: %v", s, p, anchored)
+			}
+		}
+	}
+
+	for _, pair := range [][2]string{
+		{`^database/creds/[^/]+$`, `^database/creds/(?P<role>[^/]+)$`},
+		{`^[^/]+/creds/[^/]+$`, `^([^/]+)/creds/(?P<role>[^/]+)$`},
+		{`/sign/`, `/(sign)/`},
+	} {
+		rules := compileAlertRules([]AlertRule{{Name: "plain", PathRegex: pair[0]}, {Name: "groups", PathRegex: pair[1]}})
+		re := regexp.MustCompile(pair[1])
+		for _, p := range paths {
+			var e AuditEntry
+			e.Request.Path = p
+			_, plain := rules[0].match(&e)
+			groups, ok := rules[1].match(&e)
+			if plain != ok {
+				t.Errorf("%q: %s %v, %s %v", p, pair[0], plain, pair[1], ok)
+			}
+			if ok && groups["1"] != re.FindStringSubmatch(p)[1] {
+				t.Errorf("%q: group 1 = %q, want %q", p, groups["1"], re.FindStringSubmatch(p)[1])
+			}
+		}
+	}
+}
+
+func BenchmarkRuleMatch(b *testing.B) {
+	paths := ruleTestPaths(b)
+	for _, bc := range []struct {
+		name string
+		rule AlertRule
+	}{
+		{"substrings", AlertRule{Name: "r", Paths: []string{"sign/root", "database/creds/admin"}}},
+		{"regex", AlertRule{Name: "r", PathRegex: `^database/creds/admin$`}},
+		{"regex-groups", AlertRule{Name: "r", PathRegex: `^(?P<mount>[^/]+)/creds/(?P<role>[^/]+)$`}},
+		{"substring-then-regex", AlertRule{Name: "r", Paths: []string{"sign/root"}, PathRegex: `^database/creds/admin$`}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			r := compileAlertRules([]AlertRule{bc.rule})[0]
+			entries := make([]AuditEntry, len(paths))
+			for i, p := range paths {
+				entries[i].Request.Path = p
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r.match(&entries[i%len(entries)])
+			}
+		})
+	}
+}
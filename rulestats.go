@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Rule Efficacy ---
+
+const (
+	defaultRuleHorizon = 90 * 24 * time.Hour
+	// ruleStatsWindow is the shortest span the daily counts are kept for,
+	// so the 30-day count holds with a shorter horizon.
+	ruleStatsWindow = 30 * 24 * time.Hour
+	ruleReportTop   = 15
+)
+
+// RuleStatsConfig keeps per-rule counts across restarts, so rules that
+// no longer match anything can be found and removed.
+type RuleStatsConfig struct {
+	Disabled bool `yaml:"disabled"`
+	// Horizon is how long a rule may go without matching before it is
+	// listed as a candidate for removal; default 90d.
+	Horizon Duration `yaml:"horizon"`
+	Report  string   `yaml:"report"` // cron for the report; unset, none is sent
+}
+
+// ruleStat is what is known of one rule. Daily counts matches per UTC
+// day, kept for the horizon.
+type ruleStat struct {
+	Since     time.Time        `json:"since"` // first tracked
+	Matches   int64            `json:"matches"`
+	Daily     map[string]int64 `json:"daily,omitempty"`
+	LastMatch time.Time        `json:"last_match"`
+	// Suppressed counts matches that sent nothing, by reason: "when" for
+	// the rule's condition, "cooldown" for repeats held back.
+	Suppressed map[string]int64 `json:"suppressed,omitempty"`
+	// NearMisses counts entries on the rule's paths with an operation
+	// the rule doesn't list.
+	NearMisses int64 `json:"near_misses,omitempty"`
+	// Notified and LatencyMS give the average time from audit entry to
+	// delivered notification.
+	Notified  int64   `json:"notified,omitempty"`
+	LatencyMS float64 `json:"latency_ms,omitempty"`
+}
+
+// ruleStatsTracker counts on the hot path under one lock and saves to the
+// state file once a minute and on shutdown.
+type ruleStatsTracker struct {
+	cfg   RuleStatsConfig
+	rules *ruleSet
+	store *stateStore
+
+	mu    sync.Mutex
+	stats map[string]*ruleStat
+	day   int64 // of dayKey, in days since the epoch
+	key   string
+}
+
+// ruleStats is audit mode's tracker, for the notification latency
+// recorded when the queue delivers; nil elsewhere.
+var ruleStats *ruleStatsTracker
+
+func newRuleStats(cfg *VaultConfig, rules *ruleSet) *ruleStatsTracker {
+	if cfg.RuleStats.Disabled {
+		return nil
+	}
+	t := &ruleStatsTracker{cfg: cfg.RuleStats, rules: rules, store: newStateStore(cfg.StateFile), stats: make(map[string]*ruleStat)}
+	if st, err := t.store.load(); err != nil {
+		logWarn("⚠️  Rule stats: could not load saved counts: {error}", "error", err)
+	} else if st.RuleStats != nil {
+		t.stats = st.RuleStats
+	}
+	return t
+}
+
+// stat returns name's record, starting one; t.mu is held.
+func (t *ruleStatsTracker) stat(name string, now time.Time) *ruleStat {
+	s := t.stats[name]
+	if s == nil {
+		s = &ruleStat{Since: now.UTC()}
+		t.stats[name] = s
+	}
+	return s
+}
+
+// dayKey is now's UTC date, formatted only when the day changes; t.mu is
+// held.
+func (t *ruleStatsTracker) dayKey(now time.Time) string {
+	if day := now.Unix() / 86400; day != t.day || t.key == "" {
+		t.day, t.key = day, now.UTC().Format(reviewDayFormat)
+	}
+	return t.key
+}
+
+func (t *ruleStatsTracker) matched(name string) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	t.mu.Lock()
+	s := t.stat(name, now)
+	s.Matches++
+	s.LastMatch = now.UTC()
+	if s.Daily == nil {
+		s.Daily = make(map[string]int64)
+	}
+	s.Daily[t.dayKey(now)]++
+	t.mu.Unlock()
+}
+
+func (t *ruleStatsTracker) suppressed(name, reason string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	s := t.stat(name, time.Now())
+	if s.Suppressed == nil {
+		s.Suppressed = make(map[string]int64)
+	}
+	s.Suppressed[reason]++
+	t.mu.Unlock()
+}
+
+func (t *ruleStatsTracker) nearMiss(name string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.stat(name, time.Now()).NearMisses++
+	t.mu.Unlock()
+}
+
+// delivered records how long a rule's alert took from its audit entry to
+// the notifier.
+func (t *ruleStatsTracker) delivered(a Alert) {
+	if t == nil || a.RequestID == "" || a.Time.IsZero() {
+		return
+	}
+	d := time.Since(a.Time)
+	t.mu.Lock()
+	if s := t.stats[a.Rule]; s != nil && d >= 0 {
+		s.Notified++
+		s.LatencyMS += ms(d)
+	}
+	t.mu.Unlock()
+}
+
+// save starts a record for every configured rule, drops those of rules
+// no longer configured and the days past the horizon, and writes the
+// rest to the state file.
+func (t *ruleStatsTracker) save() error {
+	if t == nil {
+		return nil
+	}
+	now := time.Now()
+	keep := time.Duration(t.cfg.Horizon)
+	if keep < ruleStatsWindow {
+		keep = ruleStatsWindow
+	}
+	oldest := now.Add(-keep).UTC().Format(reviewDayFormat)
+	t.mu.Lock()
+	configured := make(map[string]bool)
+	for _, r := range t.rules.load() {
+		configured[r.Name] = true
+		t.stat(r.Name, now)
+	}
+	out := make(map[string]*ruleStat, len(t.stats))
+	for name, s := range t.stats {
+		if !configured[name] {
+			delete(t.stats, name)
+			continue
+		}
+		for day := range s.Daily {
+			if day < oldest {
+				delete(s.Daily, day)
+			}
+		}
+		cp := *s
+		cp.Daily = make(map[string]int64, len(s.Daily))
+		for day, n := range s.Daily {
+			cp.Daily[day] = n
+		}
+		cp.Suppressed = make(map[string]int64, len(s.Suppressed))
+		for reason, n := range s.Suppressed {
+			cp.Suppressed[reason] = n
+		}
+		out[name] = &cp
+	}
+	t.mu.Unlock()
+	return t.store.update(func(st *wardenState) { st.RuleStats = out })
+}
+
+func ruleStatsJob(t *ruleStatsTracker) jobSpec {
+	return jobSpec{
+		name:    "rule-stats",
+		every:   time.Minute,
+		timeout: 10 * time.Second,
+		run:     func(ctx context.Context) error { return t.save() },
+	}
+}
+
+// within counts the matches of the days since now less d.
+func (s *ruleStat) within(now time.Time, d time.Duration) int64 {
+	from := now.Add(-d).UTC().Format(reviewDayFormat)
+	var n int64
+	for day, c := range s.Daily {
+		if day > from {
+			n += c
+		}
+	}
+	return n
+}
+
+// deadFor reports whether s has been tracked for the horizon without a
+// match in it.
+func (s *ruleStat) deadFor(now time.Time, horizon time.Duration) bool {
+	return now.Sub(s.Since) >= horizon && now.Sub(s.LastMatch) >= horizon
+}
+
+// latency is the average time to notify, or zero.
+func (s *ruleStat) latency() time.Duration {
+	if s.Notified == 0 {
+		return 0
+	}
+	return time.Duration(s.LatencyMS / float64(s.Notified) * float64(time.Millisecond))
+}
+
+func (s *ruleStat) suppressedTotal() int64 {
+	var n int64
+	for _, c := range s.Suppressed {
+		n += c
+	}
+	return n
+}
+
+var (
+	msgRuleReport     = message("rule-stats.report.title")
+	msgRuleReportBody = message("rule-stats.report.body")
+	msgRuleReportRule = message("rule-stats.report.rule")
+	msgRuleReportMore = message("rule-stats.report.more")
+	msgRuleReportDead = message("rule-stats.report.dead")
+	msgRuleReportIdle = message("rule-stats.report.idle")
+	msgRuleReportNear = message("rule-stats.report.near")
+)
+
+// report is the notification of the week's matches by rule, busiest
+// first, and the rules without a match in the horizon. It is a warning
+// when there are any of those.
+func (t *ruleStatsTracker) report(now time.Time) Alert {
+	horizon := time.Duration(t.cfg.Horizon)
+	t.mu.Lock()
+	type row struct {
+		name string
+		week int64
+		s    ruleStat
+	}
+	var rows []row
+	for _, r := range t.rules.load() {
+		s := t.stat(r.Name, now)
+		rows = append(rows, row{r.Name, s.within(now, 7*24*time.Hour), *s})
+	}
+	t.mu.Unlock()
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].week > rows[j].week })
+
+	var lines, dead []localText
+	var console []string
+	live := 0
+	for _, r := range rows {
+		name := mdCode(r.name, maxNameLen)
+		if r.s.deadFor(now, horizon) {
+			item := msgRuleReportIdle.with("rule", name)
+			if r.s.NearMisses > 0 {
+				item = msgRuleReportNear.with("rule", name, "count", r.s.NearMisses)
+			}
+			dead = append(dead, item)
+			console = append(console, r.name)
+			continue
+		}
+		if live++; live <= ruleReportTop {
+			lines = append(lines, msgRuleReportRule.with("rule", name, "week", r.week,
+				"suppressed", r.s.suppressedTotal(), "latency", formatLatency(r.s.latency())))
+		}
+	}
+	if live > ruleReportTop {
+		lines = append(lines, msgRuleReportMore.with("count", live-ruleReportTop))
+	}
+	desc := msgRuleReportBody.with("rules", lines)
+	sev := sevInfo
+	if len(dead) > 0 {
+		sev = sevWarning
+		logWarn("⚠️  Rule stats: no match in {horizon}: {rules}", "horizon", formatDuration(horizon), "rules", strings.Join(console, ", "))
+		desc = msgRuleReportDead.with("report", desc, "horizon", formatDuration(horizon), "rules", dead)
+	}
+	return Alert{Severity: sev, Color: sev.color(), Rule: "rule-stats-report"}.say(msgRuleReport.with(), desc)
+}
+
+func ruleReportJob(cfg *VaultConfig, t *ruleStatsTracker) jobSpec {
+	spec := jobSpec{
+		name:    "rule-stats-report",
+		timeout: time.Minute,
+		run:     func(ctx context.Context) error { return notify(cfg, t.report(time.Now())) },
+	}
+	spec.cron, _ = parseCron(t.cfg.Report) // validated at load
+	return spec
+}
+
+// --- Command: Rules ---
+
+// ruleListing is a rule as rules list prints it with -json.
+type ruleListing struct {
+	Name       string        `json:"name"`
+	Severity   string        `json:"severity"`
+	Paths      []string      `json:"paths,omitempty"`
+	PathRegex  string        `json:"path_regex,omitempty"`
+	Operations []string      `json:"operations,omitempty"`
+	Stats      *ruleStatView `json:"stats,omitempty"`
+}
+
+// ruleStatView is a saved ruleStat with the windowed counts worked out.
+type ruleStatView struct {
+	*ruleStat
+	Last7d     int64   `json:"matches_7d"`
+	Last30d    int64   `json:"matches_30d"`
+	InHorizon  int64   `json:"matches_in_horizon"`
+	AvgLatency float64 `json:"avg_latency_ms,omitempty"`
+	Candidate  bool    `json:"removal_candidate"`
+}
+
+func runRules(cfg *VaultConfig, args []string) error {
+	if len(args) < 1 || args[0] != "list" {
+		return fmt.Errorf("usage: vault-warden rules list [-stats] [-json]")
+	}
+	fs := flagSet("rules list")
+	withStats := fs.Bool("stats", false, "Show match counts, suppressions, near misses and latency")
+	asJSON := fs.Bool("json", false, "Print one JSON object per rule")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	var saved map[string]*ruleStat
+	if *withStats {
+		if cfg.RuleStats.Disabled {
+			return fmt.Errorf("rule_stats is disabled")
+		}
+		st, err := newStateStore(cfg.StateFile).load()
+		if err != nil {
+			return err
+		}
+		saved = st.RuleStats
+	}
+	now, horizon := time.Now(), time.Duration(cfg.RuleStats.Horizon)
+	enc := json.NewEncoder(os.Stdout)
+	for _, r := range cfg.Rules {
+		l := ruleListing{Name: r.Name, Severity: r.Severity, Paths: r.Paths, PathRegex: r.PathRegex, Operations: r.Operations}
+		s := saved[r.Name]
+		if *withStats && s != nil {
+			l.Stats = &ruleStatView{s, s.within(now, 7*24*time.Hour), s.within(now, 30*24*time.Hour), s.within(now, horizon), ms(s.latency()), s.deadFor(now, horizon)}
+		}
+		if *asJSON {
+			if err := enc.Encode(l); err != nil {
+				return err
+			}
+			continue
+		}
+		match := strings.Join(r.Paths, ", ")
+		if r.PathRegex != "" {
+			match = strings.TrimPrefix(match+", /"+r.PathRegex+"/", ", ")
+		}
+		ops := "any operation"
+		if len(r.Operations) > 0 {
+			ops = strings.Join(r.Operations, ", ")
+		}
+		fmt.Printf("%s [%s]: %s (%s)\n", r.Name, r.Severity, match, ops)
+		if !*withStats {
+			continue
+		}
+		if s == nil {
+			fmt.Println("  no stats yet; the audit daemon records them")
+			continue
+		}
+		last := "never"
+		if !s.LastMatch.IsZero() {
+			last = s.LastMatch.Local().Format(time.RFC3339)
+		}
+		fmt.Printf("  matches: %d total, %d in 7d, %d in 30d, %d in %s; last %s\n",
+			s.Matches, l.Stats.Last7d, l.Stats.Last30d, l.Stats.InHorizon, formatDuration(horizon), last)
+		fmt.Printf("  held back: %d by when, %d by cooldown; near misses: %d", s.Suppressed["when"], s.Suppressed["cooldown"], s.NearMisses)
+		if s.Notified > 0 {
+			fmt.Printf("; notified in %s on average", formatLatency(s.latency()))
+		}
+		fmt.Println()
+		switch {
+		case l.Stats.Candidate && s.NearMisses > 0:
+			fmt.Printf("  ⚠️  no match in %s, but %d near misses: the operations may be too narrow\n", formatDuration(horizon), s.NearMisses)
+		case l.Stats.Candidate:
+			fmt.Printf("  ⚠️  no match in %s: a candidate for removal\n", formatDuration(horizon))
+		}
+	}
+	return nil
+}
+
+func validateRuleStats(cfg *VaultConfig) error {
+	rs := &cfg.RuleStats
+	if rs.Horizon == 0 {
+		rs.Horizon = Duration(defaultRuleHorizon)
+	}
+	if rs.Horizon < Duration(24*time.Hour) {
+		return &fieldError{"rule_stats.horizon", "must be at least 1d"}
+	}
+	if rs.Report != "" {
+		if _, err := parseCron(rs.Report); err != nil {
+			return &fieldError{"rule_stats.report", err.Error()}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// --- Rule Thresholds ---
+
+const (
+	groupByDisplayName   = "display_name"
+	groupByRemoteAddress = "remote_address"
+	// maxThresholdCount bounds the entries a threshold rule keeps per
+	// group, one more than its count.
+	maxThresholdCount = 100000
+	// maxThresholdGroups bounds the groups a threshold rule keeps windows
+	// for, and maxThresholdEntries the entries across them.
+	maxThresholdGroups  = 10000
+	maxThresholdEntries = 1000000
+	// thresholdTopOffenders is how many offenders a threshold alert
+	// lists.
+	thresholdTopOffenders = 5
+)
+
+// RuleThreshold makes a rule fire once more than Count of one group's
+// entries fall within Window, e.g. fifty failed logins from one address in
+// two minutes, instead of for each entry. Vault writes a request and a response entry for each
+// call; only the response, which carries the outcome, is counted.
+type RuleThreshold struct {
+	Count  int      `yaml:"count"`
+	Window Duration `yaml:"window"`
+	// GroupBy is what entries are counted by: display_name, the default,
+	// or remote_address.
+	GroupBy string `yaml:"group_by"`
+	// ErrorsOnly counts only entries with an error, such as the response
+	// to a failed login.
+	ErrorsOnly bool `yaml:"errors_only"`
+}
+
+// thresholdGroup is one group's sliding window: the entry times of the
+// last window, oldest first, never more than count+1.
+type thresholdGroup struct {
+	key   string
+	times []time.Time
+}
+
+// ruleThreshold is a threshold rule's windows, one per group, the least
+// recently counted group evicted first past the rule's group cap. A
+// group going over the count fires and empties only its own window, so
+// an attack that goes on fires again once as many entries more come.
+type ruleThreshold struct {
+	cfg RuleThreshold
+
+	mu     sync.Mutex
+	order  *list.List // of *thresholdGroup; front = most recently counted
+	groups map[string]*list.Element
+}
+
+func newRuleThreshold(cfg *RuleThreshold) *ruleThreshold {
+	if cfg == nil {
+		return nil
+	}
+	return &ruleThreshold{cfg: *cfg, order: list.New(), groups: make(map[string]*list.Element)}
+}
+
+// maxGroups is how many groups the rule keeps windows for: at most
+// maxThresholdGroups, and fewer for a large count so the entries kept
+// stay under maxThresholdEntries.
+func (t *ruleThreshold) maxGroups() int {
+	n := maxThresholdEntries / (t.cfg.Count + 1)
+	if n > maxThresholdGroups {
+		n = maxThresholdGroups
+	}
+	if n < 1 {
+		n = 1
+	}
+	return shedCap(n)
+}
+
+// evictLocked drops least recently counted groups down to limit.
+func (t *ruleThreshold) evictLocked(limit int, rule string) {
+	for t.order.Len() > limit {
+		oldest := t.order.Back()
+		t.order.Remove(oldest)
+		delete(t.groups, oldest.Value.(*thresholdGroup).key)
+		metrics.inc("rule_threshold_evictions_total", "rule", rule)
+	}
+}
+
+var (
+	msgThresholdBody     = message("rule.threshold.body")
+	msgThresholdOffender = message("rule.threshold.offender")
+	msgThresholdByName   = message("rule.threshold.by.display_name")
+	msgThresholdByAddr   = message("rule.threshold.by.remote_address")
+)
+
+// observe counts the entry a raised in its group and returns the
+// threshold alert when it tips that group's window over the count: a,
+// with the count, the window and the top offenders added, the group that
+// fired first. The window slides on entry time, so a replay counts as
+// the log was written.
+func (t *ruleThreshold) observe(a Alert) (Alert, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := a.User
+	if t.cfg.GroupBy == groupByRemoteAddress {
+		key = a.SourceIP
+	}
+	if key == "" {
+		key = "-"
+	}
+	at := a.Time
+	if at.IsZero() {
+		at = time.Now()
+	}
+	el, ok := t.groups[key]
+	if !ok {
+		t.evictLocked(t.maxGroups()-1, a.Rule)
+		el = t.order.PushFront(&thresholdGroup{key: key})
+		t.groups[key] = el
+	}
+	t.order.MoveToFront(el)
+	g := el.Value.(*thresholdGroup)
+
+	// Entries from several audit logs or a forwarding edge arrive slightly
+	// out of order; the window is kept sorted so the oldest go first.
+	newest := at
+	if n := len(g.times); n > 0 && g.times[n-1].After(newest) {
+		newest = g.times[n-1]
+	}
+	cutoff := newest.Add(-time.Duration(t.cfg.Window))
+	if at.Before(cutoff) {
+		return Alert{}, false
+	}
+	i := sort.Search(len(g.times), func(i int) bool { return g.times[i].After(at) })
+	g.times = append(g.times, time.Time{})
+	copy(g.times[i+1:], g.times[i:])
+	g.times[i] = at
+	drop := 0
+	for drop < len(g.times) && g.times[drop].Before(cutoff) {
+		drop++
+	}
+	g.times = g.times[drop:]
+	if len(g.times) <= t.cfg.Count {
+		return Alert{}, false
+	}
+
+	// The group that fired heads the list, followed by the others with
+	// the most entries in their windows as of this one.
+	n := len(g.times)
+	t.order.Remove(el)
+	delete(t.groups, key)
+	counts := map[string]int{key: n}
+	offenders := []string{key}
+	for e := t.order.Front(); e != nil; e = e.Next() {
+		o := e.Value.(*thresholdGroup)
+		c := 0
+		for _, ts := range o.times {
+			if !ts.Before(cutoff) {
+				c++
+			}
+		}
+		if c > 0 {
+			counts[o.key] = c
+			offenders = append(offenders, o.key)
+		}
+	}
+	sort.SliceStable(offenders[1:], func(i, j int) bool { return counts[offenders[i+1]] > counts[offenders[j+1]] })
+	if len(offenders) > thresholdTopOffenders {
+		offenders = offenders[:thresholdTopOffenders]
+	}
+	lines := make([]localText, 0, len(offenders))
+	for _, o := range offenders {
+		lines = append(lines, msgThresholdOffender.with("offender", mdCode(o, maxNameLen), "count", counts[o]))
+	}
+	by := msgThresholdByName.with()
+	if t.cfg.GroupBy == groupByRemoteAddress {
+		by = msgThresholdByAddr.with()
+	}
+	return a.say(localText{}, msgThresholdBody.with("body", a.bodyText(), "count", n, "window", formatDuration(time.Duration(t.cfg.Window)),
+		"by", by, "offenders", lines)), true
+}
+
+// ruleThresholds is the windows of every threshold rule as one cache for
+// the memory guard.
+type ruleThresholds struct{ rules *ruleSet }
+
+// thresholdTimeSize is what an estimate charges per entry time.
+const thresholdTimeSize = 24
+
+func (rt ruleThresholds) usage() cacheUsage {
+	var u cacheUsage
+	rules := rt.rules.load()
+	for i := range rules {
+		if t := rules[i].threshold; t != nil {
+			t.mu.Lock()
+			u.Entries += t.order.Len()
+			for e := t.order.Front(); e != nil; e = e.Next() {
+				g := e.Value.(*thresholdGroup)
+				u.Bytes += cacheEntryOverhead + int64(len(g.key)+len(g.times)*thresholdTimeSize)
+			}
+			t.mu.Unlock()
+		}
+	}
+	return u
+}
+
+// shed drops the least recently counted groups, down to the shrunk cap;
+// their bursts start over.
+func (rt ruleThresholds) shed() {
+	rules := rt.rules.load()
+	for i := range rules {
+		t := rules[i].threshold
+		if t == nil {
+			continue
+		}
+		t.mu.Lock()
+		t.evictLocked(t.maxGroups(), rules[i].Name)
+		t.mu.Unlock()
+	}
+}
+
+func validateRuleThreshold(field string, r *AlertRule) *fieldError {
+	th := r.Threshold
+	if th == nil {
+		return nil
+	}
+	field += ".threshold"
+	if th.Count < 1 || th.Count > maxThresholdCount {
+		return &fieldError{field + ".count", fmt.Sprintf("must be between 1 and %d", maxThresholdCount)}
+	}
+	if th.Window <= 0 {
+		return &fieldError{field + ".window", "is required"}
+	}
+	switch th.GroupBy {
+	case "":
+		th.GroupBy = groupByDisplayName
+	case groupByDisplayName, groupByRemoteAddress:
+	default:
+		return &fieldError{field + ".group_by", fmt.Sprintf("%q is not display_name or remote_address", th.GroupBy)}
+	}
+	if r.Cooldown != 0 {
+		return &fieldError{field, "and cooldown don't mix: a threshold rule fires once per burst already"}
+	}
+	return nil
+}
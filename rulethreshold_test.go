@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func thresholdAlert(user string, at time.Time) Alert {
+	return Alert{Title: "burst", User: user, Time: at}
+}
+
+// Late entries, from a second audit log say, count as long as they fall
+// within the window of the newest.
+func TestThresholdOutOfOrder(t *testing.T) {
+	th := newRuleThreshold(&RuleThreshold{Count: 2, Window: Duration(time.Minute)})
+	base := time.Date(2026, 1, 2, 3, 0, 0, 0, time.UTC)
+	if _, fired := th.observe(thresholdAlert("a", base.Add(50*time.Second))); fired {
+		t.Fatal("fired on the first entry")
+	}
+	// Older than the window of the newest: not counted.
+	if _, fired := th.observe(thresholdAlert("a", base.Add(-20*time.Second))); fired {
+		t.Fatal("fired on an entry outside the window")
+	}
+	if _, fired := th.observe(thresholdAlert("a", base.Add(10*time.Second))); fired {
+		t.Fatal("fired on the second entry")
+	}
+	if times := thresholdTimes(th, "a"); len(times) != 2 || !times[0].Before(times[1]) {
+		t.Fatalf("times = %v, want two in time order", times)
+	}
+	// This one moves the window past the entry at 10s, so it doesn't fire.
+	if _, fired := th.observe(thresholdAlert("a", base.Add(75*time.Second))); fired {
+		t.Fatal("fired with an entry that slid out of the window still counted")
+	}
+	if _, fired := th.observe(thresholdAlert("a", base.Add(60*time.Second))); !fired {
+		t.Fatal("didn't fire with three entries in the window")
+	}
+	if times := thresholdTimes(th, "a"); times != nil {
+		t.Errorf("times = %v after firing, want none", times)
+	}
+}
+
+func thresholdTimes(th *ruleThreshold, key string) []time.Time {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	if el, ok := th.groups[key]; ok {
+		return el.Value.(*thresholdGroup).times
+	}
+	return nil
+}
+
+// Each group counts on its own: many under the count, together over it,
+// don't fire, and one going over fires and starts over alone.
+func TestThresholdGroups(t *testing.T) {
+	for _, groupBy := range []string{groupByDisplayName, groupByRemoteAddress} {
+		th := newRuleThreshold(&RuleThreshold{Count: 3, Window: Duration(time.Minute), GroupBy: groupBy})
+		base := time.Date(2026, 1, 2, 3, 0, 0, 0, time.UTC)
+		at := func(i int) time.Time { return base.Add(time.Duration(i) * time.Second) }
+		entry := func(who string, i int) Alert {
+			a := Alert{Title: "burst", Time: at(i)}
+			if groupBy == groupByRemoteAddress {
+				a.User, a.SourceIP = "oidc-shared", who
+			} else {
+				a.User, a.SourceIP = who, "10.0.0.1"
+			}
+			return a
+		}
+		// Twelve groups of three: 36 entries, each group at the count.
+		for i := 0; i < 36; i++ {
+			if _, fired := th.observe(entry(fmt.Sprintf("g%d", i%12), i)); fired {
+				t.Fatalf("%s: fired on entry %d with no group over the count", groupBy, i)
+			}
+		}
+		a, fired := th.observe(entry("g5", 40))
+		if !fired {
+			t.Fatalf("%s: g5's fourth entry didn't fire", groupBy)
+		}
+		if !strings.Contains(a.Description, "**4 matching entries in 1m.**") || !strings.Contains(a.Description, "`g5` — 4\n`g11` — 3") {
+			t.Errorf("%s: description = %q, want g5's count first, then the others, most recent first", groupBy, a.Description)
+		}
+		if thresholdTimes(th, "g5") != nil || len(thresholdTimes(th, "g6")) != 3 {
+			t.Errorf("%s: g5 = %v, g6 = %v; want only g5 reset", groupBy, thresholdTimes(th, "g5"), thresholdTimes(th, "g6"))
+		}
+		if _, fired := th.observe(entry("g6", 41)); !fired {
+			t.Errorf("%s: g6's fourth entry didn't fire", groupBy)
+		}
+		if _, fired := th.observe(entry("g5", 42)); fired {
+			t.Errorf("%s: g5 fired again on its first entry after firing", groupBy)
+		}
+	}
+}
+
+// The groups a rule keeps are capped, the least recently counted going
+// first, and fewer for a count large enough.
+func TestThresholdGroupCap(t *testing.T) {
+	th := newRuleThreshold(&RuleThreshold{Count: 2, Window: Duration(time.Hour)})
+	base := time.Date(2026, 1, 2, 3, 0, 0, 0, time.UTC)
+	th.observe(thresholdAlert("first", base))
+	th.observe(thresholdAlert("first", base))
+	for i := 0; i < maxThresholdGroups; i++ {
+		th.observe(thresholdAlert(fmt.Sprintf("u%d", i), base.Add(time.Second)))
+	}
+	if th.order.Len() != maxThresholdGroups || thresholdTimes(th, "first") != nil {
+		t.Errorf("%d groups, with first = %v; want the cap and first evicted", th.order.Len(), thresholdTimes(th, "first"))
+	}
+	if _, fired := th.observe(thresholdAlert("first", base.Add(2*time.Second))); fired {
+		t.Error("an evicted group's entries still counted")
+	}
+	if n := newRuleThreshold(&RuleThreshold{Count: maxThresholdCount, Window: Duration(time.Hour)}).maxGroups(); n != maxThresholdEntries/(maxThresholdCount+1) {
+		t.Errorf("maxGroups at the largest count = %d", n)
+	}
+
+	// The memory guard halves the cap.
+	resetShedding(t)
+	atomic.StoreInt32(&shedStage, shedShrink)
+	rules := []alertRule{{threshold: th}}
+	var set ruleSet
+	set.v.Store(rules)
+	ruleThresholds{&set}.shed()
+	if u := (ruleThresholds{&set}).usage(); u.Entries != maxThresholdGroups/2 {
+		t.Errorf("%d groups after shedding, want %d", u.Entries, maxThresholdGroups/2)
+	}
+}
+
+// A call's request and response entry are one attempt.
+func TestThresholdCountsResponsesOnly(t *testing.T) {
+	for _, errorsOnly := range []bool{false, true} {
+		rules := compileAlertRules([]AlertRule{{Name: "spray", Paths: []string{"auth/ldap/login"},
+			Threshold: &RuleThreshold{Count: 2, Window: Duration(time.Minute), ErrorsOnly: errorsOnly}}})
+		r := &rules[0]
+		for _, typ := range []string{"request", "response"} {
+			e := &AuditEntry{Type: typ, Error: "invalid credentials"}
+			e.Request.Path = "auth/ldap/login/alice"
+			if _, ok := r.match(e); ok != (typ == "response") {
+				t.Errorf("errors_only %v: %s entry matched = %v", errorsOnly, typ, ok)
+			}
+		}
+	}
+}
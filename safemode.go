@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// --- Safe Mode ---
+
+// safeModeDecision is why audit mode runs where it does in safe mode, or
+// was forced active anyway. It goes to history_file as the payload of a
+// safe-mode record, so who ran what where can be worked out later.
+type safeModeDecision struct {
+	Host   string    `json:"host"`
+	User   string    `json:"user"`
+	PID    int       `json:"pid"`
+	Config string    `json:"config,omitempty"`
+	Time   time.Time `json:"time"`
+	// Reason is why this doesn't look like the instance that should
+	// alert; empty when it does.
+	Reason string `json:"reason,omitempty"`
+	Forced bool   `json:"forced,omitempty"` // by -force-active
+	// StateDir is where state goes instead of state_file.
+	StateDir string `json:"state_dir,omitempty"`
+}
+
+func (d *safeModeDecision) safe() bool { return d != nil && d.Reason != "" && !d.Forced }
+
+// safeMode is audit mode's decision, for /statusz; nil elsewhere.
+var safeMode *safeModeDecision
+
+var (
+	msgSafeMode       = message("safe-mode.title")
+	msgSafeModeBody   = message("safe-mode.body")
+	msgForcedActive   = message("safe-mode.forced.title")
+	msgForcedActiveBy = message("safe-mode.forced.body")
+)
+
+// instanceLockFile is held by the audit process using state_file for as
+// long as it runs.
+func instanceLockFile(stateFile string) string {
+	return strings.TrimSuffix(stateFile, filepath.Ext(stateFile)) + ".instance.lock"
+}
+
+// detectForeign decides whether audit mode runs here for real: the host
+// must be one of expected_hosts, when set, and no other process may hold
+// the instance lock. The lock comes back held unless the decision is
+// safe mode; closing the file releases it.
+func detectForeign(doc *configDoc, cfg *VaultConfig, force bool) (*safeModeDecision, *os.File) {
+	d := &safeModeDecision{PID: os.Getpid(), Time: time.Now().UTC(), Forced: force}
+	if doc != nil {
+		d.Config = doc.path
+		if d.Config == "" {
+			d.Config = doc.dir
+		}
+		if abs, err := filepath.Abs(d.Config); err == nil && d.Config != "" {
+			d.Config = abs
+		}
+	}
+	d.Host, _ = os.Hostname()
+	d.User = os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		d.User = u.Username
+	}
+	if len(cfg.ExpectedHosts) > 0 && !hostExpected(cfg.ExpectedHosts, d.Host) {
+		d.Reason = fmt.Sprintf("host %s is not in expected_hosts (%s)", d.Host, strings.Join(cfg.ExpectedHosts, ", "))
+	}
+	lock, holder, err := lockInstance(instanceLockFile(newStateStore(cfg.StateFile).path), d)
+	switch {
+	case holder != "":
+		if d.Reason == "" {
+			d.Reason = "another instance holds the state file: " + holder
+		}
+	case err != nil:
+		// Not being able to lock is no sign of another instance, and a
+		// state dir that can't be written fails later anyway.
+		logDebug("🔍 Instance lock not taken: {error}", "error", err)
+	}
+	if d.safe() && lock != nil {
+		lock.Close()
+		lock = nil
+	}
+	return d, lock
+}
+
+// hostExpected matches host against expected_hosts, which may be glob
+// patterns such as vault-*.
+func hostExpected(patterns []string, host string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, host); ok || strings.EqualFold(p, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// lockInstance takes the instance lock without waiting and writes who
+// holds it into the file. When another process has it, holder says who.
+func lockInstance(file string, d *safeModeDecision) (lock *os.File, holder string, err error) {
+	if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+		return nil, "", err
+	}
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		defer f.Close()
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, "", err
+		}
+		who, _ := io.ReadAll(io.LimitReader(f, 512))
+		if s := strings.TrimSpace(string(who)); s != "" {
+			return nil, fmt.Sprintf("%s (%s)", file, s), nil
+		}
+		return nil, file, nil
+	}
+	if err := f.Truncate(0); err == nil {
+		fmt.Fprintf(f, "pid %d on %s by %s since %s\n", d.PID, d.Host, d.User, d.Time.Format(time.RFC3339))
+	}
+	return f, "", nil
+}
+
+// enterSafeMode points cfg away from everything the real instance owns:
+// state goes to a temp dir seeded with a copy of it, alerts are printed
+// rather than sent, and the canary, Discord details, forwarding, outbox,
+// sinks and listeners are off. History is kept, for the record.
+func enterSafeMode(cfg *VaultConfig, d *safeModeDecision) error {
+	dir, err := os.MkdirTemp("", "vault-warden-safe-")
+	if err != nil {
+		return fmt.Errorf("safe mode: %w", err)
+	}
+	d.StateDir = dir
+	moved := func(file string) string {
+		if file == "" {
+			return ""
+		}
+		to := filepath.Join(dir, filepath.Base(file))
+		if data, err := os.ReadFile(file); err == nil {
+			if err := os.WriteFile(to, data, 0o600); err != nil {
+				logWarn("⚠️  Safe mode: could not copy {path}: {error}", "path", file, "error", err)
+			}
+		}
+		return to
+	}
+	cfg.StateFile = moved(newStateStore(cfg.StateFile).path)
+	for i := range cfg.Vaults {
+		cfg.Vaults[i].StateFile = moved(cfg.Vaults[i].StateFile)
+	}
+	if !cfg.Position.Disabled {
+		cfg.Position.Path = moved(cfg.Position.Path)
+	}
+	cfg.ReviewExport.Table = moved(cfg.ReviewExport.Table)
+	cfg.Admin.Socket = filepath.Join(dir, "admin.sock")
+	if cfg.AuditSource == auditSourceSocket {
+		cfg.AuditSocket.Listen = filepath.Join(dir, "audit.sock")
+	}
+
+	cfg.Canary.Token = ""
+	cfg.Details = DetailsConfig{}
+	cfg.Forward.Address = ""
+	cfg.Queue.Outbox.Path = ""
+	cfg.MQTT.Broker, cfg.Grafana.URL, cfg.PagerDuty.RoutingKey, cfg.Metrics.StatsD.Address = "", "", "", ""
+	cfg.Admin.Listen, cfg.MetricsListen, cfg.Receive.Listen = "", "", ""
+	return nil
+}
+
+// announceSafeMode prints the banner and records the decision in the
+// history. A forced start is notified as well, so on-call sees who
+// overrode safe mode where.
+func announceSafeMode(cfg *VaultConfig, d *safeModeDecision) {
+	if d.Reason == "" {
+		return
+	}
+	payload, _ := json.Marshal(d)
+	if d.Forced {
+		logWarn("⚠️  -force-active: starting for real although {reason}", "reason", d.Reason, "host", d.Host, "user", d.User)
+		a := Alert{Severity: sevWarning, Color: sevWarning.color(), Rule: "safe-mode"}.say(msgForcedActive.with("host", mdCode(d.Host, maxNameLen)),
+			msgForcedActiveBy.with("user", mdCode(d.User, maxNameLen), "host", mdCode(d.Host, maxNameLen), "reason", mdText(d.Reason, maxPathLen)))
+		history.record("safe-mode", a, payload, nil)
+		notify(cfg, a)
+		return
+	}
+	const rule = "🧪 ============================================================"
+	logWarn(rule)
+	logWarn("🧪 SAFE MODE: {reason}.", "reason", d.Reason, "host", d.Host, "user", d.User)
+	logWarn("🧪 This doesn't look like the instance that should alert, so alerts are")
+	logWarn("🧪 printed here instead of sent, the canary, Discord details, forwarding and")
+	logWarn("🧪 sinks are off, and state goes to {state_dir}.", "state_dir", d.StateDir)
+	logWarn("🧪 If this really must alert, e.g. in an emergency, run again with -force-active.")
+	logWarn(rule)
+	history.record("safe-mode", Alert{Severity: sevInfo, Color: sevInfo.color(), Rule: "safe-mode"}.say(
+		msgSafeMode.with("host", mdCode(d.Host, maxNameLen)),
+		msgSafeModeBody.with("user", mdCode(d.User, maxNameLen), "reason", mdText(d.Reason, maxPathLen))), payload, nil)
+}
+
+// doctorSafeMode says whether audit mode would start in safe mode here
+// now, without taking the lock from a running instance, and lists the
+// safe-mode records in the history.
+func doctorSafeMode(cfg *VaultConfig) []byte {
+	var b strings.Builder
+	host, _ := os.Hostname()
+	fmt.Fprintf(&b, "host: %s\nexpected_hosts: %s\n", host, strings.Join(cfg.ExpectedHosts, ", "))
+	if len(cfg.ExpectedHosts) > 0 && !hostExpected(cfg.ExpectedHosts, host) {
+		fmt.Fprintf(&b, "  not expected: audit would start in safe mode\n")
+	}
+	lockFile := instanceLockFile(newStateStore(cfg.StateFile).path)
+	if f, err := os.Open(lockFile); err == nil {
+		who, _ := io.ReadAll(io.LimitReader(f, 512))
+		state := "held"
+		if syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB) == nil {
+			state = "free, last held"
+		}
+		f.Close()
+		fmt.Fprintf(&b, "instance lock %s: %s (%s)\n", lockFile, state, strings.TrimSpace(string(who)))
+	}
+	b.WriteString("\nsafe-mode records in history_file:\n")
+	if cfg.HistoryFile == "" {
+		b.WriteString("  no history_file\n")
+		return []byte(b.String())
+	}
+	n := 0
+	err := readHistory(cfg.HistoryFile, func(_ int, rec *historyRecord) error {
+		if rec.Backend == "safe-mode" {
+			n++
+			fmt.Fprintf(&b, "  %s %s\n", rec.Time.Format(time.RFC3339), rec.Payload)
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(&b, "  %v\n", err)
+	} else if n == 0 {
+		b.WriteString("  none\n")
+	}
+	return []byte(b.String())
+}
+
+func validateExpectedHosts(cfg *VaultConfig) error {
+	for i, p := range cfg.ExpectedHosts {
+		if _, err := path.Match(p, ""); err != nil || p == "" {
+			return &fieldError{fmt.Sprintf("expected_hosts[%d]", i), fmt.Sprintf("%q is not a host name or glob pattern", p)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+	"sync/atomic"
+)
+
+// --- Sampling ---
+
+// SamplingRule keeps roughly Rate of the entries whose path starts with
+// Path. Sampling only thins secondary features (session indexing, and any
+// export or statistics built on them); alert rules always see every entry.
+type SamplingRule struct {
+	Path string  `yaml:"path"`
+	Rate float64 `yaml:"rate"`
+}
+
+type sampler struct {
+	rules []SamplingRule
+	// dropped[i] counts entries sampled out by rules[i]
+	dropped []uint64
+}
+
+func newSampler(rules []SamplingRule) *sampler {
+	if len(rules) == 0 {
+		return nil
+	}
+	return &sampler{rules: rules, dropped: make([]uint64, len(rules))}
+}
+
+// keep reports whether an entry should reach the sampled features. The
+// decision hashes the raw line, so replaying a file samples identically.
+func (s *sampler) keep(path, line string) bool {
+	if s == nil {
+		return true
+	}
+	i := s.match(path)
+	if i < 0 || s.rules[i].Rate >= 1 {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write([]byte(line))
+	if float64(h.Sum64())/math.MaxUint64 < s.rules[i].Rate {
+		return true
+	}
+	atomic.AddUint64(&s.dropped[i], 1)
+	return false
+}
+
+// match returns the index of the longest rule prefix matching path, or -1.
+func (s *sampler) match(path string) int {
+	best := -1
+	for i, r := range s.rules {
+		if strings.HasPrefix(path, r.Path) && (best < 0 || len(r.Path) > len(s.rules[best].Path)) {
+			best = i
+		}
+	}
+	return best
+}
+
+// summary describes how many entries were sampled out per rule, plus the
+// factor to multiply kept counts by to estimate the real volume.
+func (s *sampler) summary() string {
+	if s == nil {
+		return ""
+	}
+	var parts []string
+	for i, r := range s.rules {
+		if n := atomic.LoadUint64(&s.dropped[i]); n > 0 {
+			parts = append(parts, fmt.Sprintf("%s: %d sampled out (scale x%.4g)", r.Path, n, 1/r.Rate))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
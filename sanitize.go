@@ -0,0 +1,91 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// --- Untrusted Field Rendering ---
+
+// Display names, paths and error strings come from audit entries and are
+// attacker-influenced. Every such value goes through one of these helpers
+// before it is placed in chat markdown.
+
+const (
+	maxNameLen  = 128
+	maxPathLen  = 512
+	maxErrorLen = 256
+)
+
+// ansiEscape matches CSI and OSC terminal escape sequences.
+var ansiEscape = regexp.MustCompile(`\x1b(?:\[[0-?]*[ -/]*[@-~]|\][^\x07\x1b]*(?:\x07|\x1b\\)?)`)
+
+// markdownChars are metacharacters of Discord, Slack and Teams markdown.
+const markdownChars = "\\*_~`|>#[]()<-:!&"
+
+// mentionWord matches the mass mentions chat backends resolve from plain text.
+var mentionWord = regexp.MustCompile(`(?i)@(everyone|here|channel)`)
+
+// mdText renders an untrusted value as inert markdown text: control and
+// escape sequences stripped, metacharacters escaped, mentions broken and the
+// length capped at max runes.
+func mdText(s string, max int) string {
+	s = cleanField(s, max)
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(markdownChars, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return breakMentions(b.String())
+}
+
+// mdCode renders an untrusted value, such as a path, as a code span, which
+// keeps it copy-pasteable while disabling markdown and mentions inside it.
+func mdCode(s string, max int) string {
+	s = cleanField(s, max)
+	if s == "" {
+		return "` `"
+	}
+	if !strings.Contains(s, "`") {
+		return "`" + s + "`"
+	}
+	// A double-backtick span may contain single backticks but not a run
+	// of two; split such runs so the span can't be closed early.
+	for strings.Contains(s, "``") {
+		s = strings.ReplaceAll(s, "``", "`\u200b`")
+	}
+	return "`` " + s + " ``"
+}
+
+// cleanField drops ANSI sequences, control and invisible formatting
+// characters (including bidi overrides) and caps the length.
+func cleanField(s string, max int) string {
+	if !utf8.ValidString(s) {
+		s = strings.ToValidUTF8(s, "�")
+	}
+	s = ansiEscape.ReplaceAllString(s, "")
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			return -1
+		}
+		return r
+	}, s)
+	if utf8.RuneCountInString(s) > max {
+		s = string([]rune(s)[:max-1]) + "…"
+	}
+	return s
+}
+
+// breakMentions inserts a zero-width space after @ in mass mentions and in
+// <@...>/<#...>/<!...> entity references so they render as text.
+func breakMentions(s string) string {
+	s = mentionWord.ReplaceAllString(s, "@\u200b$1")
+	for _, p := range []string{"<@", "<#", "<!"} {
+		s = strings.ReplaceAll(s, p, p[:1]+"\u200b"+p[1:])
+	}
+	return s
+}
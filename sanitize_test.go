@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var hostileFields = []string{
+	"@everyone",
+	"@here please look",
+	"<@&123456789> <@!42> <#555> <!channel> <!here>",
+	"[click me](https://evil.example/login)",
+	"![img](https://evil.example/x.png)",
+	"<https://evil.example|totally legit>",
+	"**bold** __under__ ~~strike~~ ||spoiler|| `code` ```block```",
+	"> quote\n# heading\n- item",
+	"\x1b[31mred\x1b[0m \x1b]8;;https://evil.example\x07link\x1b]8;;\x07",
+	"bidi \u202egnp.exe\u202c zero\u200bwidth",
+	"crlf\r\nNew-Field: injected",
+	"secret/data/``a`b``",
+	"&lt;@everyone&gt; &amp;",
+	"\xff\xfe invalid utf-8",
+	strings.Repeat("x", 5000),
+}
+
+var (
+	massMention  = regexp.MustCompile(`(?i)@(everyone|here|channel)`)
+	entityRef    = regexp.MustCompile(`<[@#!]`)
+	maskedLink   = regexp.MustCompile(`(^|[^\\])\]\(`)
+	angleLink    = regexp.MustCompile(`<https?:`)
+	teamsMention = regexp.MustCompile(`(?i)<at>`)
+	invisible    = regexp.MustCompile("[\x00-\x08\x0b\x0c\x0e-\x1f\x7f\u202a-\u202e\u2066-\u2069]")
+)
+
+// activeMarkup matches, per backend, what it would turn into a mention, a
+// link or an image outside code spans. Slack has no [text](url) links and
+// Discord and Teams none of the <url|text> kind.
+var activeMarkup = map[string][]*regexp.Regexp{
+	"discord": {massMention, entityRef, maskedLink, invisible},
+	"slack":   {massMention, entityRef, angleLink, invisible},
+	"teams":   {massMention, teamsMention, maskedLink, invisible},
+}
+
+// inertSpans are left out of the check: code spans, and the date token the
+// Slack renderer adds itself.
+var inertSpans = regexp.MustCompile("``.*?``|`[^`]*`|<!date\\^[0-9]+\\^[^|>]*\\|[^>]*>")
+
+// payloadStrings collects every string in a JSON payload.
+func payloadStrings(v interface{}, out *[]string) {
+	switch v := v.(type) {
+	case string:
+		*out = append(*out, v)
+	case []interface{}:
+		for _, e := range v {
+			payloadStrings(e, out)
+		}
+	case map[string]interface{}:
+		for _, e := range v {
+			payloadStrings(e, out)
+		}
+	}
+}
+
+func checkRendering(t *testing.T, hostile string) {
+	rules := compileAlertRules([]AlertRule{{Name: "hostile", Severity: "critical", Title: "Access", Paths: []string{""},
+		Message: "{{md .User}} did {{md .Operation}} on {{md .Path}}"}})
+	en := &enrichedEntry{Fields: map[string]string{"owner": hostile}}
+	en.Auth.DisplayName, en.Request.Path, en.Request.Operation = hostile, hostile, hostile
+	en.Request.RemoteAddress, en.Request.ID, en.Error = hostile, hostile, hostile
+	a, ok := rules[0].alert(en, nil, ruleScope{})
+	if !ok {
+		t.Fatal("rule held the alert back")
+	}
+	en.annotate(&a)
+	a.Cluster, a.AuditFile, a.AuditHost, a.Source = hostile, hostile, hostile, hostile
+	a.Color = sevCritical.color()
+
+	for _, n := range []notifier{discordNotifier{}, slackNotifier{}, teamsNotifier{}} {
+		for _, m := range packAlerts([]Alert{a}) {
+			data, err := n.encode(m)
+			if err != nil {
+				t.Fatalf("%s: encode: %v", n.kind(), err)
+			}
+			var payload interface{}
+			if err := json.Unmarshal(data, &payload); err != nil {
+				t.Fatalf("%s: payload is not JSON: %v", n.kind(), err)
+			}
+			var strs []string
+			payloadStrings(payload, &strs)
+			for _, s := range strs {
+				text := inertSpans.ReplaceAllString(s, "")
+				for _, re := range activeMarkup[n.kind()] {
+					if loc := re.FindStringIndex(text); loc != nil {
+						t.Fatalf("%s: %q survives in %.200q\n(from %.200q)", n.kind(), text[loc[0]:loc[1]], s, hostile)
+					}
+				}
+				if strings.Contains(s, "\x1b") {
+					t.Fatalf("%s: escape sequence in %q", n.kind(), s)
+				}
+			}
+		}
+	}
+}
+
+func TestHostileFieldsRenderInert(t *testing.T) {
+	for _, s := range hostileFields {
+		checkRendering(t, s)
+	}
+}
+
+func FuzzHostileFields(f *testing.F) {
+	for _, s := range hostileFields {
+		f.Add(s)
+	}
+	f.Fuzz(checkRendering)
+}
+
+func TestMdCodeKeepsPathsIntact(t *testing.T) {
+	for path, want := range map[string]string{
+		"secret/data/app":       "`secret/data/app`",
+		"secret/a`b":            "`` secret/a`b ``",
+		"":                      "` `",
+		"kv/[x](y)/@everyone":   "`kv/[x](y)/@everyone`",
+		"a\x1b[31m/b\u202e/c\r": "`a/b/c`",
+	} {
+		if got := mdCode(path, maxPathLen); got != want {
+			t.Errorf("mdCode(%q) = %q, want %q", path, got, want)
+		}
+	}
+	if got := []rune(mdText(strings.Repeat("é", 300), maxNameLen)); len(got) != maxNameLen || got[len(got)-1] != '…' {
+		t.Errorf("mdText cap: %d runes, want %d ending in …", len(got), maxNameLen)
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Scheduler ---
+
+const (
+	maxJobJitter = time.Minute
+	// jobGrace is how long shutdown waits for running jobs.
+	jobGrace = 10 * time.Second
+)
+
+// jobSpec describes a recurring task. Exactly one of every and cron is set.
+// Jitter defaults to a tenth of the gap between runs (capped at a minute)
+// so several wardens started together don't fire in lockstep.
+type jobSpec struct {
+	name    string
+	every   time.Duration
+	cron    *cronSpec
+	jitter  time.Duration
+	timeout time.Duration
+	run     func(ctx context.Context) error
+}
+
+// jobStatus is the last known outcome of a job.
+type jobStatus struct {
+	Name      string    `json:"name"`
+	Running   bool      `json:"running"`
+	LastStart time.Time `json:"last_start,omitempty"`
+	LastEnd   time.Time `json:"last_end,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+	NextRun   time.Time `json:"next_run,omitempty"`
+	Runs      int       `json:"runs"`
+	Failures  int       `json:"failures"`
+	Skipped   int       `json:"skipped"`
+}
+
+type job struct {
+	spec   jobSpec
+	mu     sync.Mutex
+	status jobStatus
+}
+
+// scheduler runs named jobs on their own schedules. A run that is still in
+// progress when the next one is due causes that one to be skipped; panics
+// are recovered and recorded as failures.
+type scheduler struct {
+	mu    sync.Mutex
+	jobs  []*job
+	ctx   context.Context // set by run
+	loops sync.WaitGroup
+	runs  sync.WaitGroup
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{}
+}
+
+// add registers a job. Jobs added before run start with it. Its metrics
+// are labelled by job: when the last run started and the last success
+// ended, the failures and each run's duration.
+func (s *scheduler) add(spec jobSpec) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	metrics.add("job_failures_total", 0, "job", spec.name)
+	j := &job{spec: spec, status: jobStatus{Name: spec.name}}
+	s.jobs = append(s.jobs, j)
+	if s.ctx != nil {
+		s.loops.Add(1)
+		go s.loop(j)
+	}
+}
+
+// run is the scheduler's component: it runs the jobs until ctx is done,
+// then waits up to jobGrace for running ones.
+func (s *scheduler) run(ctx context.Context) error {
+	s.mu.Lock()
+	s.ctx = ctx
+	for _, j := range s.jobs {
+		s.loops.Add(1)
+		go s.loop(j)
+	}
+	s.mu.Unlock()
+	<-ctx.Done()
+	s.loops.Wait()
+
+	done := make(chan struct{})
+	go func() {
+		s.runs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(jobGrace):
+		logWarn("⚠️  Scheduler: jobs still running after {grace}, abandoning them", "grace", jobGrace)
+	}
+	return nil
+}
+
+func (s *scheduler) snapshot() []jobStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]jobStatus, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		j.mu.Lock()
+		out = append(out, j.status)
+		j.mu.Unlock()
+	}
+	return out
+}
+
+func (s *scheduler) loop(j *job) {
+	defer s.loops.Done()
+	for {
+		next := j.next(time.Now())
+		j.mu.Lock()
+		j.status.NextRun = next
+		j.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-s.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		j.mu.Lock()
+		if j.status.Running {
+			j.status.Skipped++
+			j.mu.Unlock()
+			logWarn("⚠️  Scheduler: {job} still running, skipping this run", "job", j.spec.name)
+			continue
+		}
+		start := time.Now()
+		j.status.Running = true
+		j.status.LastStart = start
+		j.mu.Unlock()
+		metrics.set("job_last_run_timestamp_seconds", float64(start.Unix()), "job", j.spec.name)
+
+		s.runs.Add(1)
+		go s.execute(j)
+	}
+}
+
+func (s *scheduler) execute(j *job) {
+	defer s.runs.Done()
+
+	ctx := s.ctx
+	if j.spec.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, j.spec.timeout)
+		defer cancel()
+	}
+
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				logError("💥 Scheduler: {job} panicked: {panic}\n{stack}", "job", j.spec.name, "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		return j.spec.run(ctx)
+	}()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status.Running = false
+	j.status.LastEnd = time.Now()
+	j.status.Runs++
+	j.status.LastError = ""
+	metrics.observe("job_duration_seconds", j.status.LastEnd.Sub(j.status.LastStart).Seconds(), "job", j.spec.name)
+	if err != nil {
+		j.status.Failures++
+		j.status.LastError = err.Error()
+		metrics.inc("job_failures_total", "job", j.spec.name)
+		logWarn("⚠️  Scheduler: {job} failed: {error}", "job", j.spec.name, "error", err)
+		return
+	}
+	metrics.set("job_last_success_timestamp_seconds", float64(j.status.LastEnd.Unix()), "job", j.spec.name)
+}
+
+// next returns when the job should run after now, jitter included.
+func (j *job) next(now time.Time) time.Time {
+	var at time.Time
+	if j.spec.cron != nil {
+		at = j.spec.cron.next(now)
+	} else {
+		at = now.Add(j.spec.every)
+	}
+
+	jitter := j.spec.jitter
+	if jitter == 0 {
+		jitter = at.Sub(now) / 10
+		if jitter > maxJobJitter {
+			jitter = maxJobJitter
+		}
+	}
+	if jitter > 0 {
+		at = at.Add(time.Duration(rand.Int63n(int64(jitter))))
+	}
+	return at
+}
+
+// --- Cron Specs ---
+
+// cronSpec is a standard five-field cron expression (minute hour
+// day-of-month month day-of-week) evaluated in local time. Fields accept
+// "*", numbers, ranges "a-b", steps "*/n" or "a-b/n", and comma lists.
+type cronSpec struct {
+	minute, hour, dom, month, dow [64]bool
+	domAny, dowAny                bool
+}
+
+func parseCron(expr string) (*cronSpec, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron %q: want 5 fields, got %d", expr, len(fields))
+	}
+	var c cronSpec
+	for i, f := range []struct {
+		set      *[64]bool
+		min, max int
+	}{
+		{&c.minute, 0, 59}, {&c.hour, 0, 23}, {&c.dom, 1, 31}, {&c.month, 1, 12}, {&c.dow, 0, 7},
+	} {
+		if err := parseCronField(fields[i], f.min, f.max, f.set); err != nil {
+			return nil, fmt.Errorf("cron %q: %w", expr, err)
+		}
+	}
+	if c.dow[7] {
+		c.dow[0] = true // 7 is also Sunday
+	}
+	c.domAny, c.dowAny = fields[2] == "*", fields[4] == "*"
+	return &c, nil
+}
+
+func parseCronField(field string, min, max int, set *[64]bool) error {
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return fmt.Errorf("bad step in %q", part)
+			}
+			rng, step = part[:i], n
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(a); err != nil {
+				return fmt.Errorf("bad value in %q", part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(b); err != nil {
+					return fmt.Errorf("bad range in %q", part)
+				}
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return nil
+}
+
+// next returns the first matching minute strictly after t.
+func (c *cronSpec) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// Every valid spec matches at least once in four years (Feb 29).
+	for limit := t.AddDate(4, 0, 1); t.Before(limit); t = t.Add(time.Minute) {
+		if !c.month[t.Month()] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location()).Add(-time.Minute)
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location()).Add(-time.Minute)
+			continue
+		}
+		if !c.hour[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location()).Add(-time.Minute)
+			continue
+		}
+		if c.minute[t.Minute()] {
+			return t
+		}
+	}
+	return t
+}
+
+// dayMatches follows cron's rule: when both day fields are restricted, a
+// day matching either one counts.
+func (c *cronSpec) dayMatches(t time.Time) bool {
+	dom, dow := c.dom[t.Day()], c.dow[int(t.Weekday())]
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it holds or a second goes by.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func jobNamed(s *scheduler, name string) jobStatus {
+	for _, st := range s.snapshot() {
+		if st.Name == name {
+			return st
+		}
+	}
+	return jobStatus{}
+}
+
+func startScheduler(t *testing.T, specs ...jobSpec) (*scheduler, context.CancelFunc, <-chan struct{}) {
+	s := newScheduler()
+	for _, spec := range specs {
+		s.add(spec)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return s, cancel, done
+}
+
+func TestSchedulerSkipsOverlap(t *testing.T) {
+	release := make(chan struct{})
+	var running, most int32
+	s, _, _ := startScheduler(t, jobSpec{name: "slow", every: 2 * time.Millisecond, jitter: time.Microsecond,
+		run: func(ctx context.Context) error {
+			n := atomic.AddInt32(&running, 1)
+			if n > atomic.LoadInt32(&most) {
+				atomic.StoreInt32(&most, n)
+			}
+			<-release
+			atomic.AddInt32(&running, -1)
+			return nil
+		}})
+
+	waitFor(t, "skipped runs", func() bool { return jobNamed(s, "slow").Skipped >= 3 })
+	st := jobNamed(s, "slow")
+	if !st.Running || st.Runs != 0 {
+		t.Errorf("status = %+v, want one run in progress", st)
+	}
+	close(release)
+	waitFor(t, "a finished run", func() bool { return jobNamed(s, "slow").Runs >= 1 })
+	if m := atomic.LoadInt32(&most); m != 1 {
+		t.Errorf("%d runs at once, want 1", m)
+	}
+}
+
+func TestSchedulerIsolatesPanics(t *testing.T) {
+	var healthy int32
+	s, _, _ := startScheduler(t,
+		jobSpec{name: "broken", every: 2 * time.Millisecond, jitter: time.Microsecond,
+			run: func(ctx context.Context) error { panic("boom") }},
+		jobSpec{name: "healthy", every: 2 * time.Millisecond, jitter: time.Microsecond,
+			run: func(ctx context.Context) error { atomic.AddInt32(&healthy, 1); return nil }},
+	)
+
+	waitFor(t, "repeated panics", func() bool { return jobNamed(s, "broken").Failures >= 3 })
+	waitFor(t, "the other job running on", func() bool { return atomic.LoadInt32(&healthy) >= 3 })
+	st := jobNamed(s, "broken")
+	if st.LastError != "panic: boom" || st.Running {
+		t.Errorf("broken = %+v, want a recorded panic and no run stuck", st)
+	}
+	if st := jobNamed(s, "healthy"); st.Failures != 0 {
+		t.Errorf("healthy = %+v, want no failures", st)
+	}
+}
+
+func TestSchedulerTimeout(t *testing.T) {
+	s, _, _ := startScheduler(t, jobSpec{name: "hung", every: time.Millisecond, jitter: time.Microsecond, timeout: 5 * time.Millisecond,
+		run: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}})
+	waitFor(t, "a timed out run", func() bool { return jobNamed(s, "hung").Failures >= 1 })
+	if st := jobNamed(s, "hung"); !strings.Contains(st.LastError, context.DeadlineExceeded.Error()) {
+		t.Errorf("last error = %q, want the deadline", st.LastError)
+	}
+}
+
+// Shutdown stops new runs and waits for the one in progress, which sees
+// its context cancelled.
+func TestSchedulerDrainsOnShutdown(t *testing.T) {
+	started := make(chan struct{}, 1)
+	var finished int32
+	s, cancel, done := startScheduler(t, jobSpec{name: "drain", every: time.Millisecond, jitter: time.Microsecond,
+		run: func(ctx context.Context) error {
+			select {
+			case started <- struct{}{}:
+			default:
+			}
+			<-ctx.Done()
+			time.Sleep(20 * time.Millisecond) // cleanup after cancel
+			atomic.StoreInt32(&finished, 1)
+			return errors.New("cancelled")
+		}})
+
+	<-started
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(jobGrace):
+		t.Fatal("run didn't return after shutdown")
+	}
+	if atomic.LoadInt32(&finished) != 1 {
+		t.Error("run returned before the job finished")
+	}
+	runs := jobNamed(s, "drain").Runs
+	time.Sleep(10 * time.Millisecond)
+	if again := jobNamed(s, "drain").Runs; again != runs {
+		t.Errorf("runs went from %d to %d after shutdown", runs, again)
+	}
+}
+
+// Each job's runs show in the metrics under its name: failures count,
+// and only a success moves the last success on.
+func TestSchedulerMetrics(t *testing.T) {
+	var calls int32
+	before := time.Now().Unix()
+	s, _, _ := startScheduler(t, jobSpec{name: "metered", every: 2 * time.Millisecond, jitter: time.Microsecond,
+		run: func(ctx context.Context) error {
+			if atomic.AddInt32(&calls, 1) <= 2 {
+				return errors.New("not yet")
+			}
+			return nil
+		}})
+	waitFor(t, "two failures", func() bool { return metricValue("job_failures_total", "job", "metered") >= 2 })
+	if v := metricValue("job_last_success_timestamp_seconds", "job", "metered"); v != 0 && jobNamed(s, "metered").Runs <= 2 {
+		t.Errorf("last success = %v after failures only", v)
+	}
+	waitFor(t, "a success", func() bool { return metricValue("job_last_success_timestamp_seconds", "job", "metered") > 0 })
+
+	st := jobNamed(s, "metered")
+	if f := metricValue("job_failures_total", "job", "metered"); f != 2 || st.Failures != 2 {
+		t.Errorf("job_failures_total = %v, status %d failures; want 2", f, st.Failures)
+	}
+	for _, name := range []string{"job_last_run_timestamp_seconds", "job_last_success_timestamp_seconds"} {
+		if v := metricValue(name, "job", "metered"); v < float64(before) || v > float64(time.Now().Unix()) {
+			t.Errorf("%s = %v, want a time since the test began", name, v)
+		}
+	}
+	var runs uint64
+	for _, m := range metrics.snapshot() {
+		if m.Name == "job_duration_seconds" && strings.Join(m.Labels, "=") == "job=metered" {
+			runs = m.Count
+		}
+	}
+	if runs < 3 {
+		t.Errorf("job_duration_seconds observed %d runs, want at least 3", runs)
+	}
+	// A job that never ran has its failures at zero.
+	s.add(jobSpec{name: "idle", every: time.Hour, run: func(ctx context.Context) error { return nil }})
+	for _, m := range metrics.snapshot() {
+		if m.Name == "job_failures_total" && strings.Join(m.Labels, "=") == "job=idle" {
+			return
+		}
+	}
+	t.Error("job_failures_total{job=idle} not registered")
+}
+
+func TestCronNext(t *testing.T) {
+	tests := []struct {
+		expr string
+		from string
+		want string
+	}{
+		{"*/15 * * * *", "2026-03-04 10:07", "2026-03-04 10:15"},
+		{"0 3 * * *", "2026-03-04 10:07", "2026-03-05 03:00"},
+		{"30 9 * * 1-5", "2026-03-06 10:00", "2026-03-09 09:30"}, // Friday, after the run, to Monday
+		{"0 0 1 * *", "2026-12-15 00:00", "2027-01-01 00:00"},
+		{"0 12 * * 7", "2026-03-04 10:07", "2026-03-08 12:00"}, // 7 is Sunday
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.expr, err)
+		}
+		from, _ := time.ParseInLocation("2006-01-02 15:04", tt.from, time.Local)
+		if got := c.next(from).Format("2006-01-02 15:04"); got != tt.want {
+			t.Errorf("%s from %s: next = %s, want %s", tt.expr, tt.from, got, tt.want)
+		}
+	}
+	for _, bad := range []string{"* * * *", "60 * * * *", "*/0 * * * *", "a * * * *"} {
+		if _, err := parseCron(bad); err == nil {
+			t.Errorf("parseCron(%q) accepted", bad)
+		}
+	}
+}
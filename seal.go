@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// --- Seal Backend Health ---
+
+// sealBackendErrorMarkers are substrings Vault puts in health/seal-status
+// errors when an auto-unseal backend (HSM via PKCS#11, cloud KMS, transit)
+// can't be reached, as opposed to ordinary sealed/standby responses.
+var sealBackendErrorMarkers = []string{
+	"pkcs11", "ckr_", "hsm", "seal wrapper", "error unsealing",
+	"failed to decrypt", "error decrypting", "kms", "unwrap",
+}
+
+// sealBackendState is the last known health of a node's seal backend.
+type sealBackendState struct {
+	Type      string    `json:"type"`
+	Healthy   bool      `json:"healthy"`
+	Since     time.Time `json:"since"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// fetchSealStatus reads /v1/sys/seal-status, which (unlike sys/health)
+// reports the seal type and migration state.
+func fetchSealStatus(cfg *VaultConfig, client *http.Client) (*VaultStatus, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.of(opHealth))
+	defer cancel()
+	return fetchSealStatusContext(ctx, client, cfg.Address)
+}
+
+func fetchSealStatusContext(ctx context.Context, client *http.Client, address string) (*VaultStatus, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, address+"/v1/sys/seal-status", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("seal-status request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read seal-status response: %w", err)
+	}
+	var status VaultStatus
+	if err := json.Unmarshal(body, &status); err != nil {
+		return nil, fmt.Errorf("parse seal-status response: %w", err)
+	}
+	if len(status.Errors) > 0 {
+		return &status, fmt.Errorf("seal-status returned %d: %s", resp.StatusCode, strings.Join(status.Errors, "; "))
+	}
+	return &status, nil
+}
+
+func isSealBackendError(errs []string) bool {
+	for _, e := range errs {
+		e = strings.ToLower(e)
+		for _, m := range sealBackendErrorMarkers {
+			if strings.Contains(e, m) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isAutoSeal reports whether a seal type relies on an external backend.
+func isAutoSeal(sealType string) bool {
+	return sealType != "" && sealType != "shamir"
+}
+
+// checkSealBackend updates the node's seal backend health from either a
+// successful seal-status (seal != nil) or an errors response, and alerts on
+// transitions. Losing the backend is critical even while Vault stays
+// unsealed: the next restart cannot auto-unseal.
+func checkSealBackend(cfg *VaultConfig, store *stateStore, seal *VaultStatus, errs []string) {
+	var prev, cur sealBackendState
+	err := store.update(func(st *wardenState) {
+		if st.SealBackends == nil {
+			st.SealBackends = make(map[string]sealBackendState)
+		}
+		prev = st.SealBackends[cfg.Address]
+		cur = prev
+
+		switch {
+		case seal != nil:
+			cur.Type = seal.Type
+			cur.LastError = ""
+			if !prev.Healthy || prev.Since.IsZero() {
+				cur.Healthy, cur.Since = true, time.Now()
+			}
+		case isSealBackendError(errs):
+			cur.LastError = strings.Join(errs, "; ")
+			if prev.Healthy || prev.Since.IsZero() {
+				cur.Healthy, cur.Since = false, time.Now()
+			}
+		default:
+			return
+		}
+		st.SealBackends[cfg.Address] = cur
+	})
+	if err != nil {
+		logWarn("⚠️  Could not record seal backend state: {error}", "error", err)
+	}
+
+	if !isAutoSeal(cur.Type) {
+		return
+	}
+	switch {
+	case prev.Healthy && !cur.Healthy:
+		logWarn("🔌 Seal backend ({type}) unreachable: {error}", "type", cur.Type, "error", cur.LastError)
+		notify(cfg, Alert{Severity: sevCritical, Color: 0x992d22, Rule: "seal-backend", Incident: "seal-backend"}.say(msgSealUnreachable.with(),
+			msgSealUnreachableBody.with("type", mdText(cur.Type, maxNameLen), "error", mdCode(cur.LastError, maxErrorLen))))
+	case !prev.Healthy && !prev.Since.IsZero() && cur.Healthy:
+		logInfo("✓ Seal backend ({type}) recovered", "type", cur.Type)
+		notify(cfg, Alert{Severity: sevInfo, Color: 0x2ecc71, Rule: "seal-backend", Incident: "seal-backend", Resolved: true}.say(msgSealRecovered.with(),
+			msgSealRecoveredBody.with("type", cur.Type, "down", time.Since(prev.Since).Round(time.Second))))
+	}
+}
+
+var (
+	msgSealUnreachable     = message("seal-backend.unreachable.title")
+	msgSealUnreachableBody = message("seal-backend.unreachable.body")
+	msgSealRecovered       = message("seal-backend.recovered.title")
+	msgSealRecoveredBody   = message("seal-backend.recovered.body")
+)
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Seal Debounce ---
+
+// defaultSealGrace is how long a node's sealed alert is held, long enough
+// for a node restarted in a rolling restart to be unsealed again.
+const defaultSealGrace = 90 * time.Second
+
+// sealGroup combines the seal states of a cluster's nodes. A node
+// reported sealed while another still serves is held for the grace
+// period and dropped if it unseals within it. A cluster with no unsealed
+// node left alerts at once. A cluster without nodes is a group of one,
+// so it alerts as before.
+type sealGroup struct {
+	name  string
+	cfg   *VaultConfig // the cluster's
+	grace time.Duration
+
+	mu      sync.Mutex
+	states  map[string]string // each node's confirmed state
+	last    map[string]sealChange
+	held    map[string]*time.Timer
+	alerted map[string]bool // nodes whose sealed alert went out
+	down    bool            // no node unsealed, and alerted as such
+	blips   []string        // nodes sealed shorter than the grace, for the summary
+	summary *time.Timer
+
+	// timerRan, when set, is called after each hold or summary timer has
+	// run, so tests can wait for one instead of sleeping.
+	timerRan func()
+}
+
+func (g *sealGroup) ran() {
+	if g.timerRan != nil {
+		g.timerRan()
+	}
+}
+
+func newSealGroup(name string, cfg *VaultConfig, grace time.Duration, nodes []string) *sealGroup {
+	g := &sealGroup{name: name, cfg: cfg, grace: grace, states: make(map[string]string),
+		last: make(map[string]sealChange), held: make(map[string]*time.Timer), alerted: make(map[string]bool)}
+	for _, n := range nodes {
+		g.states[n] = "unknown"
+	}
+	return g
+}
+
+// sealChange is a node's confirmed change of state, as the node's watcher
+// saw it.
+type sealChange struct {
+	node     string
+	address  string
+	from, to string
+	flapping bool   // the node's alerts are held
+	trend    string // the node's probe latency, for the sealed alert
+}
+
+func (g *sealGroup) observe(c sealChange) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.states[c.node], g.last[c.node] = c.to, c
+	if c.from == "unknown" {
+		return
+	}
+
+	unsealed := 0
+	for _, s := range g.states {
+		if s == "unsealed" {
+			unsealed++
+		}
+	}
+	switch {
+	case c.to == "sealed" && unsealed == 0 && !g.down:
+		g.down = true
+		for node, t := range g.held {
+			t.Stop()
+			delete(g.held, node)
+		}
+		publishSealState(g.cfg, "sealed")
+		g.alert(c, Alert{Severity: sevCritical, Color: sevCritical.color(), Rule: "watch-sealed",
+			Incident: "sealed:" + g.name}.say(msgWatchSealed.with("cluster", cleanField(g.name, maxNameLen)),
+			msgWatchSealedBody.with("what", g.describe(c), "window", formatDuration(time.Duration(g.cfg.Watch.Latency.Window)),
+				"trend", c.trend)))
+	case c.to == "sealed" && !g.down:
+		g.hold(c)
+	case c.to == "unsealed" && g.down:
+		g.down = false
+		publishSealState(g.cfg, "unsealed")
+		what := msgWatchNode.with("address", mdCode(c.address, maxPathLen))
+		if len(g.states) > 1 {
+			what = msgWatchNodeOf.with("address", mdCode(c.address, maxPathLen), "cluster", mdCode(g.name, maxNameLen))
+		}
+		g.alert(c, Alert{Severity: sevInfo, Color: 0x2ecc71, Rule: "watch-sealed", Incident: "sealed:" + g.name,
+			Resolved: true}.say(msgWatchUnsealed.with("cluster", cleanField(g.name, maxNameLen)), msgWatchUnsealedBody.with("what", what)))
+		// The nodes still sealed are now sealed while another serves.
+		for node, s := range g.states {
+			if s == "sealed" {
+				g.hold(g.last[node])
+			}
+		}
+	case c.to == "unsealed" && g.held[c.node] != nil:
+		g.held[c.node].Stop()
+		delete(g.held, c.node)
+		logInfo("🔕 Seal watch: {node} unsealed within {grace}; sealed alert dropped", "node", c.node, "grace", formatDuration(g.grace))
+		metrics.inc("watch_seal_debounced_total", "cluster", g.name)
+		g.blips = append(g.blips, c.node)
+		g.scheduleSummary()
+	case c.to == "unsealed" && g.alerted[c.node]:
+		delete(g.alerted, c.node)
+		g.alert(c, Alert{Severity: sevInfo, Color: 0x2ecc71, Rule: "watch-sealed", Incident: "sealed:" + c.node,
+			Resolved: true}.say(msgWatchNodeUnsealed.with("node", cleanField(c.node, maxNameLen)),
+			msgWatchUnsealedBody.with("what", msgWatchNode.with("address", mdCode(c.address, maxPathLen)))))
+	}
+}
+
+// hold holds a node's sealed alert for the grace period. Called with
+// g.mu held.
+func (g *sealGroup) hold(c sealChange) {
+	if g.grace == 0 {
+		g.nodeSealed(c)
+		return
+	}
+	logInfo("🔕 Seal watch: {node} sealed, holding the alert for {grace}", "node", c.node, "grace", formatDuration(g.grace))
+	g.held[c.node] = time.AfterFunc(g.grace, func() {
+		defer g.ran()
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if _, ok := g.held[c.node]; ok && g.states[c.node] == "sealed" {
+			delete(g.held, c.node)
+			g.nodeSealed(c)
+		}
+	})
+}
+
+// nodeSealed alerts for one node staying sealed while others serve.
+// Called with g.mu held.
+func (g *sealGroup) nodeSealed(c sealChange) {
+	g.alerted[c.node] = true
+	g.alert(c, Alert{Severity: sevWarning, Color: sevWarning.color(), Rule: "watch-sealed",
+		Incident: "sealed:" + c.node}.say(msgWatchNodeSealed.with("node", cleanField(c.node, maxNameLen)),
+		msgWatchNodeSealedBody.with("address", mdCode(c.address, maxPathLen), "cluster", mdCode(g.name, maxNameLen),
+			"window", formatDuration(time.Duration(g.cfg.Watch.Latency.Window)), "trend", c.trend)))
+}
+
+// scheduleSummary sends one message for the dropped alerts once no node
+// has been held for a whole grace period, e.g. after a rolling restart.
+// Called with g.mu held.
+func (g *sealGroup) scheduleSummary() {
+	if g.summary != nil {
+		g.summary.Stop()
+	}
+	g.summary = time.AfterFunc(g.grace, func() {
+		defer g.ran()
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if len(g.held) > 0 {
+			g.scheduleSummary()
+			return
+		}
+		if len(g.blips) == 0 {
+			return
+		}
+		nodes := append([]string(nil), g.blips...)
+		sort.Strings(nodes)
+		g.blips = nil
+		notify(g.cfg, Alert{Severity: sevInfo, Color: sevInfo.color(), Rule: "watch-sealed",
+			Time: time.Now()}.say(msgWatchRestarted.with("cluster", cleanField(g.name, maxNameLen)),
+			msgWatchRestartedBody.with("count", len(nodes), "grace", formatDuration(g.grace),
+				"nodes", mdText(strings.Join(nodes, ", "), maxPathLen))))
+	})
+}
+
+func (g *sealGroup) describe(c sealChange) localText {
+	if len(g.states) == 1 {
+		return msgWatchNode.with("address", mdCode(c.address, maxPathLen))
+	}
+	return msgWatchEveryNode.with("cluster", mdCode(g.name, maxNameLen), "address", mdCode(c.address, maxPathLen))
+}
+
+var (
+	msgWatchSealed         = message("watch-sealed.sealed.title")
+	msgWatchSealedBody     = message("watch-sealed.sealed.body")
+	msgWatchUnsealed       = message("watch-sealed.unsealed.title")
+	msgWatchUnsealedBody   = message("watch-sealed.unsealed.body")
+	msgWatchNodeSealed     = message("watch-sealed.node-sealed.title")
+	msgWatchNodeSealedBody = message("watch-sealed.node-sealed.body")
+	msgWatchNodeUnsealed   = message("watch-sealed.node-unsealed.title")
+	msgWatchRestarted      = message("watch-sealed.restarted.title")
+	msgWatchRestartedBody  = message("watch-sealed.restarted.body")
+	msgWatchNode           = message("watch-sealed.node")
+	msgWatchNodeOf         = message("watch-sealed.node-of")
+	msgWatchEveryNode      = message("watch-sealed.every-node")
+)
+
+// alert sends a, unless the node it came from is flapping. Sealed alerts
+// carry a topology snapshot; the other nodes' changes wait for it, for at
+// most watch.topology_budget.
+func (g *sealGroup) alert(c sealChange, a Alert) {
+	if c.flapping {
+		metrics.inc("watch_alerts_held_total", "cluster", c.node)
+		return
+	}
+	if !a.Resolved {
+		a.Topology = takeTopology(g.cfg)
+	}
+	a.Time = time.Now()
+	notify(g.cfg, a)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sealTestGroup is a cluster of n nodes, all seen unsealed. Its addresses
+// refuse connections, so topology snapshots come back at once.
+func sealTestGroup(n int, grace time.Duration) *sealGroup {
+	cfg := &VaultConfig{Address: "http://127.0.0.1:1"}
+	cfg.Watch.Latency.Window = Duration(defaultLatencyWindow)
+	cfg.Watch.TopologyBudget = Duration(100 * time.Millisecond)
+	var nodes []string
+	for i := 1; i <= n; i++ {
+		nodes = append(nodes, fmt.Sprintf("prod/vault-%d:8200", i))
+		cfg.Nodes = append(cfg.Nodes, fmt.Sprintf("http://127.0.0.1:1/%d", i))
+	}
+	g := newSealGroup("prod", cfg, grace, nodes)
+	for _, node := range nodes {
+		g.observe(sealChange{node: node, address: "http://" + node, from: "unknown", to: "unsealed"})
+	}
+	return g
+}
+
+// timerWaiter has g report each timer that runs; the returned function
+// waits for one more.
+func timerWaiter(t *testing.T, g *sealGroup) func() {
+	ran := make(chan struct{}, 64)
+	g.timerRan = func() { ran <- struct{}{} }
+	return func() {
+		t.Helper()
+		select {
+		case <-ran:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no timer ran within 5s")
+		}
+	}
+}
+
+func sealNode(g *sealGroup, i int, from, to string) {
+	node := fmt.Sprintf("prod/vault-%d:8200", i)
+	g.observe(sealChange{node: node, address: "http://" + node, from: from, to: to})
+}
+
+func alertTitles(alerts []Alert) string {
+	var titles []string
+	for _, a := range alerts {
+		titles = append(titles, a.Severity.String()+": "+a.Title)
+	}
+	return strings.Join(titles, "; ")
+}
+
+// A rolling restart, one node after another, sends one summary and no
+// sealed alerts.
+func TestSealDebounceRollingRestart(t *testing.T) {
+	sent := captureAlerts(t)
+	grace := 150 * time.Millisecond
+	g := sealTestGroup(5, grace)
+	waitTimer := timerWaiter(t, g)
+	before := metrics.sum("watch_seal_debounced_total")
+
+	for i := 1; i <= 5; i++ {
+		sealNode(g, i, "unsealed", "sealed")
+		sealNode(g, i, "sealed", "unsealed")
+	}
+	if alerts := sent(); len(alerts) != 0 {
+		t.Fatalf("alerts during the restart: %s", alertTitles(alerts))
+	}
+	waitTimer() // the summary; every hold was stopped
+
+	alerts := sent()
+	if len(alerts) != 1 {
+		t.Fatalf("alerts = %s; want exactly one summary", alertTitles(alerts))
+	}
+	a := alerts[0]
+	if a.Severity != sevInfo || !strings.Contains(a.Title, "Vault nodes restarted: prod") {
+		t.Errorf("summary = %s %q, want an info restart summary", a.Severity, a.Title)
+	}
+	desc := strings.ReplaceAll(a.Description, `\`, "") // markdown escapes
+	for _, want := range []string{"5 node seals", "prod/vault-1:8200", "prod/vault-5:8200"} {
+		if !strings.Contains(desc, want) {
+			t.Errorf("summary %q lacks %q", desc, want)
+		}
+	}
+	if d := metrics.sum("watch_seal_debounced_total") - before; d != 5 {
+		t.Errorf("watch_seal_debounced_total grew by %v, want 5", d)
+	}
+}
+
+// Two nodes restarting at once, overlapping, still make one summary, sent
+// only once neither is held.
+func TestSealDebounceOverlappingRestarts(t *testing.T) {
+	sent := captureAlerts(t)
+	grace := 150 * time.Millisecond
+	g := sealTestGroup(3, grace)
+	waitTimer := timerWaiter(t, g)
+
+	sealNode(g, 1, "unsealed", "sealed")
+	sealNode(g, 2, "unsealed", "sealed")
+	sealNode(g, 1, "sealed", "unsealed")
+	if alerts := sent(); len(alerts) != 0 {
+		t.Fatalf("alerts with vault-2 still held: %s", alertTitles(alerts))
+	}
+	sealNode(g, 2, "sealed", "unsealed")
+	waitTimer()
+
+	if alerts := sent(); len(alerts) != 1 || !strings.Contains(alerts[0].Description, "2 node seals") {
+		t.Errorf("alerts = %s, want one summary for both nodes", alertTitles(alerts))
+	}
+}
+
+// A node that stays sealed past the grace alerts, and its unseal clears it.
+func TestSealDebounceNodeStaysSealed(t *testing.T) {
+	sent := captureAlerts(t)
+	grace := 50 * time.Millisecond
+	g := sealTestGroup(3, grace)
+	waitTimer := timerWaiter(t, g)
+
+	sealNode(g, 2, "unsealed", "sealed")
+	if alerts := sent(); len(alerts) != 0 {
+		t.Fatalf("alerted within the grace: %s", alertTitles(alerts))
+	}
+	waitTimer()
+	alerts := sent()
+	if len(alerts) != 1 || alerts[0].Severity != sevWarning || !strings.Contains(alerts[0].Title, "prod/vault-2:8200") {
+		t.Fatalf("alerts = %s, want a warning for vault-2", alertTitles(alerts))
+	}
+
+	sealNode(g, 2, "sealed", "unsealed")
+	alerts = sent()
+	if len(alerts) != 1 || alerts[0].Severity != sevInfo || !strings.Contains(alerts[0].Title, "prod/vault-2:8200") {
+		t.Errorf("alerts = %s, want vault-2's all-clear", alertTitles(alerts))
+	}
+	g.mu.Lock()
+	summary := g.summary
+	g.mu.Unlock()
+	if summary != nil {
+		t.Error("a summary scheduled after an alerted seal")
+	}
+}
+
+// With no unsealed node left the cluster alerts at once, however long the
+// grace, and the held nodes go with it.
+func TestSealDebounceClusterDown(t *testing.T) {
+	sent := captureAlerts(t)
+	g := sealTestGroup(3, time.Hour)
+
+	sealNode(g, 1, "unsealed", "sealed")
+	sealNode(g, 2, "unsealed", "sealed")
+	if alerts := sent(); len(alerts) != 0 {
+		t.Fatalf("alerted with a node still serving: %s", alertTitles(alerts))
+	}
+	sealNode(g, 3, "unsealed", "sealed")
+	alerts := sent()
+	if len(alerts) != 1 || alerts[0].Severity != sevCritical || !strings.Contains(alerts[0].Title, "Vault sealed: prod") {
+		t.Fatalf("alerts = %s, want the cluster's critical", alertTitles(alerts))
+	}
+	if alerts[0].Topology == nil {
+		t.Error("cluster sealed alert has no topology snapshot")
+	}
+	g.mu.Lock()
+	held := len(g.held)
+	g.mu.Unlock()
+	if held != 0 {
+		t.Errorf("%d nodes still held under a cluster alert", held)
+	}
+
+	sealNode(g, 3, "sealed", "unsealed")
+	alerts = sent()
+	if len(alerts) != 1 || alerts[0].Severity != sevInfo || !strings.Contains(alerts[0].Title, "prod") {
+		t.Fatalf("alerts = %s, want the cluster's all-clear", alertTitles(alerts))
+	}
+	// The other two are sealed while vault-3 serves: held again.
+	g.mu.Lock()
+	held = len(g.held)
+	g.mu.Unlock()
+	if held != 2 {
+		t.Errorf("held = %d after the cluster recovered, want 2", held)
+	}
+}
+
+// seal_grace: 0 alerts for every node at once, as before the debounce.
+func TestSealDebounceZeroGrace(t *testing.T) {
+	sent := captureAlerts(t)
+	g := sealTestGroup(3, 0)
+
+	sealNode(g, 1, "unsealed", "sealed")
+	alerts := sent()
+	if len(alerts) != 1 || alerts[0].Severity != sevWarning {
+		t.Fatalf("alerts = %s, want vault-1's warning at once", alertTitles(alerts))
+	}
+	sealNode(g, 1, "sealed", "unsealed")
+	if alerts := sent(); len(alerts) != 1 || alerts[0].Severity != sevInfo {
+		t.Errorf("alerts = %s, want vault-1's all-clear", alertTitles(alerts))
+	}
+}
+
+// A cluster without nodes is a group of one: sealed is critical at once.
+func TestSealDebounceSingleNode(t *testing.T) {
+	sent := captureAlerts(t)
+	cfg := &VaultConfig{Address: "http://127.0.0.1:1"}
+	cfg.Watch.TopologyBudget = Duration(100 * time.Millisecond)
+	g := newSealGroup("solo", cfg, time.Hour, []string{"solo"})
+	g.observe(sealChange{node: "solo", address: cfg.Address, from: "unknown", to: "unsealed"})
+	g.observe(sealChange{node: "solo", address: cfg.Address, from: "unsealed", to: "sealed"})
+	if alerts := sent(); len(alerts) != 1 || alerts[0].Severity != sevCritical {
+		t.Errorf("alerts = %s, want a critical at once", alertTitles(alerts))
+	}
+}
+
+func TestSealGraceConfig(t *testing.T) {
+	for body, want := range map[string]time.Duration{
+		"":                      defaultSealGrace,
+		"  seal_grace: 0s\n":    0,
+		"  seal_grace: 2m\n":    2 * time.Minute,
+		"  seal_grace: -1s\n":   -1,
+		"  seal_grace: 1h30m\n": 90 * time.Minute,
+	} {
+		cfg, err := loadTestConfig(t, envTestBase+"watch:\n  enabled: true\n"+body)
+		if want < 0 {
+			if err == nil || !strings.Contains(err.Error(), "watch.seal_grace must not be negative") {
+				t.Errorf("%q: err = %v, want negative rejected", body, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", body, err)
+			continue
+		}
+		if got := time.Duration(*cfg.Watch.SealGrace); got != want {
+			t.Errorf("%q: seal_grace = %s, want %s", body, got, want)
+		}
+	}
+}
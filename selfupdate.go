@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// --- Command: Self-Update ---
+
+const (
+	defaultReleaseURL  = "https://github.com/usenix17/vault-warden/releases"
+	defaultUpdateUnit  = "vault-warden.service"
+	releaseSumsFile    = "SHA256SUMS"
+	maxReleaseBinary   = 256 << 20
+	selfUpdateDeadline = 10 * time.Minute
+)
+
+// releaseKey is the base64 Ed25519 public key release checksums are
+// signed with, set at build time like version:
+// go build -ldflags "-X main.releaseKey=...". A build without one can't
+// verify a release and refuses to update itself.
+var releaseKey = ""
+
+// SelfUpdateConfig says where self-update finds releases. A mirror keeps
+// GitHub's layout: latest/download/<file> for the newest release and
+// download/v<version>/<file> for a given one.
+type SelfUpdateConfig struct {
+	BaseURL string `yaml:"base_url"`
+	Unit    string `yaml:"unit"` // restarted by -restart
+}
+
+// release is one release's binary for this platform, as named in its
+// signed SHA256SUMS.
+type release struct {
+	version string
+	asset   string // vault-warden_<version>_<goos>_<goarch>
+	sum     []byte
+	dir     string // URL of the release's files
+}
+
+// runSelfUpdate replaces the running executable with a release. The
+// release's SHA256SUMS must carry a valid signature from releaseKey and
+// the binary must match its checksum; until both hold, the executable
+// isn't touched.
+func runSelfUpdate(cfg *VaultConfig, args []string) error {
+	fs := flagSet("self-update")
+	checkOnly := fs.Bool("check-only", false, "Report the available version without updating")
+	want := fs.String("version", "", "Release to install instead of the latest, e.g. 1.4.0")
+	allowDowngrade := fs.Bool("allow-downgrade", false, "Install a release older than this build")
+	restart := fs.Bool("restart", false, "Restart the systemd unit after updating")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	sc := cfg.SelfUpdate
+	if releaseKey == "" {
+		return fmt.Errorf("this build has no release key to verify updates with; install releases by hand")
+	}
+	raw, err := base64.StdEncoding.DecodeString(releaseKey)
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return fmt.Errorf("this build's release key is malformed")
+	}
+
+	client := &http.Client{Timeout: selfUpdateDeadline}
+	r, err := fetchRelease(client, sc.BaseURL, *want, ed25519.PublicKey(raw))
+	if err != nil {
+		return err
+	}
+	have, known := parseVaultVersion(version)
+	next, _ := parseVaultVersion(r.version)
+	newer := known && !versionAtLeast(have, next)
+	if *checkOnly {
+		switch {
+		case newer:
+			fmt.Printf("Update available: %s -> %s\n", version, r.version)
+		case known && have == next:
+			fmt.Printf("Up to date: %s\n", version)
+		default:
+			fmt.Printf("Installed %s, available %s\n", version, r.version)
+		}
+		return nil
+	}
+	if known && have == next {
+		logInfo("✓ Already at {version}", "version", r.version)
+		return nil
+	}
+	if !newer && !*allowDowngrade {
+		if !known {
+			return fmt.Errorf("this build's version %q can't be compared with %s; pass -allow-downgrade to replace it anyway", version, r.version)
+		}
+		return fmt.Errorf("%s is older than the installed %s; pass -allow-downgrade to install it", r.version, version)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("find the executable: %w", err)
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return fmt.Errorf("find the executable: %w", err)
+	}
+	logInfo("⬇️  Downloading {asset}", "asset", r.asset)
+	if err := installRelease(client, r, exe); err != nil {
+		return err
+	}
+	logInfo("⬆️  Updated {path} from {from} to {to}", "path", exe, "from", version, "to", r.version)
+	if !*restart {
+		return nil
+	}
+	unit := sc.Unit
+	if out, err := exec.Command("systemctl", "restart", unit).CombinedOutput(); err != nil {
+		return fmt.Errorf("updated, but restarting %s failed: %v: %s", unit, err, strings.TrimSpace(string(out)))
+	}
+	logInfo("🔄 Restarted {unit}", "unit", unit)
+	return nil
+}
+
+// fetchRelease reads and verifies the SHA256SUMS of the latest release,
+// or of the one asked for, and picks this platform's binary from it.
+func fetchRelease(client *http.Client, base, want string, key ed25519.PublicKey) (*release, error) {
+	dir := strings.TrimSuffix(base, "/") + "/latest/download"
+	if want != "" {
+		dir = strings.TrimSuffix(base, "/") + "/download/v" + strings.TrimPrefix(want, "v")
+	}
+	sums, err := fetchReleaseFile(client, dir+"/"+releaseSumsFile, 1<<20)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := fetchReleaseFile(client, dir+"/"+releaseSumsFile+".sig", 4096)
+	if err != nil {
+		return nil, err
+	}
+	if !verifySignature(key, sums, strings.TrimSpace(string(sig))) {
+		return nil, fmt.Errorf("the signature of %s/%s doesn't verify against this build's release key", dir, releaseSumsFile)
+	}
+
+	suffix := "_" + runtime.GOOS + "_" + runtime.GOARCH
+	sc := bufio.NewScanner(bytes.NewReader(sums))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		name := strings.TrimPrefix(fields[1], "*")
+		if !strings.HasPrefix(name, "vault-warden_") || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		sum, err := hex.DecodeString(fields[0])
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("%s has a malformed checksum for %s", releaseSumsFile, name)
+		}
+		v := "v" + strings.TrimPrefix(strings.TrimSuffix(strings.TrimPrefix(name, "vault-warden_"), suffix), "v")
+		if _, ok := parseVaultVersion(v); !ok {
+			return nil, fmt.Errorf("%s names %s, which has no version", releaseSumsFile, name)
+		}
+		if want != "" && v != "v"+strings.TrimPrefix(want, "v") {
+			return nil, fmt.Errorf("%s of v%s is for %s", releaseSumsFile, strings.TrimPrefix(want, "v"), v)
+		}
+		// The binary comes from the release the checksum names, even if
+		// latest has moved on meanwhile.
+		return &release{version: v, asset: name, sum: sum, dir: strings.TrimSuffix(base, "/") + "/download/" + v}, nil
+	}
+	return nil, fmt.Errorf("the release has no binary for %s/%s", runtime.GOOS, runtime.GOARCH)
+}
+
+func fetchReleaseFile(client *http.Client, link string, limit int64) ([]byte, error) {
+	resp, err := client.Get(link)
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s: %w", link, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch %s: status %d", link, resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s: %w", link, err)
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("fetch %s: larger than %s", link, formatBytes(limit))
+	}
+	return data, nil
+}
+
+// installRelease downloads r's binary next to exe and renames it into
+// place with exe's mode and owner. A download that is cut short or
+// doesn't match the checksum is removed and exe stays as it was.
+func installRelease(client *http.Client, r *release, exe string) error {
+	fi, err := os.Stat(exe)
+	if err != nil {
+		return fmt.Errorf("stat %s: %w", exe, err)
+	}
+	link := r.dir + "/" + r.asset
+	resp, err := client.Get(link)
+	if err != nil {
+		return fmt.Errorf("download %s: %w", link, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download %s: status %d", link, resp.StatusCode)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(exe), "."+filepath.Base(exe)+".update*")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(resp.Body, maxReleaseBinary+1))
+	switch {
+	case err != nil:
+		tmp.Close()
+		return fmt.Errorf("download %s: %w; the installed binary is unchanged", link, err)
+	case resp.ContentLength >= 0 && n != resp.ContentLength:
+		tmp.Close()
+		return fmt.Errorf("download %s: cut short at %s of %s; the installed binary is unchanged", link, formatBytes(n), formatBytes(resp.ContentLength))
+	case n > maxReleaseBinary:
+		tmp.Close()
+		return fmt.Errorf("download %s: larger than %s; the installed binary is unchanged", link, formatBytes(maxReleaseBinary))
+	case !bytes.Equal(h.Sum(nil), r.sum):
+		tmp.Close()
+		return fmt.Errorf("%s doesn't match its checksum in %s; the installed binary is unchanged", r.asset, releaseSumsFile)
+	}
+
+	if err := tmp.Chmod(fi.Mode().Perm()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("chmod temp file: %w", err)
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		if err := tmp.Chown(int(st.Uid), int(st.Gid)); err != nil {
+			tmp.Close()
+			return fmt.Errorf("keep the owner of %s: %w", exe, err)
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close temp file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), exe); err != nil {
+		return fmt.Errorf("replace %s: %w", exe, err)
+	}
+	return nil
+}
+
+func validateSelfUpdate(cfg *VaultConfig) error {
+	sc := &cfg.SelfUpdate
+	if sc.BaseURL == "" {
+		sc.BaseURL = defaultReleaseURL
+	}
+	if sc.Unit == "" {
+		sc.Unit = defaultUpdateUnit
+	}
+	// Plain http is allowed for mirrors: the signature, not the transport,
+	// is what vouches for a release.
+	if u, err := url.Parse(sc.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return &fieldError{"self_update.base_url", "must be an http:// or https:// URL"}
+	}
+	return nil
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// --- Mount Sensitivity ---
+
+const (
+	defaultSensitivityReport          = "0 8 * * *"
+	defaultSensitivityUnclassifiedMin = 1000
+	sensitivityReloadInterval         = 30 * time.Second
+	// maxUnclassifiedPrefixes bounds the per-prefix counts kept between
+	// reports; prefixes past it are only counted in total.
+	maxUnclassifiedPrefixes = 10000
+	sensitivityReportTop    = 10
+)
+
+// sensitivityLevel classifies a path. The zero value is a path no prefix
+// covers.
+type sensitivityLevel int
+
+const (
+	sensUnclassified sensitivityLevel = iota
+	sensLow
+	sensMedium
+	sensHigh
+	sensCritical
+)
+
+var sensitivityNames = []string{"unclassified", "low", "medium", "high", "critical"}
+
+func (l sensitivityLevel) String() string {
+	if l < 0 || int(l) >= len(sensitivityNames) {
+		return fmt.Sprintf("sensitivity(%d)", int(l))
+	}
+	return sensitivityNames[l]
+}
+
+func parseSensitivity(s string) (sensitivityLevel, error) {
+	for i, name := range sensitivityNames[1:] {
+		if strings.EqualFold(s, name) {
+			return sensitivityLevel(i + 1), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown sensitivity %q (want low, medium, high or critical)", s)
+}
+
+// SensitivityConfig classifies paths so alerts on secret/prod/payments
+// weigh more than alerts on secret/dev/scratch.
+type SensitivityConfig struct {
+	// Paths maps path prefixes, as they appear in the audit log, to a
+	// level. The longest matching prefix wins.
+	Paths map[string]string `yaml:"paths"`
+	// File holds more prefixes in the same form, overriding Paths where
+	// both list one. It is re-read when it changes.
+	File string `yaml:"file"`
+	// Severity adjusts the alerts on a level's paths.
+	Severity map[string]SensitivitySeverity `yaml:"severity"`
+	Report   string                         `yaml:"report"` // cron for the daily breakdown
+	// UnclassifiedMin is how many events a prefix without a level needs
+	// between reports to be listed as worth classifying.
+	UnclassifiedMin int `yaml:"unclassified_min"`
+}
+
+// SensitivitySeverity raises an alert's severity: Boost steps up, then at
+// least Floor. An environment's max_severity still caps the result.
+type SensitivitySeverity struct {
+	Floor string `yaml:"floor"`
+	Boost int    `yaml:"boost"`
+}
+
+func (c SensitivityConfig) enabled() bool {
+	return len(c.Paths) > 0 || c.File != ""
+}
+
+type sensitivityPrefix struct {
+	prefix string
+	level  sensitivityLevel
+}
+
+// sensitivityMap classifies paths and counts events per level for the
+// report. A nil *sensitivityMap classifies every path as unclassified.
+type sensitivityMap struct {
+	cfg    SensitivityConfig
+	floors map[sensitivityLevel]severity
+	boosts map[sensitivityLevel]int
+
+	mu       sync.Mutex
+	prefixes []sensitivityPrefix // longest first
+	fileMod  time.Time
+	fileSize int64
+
+	since        time.Time
+	counts       map[sensitivityLevel]int
+	unclassified map[string]int // events by unclassifiedPrefix
+	overflow     int            // unclassified events past maxUnclassifiedPrefixes
+}
+
+func newSensitivityMap(cfg SensitivityConfig) *sensitivityMap {
+	if !cfg.enabled() {
+		return nil
+	}
+	m := &sensitivityMap{cfg: cfg, floors: make(map[sensitivityLevel]severity), boosts: make(map[sensitivityLevel]int),
+		since: time.Now(), counts: make(map[sensitivityLevel]int), unclassified: make(map[string]int)}
+	for name, s := range cfg.Severity {
+		level, _ := parseSensitivity(name) // validated at load
+		if s.Floor != "" {
+			m.floors[level], _ = parseSeverity(s.Floor)
+		}
+		m.boosts[level] = s.Boost
+	}
+	if err := m.reload(true); err != nil {
+		logWarn("⚠️  Sensitivity: {error}; using the prefixes from the config only", "error", err)
+		m.prefixes, _ = compileSensitivity(cfg.Paths) // validated at load
+	}
+	return m
+}
+
+// readSensitivityFile reads a prefix map in the form of sensitivity.paths.
+func readSensitivityFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read sensitivity file: %w", err)
+	}
+	if err := checkConfigBytes(data); err != nil {
+		return nil, fmt.Errorf("decode sensitivity file %s: %w", path, err)
+	}
+	var paths map[string]string
+	if err := yaml.Unmarshal(data, &paths); err != nil {
+		return nil, fmt.Errorf("decode sensitivity file %s: %w", path, err)
+	}
+	return paths, nil
+}
+
+// compileSensitivity orders the prefixes longest first, so the first
+// match is the longest.
+func compileSensitivity(layers ...map[string]string) ([]sensitivityPrefix, error) {
+	merged := make(map[string]string)
+	for _, paths := range layers {
+		for p, level := range paths {
+			merged[strings.TrimLeft(p, "/")] = level
+		}
+	}
+	out := make([]sensitivityPrefix, 0, len(merged))
+	for p, name := range merged {
+		if p == "" {
+			return nil, fmt.Errorf("empty prefix")
+		}
+		level, err := parseSensitivity(name)
+		if err != nil {
+			return nil, fmt.Errorf("prefix %q: %w", p, err)
+		}
+		out = append(out, sensitivityPrefix{prefix: p, level: level})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if len(out[i].prefix) != len(out[j].prefix) {
+			return len(out[i].prefix) > len(out[j].prefix)
+		}
+		return out[i].prefix < out[j].prefix
+	})
+	return out, nil
+}
+
+// reload re-reads the file if it changed since the last read, or always
+// when force is set. On an error the previous prefixes stay in use.
+func (m *sensitivityMap) reload(force bool) error {
+	var fromFile map[string]string
+	var mod time.Time
+	var size int64
+	if m.cfg.File != "" {
+		fi, err := os.Stat(m.cfg.File)
+		if err != nil {
+			return fmt.Errorf("sensitivity file: %w", err)
+		}
+		m.mu.Lock()
+		unchanged := fi.ModTime().Equal(m.fileMod) && fi.Size() == m.fileSize
+		m.mu.Unlock()
+		if unchanged && !force {
+			return nil
+		}
+		mod, size = fi.ModTime(), fi.Size()
+		if fromFile, err = readSensitivityFile(m.cfg.File); err == nil {
+			if _, err = compileSensitivity(fromFile); err != nil {
+				err = fmt.Errorf("sensitivity file %s: %w", m.cfg.File, err)
+			}
+		}
+		if err != nil {
+			// Report a broken file once, not on every check until it's fixed.
+			m.mu.Lock()
+			m.fileMod, m.fileSize = mod, size
+			m.mu.Unlock()
+			return err
+		}
+	}
+	prefixes, _ := compileSensitivity(m.cfg.Paths, fromFile)
+	m.mu.Lock()
+	m.prefixes, m.fileMod, m.fileSize = prefixes, mod, size
+	m.mu.Unlock()
+	metrics.set("sensitivity_prefixes", float64(len(prefixes)))
+	return nil
+}
+
+// classify returns the level of the longest prefix covering path.
+func (m *sensitivityMap) classify(path string) sensitivityLevel {
+	_, level := m.match(path)
+	return level
+}
+
+// match returns the longest prefix covering path and its level, or "" and
+// sensUnclassified.
+func (m *sensitivityMap) match(path string) (string, sensitivityLevel) {
+	if m == nil {
+		return "", sensUnclassified
+	}
+	path = strings.TrimLeft(path, "/")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, p := range m.prefixes {
+		if strings.HasPrefix(path, p.prefix) {
+			return p.prefix, p.level
+		}
+	}
+	return "", sensUnclassified
+}
+
+// observe counts one call for the report. Vault writes a request and a
+// response entry per call; only responses are counted.
+func (m *sensitivityMap) observe(e *AuditEntry) {
+	if m == nil || e.Type != "response" || e.Request.Path == "" {
+		return
+	}
+	level := m.classify(e.Request.Path)
+	metrics.inc("sensitivity_events_total", "level", level.String())
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts[level]++
+	if level != sensUnclassified {
+		return
+	}
+	prefix := unclassifiedPrefix(e.Request.Path)
+	if _, ok := m.unclassified[prefix]; !ok && len(m.unclassified) >= maxUnclassifiedPrefixes {
+		m.overflow++
+		return
+	}
+	m.unclassified[prefix]++
+}
+
+// unclassifiedPrefix is what the report lists an unclassified path under:
+// its first three segments, deep enough to tell secret/data/dev from
+// secret/data/prod.
+func unclassifiedPrefix(path string) string {
+	parts := strings.SplitN(strings.Trim(path, "/"), "/", 4)
+	if len(parts) > 3 {
+		parts = parts[:3]
+	}
+	return strings.Join(parts, "/") + "/"
+}
+
+// apply labels an alert with its path's level and raises its severity as
+// configured for that level.
+func (m *sensitivityMap) apply(a *Alert) {
+	if m == nil || a.Path == "" {
+		return
+	}
+	level := m.classify(a.Path)
+	if level == sensUnclassified {
+		return
+	}
+	a.Sensitivity = level.String()
+	sev := a.Severity + severity(m.boosts[level])
+	if floor, ok := m.floors[level]; ok && sev < floor {
+		sev = floor
+	}
+	if sev > sevCritical {
+		sev = sevCritical
+	}
+	if sev != a.Severity {
+		metrics.inc("sensitivity_escalations_total", "level", level.String())
+		a.Severity, a.Color = sev, sev.color()
+	}
+}
+
+// prefixCount is an unclassified prefix and its events.
+type prefixCount struct {
+	prefix string
+	events int
+}
+
+// report renders the events since the last report per level and resets
+// the counts. It also returns the unclassified prefixes at or above
+// unclassified_min, busiest first.
+func (m *sensitivityMap) report(now time.Time) (localText, []prefixCount) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var b strings.Builder
+	for level := sensCritical; level >= sensUnclassified; level-- {
+		fmt.Fprintf(&b, "%s %d", level, m.counts[level])
+		if level > sensUnclassified {
+			b.WriteString(", ")
+		}
+	}
+
+	var busy []prefixCount
+	for prefix, n := range m.unclassified {
+		if n >= m.cfg.UnclassifiedMin {
+			busy = append(busy, prefixCount{prefix, n})
+		}
+	}
+	sort.Slice(busy, func(i, j int) bool {
+		if busy[i].events != busy[j].events {
+			return busy[i].events > busy[j].events
+		}
+		return busy[i].prefix < busy[j].prefix
+	})
+	var overflow localText
+	if m.overflow > 0 {
+		overflow = msgSensOverflow.with("count", m.overflow)
+	}
+	report := msgSensReportBody.with("since", m.since.UTC().Format("2006-01-02 15:04 UTC"), "counts", b.String(), "overflow", overflow)
+	m.since, m.overflow = now, 0
+	m.counts, m.unclassified = make(map[sensitivityLevel]int), make(map[string]int)
+	return report, busy
+}
+
+var (
+	msgSensReport     = message("sensitivity-report.title")
+	msgSensReportBody = message("sensitivity-report.body")
+	msgSensOverflow   = message("sensitivity-report.overflow")
+	msgSensBusy       = message("sensitivity-report.busy")
+	msgSensBusyPrefix = message("sensitivity-report.busy.prefix")
+	msgSensBusyMore   = message("sensitivity-report.busy.more")
+)
+
+// sensitivityReloadJob picks up changes to sensitivity.file.
+func sensitivityReloadJob(m *sensitivityMap) jobSpec {
+	return jobSpec{
+		name:    "sensitivity-reload",
+		every:   sensitivityReloadInterval,
+		timeout: 10 * time.Second,
+		run: func(ctx context.Context) error {
+			m.mu.Lock()
+			before := m.fileMod
+			m.mu.Unlock()
+			if err := m.reload(false); err != nil {
+				return err
+			}
+			m.mu.Lock()
+			changed, n := !m.fileMod.Equal(before), len(m.prefixes)
+			m.mu.Unlock()
+			if changed {
+				logInfo("🏷️  Sensitivity: reloaded {file}, {prefixes} prefixes", "file", m.cfg.File, "prefixes", n)
+			}
+			return nil
+		},
+	}
+}
+
+// sensitivityReportJob sends the daily breakdown. It is a warning when
+// busy prefixes have no level, so the map grows where the traffic is.
+func sensitivityReportJob(cfg *VaultConfig, m *sensitivityMap) jobSpec {
+	spec := jobSpec{
+		name:    "sensitivity-report",
+		timeout: time.Minute,
+		run: func(ctx context.Context) error {
+			desc, busy := m.report(time.Now())
+			logInfo("🏷️  Sensitivity report: {report}", "report", desc)
+			sev := sevInfo
+			if len(busy) > 0 {
+				sev = sevWarning
+				var console []string
+				var lines []localText
+				for i, b := range busy {
+					console = append(console, fmt.Sprintf("%s (%d)", b.prefix, b.events))
+					if i < sensitivityReportTop {
+						lines = append(lines, msgSensBusyPrefix.with("prefix", mdCode(b.prefix, maxPathLen), "count", b.events))
+					}
+				}
+				if len(busy) > sensitivityReportTop {
+					lines = append(lines, msgSensBusyMore.with("count", len(busy)-sensitivityReportTop))
+				}
+				logWarn("⚠️  Sensitivity: busy prefixes without a level: {prefixes}", "prefixes", strings.Join(console, ", "))
+				desc = msgSensBusy.with("report", desc, "min", m.cfg.UnclassifiedMin, "prefixes", lines)
+			}
+			return notify(cfg, Alert{Severity: sev, Color: sev.color(), Rule: "sensitivity-report"}.say(msgSensReport.with(), desc))
+		},
+	}
+	spec.cron, _ = parseCron(m.cfg.Report) // validated at load
+	return spec
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// overlappingPaths nests four levels under one mount.
+var overlappingPaths = map[string]string{
+	"secret/":                        "low",
+	"secret/data/prod/":              "high",
+	"secret/data/prod/payments/":     "critical",
+	"/secret/data/prod/payments/dev": "medium",
+}
+
+func TestSensitivityLongestPrefixWins(t *testing.T) {
+	m := newSensitivityMap(SensitivityConfig{Paths: overlappingPaths, UnclassifiedMin: 1})
+	tests := []struct {
+		path   string
+		prefix string
+		level  sensitivityLevel
+	}{
+		{"secret/data/dev/app", "secret/", sensLow},
+		{"secret/data/prod/app", "secret/data/prod/", sensHigh},
+		{"/secret/data/prod/app", "secret/data/prod/", sensHigh},
+		{"secret/data/prod/payments/card", "secret/data/prod/payments/", sensCritical},
+		{"secret/data/prod/payments/dev-ledger", "secret/data/prod/payments/dev", sensMedium},
+		{"secret/data/prod", "secret/", sensLow},
+		{"kv/data/prod/app", "", sensUnclassified},
+		{"secrets/app", "", sensUnclassified},
+	}
+	for _, tt := range tests {
+		prefix, level := m.match(tt.path)
+		if prefix != tt.prefix || level != tt.level {
+			t.Errorf("match(%q) = %q, %s; want %q, %s", tt.path, prefix, level, tt.prefix, tt.level)
+		}
+	}
+}
+
+func TestSensitivityNilMap(t *testing.T) {
+	m := newSensitivityMap(SensitivityConfig{})
+	if m != nil {
+		t.Fatal("a config without paths or a file built a map")
+	}
+	if level := m.classify("secret/data/prod/payments/card"); level != sensUnclassified {
+		t.Errorf("nil map classified a path as %s", level)
+	}
+	a := Alert{Path: "secret/data/prod/payments/card", Severity: sevInfo}
+	m.apply(&a)
+	m.observe(&AuditEntry{Type: "response"})
+	if a.Sensitivity != "" || a.Severity != sevInfo {
+		t.Errorf("nil map changed the alert: %+v", a)
+	}
+}
+
+func TestCompileSensitivity(t *testing.T) {
+	prefixes, err := compileSensitivity(
+		map[string]string{"secret/": "low", "secret/data/": "medium"},
+		map[string]string{"/secret/data/": "high", "kv/": "critical"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, p := range prefixes {
+		got = append(got, p.prefix+"="+p.level.String())
+	}
+	if want := "[secret/data/=high secret/=low kv/=critical]"; fmt.Sprint(got) != want {
+		t.Errorf("prefixes = %v, want %s", got, want)
+	}
+
+	for _, tt := range []struct {
+		paths map[string]string
+		want  string
+	}{
+		{map[string]string{"/": "high"}, "empty prefix"},
+		{map[string]string{"secret/": "secret"}, `prefix "secret/": unknown sensitivity "secret"`},
+	} {
+		if _, err := compileSensitivity(tt.paths); !strings.HasPrefix(errString(err), tt.want) {
+			t.Errorf("compileSensitivity(%v) = %v, want %s", tt.paths, err, tt.want)
+		}
+	}
+}
+
+// writeSensitivityFile writes body and moves its mtime on, so a reload
+// sees a change even when the size is the same.
+func writeSensitivityFile(t *testing.T, path, body string, age time.Duration) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	mod := time.Now().Add(-age)
+	if err := os.Chtimes(path, mod, mod); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The file overrides sensitivity.paths where both list a prefix, and a
+// change to it is picked up without a restart.
+func TestSensitivityFileReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "sensitivity.yaml")
+	writeSensitivityFile(t, file, "secret/data/prod/: critical\nkv/: medium\n", time.Hour)
+	m := newSensitivityMap(SensitivityConfig{Paths: overlappingPaths, File: file, UnclassifiedMin: 1})
+
+	check := func(when string, want map[string]sensitivityLevel) {
+		t.Helper()
+		for path, level := range want {
+			if got := m.classify(path); got != level {
+				t.Errorf("%s: classify(%q) = %s, want %s", when, path, got, level)
+			}
+		}
+	}
+	check("loaded", map[string]sensitivityLevel{
+		"secret/data/prod/app":           sensCritical,
+		"secret/data/dev/app":            sensLow,
+		"kv/data/app":                    sensMedium,
+		"secret/data/prod/payments/card": sensCritical,
+	})
+
+	job := sensitivityReloadJob(m)
+	if err := job.run(context.Background()); err != nil {
+		t.Fatalf("unchanged file: %v", err)
+	}
+
+	writeSensitivityFile(t, file, "secret/data/prod/: low\nsecret/data/dev/: high\n", 30*time.Minute)
+	if err := job.run(context.Background()); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	check("reloaded", map[string]sensitivityLevel{
+		"secret/data/prod/app":           sensLow,
+		"secret/data/dev/app":            sensHigh,
+		"kv/data/app":                    sensUnclassified,
+		"secret/data/prod/payments/card": sensCritical,
+	})
+
+	// A broken file keeps the last good prefixes and is reported once.
+	writeSensitivityFile(t, file, "secret/data/prod/: top-secret\n", 20*time.Minute)
+	if err := job.run(context.Background()); err == nil || !strings.Contains(err.Error(), `unknown sensitivity "top-secret"`) {
+		t.Fatalf("broken file: err = %v, want the bad level named", err)
+	}
+	check("after a broken file", map[string]sensitivityLevel{
+		"secret/data/prod/app": sensLow,
+		"secret/data/dev/app":  sensHigh,
+	})
+	if err := job.run(context.Background()); err != nil {
+		t.Errorf("broken file reported twice: %v", err)
+	}
+
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := job.run(context.Background()); err == nil {
+		t.Error("missing file: no error")
+	}
+	check("after the file went away", map[string]sensitivityLevel{"secret/data/dev/app": sensHigh})
+}
+
+// A file that can't be read at startup leaves the config's own prefixes.
+func TestSensitivityBadFileAtStartup(t *testing.T) {
+	m := newSensitivityMap(SensitivityConfig{Paths: overlappingPaths, File: filepath.Join(t.TempDir(), "missing.yaml")})
+	if got := m.classify("secret/data/prod/payments/card"); got != sensCritical {
+		t.Errorf("classify = %s, want critical from sensitivity.paths", got)
+	}
+}
+
+func TestSensitivityApply(t *testing.T) {
+	m := newSensitivityMap(SensitivityConfig{
+		Paths: overlappingPaths,
+		Severity: map[string]SensitivitySeverity{
+			"critical": {Floor: "critical"},
+			"high":     {Boost: 1},
+			"medium":   {Floor: "warning", Boost: 5},
+		},
+	})
+	tests := []struct {
+		path string
+		sev  severity
+		want severity
+		tag  string
+	}{
+		{"secret/data/prod/payments/card", sevInfo, sevCritical, "critical"},
+		{"secret/data/prod/app", sevInfo, sevWarning, "high"},
+		{"secret/data/prod/app", sevWarning, sevCritical, "high"},
+		{"secret/data/prod/app", sevCritical, sevCritical, "high"},
+		{"secret/data/prod/payments/dev-ledger", sevInfo, sevCritical, "medium"},
+		{"secret/data/dev/app", sevInfo, sevInfo, "low"},
+		{"kv/data/app", sevInfo, sevInfo, ""},
+		{"", sevInfo, sevInfo, ""},
+	}
+	for _, tt := range tests {
+		a := Alert{Path: tt.path, Severity: tt.sev, Color: tt.sev.color()}
+		m.apply(&a)
+		if a.Severity != tt.want || a.Sensitivity != tt.tag {
+			t.Errorf("apply(%q, %s) = %s, %q; want %s, %q", tt.path, tt.sev, a.Severity, a.Sensitivity, tt.want, tt.tag)
+		}
+		if a.Color != a.Severity.color() {
+			t.Errorf("apply(%q, %s): color %d doesn't match %s", tt.path, tt.sev, a.Color, a.Severity)
+		}
+	}
+}
+
+// Aggregation rules select paths by level, with overlapping prefixes
+// resolved as for alerts.
+func TestAggregationBySensitivity(t *testing.T) {
+	m := newSensitivityMap(SensitivityConfig{Paths: overlappingPaths})
+	r := &aggregationRule{AggregationRule: AggregationRule{Sensitivity: []string{"critical", "unclassified"}}}
+	for path, want := range map[string]bool{
+		"secret/data/prod/payments/card":       true,
+		"secret/data/prod/payments/dev-ledger": false,
+		"secret/data/prod/app":                 false,
+		"kv/data/app":                          true,
+	} {
+		e := &AuditEntry{Type: "response"}
+		e.Request.Path = path
+		if _, ok := r.group(e, m.classify(path)); ok != want {
+			t.Errorf("rule on [critical unclassified] matched %s: %v, want %v", path, ok, want)
+		}
+	}
+}
+
+func sensitivityEntry(typ, path string) *AuditEntry {
+	e := &AuditEntry{Type: typ}
+	e.Request.Path = path
+	return e
+}
+
+func TestSensitivityReport(t *testing.T) {
+	m := newSensitivityMap(SensitivityConfig{Paths: overlappingPaths, UnclassifiedMin: 3})
+	for i := 0; i < 4; i++ {
+		m.observe(sensitivityEntry("request", "kv/data/team-a/app"))
+		m.observe(sensitivityEntry("response", "kv/data/team-a/app"))
+		m.observe(sensitivityEntry("response", fmt.Sprintf("kv/data/team-b/app-%d", i)))
+	}
+	m.observe(sensitivityEntry("response", "kv/data/team-a"))
+	m.observe(sensitivityEntry("response", "transit/keys/x"))
+	m.observe(sensitivityEntry("response", "secret/data/prod/payments/card"))
+	m.observe(sensitivityEntry("response", "secret/data/prod/app"))
+	m.observe(sensitivityEntry("response", ""))
+
+	desc, busy := m.report(time.Now())
+	text := desc.String()
+	if !strings.Contains(text, "critical 1, high 1, medium 0, low 0, unclassified 10") {
+		t.Errorf("report = %q, want the counts per level", text)
+	}
+	if got, want := fmt.Sprint(busy), "[{kv/data/team-a/ 5} {kv/data/team-b/ 4}]"; got != want {
+		t.Errorf("busy = %s, want %s", got, want)
+	}
+
+	desc, busy = m.report(time.Now())
+	if !strings.Contains(desc.String(), "unclassified 0") || len(busy) != 0 {
+		t.Errorf("second report = %q, %v; want the counts reset", desc, busy)
+	}
+}
+
+func TestSensitivityReportJobWarnsOnBusyPrefixes(t *testing.T) {
+	sent := captureAlerts(t)
+	cfg := &VaultConfig{}
+	m := newSensitivityMap(SensitivityConfig{Paths: overlappingPaths, Report: defaultSensitivityReport, UnclassifiedMin: 2})
+	job := sensitivityReportJob(cfg, m)
+
+	if err := job.run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		m.observe(sensitivityEntry("response", "kv/data/team-a/app"))
+	}
+	if err := job.run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	alerts := sent()
+	if len(alerts) != 2 {
+		t.Fatalf("sent %d alerts, want 2", len(alerts))
+	}
+	if alerts[0].Severity != sevInfo || alerts[0].Rule != "sensitivity-report" {
+		t.Errorf("quiet report = %s %s, want an info sensitivity-report", alerts[0].Severity, alerts[0].Rule)
+	}
+	if alerts[1].Severity != sevWarning || !strings.Contains(alerts[1].Description, "kv/data/team-a/") {
+		t.Errorf("busy report = %s %q, want a warning naming the prefix", alerts[1].Severity, alerts[1].Description)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Session Index ---
+
+// sessionAction is one audit entry as remembered for a token accessor.
+type sessionAction struct {
+	Path      string
+	Operation string
+	Time      time.Time
+	Error     string
+}
+
+// sessionRing holds the last N actions of one accessor, oldest first once
+// unwrapped by actions().
+type sessionRing struct {
+	accessor string
+	buf      []sessionAction
+	next     int
+	full     bool
+}
+
+func (r *sessionRing) add(a sessionAction) {
+	r.buf[r.next] = a
+	r.next = (r.next + 1) % len(r.buf)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+func (r *sessionRing) actions() []sessionAction {
+	if !r.full {
+		return append([]sessionAction(nil), r.buf[:r.next]...)
+	}
+	out := make([]sessionAction, 0, len(r.buf))
+	out = append(out, r.buf[r.next:]...)
+	return append(out, r.buf[:r.next]...)
+}
+
+// sessionIndex maps token accessors to their recent actions. Both the number
+// of actions per accessor and the number of accessors are capped; the least
+// recently active accessor is evicted first.
+type sessionIndex struct {
+	mu           sync.Mutex
+	perAccessor  int
+	maxAccessors int
+	order        *list.List // front = most recently active
+	byAccessor   map[string]*list.Element
+}
+
+func newSessionIndex(cfg SessionIndexConfig) *sessionIndex {
+	return &sessionIndex{
+		perAccessor:  cfg.EntriesPerAccessor,
+		maxAccessors: cfg.MaxAccessors,
+		order:        list.New(),
+		byAccessor:   make(map[string]*list.Element),
+	}
+}
+
+func (s *sessionIndex) record(accessor string, a sessionAction) {
+	if s == nil || accessor == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.byAccessor[accessor]; ok {
+		el.Value.(*sessionRing).add(a)
+		s.order.MoveToFront(el)
+		return
+	}
+
+	for s.order.Len() >= shedCap(s.maxAccessors) {
+		s.evictLocked()
+	}
+	ring := &sessionRing{accessor: accessor, buf: make([]sessionAction, s.perAccessor)}
+	ring.add(a)
+	s.byAccessor[accessor] = s.order.PushFront(ring)
+}
+
+func (s *sessionIndex) evictLocked() {
+	oldest := s.order.Back()
+	s.order.Remove(oldest)
+	delete(s.byAccessor, oldest.Value.(*sessionRing).accessor)
+}
+
+// sessionActionSize is what an estimate charges per action slot, strings
+// aside.
+const sessionActionSize = 80
+
+func (s *sessionIndex) usage() cacheUsage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := cacheUsage{Entries: s.order.Len()}
+	for el := s.order.Front(); el != nil; el = el.Next() {
+		r := el.Value.(*sessionRing)
+		u.Bytes += cacheEntryOverhead + int64(len(r.accessor)+len(r.buf)*sessionActionSize)
+		for _, a := range r.buf {
+			u.Bytes += int64(len(a.Path) + len(a.Operation) + len(a.Error))
+		}
+	}
+	return u
+}
+
+func (s *sessionIndex) shed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.order.Len() > shedCap(s.maxAccessors) {
+		s.evictLocked()
+	}
+}
+
+// clear forgets every accessor, for the drop-sessions stage.
+func (s *sessionIndex) clear() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.order.Init()
+	s.byAccessor = make(map[string]*list.Element)
+}
+
+// recent returns up to k of the accessor's most recent actions, oldest first.
+func (s *sessionIndex) recent(accessor string, k int) []sessionAction {
+	if s == nil || accessor == "" || k <= 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.byAccessor[accessor]
+	if !ok {
+		return nil
+	}
+	actions := el.Value.(*sessionRing).actions()
+	if len(actions) > k {
+		actions = actions[len(actions)-k:]
+	}
+	return actions
+}
+
+// formatSession renders actions as a compact block for alert descriptions.
+func formatSession(actions []sessionAction) string {
+	var b strings.Builder
+	for _, a := range actions {
+		line := fmt.Sprintf("`%s` %s %s", a.Time.UTC().Format("15:04:05"),
+			mdText(a.Operation, maxNameLen), mdCode(a.Path, maxPathLen))
+		if a.Error != "" {
+			line += " (error)"
+		}
+		b.WriteString(line + "\n")
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// --- Notification Signing ---
+
+// SigningConfig points at the directory holding notification signing keys.
+// Each key is stored as <id>.key (private, 0600) and <id>.pub; the file
+// "active" names the key used for new records. Old public keys stay in the
+// directory so records signed before a rotation still verify.
+type SigningConfig struct {
+	KeyDir string `yaml:"key_dir"`
+}
+
+type signer struct {
+	keyID string
+	key   ed25519.PrivateKey
+}
+
+// signedMessage is the canonical byte string a history record's signature
+// covers: payload, timestamp and backend.
+func signedMessage(rec *historyRecord) []byte {
+	return []byte(rec.Payload + "\n" + rec.Time.UTC().Format(time.RFC3339Nano) + "\n" + rec.Backend)
+}
+
+func (s *signer) sign(msg []byte) (string, error) {
+	if len(s.key) != ed25519.PrivateKeySize {
+		return "", fmt.Errorf("signing key %s is malformed", s.keyID)
+	}
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, msg)), nil
+}
+
+func verifySignature(pub ed25519.PublicKey, msg []byte, sig string) bool {
+	raw, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(pub, msg, raw)
+}
+
+// keyIDFor derives a short, stable identifier from a public key.
+func keyIDFor(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+func loadSigner(dir string) (*signer, error) {
+	active, err := os.ReadFile(filepath.Join(dir, "active"))
+	if err != nil {
+		return nil, fmt.Errorf("read active signing key: %w", err)
+	}
+	id := strings.TrimSpace(string(active))
+
+	data, err := os.ReadFile(filepath.Join(dir, id+".key"))
+	if err != nil {
+		return nil, fmt.Errorf("read signing key %s: %w", id, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("signing key %s is not PEM", id)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse signing key %s: %w", id, err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key %s is not Ed25519", id)
+	}
+	// Verifiers find the public key by the ID in the signature; a renamed
+	// or copied key file would sign under an ID no key of theirs has.
+	if got := keyIDFor(key.Public().(ed25519.PublicKey)); got != id {
+		return nil, fmt.Errorf("signing key %s has key ID %s; the active file must name the key by its ID", id, got)
+	}
+	return &signer{keyID: id, key: key}, nil
+}
+
+// loadPublicKeys returns every public key in dir by key ID.
+func loadPublicKeys(dir string) (map[string]ed25519.PublicKey, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.pub"))
+	if err != nil {
+		return nil, fmt.Errorf("list public keys: %w", err)
+	}
+	keys := make(map[string]ed25519.PublicKey)
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("read public key: %w", err)
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("public key %s is not PEM", f)
+		}
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse public key %s: %w", f, err)
+		}
+		pub, ok := parsed.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("public key %s is not Ed25519", f)
+		}
+		keys[keyIDFor(pub)] = pub
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no public keys in %s", dir)
+	}
+	return keys, nil
+}
+
+// --- Command: Keys ---
+
+func runKeys(cfg *VaultConfig, args []string) error {
+	if len(args) < 1 || args[0] != "sign-init" {
+		return fmt.Errorf("usage: vault-warden keys sign-init")
+	}
+	if cfg.Signing.KeyDir == "" {
+		return fmt.Errorf("signing.key_dir is not configured")
+	}
+	dir := cfg.Signing.KeyDir
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("create key dir: %w", err)
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("generate key: %w", err)
+	}
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return fmt.Errorf("encode private key: %w", err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return fmt.Errorf("encode public key: %w", err)
+	}
+
+	id := keyIDFor(pub)
+	privPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER})
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})
+	if err := writeFileAtomic(filepath.Join(dir, id+".key"), privPEM, 0o600); err != nil {
+		return fmt.Errorf("write private key: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, id+".pub"), pubPEM, 0o644); err != nil {
+		return fmt.Errorf("write public key: %w", err)
+	}
+	// Switch last, so a crash never leaves "active" pointing at a missing key.
+	if err := writeFileAtomic(filepath.Join(dir, "active"), []byte(id+"\n"), 0o600); err != nil {
+		return fmt.Errorf("activate key: %w", err)
+	}
+
+	logInfo("✓ Generated signing key {key_id} in {dir}", "key_id", id, "dir", dir)
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadSignerChecksKeyID(t *testing.T) {
+	cfg := &VaultConfig{}
+	cfg.Signing.KeyDir = t.TempDir()
+	if err := runKeys(cfg, []string{"sign-init"}); err != nil {
+		t.Fatal(err)
+	}
+	dir := cfg.Signing.KeyDir
+	s, err := loadSigner(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A copy of the key under another name must not sign as that name.
+	data, err := os.ReadFile(filepath.Join(dir, s.keyID+".key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "0123456789abcdef.key"), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "active"), []byte("0123456789abcdef\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadSigner(dir)
+	if err == nil || !strings.Contains(err.Error(), "has key ID "+s.keyID) {
+		t.Fatalf("err = %v, want the key ID mismatch", err)
+	}
+}
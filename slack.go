@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// --- Slack ---
+
+// Slack's limits per block: header text, section text and field text.
+const (
+	slackHeaderMax  = 150
+	slackSectionMax = 3000
+	slackFieldMax   = 2000
+	slackMaxFields  = 10
+)
+
+// SlackPayload is an incoming webhook message. Each alert is one
+// attachment, for the coloured bar; its blocks hold the content.
+type SlackPayload struct {
+	Attachments []SlackAttachment `json:"attachments"`
+}
+
+type SlackAttachment struct {
+	Color    string       `json:"color"`
+	Fallback string       `json:"fallback"` // notification text
+	Blocks   []SlackBlock `json:"blocks"`
+}
+
+type SlackBlock struct {
+	Type     string      `json:"type"`
+	Text     *SlackText  `json:"text,omitempty"`
+	Fields   []SlackText `json:"fields,omitempty"`
+	Elements []SlackText `json:"elements,omitempty"`
+}
+
+type SlackText struct {
+	Type string `json:"type"` // plain_text or mrkdwn
+	Text string `json:"text"`
+}
+
+// slackNotifier posts alerts the way discordNotifier does, batched by the
+// same rules. Discord's limits are the tighter ones, so they serve for
+// both.
+type slackNotifier struct{}
+
+func (slackNotifier) kind() string { return "slack" }
+
+// accept wants 200; Slack answers errors such as invalid_blocks with a 4xx.
+func (slackNotifier) accept(status int, body []byte) error {
+	if status != http.StatusOK {
+		return fmt.Errorf("returned status %d", status)
+	}
+	return nil
+}
+
+func (n slackNotifier) send(cfg *VaultConfig, alerts []Alert) ([]Alert, error) {
+	return postMessages(cfg, n, packAlerts(alerts))
+}
+
+func (slackNotifier) encode(m discordMessage) ([]byte, error) {
+	p := SlackPayload{}
+	for i, a := range m.alerts {
+		p.Attachments = append(p.Attachments, slackAttachment(a, m.embeds[i]))
+	}
+	return json.Marshal(p)
+}
+
+// slackAttachment lays an alert out like its Discord embed e: the title as
+// a header, then the description, the fields, and a context line with
+// the rule, the sender and the time.
+func slackAttachment(a Alert, e DiscordEmbed) SlackAttachment {
+	att := SlackAttachment{Color: fmt.Sprintf("#%06x", e.Color), Fallback: slackEscape(e.Title)}
+	att.Blocks = append(att.Blocks, SlackBlock{Type: "header",
+		Text: &SlackText{Type: "plain_text", Text: clipRunes(e.Title, slackHeaderMax)}})
+	if e.Description != "" {
+		att.Blocks = append(att.Blocks, SlackBlock{Type: "section",
+			Text: &SlackText{Type: "mrkdwn", Text: clipRunes(slackMarkdown(e.Description), slackSectionMax)}})
+	}
+	var fields []SlackText
+	for _, f := range e.Fields {
+		if len(fields) == slackMaxFields {
+			break
+		}
+		fields = append(fields, SlackText{Type: "mrkdwn",
+			Text: clipRunes("*"+slackEscape(f.Name)+"*\n"+slackMarkdown(f.Value), slackFieldMax)})
+	}
+	if len(fields) > 0 {
+		att.Blocks = append(att.Blocks, SlackBlock{Type: "section", Fields: fields})
+	}
+
+	ts := a.Time
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	var context []string
+	if e.Author != nil {
+		context = append(context, slackEscape(e.Author.Name))
+	}
+	if e.Footer != nil {
+		context = append(context, slackEscape(e.Footer.Text))
+	}
+	// Shown in the reader's time zone, with the UTC time as the fallback.
+	context = append(context, fmt.Sprintf("<!date^%d^{date_short_pretty} {time_secs}|%s>", ts.Unix(), ts.UTC().Format(time.RFC3339)))
+	att.Blocks = append(att.Blocks, SlackBlock{Type: "context",
+		Elements: []SlackText{{Type: "mrkdwn", Text: strings.Join(context, " · ")}}})
+	return att
+}
+
+// slackEscape escapes the three characters Slack reserves for links and
+// mentions.
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// slackMarkdown turns the Discord markdown alerts are written in into
+// Slack's mrkdwn: **bold** becomes *bold*, and the backslash escapes of
+// mdText, which Slack doesn't know, are dropped. Slack can't escape its
+// formatting characters, so an escaped *, _, ~ or ` is fenced with zero
+// width spaces instead, which keeps it from pairing with another. Code
+// spans and blocks are kept as they are.
+func slackMarkdown(md string) string {
+	var b strings.Builder
+	fence := "" // the backticks that opened the current code span or block
+	for i := 0; i < len(md); i++ {
+		c := md[i]
+		switch {
+		case c == '&' || c == '<' || c == '>':
+			b.WriteString(slackEscape(string(c)))
+		case c == '`':
+			j := i
+			for j < len(md) && md[j] == '`' {
+				j++
+			}
+			switch run := md[i:j]; {
+			case fence == "":
+				fence = run
+			case run == fence:
+				fence = ""
+			}
+			b.WriteString(md[i:j])
+			i = j - 1
+		case fence != "":
+			b.WriteByte(c)
+		case c == '\\' && i+1 < len(md) && strings.IndexByte(markdownChars, md[i+1]) >= 0:
+			i++
+			switch n := md[i]; {
+			case n == '&' || n == '<' || n == '>':
+				b.WriteString(slackEscape(string(n)))
+			case strings.IndexByte("*_~`", n) >= 0:
+				b.WriteString("\u200b" + string(n) + "\u200b")
+			default:
+				b.WriteByte(n)
+			}
+		case c == '*' && i+1 < len(md) && md[i+1] == '*':
+			b.WriteByte('*')
+			i++
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// clipRunes caps s at max runes, marking the cut.
+func clipRunes(s string, max int) string {
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	return string([]rune(s)[:max-1]) + "…"
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// --- Standby Mode ---
+
+// wardenMode tracks whether this process is the active warden. A standby
+// warden does all the same processing but sends nothing, so it can take
+// over instantly.
+type wardenMode struct {
+	mu         sync.Mutex
+	standby    bool
+	since      time.Time
+	observed   uint64 // audit lines seen while standby
+	suppressed uint64 // alerts swallowed while standby ("suppressed-standby")
+}
+
+var mode = &wardenMode{}
+
+func (m *wardenMode) setStandby(standby bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.standby = standby
+	m.since = time.Now()
+	m.observed, m.suppressed = 0, 0
+}
+
+// observe counts an audit line processed while standby.
+func (m *wardenMode) observe() {
+	m.mu.Lock()
+	if m.standby {
+		m.observed++
+	}
+	m.mu.Unlock()
+}
+
+// suppress reports whether an outbound alert must be swallowed.
+func (m *wardenMode) suppress(a Alert) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.standby {
+		return false
+	}
+	m.suppressed++
+	logInfo("🔇 Standby, suppressed: {title}", "title", a.Title)
+	return true
+}
+
+func (m *wardenMode) String() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.standby {
+		return fmt.Sprintf("standby since %s (%d events observed, %d alerts suppressed)",
+			m.since.Format(time.RFC3339), m.observed, m.suppressed)
+	}
+	return "active since " + m.since.Format(time.RFC3339)
+}
+
+// promote switches to active mode and announces the takeover. It returns
+// false if the warden was already active.
+func (m *wardenMode) promote(cfg *VaultConfig) bool {
+	m.mu.Lock()
+	if !m.standby {
+		m.mu.Unlock()
+		return false
+	}
+	since, observed, suppressed := m.since, m.observed, m.suppressed
+	m.standby = false
+	m.since = time.Now()
+	m.mu.Unlock()
+
+	logInfo("⬆️  Promoted to active")
+	notify(cfg, Alert{Severity: sevWarning, Color: 0x3498db}.say(msgPromoted.with(),
+		msgPromotedBody.with("standby", time.Since(since).Round(time.Second), "observed", observed, "suppressed", suppressed)))
+	return true
+}
+
+// demote switches back to standby. The announcement goes out before the
+// switch, since nothing is sent afterwards.
+func (m *wardenMode) demote(cfg *VaultConfig) bool {
+	m.mu.Lock()
+	standby := m.standby
+	m.mu.Unlock()
+	if standby {
+		return false
+	}
+
+	notify(cfg, Alert{Severity: sevWarning, Color: 0x95a5a6}.say(msgDemoted.with(), msgDemotedBody.with()))
+	m.setStandby(true)
+	logInfo("⬇️  Demoted to standby")
+	return true
+}
+
+var (
+	msgPromoted     = message("standby.promoted.title")
+	msgPromotedBody = message("standby.promoted.body")
+	msgDemoted      = message("standby.demoted.title")
+	msgDemotedBody  = message("standby.demoted.body")
+)
+
+// modeHandlers registers the promote/demote/mode admin endpoints.
+func modeHandlers(cfg *VaultConfig, mux *http.ServeMux) {
+	change := func(fn func(*VaultConfig) bool, already string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(w, "POST required", http.StatusMethodNotAllowed)
+				return
+			}
+			if !fn(cfg) {
+				fmt.Fprintln(w, already)
+				return
+			}
+			fmt.Fprintln(w, mode.String())
+		}
+	}
+	mux.HandleFunc("/promote", change(mode.promote, "already active"))
+	mux.HandleFunc("/demote", change(mode.demote, "already standby"))
+	mux.HandleFunc("/mode", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, mode.String())
+	})
+}
+
+// runModeCommand implements `promote` and `demote` against a running warden.
+func runModeCommand(cfg *VaultConfig, cmd string) error {
+	c := adminClient(cfg)
+	change := c.Promote
+	if cmd == "demote" {
+		change = c.Demote
+	}
+	out, err := change(context.Background())
+	if err != nil {
+		return err
+	}
+	logInfo("✓ {result}", "result", out)
+	return nil
+}
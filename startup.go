@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// --- Startup Retries ---
+
+// A node that was just started refuses connections, then accepts TCP
+// before TLS is up, then answers 500s and 503s while storage mounts.
+// unlock retries those phases until unlock_startup_wait is spent; any
+// other error fails at once, as before.
+const (
+	defaultUnlockStartupWait = time.Minute
+	startupBackoffMin        = 500 * time.Millisecond
+	startupBackoffMax        = 8 * time.Second
+)
+
+// Startup classes, in metrics and unlock's JSON output.
+const (
+	startupRefused      = "connection_refused" // nothing listening yet
+	startupTLSNotReady  = "tls_not_ready"      // connection dropped before a response, e.g. handshake EOF
+	startupNotActive    = "not_active"         // 500 "local node not active"
+	startupInitializing = "initializing"       // 503 with initialization errors
+)
+
+// Permanent classes, reported alongside the error.
+const (
+	permanentCertificate = "certificate" // the node's certificate doesn't verify
+	permanentNotFound    = "not_found"   // 404 on the endpoint
+	permanentDNS         = "dns"         // the name doesn't resolve
+	permanentOther       = "other"
+)
+
+// vaultResponseError is a Vault answer that was an error, kept whole so
+// its status and messages can be classified.
+type vaultResponseError struct {
+	op     string // e.g. "health check"
+	status int
+	errors []string
+}
+
+func (e *vaultResponseError) Error() string {
+	if len(e.errors) == 0 {
+		return fmt.Sprintf("%s returned %d", e.op, e.status)
+	}
+	return fmt.Sprintf("%s returned %d: %s", e.op, e.status, strings.Join(e.errors, "; "))
+}
+
+// classifyStartup sorts an error from a Vault request into a startup
+// class, which is worth retrying, or a permanent one. The second result
+// says which.
+func classifyStartup(err error) (class string, startup bool) {
+	var ve *vaultResponseError
+	if errors.As(err, &ve) {
+		text := strings.ToLower(strings.Join(ve.errors, " "))
+		switch {
+		case ve.status == http.StatusInternalServerError && strings.Contains(text, "local node not active"):
+			return startupNotActive, true
+		case ve.status == http.StatusServiceUnavailable && strings.Contains(text, "initializ"):
+			return startupInitializing, true
+		case ve.status == http.StatusNotFound:
+			return permanentNotFound, false
+		}
+		return permanentOther, false
+	}
+
+	var dnsErr *net.DNSError
+	var unknownCA x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	var pin *pinMismatchError
+	switch {
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		return permanentDNS, false
+	case errors.As(err, &unknownCA), errors.As(err, &invalid), errors.As(err, &hostname), errors.As(err, &pin):
+		return permanentCertificate, false
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return startupRefused, true
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, syscall.ECONNRESET):
+		return startupTLSNotReady, true
+	}
+	return permanentOther, false
+}
+
+// startupRetries is one cluster's record of waiting for Vault to come up
+// during an unlock run.
+type startupRetries struct {
+	Started  time.Time      `json:"-"`
+	WaitedMS int64          `json:"waited_ms"`
+	Retries  map[string]int `json:"retries,omitempty"` // by startup class
+	// ErrorClass is the class of the error unlock gave up on, if any.
+	ErrorClass string `json:"error_class,omitempty"`
+}
+
+// do runs op until it succeeds, fails with a permanent error, or
+// unlock_startup_wait has passed since the first call. resend says op may
+// be repeated even when an earlier attempt might have reached Vault,
+// which holds for reads but not for submitting a key share.
+func (s *startupRetries) do(cfg *VaultConfig, what string, resend bool, op func() error) error {
+	if s.Started.IsZero() {
+		s.Started = time.Now()
+	}
+	wait := time.Duration(cfg.UnlockStartupWait)
+	backoff := startupBackoffMin
+	for {
+		err := op()
+		if err == nil {
+			return nil
+		}
+		class, startup := classifyStartup(err)
+		if startup && class == startupTLSNotReady && !resend {
+			startup = false
+		}
+		if !startup || time.Since(s.Started)+backoff > wait {
+			s.ErrorClass = class
+			if startup {
+				return fmt.Errorf("%w (still not ready after %s)", err, time.Since(s.Started).Round(time.Second))
+			}
+			return err
+		}
+		if s.Retries == nil {
+			s.Retries = make(map[string]int)
+		}
+		s.Retries[class]++
+		metrics.inc("unlock_startup_retries_total", "class", class)
+		logInfo("⏳ {step}: Vault is still starting up ({class}); retrying in {retry_in}", "step", what, "class", class, "retry_in", formatDuration(backoff))
+		time.Sleep(backoff)
+		s.WaitedMS += backoff.Milliseconds()
+		if backoff *= 2; backoff > startupBackoffMax {
+			backoff = startupBackoffMax
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// dialError is err as an HTTP client returns it from a failed dial.
+func dialError(err error) error {
+	return &url.Error{Op: "Get", URL: "https://vault-1:8200/v1/sys/health",
+		Err: &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", err)}}
+}
+
+func TestClassifyStartup(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		class   string
+		startup bool
+	}{
+		{"refused", dialError(syscall.ECONNREFUSED), startupRefused, true},
+		{"refused, wrapped", fmt.Errorf("health check: %w", dialError(syscall.ECONNREFUSED)), startupRefused, true},
+		{"handshake EOF", &url.Error{Op: "Get", URL: "https://vault-1:8200", Err: io.EOF}, startupTLSNotReady, true},
+		{"unexpected EOF", &url.Error{Op: "Put", URL: "https://vault-1:8200", Err: io.ErrUnexpectedEOF}, startupTLSNotReady, true},
+		{"reset", &url.Error{Op: "Get", URL: "https://vault-1:8200", Err: &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}}, startupTLSNotReady, true},
+		{"not active", &vaultResponseError{op: "unseal", status: 500, errors: []string{"local node not active but active cluster node not found"}}, startupNotActive, true},
+		{"not active, capitalized", &vaultResponseError{op: "unseal", status: 500, errors: []string{"Local node not active"}}, startupNotActive, true},
+		{"initializing", &vaultResponseError{op: "seal status", status: 503, errors: []string{"Vault is initializing"}}, startupInitializing, true},
+		{"initialization error", &vaultResponseError{op: "seal status", status: 503, errors: []string{"core: error during initialization"}}, startupInitializing, true},
+		{"wrapped response", fmt.Errorf("node 2: %w", &vaultResponseError{op: "unseal", status: 500, errors: []string{"local node not active"}}), startupNotActive, true},
+
+		{"500 otherwise", &vaultResponseError{op: "unseal", status: 500, errors: []string{"internal error"}}, permanentOther, false},
+		{"503 sealed", &vaultResponseError{op: "health check", status: 503, errors: []string{"Vault is sealed"}}, permanentOther, false},
+		{"503 without errors", &vaultResponseError{op: "health check", status: 503}, permanentOther, false},
+		{"not active on a 503", &vaultResponseError{op: "unseal", status: 503, errors: []string{"local node not active"}}, permanentOther, false},
+		{"404", &vaultResponseError{op: "unseal", status: 404}, permanentNotFound, false},
+		{"404 with errors", &vaultResponseError{op: "unseal", status: 404, errors: []string{"no handler for route"}}, permanentNotFound, false},
+		{"400", &vaultResponseError{op: "unseal", status: 400, errors: []string{"invalid key"}}, permanentOther, false},
+		{"NXDOMAIN", &url.Error{Op: "Get", URL: "https://nope:8200", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "nope", IsNotFound: true}}}, permanentDNS, false},
+		{"DNS timeout", &url.Error{Op: "Get", URL: "https://vault-1:8200", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "i/o timeout", Name: "vault-1", IsTimeout: true}}}, permanentOther, false},
+		{"unknown CA", &url.Error{Op: "Get", URL: "https://vault-1:8200", Err: x509.UnknownAuthorityError{}}, permanentCertificate, false},
+		{"expired", &url.Error{Op: "Get", URL: "https://vault-1:8200", Err: x509.CertificateInvalidError{Reason: x509.Expired}}, permanentCertificate, false},
+		{"wrong host", &url.Error{Op: "Get", URL: "https://vault-1:8200", Err: x509.HostnameError{Host: "vault-1"}}, permanentCertificate, false},
+		{"pin mismatch", &url.Error{Op: "Get", URL: "https://vault-1:8200", Err: &pinMismatchError{address: "https://vault-1:8200", presented: &tlsIdentity{}}}, permanentCertificate, false},
+		{"timeout", &url.Error{Op: "Get", URL: "https://vault-1:8200", Err: context.DeadlineExceeded}, permanentOther, false},
+		{"unreachable", dialError(syscall.EHOSTUNREACH), permanentOther, false},
+		{"plain", errors.New("something else"), permanentOther, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			class, startup := classifyStartup(tt.err)
+			if class != tt.class || startup != tt.startup {
+				t.Errorf("classifyStartup(%v) = %s, %v; want %s, %v", tt.err, class, startup, tt.class, tt.startup)
+			}
+		})
+	}
+}
+
+// The same classes from real connections: a port nobody listens on, a
+// listener that drops the connection before TLS, and a certificate the
+// client doesn't trust.
+func TestClassifyStartupConnections(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refusedAddr := closed.Addr().String()
+	closed.Close()
+
+	dropping, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dropping.Close()
+	go func() {
+		for {
+			c, err := dropping.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	untrusted := httptest.NewTLSServer(http.NotFoundHandler())
+	defer untrusted.Close()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	for _, tt := range []struct {
+		url   string
+		class string
+	}{
+		{"https://" + refusedAddr + "/v1/sys/health", startupRefused},
+		{"https://" + dropping.Addr().String() + "/v1/sys/health", startupTLSNotReady},
+		{untrusted.URL + "/v1/sys/health", permanentCertificate},
+	} {
+		resp, err := client.Get(tt.url)
+		if err == nil {
+			resp.Body.Close()
+			t.Fatalf("GET %s succeeded", tt.url)
+		}
+		if class, _ := classifyStartup(err); class != tt.class {
+			t.Errorf("GET %s: %v classified %s, want %s", tt.url, err, class, tt.class)
+		}
+	}
+}
+
+func startupTestConfig(wait time.Duration) *VaultConfig {
+	return &VaultConfig{UnlockStartupWait: Duration(wait)}
+}
+
+// failing returns an op that fails with errs in turn, then succeeds.
+func failing(errs ...error) (func() error, *int) {
+	calls := 0
+	return func() error {
+		calls++
+		if calls <= len(errs) {
+			return errs[calls-1]
+		}
+		return nil
+	}, &calls
+}
+
+func TestStartupRetriesRecover(t *testing.T) {
+	before := metrics.sum("unlock_startup_retries_total")
+	var s startupRetries
+	op, calls := failing(dialError(syscall.ECONNREFUSED),
+		&vaultResponseError{op: "unseal", status: 500, errors: []string{"local node not active"}})
+	if err := s.do(startupTestConfig(time.Minute), "Health check", true, op); err != nil {
+		t.Fatal(err)
+	}
+	if *calls != 3 {
+		t.Errorf("op called %d times, want 3", *calls)
+	}
+	if s.WaitedMS != 1500 || s.ErrorClass != "" {
+		t.Errorf("waited %dms, error class %q; want 1500ms and none", s.WaitedMS, s.ErrorClass)
+	}
+	if d := metrics.sum("unlock_startup_retries_total") - before; d != 2 {
+		t.Errorf("unlock_startup_retries_total grew by %v, want 2", d)
+	}
+	out, _ := json.Marshal(&s)
+	if want := `{"waited_ms":1500,"retries":{"connection_refused":1,"not_active":1}}`; string(out) != want {
+		t.Errorf("JSON = %s, want %s", out, want)
+	}
+}
+
+func TestStartupRetriesPermanent(t *testing.T) {
+	start := time.Now()
+	var s startupRetries
+	op, calls := failing(&vaultResponseError{op: "unseal", status: 404})
+	err := s.do(startupTestConfig(time.Minute), "Unseal", true, op)
+	if err == nil || *calls != 1 {
+		t.Fatalf("err = %v after %d calls, want a failure on the first", err, *calls)
+	}
+	if s.ErrorClass != permanentNotFound || len(s.Retries) != 0 || time.Since(start) > 100*time.Millisecond {
+		t.Errorf("record = %+v after %s, want not_found at once", s, time.Since(start))
+	}
+}
+
+// A key share that may have reached Vault isn't sent again: a dropped
+// connection mid-submit fails instead of retrying.
+func TestStartupRetriesNoResend(t *testing.T) {
+	var s startupRetries
+	op, calls := failing(&url.Error{Op: "Put", URL: "https://vault-1:8200/v1/sys/unseal", Err: io.EOF})
+	if err := s.do(startupTestConfig(time.Minute), "Unseal", false, op); err == nil || *calls != 1 {
+		t.Fatalf("err = %v after %d calls, want a failure without a resend", err, *calls)
+	}
+	if s.ErrorClass != startupTLSNotReady {
+		t.Errorf("error class = %q, want %s", s.ErrorClass, startupTLSNotReady)
+	}
+
+	// A refused connection never reached Vault, so it is retried.
+	s = startupRetries{}
+	op, calls = failing(dialError(syscall.ECONNREFUSED))
+	if err := s.do(startupTestConfig(time.Minute), "Unseal", false, op); err != nil || *calls != 2 {
+		t.Errorf("err = %v after %d calls, want a retry then success", err, *calls)
+	}
+}
+
+func TestStartupRetriesGiveUp(t *testing.T) {
+	var s startupRetries
+	refused := dialError(syscall.ECONNREFUSED)
+	op, calls := failing(refused, refused, refused, refused)
+	err := s.do(startupTestConfig(time.Second), "Health check", true, op)
+	if err == nil || !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("err = %v, want the refused connection", err)
+	}
+	if *calls != 2 || s.Retries[startupRefused] != 1 || s.ErrorClass != startupRefused {
+		t.Errorf("%d calls, record %+v; want one retry within the 1s wait, then connection_refused", *calls, s)
+	}
+}
+
+// The wait is for the whole run: a later step starts with what the
+// earlier ones spent.
+func TestStartupRetriesShareTheWait(t *testing.T) {
+	s := startupRetries{Started: time.Now().Add(-time.Minute)}
+	op, calls := failing(dialError(syscall.ECONNREFUSED))
+	if err := s.do(startupTestConfig(time.Minute), "Unseal", true, op); err == nil || *calls != 1 {
+		t.Errorf("err = %v after %d calls, want no retry once the wait is spent", err, *calls)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// --- State Store ---
+
+const defaultStateFile = "/var/lib/vault-warden/state.json"
+
+// wardenState is everything vault-warden persists between runs. The unlock
+// and audit commands run as separate processes, so each one only touches its
+// own fields inside update().
+type wardenState struct {
+	Unseals      []unsealRecord              `json:"unseals,omitempty"`
+	SealBackends map[string]sealBackendState `json:"seal_backends,omitempty"`
+	AuditPairs   *auditPairsState            `json:"audit_pairs,omitempty"`
+	SealedSince  time.Time                   `json:"sealed_since"`
+	// Open Grafana region annotations by incident key.
+	GrafanaRegions map[string]int64 `json:"grafana_regions,omitempty"`
+	Ceremony       *ceremonyState   `json:"ceremony,omitempty"`
+	// Path prefixes each identity has accessed, by display name.
+	FirstAccess map[string]*identityAccess `json:"first_access,omitempty"`
+	// What each Vault node supports, by address.
+	VaultNodes map[string]*vaultCapabilities `json:"vault_nodes,omitempty"`
+	// Coordinated access windows by rule name, then group.
+	Coordinated map[string]map[string]*accessWindow `json:"coordinated,omitempty"`
+	// SPKI last reported as a pin mismatch, by address.
+	TLSPinMismatches map[string]string `json:"tls_pin_mismatches,omitempty"`
+	// Spool offset the hub has acknowledged, on an edge.
+	ForwardAcked int64 `json:"forward_acked,omitempty"`
+	// The cluster the keys were first used on; see binding.go.
+	ClusterBinding *clusterBinding `json:"cluster_binding,omitempty"`
+	// Match counts and more by rule name; see rulestats.go.
+	RuleStats map[string]*ruleStat `json:"rule_stats,omitempty"`
+}
+
+// unsealRecord marks a window in which this warden submitted unseal keys.
+// Finished is zero while the submission is still in progress.
+type unsealRecord struct {
+	Host     string    `json:"host"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished,omitempty"`
+	Keys     int       `json:"keys"`
+}
+
+type stateStore struct {
+	path string
+}
+
+func newStateStore(path string) *stateStore {
+	if path == "" {
+		path = defaultStateFile
+	}
+	return &stateStore{path: path}
+}
+
+// load reads the state file. A missing file is an empty state.
+func (s *stateStore) load() (*wardenState, error) {
+	var st wardenState
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &st, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read state: %w", err)
+	}
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, fmt.Errorf("parse state: %w", err)
+	}
+	return &st, nil
+}
+
+// update applies fn to the current on-disk state under an exclusive lock and
+// writes the result atomically.
+func (s *stateStore) update(fn func(*wardenState)) error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return fmt.Errorf("create state dir: %w", err)
+	}
+	lock, err := os.OpenFile(s.path+".lock", os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return fmt.Errorf("open state lock: %w", err)
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("lock state: %w", err)
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	st, err := s.load()
+	if err != nil {
+		return err
+	}
+	fn(st)
+
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal state: %w", err)
+	}
+	return writeFileAtomic(s.path, data, 0o600)
+}
+
+// writeFileAtomic writes data to a temp file next to path and renames it
+// into place, so readers never see a partial file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write temp file: %w", err)
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return fmt.Errorf("chmod temp file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close temp file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("rename temp file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// --- StatsD Exporter ---
+
+const (
+	defaultStatsDPrefix = "vault_warden."
+	defaultStatsDFlush  = 10 * time.Second
+	statsdMaxPacket     = 1432 // fits one Ethernet frame with IP/UDP headers
+)
+
+// StatsDConfig pushes the metrics registry to a statsd or DogStatsD agent
+// over UDP. Counters are sent as deltas since the previous flush.
+type StatsDConfig struct {
+	Address       string   `yaml:"address"` // host:port, e.g. 127.0.0.1:8125
+	Prefix        string   `yaml:"prefix"`
+	Tags          []string `yaml:"tags"`      // constant tags, "key:value"
+	DogStatsD     bool     `yaml:"dogstatsd"` // send labels as |#tags; plain statsd drops them
+	FlushInterval Duration `yaml:"flush_interval"`
+}
+
+// statsdExporter flushes registry snapshots on an interval. Writes never
+// block: a packet the socket buffer can't take is dropped and counted. A
+// nil *statsdExporter is a no-op.
+type statsdExporter struct {
+	cfg  StatsDConfig
+	reg  *metricsRegistry
+	conn *net.UDPConn
+
+	last map[string]float64 // counter values at the previous flush; run goroutine only
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+var statsdSink *statsdExporter
+
+func startStatsD(cfg *VaultConfig) *statsdExporter {
+	sc := cfg.Metrics.StatsD
+	if sc.Address == "" {
+		return nil
+	}
+	addr, err := net.ResolveUDPAddr("udp", sc.Address)
+	if err != nil {
+		logWarn("⚠️  StatsD: {error}", "error", err)
+		return nil
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		logWarn("⚠️  StatsD: {error}", "error", err)
+		return nil
+	}
+	e := &statsdExporter{
+		cfg:  sc,
+		reg:  metrics,
+		conn: conn,
+		last: make(map[string]float64),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+func (e *statsdExporter) run() {
+	defer close(e.done)
+	t := time.NewTicker(time.Duration(e.cfg.FlushInterval))
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			e.flush()
+		case <-e.stop:
+			e.flush()
+			return
+		}
+	}
+}
+
+// flush sends one snapshot, packed into as few packets as fit.
+func (e *statsdExporter) flush() {
+	var packet []byte
+	for _, line := range e.lines(e.reg.snapshot()) {
+		if len(packet) > 0 && len(packet)+1+len(line) > statsdMaxPacket {
+			e.write(packet)
+			packet = packet[:0]
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) > 0 {
+		e.write(packet)
+	}
+}
+
+// lines renders a snapshot in statsd line format. Histograms become
+// count and sum counters plus one bucket counter per bound, tagged le.
+func (e *statsdExporter) lines(samples []metricSample) []string {
+	var out []string
+	counter := func(name string, labels []string, v float64) {
+		key := name + "\x00" + strings.Join(labels, "\x00")
+		delta := v - e.last[key]
+		e.last[key] = v
+		if delta > 0 {
+			out = append(out, e.line(name, labels, delta, "c"))
+		}
+	}
+	for _, s := range samples {
+		switch s.Kind {
+		case kindCounter:
+			counter(s.Name, s.Labels, s.Value)
+		case kindGauge:
+			out = append(out, e.line(s.Name, s.Labels, s.Value, "g"))
+		case kindHistogram:
+			counter(s.Name+".count", s.Labels, float64(s.Count))
+			counter(s.Name+".sum", s.Labels, s.Value)
+			for i, bound := range latencyBuckets {
+				labels := append(append([]string(nil), s.Labels...), "le", strconv.FormatFloat(bound, 'f', -1, 64))
+				counter(s.Name+".bucket", labels, float64(s.Buckets[i]))
+			}
+		}
+	}
+	return out
+}
+
+func (e *statsdExporter) line(name string, labels []string, v float64, typ string) string {
+	var b strings.Builder
+	b.WriteString(e.cfg.Prefix)
+	b.WriteString(statsdSanitize(name))
+	b.WriteByte(':')
+	b.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+	b.WriteByte('|')
+	b.WriteString(typ)
+	if e.cfg.DogStatsD {
+		tags := append([]string(nil), e.cfg.Tags...)
+		for i := 0; i+1 < len(labels); i += 2 {
+			tags = append(tags, statsdSanitize(labels[i])+":"+statsdSanitize(labels[i+1]))
+		}
+		if len(tags) > 0 {
+			b.WriteString("|#")
+			b.WriteString(strings.Join(tags, ","))
+		}
+	}
+	return b.String()
+}
+
+// statsdSanitize replaces the characters that delimit the line format.
+func statsdSanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', ',', '#', '@', '\n', ' ':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// write sends one packet without waiting for buffer space.
+func (e *statsdExporter) write(packet []byte) {
+	rc, err := e.conn.SyscallConn()
+	if err == nil {
+		werr := rc.Write(func(fd uintptr) bool {
+			_, err = syscall.Write(int(fd), packet)
+			return true // never wait for writability
+		})
+		if werr != nil {
+			err = werr
+		}
+	}
+	if err != nil {
+		e.reg.inc("statsd_dropped_packets_total")
+		// A full buffer or an agent that isn't listening yet is expected.
+		if !errors.Is(err, syscall.EAGAIN) && !errors.Is(err, syscall.ENOBUFS) && !errors.Is(err, syscall.ECONNREFUSED) {
+			logWarn("⚠️  StatsD: {error}", "error", err)
+		}
+	}
+}
+
+// close sends a final flush.
+func (e *statsdExporter) close(timeout time.Duration) {
+	if e == nil {
+		return
+	}
+	close(e.stop)
+	select {
+	case <-e.done:
+	case <-time.After(timeout):
+	}
+	e.conn.Close()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// --- Audit From Stdin ---
+
+// runStdin runs the audit pipeline over entries piped in, e.g. from
+// journalctl, instead of tailing audit_log. EOF is a clean shutdown: the
+// queue drains, bursts being coalesced go out and the detectors save
+// their state, as when the daemon stops.
+func runStdin(doc *configDoc, cfg *VaultConfig, opts replayOptions) error {
+	cfg, err := opts.config(doc, cfg)
+	if err != nil {
+		return err
+	}
+	if opts.printOnly {
+		defer printAlerts()()
+	} else {
+		defer openSinks(cfg)()
+		ob, pending, err := openOutbox(cfg)
+		if err != nil {
+			logWarn("⚠️  Outbox disabled: {error}", "error", err)
+		}
+		outbox = ob
+		defer func() {
+			outbox.close()
+			outbox = nil
+		}()
+		queue = startNotifyQueue(cfg, deliverAlerts(cfg))
+		defer func() {
+			queue.close(time.Duration(cfg.Queue.DrainTimeout))
+			queue = nil
+		}()
+		replayOutbox(cfg, queue, pending)
+		alertIndex = openHistoryIndex(cfg)
+	}
+
+	a := newAuditor(cfg)
+	a.plugins = newDetectorPlugins(cfg, func(al Alert) {
+		a.sensitivity.apply(&al)
+		notify(cfg, al)
+	})
+	sched := newScheduler()
+	a.schedule(sched)
+	sup := newSupervisor()
+	sup.add(componentSpec{name: "scheduler", policy: policyFatal, run: sched.run})
+	for _, p := range a.plugins {
+		sup.add(componentSpec{name: "plugin:" + p.cfg.Name, policy: policyRestart, run: p.run})
+	}
+	logInfo("📥 Reading audit entries from stdin{window}", "window", describeReplay(opts))
+
+	// Lines are checked here, not on the reader, so nothing is processed
+	// once shutdown begins. The unbuffered channel is the backpressure:
+	// the pipe fills while a line is checked.
+	lines, done, stop := make(chan []byte), make(chan error, 1), make(chan struct{})
+	defer close(stop)
+	go func() {
+		done <- readAuditLines(os.Stdin, func(line []byte) bool {
+			select {
+			case lines <- line:
+				return false
+			case <-stop:
+				return true
+			}
+		})
+	}()
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+	var st replayStats
+	var failure error
+read:
+	for {
+		select {
+		case line := <-lines:
+			if st.line(a, opts, line) {
+				break read
+			}
+		case failure = <-done:
+			break read
+		case <-sigChan:
+			logInfo("\n🛑 Interrupted")
+			break read
+		case failure = <-sup.failure():
+			logWarn("🛑 Shutting down: {error}", "error", failure)
+			break read
+		}
+	}
+	sup.stop(shutdownGrace)
+	a.save()
+	logInfo("📥 Read {entries} entries from stdin{span} ({skipped} skipped before -from)", "entries", st.entries, "span", st.span(), "skipped", st.skipped)
+	return failure
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+// --- Supervisor ---
+
+const (
+	maxRestartDelay = 30 * time.Second
+	// A restartable component that needs more than maxRestarts restarts
+	// within restartWindow is broken rather than unlucky; it escalates to
+	// a fatal failure.
+	maxRestarts   = 5
+	restartWindow = 10 * time.Minute
+	// shutdownGrace bounds how long shutdown waits for components; the
+	// scheduler's grace for running jobs fits within it.
+	shutdownGrace = 15 * time.Second
+)
+
+// exitPolicy says what happens when a component's run returns before
+// shutdown, with or without an error. A panic counts as an error.
+type exitPolicy int
+
+const (
+	// policyRestart restarts it with a growing delay, up to maxRestarts
+	// in restartWindow, then escalates like policyFatal.
+	policyRestart exitPolicy = iota
+	// policyFatal shuts the process down through the normal shutdown
+	// path: the one component can't be done without.
+	policyFatal
+	// policyIgnore logs the exit and leaves it stopped.
+	policyIgnore
+)
+
+func (p exitPolicy) String() string {
+	switch p {
+	case policyRestart:
+		return "restart"
+	case policyFatal:
+		return "fatal"
+	default:
+		return "ignore"
+	}
+}
+
+// componentSpec is a long-lived part of a running warden. run must return
+// once ctx is done; returning earlier is an exit handled by policy.
+type componentSpec struct {
+	name   string
+	policy exitPolicy
+	run    func(ctx context.Context) error
+}
+
+// componentStatus is a component's lifecycle, shown in /statusz.
+type componentStatus struct {
+	Name      string    `json:"name"`
+	Policy    string    `json:"policy"`
+	State     string    `json:"state"` // running, restarting, stopped or failed
+	Started   time.Time `json:"started,omitempty"`
+	Restarts  int       `json:"restarts,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// supervisor runs components in their own goroutines under one context,
+// so every part of the process stops the same way and fails the same way.
+type supervisor struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	failed chan error // the first fatal failure
+	// restartDelay is the first restart's delay; it doubles for each
+	// restart after, up to maxRestartDelay.
+	restartDelay time.Duration
+
+	mu     sync.Mutex
+	status map[string]*componentStatus
+}
+
+func newSupervisor() *supervisor {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &supervisor{ctx: ctx, cancel: cancel, failed: make(chan error, 1), restartDelay: time.Second,
+		status: make(map[string]*componentStatus)}
+}
+
+// add starts a component.
+func (s *supervisor) add(spec componentSpec) {
+	s.mu.Lock()
+	s.status[spec.name] = &componentStatus{Name: spec.name, Policy: spec.policy.String()}
+	s.mu.Unlock()
+	s.wg.Add(1)
+	go s.supervise(spec)
+}
+
+// failure delivers the first fatal failure; after it the caller is
+// expected to shut down.
+func (s *supervisor) failure() <-chan error {
+	return s.failed
+}
+
+func (s *supervisor) supervise(spec componentSpec) {
+	defer s.wg.Done()
+	delay := s.restartDelay
+	var restarts []time.Time
+	for {
+		s.update(spec.name, func(st *componentStatus) { st.State, st.Started = "running", time.Now() })
+		metrics.inc("component_starts_total", "component", spec.name)
+		err := s.runOnce(spec)
+		if s.ctx.Err() != nil {
+			s.update(spec.name, func(st *componentStatus) { st.State = "stopped" })
+			return
+		}
+		if err == nil {
+			err = errors.New("exited unexpectedly")
+		}
+		metrics.inc("component_exits_total", "component", spec.name, "policy", spec.policy.String())
+		s.update(spec.name, func(st *componentStatus) { st.LastError = err.Error() })
+
+		switch spec.policy {
+		case policyIgnore:
+			logWarn("⚠️  {component} stopped: {error}", "component", spec.name, "error", err)
+			s.update(spec.name, func(st *componentStatus) { st.State = "stopped" })
+			return
+		case policyFatal:
+			s.fail(spec.name, err)
+			return
+		}
+
+		now := time.Now()
+		kept := restarts[:0]
+		for _, t := range restarts {
+			if now.Sub(t) < restartWindow {
+				kept = append(kept, t)
+			}
+		}
+		if restarts = append(kept, now); len(restarts) > maxRestarts {
+			s.fail(spec.name, fmt.Errorf("%w; %d restarts within %s", err, maxRestarts, formatDuration(restartWindow)))
+			return
+		}
+		logWarn("🔁 {component} failed: {error}; restarting in {delay}", "component", spec.name, "error", err, "delay", delay)
+		metrics.inc("component_restarts_total", "component", spec.name)
+		s.update(spec.name, func(st *componentStatus) { st.State = "restarting"; st.Restarts++ })
+		select {
+		case <-time.After(delay):
+		case <-s.ctx.Done():
+			s.update(spec.name, func(st *componentStatus) { st.State = "stopped" })
+			return
+		}
+		if delay *= 2; delay > maxRestartDelay {
+			delay = maxRestartDelay
+		}
+	}
+}
+
+// runOnce runs the component, turning a panic into an error.
+func (s *supervisor) runOnce(spec componentSpec) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			metrics.inc("component_panics_total", "component", spec.name)
+			logError("💥 {component} panicked: {panic}\n{stack}", "component", spec.name, "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return spec.run(s.ctx)
+}
+
+func (s *supervisor) fail(name string, err error) {
+	s.update(name, func(st *componentStatus) { st.State = "failed" })
+	logWarn("⛔ {component} failed: {error}", "component", name, "error", err)
+	select {
+	case s.failed <- fmt.Errorf("%s: %w", name, err):
+	default: // already shutting down for an earlier failure
+	}
+}
+
+func (s *supervisor) update(name string, fn func(*componentStatus)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(s.status[name])
+}
+
+// snapshot lists the components for /statusz.
+func (s *supervisor) snapshot() []componentStatus {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]componentStatus, 0, len(s.status))
+	for _, st := range s.status {
+		out = append(out, *st)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// stop cancels every component and waits up to grace for them to return.
+func (s *supervisor) stop(grace time.Duration) {
+	s.cancel()
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(grace):
+		logWarn("⚠️  Components still running after {grace}, abandoning them", "grace", grace)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testSupervisor(t *testing.T) *supervisor {
+	s := newSupervisor()
+	s.restartDelay = time.Millisecond
+	t.Cleanup(func() { s.stop(time.Second) })
+	return s
+}
+
+func componentNamed(s *supervisor, name string) componentStatus {
+	for _, st := range s.snapshot() {
+		if st.Name == name {
+			return st
+		}
+	}
+	return componentStatus{}
+}
+
+func awaitFailure(t *testing.T, s *supervisor) error {
+	t.Helper()
+	select {
+	case err := <-s.failure():
+		return err
+	case <-time.After(2 * time.Second):
+		t.Fatal("no fatal failure")
+		return nil
+	}
+}
+
+// A component that keeps panicking is restarted with growing delays, then
+// escalates to a fatal failure once it has used up its restarts.
+func TestSupervisorRepeatedPanics(t *testing.T) {
+	s := testSupervisor(t)
+	var runs int32
+	var starts []time.Time
+	startCh := make(chan time.Time, maxRestarts+2)
+	panics := metrics.sum("component_panics_total")
+	s.add(componentSpec{name: "flaky", policy: policyRestart, run: func(ctx context.Context) error {
+		atomic.AddInt32(&runs, 1)
+		startCh <- time.Now()
+		panic("nil map write")
+	}})
+
+	err := awaitFailure(t, s)
+	if err == nil || !strings.HasPrefix(err.Error(), "flaky: panic: nil map write") ||
+		!strings.Contains(err.Error(), "5 restarts within 10m") {
+		t.Errorf("failure = %v, want the panic and the restart limit", err)
+	}
+	if n := atomic.LoadInt32(&runs); n != maxRestarts+1 {
+		t.Errorf("ran %d times, want %d", n, maxRestarts+1)
+	}
+	if d := metrics.sum("component_panics_total") - panics; d != maxRestarts+1 {
+		t.Errorf("component_panics_total grew by %v, want %d", d, maxRestarts+1)
+	}
+	st := componentNamed(s, "flaky")
+	if st.State != "failed" || st.Restarts != maxRestarts || !strings.Contains(st.LastError, "panic: nil map write") {
+		t.Errorf("status = %+v, want failed after %d restarts", st, maxRestarts)
+	}
+
+	close(startCh)
+	for at := range startCh {
+		starts = append(starts, at)
+	}
+	// Each wait at least doubles the last one's minimum.
+	for i := 1; i < len(starts); i++ {
+		if min := s.restartDelay << (i - 1); starts[i].Sub(starts[i-1]) < min {
+			t.Errorf("restart %d after %s, want at least %s", i, starts[i].Sub(starts[i-1]), min)
+		}
+	}
+}
+
+// Restarts long enough apart don't add up to an escalation.
+func TestSupervisorRestartRecovers(t *testing.T) {
+	s := testSupervisor(t)
+	var runs int32
+	s.add(componentSpec{name: "once", policy: policyRestart, run: func(ctx context.Context) error {
+		if atomic.AddInt32(&runs, 1) == 1 {
+			return errors.New("connection reset")
+		}
+		<-ctx.Done()
+		return nil
+	}})
+	waitFor(t, "the restart", func() bool { return atomic.LoadInt32(&runs) == 2 })
+	st := componentNamed(s, "once")
+	if st.State != "running" || st.Restarts != 1 || st.LastError != "connection reset" {
+		t.Errorf("status = %+v, want running after one restart", st)
+	}
+	select {
+	case err := <-s.failure():
+		t.Errorf("failure %v for a component that recovered", err)
+	default:
+	}
+}
+
+// A fatal component's exit takes the process down the shutdown path: the
+// first failure is delivered, and stopping cancels the others, which get
+// to finish their own cleanup.
+func TestSupervisorFatalShutdown(t *testing.T) {
+	s := testSupervisor(t)
+	var cleaned int32
+	for _, name := range []string{"scheduler", "admin"} {
+		s.add(componentSpec{name: name, policy: policyRestart, run: func(ctx context.Context) error {
+			<-ctx.Done()
+			atomic.AddInt32(&cleaned, 1)
+			return ctx.Err()
+		}})
+	}
+	s.add(componentSpec{name: "receiver", policy: policyFatal, run: func(ctx context.Context) error {
+		return errors.New("listen tcp :8443: address already in use")
+	}})
+	s.add(componentSpec{name: "socket", policy: policyFatal, run: func(ctx context.Context) error {
+		time.Sleep(10 * time.Millisecond)
+		panic("second failure")
+	}})
+
+	err := awaitFailure(t, s)
+	if err == nil || err.Error() != "receiver: listen tcp :8443: address already in use" {
+		t.Fatalf("failure = %v, want the receiver's", err)
+	}
+	waitFor(t, "the second failure", func() bool { return componentNamed(s, "socket").State == "failed" })
+
+	s.stop(time.Second)
+	if n := atomic.LoadInt32(&cleaned); n != 2 {
+		t.Errorf("%d components cleaned up, want 2", n)
+	}
+	for _, st := range s.snapshot() {
+		want := "stopped"
+		if st.Policy == "fatal" {
+			want = "failed"
+		}
+		if st.State != want {
+			t.Errorf("%s is %s, want %s", st.Name, st.State, want)
+		}
+	}
+}
+
+func TestSupervisorIgnorePolicy(t *testing.T) {
+	s := testSupervisor(t)
+	var runs int32
+	s.add(componentSpec{name: "optional", policy: policyIgnore, run: func(ctx context.Context) error {
+		atomic.AddInt32(&runs, 1)
+		panic("boom")
+	}})
+	waitFor(t, "the component to stop", func() bool { return componentNamed(s, "optional").State == "stopped" })
+	time.Sleep(20 * time.Millisecond)
+	if n := atomic.LoadInt32(&runs); n != 1 {
+		t.Errorf("ran %d times, want 1", n)
+	}
+	select {
+	case err := <-s.failure():
+		t.Errorf("failure %v from an ignored component", err)
+	default:
+	}
+}
+
+// A component that ignores its context doesn't hold shutdown past the
+// grace period.
+func TestSupervisorStopGrace(t *testing.T) {
+	s := newSupervisor()
+	block := make(chan struct{})
+	defer close(block)
+	s.add(componentSpec{name: "stuck", policy: policyRestart, run: func(ctx context.Context) error {
+		<-block
+		return nil
+	}})
+	start := time.Now()
+	s.stop(50 * time.Millisecond)
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("stop took %s with a 50ms grace", took)
+	}
+}
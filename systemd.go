@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- systemd Notification ---
+
+// sdStatusInterval is how often STATUS= is refreshed when the unit has no
+// watchdog to pace it.
+const sdStatusInterval = 30 * time.Second
+
+// sdNotifier speaks the sd_notify protocol on $NOTIFY_SOCKET, for units
+// with Type=notify. A nil *sdNotifier, as when the variable is unset,
+// sends nothing.
+type sdNotifier struct {
+	conn *net.UnixConn
+	// watchdog is the unit's WatchdogSec, from $WATCHDOG_USEC; zero when
+	// it has none or it is meant for another process.
+	watchdog time.Duration
+}
+
+func newSDNotifier() *sdNotifier {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	if path[0] == '@' {
+		path = "\x00" + path[1:] // abstract namespace
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		logWarn("⚠️  systemd: {error}; readiness won't be reported", "error", err)
+		return nil
+	}
+	n := &sdNotifier{conn: conn}
+	if usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64); err == nil && usec > 0 {
+		if pid := os.Getenv("WATCHDOG_PID"); pid == "" || pid == strconv.Itoa(os.Getpid()) {
+			n.watchdog = time.Duration(usec) * time.Microsecond
+		}
+	}
+	return n
+}
+
+// send writes one notification of newline-separated assignments.
+func (n *sdNotifier) send(states ...string) {
+	if n == nil {
+		return
+	}
+	if _, err := n.conn.Write([]byte(strings.Join(states, "\n"))); err != nil {
+		logDebug("systemd notify: {error}", "error", err)
+	}
+}
+
+func (n *sdNotifier) ready(status string) { n.send("READY=1", "STATUS="+status) }
+
+func (n *sdNotifier) stopping() { n.send("STOPPING=1", "STATUS=Shutting down") }
+
+// keepalive refreshes STATUS= and, when the unit has a watchdog, pings it
+// at half of WatchdogSec while healthy says so, until ctx is done. With
+// the pings withheld, systemd restarts the process once WatchdogSec runs
+// out.
+func (n *sdNotifier) keepalive(ctx context.Context, healthy func() bool, status func() string) {
+	every := n.watchdog / 2
+	if every <= 0 {
+		every = sdStatusInterval
+	}
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	withheld := false
+	for {
+		select {
+		case <-ticker.C:
+			states := []string{"STATUS=" + status()}
+			switch {
+			case n.watchdog == 0:
+			case healthy():
+				states = append(states, "WATCHDOG=1")
+				withheld = false
+			case !withheld:
+				withheld = true
+				logError("🐕 Withholding systemd watchdog pings; systemd restarts the process after {watchdog}", "watchdog", n.watchdog)
+			}
+			n.send(states...)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sdComponent runs keepalive under the supervisor.
+func sdComponent(n *sdNotifier, healthy func() bool, status func() string) componentSpec {
+	return componentSpec{name: "systemd", policy: policyRestart, run: func(ctx context.Context) error {
+		n.keepalive(ctx, healthy, status)
+		return nil
+	}}
+}
+
+func alwaysHealthy() bool { return true }
+
+// auditStatus is the STATUS= line of the audit daemon.
+func auditStatus(gate *intakeGate) func() string {
+	return func() string {
+		s := fmt.Sprintf("%.0f audit lines processed; %s", metrics.sum("audit_lines_total"), mode)
+		if gate.status().Paused {
+			s += ", intake paused"
+		}
+		return s
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// --- Microsoft Teams ---
+
+const (
+	// teamsMaxPayload keeps a card under the 28 KB Teams accepts, with
+	// room for the envelope; longer descriptions are cut to fit.
+	teamsMaxPayload = 24 * 1024
+	teamsMaxFacts   = 10
+)
+
+// TeamsPayload is an incoming webhook message carrying one Adaptive Card.
+type TeamsPayload struct {
+	Type        string            `json:"type"` // "message"
+	Attachments []TeamsAttachment `json:"attachments"`
+}
+
+type TeamsAttachment struct {
+	ContentType string    `json:"contentType"`
+	Content     TeamsCard `json:"content"`
+}
+
+type TeamsCard struct {
+	Schema  string            `json:"$schema"`
+	Type    string            `json:"type"` // "AdaptiveCard"
+	Version string            `json:"version"`
+	Body    []TeamsElement    `json:"body"`
+	MSTeams map[string]string `json:"msteams,omitempty"`
+}
+
+// TeamsElement is the subset of Adaptive Card elements alerts use: a
+// Container holding the rest, TextBlocks and a FactSet.
+type TeamsElement struct {
+	Type     string         `json:"type"`
+	Style    string         `json:"style,omitempty"` // Container: good, warning, attention, accent
+	Bleed    bool           `json:"bleed,omitempty"`
+	Items    []TeamsElement `json:"items,omitempty"`
+	Text     string         `json:"text,omitempty"`
+	Size     string         `json:"size,omitempty"`
+	Weight   string         `json:"weight,omitempty"`
+	FontType string         `json:"fontType,omitempty"`
+	IsSubtle bool           `json:"isSubtle,omitempty"`
+	Wrap     bool           `json:"wrap,omitempty"`
+	Facts    []TeamsFact    `json:"facts,omitempty"`
+}
+
+type TeamsFact struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+}
+
+// teamsNotifier posts one card per alert. Teams shows several cards in a
+// message as a carousel, which hides all but the first.
+type teamsNotifier struct{}
+
+func (teamsNotifier) kind() string { return "teams" }
+
+// accept takes 200 and 202. Older connector webhooks answer 200 with the
+// body "1" on success, and 200 with an error text when they reject a
+// card, so any other 200 body is a failure.
+func (teamsNotifier) accept(status int, body []byte) error {
+	switch text := strings.TrimSpace(string(body)); {
+	case status == http.StatusAccepted:
+		return nil
+	case status != http.StatusOK:
+		return fmt.Errorf("returned status %d", status)
+	case text == "" || text == "1":
+		return nil
+	default:
+		return fmt.Errorf("rejected the card: %s", cleanField(text, maxErrorLen))
+	}
+}
+
+func (n teamsNotifier) send(cfg *VaultConfig, alerts []Alert) ([]Alert, error) {
+	return postMessages(cfg, n, singleMessages(alerts))
+}
+
+// encode builds the card of a message's one alert, cutting the
+// description until it fits in teamsMaxPayload.
+func (teamsNotifier) encode(m discordMessage) ([]byte, error) {
+	a, e := m.alerts[0], m.embeds[0]
+	desc := e.Description
+	for {
+		data, err := json.Marshal(TeamsPayload{Type: "message", Attachments: []TeamsAttachment{{
+			ContentType: "application/vnd.microsoft.card.adaptive", Content: teamsCard(a, e, desc)}}})
+		if err != nil || len(data) <= teamsMaxPayload || desc == "" {
+			return data, err
+		}
+		// Cut at least the excess, as bytes go; a rune is one or more.
+		keep := utf8.RuneCountInString(desc) - (len(data) - teamsMaxPayload) - 1
+		if keep < 1 {
+			desc = ""
+			continue
+		}
+		desc = string([]rune(desc)[:keep])
+		if i := strings.LastIndexByte(desc, '\n'); i > len(desc)/2 {
+			desc = desc[:i] // at a line end, so a table or list isn't cut mid-row
+		}
+		if strings.Count(desc, "```")%2 == 1 {
+			desc += "\n```" // close a code block left open by the cut
+		}
+		desc += "\n\n_(truncated)_"
+	}
+}
+
+// teamsCard lays an alert out like its Discord embed e, with desc as the
+// description: the title and description in a container coloured for the
+// alert, the fields as facts, and a line with the rule, the sender and
+// the time.
+func teamsCard(a Alert, e DiscordEmbed, desc string) TeamsCard {
+	head := TeamsElement{Type: "Container", Style: teamsStyle(a), Bleed: true, Items: []TeamsElement{
+		{Type: "TextBlock", Text: e.Title, Size: "Large", Weight: "Bolder", Wrap: true}}}
+	head.Items = append(head.Items, teamsDescription(desc)...)
+	body := []TeamsElement{head}
+
+	var facts []TeamsFact
+	for _, f := range e.Fields {
+		if len(facts) == teamsMaxFacts {
+			break
+		}
+		facts = append(facts, TeamsFact{Title: f.Name, Value: teamsMarkdown(f.Value)})
+	}
+	if len(facts) > 0 {
+		body = append(body, TeamsElement{Type: "FactSet", Facts: facts})
+	}
+
+	ts := a.Time
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	var context []string
+	if e.Author != nil {
+		context = append(context, e.Author.Name)
+	}
+	if e.Footer != nil {
+		context = append(context, e.Footer.Text)
+	}
+	// Rendered in the reader's time zone.
+	stamp := ts.UTC().Format(time.RFC3339)
+	context = append(context, fmt.Sprintf("{{DATE(%s, SHORT)}} {{TIME(%s)}}", stamp, stamp))
+	body = append(body, TeamsElement{Type: "TextBlock", Text: strings.Join(context, " · "), Size: "Small", IsSubtle: true, Wrap: true})
+
+	return TeamsCard{Schema: "http://adaptivecards.io/schemas/adaptive-card.json", Type: "AdaptiveCard",
+		Version: "1.4", Body: body, MSTeams: map[string]string{"width": "Full"}}
+}
+
+// teamsStyle maps an alert's colour onto the container styles Adaptive
+// Cards offer, as they have no free colours.
+func teamsStyle(a Alert) string {
+	switch {
+	case a.Color == 0x2ecc71:
+		return "good"
+	case a.Severity == sevCritical:
+		return "attention"
+	case a.Severity == sevWarning:
+		return "warning"
+	}
+	return "accent"
+}
+
+// teamsDescription renders a description as TextBlocks. Code blocks, such
+// as the topology table, become monospace blocks of their own, since
+// Adaptive Card markdown has none.
+func teamsDescription(desc string) []TeamsElement {
+	var out []TeamsElement
+	for i, part := range strings.Split(desc, "```") {
+		if i%2 == 1 {
+			if code := strings.Trim(part, "\n"); code != "" {
+				out = append(out, TeamsElement{Type: "TextBlock", Text: code, FontType: "Monospace", Wrap: true})
+			}
+			continue
+		}
+		if text := strings.TrimSpace(teamsMarkdown(part)); text != "" {
+			out = append(out, TeamsElement{Type: "TextBlock", Text: text, Wrap: true})
+		}
+	}
+	return out
+}
+
+// teamsMarkdown drops the backslash escapes of mdText, which Adaptive Card
+// markdown shows as they are. Its formatting characters pair up less
+// readily, so an escaped * or _ is fenced with zero width spaces to keep
+// it from pairing with another, and so is an escaped bracket, which would
+// otherwise open a [text](url) link.
+func teamsMarkdown(md string) string {
+	var b strings.Builder
+	for i := 0; i < len(md); i++ {
+		c := md[i]
+		if c == '\\' && i+1 < len(md) && strings.IndexByte(markdownChars, md[i+1]) >= 0 {
+			i++
+			if n := md[i]; n == '*' || n == '_' || n == '[' || n == ']' {
+				b.WriteString("\u200b" + string(n) + "\u200b")
+			} else {
+				b.WriteByte(n)
+			}
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
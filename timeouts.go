@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// --- Timeouts ---
+
+// defaultOpTimeout is what every request used before timeouts were
+// configurable.
+const defaultOpTimeout = 10 * time.Second
+
+// TimeoutsConfig bounds each class of outbound request. They are applied
+// per request, so one client serves all classes. Dial and TLS handshake
+// are bounded separately so a dead host fails before the request's
+// deadline would.
+type TimeoutsConfig struct {
+	Health       Duration `yaml:"health"` // sys/health and sys/seal-status
+	Unseal       Duration `yaml:"unseal"` // key submissions and resets
+	Notify       Duration `yaml:"notify"` // notifiers, email included, and Grafana
+	API          Duration `yaml:"api"`    // other Vault endpoints
+	Dial         Duration `yaml:"dial"`
+	TLSHandshake Duration `yaml:"tls_handshake"`
+}
+
+type opClass int
+
+const (
+	opHealth opClass = iota
+	opUnseal
+	opNotify
+	opAPI
+)
+
+func (t *TimeoutsConfig) setDefaults() {
+	for _, d := range []*Duration{&t.Health, &t.Unseal, &t.Notify, &t.API, &t.Dial, &t.TLSHandshake} {
+		if *d == 0 {
+			*d = Duration(defaultOpTimeout)
+		}
+	}
+}
+
+func (t TimeoutsConfig) of(op opClass) time.Duration {
+	var d Duration
+	switch op {
+	case opHealth:
+		d = t.Health
+	case opUnseal:
+		d = t.Unseal
+	case opNotify:
+		d = t.Notify
+	default:
+		d = t.API
+	}
+	if d <= 0 {
+		return defaultOpTimeout
+	}
+	return time.Duration(d)
+}
+
+// newOpRequest builds a request bounded by op's timeout. The caller must
+// call cancel once it has read the response body.
+func newOpRequest(cfg *VaultConfig, op opClass, method, url string, body io.Reader) (*http.Request, context.CancelFunc, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.of(op))
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return req, cancel, nil
+}
+
+// newTransport returns a transport with cfg's dial and handshake limits.
+func newTransport(cfg *VaultConfig) *http.Transport {
+	dial, handshake := time.Duration(cfg.Timeouts.Dial), time.Duration(cfg.Timeouts.TLSHandshake)
+	if dial <= 0 {
+		dial = defaultOpTimeout
+	}
+	if handshake <= 0 {
+		handshake = defaultOpTimeout
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: dial, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = handshake
+	return transport
+}
+
+// newNotifyClient is the client for webhook notifiers.
+func newNotifyClient(cfg *VaultConfig) *http.Client {
+	return &http.Client{Transport: newTransport(cfg)}
+}
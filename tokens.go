@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// --- Token Creation Detectors ---
+
+const defaultTokenMaxTTL = 7 * 24 * time.Hour
+
+// TokenConfig turns on the detectors for auth/token/create*. As with the
+// PKI detectors, the request fields are only readable when the token mount
+// leaves them out of audit HMACing (see tokenNonHMACKeys).
+type TokenConfig struct {
+	Enabled bool     `yaml:"enabled"`
+	MaxTTL  Duration `yaml:"max_ttl"` // token-long-ttl threshold
+	// AllowedCreators are display names that may create orphan and
+	// periodic tokens without an alert, e.g. a provisioning pipeline.
+	AllowedCreators []string                  `yaml:"allowed_creators"`
+	Detectors       map[string]DetectorConfig `yaml:"detectors"`
+}
+
+// tokenNonHMACKeys are the request fields the detectors read.
+var tokenNonHMACKeys = []string{"ttl", "explicit_max_ttl", "period", "no_parent", "policies"}
+
+var tokenDetectors = []detector{
+	{rule: "token-long-ttl", severity: "warning", title: message("token-long-ttl.title"),
+		inspects: "create/update on auth/token/create, create-orphan, create/<role>: data.ttl (or data.explicit_max_ttl) beyond max_ttl"},
+	{rule: "token-orphan", severity: "warning", title: message("token-orphan.title"),
+		inspects: "create/update on auth/token/create-orphan, or data.no_parent true, by a creator not in allowed_creators"},
+	{rule: "token-periodic", severity: "warning", title: message("token-periodic.title"),
+		inspects: "create/update with data.period set, by a creator not in allowed_creators"},
+	{rule: "token-policy-escalation", severity: "critical", title: message("token-policy-escalation.title"),
+		inspects: "create/update on auth/token/create, create-orphan: data.policies not a subset of the creator's, unless the creator has root"},
+}
+
+// tokenWatcher runs the enabled detectors over token creations.
+type tokenWatcher struct {
+	maxTTL  time.Duration
+	allowed []string
+	enabled map[string]severity
+}
+
+// policyList is a token's policies. A value that isn't a list of strings
+// decodes as empty rather than failing the entry.
+type policyList []string
+
+func (p *policyList) UnmarshalJSON(data []byte) error {
+	var list []string
+	if json.Unmarshal(data, &list) != nil {
+		list = nil
+	}
+	*p = list
+	return nil
+}
+
+func newTokenWatcher(cfg TokenConfig) *tokenWatcher {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &tokenWatcher{maxTTL: time.Duration(cfg.MaxTTL), allowed: cfg.AllowedCreators,
+		enabled: enabledDetectors(tokenDetectors, cfg.Detectors)}
+}
+
+// observe returns the alerts for one entry. Like the PKI detectors it only
+// looks at successful responses.
+func (w *tokenWatcher) observe(e *AuditEntry) []Alert {
+	if w == nil || e.Type != "response" || e.Error != "" {
+		return nil
+	}
+	if op := e.Request.Operation; op != "create" && op != "update" {
+		return nil
+	}
+	rel := strings.TrimPrefix(e.Request.Path, "auth/token/")
+	role := strings.HasPrefix(rel, "create/")
+	if rel == e.Request.Path || rel != "create" && rel != "create-orphan" && !role {
+		return nil
+	}
+	var data map[string]json.RawMessage
+	if len(e.Request.Data) > 0 {
+		json.Unmarshal(e.Request.Data, &data) // a non-object leaves data empty
+	}
+
+	var alerts []Alert
+	params := tokenParams(data)
+	var paramText localText
+	if params != "" {
+		paramText = msgTokenParams.with("params", mdCode(params, maxPathLen))
+	}
+	fire := func(rule string, detail localText) {
+		sev, on := w.enabled[rule]
+		if !on {
+			return
+		}
+		d := findDetector(tokenDetectors, rule)
+		metrics.inc("token_alerts_total", "rule", rule)
+		alerts = append(alerts, Alert{Severity: sev, Color: sev.color(), RequestID: e.Request.ID, Rule: rule,
+			User: e.Auth.DisplayName, Path: e.Request.Path, Operation: e.Request.Operation,
+			SourceIP: hostOnly(e.Request.RemoteAddress), Time: entryTime(e.Time)}.say(d.title.with(),
+			msgTokenDetail.with("detail", detail, "params", paramText)))
+	}
+
+	ttl, ok := dataDuration(data["ttl"])
+	if !ok {
+		ttl, ok = dataDuration(data["explicit_max_ttl"])
+	}
+	if ok && ttl > w.maxTTL {
+		fire("token-long-ttl", msgTokenLongTTL.with("ttl", formatDuration(ttl.Round(time.Hour)), "limit", formatDuration(w.maxTTL)))
+	}
+	allowed := containsString(w.allowed, e.Auth.DisplayName)
+	if !allowed && (rel == "create-orphan" || dataBool(data["no_parent"])) {
+		fire("token-orphan", msgTokenOrphan.with())
+	}
+	if period, ok := dataDuration(data["period"]); !allowed && ok && period > 0 {
+		fire("token-periodic", msgTokenPeriodic.with("period", formatDuration(period)))
+	}
+	// A role may grant policies its caller lacks, so role creations can't be judged this way.
+	if requested, ok := dataList(data["policies"]); ok && !role && len(e.Auth.Policies) > 0 &&
+		!containsString(e.Auth.Policies, "root") {
+		var extra []string
+		for _, p := range requested {
+			if p != "default" && !containsString(e.Auth.Policies, p) {
+				extra = append(extra, p)
+			}
+		}
+		if len(extra) > 0 {
+			fire("token-policy-escalation", msgTokenEscalation.with("policies", mdCode(strings.Join(extra, ", "), maxPathLen),
+				"creator", mdCode(strings.Join(e.Auth.Policies, ", "), maxPathLen)))
+		}
+	}
+	return alerts
+}
+
+var (
+	msgTokenDetail     = message("token.body")
+	msgTokenParams     = message("token.params")
+	msgTokenLongTTL    = message("token-long-ttl.body")
+	msgTokenOrphan     = message("token-orphan.body")
+	msgTokenPeriodic   = message("token-periodic.body")
+	msgTokenEscalation = message("token-policy-escalation.body")
+)
+
+// tokenParams renders the token fields of a request for an alert, e.g.
+// "ttl=8760h no_parent=true policies=admin,default".
+func tokenParams(data map[string]json.RawMessage) string {
+	var parts []string
+	for _, k := range tokenNonHMACKeys {
+		raw, ok := data[k]
+		if !ok {
+			continue
+		}
+		v := string(raw)
+		var s string
+		if json.Unmarshal(raw, &s) == nil {
+			v = s
+		} else if list, ok := dataList(raw); ok {
+			v = strings.Join(list, ",")
+		}
+		parts = append(parts, k+"="+v)
+	}
+	return strings.Join(parts, " ")
+}
+
+// describeTokenDetectors renders the detectors for -list-packs.
+func describeTokenDetectors() string {
+	var b strings.Builder
+	for _, d := range tokenDetectors {
+		fmt.Fprintf(&b, "  detector %s (%s): %s\n", d.rule, d.severity, d.inspects)
+	}
+	fmt.Fprintf(&b, "  (tune auth/token with audit_non_hmac_request_keys=%s)\n", strings.Join(tokenNonHMACKeys, ","))
+	return b.String()
+}
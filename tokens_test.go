@@ -0,0 +1,111 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testTokenWatcher(overrides map[string]DetectorConfig) *tokenWatcher {
+	return newTokenWatcher(TokenConfig{Enabled: true, MaxTTL: Duration(defaultTokenMaxTTL),
+		AllowedCreators: []string{"approle-provisioner"}, Detectors: overrides})
+}
+
+func TestTokenDetectorFixtures(t *testing.T) {
+	tests := map[string]string{
+		"long-ttl.jsonl":          "token-long-ttl",
+		"explicit-max-ttl.jsonl":  "token-long-ttl",
+		"ttl-within-limit.jsonl":  "",
+		"orphan-path.jsonl":       "token-orphan",
+		"no-parent.jsonl":         "token-orphan token-orphan",
+		"periodic.jsonl":          "token-periodic",
+		"allowed-creator.jsonl":   "",
+		"policy-escalation.jsonl": "token-policy-escalation",
+		"policy-subset.jsonl":     "",
+		"root-creator.jsonl":      "",
+		"role-create.jsonl":       "",
+		"hmaced.jsonl":            "",
+		"not-judged.jsonl":        "",
+		"everything.jsonl":        "token-long-ttl token-orphan token-periodic token-policy-escalation",
+	}
+	for fixture, want := range tests {
+		t.Run(fixture, func(t *testing.T) {
+			alerts := replayFixture(t, filepath.Join("tokens", fixture), testTokenWatcher(nil).observe)
+			if got := alertRules(alerts); got != want {
+				t.Errorf("alerts = [%s], want [%s]", got, want)
+			}
+			for _, a := range alerts {
+				if a.User == "" || a.RequestID == "" || a.SourceIP != "10.30.0.4" || a.Time.IsZero() {
+					t.Errorf("alert %s lacks its entry's context: %+v", a.Rule, a)
+				}
+			}
+		})
+	}
+}
+
+// Every alert names the parameters the token was asked for.
+func TestTokenDetectorParams(t *testing.T) {
+	alerts := replayFixture(t, "tokens/everything.jsonl", testTokenWatcher(nil).observe)
+	details := map[string]string{
+		"token-long-ttl":          "365d",
+		"token-periodic":          "3d",
+		"token-policy-escalation": "`admin`",
+	}
+	for _, a := range alerts {
+		if !strings.Contains(a.Description, "`ttl=8760h period=72h policies=admin,default`") {
+			t.Errorf("%s: description %q lacks the request's parameters", a.Rule, a.Description)
+		}
+		if want := details[a.Rule]; !strings.Contains(a.Description, want) {
+			t.Errorf("%s: description %q lacks %q", a.Rule, a.Description, want)
+		}
+	}
+}
+
+func TestTokenDetectorOverrides(t *testing.T) {
+	w := testTokenWatcher(map[string]DetectorConfig{
+		"token-orphan":            {Disabled: true},
+		"token-periodic":          {Disabled: true},
+		"token-policy-escalation": {Severity: "warning"},
+		"token-long-ttl":          {Severity: "critical"},
+	})
+	alerts := replayFixture(t, "tokens/everything.jsonl", w.observe)
+	if got := alertRules(alerts); got != "token-long-ttl token-policy-escalation" {
+		t.Fatalf("alerts = [%s], want the two left enabled", got)
+	}
+	if alerts[0].Severity != sevCritical || alerts[1].Severity != sevWarning {
+		t.Errorf("severities = %s, %s; want the overrides'", alerts[0].Severity, alerts[1].Severity)
+	}
+
+	w = newTokenWatcher(TokenConfig{Enabled: true, MaxTTL: Duration(30 * time.Minute)})
+	if got := alertRules(replayFixture(t, "tokens/ttl-within-limit.jsonl", w.observe)); got != "token-long-ttl token-long-ttl" {
+		t.Errorf("alerts with max_ttl 30m = [%s], want both", got)
+	}
+}
+
+func TestTokenConfigValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"unknown detector", "tokens:\n  enabled: true\n  detectors:\n    token-nope: {disabled: true}\n", "tokens.detectors.token-nope is not a token detector"},
+		{"bad severity", "tokens:\n  enabled: true\n  detectors:\n    token-orphan: {severity: loud}\n", "tokens.detectors.token-orphan.severity"},
+		{"empty creator", "tokens:\n  enabled: true\n  allowed_creators: [\"\"]\n", "tokens.allowed_creators[0] must not be empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadTestConfig(t, envTestBase+tt.body)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+	cfg, err := loadTestConfig(t, envTestBase+"tokens:\n  enabled: true\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Tokens.MaxTTL != Duration(defaultTokenMaxTTL) {
+		t.Errorf("max_ttl = %s, want the 7d default", time.Duration(cfg.Tokens.MaxTTL))
+	}
+}
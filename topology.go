@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// --- Topology Snapshot ---
+
+const (
+	defaultTopologyBudget = 3 * time.Second
+	// topologyFanOut bounds the probes of one snapshot in flight at once.
+	topologyFanOut = 8
+)
+
+// topologySnapshot is every known node of a cluster as probed at one
+// moment. Seal alerts carry one so whoever reads them sees whether the
+// rest of the cluster still serves without running status first.
+type topologySnapshot struct {
+	Taken time.Time      `json:"taken"`
+	Nodes []nodeSnapshot `json:"nodes"`
+	// Partial is set when the budget ran out before every node answered;
+	// those nodes are "pending".
+	Partial bool `json:"partial,omitempty"`
+}
+
+type nodeSnapshot struct {
+	Address   string  `json:"address"`
+	State     string  `json:"state"`          // sealed, unsealed, uninitialized, unreachable or pending
+	Role      string  `json:"role,omitempty"` // active, standby or perf-standby, when unsealed
+	Version   string  `json:"version,omitempty"`
+	LatencyMS float64 `json:"latency_ms,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// vaultHealth is the part of sys/health a snapshot reads.
+type vaultHealth struct {
+	Initialized        bool   `json:"initialized"`
+	Sealed             bool   `json:"sealed"`
+	Standby            bool   `json:"standby"`
+	PerformanceStandby bool   `json:"performance_standby"`
+	Version            string `json:"version"`
+}
+
+// topologyNodes is what a cluster is known by: its nodes, or its address.
+func topologyNodes(cfg *VaultConfig) []string {
+	if len(cfg.Nodes) > 0 {
+		return cfg.Nodes
+	}
+	return []string{cfg.Address}
+}
+
+// topologyBudget is watch.topology_budget, which status reads even when
+// the watch isn't enabled.
+func topologyBudget(cfg *VaultConfig) time.Duration {
+	if b := time.Duration(cfg.Watch.TopologyBudget); b > 0 {
+		return b
+	}
+	return defaultTopologyBudget
+}
+
+// takeTopology probes every known node of cfg, topologyFanOut at a time,
+// and returns once all have answered or the budget is spent, whichever is
+// first. Each probe is also bounded by timeouts.health.
+func takeTopology(cfg *VaultConfig) *topologySnapshot {
+	budget := topologyBudget(cfg)
+	ctx, cancel := context.WithTimeout(context.Background(), budget)
+	defer cancel()
+
+	nodes := topologyNodes(cfg)
+	snap := &topologySnapshot{Taken: time.Now(), Nodes: make([]nodeSnapshot, len(nodes))}
+	for i, addr := range nodes {
+		snap.Nodes[i] = nodeSnapshot{Address: addr, State: "pending",
+			Error: fmt.Sprintf("no answer within %s", formatDuration(budget))}
+	}
+	client, err := newVaultClient(cfg)
+	if err != nil {
+		for i := range snap.Nodes {
+			snap.Nodes[i].State, snap.Nodes[i].Error = "unreachable", err.Error()
+		}
+		return snap
+	}
+
+	type answer struct {
+		i    int
+		node nodeSnapshot
+	}
+	// Buffered for every node, so probes finishing after the budget don't
+	// block.
+	answers := make(chan answer, len(nodes))
+	slots := make(chan struct{}, topologyFanOut)
+	go func() {
+		for i, addr := range nodes {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			go func(i int, addr string) {
+				defer func() { <-slots }()
+				answers <- answer{i, probeNode(ctx, cfg, client, addr)}
+			}(i, addr)
+		}
+	}()
+	for left := len(nodes); left > 0; left-- {
+		select {
+		case a := <-answers:
+			if a.node.State != "pending" {
+				snap.Nodes[a.i] = a.node
+			}
+		case <-ctx.Done():
+			left = 0
+		}
+	}
+	for _, n := range snap.Nodes {
+		if n.State == "pending" {
+			snap.Partial = true
+		}
+	}
+	return snap
+}
+
+// probeNode reads one node's sys/health. The query makes every state
+// answer 200, though the body is read whatever the code.
+func probeNode(ctx context.Context, cfg *VaultConfig, client *http.Client, address string) nodeSnapshot {
+	n := nodeSnapshot{Address: address}
+	pctx, cancel := context.WithTimeout(ctx, cfg.Timeouts.of(opHealth))
+	defer cancel()
+	req, err := http.NewRequestWithContext(pctx, http.MethodGet,
+		address+"/v1/sys/health?standbyok=true&perfstandbyok=true&sealedcode=200&uninitcode=200", nil)
+	if err != nil {
+		n.State, n.Error = "unreachable", err.Error()
+		return n
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err == nil {
+		defer resp.Body.Close()
+	}
+	var h vaultHealth
+	if err == nil {
+		var body []byte
+		if body, err = io.ReadAll(io.LimitReader(resp.Body, 64*1024)); err == nil {
+			if jerr := json.Unmarshal(body, &h); jerr != nil {
+				err = fmt.Errorf("parse health response (HTTP %d): %w", resp.StatusCode, jerr)
+			}
+		}
+	}
+	if err != nil {
+		// Out of budget rather than out of timeouts.health: the node
+		// might still have answered.
+		if ctx.Err() != nil {
+			n.State = "pending"
+			return n
+		}
+		n.State, n.Error = "unreachable", err.Error()
+		return n
+	}
+	n.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+	n.Version = h.Version
+	switch {
+	case !h.Initialized:
+		n.State = "uninitialized"
+	case h.Sealed:
+		n.State = "sealed"
+	default:
+		n.State = "unsealed"
+		switch {
+		case h.PerformanceStandby:
+			n.Role = "perf-standby"
+		case h.Standby:
+			n.Role = "standby"
+		default:
+			n.Role = "active"
+		}
+	}
+	return n
+}
+
+// table lays the snapshot out in aligned columns, one node per line, for
+// alert code blocks and status.
+func (s *topologySnapshot) table() string {
+	rows := [][]string{{"NODE", "STATE", "ROLE", "VERSION", "LATENCY"}}
+	for _, n := range s.Nodes {
+		latency := "-"
+		if n.LatencyMS > 0 {
+			latency = formatLatency(time.Duration(n.LatencyMS * float64(time.Millisecond)))
+		}
+		// Anything but unsealed is shouted so it stands out.
+		state := n.State
+		if state != "unsealed" {
+			state = strings.ToUpper(state)
+		}
+		row := []string{n.Address, state, n.Role, n.Version, latency}
+		for i, cell := range row {
+			// Backticks would end the code block around the table.
+			cell = strings.ReplaceAll(cleanField(cell, maxNameLen), "`", "'")
+			if cell == "" {
+				cell = "-"
+			}
+			row[i] = cell
+		}
+		rows = append(rows, row)
+	}
+	widths := make([]int, len(rows[0]))
+	for _, row := range rows {
+		for i, cell := range row {
+			if w := utf8.RuneCountInString(cell); w > widths[i] {
+				widths[i] = w
+			}
+		}
+	}
+	var b strings.Builder
+	for _, row := range rows {
+		line := ""
+		for i, cell := range row {
+			if i < len(row)-1 {
+				cell += strings.Repeat(" ", widths[i]-utf8.RuneCountInString(cell)+2)
+			}
+			line += cell
+		}
+		b.WriteString(strings.TrimRight(line, " ") + "\n")
+	}
+	return b.String()
+}
+
+// note says which nodes the table can't vouch for, or "".
+func (s *topologySnapshot) note() string {
+	pending := 0
+	for _, n := range s.Nodes {
+		if n.State == "pending" {
+			pending++
+		}
+	}
+	if pending == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d of %d nodes did not answer in time; their state is unknown.", pending, len(s.Nodes))
+}
+
+// markdown renders the snapshot for an alert description.
+func (s *topologySnapshot) markdown() string {
+	md := "**Topology:**\n```\n" + s.table() + "```"
+	if note := s.note(); note != "" {
+		md += "\n⚠️ " + note
+	}
+	return md
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeVault answers health, seal-status and unseal like a single node,
+// unsealing once threshold shares have come in.
+type fakeVault struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	initialized bool
+	sealed      bool
+	migration   bool
+	threshold   int
+	progress    int
+	unseals     []map[string]interface{}
+}
+
+func newFakeVault(t *testing.T) *fakeVault {
+	v := &fakeVault{initialized: true, sealed: true, threshold: 2}
+	v.Server = httptest.NewServer(http.HandlerFunc(v.serve))
+	t.Cleanup(v.Close)
+	return v
+}
+
+func (v *fakeVault) serve(w http.ResponseWriter, r *http.Request) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if r.URL.Path == "/v1/sys/unseal" {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		v.unseals = append(v.unseals, body)
+		if v.progress++; v.progress >= v.threshold {
+			v.sealed, v.progress = false, 0
+		}
+	}
+	status := map[string]interface{}{
+		"type": "shamir", "initialized": v.initialized, "sealed": v.sealed, "t": v.threshold, "n": 3,
+		"progress": v.progress, "migration": v.migration, "version": "1.15.4", "storage_type": "raft",
+		"cluster_name": "vault-cluster-test", "cluster_id": "0f1e2d3c-4b5a-6978-8796-a5b4c3d2e1f0",
+	}
+	if r.URL.Path == "/v1/sys/health" && v.sealed {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+func (v *fakeVault) submitted() []map[string]interface{} {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return append([]map[string]interface{}(nil), v.unseals...)
+}
+
+func unlockTestConfig(t *testing.T, v *fakeVault) *VaultConfig {
+	return &VaultConfig{Address: v.URL, UnsealKeys: []string{"key-1", "key-2", "key-3"},
+		StateFile: filepath.Join(t.TempDir(), "state.json")}
+}
+
+func exitCode(err error) int {
+	var ee *exitError
+	if errors.As(err, &ee) {
+		return ee.code
+	}
+	return -1
+}
+
+func TestUnlockUninitialized(t *testing.T) {
+	alerts := captureAlerts(t)
+	v := newFakeVault(t)
+	v.initialized = false
+	cfg := unlockTestConfig(t, v)
+
+	_, err := unlockCluster(cfg, unlockOptions{})
+	if exitCode(err) != exitNotInitialized || !strings.Contains(errString(err), "cluster is not initialized") {
+		t.Fatalf("err = %v (exit %d), want exit %d", err, exitCode(err), exitNotInitialized)
+	}
+	if n := len(v.submitted()); n != 0 {
+		t.Errorf("%d shares submitted to an uninitialized node", n)
+	}
+	if got := alerts(); len(got) != 0 {
+		t.Errorf("%d alerts without notify_unlock_refusals, want 0", len(got))
+	}
+
+	cfg.NotifyUnlockRefusals = true
+	unlockCluster(cfg, unlockOptions{})
+	got := alerts()
+	if len(got) != 1 || !strings.Contains(got[0].Description, v.URL) {
+		t.Errorf("alerts = %+v, want one naming %s", got, v.URL)
+	}
+}
+
+func TestUnlockSealMigration(t *testing.T) {
+	captureAlerts(t)
+	v := newFakeVault(t)
+	v.migration = true
+	cfg := unlockTestConfig(t, v)
+
+	_, err := unlockCluster(cfg, unlockOptions{})
+	if exitCode(err) != exitSealMigration || !strings.Contains(errString(err), "allow_seal_migration") {
+		t.Fatalf("err = %v (exit %d), want exit %d", err, exitCode(err), exitSealMigration)
+	}
+	if n := len(v.submitted()); n != 0 {
+		t.Fatalf("%d shares submitted without allow_seal_migration", n)
+	}
+
+	cfg.AllowSealMigration = true
+	outcome, err := unlockCluster(cfg, unlockOptions{})
+	if err != nil || outcome != unlockUnsealed {
+		t.Fatalf("with allow_seal_migration: %v, %v", outcome, err)
+	}
+	subs := v.submitted()
+	if len(subs) != v.threshold {
+		t.Fatalf("%d shares submitted, want %d", len(subs), v.threshold)
+	}
+	for i, s := range subs {
+		if s["migrate"] != true {
+			t.Errorf("share %d sent %v, want migrate: true", i+1, s)
+		}
+	}
+}
+
+func TestUnlockWithoutMigration(t *testing.T) {
+	captureAlerts(t)
+	v := newFakeVault(t)
+	cfg := unlockTestConfig(t, v)
+	cfg.AllowSealMigration = true
+
+	if outcome, err := unlockCluster(cfg, unlockOptions{}); err != nil || outcome != unlockUnsealed {
+		t.Fatalf("unlock: %v, %v", outcome, err)
+	}
+	for i, s := range v.submitted() {
+		if _, ok := s["migrate"]; ok {
+			t.Errorf("share %d sent migrate with no migration under way: %v", i+1, s)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Vault TLS ---
+
+// VaultTLSConfig overrides how the Vault node's certificate is checked.
+// It is inlined, so the keys sit next to address.
+type VaultTLSConfig struct {
+	// ServerName is verified instead of the address's host, e.g. when
+	// nodes are addressed by IP but share a wildcard certificate.
+	ServerName string `yaml:"tls_server_name"`
+	// CACert replaces the system roots with this PEM bundle.
+	CACert string `yaml:"ca_cert"`
+	// PinnedCertSHA256 is the SHA-256 of the leaf's SubjectPublicKeyInfo,
+	// hex or base64. A node presenting another key is refused.
+	PinnedCertSHA256 string `yaml:"pinned_cert_sha256"`
+	// ClientCert and ClientKey are a PEM pair presented to nodes that
+	// require client certificates (tls_require_and_verify_client_cert).
+	ClientCert string `yaml:"client_cert"`
+	ClientKey  string `yaml:"client_key"`
+	// InsecureSkipVerify accepts any certificate. A pin is still checked.
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+}
+
+// vaultTLSKeys names the settings for error messages.
+const vaultTLSKeys = "tls_server_name, ca_cert, pinned_cert_sha256, client_cert, client_key or insecure_skip_verify"
+
+// applyVaultTLSEnv fills in the settings tc leaves unset from the Vault
+// CLI's variables, so VAULT_CACERT and friends work as they do for vault.
+func applyVaultTLSEnv(tc *VaultTLSConfig) error {
+	for _, e := range []struct {
+		name  string
+		field *string
+	}{
+		{"VAULT_CACERT", &tc.CACert},
+		{"VAULT_CLIENT_CERT", &tc.ClientCert},
+		{"VAULT_CLIENT_KEY", &tc.ClientKey},
+		{"VAULT_TLS_SERVER_NAME", &tc.ServerName},
+	} {
+		if *e.field == "" {
+			*e.field = os.Getenv(e.name)
+		}
+	}
+	if v := os.Getenv("VAULT_SKIP_VERIFY"); v != "" && !tc.InsecureSkipVerify {
+		skip, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("VAULT_SKIP_VERIFY=%q is not a boolean", v)
+		}
+		tc.InsecureSkipVerify = skip
+	}
+	return nil
+}
+
+// validateVaultTLS loads the files tc names, so a bad path fails when the
+// config is loaded rather than in the middle of an unseal.
+func validateVaultTLS(prefix string, tc VaultTLSConfig) error {
+	if tc.PinnedCertSHA256 != "" {
+		if _, err := parsePin(tc.PinnedCertSHA256); err != nil {
+			return &fieldError{prefix + "pinned_cert_sha256", err.Error()}
+		}
+	}
+	if tc.CACert != "" {
+		if _, err := loadCACert(tc.CACert); err != nil {
+			return &fieldError{prefix + "ca_cert", err.Error()}
+		}
+	}
+	switch {
+	case tc.ClientCert != "" && tc.ClientKey == "":
+		return &fieldError{prefix + "client_cert", "requires client_key"}
+	case tc.ClientKey != "" && tc.ClientCert == "":
+		return &fieldError{prefix + "client_key", "requires client_cert"}
+	}
+	if tc.ClientCert != "" {
+		if _, err := tls.LoadX509KeyPair(tc.ClientCert, tc.ClientKey); err != nil {
+			return &fieldError{prefix + "client_cert", err.Error()}
+		}
+	}
+	return nil
+}
+
+func loadCACert(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no PEM certificates", path)
+	}
+	return pool, nil
+}
+
+// tlsIdentity is what a node presented in its handshake.
+type tlsIdentity struct {
+	Subject  string    `json:"subject"`
+	Issuer   string    `json:"issuer"`
+	DNSNames []string  `json:"dns_names,omitempty"`
+	NotAfter time.Time `json:"not_after"`
+	SPKI     string    `json:"spki_sha256"` // hex
+}
+
+func identityOf(cert *x509.Certificate) *tlsIdentity {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return &tlsIdentity{Subject: cert.Subject.String(), Issuer: cert.Issuer.String(),
+		DNSNames: cert.DNSNames, NotAfter: cert.NotAfter, SPKI: hex.EncodeToString(sum[:])}
+}
+
+// pinMismatchError means the node's key is not the pinned one: either the
+// node was re-keyed without updating the pin, or someone is in the middle.
+type pinMismatchError struct {
+	address   string
+	presented *tlsIdentity
+}
+
+func (e *pinMismatchError) Error() string {
+	return fmt.Sprintf("%s presented a certificate whose key does not match pinned_cert_sha256 (got %s, %s)",
+		e.address, e.presented.SPKI, e.presented.Subject)
+}
+
+// parsePin decodes a hex or base64 SPKI pin.
+func parsePin(pin string) ([]byte, error) {
+	pin = strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")
+	if b, err := hex.DecodeString(strings.ReplaceAll(pin, ":", "")); err == nil && len(b) == sha256.Size {
+		return b, nil
+	}
+	if b, err := base64.StdEncoding.DecodeString(pin); err == nil && len(b) == sha256.Size {
+		return b, nil
+	}
+	return nil, fmt.Errorf("must be a SHA-256 digest in hex or base64")
+}
+
+// vaultTLSConfig builds the client TLS config for the configured node.
+// With verify false the chain and pin are not checked, for probing what a
+// node presents.
+func vaultTLSConfig(cfg *VaultConfig, verify bool) (*tls.Config, error) {
+	tc := cfg.VaultTLS
+	conf := &tls.Config{ServerName: tc.ServerName, InsecureSkipVerify: !verify || tc.InsecureSkipVerify}
+	if tc.CACert != "" {
+		pool, err := loadCACert(tc.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("ca_cert: %w", err)
+		}
+		conf.RootCAs = pool
+	}
+	if tc.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(tc.ClientCert, tc.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("client_cert: %w", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	if tc.PinnedCertSHA256 != "" && verify {
+		want, err := parsePin(tc.PinnedCertSHA256)
+		if err != nil {
+			return nil, fmt.Errorf("pinned_cert_sha256 %w", err)
+		}
+		wantHex := hex.EncodeToString(want)
+		// Runs after normal chain verification, so a pin only narrows
+		// what is trusted; with insecure_skip_verify it is all that is.
+		conf.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+			if len(raw) == 0 {
+				return errors.New("no peer certificate")
+			}
+			leaf, err := x509.ParseCertificate(raw[0])
+			if err != nil {
+				return err
+			}
+			if id := identityOf(leaf); id.SPKI != wantHex {
+				return &pinMismatchError{address: cfg.Address, presented: id}
+			}
+			return nil
+		}
+	}
+	return conf, nil
+}
+
+// newVaultClient is the HTTP client for every request to Vault. Requests
+// must be bounded with newOpRequest.
+func newVaultClient(cfg *VaultConfig) (*http.Client, error) {
+	conf, err := vaultTLSConfig(cfg, true)
+	if err != nil {
+		return nil, err
+	}
+	transport := newTransport(cfg)
+	transport.TLSClientConfig = conf
+	// No client timeout: each request carries its class's deadline.
+	return &http.Client{Transport: transport}, nil
+}
+
+// probeTLSIdentity handshakes with the node without verifying and returns
+// what it presented; nil when the address isn't https.
+func probeTLSIdentity(cfg *VaultConfig) (*tlsIdentity, error) {
+	u, err := url.Parse(cfg.Address)
+	if err != nil || u.Scheme != "https" {
+		return nil, err
+	}
+	conf, err := vaultTLSConfig(cfg, false)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "443")
+	}
+	if conf.ServerName == "" {
+		conf.ServerName = u.Hostname()
+	}
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: cfg.Timeouts.of(opHealth)}, "tcp", host, conf)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, errors.New("no peer certificate")
+	}
+	return identityOf(certs[0]), nil
+}
+
+// describeTLSIdentity is the one-line form used by status.
+func describeTLSIdentity(id *tlsIdentity, pin string) string {
+	s := fmt.Sprintf("%s (issuer %s, expires %s, SPKI sha256 %s)", id.Subject, id.Issuer, id.NotAfter.Format("2006-01-02"), id.SPKI)
+	if pin != "" {
+		s += " pin " + pin
+	}
+	return s
+}
+
+// reportPinMismatch sends a critical alert when err is a pin mismatch.
+// It alerts once per presented key, so the timer doesn't page every run.
+func reportPinMismatch(cfg *VaultConfig, store *stateStore, err error) {
+	var pm *pinMismatchError
+	if !errors.As(err, &pm) {
+		return
+	}
+	metrics.inc("tls_pin_mismatches_total")
+	seen := false
+	if uerr := store.update(func(st *wardenState) {
+		seen = st.TLSPinMismatches[cfg.Address] == pm.presented.SPKI
+		if st.TLSPinMismatches == nil {
+			st.TLSPinMismatches = make(map[string]string)
+		}
+		st.TLSPinMismatches[cfg.Address] = pm.presented.SPKI
+	}); uerr != nil {
+		logWarn("⚠️  Could not record TLS pin mismatch: {error}", "error", uerr)
+	}
+	logError("🚨 {mismatch}", "mismatch", pm)
+	if seen {
+		return
+	}
+	notify(cfg, Alert{Severity: sevCritical, Color: sevCritical.color(), Rule: "tls-pin-mismatch"}.say(msgPinMismatch.with(),
+		msgPinMismatchBody.with("address", mdCode(cfg.Address, maxPathLen), "subject", mdText(pm.presented.Subject, maxNameLen),
+			"issuer", mdText(pm.presented.Issuer, maxNameLen), "spki", mdCode(pm.presented.SPKI, 64))))
+}
+
+var (
+	msgPinMismatch     = message("tls-pin-mismatch.title")
+	msgPinMismatchBody = message("tls-pin-mismatch.body")
+)
+
+// clearPinMismatch forgets a reported mismatch once the pin matches again.
+func clearPinMismatch(cfg *VaultConfig, store *stateStore) {
+	st, err := store.load()
+	if err != nil || st.TLSPinMismatches[cfg.Address] == "" {
+		return
+	}
+	store.update(func(st *wardenState) { delete(st.TLSPinMismatches, cfg.Address) })
+}
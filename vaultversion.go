@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Vault Version Handshake ---
+
+// minVaultVersion is the oldest Vault whose sys/health and sys/seal-status
+// carry every field unlock relies on. Older nodes report zero thresholds
+// and progress, so unsealing them is refused rather than guessed at.
+const minVaultVersion = "1.9.0"
+
+// vaultFeature is an optional feature that needs a newer Vault than the
+// minimum. Unsupported features are switched off for that node.
+type vaultFeature struct {
+	name     string
+	min      string
+	degraded string // what happens without it
+}
+
+var vaultFeatures = []vaultFeature{
+	{"seal-migration", "1.5.0", "migration is not reported, so keys are never sent with migrate=true"},
+	{"seal-backend-health", "1.10.0", "auto-unseal backend errors are not tracked"},
+	{"unseal-ceremony", "1.10.0", "unlock -keys and -resume are refused because the unseal nonce can't be trusted"},
+}
+
+// vaultCapabilities is what one node supports, recorded on first contact
+// and whenever its version changes.
+type vaultCapabilities struct {
+	Version   string            `json:"version"`
+	Supported bool              `json:"supported"`
+	Disabled  map[string]string `json:"disabled,omitempty"` // feature -> reason
+	Checked   time.Time         `json:"checked"`
+}
+
+// has reports whether a feature is usable. Nil capabilities (version
+// unknown) allow everything.
+func (c *vaultCapabilities) has(feature string) bool {
+	if c == nil {
+		return true
+	}
+	_, off := c.Disabled[feature]
+	return !off
+}
+
+// parseVaultVersion turns "1.15.2+ent" or "v1.8.0-rc1" into numbers.
+func parseVaultVersion(v string) ([3]int, bool) {
+	var out [3]int
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	if i := strings.IndexAny(v, "-+ "); i >= 0 {
+		v = v[:i]
+	}
+	parts := strings.Split(v, ".")
+	if len(parts) < 2 || len(parts) > 3 {
+		return out, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return out, false
+		}
+		out[i] = n
+	}
+	return out, true
+}
+
+func versionAtLeast(have, want [3]int) bool {
+	for i := range have {
+		if have[i] != want[i] {
+			return have[i] > want[i]
+		}
+	}
+	return true
+}
+
+// vaultCapabilitiesFor evaluates a reported version against the minimum
+// and the feature table.
+func vaultCapabilitiesFor(version string) *vaultCapabilities {
+	have, ok := parseVaultVersion(version)
+	if !ok {
+		return nil
+	}
+	min, _ := parseVaultVersion(minVaultVersion)
+	c := &vaultCapabilities{Version: version, Supported: versionAtLeast(have, min), Checked: time.Now().UTC()}
+	for _, f := range vaultFeatures {
+		want, _ := parseVaultVersion(f.min)
+		if !versionAtLeast(have, want) {
+			if c.Disabled == nil {
+				c.Disabled = make(map[string]string)
+			}
+			c.Disabled[f.name] = fmt.Sprintf("needs Vault %s or newer: %s", f.min, f.degraded)
+		}
+	}
+	return c
+}
+
+// checkVaultVersion records the node's capabilities, logging what is
+// switched off the first time a version is seen. An empty or unparseable
+// version returns nil and a warning; nothing is disabled then.
+func checkVaultVersion(cfg *VaultConfig, store *stateStore, version string) *vaultCapabilities {
+	caps := vaultCapabilitiesFor(version)
+	if caps == nil {
+		logWarn("⚠️  Vault at {address} did not report a usable version (\"{version}\"); assuming it is supported", "address", cfg.Address, "version", version)
+		return nil
+	}
+
+	var prev *vaultCapabilities
+	if err := store.update(func(st *wardenState) {
+		prev = st.VaultNodes[cfg.Address]
+		if prev != nil && prev.Version == caps.Version {
+			caps.Checked = prev.Checked
+		}
+		if st.VaultNodes == nil {
+			st.VaultNodes = make(map[string]*vaultCapabilities)
+		}
+		st.VaultNodes[cfg.Address] = caps
+	}); err != nil {
+		logWarn("⚠️  Could not record Vault capabilities: {error}", "error", err)
+	}
+	if prev != nil && prev.Version == caps.Version {
+		return caps
+	}
+
+	logInfo("ℹ️  Vault {version} at {address}", "version", caps.Version, "address", cfg.Address)
+	if !caps.Supported {
+		logWarn("⛔ Vault {version} is older than the minimum supported {minimum}; unlock is disabled for this node", "version", caps.Version, "minimum", minVaultVersion)
+	}
+	for _, f := range vaultFeatures {
+		if reason, off := caps.Disabled[f.name]; off {
+			logInfo("   {feature} disabled: {reason}", "feature", f.name, "reason", reason)
+		}
+	}
+	return caps
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// --- Seal Watch ---
+
+const (
+	defaultWatchInterval    = 30 * time.Second
+	defaultWatchConcurrency = 8
+	defaultWatchConfirm     = 2
+	defaultWatchMaxBackoff  = 5 * time.Minute
+	// A cluster changing state this often within flapWindow is flapping;
+	// its alerts are held until it has been stable for a full window.
+	flapTransitions = 4
+	flapWindow      = 10 * time.Minute
+)
+
+// WatchConfig polls each cluster's seal status from the audit daemon, so
+// a seal is noticed within an interval rather than at the next unlock run.
+type WatchConfig struct {
+	Enabled  bool     `yaml:"enabled"`
+	Interval Duration `yaml:"interval"`
+	Timeout  Duration `yaml:"timeout"` // per probe; default timeouts.health
+	// MaxConcurrentProbes bounds simultaneous requests across all
+	// clusters. A hung cluster holds a slot for at most timeout.
+	MaxConcurrentProbes int `yaml:"max_concurrent_probes"`
+	// Confirm is how many probes in a row must agree before a change of
+	// state is believed.
+	Confirm    int           `yaml:"confirm"`
+	MaxBackoff Duration      `yaml:"max_backoff"`
+	Latency    LatencyConfig `yaml:"latency"`
+	// SealGrace holds a node's sealed alert while other nodes still
+	// serve; default 90s, 0 alerts at once.
+	SealGrace *Duration `yaml:"seal_grace"`
+	// TopologyBudget bounds the probes of the topology snapshot attached
+	// to seal alerts and shown by status; default 3s.
+	TopologyBudget Duration `yaml:"topology_budget"`
+}
+
+// watchTarget is one address to watch: a cluster's, or each of its
+// nodes. Each gets its own goroutine, ticker and backoff.
+type watchTarget struct {
+	name   string
+	cfg    *VaultConfig // the cluster's, with the node's address
+	client *http.Client
+	group  *sealGroup
+}
+
+func watchTargets(cfg *VaultConfig) ([]watchTarget, error) {
+	var grace time.Duration
+	if cfg.Watch.SealGrace != nil {
+		grace = time.Duration(*cfg.Watch.SealGrace)
+	}
+	var targets []watchTarget
+	for _, c := range clusterConfigs(cfg) {
+		label := clusterLabel(c)
+		if len(c.Nodes) == 0 {
+			client, err := newVaultClient(c)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", label, err)
+			}
+			group := newSealGroup(label, c, grace, []string{label})
+			targets = append(targets, watchTarget{name: label, cfg: c, client: client, group: group})
+			continue
+		}
+		names := make([]string, len(c.Nodes))
+		for i, addr := range c.Nodes {
+			names[i] = nodeName(label, addr)
+		}
+		group := newSealGroup(label, c, grace, names)
+		for i, addr := range c.Nodes {
+			nc := *c
+			nc.Address = addr
+			client, err := newVaultClient(&nc)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", names[i], err)
+			}
+			targets = append(targets, watchTarget{name: names[i], cfg: &nc, client: client, group: group})
+		}
+	}
+	return targets, nil
+}
+
+// nodeName names a node by its cluster and host, e.g. prod/vault-2:8200.
+func nodeName(cluster, address string) string {
+	if u, err := url.Parse(address); err == nil && u.Host != "" {
+		return cluster + "/" + u.Host
+	}
+	return cluster + "/" + address
+}
+
+// clusterHealth is a watcher's view of its cluster, shown in /statusz.
+type clusterHealth struct {
+	Name      string    `json:"name"`
+	Address   string    `json:"address"`
+	State     string    `json:"state"` // unknown, sealed, unsealed or unreachable
+	Flapping  bool      `json:"flapping,omitempty"`
+	Failures  int       `json:"consecutive_failures,omitempty"`
+	LastProbe time.Time `json:"last_probe,omitempty"`
+	LastOK    time.Time `json:"last_ok,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+	NextProbe time.Time `json:"next_probe,omitempty"`
+	Restarts  int       `json:"restarts,omitempty"`
+
+	Latency *latencySummary `json:"latency,omitempty"`
+}
+
+// watchEngine runs one supervised watcher per cluster. Watchers share
+// nothing but the probe limit, the notifier and the metrics registry, so
+// a cluster that hangs only delays itself.
+type watchEngine struct {
+	cfg     WatchConfig
+	sem     chan struct{}
+	posture *postureChecker // nil without posture checks
+
+	mu     sync.Mutex
+	health map[string]*clusterHealth
+}
+
+func startWatch(cfg *VaultConfig, sup *supervisor) *watchEngine {
+	if !cfg.Watch.Enabled {
+		return nil
+	}
+	targets, err := watchTargets(cfg)
+	if err != nil {
+		logWarn("⚠️  Seal watch disabled: {error}", "error", err)
+		return nil
+	}
+	e := &watchEngine{
+		cfg:    cfg.Watch,
+		sem:    make(chan struct{}, cfg.Watch.MaxConcurrentProbes),
+		health: make(map[string]*clusterHealth),
+	}
+	if e.posture, err = newPostureChecker(cfg); err != nil {
+		logWarn("⚠️  Posture checks disabled: {error}", "error", err)
+	}
+	for _, t := range targets {
+		t := t
+		e.health[t.name] = &clusterHealth{Name: t.name, Address: t.cfg.Address, State: "unknown"}
+		runs := 0
+		sup.add(componentSpec{name: "watch:" + t.name, policy: policyRestart, run: func(ctx context.Context) error {
+			// A restarted watcher starts over from an unknown state.
+			if runs++; runs > 1 {
+				e.update(t.name, func(h *clusterHealth) { h.Restarts = runs - 1 })
+			}
+			newClusterWatcher(e, t).run(ctx)
+			return nil
+		}})
+	}
+	return e
+}
+
+func (e *watchEngine) update(name string, fn func(*clusterHealth)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	fn(e.health[name])
+}
+
+// postureStatus returns the posture checks' outcomes for /statusz.
+func (e *watchEngine) postureStatus() []postureResult {
+	if e == nil {
+		return nil
+	}
+	return e.posture.status()
+}
+
+// status returns each cluster's health for /statusz.
+func (e *watchEngine) status() []clusterHealth {
+	if e == nil {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	out := make([]clusterHealth, 0, len(e.health))
+	for _, h := range e.health {
+		out = append(out, *h)
+	}
+	return out
+}
+
+// clusterWatcher is the state of one cluster's polling loop. It is only
+// touched by its own goroutine; clusterHealth is the shared copy.
+type clusterWatcher struct {
+	e     *watchEngine
+	t     watchTarget
+	store *stateStore
+
+	state       string // confirmed: unknown, sealed or unsealed
+	pending     string // candidate state not confirmed yet
+	agree       int    // probes in a row reporting pending
+	failures    int
+	unreachable bool
+	transitions []time.Time // confirmed changes within flapWindow
+	flapping    bool
+	latency     latencyTracker
+	slow        bool // latency alert raised
+	slowAgree   int  // latency checks in a row disagreeing with slow
+}
+
+func newClusterWatcher(e *watchEngine, t watchTarget) *clusterWatcher {
+	return &clusterWatcher{e: e, t: t, store: newStateStore(t.cfg.StateFile), state: "unknown",
+		latency: latencyTracker{cfg: e.cfg.Latency}}
+}
+
+func (w *clusterWatcher) run(ctx context.Context) {
+	interval := time.Duration(w.e.cfg.Interval)
+	next := time.Duration(0) // probe at once, then every interval
+	for {
+		w.e.update(w.t.name, func(h *clusterHealth) { h.NextProbe = time.Now().Add(next) })
+		timer := time.NewTimer(next)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		select {
+		case w.e.sem <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		sealed, took, err := w.probe(ctx)
+		<-w.e.sem
+
+		if err != nil {
+			next = w.failed(err)
+			continue
+		}
+		w.recordLatency(took)
+		w.succeeded(sealed)
+		next = interval
+	}
+}
+
+// probe returns the seal state and how long Vault took to answer.
+func (w *clusterWatcher) probe(ctx context.Context) (bool, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(w.e.cfg.Timeout))
+	defer cancel()
+	start := time.Now()
+	status, err := fetchSealStatusContext(ctx, w.t.client, w.t.cfg.Address)
+	took := time.Since(start)
+	metrics.observe("watch_probe_seconds", took.Seconds(), "cluster", w.t.name)
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	metrics.inc("watch_probes_total", "cluster", w.t.name, "result", result)
+	if err != nil {
+		return false, took, err
+	}
+	return status.Sealed, took, nil
+}
+
+// failed backs off exponentially and reports the cluster unreachable once
+// enough probes in a row have failed.
+func (w *clusterWatcher) failed(err error) time.Duration {
+	w.failures++
+	reportPinMismatch(w.t.cfg, w.store, err)
+	w.e.update(w.t.name, func(h *clusterHealth) {
+		h.LastProbe, h.LastError, h.Failures = time.Now(), err.Error(), w.failures
+	})
+	if w.failures == w.e.cfg.Confirm && !w.unreachable {
+		w.unreachable = true
+		w.e.update(w.t.name, func(h *clusterHealth) { h.State = "unreachable" })
+		logWarn("📡 Seal watch: {node} unreachable: {error}", "node", w.t.name, "error", err)
+		w.alert(Alert{Severity: sevWarning, Color: sevWarning.color(), Rule: "watch-unreachable"}.say(
+			msgWatchUnreachable.with("node", cleanField(w.t.name, maxNameLen)),
+			msgWatchUnreachableBody.with("count", w.failures, "address", mdCode(w.t.cfg.Address, maxPathLen),
+				"error", mdText(err.Error(), maxPathLen))))
+	}
+
+	backoff, limit := time.Duration(w.e.cfg.Interval), time.Duration(w.e.cfg.MaxBackoff)
+	for i := 1; i < w.failures && backoff < limit; i++ {
+		backoff *= 2
+	}
+	if backoff > limit {
+		backoff = limit
+	}
+	return backoff
+}
+
+func (w *clusterWatcher) succeeded(sealed bool) {
+	observed := "unsealed"
+	if sealed {
+		observed = "sealed"
+	}
+	if w.unreachable {
+		logInfo("📡 Seal watch: {node} reachable again", "node", w.t.name)
+		w.alert(Alert{Severity: sevInfo, Color: sevInfo.color(), Rule: "watch-unreachable"}.say(
+			msgWatchReachable.with("node", cleanField(w.t.name, maxNameLen)),
+			msgWatchReachableBody.with("address", mdCode(w.t.cfg.Address, maxPathLen), "count", w.failures)))
+	}
+	w.failures, w.unreachable = 0, false
+
+	switch {
+	case observed == w.state:
+		w.pending, w.agree = "", 0
+	case observed == w.pending:
+		w.agree++
+	default:
+		w.pending, w.agree = observed, 1
+	}
+	if w.pending != "" && (w.agree >= w.e.cfg.Confirm || w.state == "unknown") {
+		w.transition(w.pending)
+	}
+	w.updateFlapping()
+
+	state, flapping := w.state, w.flapping
+	w.e.update(w.t.name, func(h *clusterHealth) {
+		now := time.Now()
+		h.LastProbe, h.LastOK, h.LastError, h.Failures = now, now, "", 0
+		h.State, h.Flapping = state, flapping
+	})
+}
+
+// transition confirms a new state. The first state seen is only
+// recorded; what a change alerts is up to the cluster's seal group.
+func (w *clusterWatcher) transition(to string) {
+	from := w.state
+	w.state, w.pending, w.agree = to, "", 0
+	recordSealState(w.t.name, to == "sealed")
+	if from == "unknown" {
+		logInfo("👁️  Seal watch: {node} is {state}", "node", w.t.name, "state", to)
+	} else {
+		w.transitions = append(w.transitions, time.Now())
+		logInfo("👁️  Seal watch: {node} {from} -> {to}", "node", w.t.name, "from", from, "to", to)
+	}
+	w.t.group.observe(sealChange{node: w.t.name, address: w.t.cfg.Address, from: from, to: to,
+		flapping: w.flapping, trend: w.latency.trend(time.Now())})
+}
+
+// updateFlapping starts holding alerts when the cluster changes state too
+// often and stops once it has been stable for a whole window.
+func (w *clusterWatcher) updateFlapping() {
+	cutoff := time.Now().Add(-flapWindow)
+	kept := w.transitions[:0]
+	for _, t := range w.transitions {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	w.transitions = kept
+
+	switch {
+	case !w.flapping && len(w.transitions) >= flapTransitions:
+		w.flapping = true
+		logInfo("〰️  Seal watch: {node} is flapping, holding alerts", "node", w.t.name)
+		notify(w.t.cfg, Alert{Severity: sevWarning, Color: sevWarning.color(), Rule: "watch-flapping"}.say(
+			msgWatchFlapping.with("node", cleanField(w.t.name, maxNameLen)),
+			msgWatchFlappingBody.with("address", mdCode(w.t.cfg.Address, maxPathLen), "count", len(w.transitions),
+				"window", formatDuration(flapWindow), "state", w.state)))
+	case w.flapping && len(w.transitions) == 0:
+		w.flapping = false
+		logInfo("〰️  Seal watch: {node} stable again ({state})", "node", w.t.name, "state", w.state)
+		notify(w.t.cfg, Alert{Severity: sevInfo, Color: sevInfo.color(), Rule: "watch-flapping"}.say(
+			msgWatchStable.with("node", cleanField(w.t.name, maxNameLen)),
+			msgWatchStableBody.with("address", mdCode(w.t.cfg.Address, maxPathLen), "state", w.state, "window", formatDuration(flapWindow))))
+	}
+}
+
+var (
+	msgWatchUnreachable     = message("watch-unreachable.unreachable.title")
+	msgWatchUnreachableBody = message("watch-unreachable.unreachable.body")
+	msgWatchReachable       = message("watch-unreachable.reachable.title")
+	msgWatchReachableBody   = message("watch-unreachable.reachable.body")
+	msgWatchFlapping        = message("watch-flapping.flapping.title")
+	msgWatchFlappingBody    = message("watch-flapping.flapping.body")
+	msgWatchStable          = message("watch-flapping.stable.title")
+	msgWatchStableBody      = message("watch-flapping.stable.body")
+)
+
+func (w *clusterWatcher) alert(a Alert) {
+	if w.flapping {
+		metrics.inc("watch_alerts_held_total", "cluster", w.t.name)
+		return
+	}
+	a.Time = time.Now()
+	notify(w.t.cfg, a)
+}
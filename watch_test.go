@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hungVault accepts connections and never answers, like a node wedged
+// below the HTTP layer.
+func hungVault(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, c)
+			mu.Unlock()
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+	return "http://" + ln.Addr().String()
+}
+
+// watchTestConfig is a watch config with the latency defaults load
+// would fill in. Intervals are shorter than load allows.
+func watchTestConfig(interval, timeout time.Duration, probes int) WatchConfig {
+	return WatchConfig{Enabled: true, Interval: Duration(interval), Timeout: Duration(timeout),
+		MaxConcurrentProbes: probes, Confirm: 2, MaxBackoff: Duration(2 * interval),
+		Latency: LatencyConfig{Window: Duration(defaultLatencyWindow), Baseline: Duration(defaultLatencyBaseline),
+			GrowthFloor: Duration(defaultLatencyGrowthFloor), MinSamples: defaultLatencyMinSamples}}
+}
+
+// startTestWatch runs a watcher per cluster, as startWatch does but
+// without the supervisor, until the test ends.
+func startTestWatch(t *testing.T, wc WatchConfig, clusters ...*VaultConfig) *watchEngine {
+	e := &watchEngine{cfg: wc, sem: make(chan struct{}, wc.MaxConcurrentProbes), health: make(map[string]*clusterHealth)}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+	for _, c := range clusters {
+		c.StateFile = filepath.Join(t.TempDir(), "state.json")
+		targets, err := watchTargets(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tg := range targets {
+			e.health[tg.name] = &clusterHealth{Name: tg.name, Address: tg.cfg.Address, State: "unknown"}
+			w := newClusterWatcher(e, tg)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w.run(ctx)
+			}()
+		}
+	}
+	return e
+}
+
+func watchHealth(e *watchEngine, name string) clusterHealth {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return *e.health[name]
+}
+
+// A cluster whose probes hang until their timeout doesn't hold up the
+// seal detection of another: that is still down to its own interval.
+// Polled one after the other, each round would wait out the timeout too.
+func TestWatchHungClusterIsolated(t *testing.T) {
+	captureAlerts(t)
+	v := newFakeVault(t)
+	v.sealed = false
+	wc := watchTestConfig(200*time.Millisecond, 200*time.Millisecond, 2)
+	e := startTestWatch(t, wc,
+		&VaultConfig{Address: hungVault(t), Environment: "hung"},
+		&VaultConfig{Address: v.URL, Environment: "healthy"})
+
+	waitFor(t, "the healthy cluster's first probe", func() bool { return watchHealth(e, "healthy").State == "unsealed" })
+	v.mu.Lock()
+	v.sealed = true
+	v.mu.Unlock()
+	start := time.Now()
+	waitFor(t, "the seal to be noticed", func() bool { return watchHealth(e, "healthy").State == "sealed" })
+
+	// Two confirming probes an interval apart, plus scheduling.
+	if took, limit := time.Since(start), time.Duration(wc.Confirm)*time.Duration(wc.Interval)+150*time.Millisecond; took > limit {
+		t.Errorf("seal noticed after %s, want within %s", took, limit)
+	}
+	if h := watchHealth(e, "hung"); h.Failures == 0 || h.State == "sealed" || h.State == "unsealed" {
+		t.Errorf("hung cluster = %+v, want only timed-out probes", h)
+	}
+}
+
+// With the probe limit at one, a hung cluster holds the slot only until
+// its timeout; the others still get probed.
+func TestWatchProbeLimitBoundedByTimeout(t *testing.T) {
+	captureAlerts(t)
+	v := newFakeVault(t)
+	v.sealed = false
+	wc := watchTestConfig(50*time.Millisecond, 50*time.Millisecond, 1)
+	e := startTestWatch(t, wc,
+		&VaultConfig{Address: hungVault(t), Environment: "hung"},
+		&VaultConfig{Address: v.URL, Environment: "healthy"})
+
+	waitFor(t, "the hung cluster to time out twice", func() bool { return watchHealth(e, "hung").Failures >= 2 })
+	if h := watchHealth(e, "healthy"); h.State != "unsealed" {
+		t.Errorf("healthy cluster = %+v, want it probed between the hung cluster's timeouts", h)
+	}
+	if h := watchHealth(e, "hung"); h.State != "unreachable" {
+		t.Errorf("hung cluster state = %s, want unreachable after confirm failures", h.State)
+	}
+}
+
+func testWatcher(t *testing.T, wc WatchConfig) *clusterWatcher {
+	cfg := &VaultConfig{Address: "http://127.0.0.1:1", Environment: "prod", StateFile: filepath.Join(t.TempDir(), "state.json")}
+	targets, err := watchTargets(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &watchEngine{cfg: wc, health: map[string]*clusterHealth{"prod": {Name: "prod", State: "unknown"}}}
+	return newClusterWatcher(e, targets[0])
+}
+
+func TestWatchBackoff(t *testing.T) {
+	alerts := captureAlerts(t)
+	wc := watchTestConfig(time.Second, time.Second, 1)
+	wc.Confirm, wc.MaxBackoff = 3, Duration(10*time.Second)
+	w := testWatcher(t, wc)
+	var got []time.Duration
+	for i := 0; i < 6; i++ {
+		got = append(got, w.failed(errors.New("connection refused")))
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("backoff = %v, want %v", got, want)
+		}
+	}
+	if a := alerts(); len(a) != 1 || a[0].Rule != "watch-unreachable" {
+		t.Errorf("alerts = %+v, want one unreachable alert at the third failure", a)
+	}
+
+	w.succeeded(false)
+	if a := alerts(); len(a) != 1 || a[0].Severity != sevInfo {
+		t.Errorf("alerts = %+v, want the reachable-again alert", a)
+	}
+	if got := w.failed(errors.New("refused")); got != time.Second {
+		t.Errorf("backoff after recovery = %s, want the interval again", got)
+	}
+}
+
+// A change of state needs confirm probes in a row; the first state seen
+// is taken at once.
+func TestWatchConfirm(t *testing.T) {
+	captureAlerts(t)
+	wc := watchTestConfig(time.Second, time.Second, 1)
+	wc.Confirm = 3
+	w := testWatcher(t, wc)
+	w.succeeded(false)
+	if w.state != "unsealed" {
+		t.Fatalf("state = %s after the first probe, want unsealed", w.state)
+	}
+	for _, sealed := range []bool{true, true, false, true, true} {
+		w.succeeded(sealed)
+		if w.state != "unsealed" {
+			t.Fatalf("state = %s before three sealed probes in a row", w.state)
+		}
+	}
+	w.succeeded(true)
+	if w.state != "sealed" {
+		t.Errorf("state = %s after three sealed probes in a row, want sealed", w.state)
+	}
+}
+
+// A cluster changing state flapTransitions times within the window has
+// its alerts held.
+func TestWatchFlapping(t *testing.T) {
+	alerts := captureAlerts(t)
+	wc := watchTestConfig(time.Second, time.Second, 1)
+	wc.Confirm = 1
+	w := testWatcher(t, wc)
+	w.succeeded(false)
+	for i := 0; i < flapTransitions; i++ {
+		w.succeeded(i%2 == 0)
+	}
+	if !w.flapping {
+		t.Fatalf("not flapping after %d transitions", flapTransitions)
+	}
+	var flapping int
+	for _, a := range alerts() {
+		if a.Rule == "watch-flapping" {
+			flapping++
+		}
+	}
+	if flapping != 1 {
+		t.Errorf("%d flapping alerts, want 1", flapping)
+	}
+
+	held := metrics.sum("watch_alerts_held_total")
+	w.alert(Alert{Title: "t", Rule: "watch-unreachable"})
+	if metrics.sum("watch_alerts_held_total") != held+1 || len(alerts()) != 0 {
+		t.Error("alert sent while flapping, want it held")
+	}
+
+	// A window without changes ends it.
+	for i := range w.transitions {
+		w.transitions[i] = time.Now().Add(-2 * flapWindow)
+	}
+	w.succeeded(w.state == "sealed")
+	if w.flapping {
+		t.Error("still flapping after a stable window")
+	}
+}
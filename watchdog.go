@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nxadm/tail"
+)
+
+// --- Watchdog ---
+
+const (
+	defaultWatchdogHeartbeat = 10 * time.Second
+	defaultWatchdogMissed    = 3
+	defaultWatchdogMaxHeals  = 3
+)
+
+// WatchdogConfig catches a loop that is still running but no longer
+// making progress, such as a tail wedged by an NFS hiccup, which the
+// supervisor can't see because nothing returned.
+type WatchdogConfig struct {
+	// Heartbeat is how often a watched loop must show progress, or that
+	// it has nothing to do.
+	Heartbeat Duration `yaml:"heartbeat"`
+	Missed    int      `yaml:"missed"` // heartbeats missed before a self-heal
+	// MaxHeals is how many self-heals in a row may fail before the warden
+	// sends a critical alert and /healthz reports it not ready.
+	MaxHeals int  `yaml:"max_heals"`
+	Disabled bool `yaml:"disabled"`
+}
+
+// watchdogStatus is one watchdog's view, shown in /statusz.
+type watchdogStatus struct {
+	Name      string     `json:"name"`
+	LastBeat  *time.Time `json:"last_beat,omitempty"`
+	Heals     int        `json:"heals"`              // since start
+	Attempts  int        `json:"attempts,omitempty"` // in a row, without a heartbeat since
+	Escalated bool       `json:"escalated,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// watchdog expects beat at least every heartbeat. After missed heartbeats
+// it calls heal, which rebuilds what it watches in place, without a
+// process restart. A nil *watchdog ignores beats.
+type watchdog struct {
+	name     string
+	cfg      *VaultConfig
+	interval time.Duration
+	missed   int
+	maxHeals int
+	heal     func() error
+
+	mu        sync.Mutex
+	lastBeat  time.Time
+	healedAt  time.Time
+	heals     int
+	attempts  int
+	escalated bool
+	lastErr   string
+}
+
+func newWatchdog(cfg *VaultConfig, name string, heal func() error) *watchdog {
+	wc := cfg.Watchdog
+	if wc.Disabled {
+		return nil
+	}
+	return &watchdog{name: name, cfg: cfg, interval: time.Duration(wc.Heartbeat), missed: wc.Missed,
+		maxHeals: wc.MaxHeals, heal: heal, lastBeat: time.Now()}
+}
+
+// beat records progress.
+func (w *watchdog) beat() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	w.lastBeat = time.Now()
+	w.mu.Unlock()
+}
+
+// run is the watchdog's component.
+func (w *watchdog) run(ctx context.Context) error {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			w.check(now)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+var (
+	msgHealed     = message("watchdog.healed.title")
+	msgHealedBody = message("watchdog.healed.body")
+	msgStuck      = message("watchdog.stuck.title")
+	msgStuckBody  = message("watchdog.stuck.body")
+)
+
+func (w *watchdog) check(now time.Time) {
+	w.mu.Lock()
+	if w.attempts > 0 && w.lastBeat.After(w.healedAt) {
+		attempts, escalated := w.attempts, w.escalated
+		w.attempts, w.escalated, w.lastErr = 0, false, ""
+		w.mu.Unlock()
+		metrics.set("watchdog_escalated", 0, "component", w.name)
+		logInfo("✅ {component} is making progress again after {attempts} self-heal attempts", "component", w.name, "attempts", attempts)
+		if escalated {
+			notify(w.cfg, Alert{Severity: sevInfo, Color: sevInfo.color(), Rule: "watchdog", Incident: "watchdog:" + w.name,
+				Resolved: true}.say(msgHealed.with("component", w.name), msgHealedBody.with("component", w.name, "attempts", attempts)))
+		}
+		return
+	}
+	since := w.lastBeat
+	if w.healedAt.After(since) {
+		since = w.healedAt
+	}
+	if now.Sub(since) < time.Duration(w.missed)*w.interval {
+		w.mu.Unlock()
+		return
+	}
+	w.attempts++
+	w.heals++
+	w.healedAt = now
+	attempt := w.attempts
+	escalate := attempt > w.maxHeals && !w.escalated
+	if escalate {
+		w.escalated = true
+	}
+	w.mu.Unlock()
+
+	if escalate {
+		metrics.set("watchdog_escalated", 1, "component", w.name)
+		logError("🚨 {component}: {attempts} self-heal attempts in a row failed", "component", w.name, "attempts", w.maxHeals)
+		notify(w.cfg, Alert{Severity: sevCritical, Color: sevCritical.color(), Rule: "watchdog",
+			Incident: "watchdog:" + w.name}.say(msgStuck.with("component", w.name),
+			msgStuckBody.with("component", w.name, "stalled", now.Sub(w.lastBeatTime()).Round(time.Second), "attempts", w.maxHeals)))
+	}
+	metrics.inc("watchdog_heals_total", "component", w.name)
+	logInfo("🐕 {component} missed {missed} heartbeats; restarting it in place (attempt {attempt})", "component", w.name, "missed", w.missed, "attempt", attempt)
+	if err := w.heal(); err != nil {
+		logWarn("⚠️  {component}: self-heal failed: {error}", "component", w.name, "error", err)
+		w.mu.Lock()
+		w.lastErr = err.Error()
+		w.mu.Unlock()
+	}
+}
+
+func (w *watchdog) lastBeatTime() time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.lastBeat
+}
+
+// stuck returns how many self-heals in a row have failed once past
+// max_heals, for /healthz; zero otherwise.
+func (w *watchdog) stuck() int {
+	if w == nil {
+		return 0
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.escalated {
+		return 0
+	}
+	return w.attempts - 1
+}
+
+func (w *watchdog) status() *watchdogStatus {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	last := w.lastBeat
+	return &watchdogStatus{Name: w.name, LastBeat: &last, Heals: w.heals, Attempts: w.attempts,
+		Escalated: w.escalated, LastError: w.lastErr}
+}
+
+// --- Audit Log Tail ---
+
+// auditTail follows the audit log. On a self-heal it is torn down and
+// recreated at the offset after the last line read.
+type auditTail struct {
+	mu   sync.Mutex
+	path string // changed by a reload
+	t    *tail.Tail
+	pos  int64 // after the last line read
+}
+
+// openAuditTail follows path from offset; see startOffset.
+func openAuditTail(path string, offset int64) (*auditTail, error) {
+	a := &auditTail{path: path, pos: offset}
+	var err error
+	if a.t, err = tailAuditLog(path, tail.SeekInfo{Offset: offset, Whence: io.SeekStart}); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func tailAuditLog(path string, at tail.SeekInfo) (*tail.Tail, error) {
+	// Use tail library for proper log rotation handling
+	t, err := tail.TailFile(path, tail.Config{
+		Follow:   true,
+		ReOpen:   true, // Handles log rotation
+		Poll:     true, // Use polling (more reliable than inotify)
+		Location: &at,
+		Logger:   tail.DiscardingLogger, // Suppress tail's own logs
+	})
+	if err != nil {
+		return nil, fmt.Errorf("tail audit log: %w", err)
+	}
+	return t, nil
+}
+
+// lines is the current tail's channel; it changes after a reopen.
+func (a *auditTail) lines() chan *tail.Line {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.t.Lines
+}
+
+// advance records the offset after a line that was read.
+func (a *auditTail) advance(offset int64) {
+	a.mu.Lock()
+	a.pos = offset
+	a.mu.Unlock()
+}
+
+func (a *auditTail) position() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.pos
+}
+
+// reopen replaces the tail with a new one at the last offset read, or at
+// the start when the file is now shorter than that, i.e. was rotated.
+func (a *auditTail) reopen() error {
+	a.mu.Lock()
+	path, pos := a.path, a.pos
+	a.mu.Unlock()
+	if fi, err := os.Stat(path); err != nil {
+		return fmt.Errorf("audit log not accessible: %w", err)
+	} else if fi.Size() < pos {
+		pos = 0
+	}
+	t, err := tailAuditLog(path, tail.SeekInfo{Offset: pos, Whence: io.SeekStart})
+	if err != nil {
+		return err
+	}
+	a.swap(path, t, pos)
+	logInfo("🔁 Audit log {path} reopened at offset {offset}", "path", path, "offset", pos)
+	return nil
+}
+
+// swap puts t in place of the running tail. Closing the old one's lines
+// sends the intake loop to the new one.
+func (a *auditTail) swap(path string, t *tail.Tail, pos int64) {
+	a.mu.Lock()
+	old := a.t
+	a.path, a.t, a.pos = path, t, pos
+	a.mu.Unlock()
+	// A wedged tail may never return from Stop.
+	go old.Stop()
+}
+
+func (a *auditTail) logPath() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.path
+}
+
+// stop stops the tail, giving up on one that is wedged after a second.
+func (a *auditTail) stop() {
+	a.mu.Lock()
+	t := a.t
+	a.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		t.Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+	}
+}
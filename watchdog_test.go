@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nxadm/tail"
+)
+
+func watchdogTestConfig() *VaultConfig {
+	cfg := &VaultConfig{}
+	cfg.Watchdog = WatchdogConfig{Heartbeat: Duration(10 * time.Millisecond), Missed: 2, MaxHeals: 2}
+	return cfg
+}
+
+// missHeartbeats waits out the heartbeats dog allows, then lets it check.
+// The tests drive check themselves so a worker idling between beats
+// doesn't count as stuck.
+func missHeartbeats(dog *watchdog) {
+	time.Sleep(time.Duration(dog.missed+1) * dog.interval)
+	dog.check(time.Now())
+}
+
+func readyz(t *testing.T, dogs ...*watchdog) readiness {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	healthzHandler(&intakeGate{}, nil, time.Now(), dogs...)(rec, httptest.NewRequest("GET", "/healthz", nil))
+	var st readiness
+	if err := json.Unmarshal(rec.Body.Bytes(), &st); err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+// A delivery that never returns wedges the queue's worker; the watchdog
+// starts another in its place and the queue drains again.
+func TestWatchdogRestartsWedgedQueue(t *testing.T) {
+	wedged, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	sent := make(chan string, 10)
+	var once sync.Once
+	q := testQueue(10, func(alerts []Alert) ([]Alert, error) {
+		first := false
+		once.Do(func() { first = true })
+		if first {
+			close(wedged)
+			<-release
+			return nil, nil
+		}
+		for _, a := range alerts {
+			sent <- a.ID
+		}
+		return nil, nil
+	})
+	q.dog = newWatchdog(watchdogTestConfig(), "notify-queue", q.restart)
+	go q.run(0)
+
+	q.push(queueAlert("stuck", sevWarning))
+	select {
+	case <-wedged:
+	case <-time.After(2 * time.Second):
+		t.Fatal("worker never took the first alert")
+	}
+	q.push(queueAlert("behind", sevCritical))
+	select {
+	case id := <-sent:
+		t.Fatalf("sent %s while the worker was wedged", id)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	missHeartbeats(q.dog)
+	select {
+	case id := <-sent:
+		if id != "behind" {
+			t.Errorf("sent %s, want behind", id)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("nothing sent after the self-heal")
+	}
+	if q.current(0) {
+		t.Error("the wedged worker is still current")
+	}
+
+	waitFor(t, "the new worker's heartbeat", func() bool {
+		q.dog.mu.Lock()
+		defer q.dog.mu.Unlock()
+		return q.dog.lastBeat.After(q.dog.healedAt)
+	})
+	q.dog.check(time.Now())
+	st := q.dog.status()
+	if st.Heals != 1 || st.Attempts != 0 || st.Escalated {
+		t.Errorf("status = %+v, want one heal and no attempts pending", st)
+	}
+}
+
+// Self-heals that keep failing escalate once past max_heals: a critical
+// alert, and /healthz not ready, until a heartbeat comes back.
+func TestWatchdogEscalates(t *testing.T) {
+	sent := captureAlerts(t)
+	heals := 0
+	dog := newWatchdog(watchdogTestConfig(), "audit-reader", func() error {
+		heals++
+		return errors.New("audit log not accessible: stale NFS file handle")
+	})
+
+	for i := 1; i <= dog.maxHeals; i++ {
+		missHeartbeats(dog)
+		if st := readyz(t, dog); !st.Ready {
+			t.Fatalf("after %d failed self-heals: not ready (%s); want ready until max_heals is passed", i, st.Reason)
+		}
+	}
+	if alerts := sent(); len(alerts) != 0 {
+		t.Fatalf("sent %d alerts within max_heals, want none", len(alerts))
+	}
+
+	missHeartbeats(dog)
+	if heals != dog.maxHeals+1 {
+		t.Errorf("heal called %d times, want %d", heals, dog.maxHeals+1)
+	}
+	st := readyz(t, dog)
+	if want := "audit-reader stuck: 2 self-heal attempts in a row failed"; st.Ready || st.Reason != want {
+		t.Errorf("healthz = %v %q, want not ready: %q", st.Ready, st.Reason, want)
+	}
+	alerts := sent()
+	if len(alerts) != 1 || alerts[0].Severity != sevCritical || alerts[0].Rule != "watchdog" {
+		t.Fatalf("alerts = %+v, want one critical watchdog alert", alerts)
+	}
+	if status := dog.status(); !status.Escalated || !strings.Contains(status.LastError, "stale NFS file handle") {
+		t.Errorf("status = %+v, want escalated with the heal's error", status)
+	}
+
+	// Escalated once: further failures don't alert again.
+	missHeartbeats(dog)
+	if alerts := sent(); len(alerts) != 0 {
+		t.Errorf("sent %d more alerts, want none", len(alerts))
+	}
+
+	dog.beat()
+	dog.check(time.Now())
+	if st := readyz(t, dog); !st.Ready {
+		t.Errorf("after a heartbeat: not ready (%s)", st.Reason)
+	}
+	alerts = sent()
+	if len(alerts) != 1 || alerts[0].Severity != sevInfo || alerts[0].Rule != "watchdog" {
+		t.Errorf("alerts = %+v, want the all-clear", alerts)
+	}
+	if dog.stuck() != 0 {
+		t.Errorf("stuck = %d after recovering, want 0", dog.stuck())
+	}
+}
+
+func TestWatchdogDisabled(t *testing.T) {
+	cfg := watchdogTestConfig()
+	cfg.Watchdog.Disabled = true
+	dog := newWatchdog(cfg, "notify-queue", func() error { return nil })
+	if dog != nil {
+		t.Fatal("disabled watchdog was built")
+	}
+	dog.beat()
+	if dog.stuck() != 0 || dog.status() != nil {
+		t.Error("nil watchdog reported something")
+	}
+}
+
+// A tail left following a file that no longer grows, as after an NFS
+// hiccup, delivers nothing; the watchdog reopens it at the offset after
+// the last line read, so nothing is lost or read twice.
+func TestWatchdogReopensWedgedTail(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	if err := os.WriteFile(path, []byte("line-1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	stale := filepath.Join(dir, "stale.log")
+	if err := os.WriteFile(stale, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	wedged, err := tailAuditLog(stale, tail.SeekInfo{Whence: io.SeekStart})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := watchdogTestConfig()
+	cfg.AuditLogs = []string{path}
+	s := &auditTails{cfg: cfg, out: make(chan tailLine), done: make(chan struct{}), patterns: cfg.AuditLogs,
+		stops: make(map[*auditTail]chan struct{})}
+	defer close(s.done)
+	s.add(&auditTail{path: path, t: wedged, pos: int64(len("line-1\n"))})
+	dog := newWatchdog(cfg, "audit-reader", s.reopen)
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.WriteString("line-2\n")
+	select {
+	case tl := <-s.lines():
+		t.Fatalf("read %q from a wedged tail", tl.line.Text)
+	case <-time.After(400 * time.Millisecond):
+	}
+
+	missHeartbeats(dog)
+	f.WriteString("line-3\n")
+	var got []string
+	for len(got) < 2 {
+		select {
+		case tl := <-s.lines():
+			got = append(got, tl.line.Text)
+			tl.tail.advance(tl.line.SeekInfo.Offset)
+			dog.beat()
+		case <-time.After(3 * time.Second):
+			t.Fatalf("read %q after the self-heal, want line-2 and line-3", got)
+		}
+	}
+	if strings.Join(got, " ") != "line-2 line-3" {
+		t.Errorf("read %q, want line-2 then line-3", got)
+	}
+	dog.check(time.Now())
+	if st := dog.status(); st.Heals != 1 || st.Attempts != 0 {
+		t.Errorf("status = %+v, want one heal and none pending", st)
+	}
+	s.primary().stop()
+}
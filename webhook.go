@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// --- Generic Webhook ---
+
+// WebhookConfig shapes the posts of notifier: webhook, which sends each
+// alert to webhook_url as whatever JSON the receiver takes.
+type WebhookConfig struct {
+	// Headers are set on every post, e.g. an Authorization token. Their
+	// values may refer to environment variables.
+	Headers map[string]string `yaml:"headers"`
+	// Body is a text/template over the alert. Empty sends the alert JSON.
+	Body string `yaml:"body"`
+	// IdempotencyHeader names a header carrying a key unique to the
+	// alert, so a receiver can drop a retry of a post that did arrive.
+	IdempotencyHeader string `yaml:"idempotency_header"`
+	// AlreadyDelivered are error responses a receiver gives for an alert
+	// it already has, which count as delivered.
+	AlreadyDelivered []DeliveredResponse `yaml:"already_delivered"`
+	// Failover are the endpoints tried in turn for alerts webhook_url
+	// fails to take, with the same body. Each has keys of its own.
+	Failover []WebhookTarget `yaml:"failover"`
+}
+
+// WebhookTarget is a failover endpoint. Its headers replace the primary's
+// rather than adding to them, so one system's token never reaches
+// another.
+type WebhookTarget struct {
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+// DeliveredResponse matches a response by status and, optionally, a
+// regular expression its body must match.
+type DeliveredResponse struct {
+	Status int    `yaml:"status"`
+	Body   string `yaml:"body"`
+}
+
+// webhookData is what the body template sees: the alert's fields, e.g.
+// .Title, .Severity, .Path and .User, and .Timestamp, the event's time
+// in RFC 3339.
+type webhookData struct {
+	Alert
+	Timestamp string
+}
+
+// webhookFuncs are the body template's functions. json encodes a value,
+// quotes and all, which keeps audit fields from breaking the document.
+var webhookFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// webhookNotifier posts one alert per request. It is the one notifier
+// with settings of its own, so notifierFor builds it from the config.
+type webhookNotifier struct {
+	conf WebhookConfig
+	url  string
+}
+
+func (webhookNotifier) kind() string { return "webhook" }
+
+// send posts to webhook_url, then what it couldn't take to each failover
+// in turn. A retry starts over at webhook_url.
+func (n webhookNotifier) send(cfg *VaultConfig, alerts []Alert) ([]Alert, error) {
+	failed, err := postMessages(cfg, n, singleMessages(alerts))
+	for i, t := range n.conf.Failover {
+		if len(failed) == 0 {
+			break
+		}
+		logWarn("⚠️  Webhook failed for {count} alert(s), failing over to {target}: {error}",
+			"count", len(failed), "target", redactValue(t.URL), "error", err)
+		metrics.add("webhook_failovers_total", float64(len(failed)), "target", strconv.Itoa(i+1))
+		next := *cfg
+		next.WebhookURL = t.URL
+		failed, err = postMessages(&next, n.target(t), singleMessages(failed))
+	}
+	return failed, err
+}
+
+// target is n posting to the failover t.
+func (n webhookNotifier) target(t WebhookTarget) webhookNotifier {
+	n.conf.Headers, n.url = t.Headers, t.URL
+	return n
+}
+
+func (n webhookNotifier) encode(m discordMessage) ([]byte, error) {
+	a := m.alerts[0]
+	if n.conf.Body == "" {
+		return json.Marshal(a)
+	}
+	// Parsed at load, so this can't fail.
+	t := template.Must(template.New("body").Funcs(webhookFuncs).Parse(n.conf.Body))
+	var b bytes.Buffer
+	if err := t.Execute(&b, webhookData{Alert: a, Timestamp: a.Time.UTC().Format(time.RFC3339)}); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// header returns the configured headers and the alert's idempotency key.
+func (n webhookNotifier) header(m discordMessage) http.Header {
+	h := http.Header{}
+	for k, v := range n.conf.Headers {
+		h.Set(k, v)
+	}
+	if n.conf.IdempotencyHeader != "" {
+		h.Set(n.conf.IdempotencyHeader, idempotencyKey(n.kind(), n.url, m.alerts[0].ID))
+	}
+	return h
+}
+
+// accept takes any 2xx, and the responses listed in already_delivered.
+func (n webhookNotifier) accept(status int, body []byte) error {
+	if status >= 200 && status < 300 {
+		return nil
+	}
+	for _, d := range n.conf.AlreadyDelivered {
+		// Checked at load.
+		if d.Status == status && (d.Body == "" || regexp.MustCompile(d.Body).Match(body)) {
+			logInfo("ℹ️  webhook already has the alert (status {status})", "status", status)
+			return nil
+		}
+	}
+	return fmt.Errorf("returned status %d", status)
+}
+
+// idempotencyKey derives a UUID (version 8) from the notifier, the URL
+// and the alert ID. The outbox keeps the ID across restarts, so retries
+// send the same key; another backend or URL gets keys of its own.
+func idempotencyKey(kind, url, id string) string {
+	sum := sha256.Sum256([]byte(kind + "\x00" + url + "\x00" + id))
+	b := sum[:16]
+	b[6] = b[6]&0x0f | 0x80
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// validateWebhook checks webhook, rendering the body for a sample alert
+// so a template that doesn't make JSON fails at load, not at 3am.
+func validateWebhook(cfg *VaultConfig) error {
+	w := &cfg.Webhook
+	if err := validateWebhookHeaders("webhook.headers", w.Headers); err != nil {
+		return err
+	}
+	seen := map[string]bool{cfg.WebhookURL: true}
+	for i, t := range w.Failover {
+		f := fmt.Sprintf("webhook.failover[%d]", i)
+		if u, err := url.Parse(t.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return &fieldError{f + ".url", "must be an http or https URL"}
+		}
+		if seen[t.URL] {
+			return &fieldError{f + ".url", "is already webhook_url or an earlier failover"}
+		}
+		seen[t.URL] = true
+		if err := validateWebhookHeaders(f+".headers", t.Headers); err != nil {
+			return err
+		}
+	}
+	if w.IdempotencyHeader != "" && !validHeaderName(w.IdempotencyHeader) {
+		return &fieldError{"webhook.idempotency_header", "is not a valid header name"}
+	}
+	for i, d := range w.AlreadyDelivered {
+		f := fmt.Sprintf("webhook.already_delivered[%d]", i)
+		if d.Status < 300 || d.Status > 599 {
+			return &fieldError{f + ".status", "must be an error status, 300 to 599"}
+		}
+		if _, err := regexp.Compile(d.Body); err != nil {
+			return &fieldError{f + ".body", err.Error()}
+		}
+	}
+	if w.Body == "" {
+		return nil
+	}
+	if _, err := template.New("body").Funcs(webhookFuncs).Parse(w.Body); err != nil {
+		return &fieldError{"webhook.body", err.Error()}
+	}
+	n := webhookNotifier{conf: *w, url: cfg.WebhookURL}
+	data, err := n.encode(discordMessage{alerts: []Alert{sampleAlert(cfg, "privileged-access", sevWarning)}})
+	if err != nil {
+		return &fieldError{"webhook.body", err.Error()}
+	}
+	if !json.Valid(data) {
+		return &fieldError{"webhook.body", "does not render valid JSON for a sample alert: " + cleanField(string(data), maxErrorLen)}
+	}
+	return nil
+}
+
+func validateWebhookHeaders(field string, headers map[string]string) error {
+	for k, v := range headers {
+		if !validHeaderName(k) {
+			return &fieldError{field + "." + k, "is not a valid header name"}
+		}
+		if strings.ContainsAny(v, "\r\n") {
+			return &fieldError{field + "." + k, "must be a single line"}
+		}
+	}
+	return nil
+}
+
+// validHeaderName reports whether s is an HTTP header name token.
+func validHeaderName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c <= ' ' || c >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeReceiver records the idempotency keys it is sent and answers with
+// the status and body of reply.
+type fakeReceiver struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	keys   []string
+	auth   []string
+	status int
+	body   string
+}
+
+func newFakeReceiver(t *testing.T, status int) *fakeReceiver {
+	r := &fakeReceiver{status: status}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.Copy(io.Discard, req.Body)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.keys = append(r.keys, req.Header.Get("Idempotency-Key"))
+		r.auth = append(r.auth, req.Header.Get("Authorization"))
+		w.WriteHeader(r.status)
+		io.WriteString(w, r.body)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *fakeReceiver) reply(status int, body string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status, r.body = status, body
+}
+
+func (r *fakeReceiver) received() ([]string, []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.keys...), append([]string(nil), r.auth...)
+}
+
+func webhookTestConfig(primary string, failover ...string) *VaultConfig {
+	cfg := &VaultConfig{Notifier: "webhook", WebhookURL: primary}
+	cfg.Webhook.IdempotencyHeader = "Idempotency-Key"
+	cfg.Webhook.Headers = map[string]string{"Authorization": "Bearer primary"}
+	cfg.Webhook.AlreadyDelivered = []DeliveredResponse{{Status: 409}, {Status: 422, Body: "duplicate"}}
+	for _, u := range failover {
+		cfg.Webhook.Failover = append(cfg.Webhook.Failover, WebhookTarget{URL: u, Headers: map[string]string{"Authorization": "Bearer dr"}})
+	}
+	return cfg
+}
+
+var uuidV8 = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-8[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestIdempotencyKey(t *testing.T) {
+	k := idempotencyKey("webhook", "https://a.example/hook", "alert-1")
+	if !uuidV8.MatchString(k) {
+		t.Errorf("key %q is not a version 8 UUID", k)
+	}
+	if again := idempotencyKey("webhook", "https://a.example/hook", "alert-1"); again != k {
+		t.Errorf("key changed between calls: %s, then %s", k, again)
+	}
+	for _, other := range []string{
+		idempotencyKey("webhook", "https://b.example/hook", "alert-1"),
+		idempotencyKey("webhook", "https://a.example/hook", "alert-2"),
+		idempotencyKey("slack", "https://a.example/hook", "alert-1"),
+	} {
+		if other == k {
+			t.Errorf("distinct inputs share key %s", k)
+		}
+	}
+}
+
+func TestWebhookAccept(t *testing.T) {
+	n := notifierFor(webhookTestConfig("https://a.example/hook"))
+	tests := []struct {
+		status int
+		body   string
+		ok     bool
+	}{
+		{200, "", true},
+		{202, "", true},
+		{409, "", true},
+		{422, `{"error":"duplicate event"}`, true},
+		{422, `{"error":"missing field"}`, false},
+		{500, "", false},
+		{400, "duplicate", false},
+	}
+	for _, tt := range tests {
+		if err := n.accept(tt.status, []byte(tt.body)); (err == nil) != tt.ok {
+			t.Errorf("accept(%d, %q) = %v, want ok %v", tt.status, tt.body, err, tt.ok)
+		}
+	}
+}
+
+// A failed primary hands the alert to the fallback under a key of the
+// fallback's own; a retry brings the primary the same key as before.
+func TestWebhookFailoverKeyNamespaces(t *testing.T) {
+	primary := newFakeReceiver(t, http.StatusServiceUnavailable)
+	fallback := newFakeReceiver(t, http.StatusOK)
+	cfg := webhookTestConfig(primary.URL, fallback.URL)
+	a := Alert{ID: "alert-failover", Title: "t", Severity: sevCritical}
+
+	failed, err := sendAlerts(cfg, []Alert{a})
+	if len(failed) != 0 || err != nil {
+		t.Fatalf("send: failed %d, %v; want the fallback to take it", len(failed), err)
+	}
+	pKeys, _ := primary.received()
+	fKeys, fAuth := fallback.received()
+	if len(pKeys) != 1 || len(fKeys) != 1 {
+		t.Fatalf("posts: primary %d, fallback %d; want 1 each", len(pKeys), len(fKeys))
+	}
+	if want := idempotencyKey("webhook", primary.URL, a.ID); pKeys[0] != want {
+		t.Errorf("primary key = %s, want %s", pKeys[0], want)
+	}
+	if want := idempotencyKey("webhook", fallback.URL, a.ID); fKeys[0] != want {
+		t.Errorf("fallback key = %s, want %s", fKeys[0], want)
+	}
+	if pKeys[0] == fKeys[0] {
+		t.Error("fallback got the primary's key")
+	}
+	if fAuth[0] != "Bearer dr" {
+		t.Errorf("fallback Authorization = %q, want its own", fAuth[0])
+	}
+
+	// The primary did take it after all, and says so on the retry.
+	primary.reply(http.StatusConflict, "")
+	if failed, err := sendAlerts(cfg, []Alert{a}); len(failed) != 0 || err != nil {
+		t.Fatalf("retry: failed %d, %v; want already delivered", len(failed), err)
+	}
+	pKeys, _ = primary.received()
+	if len(pKeys) != 2 || pKeys[1] != pKeys[0] {
+		t.Errorf("primary keys = %v, want the same key twice", pKeys)
+	}
+	if fKeys, _ := fallback.received(); len(fKeys) != 1 {
+		t.Errorf("fallback posts = %d, want no second one", len(fKeys))
+	}
+}
+
+func TestWebhookFailoverChain(t *testing.T) {
+	primary := newFakeReceiver(t, http.StatusBadGateway)
+	first := newFakeReceiver(t, http.StatusTooManyRequests)
+	second := newFakeReceiver(t, http.StatusInternalServerError)
+	cfg := webhookTestConfig(primary.URL, first.URL, second.URL)
+	a := Alert{ID: "alert-chain", Title: "t", Severity: sevWarning}
+
+	failed, err := sendAlerts(cfg, []Alert{a})
+	if len(failed) != 1 || err == nil {
+		t.Fatalf("send: failed %d, %v; want the alert back for a retry", len(failed), err)
+	}
+	seen := map[string]bool{}
+	for _, r := range []*fakeReceiver{primary, first, second} {
+		keys, _ := r.received()
+		if len(keys) != 1 {
+			t.Fatalf("%s got %d posts, want 1", r.URL, len(keys))
+		}
+		if seen[keys[0]] {
+			t.Errorf("key %s sent to two endpoints", keys[0])
+		}
+		seen[keys[0]] = true
+	}
+}
+
+// A refusal isn't worth another endpoint: the message itself is wrong.
+func TestWebhookNoFailoverOnRefusal(t *testing.T) {
+	primary := newFakeReceiver(t, http.StatusBadRequest)
+	fallback := newFakeReceiver(t, http.StatusOK)
+	cfg := webhookTestConfig(primary.URL, fallback.URL)
+
+	sendAlerts(cfg, []Alert{{ID: "alert-refused", Title: "t"}})
+	if keys, _ := fallback.received(); len(keys) != 0 {
+		t.Errorf("fallback got %d posts for a refused alert, want 0", len(keys))
+	}
+}
+
+// The outbox keeps the alert ID, so the key a retry sends after a restart
+// is the one the first attempt sent.
+func TestIdempotencyKeySurvivesRestart(t *testing.T) {
+	oc := OutboxConfig{Path: filepath.Join(t.TempDir(), "outbox"), Freshness: Duration(time.Hour), MaxAge: Duration(24 * time.Hour)}
+	cfg := &VaultConfig{}
+	cfg.Queue.Outbox = oc
+	cfg.WebhookURL = "https://a.example/hook"
+
+	o, _, err := openOutbox(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := Alert{ID: newAlertID(), Title: "t", Time: time.Now(), DetectedAt: time.Now()}
+	before := idempotencyKey("webhook", cfg.WebhookURL, a.ID)
+	o.add(a, "webhook")
+	o.close()
+
+	o, pending, err := openOutbox(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.close()
+	if len(pending) != 1 {
+		t.Fatalf("pending = %d, want 1", len(pending))
+	}
+	if after := idempotencyKey("webhook", cfg.WebhookURL, pending[0].alert.ID); after != before {
+		t.Errorf("key after restart = %s, want %s", after, before)
+	}
+}
+
+func TestValidateWebhookFailover(t *testing.T) {
+	tests := []struct {
+		name string
+		urls []string
+		want string
+	}{
+		{"ok", []string{"https://dr.example/hook"}, ""},
+		{"not http", []string{"ftp://dr.example/hook"}, "webhook.failover[0].url must be an http or https URL"},
+		{"same as primary", []string{"https://a.example/hook"}, "webhook.failover[0].url is already webhook_url or an earlier failover"},
+		{"repeated", []string{"https://dr.example/hook", "https://dr.example/hook"}, "webhook.failover[1].url is already webhook_url or an earlier failover"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := webhookTestConfig("https://a.example/hook", tt.urls...)
+			err := validateWebhook(cfg)
+			if got := errString(err); got != tt.want {
+				t.Errorf("validateWebhook = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
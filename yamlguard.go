@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// --- Config Parsing Limits ---
+
+const (
+	maxConfigSize    = 1 << 20 // bytes per file
+	maxConfigDepth   = 64
+	maxAliasExpanded = 10000 // nodes reachable through aliases
+)
+
+// blockScalarStart matches a line that opens a block scalar, e.g.
+// "body: |", "- >-" or "text: |2 # comment".
+var blockScalarStart = regexp.MustCompile(`(?:^|[:\s-])[|>](?:[1-9][+-]?|[+-][1-9]?)?[ \t]*(?:#.*)?$`)
+
+// checkConfigBytes rejects oversized files and tab indentation before they
+// reach the YAML parser, whose errors for both are hard to read. Inside a
+// block scalar, such as a webhook body template, a tab past the block's
+// indentation is content and allowed.
+func checkConfigBytes(data []byte) error {
+	if len(data) > maxConfigSize {
+		return fmt.Errorf("file is %s, more than the %s limit", formatBytes(int64(len(data))), formatBytes(maxConfigSize))
+	}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(make([]byte, 0, 64*1024), maxConfigSize)
+	// In a block scalar, parent is the indentation of the line that
+	// opened it and indent that of its content, or -1 until known.
+	inBlock, parent, indent := false, 0, -1
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		spaces := len(line) - len(strings.TrimLeft(line, " "))
+		if inBlock {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			if indent < 0 && spaces > parent {
+				indent = spaces
+			}
+			if indent >= 0 && spaces >= indent {
+				continue
+			}
+			inBlock = false
+		}
+		lead := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if strings.Contains(lead, "\t") {
+			return fmt.Errorf("line %d: indented with a tab; YAML requires spaces", n)
+		}
+		if blockScalarStart.MatchString(line) && !strings.HasPrefix(strings.TrimSpace(line), "#") {
+			inBlock, parent, indent = true, spaces, -1
+		}
+	}
+	return nil
+}
+
+// checkConfigTree bounds nesting depth and alias expansion so a recursive or
+// exponentially nested anchor fails fast instead of hanging the decoder.
+func checkConfigTree(root *yaml.Node) error {
+	expanded := 0
+	var walk func(n *yaml.Node, depth int, anchors []*yaml.Node) error
+	walk = func(n *yaml.Node, depth int, anchors []*yaml.Node) error {
+		if depth > maxConfigDepth {
+			return fmt.Errorf("line %d: nested more than %d levels deep", n.Line, maxConfigDepth)
+		}
+		if n.Kind == yaml.AliasNode {
+			for _, a := range anchors {
+				if a == n.Alias {
+					return fmt.Errorf("line %d: alias *%s refers to an anchor that contains it", n.Line, n.Value)
+				}
+			}
+			anchors = append(anchors, n.Alias)
+			n = n.Alias
+		}
+		if len(anchors) > 0 {
+			expanded++
+			if expanded > maxAliasExpanded {
+				return fmt.Errorf("line %d: aliases expand to more than %d nodes", n.Line, maxAliasExpanded)
+			}
+		}
+		for _, c := range n.Content {
+			if err := walk(c, depth+1, anchors); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(root, 0, nil)
+}
+
+// yamlTypeErr matches the entries of a yaml.TypeError.
+var yamlTypeErr = regexp.MustCompile("^line (\\d+): cannot unmarshal !!(\\w+)(?: `(.*)`)? into (.+)$")
+
+// explainTypeError rewrites a yaml.TypeError so each problem names the field,
+// the expected type and what was found instead.
+func explainTypeError(root *yaml.Node, err error) error {
+	te, ok := err.(*yaml.TypeError)
+	if !ok {
+		return err
+	}
+	fields, containers := map[int]string{}, map[int]string{}
+	indexFields(root, "", fields, containers)
+
+	msgs := make([]string, 0, len(te.Errors))
+	for _, e := range te.Errors {
+		m := yamlTypeErr.FindStringSubmatch(e)
+		if m == nil {
+			msgs = append(msgs, e)
+			continue
+		}
+		line, tag, value, goType := m[1], m[2], m[3], m[4]
+		var n int
+		fmt.Sscan(line, &n)
+
+		msg := "line " + line + ": "
+		f := fields[n]
+		if tag == "seq" || tag == "map" {
+			// A flow list or mapping shares its line with its items.
+			if c := containers[n]; c != "" {
+				f = c
+			}
+		}
+		if f != "" {
+			msg += f + ": "
+		}
+		msg += "expected " + describeGoType(goType) + ", got " + describeTag(tag)
+		if value != "" {
+			msg += " " + fmt.Sprintf("%q", value)
+		}
+		msgs = append(msgs, msg)
+	}
+	return fmt.Errorf("%s", strings.Join(msgs, "; "))
+}
+
+// indexFields maps the line of each value node to its dotted field path:
+// scalars preferred in out, and the first list or mapping on the line in
+// containers.
+func indexFields(n *yaml.Node, path string, out, containers map[int]string) {
+	switch n.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, val := n.Content[i], n.Content[i+1]
+			p := key.Value
+			if path != "" {
+				p = path + "." + key.Value
+			}
+			if _, ok := out[val.Line]; !ok || val.Kind == yaml.ScalarNode {
+				out[val.Line] = p
+			}
+			if _, ok := containers[val.Line]; !ok && val.Kind != yaml.ScalarNode {
+				containers[val.Line] = p
+			}
+			indexFields(val, p, out, containers)
+		}
+	case yaml.SequenceNode:
+		for i, c := range n.Content {
+			p := fmt.Sprintf("%s[%d]", path, i)
+			if _, ok := out[c.Line]; !ok || c.Kind == yaml.ScalarNode {
+				out[c.Line] = p
+			}
+			if _, ok := containers[c.Line]; !ok && c.Kind != yaml.ScalarNode {
+				containers[c.Line] = p
+			}
+			indexFields(c, p, out, containers)
+		}
+	}
+}
+
+// describeGoType describes the type yaml.v3 names in a TypeError, e.g.
+// "[]string" or "main.CanaryConfig".
+func describeGoType(t string) string {
+	t = strings.TrimLeft(t, "*")
+	if rt, ok := configTypes()[t]; ok {
+		return describeType(rt)
+	}
+	switch {
+	case strings.HasPrefix(t, "[]"):
+		return "a list"
+	case strings.HasPrefix(t, "map["):
+		return "a mapping"
+	case t == "bool":
+		return "true or false"
+	case t == "string":
+		return "a string"
+	case strings.HasPrefix(t, "int"), strings.HasPrefix(t, "uint"):
+		return "a whole number"
+	case strings.HasPrefix(t, "float"):
+		return "a number"
+	}
+	return t
+}
+
+// describeType describes one of the config's own types by what it is
+// written as.
+func describeType(rt reflect.Type) string {
+	switch rt {
+	case reflect.TypeOf(Duration(0)):
+		return "a duration such as 30s or 1d12h"
+	case reflect.TypeOf(severity(0)):
+		return "a severity (" + strings.Join(severityNames, ", ") + ")"
+	case reflect.TypeOf(auditLogList(nil)):
+		return "a path or a list of paths"
+	}
+	switch rt.Kind() {
+	case reflect.Struct, reflect.Map:
+		return "a mapping"
+	case reflect.Slice, reflect.Array:
+		return "a list"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.String:
+		return "a string"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "a whole number"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	}
+	return rt.String()
+}
+
+var (
+	configTypesOnce   sync.Once
+	configTypesByName map[string]reflect.Type
+)
+
+// configTypes maps the names of the package's types reachable from
+// VaultConfig, e.g. "main.Duration", to the types.
+func configTypes() map[string]reflect.Type {
+	configTypesOnce.Do(func() {
+		configTypesByName = map[string]reflect.Type{}
+		var walk func(rt reflect.Type)
+		walk = func(rt reflect.Type) {
+			if rt.Name() != "" && rt.PkgPath() != "" {
+				if _, seen := configTypesByName[rt.String()]; seen {
+					return
+				}
+				configTypesByName[rt.String()] = rt
+			}
+			switch rt.Kind() {
+			case reflect.Ptr, reflect.Slice, reflect.Array:
+				walk(rt.Elem())
+			case reflect.Map:
+				walk(rt.Key())
+				walk(rt.Elem())
+			case reflect.Struct:
+				for i := 0; i < rt.NumField(); i++ {
+					walk(rt.Field(i).Type)
+				}
+			}
+		}
+		walk(reflect.TypeOf(VaultConfig{}))
+		for _, rt := range []reflect.Type{reflect.TypeOf(severity(0)), reflect.TypeOf(policyList(nil))} {
+			configTypesByName[rt.String()] = rt
+		}
+	})
+	return configTypesByName
+}
+
+func describeTag(tag string) string {
+	switch tag {
+	case "str":
+		return "a string"
+	case "int":
+		return "a whole number"
+	case "float":
+		return "a number"
+	case "bool":
+		return "a boolean"
+	case "seq":
+		return "a list"
+	case "map":
+		return "a mapping"
+	case "null":
+		return "null"
+	}
+	return "!!" + tag
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMalformedConfigs(t *testing.T) {
+	laughs := "a: &a [x, x, x, x, x, x, x, x, x, x]\n"
+	for i, prev := 0, "a"; i < 6; i++ {
+		name := fmt.Sprintf("l%d", i)
+		laughs += fmt.Sprintf("%s: &%s [*%s, *%s, *%s, *%s, *%s, *%s, *%s, *%s, *%s, *%s]\n", name, name, prev, prev, prev, prev, prev, prev, prev, prev, prev, prev)
+		prev = name
+	}
+	deep := "x: " + strings.Repeat("[", maxConfigDepth+2) + strings.Repeat("]", maxConfigDepth+2) + "\n"
+
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"too large", "# " + strings.Repeat("x", maxConfigSize) + "\n", "more than the 1.0 MiB limit"},
+		{"tab indent", "queue:\n\tsize: 10\n", "line 2: indented with a tab; YAML requires spaces"},
+		{"tab after spaces", "queue:\n  \tsize: 10\n", "line 2: indented with a tab"},
+		{"tab after a block scalar", "webhook:\n  body: |\n    {}\nqueue:\n\tsize: 10\n", "line 5: indented with a tab"},
+		{"billion laughs", laughs, "aliases expand to more than 10000 nodes"},
+		{"too deep", deep, fmt.Sprintf("nested more than %d levels deep", maxConfigDepth)},
+		{"not a mapping", "- a\n- b\n", "top level must be a mapping"},
+		{"string for a number", "queue:\n  size: lots\n", `line 2: queue.size: expected a whole number, got a string "lots"`},
+		{"string for a bool", "intake:\n  pause_on_sink_failure: maybe\n", `line 2: intake.pause_on_sink_failure: expected true or false, got a string "maybe"`},
+		{"scalar for a section", "canary: yes\n", `line 1: canary: expected a mapping, got a string "yes"`},
+		{"scalar for a list", "rules: privileged\n", `line 1: rules: expected a list, got a string "privileged"`},
+		{"list for a string", "webhook_url: [a, b]\n", "line 1: webhook_url: expected a string, got a list"},
+		{"bad duration", "queue:\n  drain_timeout: soon\n", `line 2: invalid duration "soon"`},
+		{"unclosed quote", "webhook_url: \"https://x\n", "decode config"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadTestConfig(t, tt.body)
+			if err == nil {
+				t.Fatal("loaded")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v\nwant it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// Tabs are content inside a block scalar, e.g. a webhook body template
+// indented with tabs past its first column.
+func TestTabsInBlockScalars(t *testing.T) {
+	for _, body := range []string{
+		"body: |\n  {\n  \t\"summary\": {{json .Title}}\n  }\n",
+		"body: |-\n    {\n    \t\"a\": 1\n\n    }\nother: x\n",
+		"list:\n  - >\n    folded\n    \twith a tab\n",
+		"body: |2 # explicit indentation\n  \tx\n",
+	} {
+		if err := checkConfigBytes([]byte(body)); err != nil {
+			t.Errorf("checkConfigBytes(%q) = %v, want nil", body, err)
+		}
+	}
+}
+
+func TestTabbedWebhookBodyLoads(t *testing.T) {
+	cfg, err := loadTestConfig(t, `
+address: "http://127.0.0.1:8200"
+notifier: webhook
+webhook_url: "https://a.example/hook"
+unseal_keys: ["k1"]
+webhook:
+  body: |
+    {
+    	"summary": {{json .Title}},
+    	"severity": {{json .Severity}}
+    }
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(cfg.Webhook.Body, "\t\"summary\"") {
+		t.Errorf("body = %q, want its tabs kept", cfg.Webhook.Body)
+	}
+}
+
+func TestDescribeGoType(t *testing.T) {
+	tests := map[string]string{
+		"main.Duration":       "a duration such as 30s or 1d12h",
+		"main.severity":       "a severity (info, warning, critical)",
+		"main.policyList":     "a list",
+		"main.auditLogList":   "a path or a list of paths",
+		"main.CanaryConfig":   "a mapping",
+		"*main.RuleThreshold": "a mapping",
+		"[]main.AlertRule":    "a list",
+		"map[string]string":   "a mapping",
+		"string":              "a string",
+		"int":                 "a whole number",
+		"float64":             "a number",
+		"bool":                "true or false",
+	}
+	for goType, want := range tests {
+		if got := describeGoType(goType); got != want {
+			t.Errorf("describeGoType(%q) = %q, want %q", goType, got, want)
+		}
+	}
+	if rt := configTypes()["main.Duration"]; rt != reflect.TypeOf(Duration(0)) {
+		t.Errorf("configTypes has Duration as %v", rt)
+	}
+}